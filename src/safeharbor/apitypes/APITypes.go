@@ -13,6 +13,9 @@
  *      the design in the slide "API REST Binding". We could use go's built-in
  *		JSON formatting for this, but we do it manually to have better control
  *		of what gets sent.
+ * Object Ids (the "Id" fields, and fields ending in "Id" or "Ids") are opaque
+ * strings: clients must not assume that they are numeric, sequential, or of any
+ * particular length.
  * To do: Define JSON schema for the API. See http://json-schema.org/example2.html.
  *
  * Copyright Scaled Markets, Inc.
@@ -392,10 +395,11 @@ type UserDesc struct {
 	EmailIsVerified bool
 	CanModifyTheseRealms []string  // This reveals too much - this info should
 		// only be available for the user who is authenticated.
+	Locale string  // "" if the user has not chosen one
 }
 
 func NewUserDesc(id, userId, userName, realmId, defaultRepoId, emailAddress string, 
-	emailIsVerified bool, canModRealms []string) *UserDesc {
+	emailIsVerified bool, canModRealms []string, locale string) *UserDesc {
 	return &UserDesc{
 		ResponseType: *NewResponseType(200, "OK", "UserDesc"),
 		Id: id,
@@ -406,6 +410,7 @@ func NewUserDesc(id, userId, userName, realmId, defaultRepoId, emailAddress stri
 		EmailAddress: emailAddress,
 		EmailIsVerified: emailIsVerified,
 		CanModifyTheseRealms: canModRealms,
+		Locale: locale,
 	}
 }
 
@@ -421,7 +426,7 @@ func (userDesc *UserDesc) AsJSON() string {
 		if i > 0 { response = response + ", " }
 		response = response + "\"" + adminRealmId + "\""
 	}
-	response = response + "]}"
+	response = response + fmt.Sprintf("], \"Locale\": \"%s\"}", userDesc.Locale)
 	return response
 }
 
@@ -442,6 +447,582 @@ func (userDescs UserDescs) SendFile() (string, bool) {
 	return "", false
 }
 
+/*******************************************************************************
+ * A user whose account is locked because of repeated failed logins, as returned
+ * by getLockedUsers. LockoutCount is the number of times that the account has
+ * been locked since the user last logged in successfully.
+ */
+type LockedUserDesc struct {
+	ResponseType
+	Id string
+	UserId string
+	UserName string
+	RealmId string
+	LockedUntil time.Time
+	LockoutCount int
+}
+
+func NewLockedUserDesc(id, userId, userName, realmId string, lockedUntil time.Time,
+	lockoutCount int) *LockedUserDesc {
+	return &LockedUserDesc{
+		ResponseType: *NewResponseType(200, "OK", "LockedUserDesc"),
+		Id: id,
+		UserId: userId,
+		UserName: userName,
+		RealmId: realmId,
+		LockedUntil: lockedUntil,
+		LockoutCount: lockoutCount,
+	}
+}
+
+func (desc *LockedUserDesc) AsJSON() string {
+	return fmt.Sprintf(" {%s, \"Id\": \"%s\", \"UserId\": \"%s\", \"Name\": \"%s\", " +
+		"\"RealmId\": \"%s\", \"LockedUntil\": %s, \"LockoutCount\": %d}",
+		desc.responseTypeFieldsAsJSON(), desc.Id, desc.UserId, desc.UserName, desc.RealmId,
+		FormatTimeAsJavascriptDate(desc.LockedUntil), desc.LockoutCount)
+}
+
+type LockedUserDescs []*LockedUserDesc
+
+func (lockedUserDescs LockedUserDescs) AsJSON() string {
+	var response string = " {" + rest.HttpOKResponse() + ", \"payload\": [\n"
+	var firstTime bool = true
+	for _, desc := range lockedUserDescs {
+		if firstTime { firstTime = false } else { response = response + ",\n" }
+		response = response + desc.AsJSON()
+	}
+	response = response + "]}"
+	return response
+}
+
+func (lockedUserDescs LockedUserDescs) SendFile() (string, bool) {
+	return "", false
+}
+
+/*******************************************************************************
+ * Returned by authenticate, instead of a SessionToken, when the user must also
+ * present a second factor: the ChallengeId is then passed to verifySecondFactor.
+ * If EnrollmentRequired, the user's realm requires a second factor that the user
+ * does not yet have, and the ChallengeId may be passed to enrollTOTP and
+ * confirmTOTPEnrollment instead.
+ */
+type SecondFactorChallenge struct {
+	ResponseType
+	ChallengeId string
+	UserId string
+	EnrollmentRequired bool
+}
+
+func NewSecondFactorChallenge(challengeId, userId string,
+	enrollmentRequired bool) *SecondFactorChallenge {
+	return &SecondFactorChallenge{
+		ResponseType: *NewResponseType(200, "OK", "SecondFactorChallenge"),
+		ChallengeId: challengeId,
+		UserId: userId,
+		EnrollmentRequired: enrollmentRequired,
+	}
+}
+
+func (challenge *SecondFactorChallenge) AsJSON() string {
+	return fmt.Sprintf(" {%s, \"ChallengeId\": \"%s\", \"UserId\": \"%s\", " +
+		"\"EnrollmentRequired\": %s}", challenge.responseTypeFieldsAsJSON(),
+		challenge.ChallengeId, challenge.UserId, BoolToString(challenge.EnrollmentRequired))
+}
+
+/*******************************************************************************
+ * The secret of a new TOTP second factor. ProvisioningURI is an otpauth URI;
+ * QRPayload is the text to be encoded as a QR code for an authenticator app to
+ * scan, which is currently the same URI.
+ */
+type TOTPEnrollmentDesc struct {
+	ResponseType
+	UserId string
+	Secret string
+	ProvisioningURI string
+	QRPayload string
+}
+
+func NewTOTPEnrollmentDesc(userId, secret, uri, qrPayload string) *TOTPEnrollmentDesc {
+	return &TOTPEnrollmentDesc{
+		ResponseType: *NewResponseType(200, "OK", "TOTPEnrollmentDesc"),
+		UserId: userId,
+		Secret: secret,
+		ProvisioningURI: uri,
+		QRPayload: qrPayload,
+	}
+}
+
+func (desc *TOTPEnrollmentDesc) AsJSON() string {
+	return fmt.Sprintf(" {%s, \"UserId\": \"%s\", \"Secret\": \"%s\", " +
+		"\"ProvisioningURI\": \"%s\", \"QRPayload\": \"%s\"}", desc.responseTypeFieldsAsJSON(),
+		desc.UserId, desc.Secret, rest.EncodeStringForJSON(desc.ProvisioningURI),
+		rest.EncodeStringForJSON(desc.QRPayload))
+}
+
+/*******************************************************************************
+ * One-time recovery codes for a second factor. The codes are shown only once:
+ * SafeHarbor retains only their hashes.
+ */
+type RecoveryCodesDesc struct {
+	ResponseType
+	UserId string
+	RecoveryCodes []string
+}
+
+func NewRecoveryCodesDesc(userId string, codes []string) *RecoveryCodesDesc {
+	return &RecoveryCodesDesc{
+		ResponseType: *NewResponseType(200, "OK", "RecoveryCodesDesc"),
+		UserId: userId,
+		RecoveryCodes: codes,
+	}
+}
+
+func (desc *RecoveryCodesDesc) AsJSON() string {
+	var s = fmt.Sprintf(" {%s, \"UserId\": \"%s\", \"RecoveryCodes\": [",
+		desc.responseTypeFieldsAsJSON(), desc.UserId)
+	for i, code := range desc.RecoveryCodes {
+		if i > 0 { s = s + ", " }
+		s = s + fmt.Sprintf("\"%s\"", code)
+	}
+	s = s + "]}"
+	return s
+}
+
+/*******************************************************************************
+ * A message in the email outbox of a realm. Status is "pending", "sending", or,
+ * once the outbox has given up on the message, "failed". Messages that have been
+ * sent are no longer in the outbox.
+ */
+type OutboundEmailDesc struct {
+	ResponseType
+	Id string
+	RealmId string
+	Address string
+	Subject string
+	Status string
+	Attempts int
+	NextAttemptTime time.Time
+	LastError string
+	CreationTime time.Time
+}
+
+func NewOutboundEmailDesc(id, realmId, address, subject, status string, attempts int,
+	nextAttemptTime time.Time, lastError string, creationTime time.Time) *OutboundEmailDesc {
+	return &OutboundEmailDesc{
+		ResponseType: *NewResponseType(200, "OK", "OutboundEmailDesc"),
+		Id: id,
+		RealmId: realmId,
+		Address: address,
+		Subject: subject,
+		Status: status,
+		Attempts: attempts,
+		NextAttemptTime: nextAttemptTime,
+		LastError: lastError,
+		CreationTime: creationTime,
+	}
+}
+
+func (desc *OutboundEmailDesc) AsJSON() string {
+	return fmt.Sprintf(" {%s, \"Id\": \"%s\", \"RealmId\": \"%s\", \"Address\": \"%s\", " +
+		"\"Subject\": \"%s\", \"Status\": \"%s\", \"Attempts\": %d, \"NextAttemptTime\": %s, " +
+		"\"LastError\": \"%s\", \"CreationTime\": %s}", desc.responseTypeFieldsAsJSON(),
+		desc.Id, desc.RealmId, rest.EncodeStringForJSON(desc.Address),
+		rest.EncodeStringForJSON(desc.Subject), desc.Status, desc.Attempts,
+		FormatTimeAsJavascriptDate(desc.NextAttemptTime), rest.EncodeStringForJSON(desc.LastError),
+		FormatTimeAsJavascriptDate(desc.CreationTime))
+}
+
+type OutboundEmailDescs []*OutboundEmailDesc
+
+func (outboundEmailDescs OutboundEmailDescs) AsJSON() string {
+	var response string = " {" + rest.HttpOKResponse() + ", \"payload\": [\n"
+	var firstTime bool = true
+	for _, desc := range outboundEmailDescs {
+		if firstTime { firstTime = false } else { response = response + ",\n" }
+		response = response + desc.AsJSON()
+	}
+	response = response + "]}"
+	return response
+}
+
+func (outboundEmailDescs OutboundEmailDescs) SendFile() (string, bool) {
+	return "", false
+}
+
+/*******************************************************************************
+ * A user's subscription to notifications of events that concern a realm, a repo,
+ * or an image.
+ */
+type NotificationSubscriptionDesc struct {
+	ResponseType
+	Id string
+	UserObjId string
+	ResourceId string
+	EventTypes []string
+	CreationTime time.Time
+}
+
+func NewNotificationSubscriptionDesc(id, userObjId, resourceId string, eventTypes []string,
+	creationTime time.Time) *NotificationSubscriptionDesc {
+	return &NotificationSubscriptionDesc{
+		ResponseType: *NewResponseType(200, "OK", "NotificationSubscriptionDesc"),
+		Id: id,
+		UserObjId: userObjId,
+		ResourceId: resourceId,
+		EventTypes: eventTypes,
+		CreationTime: creationTime,
+	}
+}
+
+func (desc *NotificationSubscriptionDesc) AsJSON() string {
+	var s = fmt.Sprintf(" {%s, \"Id\": \"%s\", \"UserObjId\": \"%s\", \"ResourceId\": \"%s\", " +
+		"\"EventTypes\": [", desc.responseTypeFieldsAsJSON(), desc.Id, desc.UserObjId, desc.ResourceId)
+	for i, t := range desc.EventTypes {
+		if i > 0 { s = s + ", " }
+		s = s + fmt.Sprintf("\"%s\"", t)
+	}
+	s = s + fmt.Sprintf("], \"CreationTime\": %s}", FormatTimeAsJavascriptDate(desc.CreationTime))
+	return s
+}
+
+type NotificationSubscriptionDescs []*NotificationSubscriptionDesc
+
+func (subscriptionDescs NotificationSubscriptionDescs) AsJSON() string {
+	var response string = " {" + rest.HttpOKResponse() + ", \"payload\": [\n"
+	var firstTime bool = true
+	for _, desc := range subscriptionDescs {
+		if firstTime { firstTime = false } else { response = response + ",\n" }
+		response = response + desc.AsJSON()
+	}
+	response = response + "]}"
+	return response
+}
+
+func (subscriptionDescs NotificationSubscriptionDescs) SendFile() (string, bool) {
+	return "", false
+}
+
+/*******************************************************************************
+ * An in-app notification of an event, for the user who is retrieving it.
+ */
+type NotificationDesc struct {
+	ResponseType
+	Id string
+	EventType string
+	ResourceId string
+	Subject string
+	Message string
+	IsRead bool
+	CreationTime time.Time
+}
+
+func NewNotificationDesc(id, eventType, resourceId, subject, message string, isRead bool,
+	creationTime time.Time) *NotificationDesc {
+	return &NotificationDesc{
+		ResponseType: *NewResponseType(200, "OK", "NotificationDesc"),
+		Id: id,
+		EventType: eventType,
+		ResourceId: resourceId,
+		Subject: subject,
+		Message: message,
+		IsRead: isRead,
+		CreationTime: creationTime,
+	}
+}
+
+func (desc *NotificationDesc) AsJSON() string {
+	return fmt.Sprintf(" {%s, \"Id\": \"%s\", \"EventType\": \"%s\", \"ResourceId\": \"%s\", " +
+		"\"Subject\": \"%s\", \"Message\": \"%s\", \"IsRead\": %s, \"CreationTime\": %s}",
+		desc.responseTypeFieldsAsJSON(), desc.Id, desc.EventType, desc.ResourceId,
+		rest.EncodeStringForJSON(desc.Subject), rest.EncodeStringForJSON(desc.Message),
+		BoolToString(desc.IsRead), FormatTimeAsJavascriptDate(desc.CreationTime))
+}
+
+type NotificationDescs []*NotificationDesc
+
+func (notificationDescs NotificationDescs) AsJSON() string {
+	var response string = " {" + rest.HttpOKResponse() + ", \"payload\": [\n"
+	var firstTime bool = true
+	for _, desc := range notificationDescs {
+		if firstTime { firstTime = false } else { response = response + ",\n" }
+		response = response + desc.AsJSON()
+	}
+	response = response + "]}"
+	return response
+}
+
+func (notificationDescs NotificationDescs) SendFile() (string, bool) {
+	return "", false
+}
+
+/*******************************************************************************
+ * How a user receives notifications. EmailNotifications is "immediate", "digest"
+ * (once a day), or "never". Quiet hours, during which no notification email is
+ * sent, are given as HH:MM in the user's time zone; they are "" if the user has
+ * none.
+ */
+type NotificationPreferencesDesc struct {
+	ResponseType
+	UserObjId string
+	EmailNotifications string
+	InAppNotifications bool
+	QuietHoursStart string
+	QuietHoursEnd string
+	TimeZone string
+}
+
+func NewNotificationPreferencesDesc(userObjId, emailNotifications string, inAppNotifications bool,
+	quietHoursStart, quietHoursEnd, timeZone string) *NotificationPreferencesDesc {
+	return &NotificationPreferencesDesc{
+		ResponseType: *NewResponseType(200, "OK", "NotificationPreferencesDesc"),
+		UserObjId: userObjId,
+		EmailNotifications: emailNotifications,
+		InAppNotifications: inAppNotifications,
+		QuietHoursStart: quietHoursStart,
+		QuietHoursEnd: quietHoursEnd,
+		TimeZone: timeZone,
+	}
+}
+
+func (desc *NotificationPreferencesDesc) AsJSON() string {
+	return fmt.Sprintf(" {%s, \"UserObjId\": \"%s\", \"EmailNotifications\": \"%s\", " +
+		"\"InAppNotifications\": %s, \"QuietHoursStart\": \"%s\", \"QuietHoursEnd\": \"%s\", " +
+		"\"TimeZone\": \"%s\"}", desc.responseTypeFieldsAsJSON(), desc.UserObjId,
+		desc.EmailNotifications, BoolToString(desc.InAppNotifications), desc.QuietHoursStart,
+		desc.QuietHoursEnd, rest.EncodeStringForJSON(desc.TimeZone))
+}
+
+/*******************************************************************************
+ * A URL to which events pertaining to a realm or repo are posted. EventTypes is
+ * empty if every type of event is posted. Secret, with which each post is signed,
+ * is "" except in the response to the request that registers the hook.
+ */
+type WebhookDesc struct {
+	ResponseType
+	Id string
+	RealmId string
+	ResourceId string
+	URL string
+	Secret string
+	EventTypes []string
+	CreatorId string
+	CreationTime time.Time
+}
+
+func NewWebhookDesc(id, realmId, resourceId, url, secret string, eventTypes []string,
+	creatorId string, creationTime time.Time) *WebhookDesc {
+	return &WebhookDesc{
+		ResponseType: *NewResponseType(200, "OK", "WebhookDesc"),
+		Id: id,
+		RealmId: realmId,
+		ResourceId: resourceId,
+		URL: url,
+		Secret: secret,
+		EventTypes: eventTypes,
+		CreatorId: creatorId,
+		CreationTime: creationTime,
+	}
+}
+
+func (desc *WebhookDesc) AsJSON() string {
+	var s = fmt.Sprintf(" {%s, \"Id\": \"%s\", \"RealmId\": \"%s\", \"ResourceId\": \"%s\", " +
+		"\"URL\": \"%s\", \"Secret\": \"%s\", \"EventTypes\": [", desc.responseTypeFieldsAsJSON(),
+		desc.Id, desc.RealmId, desc.ResourceId, rest.EncodeStringForJSON(desc.URL),
+		rest.EncodeStringForJSON(desc.Secret))
+	for i, t := range desc.EventTypes {
+		if i > 0 { s = s + ", " }
+		s = s + fmt.Sprintf("\"%s\"", t)
+	}
+	s = s + fmt.Sprintf("], \"CreatorId\": \"%s\", \"CreationTime\": %s}", desc.CreatorId,
+		FormatTimeAsJavascriptDate(desc.CreationTime))
+	return s
+}
+
+type WebhookDescs []*WebhookDesc
+
+func (webhookDescs WebhookDescs) AsJSON() string {
+	var response string = " {" + rest.HttpOKResponse() + ", \"payload\": [\n"
+	var firstTime bool = true
+	for _, desc := range webhookDescs {
+		if firstTime { firstTime = false } else { response = response + ",\n" }
+		response = response + desc.AsJSON()
+	}
+	response = response + "]}"
+	return response
+}
+
+func (webhookDescs WebhookDescs) SendFile() (string, bool) {
+	return "", false
+}
+
+/*******************************************************************************
+ * One post of an event to a webhook. Status is "pending", "sending", "delivered",
+ * or "failed". ResponseStatus is the HTTP status of the most recent attempt, or 0
+ * if no response was received; LastError describes why that attempt failed.
+ * Payload is the JSON body of the post.
+ */
+type WebhookDeliveryDesc struct {
+	ResponseType
+	Id string
+	WebhookId string
+	EventType string
+	Payload string
+	Status string
+	Attempts int
+	NextAttemptTime time.Time
+	ResponseStatus int
+	LastError string
+	CreationTime time.Time
+	CompletionTime time.Time
+}
+
+func NewWebhookDeliveryDesc(id, webhookId, eventType, payload, status string, attempts int,
+	nextAttemptTime time.Time, responseStatus int, lastError string,
+	creationTime, completionTime time.Time) *WebhookDeliveryDesc {
+	return &WebhookDeliveryDesc{
+		ResponseType: *NewResponseType(200, "OK", "WebhookDeliveryDesc"),
+		Id: id,
+		WebhookId: webhookId,
+		EventType: eventType,
+		Payload: payload,
+		Status: status,
+		Attempts: attempts,
+		NextAttemptTime: nextAttemptTime,
+		ResponseStatus: responseStatus,
+		LastError: lastError,
+		CreationTime: creationTime,
+		CompletionTime: completionTime,
+	}
+}
+
+func (desc *WebhookDeliveryDesc) AsJSON() string {
+	return fmt.Sprintf(" {%s, \"Id\": \"%s\", \"WebhookId\": \"%s\", \"EventType\": \"%s\", " +
+		"\"Payload\": \"%s\", \"Status\": \"%s\", \"Attempts\": %d, \"NextAttemptTime\": %s, " +
+		"\"ResponseStatus\": %d, \"LastError\": \"%s\", \"CreationTime\": %s, \"CompletionTime\": %s}",
+		desc.responseTypeFieldsAsJSON(), desc.Id, desc.WebhookId, desc.EventType,
+		rest.EncodeStringForJSON(desc.Payload), desc.Status, desc.Attempts,
+		FormatTimeAsJavascriptDate(desc.NextAttemptTime), desc.ResponseStatus,
+		rest.EncodeStringForJSON(desc.LastError), FormatTimeAsJavascriptDate(desc.CreationTime),
+		FormatTimeAsJavascriptDate(desc.CompletionTime))
+}
+
+type WebhookDeliveryDescs []*WebhookDeliveryDesc
+
+func (deliveryDescs WebhookDeliveryDescs) AsJSON() string {
+	var response string = " {" + rest.HttpOKResponse() + ", \"payload\": [\n"
+	var firstTime bool = true
+	for _, desc := range deliveryDescs {
+		if firstTime { firstTime = false } else { response = response + ",\n" }
+		response = response + desc.AsJSON()
+	}
+	response = response + "]}"
+	return response
+}
+
+func (deliveryDescs WebhookDeliveryDescs) SendFile() (string, bool) {
+	return "", false
+}
+
+/*******************************************************************************
+ * A schedule on which an image, or each image in a repo, is rescanned. Schedule
+ * is a cron expression, evaluated in TimeZone ("" for UTC). If AllVersions is
+ * false, only the most recent version of each image is rescanned. NextRunTime is
+ * zero if the schedule will not run again; LastRunTime is zero if it has not run.
+ */
+type ScanScheduleDesc struct {
+	ResponseType
+	Id string
+	RealmId string
+	ResourceId string
+	Schedule string
+	TimeZone string
+	AllVersions bool
+	CreatorId string
+	CreationTime time.Time
+	NextRunTime time.Time
+	LastRunTime time.Time
+}
+
+func NewScanScheduleDesc(id, realmId, resourceId, schedule, timeZone string, allVersions bool,
+	creatorId string, creationTime, nextRunTime, lastRunTime time.Time) *ScanScheduleDesc {
+	return &ScanScheduleDesc{
+		ResponseType: *NewResponseType(200, "OK", "ScanScheduleDesc"),
+		Id: id,
+		RealmId: realmId,
+		ResourceId: resourceId,
+		Schedule: schedule,
+		TimeZone: timeZone,
+		AllVersions: allVersions,
+		CreatorId: creatorId,
+		CreationTime: creationTime,
+		NextRunTime: nextRunTime,
+		LastRunTime: lastRunTime,
+	}
+}
+
+func (desc *ScanScheduleDesc) AsJSON() string {
+	return fmt.Sprintf(" {%s, \"Id\": \"%s\", \"RealmId\": \"%s\", \"ResourceId\": \"%s\", " +
+		"\"Schedule\": \"%s\", \"TimeZone\": \"%s\", \"AllVersions\": %t, \"CreatorId\": \"%s\", " +
+		"\"CreationTime\": %s, \"NextRunTime\": %s, \"LastRunTime\": %s}",
+		desc.responseTypeFieldsAsJSON(), desc.Id, desc.RealmId, desc.ResourceId,
+		rest.EncodeStringForJSON(desc.Schedule), rest.EncodeStringForJSON(desc.TimeZone),
+		desc.AllVersions, desc.CreatorId, FormatTimeAsJavascriptDate(desc.CreationTime),
+		FormatTimeAsJavascriptDate(desc.NextRunTime), FormatTimeAsJavascriptDate(desc.LastRunTime))
+}
+
+type ScanScheduleDescs []*ScanScheduleDesc
+
+func (scheduleDescs ScanScheduleDescs) AsJSON() string {
+	var response string = " {" + rest.HttpOKResponse() + ", \"payload\": [\n"
+	var firstTime bool = true
+	for _, desc := range scheduleDescs {
+		if firstTime { firstTime = false } else { response = response + ",\n" }
+		response = response + desc.AsJSON()
+	}
+	response = response + "]}"
+	return response
+}
+
+func (scheduleDescs ScanScheduleDescs) SendFile() (string, bool) {
+	return "", false
+}
+
+/*******************************************************************************
+ * An email message rendered from one of the system email templates, with sample
+ * values for its variables, so that an administrator can check the templates
+ * that apply to a realm and locale.
+ */
+type EmailPreviewDesc struct {
+	ResponseType
+	TemplateName string
+	RealmId string
+	Locale string
+	Subject string
+	TextMessage string
+	HTMLMessage string
+}
+
+func NewEmailPreviewDesc(templateName, realmId, locale, subject, textMessage,
+	htmlMessage string) *EmailPreviewDesc {
+	return &EmailPreviewDesc{
+		ResponseType: *NewResponseType(200, "OK", "EmailPreviewDesc"),
+		TemplateName: templateName,
+		RealmId: realmId,
+		Locale: locale,
+		Subject: subject,
+		TextMessage: textMessage,
+		HTMLMessage: htmlMessage,
+	}
+}
+
+func (desc *EmailPreviewDesc) AsJSON() string {
+	return fmt.Sprintf(" {%s, \"TemplateName\": \"%s\", \"RealmId\": \"%s\", " +
+		"\"Locale\": \"%s\", \"Subject\": \"%s\", \"TextMessage\": \"%s\", " +
+		"\"HTMLMessage\": \"%s\"}", desc.responseTypeFieldsAsJSON(),
+		desc.TemplateName, desc.RealmId, desc.Locale, rest.EncodeStringForJSON(desc.Subject),
+		rest.EncodeStringForJSON(desc.TextMessage), rest.EncodeStringForJSON(desc.HTMLMessage))
+}
+
 /*******************************************************************************
  * 
  */
@@ -860,8 +1441,12 @@ func (versionDesc *DockerImageVersionDesc) AsJSON() string {
 		if i > 0 { json = json + ", " }
 		json = json + fmt.Sprintf("\"%s\"", id)
 	}
-	json = json + fmt.Sprintf("], \"ParsedDockerBuildOutput\": %s}",
-		versionDesc.ParsedDockerBuildOutput.AsJSON())
+	// A version that was pushed to the registry, rather than built, has no build output.
+	var parsedOutputJSON = "null"
+	if versionDesc.ParsedDockerBuildOutput != nil {
+		parsedOutputJSON = versionDesc.ParsedDockerBuildOutput.AsJSON()
+	}
+	json = json + fmt.Sprintf("], \"ParsedDockerBuildOutput\": %s}", parsedOutputJSON)
 	return json
 }
 
@@ -919,7 +1504,9 @@ func (mask *PermissionMask) AsJSON() string {
 }
 
 /*******************************************************************************
- * 
+ * DenyMask lists the access modes that the ACL entry explicitly denies. A denial
+ * overrides any grant of the same mode that the party would otherwise inherit
+ * from a containing resource.
  */
 type PermissionDesc struct {
 	ResponseType
@@ -927,10 +1514,18 @@ type PermissionDesc struct {
 	ACLEntryId string
 	ResourceId string
 	PartyId string
+	DenyMask []bool
+	RoleName string  // "" if no role was assigned
+	ExpiresAt string  // as JSON: a date, or "" if the permission does not expire
+	InvitationId string  // "" unless the permission was granted across realms
 }
 
 func NewPermissionDesc(aclEntryId string, resourceId string, partyId string,
-	permissionMask []bool) *PermissionDesc {
+	permissionMask []bool, denyMask []bool, roleName string, expiresAt time.Time,
+	invitationId string) *PermissionDesc {
+	
+	var expiry = "\"\""
+	if ! expiresAt.IsZero() { expiry = FormatTimeAsJavascriptDate(expiresAt) }
 
 	return &PermissionDesc{
 		ResponseType: *NewResponseType(200, "OK", "PermissionDesc"),
@@ -938,19 +1533,181 @@ func NewPermissionDesc(aclEntryId string, resourceId string, partyId string,
 		ResourceId: resourceId,
 		PartyId: partyId,
 		PermissionMask: PermissionMask{Mask: permissionMask},
+		DenyMask: denyMask,
+		RoleName: roleName,
+		ExpiresAt: expiry,
+		InvitationId: invitationId,
 	}
 }
 
 func (desc *PermissionDesc) AsJSON() string {
 	return fmt.Sprintf(
-		" {%s, \"ACLEntryId\": \"%s\", \"ResourceId\": \"%s\", \"PartyId\": \"%s\", " +
-		"\"CanCreateIn\": %s, \"CanRead\": %s, \"CanWrite\": %s, \"CanExecute\": %s, \"CanDelete\": %s}",
+		" {%s, \"ACLEntryId\": \"%s\", \"ResourceId\": \"%s\", \"PartyId\": \"%s\", \"Role\": \"%s\", \"ExpiresAt\": %s, " +
+		"\"CrossRealm\": %s, \"InvitationId\": \"%s\", " +
+		"\"CanCreateIn\": %s, \"CanRead\": %s, \"CanWrite\": %s, \"CanExecute\": %s, \"CanDelete\": %s, " +
+		"\"DenyCreateIn\": %s, \"DenyRead\": %s, \"DenyWrite\": %s, \"DenyExecute\": %s, \"DenyDelete\": %s}",
 		desc.responseTypeFieldsAsJSON(), desc.ACLEntryId, desc.ResourceId, desc.PartyId,
+		desc.RoleName, desc.ExpiresAt, BoolToString(desc.InvitationId != ""), desc.InvitationId,
+		BoolToString(desc.CanCreateIn()), BoolToString(desc.CanRead()),
+		BoolToString(desc.CanWrite()), BoolToString(desc.CanExecute()),
+		BoolToString(desc.CanDelete()),
+		BoolToString(desc.denies(CanCreateIn)), BoolToString(desc.denies(CanRead)),
+		BoolToString(desc.denies(CanWrite)), BoolToString(desc.denies(CanExecute)),
+		BoolToString(desc.denies(CanDelete)))
+}
+
+func (desc *PermissionDesc) denies(mode uint) bool {
+	return (int(mode) < len(desc.DenyMask)) && desc.DenyMask[mode]
+}
+
+/*******************************************************************************
+ * An invitation to a party of another realm to access a resource. Status is one
+ * of pending, accepted, rejected, or revoked.
+ */
+type InvitationDesc struct {
+	ResponseType
+	PermissionMask
+	Id string
+	ResourceId string
+	InvitingRealmId string
+	InviterId string
+	InviteeRealmId string
+	InviteePartyId string  // "" until accepted
+	InviteeUserId string
+	InviteeEmail string
+	InviteeGroupName string
+	Status string
+	ACLEntryId string
+	CreationDate string
+}
+
+func NewInvitationDesc(id, resourceId, invitingRealmId, inviterId, inviteeRealmId,
+	inviteePartyId, inviteeUserId, inviteeEmail, inviteeGroupName string, mask []bool,
+	status, aclEntryId string, creationTime time.Time) *InvitationDesc {
+
+	return &InvitationDesc{
+		ResponseType: *NewResponseType(200, "OK", "InvitationDesc"),
+		PermissionMask: PermissionMask{Mask: mask},
+		Id: id,
+		ResourceId: resourceId,
+		InvitingRealmId: invitingRealmId,
+		InviterId: inviterId,
+		InviteeRealmId: inviteeRealmId,
+		InviteePartyId: inviteePartyId,
+		InviteeUserId: inviteeUserId,
+		InviteeEmail: inviteeEmail,
+		InviteeGroupName: inviteeGroupName,
+		Status: status,
+		ACLEntryId: aclEntryId,
+		CreationDate: FormatTimeAsJavascriptDate(creationTime),
+	}
+}
+
+func (desc *InvitationDesc) AsJSON() string {
+	return fmt.Sprintf(" {%s, \"Id\": \"%s\", \"ResourceId\": \"%s\", \"InvitingRealmId\": \"%s\", " +
+		"\"InviterId\": \"%s\", \"InviteeRealmId\": \"%s\", \"InviteePartyId\": \"%s\", " +
+		"\"InviteeUserId\": \"%s\", \"InviteeEmail\": \"%s\", \"InviteeGroupName\": \"%s\", " +
+		"\"Status\": \"%s\", \"ACLEntryId\": \"%s\", \"CreationDate\": %s, " +
+		"\"CanCreateIn\": %s, \"CanRead\": %s, \"CanWrite\": %s, \"CanExecute\": %s, \"CanDelete\": %s}",
+		desc.responseTypeFieldsAsJSON(), desc.Id, desc.ResourceId, desc.InvitingRealmId,
+		desc.InviterId, desc.InviteeRealmId, desc.InviteePartyId,
+		desc.InviteeUserId, desc.InviteeEmail, desc.InviteeGroupName,
+		desc.Status, desc.ACLEntryId, desc.CreationDate,
 		BoolToString(desc.CanCreateIn()), BoolToString(desc.CanRead()),
 		BoolToString(desc.CanWrite()), BoolToString(desc.CanExecute()),
 		BoolToString(desc.CanDelete()))
 }
 
+type InvitationDescs []*InvitationDesc
+
+func (invitationDescs InvitationDescs) AsJSON() string {
+	var response string = " {" + rest.HttpOKResponse() + ", \"payload\": [\n"
+	var firstTime bool = true
+	for _, desc := range invitationDescs {
+		if firstTime { firstTime = false } else { response = response + ",\n" }
+		response = response + desc.AsJSON()
+	}
+	response = response + "]}"
+	return response
+}
+
+func (invitationDescs InvitationDescs) SendFile() (string, bool) {
+	return "", false
+}
+
+type PermissionDescs []*PermissionDesc
+
+func (permissionDescs PermissionDescs) AsJSON() string {
+	var response string = " {" + rest.HttpOKResponse() + ", \"payload\": [\n"
+	var firstTime bool = true
+	for _, desc := range permissionDescs {
+		if firstTime { firstTime = false } else { response = response + ",\n" }
+		response = response + desc.AsJSON()
+	}
+	response = response + "]}"
+	return response
+}
+
+func (permissionDescs PermissionDescs) SendFile() (string, bool) {
+	return "", false
+}
+
+/*******************************************************************************
+ * A named set of access modes. RealmId and Id are "" for a built-in role.
+ */
+type RoleDesc struct {
+	ResponseType
+	PermissionMask
+	Id string
+	RealmId string
+	RoleName string
+	Description string
+	NumberOfAssignments int
+}
+
+func NewRoleDesc(id, realmId, name, desc string, permissionMask []bool,
+	numberOfAssignments int) *RoleDesc {
+
+	return &RoleDesc{
+		ResponseType: *NewResponseType(200, "OK", "RoleDesc"),
+		PermissionMask: PermissionMask{Mask: permissionMask},
+		Id: id,
+		RealmId: realmId,
+		RoleName: name,
+		Description: desc,
+		NumberOfAssignments: numberOfAssignments,
+	}
+}
+
+func (desc *RoleDesc) AsJSON() string {
+	return fmt.Sprintf(
+		" {%s, \"Id\": \"%s\", \"RealmId\": \"%s\", \"RoleName\": \"%s\", " +
+		"\"Description\": \"%s\", \"IsBuiltIn\": %s, \"NumberOfAssignments\": %d, " +
+		"\"CanCreateIn\": %s, \"CanRead\": %s, \"CanWrite\": %s, \"CanExecute\": %s, \"CanDelete\": %s}",
+		desc.responseTypeFieldsAsJSON(), desc.Id, desc.RealmId, desc.RoleName,
+		desc.Description, BoolToString(desc.RealmId == ""), desc.NumberOfAssignments,
+		BoolToString(desc.CanCreateIn()), BoolToString(desc.CanRead()),
+		BoolToString(desc.CanWrite()), BoolToString(desc.CanExecute()),
+		BoolToString(desc.CanDelete()))
+}
+
+type RoleDescs []*RoleDesc
+
+func (roleDescs RoleDescs) AsJSON() string {
+	var response string = " {" + rest.HttpOKResponse() + ", \"payload\": [\n"
+	var firstTime bool = true
+	for _, desc := range roleDescs {
+		if firstTime { firstTime = false } else { response = response + ",\n" }
+		response = response + desc.AsJSON()
+	}
+	response = response + "]}"
+	return response
+}
+
+func (roleDescs RoleDescs) SendFile() (string, bool) {
+	return "", false
+}
+
 /*******************************************************************************
  * 
  */
@@ -1217,6 +1974,42 @@ func (eventDescs ScanEventDescs) SendFile() (string, bool) {
 	return "", false
 }
 
+/*******************************************************************************
+ * Records that an ACL entry expired and was deleted. The mask is that which the
+ * entry granted.
+ */
+type ACLEntryExpiryEventDesc struct {
+	EventDescBase
+	ResourceId string
+	PartyId string
+	PermissionMask []bool
+}
+
+func NewACLEntryExpiryEventDesc(objId string, when time.Time, userObjId string,
+	resourceId, partyId string, mask []bool) *ACLEntryExpiryEventDesc {
+
+	return &ACLEntryExpiryEventDesc{
+		EventDescBase: *NewEventDesc("ACLEntryExpiryEventDesc", objId, when, userObjId),
+		ResourceId: resourceId,
+		PartyId: partyId,
+		PermissionMask: mask,
+	}
+}
+
+func (eventDesc *ACLEntryExpiryEventDesc) AsJSON() string {
+	var s = fmt.Sprintf(" {%s, \"Id\": \"%s\", \"When\": %s, \"UserObjId\": \"%s\", " +
+		"\"ResourceId\": \"%s\", \"PartyId\": \"%s\", \"PermissionMask\": [",
+		eventDesc.responseTypeFieldsAsJSON(),
+		eventDesc.EventId, eventDesc.When, eventDesc.UserObjId,
+		eventDesc.ResourceId, eventDesc.PartyId)
+	for i, b := range eventDesc.PermissionMask {
+		if i > 0 { s = s + ", " }
+		s = s + BoolToString(b)
+	}
+	s = s + "]}"
+	return s
+}
+
 /*******************************************************************************
  * 
  */
@@ -1259,6 +2052,291 @@ func (eventDesc *DockerfileExecEventDesc) AsJSON() string {
 	return s
 }
 
+/*******************************************************************************
+ * Records that an image version was pushed to the registry, rather than built by
+ * SafeHarbor. Repository and Tag are as the registry reported them; Digest is
+ * the digest of the image's manifest.
+ */
+type ImageUploadEventDesc struct {
+	EventDescBase
+	ImageVersionObjId string
+	Repository string
+	Tag string
+	Digest string
+	RegistryEventId string
+}
+
+func NewImageUploadEventDesc(objId string, when time.Time, userId string,
+	imageVersionObjId, repository, tag, digest, registryEventId string) *ImageUploadEventDesc {
+
+	return &ImageUploadEventDesc{
+		EventDescBase: *NewEventDesc("ImageUploadEventDesc", objId, when, userId),
+		ImageVersionObjId: imageVersionObjId,
+		Repository: repository,
+		Tag: tag,
+		Digest: digest,
+		RegistryEventId: registryEventId,
+	}
+}
+
+func (eventDesc *ImageUploadEventDesc) AsJSON() string {
+	return fmt.Sprintf(" {%s, \"Id\": \"%s\", \"When\": %s, \"UserObjId\": \"%s\", " +
+		"\"ImageVersionObjId\": \"%s\", \"Repository\": \"%s\", \"Tag\": \"%s\", " +
+		"\"Digest\": \"%s\", \"RegistryEventId\": \"%s\"}", eventDesc.responseTypeFieldsAsJSON(),
+		eventDesc.EventId, eventDesc.When, eventDesc.UserObjId, eventDesc.ImageVersionObjId,
+		rest.EncodeStringForJSON(eventDesc.Repository), rest.EncodeStringForJSON(eventDesc.Tag),
+		rest.EncodeStringForJSON(eventDesc.Digest), rest.EncodeStringForJSON(eventDesc.RegistryEventId))
+}
+
+
+/*******************************************************************************
+ * 
+ */
+type ObjectCacheStatsDesc struct {
+	ResponseType
+	Enabled bool
+	Hits int64
+	Misses int64
+	Evictions int64
+	Invalidations int64
+	Size int
+}
+
+func NewObjectCacheStatsDesc(enabled bool, hits, misses, evictions, invalidations int64,
+	size int) *ObjectCacheStatsDesc {
+	return &ObjectCacheStatsDesc{
+		ResponseType: *NewResponseType(200, "OK", "ObjectCacheStatsDesc"),
+		Enabled: enabled,
+		Hits: hits,
+		Misses: misses,
+		Evictions: evictions,
+		Invalidations: invalidations,
+		Size: size,
+	}
+}
+
+func (desc *ObjectCacheStatsDesc) AsJSON() string {
+	return fmt.Sprintf(" {%s, \"Enabled\": %s, \"Hits\": %d, \"Misses\": %d, " +
+		"\"Evictions\": %d, \"Invalidations\": %d, \"Size\": %d}",
+		desc.responseTypeFieldsAsJSON(), BoolToString(desc.Enabled),
+		desc.Hits, desc.Misses, desc.Evictions, desc.Invalidations, desc.Size)
+}
+
+
+/*******************************************************************************
+ * The explanation of an access decision, as returned by explainAccess. Parties
+ * lists the party and each group that it belongs to, and Steps lists the
+ * resources whose ACL entries were considered, from the realm down to the
+ * resource itself.
+ */
+type AccessExplanationDesc struct {
+	ResponseType
+	PartyId string
+	ResourceId string
+	Action string
+	Granted bool
+	Reason string
+	Parties []*PartyMembershipDesc
+	Steps []*AccessStepDesc
+}
+
+func NewAccessExplanationDesc(partyId, resourceId, action string, granted bool,
+	reason string, parties []*PartyMembershipDesc, steps []*AccessStepDesc) *AccessExplanationDesc {
+	return &AccessExplanationDesc{
+		ResponseType: *NewResponseType(200, "OK", "AccessExplanationDesc"),
+		PartyId: partyId,
+		ResourceId: resourceId,
+		Action: action,
+		Granted: granted,
+		Reason: reason,
+		Parties: parties,
+		Steps: steps,
+	}
+}
+
+func (desc *AccessExplanationDesc) AsJSON() string {
+	var s = fmt.Sprintf(" {%s, \"PartyId\": \"%s\", \"ResourceId\": \"%s\", " +
+		"\"Action\": \"%s\", \"Granted\": %s, \"Reason\": \"%s\", \"Parties\": [",
+		desc.responseTypeFieldsAsJSON(), desc.PartyId, desc.ResourceId, desc.Action,
+		BoolToString(desc.Granted), rest.EncodeStringForJSON(desc.Reason))
+	for i, partyDesc := range desc.Parties {
+		if i > 0 { s = s + "," }
+		s = s + partyDesc.AsJSON()
+	}
+	s = s + "], \"Steps\": ["
+	for i, stepDesc := range desc.Steps {
+		if i > 0 { s = s + ",\n" }
+		s = s + stepDesc.AsJSON()
+	}
+	s = s + "]}"
+	return s
+}
+
+/*******************************************************************************
+ * A party whose ACL entries apply to the party being explained. Via lists the
+ * Ids of the groups through which the explained party belongs to this party,
+ * nearest first; it is empty for the explained party itself and for the groups
+ * that it belongs to directly.
+ */
+type PartyMembershipDesc struct {
+	PartyId string
+	PartyName string
+	Via []string
+}
+
+func NewPartyMembershipDesc(partyId, partyName string, via []string) *PartyMembershipDesc {
+	return &PartyMembershipDesc{
+		PartyId: partyId,
+		PartyName: partyName,
+		Via: via,
+	}
+}
+
+func (desc *PartyMembershipDesc) AsJSON() string {
+	var s = fmt.Sprintf(" {\"PartyId\": \"%s\", \"PartyName\": \"%s\", \"Via\": [",
+		desc.PartyId, rest.EncodeStringForJSON(desc.PartyName))
+	for i, id := range desc.Via {
+		if i > 0 { s = s + ", " }
+		s = s + fmt.Sprintf("\"%s\"", id)
+	}
+	s = s + "]}"
+	return s
+}
+
+/*******************************************************************************
+ * The ACL entries that apply at one level of the resource hierarchy, and their
+ * effect on the action: Outcome is "denied" or "granted" if an entry denies or
+ * grants the action, or "inherited" if none does. Allowed is the resulting
+ * decision at this level.
+ */
+type AccessStepDesc struct {
+	ResourceId string
+	ResourceName string
+	Entries []*PermissionDesc
+	Outcome string
+	Allowed bool
+}
+
+func NewAccessStepDesc(resourceId, resourceName string, entries []*PermissionDesc,
+	outcome string, allowed bool) *AccessStepDesc {
+	return &AccessStepDesc{
+		ResourceId: resourceId,
+		ResourceName: resourceName,
+		Entries: entries,
+		Outcome: outcome,
+		Allowed: allowed,
+	}
+}
+
+func (desc *AccessStepDesc) AsJSON() string {
+	var s = fmt.Sprintf(" {\"ResourceId\": \"%s\", \"ResourceName\": \"%s\", " +
+		"\"Outcome\": \"%s\", \"Allowed\": %s, \"Entries\": [",
+		desc.ResourceId, rest.EncodeStringForJSON(desc.ResourceName), desc.Outcome,
+		BoolToString(desc.Allowed))
+	for i, entryDesc := range desc.Entries {
+		if i > 0 { s = s + "," }
+		s = s + entryDesc.AsJSON()
+	}
+	s = s + "]}"
+	return s
+}
+
+/*******************************************************************************
+ * A party that has at least one access mode for a resource, taking account of
+ * group membership, inheritance, and denials.
+ */
+type PartyAccessDesc struct {
+	ResponseType
+	PermissionMask
+	PartyId string
+	PartyName string
+	IsGroup bool
+}
+
+func NewPartyAccessDesc(partyId, partyName string, isGroup bool, mask []bool) *PartyAccessDesc {
+	return &PartyAccessDesc{
+		ResponseType: *NewResponseType(200, "OK", "PartyAccessDesc"),
+		PermissionMask: PermissionMask{Mask: mask},
+		PartyId: partyId,
+		PartyName: partyName,
+		IsGroup: isGroup,
+	}
+}
+
+func (desc *PartyAccessDesc) AsJSON() string {
+	return fmt.Sprintf(" {%s, \"PartyId\": \"%s\", \"PartyName\": \"%s\", \"IsGroup\": %s, " +
+		"\"CanCreateIn\": %s, \"CanRead\": %s, \"CanWrite\": %s, \"CanExecute\": %s, \"CanDelete\": %s}",
+		desc.responseTypeFieldsAsJSON(), desc.PartyId, rest.EncodeStringForJSON(desc.PartyName),
+		BoolToString(desc.IsGroup),
+		BoolToString(desc.CanCreateIn()), BoolToString(desc.CanRead()),
+		BoolToString(desc.CanWrite()), BoolToString(desc.CanExecute()),
+		BoolToString(desc.CanDelete()))
+}
+
+type PartyAccessDescs []*PartyAccessDesc
+
+func (partyDescs PartyAccessDescs) AsJSON() string {
+	var response string = " {" + rest.HttpOKResponse() + ", \"payload\": [\n"
+	var firstTime bool = true
+	for _, desc := range partyDescs {
+		if firstTime { firstTime = false } else { response = response + ",\n" }
+		response = response + desc.AsJSON()
+	}
+	response = response + "]}"
+	return response
+}
+
+func (partyDescs PartyAccessDescs) SendFile() (string, bool) {
+	return "", false
+}
+
+/*******************************************************************************
+ * A realm's consumption of each resource that is subject to a quota, and the
+ * quota itself. A limit of zero means that the resource is unlimited.
+ */
+type RealmUsageDesc struct {
+	ResponseType
+	RealmId string
+	Repos int
+	MaxRepos int
+	Images int
+	MaxImages int
+	ImageVersions int
+	MaxImageVersions int
+	StoredBytes int64
+	MaxStoredBytes int64
+	ScansToday int
+	MaxScansPerDay int
+}
+
+func NewRealmUsageDesc(realmId string, repos, maxRepos, images, maxImages,
+	imageVersions, maxImageVersions int, storedBytes, maxStoredBytes int64,
+	scansToday, maxScansPerDay int) *RealmUsageDesc {
+	return &RealmUsageDesc{
+		ResponseType: *NewResponseType(200, "OK", "RealmUsageDesc"),
+		RealmId: realmId,
+		Repos: repos,
+		MaxRepos: maxRepos,
+		Images: images,
+		MaxImages: maxImages,
+		ImageVersions: imageVersions,
+		MaxImageVersions: maxImageVersions,
+		StoredBytes: storedBytes,
+		MaxStoredBytes: maxStoredBytes,
+		ScansToday: scansToday,
+		MaxScansPerDay: maxScansPerDay,
+	}
+}
+
+func (desc *RealmUsageDesc) AsJSON() string {
+	return fmt.Sprintf(" {%s, \"RealmId\": \"%s\", \"Repos\": %d, \"MaxRepos\": %d, " +
+		"\"Images\": %d, \"MaxImages\": %d, \"ImageVersions\": %d, \"MaxImageVersions\": %d, " +
+		"\"StoredBytes\": %d, \"MaxStoredBytes\": %d, \"ScansToday\": %d, \"MaxScansPerDay\": %d}",
+		desc.responseTypeFieldsAsJSON(), desc.RealmId, desc.Repos, desc.MaxRepos,
+		desc.Images, desc.MaxImages, desc.ImageVersions, desc.MaxImageVersions,
+		desc.StoredBytes, desc.MaxStoredBytes, desc.ScansToday, desc.MaxScansPerDay)
+}
+
 
 /****************************** Utility Methods ********************************
  ******************************************************************************/
@@ -0,0 +1,164 @@
+/*******************************************************************************
+ * Expiry of time-limited ACL entries. An expired entry has no effect on access
+ * decisions (see getApplicableACLEntries), but it remains in the database until
+ * the sweeper, which runs periodically in the background, deletes it and
+ * records an ACLEntryExpiryEvent for the user who set the expiry.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultACLExpirySweepInterval = 300  // seconds
+	ACLExpirySweepClaimKeyPrefix = "SafeHarbor/ACLExpirySweep/"
+	MaxExpiringWithinHours = 10 * 366 * 24  // the longest horizon of getExpiringPermissions
+)
+
+/*******************************************************************************
+ * Delete expired ACL entries every ACLExpirySweepInterval seconds, until the
+ * process exits. Each realm is swept in its own transaction. If several servers
+ * share the database, only one sweeps a realm in each interval: the one that
+ * claims the realm's ACLExpirySweepClaimKeyPrefix key. A sweep whose transaction
+ * conflicts with a request is logged, and the entries that it would have deleted
+ * are deleted by the next sweep.
+ */
+func (server *Server) sweepExpiredACLEntriesPeriodically() {
+	
+	var interval = server.getACLExpirySweepInterval()
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		var count, err = server.sweepExpiredACLEntries()
+		if err != nil { fmt.Println("While sweeping expired ACL entries: " + err.Error()) }
+		if count > 0 { fmt.Println(fmt.Sprintf("Deleted %d expired ACL entries", count)) }
+	}
+}
+
+/*******************************************************************************
+ * Return the number of seconds between sweeps.
+ */
+func (server *Server) getACLExpirySweepInterval() int {
+	var interval = server.Config.ACLExpirySweepInterval
+	if interval <= 0 { interval = DefaultACLExpirySweepInterval }
+	return interval
+}
+
+/*******************************************************************************
+ * Delete each ACL entry that has expired, and return the number deleted. A realm
+ * that cannot be swept is logged and skipped.
+ */
+func (server *Server) sweepExpiredACLEntries() (int, error) {
+	
+	var dbClient *InMemClient
+	var err error
+	dbClient, err = NewInMemClient(server)
+	if err != nil { return 0, err }
+	var realmIds []string
+	realmIds, err = dbClient.dbGetAllRealmIds()
+	dbClient.abort()
+	if err != nil { return 0, err }
+	
+	var total = 0
+	for _, realmId := range realmIds {
+		var count int
+		count, err = server.sweepExpiredACLEntriesForRealm(realmId)
+		if err != nil {
+			fmt.Println("While sweeping expired ACL entries of realm " + realmId + ": " + err.Error())
+			continue
+		}
+		total = total + count
+	}
+	return total, nil
+}
+
+/*******************************************************************************
+ * Within a transaction, delete each expired ACL entry for the realm or for a
+ * resource that it contains, and return the number deleted. Nothing is deleted
+ * unless this server claims the realm's sweep for the sweep interval.
+ */
+func (server *Server) sweepExpiredACLEntriesForRealm(realmId string) (int, error) {
+	
+	var claimed, err = server.persistence.claimKey(ACLExpirySweepClaimKeyPrefix + realmId,
+		server.getACLExpirySweepInterval())
+	if err != nil { return 0, err }
+	if ! claimed { return 0, nil }  // another server is sweeping it
+	
+	var dbClient *InMemClient
+	dbClient, err = NewInMemClient(server)
+	if err != nil { return 0, err }
+	
+	var count int
+	count, err = deleteExpiredACLEntries(dbClient, realmId, time.Now())
+	if err != nil {
+		dbClient.abort()
+		return 0, err
+	}
+	if count == 0 {
+		dbClient.abort()
+		return 0, nil
+	}
+	err = dbClient.commit()
+	if err != nil { return 0, err }
+	return count, nil
+}
+
+/*******************************************************************************
+ * Delete each ACL entry for the realm, or for a resource that it contains, that
+ * has expired as of the specified time, and record an event for each.
+ */
+func deleteExpiredACLEntries(dbClient DBClient, realmId string, now time.Time) (int, error) {
+	
+	var entries []ACLEntry
+	var err error
+	entries, err = getRealmACLEntries(dbClient, realmId)
+	if err != nil { return 0, err }
+	var count = 0
+	for _, entry := range entries {
+		if ! entry.hasExpired(now) { continue }
+		
+		var resource Resource
+		resource, err = dbClient.getResource(entry.getResourceId())
+		if err != nil { return count, err }
+		var party Party
+		party, err = dbClient.getParty(entry.getPartyId())
+		if err != nil { return count, err }
+		_, err = dbClient.dbCreateACLEntryExpiryEvent(entry)
+		if err != nil { return count, err }
+		err = dbClient.deleteAccess(resource, party)
+		if err != nil { return count, err }
+		count++
+	}
+	return count, nil
+}
+
+/*******************************************************************************
+ * Return the ACL entries for the realm and for each resource that it contains.
+ */
+func getRealmACLEntries(dbClient DBClient, realmId string) ([]ACLEntry, error) {
+	
+	var entries = make([]ACLEntry, 0)
+	var resourceIds = []string{ realmId }
+	for len(resourceIds) > 0 {  // one level of the resource hierarchy at a time
+		var resources []Resource
+		var err error
+		resources, err = getResources(dbClient, resourceIds)
+		if err != nil { return nil, err }
+		resourceIds = make([]string, 0)
+		for _, resource := range resources {
+			for _, entryId := range resource.getACLEntryIds() {
+				var entry ACLEntry
+				entry, err = getACLEntryIfExists(dbClient, entryId)
+				if err != nil { return nil, err }
+				if entry == nil { continue }  // dangling entry Id
+				entries = append(entries, entry)
+			}
+			resourceIds = append(resourceIds, getChildResourceIds(resource)...)
+		}
+	}
+	return entries, nil
+}
@@ -14,9 +14,11 @@
 package server
 
 import (
+	"crypto/x509"
 	"errors"
 	"os"
 	"io"
+	"io/ioutil"
 	"fmt"
 	"encoding/json"
 	"strings"
@@ -40,6 +42,7 @@ type Configuration struct {
 	RegistryPort int
 	RegistryUserId string
 	RegistryPassword string
+	RegistryNotificationToken string // "" if registry notifications are not accepted; see RegistryNotifications.go
 	LocalAuthCertPath string
 	LocalRootCertPath string // may be null
 	AuthServerName string
@@ -47,6 +50,22 @@ type Configuration struct {
 	AuthCertPath string
 	AuthKeyPath string
 	FileRepoRootPath string // where Dockerfiles, images, etc. are stored
+	ObjectCacheSize int // max number of objects in the shared object cache
+	ACLExpirySweepInterval int // seconds between deletions of expired ACL entries
+	MaxRealms int // max number of realms that may be created; zero means no limit
+	PasswordMinLength int // see PasswordPolicy.go
+	PasswordMaxLength int
+	BreachedPasswordFile string // may be empty
+	EmailTemplateDirectory string // may be empty; see EmailTemplates.go
+	DefaultLocale string // locale of email to users who have not chosen one
+	EmailOutboxPollInterval int // seconds between attempts to send queued email
+	NotificationPollInterval int // seconds between checks for notification digests that are due
+	WebhookPollInterval int // seconds between attempts to post queued webhook deliveries
+	ScanSchedulePollInterval int // seconds between checks for scheduled scans that are due
+	RealmQuotas map[string]*RealmQuota // keyed on realm name, or DefaultRealmQuotaName
+	RateLimits *RateLimitConfig // nil if requests are not rate limited
+	LDAP *LDAPConfig // nil if users are not authenticated against an LDAP directory
+	SCIM *SCIMConfig // nil if users and groups are not provisioned through SCIM
 	ScanServices map[string]interface{}
 	EmailService map[string]interface{}
 }
@@ -144,6 +163,147 @@ func NewConfiguration(file *os.File) (*Configuration, error) {
 	config.RedisPswd, err = substituteEnvValue(rawValue)
 	if err != nil { return nil, errors.New("Did not find environment variable " + rawValue) }
 	
+	// OBJECT_CACHE_SIZE
+	rawValue, exists = entries["OBJECT_CACHE_SIZE"].(string)
+	if exists {
+		stringValue, err = substituteEnvValue(rawValue)
+		if err != nil { return nil, errors.New("Did not find environment variable " + rawValue) }
+		config.ObjectCacheSize, err = strconv.Atoi(stringValue)
+		if err != nil { return nil, fmt.Errorf(
+			"OBJECT_CACHE_SIZE value in configuration is not an integer")
+		}
+	} else {
+		config.ObjectCacheSize = DefaultObjectCacheSize
+	}
+	
+	// ACL_EXPIRY_SWEEP_INTERVAL
+	rawValue, exists = entries["ACL_EXPIRY_SWEEP_INTERVAL"].(string)
+	if exists {
+		stringValue, err = substituteEnvValue(rawValue)
+		if err != nil { return nil, errors.New("Did not find environment variable " + rawValue) }
+		config.ACLExpirySweepInterval, err = strconv.Atoi(stringValue)
+		if err != nil { return nil, fmt.Errorf(
+			"ACL_EXPIRY_SWEEP_INTERVAL value in configuration is not an integer")
+		}
+	} else {
+		config.ACLExpirySweepInterval = DefaultACLExpirySweepInterval
+	}
+	
+	// MAX_REALMS
+	rawValue, exists = entries["MAX_REALMS"].(string)
+	if exists {
+		stringValue, err = substituteEnvValue(rawValue)
+		if err != nil { return nil, errors.New("Did not find environment variable " + rawValue) }
+		config.MaxRealms, err = strconv.Atoi(stringValue)
+		if err != nil { return nil, fmt.Errorf(
+			"MAX_REALMS value in configuration is not an integer")
+		}
+	}
+	
+	// PASSWORD_MIN_LENGTH
+	rawValue, exists = entries["PASSWORD_MIN_LENGTH"].(string)
+	if exists {
+		stringValue, err = substituteEnvValue(rawValue)
+		if err != nil { return nil, errors.New("Did not find environment variable " + rawValue) }
+		config.PasswordMinLength, err = strconv.Atoi(stringValue)
+		if err != nil { return nil, fmt.Errorf(
+			"PASSWORD_MIN_LENGTH value in configuration is not an integer")
+		}
+	} else {
+		config.PasswordMinLength = DefaultPasswordMinLength
+	}
+	
+	// PASSWORD_MAX_LENGTH
+	rawValue, exists = entries["PASSWORD_MAX_LENGTH"].(string)
+	if exists {
+		stringValue, err = substituteEnvValue(rawValue)
+		if err != nil { return nil, errors.New("Did not find environment variable " + rawValue) }
+		config.PasswordMaxLength, err = strconv.Atoi(stringValue)
+		if err != nil { return nil, fmt.Errorf(
+			"PASSWORD_MAX_LENGTH value in configuration is not an integer")
+		}
+	} else {
+		config.PasswordMaxLength = DefaultPasswordMaxLength
+	}
+	
+	// BREACHED_PASSWORD_FILE
+	rawValue, exists = entries["BREACHED_PASSWORD_FILE"].(string)
+	if exists {
+		config.BreachedPasswordFile, err = substituteEnvValue(rawValue)
+		if err != nil { return nil, errors.New("Did not find environment variable " + rawValue) }
+	}
+	
+	// EMAIL_TEMPLATE_DIRECTORY
+	rawValue, exists = entries["EMAIL_TEMPLATE_DIRECTORY"].(string)
+	if exists {
+		stringValue, err = substituteEnvValue(rawValue)
+		if err != nil { return nil, errors.New("Did not find environment variable " + rawValue) }
+		config.EmailTemplateDirectory = strings.TrimRight(stringValue, "/ ")
+	}
+	
+	// DEFAULT_LOCALE
+	rawValue, exists = entries["DEFAULT_LOCALE"].(string)
+	if exists {
+		stringValue, err = substituteEnvValue(rawValue)
+		if err != nil { return nil, errors.New("Did not find environment variable " + rawValue) }
+		config.DefaultLocale, err = normalizeLocale(stringValue)
+		if err != nil { return nil, errors.New("DEFAULT_LOCALE: " + err.Error()) }
+	} else {
+		config.DefaultLocale = DefaultLocale
+	}
+	
+	// EMAIL_OUTBOX_POLL_INTERVAL
+	rawValue, exists = entries["EMAIL_OUTBOX_POLL_INTERVAL"].(string)
+	if exists {
+		stringValue, err = substituteEnvValue(rawValue)
+		if err != nil { return nil, errors.New("Did not find environment variable " + rawValue) }
+		config.EmailOutboxPollInterval, err = strconv.Atoi(stringValue)
+		if err != nil { return nil, fmt.Errorf(
+			"EMAIL_OUTBOX_POLL_INTERVAL value in configuration is not an integer")
+		}
+	} else {
+		config.EmailOutboxPollInterval = DefaultEmailOutboxPollInterval
+	}
+	
+	// NOTIFICATION_POLL_INTERVAL
+	rawValue, exists = entries["NOTIFICATION_POLL_INTERVAL"].(string)
+	if exists {
+		stringValue, err = substituteEnvValue(rawValue)
+		if err != nil { return nil, errors.New("Did not find environment variable " + rawValue) }
+		config.NotificationPollInterval, err = strconv.Atoi(stringValue)
+		if err != nil { return nil, fmt.Errorf(
+			"NOTIFICATION_POLL_INTERVAL value in configuration is not an integer")
+		}
+	} else {
+		config.NotificationPollInterval = DefaultNotificationPollInterval
+	}
+	
+	// WEBHOOK_POLL_INTERVAL
+	rawValue, exists = entries["WEBHOOK_POLL_INTERVAL"].(string)
+	if exists {
+		stringValue, err = substituteEnvValue(rawValue)
+		if err != nil { return nil, errors.New("Did not find environment variable " + rawValue) }
+		config.WebhookPollInterval, err = strconv.Atoi(stringValue)
+		if err != nil { return nil, fmt.Errorf(
+			"WEBHOOK_POLL_INTERVAL value in configuration is not an integer")
+		}
+	} else {
+		config.WebhookPollInterval = DefaultWebhookPollInterval
+	}
+	
+	// SCAN_SCHEDULE_POLL_INTERVAL
+	rawValue, exists = entries["SCAN_SCHEDULE_POLL_INTERVAL"].(string)
+	if exists {
+		stringValue, err = substituteEnvValue(rawValue)
+		if err != nil { return nil, errors.New("Did not find environment variable " + rawValue) }
+		config.ScanSchedulePollInterval, err = strconv.Atoi(stringValue)
+		if err != nil { return nil, fmt.Errorf(
+			"SCAN_SCHEDULE_POLL_INTERVAL value in configuration is not an integer")
+		}
+	} else {
+		config.ScanSchedulePollInterval = DefaultScanSchedulePollInterval
+	}
+	
 	// REGISTRY_HOST
 	rawValue, exists = entries["REGISTRY_HOST"].(string)
 	config.RegistryHost, err = substituteEnvValue(rawValue)
@@ -170,6 +330,11 @@ func NewConfiguration(file *os.File) (*Configuration, error) {
 	config.RegistryPassword, err = substituteEnvValue(rawValue)
 	if err != nil { return nil, errors.New("Did not find environment variable " + rawValue) }
 	
+	// REGISTRY_NOTIFICATION_TOKEN
+	rawValue, exists = entries["REGISTRY_NOTIFICATION_TOKEN"].(string)
+	config.RegistryNotificationToken, err = substituteEnvValue(rawValue)
+	if err != nil { return nil, errors.New("Did not find environment variable " + rawValue) }
+	
 	// ScanServices
 	var obj interface{}
 	obj, exists = entries["ScanServices"]
@@ -191,6 +356,64 @@ func NewConfiguration(file *os.File) (*Configuration, error) {
 		}
 	}
 	
+	// RealmQuotas
+	config.RealmQuotas = make(map[string]*RealmQuota)
+	obj, exists = entries["RealmQuotas"]
+	if exists {
+		var quotaConfigs map[string]interface{}
+		quotaConfigs, isType = obj.(map[string]interface{})
+		if ! isType {
+			fmt.Println("RealmQuotas is a", reflect.TypeOf(obj))
+			return nil, fmt.Errorf("Realm quota configuration is ill-formatted")
+		}
+		for realmName, obj := range quotaConfigs { // each realm name, or Default
+			var quotaParams map[string]interface{}
+			quotaParams, isType = obj.(map[string]interface{})
+			if ! isType { return nil, errors.New("Quotas for " + realmName + " are invalid") }
+			config.RealmQuotas[realmName], err = parseRealmQuota(quotaParams)
+			if err != nil { return nil, errors.New("Quotas for " + realmName + ": " + err.Error()) }
+		}
+	}
+	
+	// RateLimits
+	obj, exists = entries["RateLimits"]
+	if exists {
+		var rateLimitParams map[string]interface{}
+		rateLimitParams, isType = obj.(map[string]interface{})
+		if ! isType {
+			fmt.Println("RateLimits is a", reflect.TypeOf(obj))
+			return nil, fmt.Errorf("Rate limit configuration is ill-formatted")
+		}
+		config.RateLimits, err = parseRateLimits(rateLimitParams)
+		if err != nil { return nil, errors.New("RateLimits: " + err.Error()) }
+	}
+	
+	// LDAP
+	obj, exists = entries["LDAP"]
+	if exists {
+		var ldapParams map[string]interface{}
+		ldapParams, isType = obj.(map[string]interface{})
+		if ! isType {
+			fmt.Println("LDAP is a", reflect.TypeOf(obj))
+			return nil, fmt.Errorf("LDAP configuration is ill-formatted")
+		}
+		config.LDAP, err = parseLDAPConfig(ldapParams)
+		if err != nil { return nil, errors.New("LDAP: " + err.Error()) }
+	}
+	
+	// SCIM
+	obj, exists = entries["SCIM"]
+	if exists {
+		var scimParams map[string]interface{}
+		scimParams, isType = obj.(map[string]interface{})
+		if ! isType {
+			fmt.Println("SCIM is a", reflect.TypeOf(obj))
+			return nil, fmt.Errorf("SCIM configuration is ill-formatted")
+		}
+		config.SCIM, err = parseSCIMConfig(scimParams)
+		if err != nil { return nil, errors.New("SCIM: " + err.Error()) }
+	}
+	
 	// Email service.
 	obj, exists = entries["EmailService"]
 	if ! exists { return nil, fmt.Errorf("Did not find EmailService in configuration") }
@@ -210,6 +433,230 @@ func NewConfiguration(file *os.File) (*Configuration, error) {
 	return config, nil
 }
 
+/*******************************************************************************
+ * Build a RealmQuota from the attributes of an entry of RealmQuotas. Each
+ * attribute value is a string (which may reference an environment variable)
+ * containing an integer.
+ */
+func parseRealmQuota(quotaParams map[string]interface{}) (*RealmQuota, error) {
+	
+	var quota = &RealmQuota{
+		MaxRepos: UnsetQuota,
+		MaxImages: UnsetQuota,
+		MaxImageVersions: UnsetQuota,
+		MaxStoredBytes: UnsetQuota,
+		MaxScansPerDay: UnsetQuota,
+	}
+	for key, value := range quotaParams {
+		var stringValue, isType = value.(string)
+		if ! isType { return nil, errors.New("Parameter for " + key + " is not a string") }
+		var err error
+		stringValue, err = substituteEnvValue(stringValue)
+		if err != nil { return nil, err }
+		var limit int64
+		limit, err = strconv.ParseInt(stringValue, 10, 64)
+		if err != nil { return nil, errors.New(key + " value is not an integer") }
+		if limit < 0 { return nil, errors.New(key + " value is negative") }
+		switch key {
+			case "MaxRepos": quota.MaxRepos = int(limit)
+			case "MaxImages": quota.MaxImages = int(limit)
+			case "MaxImageVersions": quota.MaxImageVersions = int(limit)
+			case "MaxStoredBytes": quota.MaxStoredBytes = limit
+			case "MaxScansPerDay": quota.MaxScansPerDay = int(limit)
+			default: return nil, errors.New("Unrecognized quota: " + key)
+		}
+	}
+	return quota, nil
+}
+
+/*******************************************************************************
+ * Build a RateLimitConfig from the RateLimits entry. The User, Session, IP, and
+ * TargetUser attributes are each an object with a Rate (tokens per second) and a
+ * Burst; Costs is an object mapping method names to costs; TrustForwardedFor is
+ * "true" or "false"; and ProxyHops is a positive integer. All values are strings,
+ * which may reference environment variables.
+ */
+func parseRateLimits(rateLimitParams map[string]interface{}) (*RateLimitConfig, error) {
+	
+	var rateLimits = &RateLimitConfig{
+		Costs: make(map[string]int),
+	}
+	var err error
+	for key, value := range rateLimitParams {
+		var params map[string]interface{}
+		var stringValue string
+		var isType bool
+		switch key {
+			case "User", "Session", "IP", "TargetUser":
+				params, isType = value.(map[string]interface{})
+				if ! isType { return nil, errors.New(key + " is not an object") }
+				var limit = &TokenBucketLimit{}
+				for name, value := range params {
+					stringValue, isType = value.(string)
+					if ! isType { return nil, errors.New("Parameter for " + name + " is not a string") }
+					stringValue, err = substituteEnvValue(stringValue)
+					if err != nil { return nil, err }
+					var number float64
+					number, err = strconv.ParseFloat(stringValue, 64)
+					if err != nil { return nil, errors.New(key + " " + name + " value is not a number") }
+					switch name {
+						case "Rate": limit.Rate = number
+						case "Burst": limit.Burst = number
+						default: return nil, errors.New("Unrecognized parameter: " + key + " " + name)
+					}
+				}
+				if limit.Rate <= 0 { return nil, errors.New(key + " Rate must be positive") }
+				if limit.Burst < 1 { return nil, errors.New(key + " Burst must be at least 1") }
+				switch key {
+					case "User": rateLimits.User = limit
+					case "Session": rateLimits.Session = limit
+					case "IP": rateLimits.IP = limit
+					case "TargetUser": rateLimits.TargetUser = limit
+				}
+			case "Costs":
+				params, isType = value.(map[string]interface{})
+				if ! isType { return nil, errors.New(key + " is not an object") }
+				for methodName, value := range params {
+					stringValue, isType = value.(string)
+					if ! isType { return nil, errors.New("Cost for " + methodName + " is not a string") }
+					stringValue, err = substituteEnvValue(stringValue)
+					if err != nil { return nil, err }
+					rateLimits.Costs[methodName], err = strconv.Atoi(stringValue)
+					if err != nil { return nil, errors.New("Cost for " + methodName + " is not an integer") }
+				}
+			case "TrustForwardedFor":
+				stringValue, isType = value.(string)
+				if ! isType { return nil, errors.New("Parameter for " + key + " is not a string") }
+				stringValue, err = substituteEnvValue(stringValue)
+				if err != nil { return nil, err }
+				rateLimits.TrustForwardedFor, err = strconv.ParseBool(stringValue)
+				if err != nil { return nil, errors.New(key + " value is not true or false") }
+			case "ProxyHops":
+				stringValue, isType = value.(string)
+				if ! isType { return nil, errors.New("Parameter for " + key + " is not a string") }
+				stringValue, err = substituteEnvValue(stringValue)
+				if err != nil { return nil, err }
+				rateLimits.ProxyHops, err = strconv.Atoi(stringValue)
+				if (err != nil) || (rateLimits.ProxyHops < 1) {
+					return nil, errors.New(key + " value is not a positive integer")
+				}
+			default:
+				return nil, errors.New("Unrecognized parameter: " + key)
+		}
+	}
+	return rateLimits, nil
+}
+
+/*******************************************************************************
+ * Build the LDAP configuration. Each attribute is a string, which may reference
+ * an environment variable, except GroupRealms, which is an object that maps
+ * group names to realm names. URL, UserBaseDN, and Realm are required. If
+ * CACertFile is specified, its certificates are loaded.
+ */
+func parseLDAPConfig(params map[string]interface{}) (*LDAPConfig, error) {
+	
+	var ldapConfig = &LDAPConfig{
+		UserFilter: DefaultLDAPUserFilter,
+		UserNameAttribute: "cn",
+		EmailAttribute: "mail",
+		GroupFilter: DefaultLDAPGroupFilter,
+		GroupNameAttribute: "cn",
+		GroupMemberAttribute: "member",
+		GroupRealms: make(map[string]string),
+		SyncInterval: DefaultLDAPSyncInterval,
+	}
+	for key, value := range params {
+		var stringValue string
+		var isType bool
+		var err error
+		if key == "GroupRealms" {
+			var groupRealms map[string]interface{}
+			groupRealms, isType = value.(map[string]interface{})
+			if ! isType { return nil, errors.New(key + " is not an object") }
+			for groupName, value := range groupRealms {
+				stringValue, isType = value.(string)
+				if ! isType { return nil, errors.New("Realm for group " + groupName + " is not a string") }
+				ldapConfig.GroupRealms[groupName], err = substituteEnvValue(stringValue)
+				if err != nil { return nil, err }
+			}
+			continue
+		}
+		stringValue, isType = value.(string)
+		if ! isType { return nil, errors.New("Parameter for " + key + " is not a string") }
+		stringValue, err = substituteEnvValue(stringValue)
+		if err != nil { return nil, err }
+		switch key {
+			case "URL": ldapConfig.URL = stringValue
+			case "BindDN": ldapConfig.BindDN = stringValue
+			case "BindPassword": ldapConfig.BindPassword = stringValue
+			case "UserBaseDN": ldapConfig.UserBaseDN = stringValue
+			case "UserFilter": ldapConfig.UserFilter = stringValue
+			case "UserNameAttribute": ldapConfig.UserNameAttribute = stringValue
+			case "EmailAttribute": ldapConfig.EmailAttribute = stringValue
+			case "GroupBaseDN": ldapConfig.GroupBaseDN = stringValue
+			case "GroupFilter": ldapConfig.GroupFilter = stringValue
+			case "GroupNameAttribute": ldapConfig.GroupNameAttribute = stringValue
+			case "GroupMemberAttribute": ldapConfig.GroupMemberAttribute = stringValue
+			case "Realm": ldapConfig.Realm = stringValue
+			case "CACertFile": ldapConfig.CACertFile = stringValue
+			case "SyncInterval":
+				ldapConfig.SyncInterval, err = strconv.Atoi(stringValue)
+				if err != nil { return nil, errors.New(key + " value is not an integer") }
+			default:
+				return nil, errors.New("Unrecognized parameter: " + key)
+		}
+	}
+	if ldapConfig.URL == "" { return nil, errors.New("URL is required") }
+	if ldapConfig.UserBaseDN == "" { return nil, errors.New("UserBaseDN is required") }
+	if ldapConfig.Realm == "" { return nil, errors.New("Realm is required") }
+	if ldapConfig.GroupBaseDN == "" { ldapConfig.GroupBaseDN = ldapConfig.UserBaseDN }
+	if ldapConfig.CACertFile != "" {
+		var pemBytes, err = ioutil.ReadFile(ldapConfig.CACertFile)
+		if err != nil { return nil, err }
+		ldapConfig.rootCAs = x509.NewCertPool()
+		if ! ldapConfig.rootCAs.AppendCertsFromPEM(pemBytes) { return nil, errors.New(
+			"CACertFile contains no PEM certificates") }
+	}
+	if ! strings.Contains(ldapConfig.UserFilter, "%s") { return nil, errors.New(
+		"UserFilter must contain %s, which is replaced by the user Id") }
+	return ldapConfig, nil
+}
+
+/*******************************************************************************
+ * Build the SCIM configuration. Tokens is an object that maps the name of each
+ * realm that is provisioned through SCIM to its bearer token, which is a string
+ * that may reference an environment variable. Tokens must be distinct.
+ */
+func parseSCIMConfig(params map[string]interface{}) (*SCIMConfig, error) {
+	
+	var scimConfig = &SCIMConfig{
+		Tokens: make(map[string]string),
+	}
+	var realmNames = make(map[string]string)  // keyed on token
+	for key, value := range params {
+		if key != "Tokens" { return nil, errors.New("Unrecognized parameter: " + key) }
+		var tokens, isType = value.(map[string]interface{})
+		if ! isType { return nil, errors.New(key + " is not an object") }
+		for realmName, value := range tokens {
+			var token string
+			token, isType = value.(string)
+			if ! isType { return nil, errors.New("Token for realm " + realmName + " is not a string") }
+			var err error
+			token, err = substituteEnvValue(token)
+			if err != nil { return nil, err }
+			if len(token) < SCIMMinTokenLength { return nil, fmt.Errorf(
+				"Token for realm %s must have at least %d characters", realmName, SCIMMinTokenLength) }
+			var otherRealmName, exists = realmNames[token]
+			if exists { return nil, errors.New(
+				"Realms " + otherRealmName + " and " + realmName + " have the same token") }
+			realmNames[token] = realmName
+			scimConfig.Tokens[realmName] = token
+		}
+	}
+	if len(scimConfig.Tokens) == 0 { return nil, errors.New("Tokens is required") }
+	return scimConfig, nil
+}
+
 /*******************************************************************************
  * If the raw value begins with a dollar sign ($), assume that it is an environment
  * variable reference: search the environment for the variable. If found, return it,
@@ -73,6 +73,13 @@ type DBClient interface {
 	getPersistentObject(id string) (PersistObj, error)
 		/** Return the database object identified by the id, or error if not found. */
 	
+	getPersistentObjectIfExists(id string) (PersistObj, error)
+		/** Return the database object identified by the id, or nil if not found. */
+	
+	getPersistentObjects(ids []string) ([]PersistObj, error)
+		/** Return the database objects identified by the ids, in the same order,
+			or error if any is not found. The objects are loaded in a single batch. */
+	
 	// Superfluous - eliminate:
 	writeBack(PersistObj) error
 		/** Update the state of the object in the database. If the object exists,
@@ -87,12 +94,29 @@ type DBClient interface {
 
 	dbGetUserByUserId(string) (User, error)
 	dbCreateIdentityValidationInfo(userId string, creationTime time.Time,
-		token string) (IdentityValidationInfo, error)
+		token, purpose string) (IdentityValidationInfo, error)
 	dbCreateGroup(string, string, string) (Group, error)
 	dbCreateUser(string, string, string, string, string) (User, error)
 	dbCreateACLEntry(resourceId string, partyId string, permissionMask []bool) (ACLEntry, error)
 	dbCreateRealm(*apitypes.RealmInfo, string) (Realm, error)
 	dbCreateRepo(realmId, name, desc string) (Repo, error)  // name may be ""
+	dbCreateRole(realmId, name, desc string, mask []bool) (Role, error)
+	dbCreateInvitation(resourceId, inviterId, inviteeRealmId, inviteeUserId, inviteeEmail,
+		inviteeGroupName string, mask []bool) (Invitation, error)
+	dbCreateOutboundEmail(realmId, address, subject, textMessage, htmlMessage string) (OutboundEmail, error)
+	dbDeleteOutboundEmail(OutboundEmail) error
+	dbCreateNotificationSubscription(userObjId, realmId, resourceId string,
+		eventTypes []string) (NotificationSubscription, error)
+	dbDeleteNotificationSubscription(NotificationSubscription) error
+	dbCreateNotification(userObjId, eventType, resourceId, subject, message string,
+		creationTime time.Time) (Notification, error)
+	dbCreateWebhook(realmId, resourceId, url, secret string, eventTypes []string,
+		creatorId string) (Webhook, error)
+	dbDeleteWebhook(Webhook) error
+	dbCreateWebhookDelivery(webhook Webhook, eventType, payload string) (WebhookDelivery, error)
+	dbCreateScanSchedule(realmId, resourceId, schedule, timeZone string, allVersions bool,
+		creatorId string, nextRunTime time.Time) (ScanSchedule, error)
+	dbDeleteScanSchedule(ScanSchedule) error
 	dbCreateDockerfile(string, string, string, string) (Dockerfile, error)
 	dbCreateDockerImage(string, string, string) (DockerImage, error)
 	dbCreateDockerImageVersion(version, dockerImageObjId string, creationDate time.Time,
@@ -104,6 +128,9 @@ type DBClient interface {
 		userObjId, score string, result *scanners.ScanResult) (ScanEvent, error)
 	dbCreateDockerfileExecEvent(dockerfileId string, paramNames, paramValues []string,
 		imageId, userObjId string) (DockerfileExecEvent, error)
+	dbCreateImageUploadEvent(imageVersionId, userObjId, repository, tag, digest,
+		registryEventId string) (ImageUploadEvent, error)
+	dbCreateACLEntryExpiryEvent(ACLEntry) (ACLEntryExpiryEvent, error)
 	dbCreateDockerfileExecParameterValue(name, value, dockerfileId string) (DockerfileExecParameterValue, error)
 	dbDeactivateRealm(realmId string) error
 	
@@ -113,6 +140,15 @@ type DBClient interface {
 	getGroup(string) (Group, error)
 	getUser(string) (User, error)
 	getACLEntry(string) (ACLEntry, error)
+	getRole(string) (Role, error)
+	getInvitation(string) (Invitation, error)
+	getOutboundEmail(string) (OutboundEmail, error)
+	getOutboundEmailIds(realmId string) ([]string, error)
+	getNotificationSubscription(string) (NotificationSubscription, error)
+	getNotification(string) (Notification, error)
+	getWebhook(string) (Webhook, error)
+	getWebhookDelivery(string) (WebhookDelivery, error)
+	getScanSchedule(string) (ScanSchedule, error)
 	getRealm(string) (Realm, error)
 	getRepo(string) (Repo, error)
 	getDockerfile(string) (Dockerfile, error)
@@ -133,6 +169,7 @@ type DBClient interface {
 		
 	// From Party
 	setActive(Party, bool) error
+	markUserDeleted(User) error
 	addACLEntryForParty(Party, ACLEntry) error
 	deleteACLEntryForParty(party Party, entry ACLEntry) error
 	
@@ -168,6 +205,7 @@ type IdentityValidationInfo interface {
 	PersistObj
 	getUserId() string
 	getCreationTime() time.Time
+	getPurpose() string
 }
 
 /* A Party is a User or a Group. Parties act on Resources. */
@@ -240,6 +278,13 @@ type Group interface {
 	addUserId(DBClient, string) error
 	addUser(DBClient, User) error
 	removeUser(DBClient, User) error
+	getGroupIds() []string  // the groups that this group belongs to
+	getMemberGroupIds() []string  // the groups that belong to this group
+	hasMemberGroupWithId(string) bool
+	addMemberGroup(DBClient, Group) error
+	removeMemberGroup(DBClient, Group) error
+	addGroupIdDeferredUpdate(string)
+	removeGroupIdDeferredUpdate(string)
 	asGroupDesc() *apitypes.GroupDesc
 }
 
@@ -259,9 +304,44 @@ type User interface {
 	validatePassword(dbClient DBClient, pswd string) bool
 	hasGroupWithId(DBClient, string) bool
 	addGroupIdDeferredUpdate(DBClient, string) error
+	removeGroupIdDeferredUpdate(string)
 	getGroupIds() []string
+	getLDAPDN() string  // "" unless the user was provisioned from the LDAP directory
+	setLDAPDN(DBClient, string) error
+	getLocale() string  // "" if the user has not chosen one
+	setLocale(DBClient, string) error
+	getNotificationSubscriptionIds() []string
+	addNotificationSubscription(DBClient, NotificationSubscription) error
+	removeNotificationSubscription(DBClient, NotificationSubscription) error
+	getNotificationIds() []string  // in-app, oldest first
+	addNotification(DBClient, Notification) error
+	removeNotificationId(DBClient, string) error
+	getPendingNotificationIds() []string  // to be emailed
+	addPendingNotification(DBClient, Notification) error
+	clearPendingNotifications(DBClient) error
+	getNotificationPreferences() *NotificationPreferences
+	setNotificationPreferences(DBClient, *NotificationPreferences) error
 	addLoginAttempt(DBClient)
 	getMostRecentLoginAttempts() []string // each in seconds, Unix time
+	getFailedLoginAttempts() []string // each in seconds, Unix time
+	getLockedUntil() time.Time
+	getLockoutCount() int
+	isLockedOut(time.Time) bool
+	recordFailedLogin(DBClient, time.Time) (bool, error)
+	recordSuccessfulLogin(DBClient) error
+	unlock(DBClient) error
+	isDeleted() bool
+	getCredentialEpoch() time.Time
+	advanceCredentialEpoch(DBClient, time.Time) error
+	getTOTPSecret() string
+	isTOTPEnabled() bool
+	getRecoveryCodeCount() int
+	beginTOTPEnrollment(DBClient, string) error
+	enableTOTP(DBClient, []string) error
+	setRecoveryCodeHashes(DBClient, []string) error
+	resetSecondFactor(DBClient) error
+	verifyTOTPCode(DBClient, string, time.Time) (bool, error)
+	useRecoveryCode(DBClient, string) (bool, error)
 	addEventId(DBClient, string)
 	getEventIds() []string
 	deleteEvent(DBClient, Event) error
@@ -274,10 +354,134 @@ type ACLEntry interface {
 	getPartyId() string
 	getParty(DBClient) (Party, error)
 	getPermissionMask() []bool
-	setPermissionMask(DBClient, []bool) error
+	setPermissionMask(DBClient, []bool) error  // clears the denial of each mode that is granted
+	addPermissionModes(DBClient, []bool) error  // except those denied; leaves the denials and role alone
+	remPermissionModes(DBClient, []bool) error  // leaves the denials and role alone
+	getDenyMask() []bool
+	setDenyMask(DBClient, []bool) error  // clears the grant of each mode that is denied
+	addDenyMask(DBClient, []bool) error
+	getRoleName() string  // "" if the granted modes were not assigned by means of a role
+	setRole(DBClient, Role) error
+	getExpiresAt() time.Time  // zero if the entry does not expire
+	getGrantorId() string  // the user who set the expiry
+	setExpiry(dbClient DBClient, expiresAt time.Time, grantorId string) error
+	hasExpired(now time.Time) bool
+	getInvitationId() string  // "" unless the entry grants access across realms
+	setInvitationId(DBClient, string) error
 	asPermissionDesc() *apitypes.PermissionDesc
 }
 
+type Role interface {
+	PersistObj
+	getRealmId() string  // "" for a built-in role
+	getName() string
+	getDescription() string
+	getPermissionMask() []bool
+	isBuiltIn() bool
+	getACLEntryIds() []string
+	addACLEntryId(DBClient, string) error
+	setDefinition(dbClient DBClient, desc string, mask []bool) error  // updates each assignment
+	asRoleDesc() *apitypes.RoleDesc
+}
+
+type Invitation interface {
+	PersistObj
+	getResourceId() string
+	getInvitingRealmId() string
+	getInviteeRealmId() string
+	getInviteePartyId() string  // "" until accepted
+	getStatus() string
+	accept(DBClient) (ACLEntry, error)
+	reject(DBClient) error
+	revoke(DBClient) error  // deletes the ACL entry, if accepted
+	asInvitationDesc() *apitypes.InvitationDesc
+}
+
+type OutboundEmail interface {
+	PersistObj
+	getRealmId() string
+	getAddress() string
+	getSubject() string
+	getTextMessage() string
+	getHTMLMessage() string
+	getStatus() string
+	getAttempts() int
+	isDue(time.Time) bool
+	claim(dbClient DBClient, claimExpires time.Time) error
+	recordFailure(dbClient DBClient, errMsg string, nextAttemptTime time.Time) error  // zero time: give up
+	retry(DBClient) error
+	asOutboundEmailDesc() *apitypes.OutboundEmailDesc
+}
+
+type NotificationSubscription interface {
+	PersistObj
+	getUserObjId() string
+	getRealmId() string
+	getResourceId() string  // a realm, repo, or image
+	getEventTypes() []string
+	setEventTypes(DBClient, []string) error
+	includesEventType(string) bool
+	asNotificationSubscriptionDesc() *apitypes.NotificationSubscriptionDesc
+}
+
+type Notification interface {
+	PersistObj
+	getUserObjId() string
+	getEventType() string
+	getResourceId() string
+	getSubject() string
+	getMessage() string
+	isRead() bool
+	markRead(DBClient) error
+	getCreationTime() time.Time
+	asNotificationDesc() *apitypes.NotificationDesc
+}
+
+type Webhook interface {
+	PersistObj
+	getRealmId() string
+	getResourceId() string  // a realm or repo
+	getURL() string
+	getSecret() string
+	getEventTypes() []string  // empty if the hook receives every type of event
+	getDeliveryIds() []string  // oldest first
+	addDelivery(DBClient, WebhookDelivery) error
+	removeDeliveryId(DBClient, string) error
+	asWebhookDesc(includeSecret bool) *apitypes.WebhookDesc
+}
+
+type WebhookDelivery interface {
+	PersistObj
+	getWebhookId() string
+	getRealmId() string
+	getEventType() string
+	getPayload() string
+	getStatus() string
+	getAttempts() int
+	isDue(time.Time) bool
+	claim(dbClient DBClient, claimExpires time.Time) error
+	recordSuccess(dbClient DBClient, responseStatus int, now time.Time) error
+	recordFailure(dbClient DBClient, responseStatus int, errMsg string,
+		nextAttemptTime, now time.Time) error  // zero nextAttemptTime: give up
+	redeliver(DBClient) error
+	asWebhookDeliveryDesc() *apitypes.WebhookDeliveryDesc
+}
+
+type ScanSchedule interface {
+	PersistObj
+	getRealmId() string
+	getResourceId() string  // a DockerImage or a Repo
+	getSchedule() string  // a cron expression; see CronSchedule
+	getTimeZone() string  // "" for UTC
+	scansAllVersions() bool  // false if only the most recent version of each image is scanned
+	getCreatorId() string
+	getNextRunTime() time.Time
+	getLastRunTime() time.Time
+	isDue(time.Time) bool
+	recordRun(dbClient DBClient, nextRunTime time.Time) error
+	asScanScheduleDesc() *apitypes.ScanScheduleDesc
+}
+
 type Realm interface {
 	Resource
 	getAdminUserId() string
@@ -301,6 +505,26 @@ type Realm interface {
 	deleteGroup(DBClient, Group) error
 	deleteRepo(DBClient, Repo) error
 	createUniqueRepoName(DBClient, string) (string, error)
+	getRoleIds() []string
+	getRole(DBClient, string) (Role, error)  // a built-in role, or one that the realm defines
+	addRole(DBClient, Role) error
+	deleteRole(DBClient, Role) error
+	getInvitationIds() []string
+	getNotificationSubscriptionIds() []string
+	addNotificationSubscription(DBClient, NotificationSubscription) error
+	removeNotificationSubscription(DBClient, NotificationSubscription) error
+	getWebhookIds() []string
+	addWebhook(DBClient, Webhook) error
+	removeWebhook(DBClient, Webhook) error
+	getPendingWebhookDeliveryIds() []string
+	addPendingWebhookDelivery(DBClient, WebhookDelivery) error
+	removePendingWebhookDelivery(DBClient, WebhookDelivery) error
+	getScanScheduleIds() []string
+	addScanSchedule(DBClient, ScanSchedule) error
+	removeScanSchedule(DBClient, ScanSchedule) error
+	addInvitation(DBClient, Invitation) error
+	requiresTOTP() bool
+	setRequireTOTP(DBClient, bool) error
 	asRealmDesc() *apitypes.RealmDesc
 }
 
@@ -463,6 +687,7 @@ type Event interface {  // abstract
 type ScanEvent interface {
 	Event
 	getScore() string
+	getVulnerabilities() []*scanners.VulnerabilityDesc
 	//getDockerImageId() string  // may be empty (if Dockerfile has been deleted).
 	getDockerImageVersionId() string  // may be empty (if Dockerfile has been deleted).
 	getScanConfigId() string  // may be empty (if ScanConfig has been deleted).
@@ -493,6 +718,18 @@ type DockerfileExecEvent interface {
 	nullifyDockerfile(DBClient) error
 }
 
+type ACLEntryExpiryEvent interface {
+	Event
+	getResourceId() string
+	getPartyId() string
+	getPermissionMask() []bool
+}
+
 type ImageUploadEvent interface {
 	ImageCreationEvent
+	getRepository() string
+	getTag() string
+	getDigest() string  // of the image's manifest
+	getRegistryEventId() string
+	asImageUploadEventDesc() *apitypes.ImageUploadEventDesc
 }
@@ -51,6 +51,94 @@ func retrieveTypeName(json string) (typeName string, remainder string, err error
 	return s3, s2[j+k+1:], nil
 }
 
+/*******************************************************************************
+ * Split the JSON for an object, as produced by its asJSON method, into its
+ * type name, and the name and JSON text of each of its fields, in order. The
+ * values are not interpreted, other than to find where each one ends.
+ */
+func splitJSONObject(json string) (typeName string, fieldNames []string,
+	values []string, err error) {
+	
+	var remainder string
+	typeName, remainder, err = retrieveTypeName(json)
+	if err != nil { return "", nil, nil, err }
+	
+	fieldNames = make([]string, 0)
+	values = make([]string, 0)
+	var pos int = 0
+	var token = parseJSON_findNextToken(remainder, &pos)
+	if token != "{" { return "", nil, nil, parseJSON_tokenError(token, remainder, &pos,
+		"while looking for start of object") }
+	
+	token = parseJSON_findNextToken(remainder, &pos)
+	if token == "}" { return typeName, fieldNames, values, nil }
+	parseJSON_pushTokenBack(token, &pos)
+	
+	for {
+		token = parseJSON_findNextToken(remainder, &pos)
+		if token != "\"" { return "", nil, nil, parseJSON_tokenError(token, remainder, &pos,
+			"while looking for field name") }
+		var fieldName string
+		fieldName, err = parseJSON_field_name(remainder, &pos)
+		if err != nil { return "", nil, nil, err }
+		parseJSON_findNextToken(remainder, &pos)  // trailing double quote
+		token = parseJSON_findNextToken(remainder, &pos)
+		if token != ":" { return "", nil, nil, parseJSON_tokenError(token, remainder, &pos,
+			"while looking for colon following a field name") }
+		
+		var startPos = pos
+		var value reflect.Value
+		value, err = parseJSON_value(remainder, &pos)
+		if err != nil { return "", nil, nil, err }
+		if ! value.IsValid() { return "", nil, nil, parseJSON_syntaxError(remainder, &pos,
+			"while looking for object field value") }
+		fieldNames = append(fieldNames, fieldName)
+		values = append(values, strings.TrimSpace(remainder[startPos:pos]))
+		
+		token = parseJSON_findNextToken(remainder, &pos)
+		if token == "}" { break }
+		if token != "," { return "", nil, nil, parseJSON_tokenError(token, remainder, &pos,
+			"while looking for object terminator") }
+	}
+	
+	return typeName, fieldNames, values, nil
+}
+
+/*******************************************************************************
+ * If the JSON value is an array of strings (or an empty array), return the JSON
+ * text of each of its elements, and true. Otherwise return false.
+ */
+func splitJSONStringArray(json string) ([]string, bool, error) {
+	
+	var pos int = 0
+	var token = parseJSON_findNextToken(json, &pos)
+	if token != "[" { return nil, false, nil }
+	
+	var elements = make([]string, 0)
+	token = parseJSON_findNextToken(json, &pos)
+	if token == "]" { return elements, true, nil }
+	parseJSON_pushTokenBack(token, &pos)
+	
+	for {
+		var startPos = pos
+		var value reflect.Value
+		var err error
+		value, err = parseJSON_value(json, &pos)
+		if err != nil { return nil, false, err }
+		if ! value.IsValid() { return nil, false, parseJSON_syntaxError(json, &pos,
+			"while looking for array value") }
+		if value.Kind() != reflect.String { return nil, false, nil }
+		elements = append(elements, strings.TrimSpace(json[startPos:pos]))
+		
+		token = parseJSON_findNextToken(json, &pos)
+		if token == "]" { break }
+		if token != "," { return nil, false, parseJSON_tokenError(token, json, &pos,
+			"while looking for array terminator") }
+	}
+	
+	return elements, true, nil
+}
+
 /*******************************************************************************
  * Parse each json field and return a Value for each.
  * Only built-in types are allowed in the JSON fields, including byte and time.Time.
@@ -5,10 +5,10 @@ import (
 	"testing"
 	"fmt"
 	"reflect"
-	"strings"
-	"errors"
-	"time"
+	"os"
 	"runtime/debug"
+	
+	"safeharbor/apitypes"
 )
 
 /*******************************************************************************
@@ -57,7 +57,7 @@ func Test_JSONDeserialization(testContext *testing.T) {
 /*******************************************************************************
  * 
  */
-func Test_JSONDeserialization(testContext *testing.T) {
+func Test_JSONDeserializationString(testContext *testing.T) {
 	var json = "\"this is a string\""
 	var expected = "this is a string"
 	TryJsonDeserString(testContext, json, expected)
@@ -66,14 +66,14 @@ func Test_JSONDeserialization(testContext *testing.T) {
 /*******************************************************************************
  * 
  */
-func Test_JSONDeserialization(testContext *testing.T) {
+func Test_JSONDeserializationSimple(testContext *testing.T) {
 	TryJsonDeserSimple(testContext)
 }
 	
 /*******************************************************************************
  * 
  */
-func Test_JSONDeserialization(testContext *testing.T) {
+func Test_JSONDeserializationNestedType(testContext *testing.T) {
 	TryJsonDeserNestedType(testContext)
 }
 
@@ -99,7 +99,7 @@ func TryJsonDeserString(testContext *testing.T, json, expected string) {
 	var err error
 	var pos int = 0
 	value, err = parseJSON_string_value(json, &pos)
-	AssertErrIsNil(testContext, err, "")
+	AssertNoErr(testContext, err, "")
 	AssertThat(testContext, value.IsValid(), "Value is not valid")
 }
 
@@ -108,14 +108,14 @@ func TryJsonDeserString(testContext *testing.T, json, expected string) {
  */
 func TryJsonDeserSimple(testContext *testing.T) {
 
-	var client Client = &InMemClient{}
+	var client Client = &InMemJSONClient{}
 	var abc = &InMemABC{ 123, "this is a string", []string{"alpha", "beta"}, true }
 	var jsonString = abc.toJSON()
 
 	var retValue0 interface{}
 	var err error
-	retValue0, err = ReconstituteObject(client, jsonString)
-	AssertErrIsNil(testContext, err, "on return from ReconstituteObject")
+	_, retValue0, err = ReconstituteObject(client, jsonString)
+	AssertNoErr(testContext, err, "on return from ReconstituteObject")
 	
 	var abc2 ABC
 	var isType bool
@@ -134,7 +134,7 @@ func TryJsonDeserSimple(testContext *testing.T) {
  */
 func TryJsonDeserNestedType(testContext *testing.T) {
 
-	var client Client = &InMemClient{}
+	var client Client = &InMemJSONClient{}
 	var def = &InMemDEF{
 		ABC: client.NewABC(123, "this is a string", []string{"alpha", "beta"}, true),
 		xyz: 456,
@@ -143,8 +143,8 @@ func TryJsonDeserNestedType(testContext *testing.T) {
 
 	var retValue0 interface{}
 	var err error
-	retValue0, err = ReconstituteObject(client, jsonString)
-	AssertErrIsNil(testContext, err, "on return from ReconstituteObject")
+	_, retValue0, err = ReconstituteObject(client, jsonString)
+	AssertNoErr(testContext, err, "on return from ReconstituteObject")
 	
 	var def2 DEF
 	var isType bool
@@ -171,7 +171,7 @@ type ABC interface {
 	toJSON() string
 }
 
-type InMemClient struct {
+type InMemJSONClient struct {
 }
 
 type InMemABC struct {
@@ -181,11 +181,15 @@ type InMemABC struct {
 	db bool
 }
 
-func (client *InMemClient) NewABC(a int, bs string, car []string, db bool) ABC {
+func (client *InMemJSONClient) NewABC(a int, bs string, car []string, db bool) ABC {
 	var abc *InMemABC = &InMemABC{a, bs, car, db}
 	return abc
 }
 
+func (client *InMemJSONClient) ReconstituteABC(a int, bs string, car []string, db bool) ABC {
+	return client.NewABC(a, bs, car, db)
+}
+
 func (abc *InMemABC) getA() int {
 	return abc.a
 }
@@ -209,7 +213,7 @@ func (abc *InMemABC) toJSON() string {
 		if i > 0 { res = res + ", " }
 		res = res + "\"" + s + "\""  // Note - need to replace any quotes in s
 	}
-	res = res + fmt.Sprintf("], \"db\": %s}", BoolToString(abc.db))
+	res = res + fmt.Sprintf("], \"db\": %s}", apitypes.BoolToString(abc.db))
 	return res
 }
 
@@ -223,7 +227,7 @@ type InMemDEF struct {
 	xyz int
 }
 
-func (client *InMemClient) NewDEF(a int, bs string, car []string, db bool, x int) DEF {
+func (client *InMemJSONClient) NewDEF(a int, bs string, car []string, db bool, x int) DEF {
 	var def = &InMemDEF{
 		ABC: client.NewABC(a, bs, car, db),
 		xyz: x,
@@ -231,6 +235,10 @@ func (client *InMemClient) NewDEF(a int, bs string, car []string, db bool, x int
 	return def
 }
 
+func (client *InMemJSONClient) ReconstituteDEF(a int, bs string, car []string, db bool, x int) DEF {
+	return client.NewDEF(a, bs, car, db, x)
+}
+
 func (def *InMemDEF) getXyz() int {
 	return def.xyz
 }
@@ -244,7 +252,7 @@ func (def *InMemDEF) toJSON() string {
 		res = res + "\"" + s + "\""  // Note - need to replace any quotes in s
 	}
 	res = res + fmt.Sprintf("], \"db\": %s, \"xyz\": %d}",
-		BoolToString(def.getDb()), def.xyz)
+		apitypes.BoolToString(def.getDb()), def.xyz)
 	return res
 }
 
@@ -279,10 +287,10 @@ func AssertThat(testContext *testing.T, condition bool, msg string) bool {
 /*******************************************************************************
  * 
  */
-func AssertErrIsNil(testContext *testing.T, err error, msg string) bool {
+func AssertNoErr(testContext *testing.T, err error, msg string) bool {
 	if err == nil { return true }
 	fmt.Println("Message:", msg)
 	fmt.Println("Original error message:", err.Error())
-	testContext.FailTest()
+	FailTest(testContext)
 	return false
 }
@@ -13,6 +13,8 @@ import (
 	"io"
 	"fmt"
 	"os"
+	"time"
+	"math/rand"
 	//"errors"
 	
 	"safeharbor/apitypes"
@@ -34,8 +36,16 @@ type ReqHandlerFuncType func (*InMemClient, *apitypes.SessionToken, url.Values,
 type Dispatcher struct {
 	server *Server
 	handlers map[string]ReqHandlerFuncType
+	retrySafeHandlers map[string]bool
 }
 
+const (
+	// Maximum number of times that a request is re-run when its transaction
+	// conflicts with another request's transaction.
+	MaxTransactionRetries int = 3
+	TransactionRetryBaseDelay time.Duration = 20 * time.Millisecond
+)
+
 /*******************************************************************************
  * Create a new dispatcher for dispatching to REST handlers. This is often
  * called "muxing", but the implementation here is simpler, clearer and more
@@ -55,16 +65,35 @@ func NewDispatcher() *Dispatcher {
 		"createUser": createUser,
 		"disableUser": disableUser,
 		"reenableUser": reenableUser,
+		"getLockedUsers": getLockedUsers,
+		"unlockUser": unlockUser,
 		"changePassword": changePassword,
+		"verifySecondFactor": verifySecondFactor,
+		"enrollTOTP": enrollTOTP,
+		"confirmTOTPEnrollment": confirmTOTPEnrollment,
+		"regenerateRecoveryCodes": regenerateRecoveryCodes,
+		"disableTOTP": disableTOTP,
+		"resetSecondFactor": resetSecondFactor,
+		"setRealmRequireTOTP": setRealmRequireTOTP,
+		"requestPasswordReset": requestPasswordReset,
+		"resetPassword": resetPassword,
+		"previewEmailTemplate": previewEmailTemplate,
+		"getEmailOutbox": getEmailOutbox,
+		"retryOutboundEmail": retryOutboundEmail,
+		"deleteOutboundEmail": deleteOutboundEmail,
 		"createGroup": createGroup,
 		"deleteGroup": deleteGroup,
 		"getGroupUsers": getGroupUsers,
 		"addGroupUser": addGroupUser,
 		"remGroupUser": remGroupUser,
+		"getSubgroups": getSubgroups,
+		"addSubgroup": addSubgroup,
+		"remSubgroup": remSubgroup,
 		"createRealmAnon": createRealmAnon,
 		"createRealm": createRealm,
 		"getRealmDesc": getRealmDesc,
 		"getRealmByName": getRealmByName,
+		"getRealmUsage": getRealmUsage,
 		"deactivateRealm": deactivateRealm,
 		"moveUserToRealm": moveUserToRealm,
 		"getRealmUsers": getRealmUsers,
@@ -85,6 +114,19 @@ func NewDispatcher() *Dispatcher {
 		"addPermission": addPermission,
 		"remPermission": remPermission,
 		"getPermission": getPermission,
+		"defineRole": defineRole,
+		"updateRole": updateRole,
+		"deleteRole": deleteRole,
+		"getRealmRoles": getRealmRoles,
+		"assignRole": assignRole,
+		"explainAccess": explainAccess,
+		"getResourceAccess": getResourceAccess,
+		"getExpiringPermissions": getExpiringPermissions,
+		"inviteParty": inviteParty,
+		"getRealmInvitations": getRealmInvitations,
+		"acceptInvitation": acceptInvitation,
+		"rejectInvitation": rejectInvitation,
+		"revokeInvitation": revokeInvitation,
 		"getMyDesc": getMyDesc,
 		"getMyGroups": getMyGroups,
 		"getMyRealms": getMyRealms,
@@ -96,6 +138,21 @@ func NewDispatcher() *Dispatcher {
 		"updateScanConfig": updateScanConfig,
 		"scanImage": scanImage,
 		"getUserEvents": getUserEvents,
+		"subscribeToNotifications": subscribeToNotifications,
+		"unsubscribeFromNotifications": unsubscribeFromNotifications,
+		"getMyNotificationSubscriptions": getMyNotificationSubscriptions,
+		"getMyNotifications": getMyNotifications,
+		"markNotificationsRead": markNotificationsRead,
+		"getNotificationPreferences": getNotificationPreferences,
+		"setNotificationPreferences": setNotificationPreferences,
+		"createWebhook": createWebhook,
+		"getWebhooks": getWebhooks,
+		"deleteWebhook": deleteWebhook,
+		"getWebhookDeliveries": getWebhookDeliveries,
+		"redeliverWebhookDelivery": redeliverWebhookDelivery,
+		"createScanSchedule": createScanSchedule,
+		"getScanSchedules": getScanSchedules,
+		"deleteScanSchedule": deleteScanSchedule,
 		"getDockerImageEvents": getDockerImageEvents,
 		"getDockerImageStatus": getDockerImageStatus,
 		"getDockerfileEvents": getDockerfileEvents,
@@ -124,11 +181,114 @@ func NewDispatcher() *Dispatcher {
 		"enableEmailVerification": enableEmailVerification,
 		"useScanConfigForImage": useScanConfigForImage,
 		"stopUsingScanConfigForImage": stopUsingScanConfigForImage,
+		"getObjectCacheStats": getObjectCacheStats,
+	}
+	
+	// Handlers that are known to be safe to re-run if their transaction fails to
+	// commit: those that only read, or that only change the database within
+	// their transaction. A handler that has effects outside of the database -
+	// e.g., that sends email, builds or scans images, writes files, posts to a
+	// webhook, or changes the sessions of this server - is not listed, and is
+	// not re-run; nor is any handler that has not been checked.
+	retrySafe := map[string]bool{
+		"ping": true,
+		"printDatabase": true,
+		"acknowledge": true,
+		"disableUser": true,
+		"reenableUser": true,
+		"getLockedUsers": true,
+		"changePassword": true,
+		"enrollTOTP": true,
+		"regenerateRecoveryCodes": true,
+		"disableTOTP": true,
+		"resetSecondFactor": true,
+		"setRealmRequireTOTP": true,
+		"previewEmailTemplate": true,
+		"getEmailOutbox": true,
+		"deleteOutboundEmail": true,
+		"createGroup": true,
+		"deleteGroup": true,
+		"getGroupUsers": true,
+		"addGroupUser": true,
+		"remGroupUser": true,
+		"getSubgroups": true,
+		"addSubgroup": true,
+		"remSubgroup": true,
+		"getRealmDesc": true,
+		"getRealmByName": true,
+		"getRealmUsage": true,
+		"deactivateRealm": true,
+		"moveUserToRealm": true,
+		"getRealmUsers": true,
+		"getUserDesc": true,
+		"getRealmGroups": true,
+		"getRealmRepos": true,
+		"getAllRealms": true,
+		"getDockerfiles": true,
+		"getDockerImages": true,
+		"setPermission": true,
+		"addPermission": true,
+		"remPermission": true,
+		"getPermission": true,
+		"defineRole": true,
+		"updateRole": true,
+		"deleteRole": true,
+		"getRealmRoles": true,
+		"assignRole": true,
+		"explainAccess": true,
+		"getResourceAccess": true,
+		"getExpiringPermissions": true,
+		"getRealmInvitations": true,
+		"acceptInvitation": true,
+		"rejectInvitation": true,
+		"revokeInvitation": true,
+		"getMyDesc": true,
+		"getMyGroups": true,
+		"getMyRealms": true,
+		"getMyRepos": true,
+		"getMyDockerfiles": true,
+		"getMyDockerImages": true,
+		"getScanProviders": true,
+		"getUserEvents": true,
+		"subscribeToNotifications": true,
+		"unsubscribeFromNotifications": true,
+		"getMyNotificationSubscriptions": true,
+		"getMyNotifications": true,
+		"markNotificationsRead": true,
+		"getNotificationPreferences": true,
+		"setNotificationPreferences": true,
+		"getWebhooks": true,
+		"deleteWebhook": true,
+		"getWebhookDeliveries": true,
+		"createScanSchedule": true,
+		"getScanSchedules": true,
+		"deleteScanSchedule": true,
+		"getDockerImageEvents": true,
+		"getDockerImageStatus": true,
+		"getDockerfileEvents": true,
+		"getGroupDesc": true,
+		"getRepoDesc": true,
+		"getDockerImageDesc": true,
+		"getDockerfileDesc": true,
+		"getScanConfigDesc": true,
+		"getFlagDesc": true,
+		"getFlagImage": true,
+		"getMyScanConfigs": true,
+		"getScanConfigDescByName": true,
+		"getMyFlags": true,
+		"getFlagDescByName": true,
+		"getDockerImageVersions": true,
+		"getEventDesc": true,
+		"userExists": true,
+		"useScanConfigForImage": true,
+		"stopUsingScanConfigForImage": true,
+		"getObjectCacheStats": true,
 	}
 	
 	var dispatcher *Dispatcher = &Dispatcher{
 		server: nil,  // must be filled in by server
 		handlers: hdlrs,
+		retrySafeHandlers: retrySafe,
 	}
 	
 	return dispatcher
@@ -136,7 +296,7 @@ func NewDispatcher() *Dispatcher {
 
 /*******************************************************************************
  * Invoke the method specified by the REST request. This is called by the
- * Server dispatch method.
+ * Server dispatch method, which has already checked the client's rate limit.
  */
 func (dispatcher *Dispatcher) handleRequest(sessionToken *apitypes.SessionToken,
 	headers http.Header, w http.ResponseWriter, reqName string, values url.Values,
@@ -153,6 +313,7 @@ func (dispatcher *Dispatcher) handleRequest(sessionToken *apitypes.SessionToken,
 		fmt.Println("Handler is nil!!!")
 		return
 	}
+	
 	var curdir string
 	var err error
 	curdir, err = os.Getwd()
@@ -164,14 +325,106 @@ func (dispatcher *Dispatcher) handleRequest(sessionToken *apitypes.SessionToken,
 		dispatcher.printHTTPParameters(values)
 	}
 	
-	// Start a transaction.
-	var server = dispatcher.server
-	var inMemClient *InMemClient
-	inMemClient, err = NewInMemClient(server)
+	// Perform the request within a transaction, re-running it if it conflicts
+	// with another request and is safe to re-run.
+	var result apitypes.RespIntfTp
+	result, err = dispatcher.invokeWithRetries(reqName, func() (apitypes.RespIntfTp, error) {
+		return dispatcher.invokeHandlerInTransaction(handler, sessionToken, values, files)
+	})
 	if err != nil {
-		dispatcher.returnSystemErrorResponse(headers, w, err.Error())
+		var conflictErr, isConflict = err.(*TransactionConflictError)
+		if isConflict {
+			var failureDesc = conflictErr.asFailureDesc()
+			http.Error(w, failureDesc.AsJSON(), failureDesc.HTTPStatusCode)
+		} else {
+			dispatcher.returnSystemErrorResponse(headers, w, err.Error())
+		}
 		return
 	}
+	
+	// Detect whether an error occurred.
+	failureDesc, isType := result.(*apitypes.FailureDesc)
+	if isType {
+		fmt.Printf("Error:", failureDesc.HTTPReasonPhrase)
+		http.Error(w, failureDesc.AsJSON(), failureDesc.HTTPStatusCode)
+		return
+	}
+	
+	dispatcher.returnOkResponse(headers, w, result)
+	
+	fmt.Printf("Handled %s\n", reqName)
+}
+
+/*******************************************************************************
+ * Call invoke, which performs the request in a transaction. If the transaction
+ * cannot be committed because another request modified data that this request
+ * read, and if the handler is known to be safe to re-run, then call invoke
+ * again, up to MaxTransactionRetries times. If the request still conflicts, the
+ * TransactionConflictError is returned.
+ */
+func (dispatcher *Dispatcher) invokeWithRetries(reqName string,
+	invoke func() (apitypes.RespIntfTp, error)) (apitypes.RespIntfTp, error) {
+	
+	var retrySafe = dispatcher.retrySafeHandlers[reqName]
+	for attempt := 0; ; attempt++ {
+		var result, err = invoke()
+		if err == nil { return result, nil }
+		var _, isConflict = err.(*TransactionConflictError)
+		if ! isConflict { return nil, err }
+		if (! retrySafe) || (attempt >= MaxTransactionRetries) {
+			fmt.Printf("Giving up on %s after %d attempt(s)\n", reqName, attempt+1)
+			return nil, err
+		}
+		fmt.Printf("Transaction conflict for %s; retrying\n", reqName)
+		time.Sleep(transactionRetryDelay(attempt))
+	}
+}
+
+/*******************************************************************************
+ * Call perform in a new transaction, and then commit the transaction - or abort
+ * it if perform returns an error, or returns false, indicating that it changed
+ * nothing. As for a request (see invokeWithRetries), if the transaction conflicts
+ * with another, perform is called again, in a new transaction, up to
+ * MaxTransactionRetries times, and then the TransactionConflictError is
+ * returned. Since it may be called more than once, perform must have no effects
+ * outside of the database. The description names what is performed, for the log.
+ */
+func (server *Server) performInTransaction(description string,
+	perform func(*InMemClient) (bool, error)) error {
+	
+	for attempt := 0; ; attempt++ {
+		var dbClient, err = NewInMemClient(server)
+		if err != nil { return err }
+		var changed bool
+		changed, err = perform(dbClient)
+		if (err != nil) || ! changed {
+			dbClient.abort()
+			return err
+		}
+		err = dbClient.commit()
+		if err == nil { return nil }
+		var _, isConflict = err.(*TransactionConflictError)
+		if (! isConflict) || (attempt >= MaxTransactionRetries) { return err }
+		fmt.Printf("Transaction conflict for %s; retrying\n", description)
+		time.Sleep(transactionRetryDelay(attempt))
+	}
+}
+
+/*******************************************************************************
+ * Create a new transaction, call the handler within it, and then commit the
+ * transaction - or abort it if the handler returned a FailureDesc. An error is
+ * returned only if the transaction could not be created or committed; a
+ * TransactionConflictError indicates that the handler may be called again.
+ */
+func (dispatcher *Dispatcher) invokeHandlerInTransaction(handler ReqHandlerFuncType,
+	sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) (apitypes.RespIntfTp, error) {
+	
+	// Start a transaction.
+	var inMemClient *InMemClient
+	var err error
+	inMemClient, err = NewInMemClient(dispatcher.server)
+	if err != nil { return nil, err }
 	var inMemClients = []*InMemClient{ inMemClient }
 		// We created an array, because that is the only way to get the defer
 		// statement to defer evaluating inMemClient in the function below:
@@ -186,31 +439,26 @@ func (dispatcher *Dispatcher) handleRequest(sessionToken *apitypes.SessionToken,
 	var result apitypes.RespIntfTp = handler(inMemClients[0], sessionToken, values, files)
 	if result == nil { fmt.Println("result is nil") }
 	
-	// Detect whether an error occurred.
-	failureDesc, isType := result.(*apitypes.FailureDesc)
-	if isType {
-		fmt.Printf("Error:", failureDesc.HTTPReasonPhrase)
-		http.Error(w, failureDesc.AsJSON(), failureDesc.HTTPStatusCode)
-		
-		// Abort transaction.
-		inMemClients[0].abort()
-		inMemClient = nil
-		
-		return
-	}
+	// If an error occurred, the deferred function aborts the transaction.
+	_, isType := result.(*apitypes.FailureDesc)
+	if isType { return result, nil }
 	
 	// Commit transaction.
 	err = inMemClients[0].commit()
 	inMemClients[0] = nil
-	inMemClients = nil
-	if err != nil {
-		dispatcher.returnSystemErrorResponse(headers, w, err.Error())
-		return
-	}
+	if err != nil { return nil, err }
 	
-	dispatcher.returnOkResponse(headers, w, result)
-	
-	fmt.Printf("Handled %s\n", reqName)
+	return result, nil
+}
+
+/*******************************************************************************
+ * Return the time to wait before the specified retry attempt (zero-based). The
+ * delay doubles with each attempt, and is randomized so that requests that
+ * conflicted with each other do not simply collide again.
+ */
+func transactionRetryDelay(attempt int) time.Duration {
+	var max = TransactionRetryBaseDelay << uint(attempt)
+	return max/2 + time.Duration(rand.Int63n(int64(max/2) + 1))
 }
 
 /*******************************************************************************
@@ -306,6 +554,21 @@ func (dispatcher *Dispatcher) respondNoSuchMethod(headers http.Header,
 	fmt.Println(msg)
 }
 
+/*******************************************************************************
+ * Respond with StatusTooManyRequests, and a Retry-After header giving the
+ * number of seconds (rounded up) that the client should wait.
+ */
+func (dispatcher *Dispatcher) respondTooManyRequests(writer http.ResponseWriter,
+	methodName string, retryAfter time.Duration) {
+	
+	var seconds = int64((retryAfter + time.Second - 1) / time.Second)
+	writer.Header().Set("Retry-After", fmt.Sprintf("%d", seconds))
+	var failureDesc = apitypes.NewFailureDesc(http.StatusTooManyRequests, fmt.Sprintf(
+		"Rate limit exceeded for %s; retry after %d seconds", methodName, seconds))
+	http.Error(writer, failureDesc.AsJSON(), failureDesc.HTTPStatusCode)
+	fmt.Println(failureDesc.HTTPReasonPhrase)
+}
+
 /*******************************************************************************
  * 
  */
@@ -0,0 +1,48 @@
+package server
+
+
+import (
+	"net/http"
+	"testing"
+	
+	"safeharbor/apitypes"
+)
+
+func Test_OnlyRetrySafeRequestsAreRetriedOnConflict(testContext *testing.T) {
+	
+	var dispatcher = NewDispatcher()
+	var calls int
+	var conflictUntil int
+	var invoke = func() (apitypes.RespIntfTp, error) {
+		calls++
+		if calls <= conflictUntil { return nil, NewTransactionConflictError("conflict") }
+		return apitypes.NewResult(200, "done"), nil
+	}
+	
+	// A request that conflicts once is re-run, and succeeds.
+	calls, conflictUntil = 0, 1
+	var result, err = dispatcher.invokeWithRetries("createGroup", invoke)
+	if err != nil { testContext.Fatal(err) }
+	if (result == nil) || (calls != 2) { testContext.Errorf("Expected 2 calls, but there were %d", calls) }
+	
+	// A request that always conflicts is given up on, with a 409.
+	calls, conflictUntil = 0, 100
+	_, err = dispatcher.invokeWithRetries("createGroup", invoke)
+	if calls != MaxTransactionRetries + 1 {
+		testContext.Errorf("Expected %d calls, but there were %d", MaxTransactionRetries + 1, calls)
+	}
+	var conflictErr, isConflict = err.(*TransactionConflictError)
+	if ! isConflict { testContext.Fatalf("Expected a TransactionConflictError, but got %v", err) }
+	if conflictErr.asFailureDesc().HTTPStatusCode != http.StatusConflict {
+		testContext.Error("Expected a conflict to be reported as a 409")
+	}
+	
+	// A request that is not known to be safe to re-run is not re-run.
+	for _, reqName := range []string{ "createRepo", "inviteParty", "unlockUser", "noSuchRequest" } {
+		calls, conflictUntil = 0, 1
+		_, err = dispatcher.invokeWithRetries(reqName, invoke)
+		if _, isConflict = err.(*TransactionConflictError); (! isConflict) || (calls != 1) {
+			testContext.Errorf("Expected %s to be attempted once, but it was attempted %d times", reqName, calls)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+/*******************************************************************************
+ * The email outbox. Messages are not sent by the request that produces them:
+ * instead, each is stored as an OutboundEmail in the outbox of a realm (see
+ * Persistence.getOutboundEmailIds), in the request's transaction, so that a
+ * message is sent if and only if the request commits, and a request does not
+ * fail because the mail server is unavailable.
+ * A background worker sends the messages that are due, every
+ * EMAIL_OUTBOX_POLL_INTERVAL seconds. A message that cannot be sent is retried
+ * after EmailRetryInitialDelay, then after twice as long each time, up to
+ * EmailRetryMaxDelay, until MaxEmailDeliveryAttempts attempts have failed; it
+ * then remains in the outbox, as failed, until an administrator of the realm
+ * retries or deletes it (see the getEmailOutbox handler).
+ *
+ * Several servers may share the database. Before sending a message, a worker
+ * claims the attempt to send it, by setting a key (see Persistence.claimKey), and
+ * then records the claim, in a transaction, for EmailSendClaimDuration; if the
+ * worker fails to record the outcome, another worker sends it once the claim
+ * lapses. A message is therefore sent at least once, and occasionally more than
+ * once.
+ *
+ * The messages are sent by the EmailDriver that is configured by the EmailService
+ * entry of the configuration: the SMTP service (see utilities.EmailService) by
+ * default, or, if its Driver is "maildir", a MaildirEmailDriver, which writes
+ * each message to a file, so that development and test environments can capture
+ * messages without a mail server.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	
+	"utilities"
+)
+
+const (
+	DefaultEmailOutboxPollInterval = 10  // seconds
+	MaxEmailDeliveryAttempts = 8
+	EmailRetryInitialDelay = 30 * time.Second
+	EmailRetryMaxDelay = time.Hour
+	EmailSendClaimDuration = 2 * time.Minute
+	EmailSendClaimKeyPrefix = "SafeHarbor/OutboundEmailSend/"
+)
+
+/*******************************************************************************
+ * A means of sending email.
+ */
+type EmailDriver interface {
+	SendEmail(address, subject, textMessage, htmlMessage string) error
+}
+
+var _ EmailDriver = (*utilities.EmailService)(nil)
+
+/*******************************************************************************
+ * Add a message, rendered from a template, to the outbox of the realm. If no
+ * EmailDriver is configured, the message is discarded.
+ */
+func queueEmail(dbClient DBClient, realmId, address string, email *RenderedEmail) error {
+	
+	if dbClient.getServer().EmailDriver == nil {
+		fmt.Println("Email is not configured; not sending '" + email.Subject + "' to " + address)
+		return nil
+	}
+	var _, err = dbClient.dbCreateOutboundEmail(realmId, address, email.Subject,
+		email.TextMessage, email.HTMLMessage)
+	return err
+}
+
+/*******************************************************************************
+ * Return how long to wait before the next attempt to send a message, after the
+ * specified number of failed attempts.
+ */
+func getEmailRetryDelay(attempts int) time.Duration {
+	
+	var delay = EmailRetryInitialDelay
+	for i := 1; i < attempts; i++ {
+		delay = delay * 2
+		if delay >= EmailRetryMaxDelay { return EmailRetryMaxDelay }
+	}
+	return delay
+}
+
+/*******************************************************************************
+ * Send the messages that are due, every EmailOutboxPollInterval seconds, until
+ * the process exits.
+ */
+func (server *Server) deliverQueuedEmailPeriodically() {
+	
+	var interval = server.Config.EmailOutboxPollInterval
+	if interval <= 0 { interval = DefaultEmailOutboxPollInterval }
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		var count, err = server.deliverQueuedEmail()
+		if err != nil { fmt.Println("While sending queued email: " + err.Error()) }
+		if count > 0 { fmt.Println(fmt.Sprintf("Sent %d queued email messages", count)) }
+	}
+}
+
+/*******************************************************************************
+ * Attempt to send each message, of any realm, that is due, and return the number
+ * sent. A realm whose messages cannot be sent is logged and skipped.
+ */
+func (server *Server) deliverQueuedEmail() (int, error) {
+	
+	var dbClient *InMemClient
+	var err error
+	dbClient, err = NewInMemClient(server)
+	if err != nil { return 0, err }
+	var realmIds []string
+	realmIds, err = dbClient.dbGetAllRealmIds()
+	dbClient.abort()
+	if err != nil { return 0, err }
+	
+	var total = 0
+	for _, realmId := range realmIds {
+		var count int
+		count, err = server.deliverQueuedEmailForRealm(realmId, time.Now())
+		if err != nil {
+			fmt.Println("While sending queued email of realm " + realmId + ": " + err.Error())
+			continue
+		}
+		total = total + count
+	}
+	return total, nil
+}
+
+/*******************************************************************************
+ * Claim the realm's messages that are due as of now, send them, and record the
+ * outcomes. Return the number sent.
+ */
+func (server *Server) deliverQueuedEmailForRealm(realmId string, now time.Time) (int, error) {
+	
+	var claimed []OutboundEmail
+	var err error
+	claimed, err = server.claimDueEmail(realmId, now)
+	if err != nil { return 0, err }
+	if len(claimed) == 0 { return 0, nil }
+	
+	var sendErrs = make([]error, len(claimed))
+	var count = 0
+	for i, email := range claimed {
+		sendErrs[i] = server.EmailDriver.SendEmail(email.getAddress(), email.getSubject(),
+			email.getTextMessage(), email.getHTMLMessage())
+		if sendErrs[i] == nil { count++ }
+	}
+	
+	err = server.performInTransaction("email delivery outcomes", func(dbClient *InMemClient) (bool, error) {
+		return true, recordEmailDeliveryOutcomes(dbClient, claimed, sendErrs, time.Now())
+	})
+	return count, err
+}
+
+/*******************************************************************************
+ * Claim each of the realm's messages that is due, and return those claimed. The
+ * attempt to send a message is claimed with a key that expires with the claim,
+ * so that, of several servers that find the message due at the same time, only
+ * one sends it; the claims are then recorded in a transaction.
+ */
+func (server *Server) claimDueEmail(realmId string, now time.Time) ([]OutboundEmail, error) {
+	
+	var keyClaimed = make(map[string]bool)  // keys that this server has set
+	var claimed []OutboundEmail
+	var err = server.performInTransaction("email claims", func(dbClient *InMemClient) (bool, error) {
+		claimed = make([]OutboundEmail, 0)
+		var emailIds, err = dbClient.getOutboundEmailIds(realmId)
+		if err != nil { return false, err }
+		for _, emailId := range emailIds {
+			var email OutboundEmail
+			email, err = dbClient.getOutboundEmail(emailId)
+			if err != nil { continue }  // dangling Id
+			var isClaimed bool
+			isClaimed, err = server.claimQueuedSend(dbClient, email, EmailSendClaimKeyPrefix,
+				EmailSendClaimDuration, now, keyClaimed)
+			if err != nil { return false, err }
+			if isClaimed { claimed = append(claimed, email) }
+		}
+		return len(claimed) > 0, nil
+	})
+	if err != nil { return nil, err }
+	return claimed, nil
+}
+
+/*******************************************************************************
+ * A message or webhook delivery that is queued to be sent.
+ */
+type queuedSend interface {
+	getId() string
+	getAttempts() int
+	isDue(time.Time) bool
+	claim(DBClient, time.Time) error
+}
+
+/*******************************************************************************
+ * If the queued message or delivery is due, claim the attempt to send it, with a
+ * key - the prefix, the Id and the number of attempts - that expires with the
+ * claim, and record the claim. Return false if it is not due, or if another
+ * server has claimed it. keyClaimed records the keys that this server has set,
+ * so that the claim is not refused if the transaction is performed again.
+ */
+func (server *Server) claimQueuedSend(dbClient DBClient, item queuedSend, keyPrefix string,
+	claimDuration time.Duration, now time.Time, keyClaimed map[string]bool) (bool, error) {
+	
+	if ! item.isDue(now) { return false, nil }
+	var keyname = keyPrefix + item.getId() + "/" + strconv.Itoa(item.getAttempts())
+	if ! keyClaimed[keyname] {
+		var err error
+		keyClaimed[keyname], err = server.persistence.claimKey(keyname, int(claimDuration / time.Second))
+		if err != nil { return false, err }
+		if ! keyClaimed[keyname] { return false, nil }  // another server is sending it
+	}
+	return true, item.claim(dbClient, now.Add(claimDuration))
+}
+
+/*******************************************************************************
+ * Delete each message that was sent, and schedule the next attempt to send each
+ * that was not - unless it has been attempted MaxEmailDeliveryAttempts times, in
+ * which case it is marked as failed. A message that was deleted or retried by an
+ * administrator while it was being sent is left as it is.
+ */
+func recordEmailDeliveryOutcomes(dbClient DBClient, claimed []OutboundEmail, sendErrs []error,
+	now time.Time) error {
+	
+	for i, claimedEmail := range claimed {
+		var email OutboundEmail
+		var err error
+		email, err = dbClient.getOutboundEmail(claimedEmail.getId())
+		if err != nil { continue }  // deleted
+		if email.getStatus() != OutboundEmailSending { continue }  // retried
+		if sendErrs[i] == nil {
+			err = dbClient.dbDeleteOutboundEmail(email)
+		} else {
+			var nextAttemptTime time.Time
+			if email.getAttempts() < MaxEmailDeliveryAttempts {
+				nextAttemptTime = now.Add(getEmailRetryDelay(email.getAttempts()))
+			}
+			err = email.recordFailure(dbClient, sendErrs[i].Error(), nextAttemptTime)
+		}
+		if err != nil { return err }
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * An EmailDriver that writes each message, in Internet Message Format, to the
+ * new subdirectory of a maildir (see https://cr.yp.to/proto/maildir.html), where
+ * mail clients and tests can read it.
+ */
+type MaildirEmailDriver struct {
+	Directory string
+	From string
+	hostname string
+	count int64  // messages written, so that file names are unique
+}
+
+var _ EmailDriver = &MaildirEmailDriver{}
+
+func NewMaildirEmailDriver(directory, from string) (*MaildirEmailDriver, error) {
+	
+	if directory == "" { return nil, utilities.ConstructServerError(
+		"A Directory is required for the maildir email driver") }
+	for _, subdir := range []string{ "tmp", "new", "cur" } {
+		var err = os.MkdirAll(filepath.Join(directory, subdir), 0700)
+		if err != nil { return nil, err }
+	}
+	var hostname, err = os.Hostname()
+	if err != nil { hostname = "localhost" }
+	if from == "" { from = "SafeHarbor <safeharbor@" + hostname + ">" }
+	return &MaildirEmailDriver{
+		Directory: directory,
+		From: from,
+		hostname: hostname,
+	}, nil
+}
+
+/*******************************************************************************
+ * Write the message to a file in tmp, and then move it to new, so that a reader
+ * never sees a partial message. An address that contains a line break, which
+ * would add headers to the message, is rejected; the subject is encoded as an
+ * RFC 2047 encoded-word if it contains a line break or any non-ASCII character.
+ */
+func (driver *MaildirEmailDriver) SendEmail(address, subject, textMessage,
+	htmlMessage string) error {
+	
+	if strings.ContainsAny(address, "\r\n") { return utilities.ConstructUserError(
+		"Email address " + strconv.Quote(address) + " contains a line break") }
+	var now = time.Now()
+	var uniqueName = fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000,
+		os.Getpid(), atomic.AddInt64(&driver.count, 1), driver.hostname)
+	
+	var body bytes.Buffer
+	var writer = multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{ "text/plain; charset=utf-8", textMessage },
+		{ "text/html; charset=utf-8", htmlMessage } } {
+		var partWriter, err = writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": { part.contentType },
+			"Content-Transfer-Encoding": { "8bit" },
+		})
+		if err != nil { return err }
+		_, err = partWriter.Write([]byte(part.content))
+		if err != nil { return err }
+	}
+	var err = writer.Close()
+	if err != nil { return err }
+	
+	var message = "From: " + driver.From + "\r\n" +
+		"To: " + address + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Date: " + now.Format(time.RFC1123Z) + "\r\n" +
+		"Message-ID: <" + uniqueName + "@" + driver.hostname + ">\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=" + writer.Boundary() + "\r\n" +
+		"\r\n" + body.String()
+	
+	var tmpPath = filepath.Join(driver.Directory, "tmp", uniqueName)
+	err = ioutil.WriteFile(tmpPath, []byte(message), 0600)
+	if err != nil { return err }
+	return os.Rename(tmpPath, filepath.Join(driver.Directory, "new", uniqueName))
+}
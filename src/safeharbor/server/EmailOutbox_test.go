@@ -0,0 +1,119 @@
+package server
+
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type stubEmailDriver struct {
+	err error
+	sent int
+}
+
+func (driver *stubEmailDriver) SendEmail(address, subject, textMessage, htmlMessage string) error {
+	if driver.err != nil { return driver.err }
+	driver.sent++
+	return nil
+}
+
+func getOutboxIds(testContext *testing.T, f *testDB) []string {
+	var emailIds, err = f.client.getOutboundEmailIds(f.realm.getId())
+	if err != nil { testContext.Fatal(err) }
+	return emailIds
+}
+
+func Test_EmailOutboxRetriesUntilSent(testContext *testing.T) {
+	
+	var f = newTestDB(testContext)
+	var stub = &stubEmailDriver{ err: errors.New("connection refused") }
+	f.server.EmailDriver = stub
+	var err = queueEmail(f.client, f.realm.getId(), "jdoe@example.com", &RenderedEmail{
+		Subject: "Hello", TextMessage: "Hello, world", HTMLMessage: "<p>Hello, world</p>" })
+	if err != nil { testContext.Fatal(err) }
+	var emailIds = getOutboxIds(testContext, f)
+	if len(emailIds) != 1 { testContext.Fatalf("Expected one queued message, but found %d", len(emailIds)) }
+	
+	var now = time.Now()
+	var count int
+	count, err = f.server.deliverQueuedEmailForRealm(f.realm.getId(), now)
+	if err != nil { testContext.Fatal(err) }
+	var email OutboundEmail
+	email, err = f.client.getOutboundEmail(emailIds[0])
+	if err != nil { testContext.Fatal(err) }
+	if (count != 0) || (email.getStatus() != OutboundEmailPending) || (email.getAttempts() != 1) ||
+		email.isDue(now) {
+		testContext.Errorf("Expected a failed attempt to be retried later, but status is %s after %d attempts",
+			email.getStatus(), email.getAttempts())
+	}
+	
+	// Deliver to a maildir once the retry is due.
+	var dir = testContext.TempDir()
+	f.server.EmailDriver, err = NewMaildirEmailDriver(dir, "")
+	if err != nil { testContext.Fatal(err) }
+	count, err = f.server.deliverQueuedEmailForRealm(f.realm.getId(), now.Add(EmailRetryInitialDelay + time.Minute))
+	if err != nil { testContext.Fatal(err) }
+	if (count != 1) || (len(getOutboxIds(testContext, f)) != 0) {
+		testContext.Error("Expected the message to be sent and removed from the outbox")
+	}
+	var files []string
+	files, err = filepath.Glob(filepath.Join(dir, "new", "*"))
+	if err != nil { testContext.Fatal(err) }
+	if len(files) != 1 { testContext.Fatalf("Expected one message in the maildir, but found %d", len(files)) }
+	var content []byte
+	content, err = ioutil.ReadFile(files[0])
+	if err != nil { testContext.Fatal(err) }
+	if (! strings.Contains(string(content), "To: jdoe@example.com\r\n")) ||
+		(! strings.Contains(string(content), "Subject: Hello\r\n")) ||
+		(! strings.Contains(string(content), "<p>Hello, world</p>")) {
+		testContext.Errorf("Unexpected message: %s", string(content))
+	}
+	
+	// A message that can never be sent is eventually marked as failed.
+	f.server.EmailDriver = stub
+	err = queueEmail(f.client, f.realm.getId(), "jdoe@example.com", &RenderedEmail{ Subject: "Again" })
+	if err != nil { testContext.Fatal(err) }
+	var emailId = getOutboxIds(testContext, f)[0]
+	for i := 1; i <= MaxEmailDeliveryAttempts + 1; i++ {
+		_, err = f.server.deliverQueuedEmailForRealm(f.realm.getId(), now.Add(time.Duration(i) * EmailRetryMaxDelay))
+		if err != nil { testContext.Fatal(err) }
+	}
+	email, err = f.client.getOutboundEmail(emailId)
+	if err != nil { testContext.Fatal(err) }
+	if (email.getStatus() != OutboundEmailFailed) || (email.getAttempts() != MaxEmailDeliveryAttempts) {
+		testContext.Errorf("Expected the message to fail after %d attempts, but status is %s after %d",
+			MaxEmailDeliveryAttempts, email.getStatus(), email.getAttempts())
+	}
+	err = email.retry(f.client)
+	if err != nil { testContext.Fatal(err) }
+	stub.err = nil
+	count, err = f.server.deliverQueuedEmailForRealm(f.realm.getId(), time.Now())
+	if err != nil { testContext.Fatal(err) }
+	if (count != 1) || (stub.sent != 1) { testContext.Error("Expected the retried message to be sent") }
+}
+
+func Test_MaildirEmailDriverDoesNotLetHeadersBeInjected(testContext *testing.T) {
+	
+	var dir = testContext.TempDir()
+	var driver, err = NewMaildirEmailDriver(dir, "")
+	if err != nil { testContext.Fatal(err) }
+	err = driver.SendEmail("jdoe@example.com\r\nBcc: mallory@example.com", "Hello", "", "")
+	if err == nil { testContext.Error("Expected an address with a line break to be rejected") }
+	err = driver.SendEmail("jdoe@example.com", "Hello\r\nBcc: mallory@example.com", "", "")
+	if err != nil { testContext.Fatal(err) }
+	
+	var files []string
+	files, err = filepath.Glob(filepath.Join(dir, "new", "*"))
+	if err != nil { testContext.Fatal(err) }
+	if len(files) != 1 { testContext.Fatalf("Expected one message in the maildir, but found %d", len(files)) }
+	var content []byte
+	content, err = ioutil.ReadFile(files[0])
+	if err != nil { testContext.Fatal(err) }
+	if strings.Contains(string(content), "\r\nBcc:") || ! strings.Contains(string(content), "Subject: =?utf-8?q?") {
+		testContext.Errorf("Expected the subject to be encoded, but the message is: %s", string(content))
+	}
+}
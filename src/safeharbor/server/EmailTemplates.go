@@ -0,0 +1,310 @@
+/*******************************************************************************
+ * Templates for the email messages that SafeHarbor sends. Each template has
+ * three parts - a subject, a text body, and an HTML body - and each part is a Go
+ * template (see https://golang.org/pkg/text/template), which is executed with a
+ * map of variables: the subject and text body with text/template, and the HTML
+ * body with html/template, so that values are escaped.
+ *
+ * Every template has a built-in English version. To override a part, place a file
+ * named <template>.<locale>.<part>, or <template>.<part> for all locales, in the
+ * directory EMAIL_TEMPLATE_DIRECTORY, or in its subdirectory realms/<realm name>
+ * to override it for one realm only; <part> is subject, txt, or html. A part is
+ * taken from the first of these that exists, trying the user's locale, then its
+ * language alone (e.g., fr-CA, then fr), then DEFAULT_LOCALE, then no locale; for
+ * each locale the realm's directory is tried before the server's.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+	"time"
+	
+	"utilities"
+)
+
+const (
+	DefaultLocale = "en"
+	
+	// The names of the system email templates.
+	VerifyEmailTemplate = "verify-email"
+	ResetPasswordTemplate = "reset-password"
+	AccountLockedTemplate = "account-locked"
+)
+
+var localePattern = regexp.MustCompile("^[A-Za-z]{2,8}([-_][A-Za-z0-9]{1,8})*$")
+
+type emailTemplateParts struct {
+	subject string
+	txt string
+	html string
+}
+
+var builtInEmailTemplates = map[string]*emailTemplateParts{
+	VerifyEmailTemplate: &emailTemplateParts{
+		subject: "Verify address",
+		txt: "In your browser, go to {{.ConfirmationURL}} to confirm your email address",
+		html: "Click <a href=\"{{.ConfirmationURL}}\">here</a> to confirm your email address. " +
+			"This enables SafeHarbor to verify your identity, and protects you " +
+			"from others who might try to register using your email address.",
+	},
+	ResetPasswordTemplate: &emailTemplateParts{
+		subject: "Reset password",
+		txt: "A new password was requested for the SafeHarbor account {{.UserId}}. To choose one, " +
+			"submit the token below, with your new password, within {{.LifespanInMinutes}} minutes. " +
+			"If you did not request a new password, you may ignore this message.\n\n{{.Token}}",
+		html: "A new password was requested for the SafeHarbor account <b>{{.UserId}}</b>. To choose one, " +
+			"submit the token below, with your new password, within {{.LifespanInMinutes}} minutes. " +
+			"If you did not request a new password, you may ignore this message.<p><code>{{.Token}}</code></p>",
+	},
+	AccountLockedTemplate: &emailTemplateParts{
+		subject: "SafeHarbor account locked",
+		txt: "After repeated failed attempts to log in as {{.LockedUserId}}, the account has been " +
+			"locked until {{.LockedUntil}}. If these attempts were not made by the account's owner, " +
+			"someone may be trying to guess the password.",
+		html: "After repeated failed attempts to log in as <b>{{.LockedUserId}}</b>, the account has been " +
+			"locked until {{.LockedUntil}}. If these attempts were not made by the account's owner, " +
+			"someone may be trying to guess the password.",
+	},
+	NotificationTemplate: &emailTemplateParts{
+		subject: "SafeHarbor: {{.Subject}}",
+		txt: "{{.Message}}\n\nTo change which notifications you receive, or how, go to {{.PublicURL}}.",
+		html: "<p>{{.Message}}</p><p>To change which notifications you receive, or how, go to " +
+			"<a href=\"{{.PublicURL}}\">SafeHarbor</a>.</p>",
+	},
+	NotificationDigestTemplate: &emailTemplateParts{
+		subject: "SafeHarbor: {{.Count}} notifications",
+		txt: "{{range .Notifications}}{{.Subject}} ({{.Time}})\n{{.Message}}\n\n{{end}}" +
+			"To change which notifications you receive, or how, go to {{.PublicURL}}.",
+		html: "<ul>{{range .Notifications}}<li><b>{{.Subject}}</b> ({{.Time}})<br>{{.Message}}</li>{{end}}</ul>" +
+			"<p>To change which notifications you receive, or how, go to " +
+			"<a href=\"{{.PublicURL}}\">SafeHarbor</a>.</p>",
+	},
+}
+
+/*******************************************************************************
+ * A message produced from a template, ready to be passed to SendEmail.
+ */
+type RenderedEmail struct {
+	Subject string
+	TextMessage string
+	HTMLMessage string
+}
+
+/*******************************************************************************
+ * Return the locale in canonical form - e.g., "fr-CA" for "fr_ca" - or a user
+ * error if it is not a well formed locale. The empty string is returned as is.
+ */
+func normalizeLocale(locale string) (string, error) {
+	
+	if locale == "" { return "", nil }
+	if ! localePattern.MatchString(locale) { return "", utilities.ConstructUserError(
+		"Locale " + locale + " is not of the form language[-region], e.g., en-US") }
+	var subtags = strings.Split(strings.Replace(locale, "_", "-", -1), "-")
+	subtags[0] = strings.ToLower(subtags[0])
+	for i := 1; i < len(subtags); i++ {
+		switch len(subtags[i]) {
+			case 2: subtags[i] = strings.ToUpper(subtags[i])  // region
+			case 4: subtags[i] = strings.ToUpper(subtags[i][0:1]) + strings.ToLower(subtags[i][1:])  // script
+			default: subtags[i] = strings.ToLower(subtags[i])
+		}
+	}
+	return strings.Join(subtags, "-"), nil
+}
+
+/*******************************************************************************
+ * Return the locales to try, most preferred first, ending with "" (no locale).
+ */
+func getLocaleCandidates(server *Server, locale string) []string {
+	
+	var candidates = make([]string, 0)
+	var add = func(loc string) {
+		loc, _ = normalizeLocale(loc)
+		for loc != "" {
+			var found = false
+			for _, c := range candidates { if c == loc { found = true } }
+			if ! found { candidates = append(candidates, loc) }
+			var i = strings.LastIndex(loc, "-")
+			if i < 0 { break }
+			loc = loc[0:i]
+		}
+	}
+	add(locale)
+	var defaultLocale = server.Config.DefaultLocale
+	if defaultLocale == "" { defaultLocale = DefaultLocale }
+	add(defaultLocale)
+	return append(candidates, "")
+}
+
+/*******************************************************************************
+ * Return the text of one part of the template, following the search order
+ * described at the top of this file.
+ */
+func getEmailTemplatePart(server *Server, templateName, realmName, locale,
+	part string) (string, error) {
+	
+	var builtIn = builtInEmailTemplates[templateName]
+	if builtIn == nil { return "", utilities.ConstructUserError(
+		"Unrecognized email template: " + templateName) }
+	
+	var dir = server.Config.EmailTemplateDirectory
+	if dir != "" {
+		var dirs = []string{ dir }
+		// A realm name that is not a plain file name is not used as a path.
+		if (realmName != "") && (filepath.Base(realmName) == realmName) &&
+			(! strings.HasPrefix(realmName, ".")) {
+			dirs = []string{ filepath.Join(dir, "realms", realmName), dir }
+		}
+		for _, loc := range getLocaleCandidates(server, locale) {
+			var fileName = templateName + "." + part
+			if loc != "" { fileName = templateName + "." + loc + "." + part }
+			for _, d := range dirs {
+				var content, err = ioutil.ReadFile(filepath.Join(d, fileName))
+				if err == nil { return string(content), nil }
+				if ! os.IsNotExist(err) { return "", err }
+			}
+		}
+	}
+	
+	switch part {
+		case "subject": return builtIn.subject, nil
+		case "txt": return builtIn.txt, nil
+		default: return builtIn.html, nil
+	}
+}
+
+/*******************************************************************************
+ * Produce the message from the template that is appropriate to the realm and
+ * locale. A variable that a template refers to but that is not in vars is an
+ * error, so that a mistyped variable name is reported by previewEmailTemplate
+ * rather than sent.
+ */
+func renderEmail(server *Server, templateName, realmName, locale string,
+	vars map[string]interface{}) (*RenderedEmail, error) {
+	
+	var email = &RenderedEmail{}
+	var source string
+	var buf bytes.Buffer
+	var err error
+	
+	for _, part := range []string{ "subject", "txt" } {
+		source, err = getEmailTemplatePart(server, templateName, realmName, locale, part)
+		if err != nil { return nil, err }
+		var tmpl *texttemplate.Template
+		tmpl, err = texttemplate.New(templateName + "." + part).Option("missingkey=error").Parse(source)
+		if err != nil { return nil, utilities.ConstructServerError(
+			"In email template " + templateName + "." + part + ": " + err.Error()) }
+		buf.Reset()
+		err = tmpl.Execute(&buf, vars)
+		if err != nil { return nil, utilities.ConstructServerError(
+			"In email template " + templateName + "." + part + ": " + err.Error()) }
+		if part == "subject" {
+			email.Subject = strings.TrimSpace(buf.String())
+		} else {
+			email.TextMessage = buf.String()
+		}
+	}
+	
+	source, err = getEmailTemplatePart(server, templateName, realmName, locale, "html")
+	if err != nil { return nil, err }
+	var htmlTmpl *htmltemplate.Template
+	htmlTmpl, err = htmltemplate.New(templateName + ".html").Option("missingkey=error").Parse(source)
+	if err != nil { return nil, utilities.ConstructServerError(
+		"In email template " + templateName + ".html: " + err.Error()) }
+	buf.Reset()
+	err = htmlTmpl.Execute(&buf, vars)
+	if err != nil { return nil, utilities.ConstructServerError(
+		"In email template " + templateName + ".html: " + err.Error()) }
+	email.HTMLMessage = buf.String()
+	
+	return email, nil
+}
+
+/*******************************************************************************
+ * Return the variables that every template may use, for a message to the user.
+ * Each template adds its own: see getSampleEmailVariables.
+ */
+func newEmailVariables(server *Server, user User, realmName string) map[string]interface{} {
+	return map[string]interface{}{
+		"ServiceName": "SafeHarbor",
+		"PublicURL": server.GetBasePublicURL(),
+		"UserId": user.getUserId(),
+		"UserName": user.getName(),
+		"RealmName": realmName,
+	}
+}
+
+/*******************************************************************************
+ * Render the template for the user, in the user's locale, and add the message,
+ * addressed to the specified address, to the outbox of the user's realm (see
+ * EmailOutbox.go).
+ */
+func queueTemplatedEmail(dbClient DBClient, address string, templateName string,
+	user User, realmName string, vars map[string]interface{}) error {
+	
+	var email *RenderedEmail
+	var err error
+	email, err = renderEmail(dbClient.getServer(), templateName, realmName, user.getLocale(), vars)
+	if err != nil { return err }
+	return queueEmail(dbClient, user.getRealmId(), address, email)
+}
+
+/*******************************************************************************
+ * Return the name of the user's realm, or "" if it cannot be determined, in
+ * which case the server's templates are used.
+ */
+func getRealmNameForEmail(dbClient DBClient, user User) string {
+	
+	var realm, err = dbClient.getRealm(user.getRealmId())
+	if err != nil {
+		fmt.Println("While identifying the realm of user " + user.getUserId() + ": " + err.Error())
+		return ""
+	}
+	return realm.getName()
+}
+
+/*******************************************************************************
+ * Return variables with which to preview the template, for a message to the user.
+ */
+func getSampleEmailVariables(server *Server, templateName string, user User,
+	realmName string) map[string]interface{} {
+	
+	var vars = newEmailVariables(server, user, realmName)
+	var sampleToken = "SAMPLE-TOKEN"
+	switch templateName {
+		case VerifyEmailTemplate:
+			vars["ConfirmationURL"] = constructConfirmationURL(server, sampleToken)
+		case ResetPasswordTemplate:
+			vars["Token"] = sampleToken
+			vars["LifespanInMinutes"] = PasswordResetTokenLifespanInMinutes
+		case AccountLockedTemplate:
+			vars["LockedUserId"] = user.getUserId()
+			vars["LockedUntil"] = time.Now().Add(InitialLockoutDuration).Format(time.RFC1123)
+		case NotificationTemplate:
+			vars["Subject"] = "Scan of myrepo/myimage failed"
+			vars["Message"] = "The scan of myrepo/myimage with scan config myscan failed: timeout"
+			vars["EventType"] = ScanFailedNotification
+		case NotificationDigestTemplate:
+			vars["Notifications"] = []map[string]interface{}{
+				{
+					"Subject": "New critical vulnerabilities in myrepo/myimage",
+					"Message": "The scan of myrepo/myimage with scan config myscan found critical " +
+						"vulnerabilities that were not found before: CVE-2016-0001.",
+					"EventType": NewCriticalVulnerabilityNotification,
+					"Time": time.Now().Format(time.RFC1123),
+				},
+			}
+			vars["Count"] = 1
+	}
+	return vars
+}
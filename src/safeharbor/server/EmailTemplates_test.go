@@ -0,0 +1,72 @@
+package server
+
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_EmailTemplatesAreSelectedByRealmAndLocale(testContext *testing.T) {
+	
+	var f = newTestDB(testContext)
+	var dir = testContext.TempDir()
+	f.server.Config.EmailTemplateDirectory = dir
+	f.server.Config.DefaultLocale = "en"
+	var realmDir = filepath.Join(dir, "realms", f.realm.getName())
+	var err = os.MkdirAll(realmDir, 0700)
+	if err != nil { testContext.Fatal(err) }
+	var files = map[string]string{
+		filepath.Join(dir, "reset-password.fr.subject"): "Nouveau mot de passe",
+		filepath.Join(dir, "reset-password.fr.txt"): "Bonjour {{.UserName}}: {{.Token}}",
+		filepath.Join(dir, "reset-password.en.html"): "<p>{{.UserName}}</p>",
+		filepath.Join(realmDir, "reset-password.fr-CA.txt"): "Allo {{.UserName}}: {{.Token}}",
+		filepath.Join(dir, "account-locked.txt"): "{{.Misspelled}}",
+	}
+	for path, content := range files {
+		err = ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil { testContext.Fatal(err) }
+	}
+	
+	var vars = newEmailVariables(f.server, f.user, f.realm.getName())
+	vars["UserName"] = "<Jane>"
+	vars["Token"] = "T"
+	vars["LifespanInMinutes"] = PasswordResetTokenLifespanInMinutes
+	
+	var email *RenderedEmail
+	email, err = renderEmail(f.server, ResetPasswordTemplate, f.realm.getName(), "fr_ca", vars)
+	if err != nil { testContext.Fatal(err) }
+	if (email.Subject != "Nouveau mot de passe") || (email.TextMessage != "Allo <Jane>: T") ||
+		(email.HTMLMessage != "<p>&lt;Jane&gt;</p>") {
+		testContext.Errorf("Expected the realm's fr-CA text, the server's fr subject, and " +
+			"the escaped en HTML, but got %+v", email)
+	}
+	
+	email, err = renderEmail(f.server, ResetPasswordTemplate, "otherrealm", "fr-CA", vars)
+	if err != nil { testContext.Fatal(err) }
+	if email.TextMessage != "Bonjour <Jane>: T" {
+		testContext.Errorf("Expected the server's fr text for another realm, but got %s", email.TextMessage)
+	}
+	
+	email, err = renderEmail(f.server, ResetPasswordTemplate, f.realm.getName(), "de", vars)
+	if err != nil { testContext.Fatal(err) }
+	if (email.Subject != "Reset password") || (! strings.HasSuffix(email.TextMessage, "\n\nT")) {
+		testContext.Errorf("Expected the built-in template, but got %+v", email)
+	}
+	
+	_, err = renderEmail(f.server, AccountLockedTemplate, "", "",
+		getSampleEmailVariables(f.server, AccountLockedTemplate, f.user, ""))
+	if err == nil { testContext.Error("Expected an unknown variable to be an error") }
+	_, err = renderEmail(f.server, "no-such-template", "", "", vars)
+	if err == nil { testContext.Error("Expected an unknown template to be an error") }
+	
+	var locale string
+	locale, err = normalizeLocale("zh_hant_tw")
+	if (err != nil) || (locale != "zh-Hant-TW") {
+		testContext.Errorf("Expected zh-Hant-TW, but got %s", locale)
+	}
+	_, err = normalizeLocale("../fr")
+	if err == nil { testContext.Error("Expected a path to be rejected as a locale") }
+}
@@ -9,13 +9,18 @@ import (
 
 const (
 		IdentityVerificationTokenLifespanInHours = 72
+		PasswordResetTokenLifespanInMinutes = 60
+		
+		// The purposes for which an emailed token may be used.
+		EmailVerificationPurpose = "VerifyEmail"
+		PasswordResetPurpose = "ResetPassword"
 )
 
 /*******************************************************************************
  * Store EmailAddress in Joe’s account, and flag it as unverified.
  * This method does not commit the transaction.
  */
-func EstablishEmail(authSvc *AuthService, dbClient DBClient, emailSvc *utilities.EmailService,
+func EstablishEmail(authSvc *AuthService, dbClient DBClient,
 	userId string, emailAddress string) error {
 	
 	var user User
@@ -28,36 +33,38 @@ func EstablishEmail(authSvc *AuthService, dbClient DBClient, emailSvc *utilities
 	
 	if dbClient.getServer().PerformEmailIdentityVerification {
 		// Send email to user, containing the URL to click.
-		return ValidateEmail(authSvc, dbClient, emailSvc, userId, emailAddress)
+		return ValidateEmail(authSvc, dbClient, userId, emailAddress)
 	} else {
 		return user.flagEmailAsVerified(dbClient, emailAddress)
 	}
 }
 
 /*******************************************************************************
- * Send email to the specified address.
+ * Send email to the specified address, by means of the outbox, so that it is
+ * sent only if the transaction commits.
  * Embed unforgeable, token containing a digest of the email address and a unique
  * token Id.
  */
-func ValidateEmail(authSvc *AuthService, dbClient DBClient, emailSvc *utilities.EmailService,
+func ValidateEmail(authSvc *AuthService, dbClient DBClient,
 	userId, emailAddress string) error {
 	
 	var token string
 	var err error
-	token, _, err = createEmailToken(authSvc, dbClient, userId)
+	token, _, err = createEmailToken(authSvc, dbClient, userId, EmailVerificationPurpose)
 	if err != nil { return err }
 	
-	var confirmationURL = constructConfirmationURL(dbClient.getServer(), token)
+	var user User
+	user, err = dbClient.dbGetUserByUserId(userId)
+	if err != nil { return err }
+	if user == nil { return utilities.ConstructUserError("Unrecognized user Id") }
 	
-	var textMessage = fmt.Sprintf(
-		"In your browser, go to %s to confirm your email address", confirmationURL)
-	var htmlMessage = fmt.Sprintf(
-		"Click <a href=\"%s\">here</a> to confirm your email address. " +
-		"This enables SafeHarbor to verify your identity, and protects you " +
-		"from others who might try to register using your email address.",
-		confirmationURL)
+	var server = dbClient.getServer()
+	var realmName = getRealmNameForEmail(dbClient, user)
+	var vars = newEmailVariables(server, user, realmName)
+	vars["ConfirmationURL"] = constructConfirmationURL(server, token)
 	
-	return emailSvc.SendEmail(emailAddress, "Verify address", textMessage, htmlMessage)
+	return queueTemplatedEmail(dbClient, emailAddress, VerifyEmailTemplate,
+		user, realmName, vars)
 }
 
 /*******************************************************************************
@@ -78,6 +85,9 @@ func ValidateEmailToken(dbClient DBClient, authSvc *AuthService,
 		// Retrieve userId and email address.
 		info, err = dbClient.getIdentityValidationInfo(infoObjId)
 		if err != nil { return "", "", err }
+		if info.getPurpose() != EmailVerificationPurpose {
+			return "", "", utilities.ConstructUserError("Token not recognized")
+		}
 		var user User
 		user, err = dbClient.dbGetUserByUserId(info.getUserId())
 		if err != nil { return "", "", err }
@@ -102,17 +112,69 @@ func ValidateEmailToken(dbClient DBClient, authSvc *AuthService,
 }
 
 
+/*******************************************************************************
+ * Queue email to the user, containing the token, created by createEmailToken,
+ * with which the user may choose a new password (see the resetPassword handler).
+ * The token expires after PasswordResetTokenLifespanInMinutes, and may be used
+ * only once.
+ */
+func sendPasswordResetEmail(dbClient DBClient, user User, token string) error {
+	
+	var realmName = getRealmNameForEmail(dbClient, user)
+	var vars = newEmailVariables(dbClient.getServer(), user, realmName)
+	vars["Token"] = token
+	vars["LifespanInMinutes"] = PasswordResetTokenLifespanInMinutes
+	
+	return queueTemplatedEmail(dbClient, user.getEmailAddress(),
+		ResetPasswordTemplate, user, realmName, vars)
+}
+
+/*******************************************************************************
+ * Return the user for whom the password reset token was issued. The token is
+ * not consumed: see the resetPassword handler. Every kind of invalid token
+ * results in the same error, so that the error reveals nothing about accounts.
+ */
+func ValidatePasswordResetToken(dbClient DBClient, authSvc *AuthService,
+	token string) (User, error) {
+	
+	var invalidErr = utilities.ConstructUserError("Token is invalid or has expired")
+	if ! authSvc.validateSessionId(token) { return nil, invalidErr }
+	
+	var infoObjId string
+	var err error
+	infoObjId, err = dbClient.getPersistence().getIdentityValidationInfoByToken(token)
+	if err != nil { return nil, err }
+	if infoObjId == "" { return nil, invalidErr }
+	var info IdentityValidationInfo
+	info, err = dbClient.getIdentityValidationInfo(infoObjId)
+	if err != nil { return nil, invalidErr }
+	if info.getPurpose() != PasswordResetPurpose { return nil, invalidErr }
+	var lifespan = time.Duration(PasswordResetTokenLifespanInMinutes)*time.Minute
+	if time.Now().After(info.getCreationTime().Add(lifespan)) { return nil, invalidErr }
+	
+	var user User
+	user, err = dbClient.dbGetUserByUserId(info.getUserId())
+	if err != nil { return nil, err }
+	if (user == nil) || (! user.isActive()) || (user.getLDAPDN() != "") { return nil, invalidErr }
+	if authSvc.getSessionCreationTime(token).Before(user.getCredentialEpoch()) {
+		return nil, invalidErr  // used, or superseded by a later reset
+	}
+	return user, nil
+}
+
+
 /*****************************Internal Methods*********************************/
 
 
 /*******************************************************************************
  * 
  */
-func createEmailToken(authSvc *AuthService, dbClient DBClient, userId string) (string, IdentityValidationInfo, error) {
+func createEmailToken(authSvc *AuthService, dbClient DBClient, userId,
+	purpose string) (string, IdentityValidationInfo, error) {
 	var token = authSvc.createUniqueSessionId()
 	var info IdentityValidationInfo
 	var err error
-	info, err = dbClient.dbCreateIdentityValidationInfo(userId, time.Now(), token)
+	info, err = dbClient.dbCreateIdentityValidationInfo(userId, time.Now(), token, purpose)
 	if err != nil { return "", nil, err }
 	return token, info, nil
 }
@@ -0,0 +1,47 @@
+package server
+
+
+import (
+	"net/url"
+	"testing"
+	
+	"safeharbor/apitypes"
+)
+
+func Test_ResetPasswordEndsSessionsAndInvalidatesOtherTokens(testContext *testing.T) {
+	
+	var f = newTestDB(testContext)
+	var authSvc = f.server.authService
+	var session = authSvc.createSession(apitypes.NewCredentials(f.user.getUserId(), ""))
+	var token, otherToken string
+	var err error
+	token, _, err = createEmailToken(authSvc, f.client, f.user.getUserId(), PasswordResetPurpose)
+	if err != nil { testContext.Fatal(err) }
+	otherToken, _, err = createEmailToken(authSvc, f.client, f.user.getUserId(), PasswordResetPurpose)
+	if err != nil { testContext.Fatal(err) }
+	
+	var response = resetPassword(f.client, nil, url.Values{
+		"ResetToken": []string{ token }, "NewPassword": []string{ "a new passphrase" } }, nil)
+	if _, isFailure := response.(*apitypes.FailureDesc); isFailure {
+		testContext.Fatalf("Expected the password to be reset: %s", response.AsJSON())
+	}
+	
+	// This server has removed the session; restore it, as another server would
+	// still have it, to check that the credential epoch ends it.
+	authSvc.sessionLock.Lock()
+	authSvc.Sessions[session.UniqueSessionId] = apitypes.NewCredentials(f.user.getUserId(), "")
+	authSvc.sessionLock.Unlock()
+	var failMsg apitypes.RespIntfTp
+	_, failMsg = authenticateSession(f.client, session, url.Values{})
+	if failMsg == nil { testContext.Error("Expected the session to be ended") }
+	
+	for _, t := range []string{ token, otherToken } {
+		_, err = ValidatePasswordResetToken(f.client, authSvc, t)
+		if err == nil { testContext.Error("Expected the user's reset tokens to be invalidated") }
+	}
+	
+	// A session created afterwards is unaffected.
+	var newSession = authSvc.createSession(apitypes.NewCredentials(f.user.getUserId(), ""))
+	_, failMsg = authenticateSession(f.client, newSession, url.Values{})
+	if failMsg != nil { testContext.Errorf("Expected a new session to be valid: %s", failMsg.AsJSON()) }
+}
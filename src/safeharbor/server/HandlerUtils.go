@@ -22,6 +22,7 @@ import (
 	// SafeHarbor packages:
 	"safeharbor/apitypes"
 	"docker"
+	"scanners"
 	"utilities"
 )
 
@@ -171,11 +172,84 @@ func authenticateSession(dbClient *InMemClient, sessionToken *apitypes.SessionTo
 		return nil, apitypes.NewFailureDesc(
 			http.StatusUnauthorized, "user object cannot be identified from user id " + userId)
 	}
+	if dbClient.getServer().authService.getSessionCreationTime(sessionToken.UniqueSessionId).Before(
+		user.getCredentialEpoch()) {
+		return nil, apitypes.NewFailureDesc(http.StatusUnauthorized, "Session has been ended")
+	}
 	dbClient.getTransactionContext().setUserId(userId)
 	
 	return sessionToken, nil
 }
 
+/*******************************************************************************
+ * Create a session for the user, whose credentials (and second factor, if any)
+ * have been verified, replacing the prior session, if any. Used by authenticate
+ * and verifySecondFactor.
+ */
+func createLoginSession(dbClient *InMemClient, sessionToken *apitypes.SessionToken,
+	creds *apitypes.Credentials, user User) apitypes.RespIntfTp {
+	
+	var err = user.recordSuccessfulLogin(dbClient)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	// Create new user session.
+	var newSessionToken *apitypes.SessionToken = dbClient.Server.authService.createSession(creds)
+	newSessionToken.SetRealmId(user.getRealmId())
+	
+	// If the user had a prior session, invalidate it.
+	if sessionToken != nil {
+		dbClient.Server.authService.invalidateSessionId(sessionToken.UniqueSessionId)
+	}
+	
+	// Flag whether the user has Write access to the realm.
+	var realm Realm
+	realm, err = dbClient.getRealm(user.getRealmId())
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var entry ACLEntry
+	entry, err = realm.getACLEntryForPartyId(dbClient, user.getId())
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if entry != nil {
+		newSessionToken.SetIsAdminUser(entry.getPermissionMask()[apitypes.CanWrite])
+	}
+	
+	return newSessionToken
+}
+
+/*******************************************************************************
+ * Identify the user who is enrolling a second factor: the user of the login
+ * challenge, if a ChallengeId is given, or else the current user. The challenge,
+ * if any, is also returned.
+ */
+func getEnrollingUser(dbClient *InMemClient, sessionToken *apitypes.SessionToken,
+	values url.Values) (User, *LoginChallenge, apitypes.RespIntfTp) {
+	
+	var challengeId string
+	var err error
+	challengeId, err = apitypes.GetHTTPParameterValue(true, values, "ChallengeId")
+	if err != nil { return nil, nil, apitypes.NewFailureDescFromError(err) }
+	
+	var user User
+	if challengeId == "" {
+		var failMsg apitypes.RespIntfTp
+		sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+		if failMsg != nil { return nil, nil, failMsg }
+		user, err = getCurrentUser(dbClient, sessionToken)
+		if err != nil { return nil, nil, apitypes.NewFailureDescFromError(err) }
+		return user, nil, nil
+	}
+	
+	var challenge = dbClient.Server.authService.getLoginChallenge(challengeId)
+	if challenge == nil { return nil, nil, apitypes.NewFailureDesc(http.StatusUnauthorized,
+		"Login challenge is invalid or has expired") }
+	if ! challenge.EnrollmentRequired { return nil, nil, apitypes.NewFailureDesc(
+		http.StatusBadRequest, "Login challenge does not permit enrollment") }
+	user, err = dbClient.dbGetUserByUserId(challenge.UserId)
+	if err != nil { return nil, nil, apitypes.NewFailureDescFromError(err) }
+	if (user == nil) || (! user.isActive()) { return nil, nil, apitypes.NewFailureDesc(
+		http.StatusUnauthorized, "User is not active") }
+	return user, challenge, nil
+}
+
 /*******************************************************************************
  * Get the current authenticated user. If no one is authenticated, return nil. If
  * any other error, return an error.
@@ -365,10 +439,14 @@ func buildDockerfile(dbClient DBClient, dockerfile Dockerfile, sessionToken *api
 	if err != nil { return nil, err }
 	fmt.Println("E")  // debug
 	
-	// Retrieve the Image, or if it does not exist, create it.
+	// Retrieve the Image, or if it does not exist, create it. If the build
+	// fails, the subscribers to the image are notified, or, if the image is new,
+	// those to the Dockerfile's repo and realm.
 	var dockerImage DockerImage
 	dockerImage, err = repo.getDockerImageByName(dbClient, imageName)
 	if err != nil { return nil, err }
+	var notifyResourceId = dockerfile.getId()
+	if dockerImage != nil { notifyResourceId = dockerImage.getId() }
 	if dockerImage == nil {
 		dockerImage, err = dbClient.dbCreateDockerImage(repo.getId(), imageName,
 			dockerfile.getDescription())
@@ -393,12 +471,17 @@ func buildDockerfile(dbClient DBClient, dockerfile Dockerfile, sessionToken *api
 	outputStr, err = dockerSvcs.BuildDockerfile(
 		dockerfile.getExternalFilePath(), dockerfile.getName(),
 		dockerImageName, tag, paramNames, paramValues)
-	if err != nil { return nil, err }
-	fmt.Println("I")  // debug
-	
 	var dockerBuildOutput *docker.DockerBuildOutput
-	dockerBuildOutput, err = docker.ParseBuildRESTOutput(outputStr)
-	if err != nil { return nil, err }
+	if err == nil {
+		fmt.Println("I")  // debug
+		dockerBuildOutput, err = docker.ParseBuildRESTOutput(outputStr)
+	}
+	if err != nil {
+		dbClient.getServer().notifySubscribersSeparately(BuildFailedNotification, notifyResourceId,
+			"Build of " + imageName + " failed", "The build of " + imageName + " from " +
+			dockerfile.getName() + " in repo " + repo.getName() + " failed: " + err.Error())
+		return nil, err
+	}
 	fmt.Println("J.1")  // debug
 	var dockerImageId string = dockerBuildOutput.GetFinalDockerImageId()
 	fmt.Println("J.2")  // debug
@@ -429,6 +512,122 @@ func buildDockerfile(dbClient DBClient, dockerfile Dockerfile, sessionToken *api
 	return imageVersion, err
 }
 
+/*******************************************************************************
+ * Scan the image version with the scan config, on behalf of the user, record the
+ * outcome as a ScanEvent, and notify the subscribers to the image if the image
+ * is worse than it was. If the scan fails, the subscribers are notified in a
+ * transaction of their own, since the caller's transaction is aborted.
+ */
+func scanDockerImageVersion(dbClient DBClient, dockerImage DockerImage,
+	dockerImageVersion DockerImageVersion, scanConfig ScanConfig, user User) (ScanEvent, error) {
+	
+	var params, err = getScanParameters(dbClient, scanConfig)
+	if err != nil { return nil, err }
+	var imageName string
+	imageName, err = dockerImageVersion.getFullName(dbClient)
+	if err != nil { return nil, err }
+	var result *scanners.ScanResult
+	result, err = runScanner(dbClient.getServer(), dockerImage, imageName, scanConfig, params)
+	if err != nil { return nil, err }
+	return recordScanResult(dbClient, dockerImage, dockerImageVersion, imageName,
+		scanConfig, params, user, result)
+}
+
+/*******************************************************************************
+ * Return the names and values of the scan config's parameters.
+ */
+func getScanParameters(dbClient DBClient, scanConfig ScanConfig) (map[string]string, error) {
+	
+	var params = map[string]string{}
+	for _, id := range scanConfig.getParameterValueIds() {
+		var paramValue, err = dbClient.getParameterValue(id)
+		if err != nil { return nil, err }
+		params[paramValue.getName()] = paramValue.getStringValue()
+	}
+	return params, nil
+}
+
+/*******************************************************************************
+ * Scan the named image with the scan config's provider. The database is not
+ * accessed, so that this may be called outside of any transaction. If the scan
+ * fails, the subscribers to the image are notified in a transaction of their own.
+ */
+func runScanner(server *Server, dockerImage DockerImage, imageName string,
+	scanConfig ScanConfig, params map[string]string) (*scanners.ScanResult, error) {
+	
+	// Locate the scan provider.
+	var scanProviderName = scanConfig.getProviderName()
+	fmt.Println("Getting scan service...")
+	var scanService scanners.ScanService
+	scanService = server.GetScanService(scanProviderName)
+	if scanService == nil { return nil, utilities.ConstructUserError(
+		"Unable to identify a scan service named '" + scanProviderName + "'") }
+	
+	// Attach to the scan provider.
+	var scanContext scanners.ScanContext
+	var err error
+	scanContext, err = scanService.CreateScanContext(params)
+	if err != nil { return nil, err }
+	var result *scanners.ScanResult
+	fmt.Println("Contacting scan service...")
+	
+	// Perform scan.
+	result, err = scanContext.ScanImage(imageName)
+	if err != nil {
+		server.notifySubscribersSeparately(ScanFailedNotification, dockerImage.getId(),
+			"Scan of " + imageName + " failed", "The scan of " + imageName +
+			" with scan config " + scanConfig.getName() + " failed: " + err.Error())
+		return nil, err
+	}
+	fmt.Println("Scanner service completed")
+	return result, nil
+}
+
+/*******************************************************************************
+ * Record the result of a scan as a ScanEvent, and notify the subscribers to the
+ * image if the image is worse than it was. The scan must already have been
+ * counted against the realm's quota (see reserveRealmScans).
+ */
+func recordScanResult(dbClient DBClient, dockerImage DockerImage,
+	dockerImageVersion DockerImageVersion, imageName string, scanConfig ScanConfig,
+	params map[string]string, user User, result *scanners.ScanResult) (ScanEvent, error) {
+	
+	var scanProviderName = scanConfig.getProviderName()
+	var err error
+	
+	// Compute score.
+	// TBD: Here we should use the scanConfig.SuccessExpression to compute the score.
+	var score string
+	score = fmt.Sprintf("%d", len(result.Vulnerabilities))
+	
+	// Construct arrays of param names and values, needed by dbCreateScanEvent.
+	var paramNames = make([]string, len(params))
+	var paramValues = make([]string, len(paramNames))
+	var i = 0
+	for name, value := range params {
+		paramNames[i] = name
+		paramValues[i] = value
+		i++
+	}
+	
+	// Create a scan event.
+	var previousScanEvent ScanEvent
+	previousScanEvent, err = getPreviousScanEvent(dbClient, dockerImage, dockerImageVersion,
+		scanConfig.getId())
+	if err != nil { return nil, err }
+	var scanEvent ScanEvent
+	scanEvent, err = dbClient.dbCreateScanEvent(scanConfig.getId(), scanProviderName,
+		paramNames, paramValues, dockerImageVersion.getId(), user.getId(), score, result)
+	if err != nil { return nil, err }
+	
+	// Notify subscribers if the image is worse than it was.
+	err = notifyScanOutcome(dbClient, dockerImage, imageName, scanConfig,
+		scanEvent, previousScanEvent)
+	if err != nil { return nil, err }
+	
+	return scanEvent, nil
+}
+
 /*******************************************************************************
  * 
  */
@@ -473,7 +672,13 @@ func getDefaultRepoForUser(dbClient DBClient, userId string) (Repo, error) {
 	}
 	
 	if repo == nil {
-		// Create a Repo.
+		// Create a Repo. It is counted against the realm, but a user may
+		// always have a default Repo, regardless of the realm's quota.
+		var realm Realm
+		realm, err = dbClient.getRealm(user.getRealmId())
+		if err != nil { return nil, err }
+		err = countRealmResources(dbClient, realm, 1, 0, 0)
+		if err != nil { return nil, err }
 		repo, err = dbClient.dbCreateRepo(user.getRealmId(), "",
 			"Repo created automatically")
 		if err != nil { return nil, err }
@@ -481,7 +686,10 @@ func getDefaultRepoForUser(dbClient DBClient, userId string) (Repo, error) {
 	
 	// Give the user fill access to the Repo.
 	var mask = []bool{ true, true, true, true, true }
-	_, err = dbClient.setAccess(repo, user, mask)
+	var aclEntry ACLEntry
+	aclEntry, err = dbClient.setAccess(repo, user, mask)
+	if err != nil { return nil, err }
+	err = queuePermissionChangeWebhookEvent(dbClient, "set", repo, user, aclEntry)
 	if err != nil { return nil, err }
 	
 	// Set the Repo as the user's default Repo.
@@ -493,128 +701,185 @@ func getDefaultRepoForUser(dbClient DBClient, userId string) (Repo, error) {
 }
 
 /*******************************************************************************
- * Create a map of the leaf resources (resources that are not containers for other
- * resources) that the specified user has access to. The map is keyed on each
- * resource''s object Id.
+ * Create a map of the resources of the specified type that the specified user
+ * has access to, either directly or by inheritance - see getAccessibleResources.
+ * The map is keyed on each resource''s object Id.
  */
-func getLeafResources(dbClient DBClient, user User,
-	leafType ResourceType) (map[string]Resource, error) {
+func getAccessibleResourcesOfType(dbClient DBClient, user User,
+	resourceType ResourceType) (map[string]Resource, error) {
 	
-	var realms map[string]Realm = make(map[string]Realm)
-	var repos map[string]Repo = make(map[string]Repo)
-	var leaves map[string]Resource = make(map[string]Resource)
-	
-	// Add leaves for which there are direct entries, and while doing that,
-	// create a list of realms and repos that the user has access to.
-	var aclEntrieIds []string = user.getACLEntryIds()
+	var accessible map[string]Resource
 	var err error
-	for _, aclEntryId := range aclEntrieIds {
-		var aclEntry ACLEntry
-		aclEntry, err = dbClient.getACLEntry(aclEntryId)
-		if err != nil { return nil, err }
-		var resourceId string = aclEntry.getResourceId()
-		var resource Resource
-		resource, err = dbClient.getResource(resourceId)
-		if err != nil { return nil, err }
-		switch v := resource.(type) {
-			case Realm: realms[v.getId()] = v
-			case Repo: repos[v.getId()] = v
-			case Dockerfile: if leafType == ADockerfile { leaves[v.getId()] = v }
-			case DockerImage: if leafType == ADockerImage { leaves[v.getId()] = v }
-			case ScanConfig: if leafType == AScanConfig { leaves[v.getId()] = v }
-			case Flag: if leafType == AFlag { leaves[v.getId()] = v }
-			default: return nil, utilities.ConstructServerError("Internal error: unexpected repository object type")
-		}
-	}
-	// Create composite list of repos that the user has access to, either directly
-	// or as a result of having access to the owning realm.
-	for _, realm := range realms {
-		// Add all of the repos belonging to realm.
-		for _, repoId := range realm.getRepoIds() {
-			fmt.Println("\tadding repoId", repoId)
-			var r Repo
-			var err error
-			r, err = dbClient.getRepo(repoId)
-			if err != nil { return nil, err }
-			if r == nil { return nil, utilities.ConstructServerError("No repo found for Id " + repoId) }
-			repos[repoId] = r
-		}
-	}
-	// Add the leaves that belong to each of those repos.
-	for _, repo := range repos {
-		switch leafType {
-			case ADockerfile: err = mapRepoDockerfileIds(dbClient, repo, leaves)
-			case ADockerImage: err = mapRepoDockerImageIds(dbClient, repo, leaves)
-			case AScanConfig: err = mapRepoScanConfigIds(dbClient, repo, leaves)
-			case AFlag: err = mapRepoFlagIds(dbClient, repo, leaves)
-			default: return nil, utilities.ConstructServerError("Internal error: unexpected repository object type")
+	accessible, err = getAccessibleResources(dbClient, user)
+	if err != nil { return nil, err }
+	
+	var resources = make(map[string]Resource)
+	for id, resource := range accessible {
+		var isType bool
+		switch resourceType {
+			case ARealm: isType = resource.isRealm()
+			case ARepo: isType = resource.isRepo()
+			case ADockerfile: isType = resource.isDockerfile()
+			case ADockerImage: isType = resource.isDockerImage()
+			case AScanConfig: isType = resource.isScanConfig()
+			case AFlag: isType = resource.isFlag()
+			default: return nil, utilities.ConstructServerError("Internal error: unexpected resource type")
 		}
-		if err != nil { return nil, err }
+		if isType { resources[id] = resource }
 	}
+	return resources, nil
+}
+
+/*******************************************************************************
+ * Load the specified Resources in a single batch.
+ */
+func getResources(dbClient DBClient, ids []string) ([]Resource, error) {
 	
-	return leaves, nil
+	var objs []PersistObj
+	var err error
+	objs, err = dbClient.getPersistentObjects(ids)
+	if err != nil { return nil, err }
+	var resources = make([]Resource, len(objs))
+	for i, obj := range objs {
+		var isType bool
+		resources[i], isType = obj.(Resource)
+		if ! isType { return nil, utilities.ConstructUserError(
+			"Object with Id " + ids[i] + " is not a Resource") }
+	}
+	return resources, nil
 }
 
 /*******************************************************************************
- * Populate a map of the Repo''s Dockerfiles, indexed by Dockerfile object Id.
+ * Check that exactly one of an invitee's user Id, email address, and group name
+ * is specified.
  */
-func mapRepoDockerfileIds(dbClient DBClient, repo Repo, leaves map[string]Resource) error {
-		
-	for _, dockerfileId := range repo.getDockerfileIds() {
-		var d Dockerfile
-		var err error
-		d, err = dbClient.getDockerfile(dockerfileId)
-		if err != nil { return err }
-		if d == nil { return utilities.ConstructServerError("Internal Error: No dockerfile found for Id " + dockerfileId) }
-		leaves[dockerfileId] = d
+func checkInviteeIdentified(userId, email, groupName string) error {
+	
+	var specified = 0
+	for _, value := range []string{ userId, email, groupName } {
+		if value != "" { specified++ }
 	}
+	if specified != 1 { return utilities.ConstructUserError(
+		"Specify exactly one of InviteeUserId, InviteeEmail, and InviteeGroupName") }
 	return nil
 }
 
 /*******************************************************************************
- * Populate a map of the Repo''s DockerImages, indexed by Image object Id.
+ * Identify a user of the realm by user Id or email address, or a group of the
+ * realm by name. Exactly one of these must be specified. This is done when an
+ * administrator of the realm accepts an invitation, not when the invitation is
+ * made, so that the inviter cannot use it to discover the realm's users.
  */
-func mapRepoDockerImageIds(dbClient DBClient, repo Repo, leaves map[string]Resource) error {
-		
-	for _, id := range repo.getDockerImageIds() {
-		var d DockerImage
-		var err error
-		d, err = dbClient.getDockerImage(id)
-		if err != nil { return err }
-		if d == nil { return utilities.ConstructServerError("Internal Error: No docker image found for Id " + id) }
-		leaves[id] = d
+func findInvitee(dbClient DBClient, realm Realm, userId, email, groupName string) (Party, error) {
+	
+	var err = checkInviteeIdentified(userId, email, groupName)
+	if err != nil { return nil, err }
+	
+	if groupName != "" {
+		var group Group
+		group, err = realm.getGroupByName(dbClient, groupName)
+		if err != nil { return nil, err }
+		if group == nil { return nil, utilities.ConstructUserError(
+			"Realm " + realm.getName() + " has no group named " + groupName) }
+		return group, nil
 	}
-	return nil
+	for _, userObjId := range realm.getUserObjIds() {
+		var user User
+		user, err = dbClient.getUser(userObjId)
+		if err != nil { return nil, err }
+		if (userId != "") && (user.getUserId() == userId) { return user, nil }
+		if (email != "") && strings.EqualFold(user.getEmailAddress(), email) { return user, nil }
+	}
+	return nil, utilities.ConstructUserError("Realm " + realm.getName() + " has no such user")
 }
 
 /*******************************************************************************
- * Populate a map of the Repo''s ScanConfigs, indexed by ScanConfig object Id.
+ * Obtain the Invitation identified by the required InvitationId parameter.
  */
-func mapRepoScanConfigIds(dbClient DBClient, repo Repo, leaves map[string]Resource) error {
-		
-	for _, id := range repo.getScanConfigIds() {
-		var d ScanConfig
+func getInvitationParameter(dbClient DBClient, values url.Values) (Invitation, apitypes.RespIntfTp) {
+	
+	var invitationId string
+	var err error
+	invitationId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "InvitationId")
+	if err != nil { return nil, apitypes.NewFailureDescFromError(err) }
+	var invitation Invitation
+	invitation, err = dbClient.getInvitation(invitationId)
+	if err != nil { return nil, apitypes.NewFailureDescFromError(err) }
+	return invitation, nil
+}
+
+/*******************************************************************************
+ * Obtain the optional ExpiresAt parameter, in RFC 3339 format (for example,
+ * 2017-06-30T17:00:00Z). The time must be in the future. Return the zero time,
+ * and false, if the parameter is absent.
+ */
+func getExpiryParameter(values url.Values) (time.Time, bool, error) {
+	
+	var value string
+	var err error
+	value, err = apitypes.GetHTTPParameterValue(true, values, "ExpiresAt")
+	if err != nil { return time.Time{}, false, err }
+	if value == "" { return time.Time{}, false, nil }
+	var expiresAt time.Time
+	expiresAt, err = time.Parse(time.RFC3339, value)
+	if err != nil { return time.Time{}, false, utilities.ConstructUserError(
+		"ExpiresAt must be a time in RFC 3339 format: " + err.Error()) }
+	if ! expiresAt.After(time.Now()) { return time.Time{}, false, utilities.ConstructUserError(
+		"ExpiresAt must be in the future") }
+	return expiresAt, true, nil
+}
+
+/*******************************************************************************
+ * Obtain the required CanCreateIn, CanRead, CanWrite, CanExecute and CanDelete
+ * parameters, as a mask.
+ */
+func getPermissionMaskParameters(values url.Values) ([]bool, error) {
+	
+	var names = []string{ "CanCreateIn", "CanRead", "CanWrite", "CanExecute", "CanDelete" }
+	var smask = make([]string, len(names))
+	for i, name := range names {
 		var err error
-		d, err = dbClient.getScanConfig(id)
-		if err != nil { return err }
-		if d == nil { return utilities.ConstructServerError("Internal Error: No scan config found for Id " + id) }
-		leaves[id] = d
+		smask[i], err = apitypes.GetRequiredHTTPParameterValue(true, values, name)
+		if err != nil { return nil, err }
 	}
-	return nil
+	return apitypes.ToBoolAr(smask)
 }
 
 /*******************************************************************************
- * Populate a map of the Repo''s Flags, indexed by Flag object Id.
+ * Obtain the role with the specified name that is available in the realm: a
+ * built-in role, or one that the realm defines.
  */
-func mapRepoFlagIds(dbClient DBClient, repo Repo, leaves map[string]Resource) error {
-		
-	for _, id := range repo.getFlagIds() {
-		var d Flag
+func getRealmRoleByName(dbClient DBClient, realmId, roleName string) (Role, apitypes.RespIntfTp) {
+	
+	var realm Realm
+	var err error
+	realm, err = dbClient.getRealm(realmId)
+	if err != nil { return nil, apitypes.NewFailureDescFromError(err) }
+	var role Role
+	role, err = realm.getRole(dbClient, roleName)
+	if err != nil { return nil, apitypes.NewFailureDescFromError(err) }
+	if role == nil { return nil, apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Realm " + realm.getName() + " has no role named " + roleName) }
+	return role, nil
+}
+
+/*******************************************************************************
+ * Obtain the optional DenyCreateIn, DenyRead, DenyWrite, DenyExecute and
+ * DenyDelete parameters, as a mask. A mode may not be both granted (in the
+ * specified permission mask) and denied.
+ */
+func getDenyMaskParameters(values url.Values, permissionMask []bool) ([]bool, error) {
+	
+	var names = []string{ "DenyCreateIn", "DenyRead", "DenyWrite", "DenyExecute", "DenyDelete" }
+	var denyMask = make([]bool, len(names))
+	for i, name := range names {
+		var value string
 		var err error
-		d, err = dbClient.getFlag(id)
-		if err != nil { return err }
-		if d == nil { return utilities.ConstructServerError("Internal Error: No flag found for Id " + id) }
-		leaves[id] = d
+		value, err = apitypes.GetHTTPParameterValue(true, values, name)
+		if err != nil { return nil, err }
+		denyMask[i] = (value == "true")
+		if denyMask[i] && permissionMask[i] { return nil, utilities.ConstructUserError(
+			"A permission may not be both granted and denied: " + name) }
 	}
-	return nil
+	return denyMask, nil
 }
@@ -5,7 +5,8 @@
  * Error codes used are (see https://golang.org/pkg/net/http/#pkg-constants),
 	StatusBadRequest (400) - Bad request.
 	StatusUnauthorized (401) - User is not authenticated, and must be to perform the requested action.
-	StatusForbidden (403) - User is authenticated, but is not authorized to perform the action.
+	StatusForbidden (403) - User is authenticated, but is not authorized to perform the action,
+		or the action would exceed a quota (see Quotas.go).
 	StatusConflict (409) - Contention among multiple users for update to the same data.
 	StatusInternalServerError (500) - An unexpected internal server error.
  *
@@ -22,6 +23,7 @@ import (
 	"os/exec"
 	"strings"
 	"reflect"
+	"strconv"
 	"time"
 	//"runtime/debug"
 	
@@ -234,52 +236,350 @@ func authenticate(dbClient *InMemClient, sessionToken *apitypes.SessionToken, va
 	creds, err = apitypes.GetCredentials(values)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
-	// Verify credentials.
+	// Verify credentials. A user who is not known, or who was provisioned from
+	// the LDAP directory, is authenticated by the directory, if there is one.
 	var user User
 	user, err = dbClient.dbGetUserByUserId(creds.UserId)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	if user == nil {
+	var ldapClient = dbClient.Server.ldapClient
+	var useLDAP = (ldapClient != nil) && ((user == nil) || (user.getLDAPDN() != ""))
+	if (user == nil) && ! useLDAP {
 		return apitypes.NewFailureDesc(http.StatusBadRequest, "User not found in the database")
 	}
 	
-	if ! user.isActive() { return apitypes.NewFailureDesc(http.StatusUnauthorized,
-		"User is not active") }
-	
-	// Check against brute force password attack.
-	var attempts []string = user.getMostRecentLoginAttempts()
-	if len(attempts) >= dbClient.Server.MaxLoginAttemptsToRetain &&
-		apitypes.AreAllWithinTimePeriod(attempts, 600) {
-		dbClient.Server.LoginAlert(creds.UserId)
-		return apitypes.NewFailureDesc(http.StatusUnauthorized, "Too many login attempts")
+	if user != nil {
+		if ! user.isActive() { return apitypes.NewFailureDesc(http.StatusUnauthorized,
+			"User is not active") }
+		
+		// Check against brute force password attack (see Lockout.go).
+		if user.isLockedOut(time.Now()) {
+			return apitypes.NewFailureDesc(http.StatusUnauthorized,
+				"Too many failed login attempts; account is locked until " +
+				user.getLockedUntil().Format(time.RFC3339))
+		}
 	}
-	user.addLoginAttempt(dbClient)
 	
 	// Verify password.
-	if ! user.validatePassword(dbClient, creds.Password) {
+	var valid bool
+	if useLDAP {
+		var ldapUser User
+		ldapUser, err = authenticateLDAPUser(dbClient, ldapClient, creds.UserId, creds.Password)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		valid = (ldapUser != nil)
+		if valid { user = ldapUser }
+	} else {
+		valid = user.validatePassword(dbClient, creds.Password)
+	}
+	if ! valid {
+		if user == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+			"Invalid user Id or password") }
+		var locked bool
+		locked, err = dbClient.Server.recordFailedLoginAttempt(user.getId())
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		if locked { return apitypes.NewFailureDesc(http.StatusUnauthorized,
+			"Too many failed login attempts; account is locked") }
 		return apitypes.NewFailureDesc(http.StatusBadRequest, "Invalid password")
 	}
 	
-	// Create new user session.
-	var newSessionToken *apitypes.SessionToken = dbClient.Server.authService.createSession(creds)
-	newSessionToken.SetRealmId(user.getRealmId())
+	// If a second factor is required, the session is created by verifySecondFactor.
+	var realm Realm
+	realm, err = dbClient.getRealm(user.getRealmId())
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if user.isTOTPEnabled() || realm.requiresTOTP() {
+		var challengeId = dbClient.Server.authService.createLoginChallenge(user.getUserId(),
+			! user.isTOTPEnabled())
+		return apitypes.NewSecondFactorChallenge(challengeId, user.getUserId(),
+			! user.isTOTPEnabled())
+	}
+	
+	return createLoginSession(dbClient, sessionToken, creds, user)
+}
+
+/*******************************************************************************
+ * Arguments: ChallengeId, Code or RecoveryCode
+ * Returns: apitypes.SessionToken
+ * Complete a login for which authenticate returned a SecondFactorChallenge. If
+ * the challenge was satisfied by enrolling (see confirmTOTPEnrollment), no code
+ * is needed. Each rejected code counts as a failed login (see Lockout.go).
+ */
+func verifySecondFactor(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var challengeId, code, recoveryCode string
+	var err error
+	challengeId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ChallengeId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	code, err = apitypes.GetHTTPParameterValue(true, values, "Code")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	recoveryCode, err = apitypes.GetHTTPParameterValue(true, values, "RecoveryCode")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var authService = dbClient.Server.authService
+	var challenge = authService.getLoginChallenge(challengeId)
+	if challenge == nil { return apitypes.NewFailureDesc(http.StatusUnauthorized,
+		"Login challenge is invalid or has expired") }
+	var user User
+	user, err = dbClient.dbGetUserByUserId(challenge.UserId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if (user == nil) || (! user.isActive()) {
+		authService.removeLoginChallenge(challengeId)
+		return apitypes.NewFailureDesc(http.StatusUnauthorized, "User is not active")
+	}
+	if user.isLockedOut(time.Now()) {
+		authService.removeLoginChallenge(challengeId)
+		return apitypes.NewFailureDesc(http.StatusUnauthorized,
+			"Too many failed login attempts; account is locked until " +
+			user.getLockedUntil().Format(time.RFC3339))
+	}
 	
-	// If the user had a prior session, invalidate it.
-	if sessionToken != nil {
-		dbClient.Server.authService.invalidateSessionId(sessionToken.UniqueSessionId)
+	if ! challenge.SecondFactorVerified {
+		if ! user.isTOTPEnabled() { return apitypes.NewFailureDesc(http.StatusBadRequest,
+			"User " + user.getUserId() + " must enroll a second factor: see enrollTOTP") }
+		var valid bool
+		if code != "" {
+			valid, err = user.verifyTOTPCode(dbClient, code, time.Now())
+		} else if recoveryCode != "" {
+			valid, err = user.useRecoveryCode(dbClient, recoveryCode)
+		} else {
+			return apitypes.NewFailureDesc(http.StatusBadRequest, "Code or RecoveryCode is required")
+		}
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		if ! valid {
+			authService.recordLoginChallengeFailure(challengeId)
+			var locked bool
+			locked, err = dbClient.Server.recordFailedLoginAttempt(user.getId())
+			if err != nil { return apitypes.NewFailureDescFromError(err) }
+			if locked {
+				authService.removeLoginChallenge(challengeId)
+				return apitypes.NewFailureDesc(http.StatusUnauthorized,
+					"Too many failed login attempts; account is locked")
+			}
+			return apitypes.NewFailureDesc(http.StatusBadRequest, "Invalid code")
+		}
 	}
 	
-	// Flag whether the user has Write access to the realm.
+	if ! authService.removeLoginChallenge(challengeId) { return apitypes.NewFailureDesc(
+		http.StatusUnauthorized, "Login challenge is invalid or has expired") }
+	return createLoginSession(dbClient, sessionToken,
+		apitypes.NewCredentials(user.getUserId(), ""), user)
+}
+
+/*******************************************************************************
+ * Arguments: ChallengeId (only if not logged in)
+ * Returns: apitypes.TOTPEnrollmentDesc
+ * Generate a new TOTP secret for the current user, or for the user of a login
+ * challenge that requires enrollment. The secret takes effect when the user
+ * calls confirmTOTPEnrollment with a code that it generates.
+ */
+func enrollTOTP(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var user User
+	var failMsg apitypes.RespIntfTp
+	user, _, failMsg = getEnrollingUser(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var secret string
+	var err error
+	secret, err = generateTOTPSecret()
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	err = user.beginTOTPEnrollment(dbClient, secret)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var uri = getTOTPProvisioningURI(user.getUserId(), secret)
+	return apitypes.NewTOTPEnrollmentDesc(user.getUserId(), secret, uri, uri)
+}
+
+/*******************************************************************************
+ * Arguments: Code, ChallengeId (only if not logged in)
+ * Returns: apitypes.RecoveryCodesDesc
+ * Enable the second factor that enrollTOTP generated, if the code is valid for
+ * it. If the user is enrolling during login, the login challenge is satisfied,
+ * and verifySecondFactor then creates the session.
+ */
+func confirmTOTPEnrollment(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var user User
+	var challenge *LoginChallenge
+	var failMsg apitypes.RespIntfTp
+	user, challenge, failMsg = getEnrollingUser(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var code string
+	var err error
+	code, err = apitypes.GetRequiredHTTPParameterValue(true, values, "Code")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if user.getTOTPSecret() == "" { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"No second factor enrollment is in progress: see enrollTOTP") }
+	
+	var valid bool
+	valid, err = user.verifyTOTPCode(dbClient, code, time.Now())
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if ! valid { return apitypes.NewFailureDesc(http.StatusBadRequest, "Invalid code") }
+	
+	var codes []string
+	var hashes []string
+	codes, hashes, err = createRecoveryCodes(dbClient.Server.authService)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	err = user.enableTOTP(dbClient, hashes)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if challenge != nil { dbClient.Server.authService.setLoginChallengeVerified(challenge.Id) }
+	
+	return apitypes.NewRecoveryCodesDesc(user.getUserId(), codes)
+}
+
+/*******************************************************************************
+ * Arguments: Code
+ * Returns: apitypes.RecoveryCodesDesc
+ * Replace the current user's recovery codes with new ones.
+ */
+func regenerateRecoveryCodes(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var code string
+	var err error
+	code, err = apitypes.GetRequiredHTTPParameterValue(true, values, "Code")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var user User
+	user, err = getCurrentUser(dbClient, sessionToken)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if ! user.isTOTPEnabled() { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"User " + user.getUserId() + " does not have a second factor") }
+	var valid bool
+	valid, err = user.verifyTOTPCode(dbClient, code, time.Now())
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if ! valid { return apitypes.NewFailureDesc(http.StatusBadRequest, "Invalid code") }
+	
+	var codes []string
+	var hashes []string
+	codes, hashes, err = createRecoveryCodes(dbClient.Server.authService)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	err = user.setRecoveryCodeHashes(dbClient, hashes)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	return apitypes.NewRecoveryCodesDesc(user.getUserId(), codes)
+}
+
+/*******************************************************************************
+ * Arguments: Code or RecoveryCode
+ * Returns: apitypes.Result
+ * Remove the current user's second factor. Not permitted if the user's realm
+ * requires one; an administrator may instead use resetSecondFactor.
+ */
+func disableTOTP(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var code, recoveryCode string
+	var err error
+	code, err = apitypes.GetHTTPParameterValue(true, values, "Code")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	recoveryCode, err = apitypes.GetHTTPParameterValue(true, values, "RecoveryCode")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var user User
+	user, err = getCurrentUser(dbClient, sessionToken)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if ! user.isTOTPEnabled() { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"User " + user.getUserId() + " does not have a second factor") }
 	var realm Realm
 	realm, err = dbClient.getRealm(user.getRealmId())
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	var entry ACLEntry
-	entry, err = realm.getACLEntryForPartyId(dbClient, user.getId())
-	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	if entry != nil {
-		newSessionToken.SetIsAdminUser(entry.getPermissionMask()[apitypes.CanWrite])
+	if realm.requiresTOTP() { return apitypes.NewFailureDesc(http.StatusForbidden,
+		"Realm " + realm.getName() + " requires a second factor") }
+	
+	var valid bool
+	if code != "" {
+		valid, err = user.verifyTOTPCode(dbClient, code, time.Now())
+	} else if recoveryCode != "" {
+		valid, err = user.useRecoveryCode(dbClient, recoveryCode)
+	} else {
+		return apitypes.NewFailureDesc(http.StatusBadRequest, "Code or RecoveryCode is required")
 	}
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if ! valid { return apitypes.NewFailureDesc(http.StatusBadRequest, "Invalid code") }
+	
+	err = user.resetSecondFactor(dbClient)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return apitypes.NewResult(200, "Second factor removed")
+}
+
+/*******************************************************************************
+ * Arguments: UserObjId
+ * Returns: apitypes.Result
+ * Remove the user's second factor, for example because the user has lost both
+ * the device and the recovery codes. If the realm requires a second factor, the
+ * user must enroll again when next logging in.
+ */
+func resetSecondFactor(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var userObjId string
+	var err error
+	userObjId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "UserObjId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
-	return newSessionToken
+	var user User
+	user, err = dbClient.getUser(userObjId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+		user.getRealmId(), "resetSecondFactor")
+	if failMsg != nil { return failMsg }
+	
+	err = user.resetSecondFactor(dbClient)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return apitypes.NewResult(200,
+		"Second factor of user with user Id '" + user.getUserId() + "' removed")
+}
+
+/*******************************************************************************
+ * Arguments: RealmId, Required
+ * Returns: apitypes.Result
+ * Set whether each user of the realm must log in with a second factor.
+ */
+func setRealmRequireTOTP(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var realmId, requiredStr string
+	var err error
+	realmId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RealmId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	requiredStr, err = apitypes.GetRequiredHTTPParameterValue(true, values, "Required")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var required bool
+	required, err = strconv.ParseBool(requiredStr)
+	if err != nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Required must be true or false") }
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+		realmId, "setRealmRequireTOTP")
+	if failMsg != nil { return failMsg }
+	
+	var realm Realm
+	realm, err = dbClient.getRealm(realmId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	err = realm.setRequireTOTP(dbClient, required)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if required { return apitypes.NewResult(200, "Realm " + realm.getName() + " requires a second factor") }
+	return apitypes.NewResult(200, "Realm " + realm.getName() + " does not require a second factor")
 }
 
 /*******************************************************************************
@@ -335,13 +635,22 @@ func createUser(dbClient *InMemClient, sessionToken *apitypes.SessionToken, valu
 	var realmId string = userInfo.RealmId
 	var email string = userInfo.EmailAddress
 	var pswd string = userInfo.Password
+	err = dbClient.getServer().checkPasswordPolicy(newUserId, pswd)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var realm Realm
+	realm, err = dbClient.getRealm(realmId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var existingUser User
+	existingUser, err = realm.getUserByName(dbClient, newUserName)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if existingUser != nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"A user with name " + newUserName + " already exists in realm " + realm.getName()) }
 	var newUser User
 	newUser, err = dbClient.dbCreateUser(newUserId, newUserName, email, pswd, realmId)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
 	if email != "" {
-		err = EstablishEmail(dbClient.getServer().authService, dbClient,
-			dbClient.getServer().EmailService, newUserId, email)
+		err = EstablishEmail(dbClient.getServer().authService, dbClient, newUserId, email)
 		if err != nil { return apitypes.NewFailureDescFromError(err) }
 	}
 	
@@ -411,6 +720,75 @@ func reenableUser(dbClient *InMemClient, sessionToken *apitypes.SessionToken, va
 	return apitypes.NewResult(200, "User with user Id '" + user.getUserId() + "' reenabled")
 }
 
+/*******************************************************************************
+ * Arguments: RealmId
+ * Returns: apitypes.LockedUserDescs
+ */
+func getLockedUsers(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var realmId string
+	var err error
+	realmId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RealmId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, realmId,
+		"getLockedUsers")
+	if failMsg != nil { return failMsg }
+	
+	var realm Realm
+	realm, err = dbClient.getRealm(realmId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var now = time.Now()
+	var lockedUserDescs apitypes.LockedUserDescs = make([]*apitypes.LockedUserDesc, 0)
+	for _, userObjId := range realm.getUserObjIds() {
+		var user User
+		user, err = dbClient.getUser(userObjId)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		if ! user.isLockedOut(now) { continue }
+		lockedUserDescs = append(lockedUserDescs, apitypes.NewLockedUserDesc(user.getId(),
+			user.getUserId(), user.getName(), user.getRealmId(), user.getLockedUntil(),
+			user.getLockoutCount()))
+	}
+	return lockedUserDescs
+}
+
+/*******************************************************************************
+ * Arguments: UserObjId
+ * Returns: apitypes.Result
+ */
+func unlockUser(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var userObjId string
+	var err error
+	userObjId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "UserObjId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var user User
+	user, err = dbClient.getUser(userObjId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+		user.getRealmId(), "unlockUser")
+	if failMsg != nil { return failMsg }
+	
+	if ! user.isLockedOut(time.Now()) { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"User " + user.getUserId() + " is not locked") }
+	
+	err = user.unlock(dbClient)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return apitypes.NewResult(200, "User with user Id '" + user.getUserId() + "' unlocked")
+}
+
 /*******************************************************************************
  * Arguments: UserId, OldPassword, NewPassword
  * Returns: apitypes.Result
@@ -437,6 +815,8 @@ func changePassword(dbClient *InMemClient, sessionToken *apitypes.SessionToken,
 	user, err = dbClient.dbGetUserByUserId(userId)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	if user == nil { return apitypes.NewFailureDesc(http.StatusInternalServerError, "User unidentified") }
+	if user.getLDAPDN() != "" { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"The password of user " + userId + " is managed by the LDAP directory") }
 	
 	var oldPswd string
 	oldPswd, err = apitypes.GetRequiredHTTPParameterValue(true, values, "OldPassword")
@@ -454,6 +834,8 @@ func changePassword(dbClient *InMemClient, sessionToken *apitypes.SessionToken,
 		user.getId(), "changePassword")
 	if failMsg != nil { return failMsg }
 	
+	err = dbClient.getServer().checkPasswordPolicy(userId, newPswd)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	err = user.setPassword(dbClient, newPswd)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
@@ -461,33 +843,254 @@ func changePassword(dbClient *InMemClient, sessionToken *apitypes.SessionToken,
 }
 
 /*******************************************************************************
- * Arguments: RealmId, <name>
- * Returns: apitypes.GroupDesc
+ * Arguments: UserId
+ * Returns: apitypes.Result
+ * If the user exists, is active, has a verified email address, and is not an
+ * LDAP user (whose password is managed by the directory), send the user a token
+ * with which to choose a new password. The response is the same in every case,
+ * so that it does not reveal whether an account exists.
  */
-func createGroup(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func requestPasswordReset(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
 
-	var failMsg apitypes.RespIntfTp
-	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
-	if failMsg != nil { return failMsg }
-
+	var userId string
 	var err error
-	var realmId string
-	realmId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RealmId")
+	userId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "UserId")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
-	var groupName string
-	groupName, err = apitypes.GetRequiredHTTPParameterValue(true, values, "Name")
+	var result = apitypes.NewResult(200,
+		"If the account exists, a message has been sent to its email address")
+	var user User
+	user, err = dbClient.dbGetUserByUserId(userId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if (user == nil) || (! user.isActive()) || (! user.emailIsVerified()) ||
+		(user.getEmailAddress() == "") || (user.getLDAPDN() != "") ||
+		(dbClient.getServer().EmailDriver == nil) {
+		return result
+	}
+	
+	// The message is queued, rather than sent, so that the time taken to respond
+	// does not reveal whether a message was sent.
+	var token string
+	token, _, err = createEmailToken(dbClient.getServer().authService, dbClient, user.getUserId(),
+		PasswordResetPurpose)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	err = sendPasswordResetEmail(dbClient, user, token)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return result
+}
 
-	var groupDescription string
-	groupDescription, err = apitypes.GetRequiredHTTPParameterValue(true, values, "Description")
+/*******************************************************************************
+ * Arguments: ResetToken, NewPassword
+ * Returns: apitypes.Result
+ * Set the password of the user to whom the token was sent, unlock the account,
+ * and end all of the user's sessions. The token may be used only once.
+ */
+func resetPassword(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var token string
+	var newPswd string
+	var err error
+	token, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ResetToken")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	newPswd, err = apitypes.GetRequiredHTTPParameterValue(true, values, "NewPassword")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
-	var addMeStr string
-	addMeStr, err = apitypes.GetHTTPParameterValue(true, values, "AddMe")
+	var authService = dbClient.getServer().authService
+	var user User
+	user, err = ValidatePasswordResetToken(dbClient, authService, token)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	var addMe bool = false
+	err = dbClient.getServer().checkPasswordPolicy(user.getUserId(), newPswd)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	// Consume the token, in the transaction, so that it remains usable if the
+	// transaction does not commit. Ending the user's sessions also invalidates
+	// this token, and any others that the user has been sent.
+	err = dbClient.getPersistence().queueRemIdentityValidationInfo(dbClient.getTransactionContext(), token)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	err = user.setPassword(dbClient, newPswd)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	err = user.unlock(dbClient)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	err = authService.invalidateSessionsForUser(dbClient, user)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	return apitypes.NewResult(200, "Password changed")
+}
+
+/*******************************************************************************
+ * Arguments: RealmId, TemplateName, Locale (optional)
+ * Returns: apitypes.EmailPreviewDesc
+ * Render a system email template as it would be sent to the caller by the realm,
+ * but with sample values. If no Locale is given, the caller's own is used.
+ */
+func previewEmailTemplate(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var realmId, templateName, locale string
+	var err error
+	realmId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RealmId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	templateName, err = apitypes.GetRequiredHTTPParameterValue(true, values, "TemplateName")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	locale, err = apitypes.GetHTTPParameterValue(true, values, "Locale")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+		realmId, "previewEmailTemplate")
+	if failMsg != nil { return failMsg }
+	
+	var realm Realm
+	realm, err = dbClient.getRealm(realmId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var user User
+	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if user == nil { return apitypes.NewFailureDesc(http.StatusInternalServerError, "User unidentified") }
+	if locale == "" { locale = user.getLocale() }
+	locale, err = normalizeLocale(locale)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var server = dbClient.getServer()
+	var email *RenderedEmail
+	email, err = renderEmail(server, templateName, realm.getName(), locale,
+		getSampleEmailVariables(server, templateName, user, realm.getName()))
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return apitypes.NewEmailPreviewDesc(templateName, realmId, locale,
+		email.Subject, email.TextMessage, email.HTMLMessage)
+}
+
+/*******************************************************************************
+ * Arguments: RealmId
+ * Returns: apitypes.OutboundEmailDescs
+ * Return the messages in the realm's email outbox: those waiting to be sent, and
+ * those that the outbox has given up on (see EmailOutbox.go).
+ */
+func getEmailOutbox(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var realmId string
+	var err error
+	realmId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RealmId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, realmId,
+		"getEmailOutbox")
+	if failMsg != nil { return failMsg }
+	
+	_, err = dbClient.getRealm(realmId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var emailIds []string
+	emailIds, err = dbClient.getOutboundEmailIds(realmId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var descs apitypes.OutboundEmailDescs = make([]*apitypes.OutboundEmailDesc, 0)
+	for _, emailId := range emailIds {
+		var email OutboundEmail
+		email, err = dbClient.getOutboundEmail(emailId)
+		if err != nil { continue }  // dangling Id
+		descs = append(descs, email.asOutboundEmailDesc())
+	}
+	return descs
+}
+
+/*******************************************************************************
+ * Arguments: OutboundEmailId
+ * Returns: apitypes.OutboundEmailDesc
+ * Make a message in the email outbox due immediately, with a fresh set of
+ * attempts - typically one that the outbox has given up on.
+ */
+func retryOutboundEmail(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var emailId string
+	var err error
+	emailId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "OutboundEmailId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var email OutboundEmail
+	email, err = dbClient.getOutboundEmail(emailId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+		email.getRealmId(), "retryOutboundEmail")
+	if failMsg != nil { return failMsg }
+	
+	if email.getStatus() == OutboundEmailSending { return apitypes.NewFailureDesc(
+		http.StatusConflict, "The message is being sent") }
+	err = email.retry(dbClient)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return email.asOutboundEmailDesc()
+}
+
+/*******************************************************************************
+ * Arguments: OutboundEmailId
+ * Returns: apitypes.Result
+ * Remove a message from the email outbox without sending it.
+ */
+func deleteOutboundEmail(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var emailId string
+	var err error
+	emailId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "OutboundEmailId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var email OutboundEmail
+	email, err = dbClient.getOutboundEmail(emailId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+		email.getRealmId(), "deleteOutboundEmail")
+	if failMsg != nil { return failMsg }
+	
+	err = dbClient.dbDeleteOutboundEmail(email)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return apitypes.NewResult(200, "Message to " + email.getAddress() + " deleted")
+}
+
+/*******************************************************************************
+ * Arguments: RealmId, <name>
+ * Returns: apitypes.GroupDesc
+ */
+func createGroup(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var err error
+	var realmId string
+	realmId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RealmId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var groupName string
+	groupName, err = apitypes.GetRequiredHTTPParameterValue(true, values, "Name")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+
+	var groupDescription string
+	groupDescription, err = apitypes.GetRequiredHTTPParameterValue(true, values, "Description")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var addMeStr string
+	addMeStr, err = apitypes.GetHTTPParameterValue(true, values, "AddMe")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var addMe bool = false
 	if addMeStr == "true" { addMe = true }
 	fmt.Println(fmt.Sprintf("AddMe=%s", addMeStr))
 
@@ -545,8 +1148,10 @@ func deleteGroup(dbClient *InMemClient, sessionToken *apitypes.SessionToken, val
 }
 
 /*******************************************************************************
- * Arguments: GroupId
+ * Arguments: GroupId, Effective (optional)
  * Returns: []*apitypes.UserDesc
+ * If Effective is "true", the users who belong to the group indirectly - by
+ * belonging to a group that the group contains - are returned as well.
  */
 func getGroupUsers(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
@@ -560,6 +1165,10 @@ func getGroupUsers(dbClient *InMemClient, sessionToken *apitypes.SessionToken, v
 	groupId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "GroupId")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
+	var effectiveStr string
+	effectiveStr, err = apitypes.GetHTTPParameterValue(true, values, "Effective")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
 	var group Group
 	group, err = dbClient.getGroup(groupId)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
@@ -572,6 +1181,10 @@ func getGroupUsers(dbClient *InMemClient, sessionToken *apitypes.SessionToken, v
 	if failMsg != nil { return failMsg }
 	
 	var userObjIds []string = group.getUserObjIds()
+	if effectiveStr == "true" {
+		userObjIds, err = getEffectiveGroupUserObjIds(dbClient, group)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+	}
 	var userDescs apitypes.UserDescs = make([]*apitypes.UserDesc, 0)
 	for _, id := range userObjIds {
 		var user User
@@ -669,6 +1282,120 @@ func remGroupUser(dbClient *InMemClient, sessionToken *apitypes.SessionToken, va
 	return apitypes.NewResult(200, "User " + user.getName() + " removed from group " + group.getName())
 }
 
+/*******************************************************************************
+ * Arguments: GroupId
+ * Returns: []*apitypes.GroupDesc
+ * Returns the groups that belong directly to the specified group.
+ */
+func getSubgroups(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var err error
+	var groupId string
+	groupId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "GroupId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var group Group
+	group, err = dbClient.getGroup(groupId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.ReadMask,
+		group.getRealmId(), "getSubgroups")
+	if failMsg != nil { return failMsg }
+	
+	var groupDescs apitypes.GroupDescs = make([]*apitypes.GroupDesc, 0)
+	for _, id := range group.getMemberGroupIds() {
+		var member Group
+		member, err = dbClient.getGroup(id)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		groupDescs = append(groupDescs, member.asGroupDesc())
+	}
+	
+	return groupDescs
+}
+
+/*******************************************************************************
+ * Arguments: GroupId, SubgroupId
+ * Returns: apitypes.Result
+ * Make the subgroup a member of the group. Both groups must belong to the same
+ * realm, and the group may not already belong to the subgroup.
+ */
+func addSubgroup(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var err error
+	var groupId string
+	groupId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "GroupId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var subgroupId string
+	subgroupId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "SubgroupId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var group Group
+	group, err = dbClient.getGroup(groupId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var subgroup Group
+	subgroup, err = dbClient.getGroup(subgroupId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+		group.getRealmId(), "addSubgroup")
+	if failMsg != nil { return failMsg }
+	
+	err = group.addMemberGroup(dbClient, subgroup)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	return apitypes.NewResult(200, "Group " + subgroup.getName() + " added to group " + group.getName())
+}
+
+/*******************************************************************************
+ * Arguments: GroupId, SubgroupId
+ * Returns: apitypes.Result
+ */
+func remSubgroup(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var err error
+	var groupId string
+	groupId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "GroupId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var subgroupId string
+	subgroupId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "SubgroupId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var group Group
+	group, err = dbClient.getGroup(groupId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var subgroup Group
+	subgroup, err = dbClient.getGroup(subgroupId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+		group.getRealmId(), "remSubgroup")
+	if failMsg != nil { return failMsg }
+	
+	err = group.removeMemberGroup(dbClient, subgroup)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	return apitypes.NewResult(200, "Group " + subgroup.getName() + " removed from group " + group.getName())
+}
+
 /*******************************************************************************
  * Arguments: apitypes.RealmInfo, apitypes.UserInfo
  * Returns: apitypes.UserDesc
@@ -686,11 +1413,15 @@ func createRealmAnon(dbClient *InMemClient, sessionToken *apitypes.SessionToken,
 	//var realmId string = userInfo.RealmId  // ignored
 	var email string = userInfo.EmailAddress
 	var pswd string = userInfo.Password
+	err = dbClient.getServer().checkPasswordPolicy(newUserId, pswd)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
 
 	// Create a realm.
 	var newRealmInfo *apitypes.RealmInfo
 	newRealmInfo, err = apitypes.GetRealmInfo(values)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var failMsg = checkRealmCount(dbClient)
+	if failMsg != nil { return failMsg }
 	fmt.Println("Creating realm", newRealmInfo.RealmName)
 	var newRealm Realm
 	newRealm, err = dbClient.dbCreateRealm(newRealmInfo, newUserId)
@@ -702,8 +1433,7 @@ func createRealmAnon(dbClient *InMemClient, sessionToken *apitypes.SessionToken,
 	newUser, err = dbClient.dbCreateUser(newUserId, newUserName, email, pswd, newRealm.getId())
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	if newUser != nil {
-		err = EstablishEmail(dbClient.getServer().authService, dbClient,
-			dbClient.getServer().EmailService, newUserId, email)
+		err = EstablishEmail(dbClient.getServer().authService, dbClient, newUserId, email)
 		if err != nil { return apitypes.NewFailureDescFromError(err) }
 	}
 	
@@ -791,6 +1521,39 @@ func getRealmByName(dbClient *InMemClient, sessionToken *apitypes.SessionToken,
 	return realm.asRealmDesc()
 }
 
+/*******************************************************************************
+ * Arguments: RealmId
+ * Returns: apitypes.RealmUsageDesc
+ */
+func getRealmUsage(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var err error
+	var realmId string
+	realmId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RealmId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.ReadMask, realmId,
+		"getRealmUsage")
+	if failMsg != nil { return failMsg }
+	
+	var realm Realm
+	realm, err = dbClient.getRealm(realmId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var usage *RealmUsage
+	usage, err = computeRealmUsage(dbClient, realm)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var quota = getRealmQuota(dbClient.getServer().Config, realm)
+	
+	return apitypes.NewRealmUsageDesc(realmId, usage.Repos, quota.MaxRepos,
+		usage.Images, quota.MaxImages, usage.ImageVersions, quota.MaxImageVersions,
+		usage.StoredBytes, quota.MaxStoredBytes, usage.ScansToday, quota.MaxScansPerDay)
+}
+
 /*******************************************************************************
  * Arguments: RealmInfo
  * Returns: apitypes.RealmDesc
@@ -806,6 +1569,8 @@ func createRealm(dbClient *InMemClient, sessionToken *apitypes.SessionToken, val
 	var realmInfo *apitypes.RealmInfo
 	realmInfo, err = apitypes.GetRealmInfo(values)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	failMsg = checkRealmCount(dbClient)
+	if failMsg != nil { return failMsg }
 	
 	var user User
 	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
@@ -1120,6 +1885,12 @@ func createRepo(dbClient *InMemClient, sessionToken *apitypes.SessionToken, valu
 		"createRepo")
 	if failMsg != nil { return failMsg }
 	
+	var realm Realm
+	realm, err = dbClient.getRealm(realmId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	failMsg = reserveRealmQuota(dbClient, realm, 1, 0, 0)
+	if failMsg != nil { return failMsg }
+	
 	fmt.Println("Creating repo", repoName)
 	var repo Repo
 	repo, err = dbClient.dbCreateRepo(realmId, repoName, repoDesc)
@@ -1138,6 +1909,8 @@ func createRepo(dbClient *InMemClient, sessionToken *apitypes.SessionToken, valu
 	name, filepath, err = captureFile(repo, files)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	if filepath != "" { // a file was attached - presume that it is a dockerfile
+		failMsg = checkStoredBytesQuota(dbClient, realm, filepath)
+		if failMsg != nil { return failMsg }
 		var newDockerfile Dockerfile
 		newDockerfile, err = createDockerfile(sessionToken, dbClient, repo,
 			name, filepath, repo.getDescription())
@@ -1319,6 +2092,8 @@ func addDockerfile(dbClient *InMemClient, sessionToken *apitypes.SessionToken, v
 	name, filepath, err = captureFile(repo, files)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	if filepath == "" { return apitypes.NewFailureDesc(http.StatusBadRequest, "No file was found") }
+	failMsg = checkRepoStoredBytesQuota(dbClient, repo, filepath)
+	if failMsg != nil { return failMsg }
 	
 	var dockerfile Dockerfile
 	dockerfile, err = createDockerfile(sessionToken, dbClient, repo, name, filepath, desc)
@@ -1468,6 +2243,8 @@ func replaceDockerfile(dbClient *InMemClient, sessionToken *apitypes.SessionToke
 	_, filepath, err = captureFile(repo, files)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	if filepath == "" { return apitypes.NewFailureDesc(http.StatusBadRequest, "No file was found") }
+	failMsg = checkRepoStoredBytesQuota(dbClient, repo, filepath)
+	if failMsg != nil { return failMsg }
 	
 	
 	//....create DockerfileExecParameterValues
@@ -1509,6 +2286,12 @@ func execDockerfile(dbClient *InMemClient, sessionToken *apitypes.SessionToken,
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	fmt.Println("Dockerfile name =", dockerfile.getName())
 	
+	var repo Repo
+	repo, err = dockerfile.getRepo(dbClient)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	failMsg = reserveBuildQuota(dbClient, repo, values)
+	if failMsg != nil { return failMsg }
+	
 	var imageVersion DockerImageVersion
 	imageVersion, err = buildDockerfile(dbClient, dockerfile, sessionToken, values)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
@@ -1555,6 +2338,8 @@ func addAndExecDockerfile(dbClient *InMemClient, sessionToken *apitypes.SessionT
 	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, repoId,
 		"addAndExecDockerfile")
 	if failMsg != nil { return failMsg }
+	failMsg = reserveBuildQuota(dbClient, repo, values)
+	if failMsg != nil { return failMsg }
 	
 	var desc string
 	desc, err = apitypes.GetHTTPParameterValue(true, values, "Description")
@@ -1565,6 +2350,8 @@ func addAndExecDockerfile(dbClient *InMemClient, sessionToken *apitypes.SessionT
 	name, filepath, err = captureFile(repo, files)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	if filepath == "" { return apitypes.NewFailureDesc(http.StatusBadRequest, "No file was found") }
+	failMsg = checkRepoStoredBytesQuota(dbClient, repo, filepath)
+	if failMsg != nil { return failMsg }
 	
 	var dockerfile Dockerfile
 	dockerfile, err = createDockerfile(sessionToken, dbClient, repo, name, filepath, desc)
@@ -1650,8 +2437,12 @@ func downloadImage(dbClient *InMemClient, sessionToken *apitypes.SessionToken, v
 }
 
 /*******************************************************************************
- * Arguments: PartyId, ResourceId, PermissionMask
+ * Arguments: PartyId, ResourceId, PermissionMask, DenyMask (optional), ExpiresAt (optional)
  * Returns: PermissionDesc
+ * Replaces the party's grants and denials for the resource. The DenyMask consists
+ * of the parameters DenyCreateIn, DenyRead, DenyWrite, DenyExecute, DenyDelete,
+ * each "true" or "false" (the default). If ExpiresAt (RFC 3339) is specified,
+ * the grants and denials lapse at that time; otherwise they do not expire.
  */
 func setPermission(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
@@ -1684,6 +2475,13 @@ func setPermission(dbClient *InMemClient, sessionToken *apitypes.SessionToken, v
 	mask, err = apitypes.ToBoolAr(smask)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
+	var denyMask []bool
+	denyMask, err = getDenyMaskParameters(values, mask)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var expiresAt time.Time
+	expiresAt, _, err = getExpiryParameter(values)  // zero if absent: no expiry
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
 	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, resourceId,
 		"setPermission")
 	if failMsg != nil { return failMsg }
@@ -1706,13 +2504,25 @@ func setPermission(dbClient *InMemClient, sessionToken *apitypes.SessionToken, v
 	var aclEntry ACLEntry
 	aclEntry, err = dbClient.setAccess(resource, party, mask)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	err = aclEntry.setDenyMask(dbClient, denyMask)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var grantor User
+	grantor, err = getCurrentUser(dbClient, sessionToken)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	err = aclEntry.setExpiry(dbClient, expiresAt, grantor.getId())
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	err = queuePermissionChangeWebhookEvent(dbClient, "set", resource, party, aclEntry)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
 	return aclEntry.asPermissionDesc()
 }
 
 /*******************************************************************************
- * Arguments: PartyId, ResourceId, PermissionMask
+ * Arguments: PartyId, ResourceId, PermissionMask, DenyMask (optional), ExpiresAt (optional)
  * Returns: PermissionDesc
+ * Adds to the party's grants and denials for the resource. Granting a mode
+ * removes any denial of it, and vice versa. If ExpiresAt is specified, it
+ * replaces any existing expiry of the party's grants and denials for the resource.
  */
 func addPermission(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
@@ -1744,6 +2554,14 @@ func addPermission(dbClient *InMemClient, sessionToken *apitypes.SessionToken, v
 	var mask []bool
 	mask, err = apitypes.ToBoolAr(smask)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var denyMask []bool
+	denyMask, err = getDenyMaskParameters(values, mask)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var expiresAt time.Time
+	var hasExpiry bool
+	expiresAt, hasExpiry, err = getExpiryParameter(values)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
 
 	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, resourceId,
 		"addPermission")
@@ -1767,6 +2585,17 @@ func addPermission(dbClient *InMemClient, sessionToken *apitypes.SessionToken, v
 	var aclEntry ACLEntry
 	aclEntry, err = dbClient.addAccess(resource, party, mask)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	err = aclEntry.addDenyMask(dbClient, denyMask)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if hasExpiry {
+		var grantor User
+		grantor, err = getCurrentUser(dbClient, sessionToken)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		err = aclEntry.setExpiry(dbClient, expiresAt, grantor.getId())
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+	}
+	err = queuePermissionChangeWebhookEvent(dbClient, "add", resource, party, aclEntry)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
 	return aclEntry.asPermissionDesc()
 }
@@ -1856,501 +2685,919 @@ func getPermission(dbClient *InMemClient, sessionToken *apitypes.SessionToken, v
 	aclEntry, err = party.getACLEntryForResourceId(dbClient, resourceId)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	var mask []bool
+	var denyMask []bool
 	var aclEntryId string = ""
+	var roleName string = ""
+	var expiresAt time.Time
+	var invitationId string = ""
 	if aclEntry == nil {
 		mask = make([]bool, 5)
+		denyMask = make([]bool, 5)
 	} else {
 		mask = aclEntry.getPermissionMask()
+		denyMask = aclEntry.getDenyMask()
 		aclEntryId = aclEntry.getId()
+		roleName = aclEntry.getRoleName()
+		expiresAt = aclEntry.getExpiresAt()
+		invitationId = aclEntry.getInvitationId()
 	}
-	return apitypes.NewPermissionDesc(aclEntryId, resourceId, partyId, mask)
+	return apitypes.NewPermissionDesc(aclEntryId, resourceId, partyId, mask, denyMask,
+		roleName, expiresAt, invitationId)
 }
 
 /*******************************************************************************
- * Arguments: 
- * Returns: apitypes.UserDesc
+ * Arguments: RealmId, RoleName, Description, PermissionMask
+ * Returns: RoleDesc
+ * Defines a role for the realm. The name may not be that of a built-in role.
  */
-func getMyDesc(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func defineRole(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
 
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
-	if sessionToken == nil { return apitypes.NewFailureDesc(
-		http.StatusUnauthorized, "User not authenticated") }
-	
-	// Identify the user.
-	var userId string = sessionToken.AuthenticatedUserid
-	fmt.Println("userid=", userId)
-	var user User
+
+	var realmId, roleName, desc string
 	var err error
-	user, err = dbClient.dbGetUserByUserId(userId)
+	realmId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RealmId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	roleName, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RoleName")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	desc, err = apitypes.GetHTTPParameterValue(true, values, "Description")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var mask []bool
+	mask, err = getPermissionMaskParameters(values)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	if user == nil {
-		return apitypes.NewFailureDesc(http.StatusBadRequest,
-			"user object cannot be identified from user id " + userId)
-	}
 
-	return user.asUserDesc(dbClient)
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, realmId,
+		"defineRole")
+	if failMsg != nil { return failMsg }
+	
+	var role Role
+	role, err = dbClient.dbCreateRole(realmId, roleName, desc, mask)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	return role.asRoleDesc()
 }
 
 /*******************************************************************************
- * Arguments: 
- * Returns: []*apitypes.GroupDesc
+ * Arguments: RealmId, RoleName, Description, PermissionMask
+ * Returns: RoleDesc
+ * Changes the definition of a role that the realm defines. Each party to whom
+ * the role has been assigned receives the new permissions.
  */
-func getMyGroups(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func updateRole(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
 
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
 
-	var groupDescs apitypes.GroupDescs = make([]*apitypes.GroupDesc, 0)
-	var user User
+	var realmId, roleName, desc string
 	var err error
-	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
+	realmId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RealmId")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	var groupIds []string = user.getGroupIds()
-	for _, groupId := range groupIds {
-		var group Group
-		var err error
-		group, err = dbClient.getGroup(groupId)
-		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		if group == nil {
-			fmt.Println("Internal error: group with Id " + groupId + " could not be found")
-			continue
-		}
-		groupDescs = append(groupDescs, group.asGroupDesc())
-	}
-	return groupDescs
+	roleName, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RoleName")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	desc, err = apitypes.GetHTTPParameterValue(true, values, "Description")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var mask []bool
+	mask, err = getPermissionMaskParameters(values)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, realmId,
+		"updateRole")
+	if failMsg != nil { return failMsg }
+	
+	var role Role
+	role, failMsg = getRealmRoleByName(dbClient, realmId, roleName)
+	if failMsg != nil { return failMsg }
+	err = role.setDefinition(dbClient, desc, mask)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	return role.asRoleDesc()
 }
 
 /*******************************************************************************
- * Arguments: 
- * Returns: []*apitypes.RealmDesc
+ * Arguments: RealmId, RoleName
+ * Returns: Result
+ * Removes a role that the realm defines. The role may not be assigned to anyone.
  */
-func getMyRealms(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func deleteRole(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
 
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
 
-	var realms map[string]Realm = make(map[string]Realm)
-	
-	var user User
+	var realmId, roleName string
 	var err error
-	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
+	realmId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RealmId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	roleName, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RoleName")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	var aclEntrieIds []string = user.getACLEntryIds()
-	fmt.Println("For each acl entry...")
-	for _, aclEntryId := range aclEntrieIds {
-		var err error
-		var aclEntry ACLEntry
-		aclEntry, err = dbClient.getACLEntry(aclEntryId)
-		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		var resourceId string = aclEntry.getResourceId()
-		var resource Resource
-		resource, err = dbClient.getResource(resourceId)
-		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		switch v := resource.(type) {
-			case Realm: realms[v.getId()] = v
-				fmt.Println("\t\ta Realm")
-			default: fmt.Println("\t\ta " + reflect.TypeOf(v).String())
-		}
-	}
-	fmt.Println("For each realm...")
-	var realmDescs apitypes.RealmDescs = make([]*apitypes.RealmDesc, 0)
-	for _, realm := range realms {
-		fmt.Println("\tappending realm", realm.getName())
-		realmDescs = append(realmDescs, realm.asRealmDesc())
-	}
-	return realmDescs
-}
-
-/*******************************************************************************
- * Arguments: 
- * Returns: []*apitypes.RepoDesc
- */
-func getMyRepos(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
-	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
 
-	var failMsg apitypes.RespIntfTp
-	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, realmId,
+		"deleteRole")
 	if failMsg != nil { return failMsg }
 	
-	// Traverse the user's ACL entries; form the union of the repos that the user
-	// has explicit access to, and the repos that belong to the realms that the user
-	// has access to.
-	
-	var realms map[string]Realm = make(map[string]Realm)
-	var repos map[string]Repo = make(map[string]Repo)
-	
-	var user User
-	var err error
-	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
+	var role Role
+	role, failMsg = getRealmRoleByName(dbClient, realmId, roleName)
+	if failMsg != nil { return failMsg }
+	if role.isBuiltIn() { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Built-in role " + roleName + " may not be deleted") }
+	var realm Realm
+	realm, err = dbClient.getRealm(realmId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	err = realm.deleteRole(dbClient, role)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	var aclEntrieIds []string = user.getACLEntryIds()
-	for _, aclEntryId := range aclEntrieIds {
-		var err error
-		var aclEntry ACLEntry
-		aclEntry, err = dbClient.getACLEntry(aclEntryId)
-		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		var resourceId string = aclEntry.getResourceId()
-		var resource Resource
-		resource, err = dbClient.getResource(resourceId)
-		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		switch v := resource.(type) {
-			case Realm: realms[v.getId()] = v
-			case Repo: repos[v.getId()] = v
-		}
-	}
-	for _, realm := range realms {
-		// Add all of the repos belonging to realm.
-		for _, repoId := range realm.getRepoIds() {
-			var r Repo
-			var err error
-			r, err = dbClient.getRepo(repoId)
-			if err != nil { return apitypes.NewFailureDescFromError(err) }
-			if r == nil { return apitypes.NewFailureDesc(http.StatusInternalServerError,
-				"Internal error: No repo found for Id " + repoId) }
-			repos[repoId] = r
-		}
-	}
-	var repoDescs apitypes.RepoDescs = make([]*apitypes.RepoDesc, 0)
-	for _, repo := range repos {
-		repoDescs = append(repoDescs, repo.asRepoDesc())
-	}
 	
-	return repoDescs
+	return apitypes.NewResult(200, "Role " + roleName + " deleted")
 }
 
 /*******************************************************************************
- * Arguments: 
- * Returns: DockerfileDescs
+ * Arguments: RealmId
+ * Returns: []*apitypes.RoleDesc
+ * Lists the built-in roles, followed by the roles that the realm defines.
  */
-func getMyDockerfiles(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func getRealmRoles(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
 
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
-	
-	var user User
+
+	var realmId string
 	var err error
-	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
+	realmId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RealmId")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
+
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.ReadMask, realmId,
+		"getRealmRoles")
+	if failMsg != nil { return failMsg }
 	
-	var leaves map[string]Resource
-	leaves, err = getLeafResources(dbClient, user, ADockerfile)
+	var realm Realm
+	realm, err = dbClient.getRealm(realmId)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
-	fmt.Println("Creating result...")
-	var dockerfileDescs apitypes.DockerfileDescs = make([]*apitypes.DockerfileDesc, 0)
-	for _, leaf := range leaves {
-		fmt.Println("\tappending dockerfile", leaf.getName())
-		var dockerfile Dockerfile
-		var isType bool
-		dockerfile, isType = leaf.(Dockerfile)
-		if ! isType { return apitypes.NewFailureDesc(http.StatusInternalServerError,
-			"Internal error: type of resource is unexpected") }
-		var dockerfileDesc *apitypes.DockerfileDesc
-		dockerfileDesc, err = dockerfile.asDockerfileDesc()
+	var roleDescs apitypes.RoleDescs = make([]*apitypes.RoleDesc, 0)
+	for _, role := range BuiltInRoles {
+		roleDescs = append(roleDescs, role.asRoleDesc())
+	}
+	for _, roleId := range realm.getRoleIds() {
+		var role Role
+		role, err = dbClient.getRole(roleId)
 		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		dockerfileDescs = append(dockerfileDescs, dockerfileDesc)
+		roleDescs = append(roleDescs, role.asRoleDesc())
 	}
-	return dockerfileDescs
+	return roleDescs
 }
 
 /*******************************************************************************
- * Arguments: 
- * Returns: DockerImageDescs
+ * Arguments: PartyId, ResourceId, RoleName
+ * Returns: PermissionDesc
+ * Replaces the permissions that the party has for the resource with those of
+ * the role, which must be a built-in role or one defined by the resource's realm.
+ * Denials of modes that the role does not grant are retained.
  */
-func getMyDockerImages(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func assignRole(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
 
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
-	
-	var user User
+
+	var partyId, resourceId, roleName string
 	var err error
-	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
+	partyId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "PartyId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	resourceId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ResourceId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	roleName, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RoleName")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
+
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, resourceId,
+		"assignRole")
+	if failMsg != nil { return failMsg }
 	
-	var leaves map[string]Resource
-	leaves, err = getLeafResources(dbClient, user, ADockerImage)
+	// Identify the Resource, and the realm that contains it.
+	var resource Resource
+	resource, err = dbClient.getResource(resourceId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if resource == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Unable to identify resource with Id " + resourceId) }
+	var lineage []Resource
+	lineage, err = getResourceLineage(dbClient, resource)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
-	fmt.Println("Creating result...")
-	var dockerImageDescs apitypes.DockerImageDescs = make([]*apitypes.DockerImageDesc, 0)
-	for _, leaf := range leaves {
-		fmt.Println("\tappending docker image", leaf.getName())
-		var dockerImage DockerImage
-		var isType bool
-		dockerImage, isType = leaf.(DockerImage)
-		if ! isType { return apitypes.NewFailureDesc(http.StatusInternalServerError,
-			"Internal error: type of resource is unexpected") }
-		dockerImageDescs = append(dockerImageDescs, dockerImage.asDockerImageDesc())
-	}
-	return dockerImageDescs
+	// Identify the Party.
+	var party Party
+	party, err = dbClient.getParty(partyId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if party == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Unable to identify party with Id " + partyId) }
+	
+	var role Role
+	role, failMsg = getRealmRoleByName(dbClient, lineage[len(lineage)-1].getId(), roleName)
+	if failMsg != nil { return failMsg }
+	
+	var aclEntry ACLEntry
+	aclEntry, err = dbClient.setAccess(resource, party, make([]bool, NumberOfAccessModes))
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	err = aclEntry.setRole(dbClient, role)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	err = queuePermissionChangeWebhookEvent(dbClient, "set", resource, party, aclEntry)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	return aclEntry.asPermissionDesc()
 }
 
 /*******************************************************************************
- * Arguments: 
- * Returns: ScanConfigDesc...
+ * Arguments: ResourceId, InviteeRealmName, InviteeUserId | InviteeEmail | InviteeGroupName,
+ *	PermissionMask
+ * Returns: InvitationDesc
+ * Invites a user or group of another realm to access the resource. The access is
+ * granted when an administrator of the invitee's realm accepts the invitation.
+ * The invitee is not looked up until then, and so the response is the same
+ * whether or not the realm has such a user or group.
  */
-func getMyScanConfigs(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func inviteParty(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
-	
+
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
 
-	var user User
+	var resourceId, realmName, inviteeUserId, inviteeEmail, inviteeGroupName string
 	var err error
-	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
+	resourceId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ResourceId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	realmName, err = apitypes.GetRequiredHTTPParameterValue(true, values, "InviteeRealmName")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	inviteeUserId, err = apitypes.GetHTTPParameterValue(true, values, "InviteeUserId")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	inviteeEmail, err = apitypes.GetHTTPParameterValue(true, values, "InviteeEmail")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	inviteeGroupName, err = apitypes.GetHTTPParameterValue(true, values, "InviteeGroupName")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var mask []bool
+	mask, err = getPermissionMaskParameters(values)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, resourceId,
+		"inviteParty")
+	if failMsg != nil { return failMsg }
 	
-	var leaves map[string]Resource
-	leaves, err = getLeafResources(dbClient, user, AScanConfig)
+	// Identify the invitee's realm.
+	var realmId string
+	realmId, err = dbClient.getPersistence().GetRealmObjIdByRealmName(realmName)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if realmId == "" { return apitypes.NewFailureDesc(
+		http.StatusBadRequest, "Realm with name " + realmName + " not found") }
 	
-	fmt.Println("Creating result...")
-	var dcanConfigDescs apitypes.ScanConfigDescs = make([]*apitypes.ScanConfigDesc, 0)
-	for _, leaf := range leaves {
-		fmt.Println("\tappending scan config", leaf.getName())
-		var dcanConfig ScanConfig
-		var isType bool
-		dcanConfig, isType = leaf.(ScanConfig)
-		if ! isType { return apitypes.NewFailureDesc(http.StatusInternalServerError,
-			"Internal error: type of resource is unexpected") }
-		dcanConfigDescs = append(dcanConfigDescs, dcanConfig.asScanConfigDesc(dbClient))
-	}
-	return dcanConfigDescs
+	var inviter User
+	inviter, err = getCurrentUser(dbClient, sessionToken)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var invitation Invitation
+	invitation, err = dbClient.dbCreateInvitation(resourceId, inviter.getId(), realmId,
+		inviteeUserId, inviteeEmail, inviteeGroupName, mask)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	return invitation.asInvitationDesc()
 }
 
 /*******************************************************************************
- * Arguments: 
- * Returns: FlagDesc...
+ * Arguments: RealmId
+ * Returns: []*apitypes.InvitationDesc
+ * Lists the invitations made by the realm's users and those made to the realm's
+ * users and groups.
  */
-func getMyFlags(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func getRealmInvitations(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
-	
+
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
-	
-	var user User
+
+	var realmId string
 	var err error
-	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
+	realmId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RealmId")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
+
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, realmId,
+		"getRealmInvitations")
+	if failMsg != nil { return failMsg }
 	
-	var leaves map[string]Resource
-	leaves, err = getLeafResources(dbClient, user, AFlag)
+	var realm Realm
+	realm, err = dbClient.getRealm(realmId)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	
-	fmt.Println("Creating result...")
-	var flagDescs apitypes.FlagDescs = make([]*apitypes.FlagDesc, 0)
-	for _, leaf := range leaves {
-		fmt.Println("\tappending docker image", leaf.getName())
-		var flag Flag
-		var isType bool
-		flag, isType = leaf.(Flag)
-		if ! isType { return apitypes.NewFailureDesc(http.StatusInternalServerError,
-			"Internal error: type of resource is unexpected") }
-		flagDescs = append(flagDescs, flag.asFlagDesc())
+	var invitationDescs apitypes.InvitationDescs = make([]*apitypes.InvitationDesc, 0)
+	for _, invitationId := range realm.getInvitationIds() {
+		var invitation Invitation
+		invitation, err = dbClient.getInvitation(invitationId)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		invitationDescs = append(invitationDescs, invitation.asInvitationDesc())
 	}
-	return flagDescs
+	return invitationDescs
 }
 
 /*******************************************************************************
- * Arguments: (none)
- * Returns: scanners.ScanProviderDescs
+ * Arguments: InvitationId
+ * Returns: PermissionDesc
+ * Accepts an invitation made to a user or group of a realm that the current user
+ * administers, granting the invitee access to the other realm's resource.
  */
-func getScanProviders(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func acceptInvitation(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
 
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
+
+	var invitation Invitation
+	invitation, failMsg = getInvitationParameter(dbClient, values)
+	if failMsg != nil { return failMsg }
+
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+		invitation.getInviteeRealmId(), "acceptInvitation")
+	if failMsg != nil { return failMsg }
 	
-	var providerDescs scanners.ScanProviderDescs = make([]*scanners.ScanProviderDesc, 0)
-	var services []scanners.ScanService = dbClient.Server.GetScanServices()
-	for _, service := range services {
-		providerDescs = append(providerDescs, service.AsScanProviderDesc())
-	}
-	
-	return providerDescs
+	var entry ACLEntry
+	var err error
+	entry, err = invitation.accept(dbClient)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return entry.asPermissionDesc()
 }
 
 /*******************************************************************************
- * Arguments: Name, Description, RepoId, ProviderName, Params..., SuccessExpression, <optional File>
- * Returns: ScanConfigDesc
+ * Arguments: InvitationId
+ * Returns: InvitationDesc
+ * Declines an invitation made to a user or group of a realm that the current
+ * user administers.
  */
-func defineScanConfig(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func rejectInvitation(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
-	
+
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
+
+	var invitation Invitation
+	invitation, failMsg = getInvitationParameter(dbClient, values)
+	if failMsg != nil { return failMsg }
+
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+		invitation.getInviteeRealmId(), "rejectInvitation")
+	if failMsg != nil { return failMsg }
 	
-	var err error
-	var providerName string
-	providerName, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ProviderName")
+	var err = invitation.reject(dbClient)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	
-	var scanService scanners.ScanService
-	scanService = dbClient.Server.GetScanService(providerName)
-	if scanService == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
-		"Unable to identify a scan service named '" + providerName + "'")
+	return invitation.asInvitationDesc()
+}
+
+/*******************************************************************************
+ * Arguments: InvitationId
+ * Returns: InvitationDesc
+ * Withdraws an invitation, or, if it was accepted, removes the access that it
+ * granted. Either a user who may change the permissions of the resource, or an
+ * administrator of the invitee's realm, may revoke the invitation.
+ */
+func revokeInvitation(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var invitation Invitation
+	invitation, failMsg = getInvitationParameter(dbClient, values)
+	if failMsg != nil { return failMsg }
+
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+		invitation.getResourceId(), "revokeInvitation")
+	if failMsg != nil {
+		failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+			invitation.getInviteeRealmId(), "revokeInvitation")
+		if failMsg != nil { return failMsg }
 	}
 	
-	var name string
-	name, err = apitypes.GetRequiredHTTPParameterValue(true, values, "Name")
+	var err = invitation.revoke(dbClient)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	
-	var desc string
-	desc, err = apitypes.GetRequiredHTTPParameterValue(true, values, "Description")
+	return invitation.asInvitationDesc()
+}
+
+/*******************************************************************************
+ * Arguments: RealmId, WithinHours (optional, default 168, at most MaxExpiringWithinHours)
+ * Returns: []*apitypes.PermissionDesc
+ * Lists the permissions for the realm, and for the resources that it contains,
+ * that will expire within the specified number of hours, soonest first.
+ */
+func getExpiringPermissions(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var realmId string
+	var err error
+	realmId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "RealmId")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	
-	var repoId string
-	repoId, err = apitypes.GetHTTPParameterValue(true, values, "RepoId")
+	var withinHours = 168
+	var value string
+	value, err = apitypes.GetHTTPParameterValue(true, values, "WithinHours")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	// If not specified, use default repo (and create if not exist).
-	var repo Repo
-	if repoId == "" {
-		repo, err = getDefaultRepoForUser(dbClient, sessionToken.AuthenticatedUserid)
-		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		repoId = repo.getId()
-	} else {
-		repo, err = dbClient.getRepo(repoId)
-		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		if repo == nil { return apitypes.NewFailureDesc(http.StatusBadRequest, "Repo does not exist") }
+	if value != "" {
+		withinHours, err = strconv.Atoi(value)
+		if (err != nil) || (withinHours < 0) { return apitypes.NewFailureDesc(http.StatusBadRequest,
+			"WithinHours must be a non-negative integer") }
+		if withinHours > MaxExpiringWithinHours { withinHours = MaxExpiringWithinHours }  // so the duration cannot overflow
 	}
 	
-	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, repoId,
-		"defineScanConfig")
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, realmId,
+		"getExpiringPermissions")
 	if failMsg != nil { return failMsg }
 	
-	var successExpr string = ""
-	successExpr, err = apitypes.GetHTTPParameterValue(true, values, "SuccessExpression")
+	var entries []ACLEntry
+	entries, err = getRealmACLEntries(dbClient, realmId)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var now = time.Now()
+	var horizon = now.Add(time.Duration(withinHours) * time.Hour)
+	var expiring = make([]ACLEntry, 0)
+	for _, entry := range entries {
+		if entry.getExpiresAt().IsZero() || entry.hasExpired(now) { continue }
+		if entry.getExpiresAt().After(horizon) { continue }
+		
+		// Insert in order of expiry.
+		var i = len(expiring)
+		for (i > 0) && expiring[i-1].getExpiresAt().After(entry.getExpiresAt()) { i-- }
+		expiring = append(expiring, nil)
+		copy(expiring[i+1:], expiring[i:])
+		expiring[i] = entry
+	}
 	
-	var scanConfig ScanConfig
-	var paramValueIds []string = make([]string, 0)
-	scanConfig, err = dbClient.dbCreateScanConfig(name, desc, repoId,
-		providerName, paramValueIds, successExpr, "")
+	var permissionDescs apitypes.PermissionDescs = make([]*apitypes.PermissionDesc, 0)
+	for _, entry := range expiring {
+		permissionDescs = append(permissionDescs, entry.asPermissionDesc())
+	}
+	return permissionDescs
+}
+
+/*******************************************************************************
+ * Arguments: PartyId (optional), ResourceId, Action
+ * Returns: AccessExplanationDesc
+ * Explains whether the party may perform the action (CreateIn, Read, Write,
+ * Execute, or Delete) on the resource, and why. If PartyId is omitted, it is the
+ * current user. A user may always ask about their own access - including access
+ * that they are denied - and is then told only about the entries that apply to
+ * them and the groups through which they apply - and, unless they may read the
+ * resource, the resource and those that contain it are identified only by their
+ * Ids. Asking about another party requires permission to change the resource's
+ * permissions.
+ */
+func explainAccess(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var partyId, resourceId, actionName string
+	var err error
+	partyId, err = apitypes.GetHTTPParameterValue(true, values, "PartyId")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	
-	// Retrieve and set the provider parameters.
-	for key, valueAr := range values {
-		if strings.HasPrefix(key, "scan.") {
-			if len(valueAr) != 1 { return apitypes.NewFailureDesc(http.StatusBadRequest,
-				"Parameter " + key + " is ill-formatted")
-			}
-			var paramName string = strings.TrimPrefix(key, "scan.")
-			// See if the parameter is known by the scanner.
-			_, err = scanService.GetParameterDescription(paramName)
-			if err != nil { return apitypes.NewFailureDescFromError(err) }
-			// Create a ParameterValue and attach it to the ScanConfig.
-			if len(valueAr) != 1 { return apitypes.NewFailureDesc(http.StatusBadRequest,
-				"Value for scan parameter '" + paramName + "' is ill-formed") }
-			var value string = valueAr[0]
-			_, err = scanConfig.setParameterValue(dbClient, paramName, value)
-			if err != nil { return apitypes.NewFailureDescFromError(err) }
-		}
+	resourceId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ResourceId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	actionName, err = apitypes.GetRequiredHTTPParameterValue(true, values, "Action")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var action = -1
+	for i, name := range AccessModeNames {
+		if name == actionName { action = i }
 	}
+	if action == -1 { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Action must be one of " + strings.Join(AccessModeNames, ", ")) }
 	
-	// Add ACL entry to enable the current user to access what he/she just created.
-	var userId string = sessionToken.AuthenticatedUserid
 	var user User
-	user, err = dbClient.dbGetUserByUserId(userId)
+	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	if user == nil { return apitypes.NewFailureDesc(http.StatusInternalServerError,
-		"Internal error - could not identify user after use has been authenticated") }
-
-	_, err = dbClient.dbCreateACLEntry(scanConfig.getId(), user.getId(),
-		[]bool{ true, true, true, true, true } )
-	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	
-	// Add success image, if one was attached.
-	var imageFilepath string
-	_, imageFilepath, err = captureFile(repo, files)
-	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	if imageFilepath != "" { // a file was attached - presume that it is an image
-		fmt.Println("file attached...")
-		var flag Flag
-		flag, err = dbClient.dbCreateFlag(name, desc, repoId, imageFilepath)
-		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		err = scanConfig.setFlagId(dbClient, flag.getId())
-		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		if scanConfig.getFlagId() == "" { return apitypes.NewFailureDesc(
-			http.StatusInternalServerError, "Flag set failed") }
-		// Add ACL entry.
-		_, err = dbClient.dbCreateACLEntry(flag.getId(), user.getId(),
-			[]bool{ true, true, true, true, true } )
+		"User with Id " + sessionToken.AuthenticatedUserid + " not found") }
+	if partyId == "" { partyId = user.getId() }
+	var redactNames = false
+	if partyId != user.getId() {
+		failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, resourceId,
+			"explainAccess")
+		if failMsg != nil { return failMsg }
+	} else if dbClient.getServer().Authorize {
+		var mayRead bool
+		mayRead, err = dbClient.getServer().authService.authorized(dbClient, sessionToken,
+			apitypes.ReadMask, resourceId)
 		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		redactNames = ! mayRead
 	}
 	
-	return scanConfig.asScanConfigDesc(dbClient)
+	var resource Resource
+	resource, err = dbClient.getResource(resourceId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if resource == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Unable to identify resource with Id " + resourceId) }
+	var party Party
+	party, err = dbClient.getParty(partyId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if party == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Unable to identify party with Id " + partyId) }
+	
+	var explanation *apitypes.AccessExplanationDesc
+	explanation, err = explainPartyAccess(dbClient, party, resource, action, redactNames)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return explanation
 }
 
 /*******************************************************************************
- * Arguments: ScanConfigId, Name, Description, ProviderName, Params..., SuccessExpression, file
- * Returns: ScanConfigDesc
+ * Arguments: ResourceId
+ * Returns: []*apitypes.PartyAccessDesc
+ * Lists every user and group that has at least one access mode for the resource,
+ * whether by an ACL entry for the resource, by inheritance from a resource that
+ * contains it, or by group membership. Intended for access reviews.
  */
-func updateScanConfig(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func getResourceAccess(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
 
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
-		
-	// Update only the fields that are specified and that are not empty strings.
-	var err error
 
-	var scanConfigId string
-	scanConfigId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ScanConfigId")
-	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	
-	var scanConfig ScanConfig
-	scanConfig, err = dbClient.getScanConfig(scanConfigId)
+	var resourceId string
+	var err error
+	resourceId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ResourceId")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
-	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
-		scanConfig.getRepoId(), "defineScanConfig")
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, resourceId,
+		"getResourceAccess")
 	if failMsg != nil { return failMsg }
 	
-	var name string
-	name, err = apitypes.GetHTTPParameterValue(true, values, "Name")
-	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	if name != "" { scanConfig.setNameDeferredUpdate(name) }
-	
-	var desc string
-	desc, err = apitypes.GetHTTPParameterValue(true, values, "Description")
-	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	if desc != "" { scanConfig.setDescriptionDeferredUpdate(desc) }
-	
-	var providerName string
-	providerName, err = apitypes.GetHTTPParameterValue(true, values, "ProviderName")
+	var resource Resource
+	resource, err = dbClient.getResource(resourceId)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	if providerName != "" { scanConfig.setProviderNameDeferredUpdate(providerName) }
+	if resource == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Unable to identify resource with Id " + resourceId) }
 	
-	var successExpr string = ""
-	successExpr, err = apitypes.GetHTTPParameterValue(true, values, "SuccessExpression")
+	var parties []Party
+	var masks [][]bool
+	parties, masks, err = getPartiesWithAccess(dbClient, resource)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	if successExpr != "" { scanConfig.setSuccessExpressionDeferredUpdate(successExpr) }
-	
-	var scanService scanners.ScanService
-	scanService = dbClient.Server.GetScanService(scanConfig.getProviderName())
-	if scanService == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
-		"Unable to identify a scan service named '" + providerName + "'")
+	var partyDescs apitypes.PartyAccessDescs = make([]*apitypes.PartyAccessDesc, 0)
+	for i, party := range parties {
+		var _, isGroup = party.(Group)
+		partyDescs = append(partyDescs, apitypes.NewPartyAccessDesc(party.getId(),
+			party.getName(), isGroup, masks[i]))
 	}
+	return partyDescs
+}
+
+/*******************************************************************************
+ * Arguments: 
+ * Returns: apitypes.UserDesc
+ */
+func getMyDesc(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	if sessionToken == nil { return apitypes.NewFailureDesc(
+		http.StatusUnauthorized, "User not authenticated") }
 	
-	err = dbClient.writeBack(scanConfig)
+	// Identify the user.
+	var userId string = sessionToken.AuthenticatedUserid
+	fmt.Println("userid=", userId)
+	var user User
+	var err error
+	user, err = dbClient.dbGetUserByUserId(userId)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	
+	if user == nil {
+		return apitypes.NewFailureDesc(http.StatusBadRequest,
+			"user object cannot be identified from user id " + userId)
+	}
+
+	return user.asUserDesc(dbClient)
+}
+
+/*******************************************************************************
+ * Arguments: 
+ * Returns: []*apitypes.GroupDesc
+ */
+func getMyGroups(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var groupDescs apitypes.GroupDescs = make([]*apitypes.GroupDesc, 0)
+	var user User
+	var err error
+	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var groupIds []string = user.getGroupIds()
+	for _, groupId := range groupIds {
+		var group Group
+		var err error
+		group, err = dbClient.getGroup(groupId)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		if group == nil {
+			fmt.Println("Internal error: group with Id " + groupId + " could not be found")
+			continue
+		}
+		groupDescs = append(groupDescs, group.asGroupDesc())
+	}
+	return groupDescs
+}
+
+/*******************************************************************************
+ * Arguments: 
+ * Returns: []*apitypes.RealmDesc
+ */
+func getMyRealms(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var user User
+	var err error
+	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var realms map[string]Resource
+	realms, err = getAccessibleResourcesOfType(dbClient, user, ARealm)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var realmDescs apitypes.RealmDescs = make([]*apitypes.RealmDesc, 0)
+	for _, resource := range realms {
+		var realm Realm
+		var isType bool
+		realm, isType = resource.(Realm)
+		if ! isType { return apitypes.NewFailureDesc(http.StatusInternalServerError,
+			"Internal error: type of resource is unexpected") }
+		fmt.Println("\tappending realm", realm.getName())
+		realmDescs = append(realmDescs, realm.asRealmDesc())
+	}
+	return realmDescs
+}
+
+/*******************************************************************************
+ * Arguments: 
+ * Returns: []*apitypes.RepoDesc
+ */
+func getMyRepos(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	// The repos that the user has explicit access to, and the repos that belong
+	// to the realms that the user has access to.
+	
+	var user User
+	var err error
+	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var repos map[string]Resource
+	repos, err = getAccessibleResourcesOfType(dbClient, user, ARepo)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var repoDescs apitypes.RepoDescs = make([]*apitypes.RepoDesc, 0)
+	for _, resource := range repos {
+		var repo Repo
+		var isType bool
+		repo, isType = resource.(Repo)
+		if ! isType { return apitypes.NewFailureDesc(http.StatusInternalServerError,
+			"Internal error: type of resource is unexpected") }
+		repoDescs = append(repoDescs, repo.asRepoDesc())
+	}
+	
+	return repoDescs
+}
+
+/*******************************************************************************
+ * Arguments: 
+ * Returns: DockerfileDescs
+ */
+func getMyDockerfiles(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var user User
+	var err error
+	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var leaves map[string]Resource
+	leaves, err = getAccessibleResourcesOfType(dbClient, user, ADockerfile)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	fmt.Println("Creating result...")
+	var dockerfileDescs apitypes.DockerfileDescs = make([]*apitypes.DockerfileDesc, 0)
+	for _, leaf := range leaves {
+		fmt.Println("\tappending dockerfile", leaf.getName())
+		var dockerfile Dockerfile
+		var isType bool
+		dockerfile, isType = leaf.(Dockerfile)
+		if ! isType { return apitypes.NewFailureDesc(http.StatusInternalServerError,
+			"Internal error: type of resource is unexpected") }
+		var dockerfileDesc *apitypes.DockerfileDesc
+		dockerfileDesc, err = dockerfile.asDockerfileDesc()
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		dockerfileDescs = append(dockerfileDescs, dockerfileDesc)
+	}
+	return dockerfileDescs
+}
+
+/*******************************************************************************
+ * Arguments: 
+ * Returns: DockerImageDescs
+ */
+func getMyDockerImages(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var user User
+	var err error
+	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var leaves map[string]Resource
+	leaves, err = getAccessibleResourcesOfType(dbClient, user, ADockerImage)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	fmt.Println("Creating result...")
+	var dockerImageDescs apitypes.DockerImageDescs = make([]*apitypes.DockerImageDesc, 0)
+	for _, leaf := range leaves {
+		fmt.Println("\tappending docker image", leaf.getName())
+		var dockerImage DockerImage
+		var isType bool
+		dockerImage, isType = leaf.(DockerImage)
+		if ! isType { return apitypes.NewFailureDesc(http.StatusInternalServerError,
+			"Internal error: type of resource is unexpected") }
+		dockerImageDescs = append(dockerImageDescs, dockerImage.asDockerImageDesc())
+	}
+	return dockerImageDescs
+}
+
+/*******************************************************************************
+ * Arguments: 
+ * Returns: ScanConfigDesc...
+ */
+func getMyScanConfigs(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var user User
+	var err error
+	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var leaves map[string]Resource
+	leaves, err = getAccessibleResourcesOfType(dbClient, user, AScanConfig)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	fmt.Println("Creating result...")
+	var dcanConfigDescs apitypes.ScanConfigDescs = make([]*apitypes.ScanConfigDesc, 0)
+	for _, leaf := range leaves {
+		fmt.Println("\tappending scan config", leaf.getName())
+		var dcanConfig ScanConfig
+		var isType bool
+		dcanConfig, isType = leaf.(ScanConfig)
+		if ! isType { return apitypes.NewFailureDesc(http.StatusInternalServerError,
+			"Internal error: type of resource is unexpected") }
+		dcanConfigDescs = append(dcanConfigDescs, dcanConfig.asScanConfigDesc(dbClient))
+	}
+	return dcanConfigDescs
+}
+
+/*******************************************************************************
+ * Arguments: 
+ * Returns: FlagDesc...
+ */
+func getMyFlags(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var user User
+	var err error
+	user, err = dbClient.dbGetUserByUserId(sessionToken.AuthenticatedUserid)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var leaves map[string]Resource
+	leaves, err = getAccessibleResourcesOfType(dbClient, user, AFlag)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	fmt.Println("Creating result...")
+	var flagDescs apitypes.FlagDescs = make([]*apitypes.FlagDesc, 0)
+	for _, leaf := range leaves {
+		fmt.Println("\tappending docker image", leaf.getName())
+		var flag Flag
+		var isType bool
+		flag, isType = leaf.(Flag)
+		if ! isType { return apitypes.NewFailureDesc(http.StatusInternalServerError,
+			"Internal error: type of resource is unexpected") }
+		flagDescs = append(flagDescs, flag.asFlagDesc())
+	}
+	return flagDescs
+}
+
+/*******************************************************************************
+ * Arguments: (none)
+ * Returns: scanners.ScanProviderDescs
+ */
+func getScanProviders(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var providerDescs scanners.ScanProviderDescs = make([]*scanners.ScanProviderDesc, 0)
+	var services []scanners.ScanService = dbClient.Server.GetScanServices()
+	for _, service := range services {
+		providerDescs = append(providerDescs, service.AsScanProviderDesc())
+	}
+	
+	return providerDescs
+}
+
+/*******************************************************************************
+ * Arguments: Name, Description, RepoId, ProviderName, Params..., SuccessExpression, <optional File>
+ * Returns: ScanConfigDesc
+ */
+func defineScanConfig(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var err error
+	var providerName string
+	providerName, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ProviderName")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var scanService scanners.ScanService
+	scanService = dbClient.Server.GetScanService(providerName)
+	if scanService == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Unable to identify a scan service named '" + providerName + "'")
+	}
+	
+	var name string
+	name, err = apitypes.GetRequiredHTTPParameterValue(true, values, "Name")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var desc string
+	desc, err = apitypes.GetRequiredHTTPParameterValue(true, values, "Description")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var repoId string
+	repoId, err = apitypes.GetHTTPParameterValue(true, values, "RepoId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	// If not specified, use default repo (and create if not exist).
+	var repo Repo
+	if repoId == "" {
+		repo, err = getDefaultRepoForUser(dbClient, sessionToken.AuthenticatedUserid)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		repoId = repo.getId()
+	} else {
+		repo, err = dbClient.getRepo(repoId)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		if repo == nil { return apitypes.NewFailureDesc(http.StatusBadRequest, "Repo does not exist") }
+	}
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, repoId,
+		"defineScanConfig")
+	if failMsg != nil { return failMsg }
+	
+	var successExpr string = ""
+	successExpr, err = apitypes.GetHTTPParameterValue(true, values, "SuccessExpression")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var scanConfig ScanConfig
+	var paramValueIds []string = make([]string, 0)
+	scanConfig, err = dbClient.dbCreateScanConfig(name, desc, repoId,
+		providerName, paramValueIds, successExpr, "")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
 	// Retrieve and set the provider parameters.
 	for key, valueAr := range values {
 		if strings.HasPrefix(key, "scan.") {
@@ -2370,42 +3617,437 @@ func updateScanConfig(dbClient *InMemClient, sessionToken *apitypes.SessionToken
 		}
 	}
 	
-	// Add success image, if one was attached.
-	var userId string = sessionToken.AuthenticatedUserid
-	var user User
-	user, err = dbClient.dbGetUserByUserId(userId)
-	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	if user == nil { return apitypes.NewFailureDesc(http.StatusInternalServerError,
-		"Internal error - could not identify user after use has been authenticated") }
-	var imageFilepath string
+	// Add ACL entry to enable the current user to access what he/she just created.
+	var userId string = sessionToken.AuthenticatedUserid
+	var user User
+	user, err = dbClient.dbGetUserByUserId(userId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if user == nil { return apitypes.NewFailureDesc(http.StatusInternalServerError,
+		"Internal error - could not identify user after use has been authenticated") }
+
+	_, err = dbClient.dbCreateACLEntry(scanConfig.getId(), user.getId(),
+		[]bool{ true, true, true, true, true } )
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	// Add success image, if one was attached.
+	var imageFilepath string
+	_, imageFilepath, err = captureFile(repo, files)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if imageFilepath != "" { // a file was attached - presume that it is an image
+		fmt.Println("file attached...")
+		var flag Flag
+		flag, err = dbClient.dbCreateFlag(name, desc, repoId, imageFilepath)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		err = scanConfig.setFlagId(dbClient, flag.getId())
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		if scanConfig.getFlagId() == "" { return apitypes.NewFailureDesc(
+			http.StatusInternalServerError, "Flag set failed") }
+		// Add ACL entry.
+		_, err = dbClient.dbCreateACLEntry(flag.getId(), user.getId(),
+			[]bool{ true, true, true, true, true } )
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+	}
+	
+	return scanConfig.asScanConfigDesc(dbClient)
+}
+
+/*******************************************************************************
+ * Arguments: ScanConfigId, Name, Description, ProviderName, Params..., SuccessExpression, file
+ * Returns: ScanConfigDesc
+ */
+func updateScanConfig(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+		
+	// Update only the fields that are specified and that are not empty strings.
+	var err error
+
+	var scanConfigId string
+	scanConfigId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ScanConfigId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var scanConfig ScanConfig
+	scanConfig, err = dbClient.getScanConfig(scanConfigId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+		scanConfig.getRepoId(), "defineScanConfig")
+	if failMsg != nil { return failMsg }
+	
+	var name string
+	name, err = apitypes.GetHTTPParameterValue(true, values, "Name")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if name != "" { scanConfig.setNameDeferredUpdate(name) }
+	
+	var desc string
+	desc, err = apitypes.GetHTTPParameterValue(true, values, "Description")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if desc != "" { scanConfig.setDescriptionDeferredUpdate(desc) }
+	
+	var providerName string
+	providerName, err = apitypes.GetHTTPParameterValue(true, values, "ProviderName")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if providerName != "" { scanConfig.setProviderNameDeferredUpdate(providerName) }
+	
+	var successExpr string = ""
+	successExpr, err = apitypes.GetHTTPParameterValue(true, values, "SuccessExpression")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if successExpr != "" { scanConfig.setSuccessExpressionDeferredUpdate(successExpr) }
+	
+	var scanService scanners.ScanService
+	scanService = dbClient.Server.GetScanService(scanConfig.getProviderName())
+	if scanService == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Unable to identify a scan service named '" + providerName + "'")
+	}
+	
+	err = dbClient.writeBack(scanConfig)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	// Retrieve and set the provider parameters.
+	for key, valueAr := range values {
+		if strings.HasPrefix(key, "scan.") {
+			if len(valueAr) != 1 { return apitypes.NewFailureDesc(http.StatusBadRequest,
+				"Parameter " + key + " is ill-formatted")
+			}
+			var paramName string = strings.TrimPrefix(key, "scan.")
+			// See if the parameter is known by the scanner.
+			_, err = scanService.GetParameterDescription(paramName)
+			if err != nil { return apitypes.NewFailureDescFromError(err) }
+			// Create a ParameterValue and attach it to the ScanConfig.
+			if len(valueAr) != 1 { return apitypes.NewFailureDesc(http.StatusBadRequest,
+				"Value for scan parameter '" + paramName + "' is ill-formed") }
+			var value string = valueAr[0]
+			_, err = scanConfig.setParameterValue(dbClient, paramName, value)
+			if err != nil { return apitypes.NewFailureDescFromError(err) }
+		}
+	}
+	
+	// Add success image, if one was attached.
+	var userId string = sessionToken.AuthenticatedUserid
+	var user User
+	user, err = dbClient.dbGetUserByUserId(userId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if user == nil { return apitypes.NewFailureDesc(http.StatusInternalServerError,
+		"Internal error - could not identify user after use has been authenticated") }
+	var imageFilepath string
+	var repo Repo
+	repo, err = dbClient.getRepo(scanConfig.getRepoId())
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	_, imageFilepath, err = captureFile(repo, files)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if imageFilepath != "" { // a file was attached - presume that it is an image
+		fmt.Println("file attached...")
+		var flag Flag
+		flag, err = dbClient.dbCreateFlag(name, desc, repo.getId(), imageFilepath)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		err = scanConfig.setFlagId(dbClient, flag.getId())
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		// Add ACL entry.
+		_, err = dbClient.dbCreateACLEntry(flag.getId(), user.getId(),
+			[]bool{ true, true, true, true, true } )
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+	}
+	
+	return scanConfig.asScanConfigDesc(dbClient)
+}
+
+/*******************************************************************************
+ * Arguments: FlagId
+ * Returns: image file
+ */
+func getFlagImage(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var flagId string
+	var err error
+	flagId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "FlagId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var flag Flag
+	flag, err = dbClient.getFlag(flagId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.ReadMask, flagId,
+		"getFlagImage")
+	if failMsg != nil { return failMsg }
+
+	var path string = flag.getSuccessImagePath()
+	
+	return apitypes.NewFileResponse(200, path, false)
+}
+
+/*******************************************************************************
+ * Arguments: RepoId, Name, Description, image file
+ * Returns: FlagDesc
+ */
+func defineFlag(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var repoId string
+	var err error
+	repoId, err = apitypes.GetHTTPParameterValue(true, values, "RepoId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	// If not specified, use default repo (and create if not exist).
+	var repo Repo
+	if repoId == "" {
+		repo, err = getDefaultRepoForUser(dbClient, sessionToken.AuthenticatedUserid)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		repoId = repo.getId()
+	} else {
+		repo, err = dbClient.getRepo(repoId)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		if repo == nil { return apitypes.NewFailureDesc(http.StatusBadRequest, "Repo does not exist") }
+	}
+	
+	var name string
+	name, err = apitypes.GetRequiredHTTPParameterValue(true, values, "Name")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var desc string
+	desc, err = apitypes.GetRequiredHTTPParameterValue(true, values, "Description")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var successImagePath string
+	_, successImagePath, err = captureFile(repo, files)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if successImagePath == "" { return apitypes.NewFailureDesc(
+		http.StatusBadRequest, "No file attached") }
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.CreateInMask, repoId,
+		"defineFlag")
+	if failMsg != nil { return failMsg }
+
+	var flag Flag
+	flag, err = dbClient.dbCreateFlag(name, desc, repoId, successImagePath)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	return flag.asFlagDesc()
+}
+
+/*******************************************************************************
+ * Arguments: ScanConfigId..., ImageObjId
+ * Returns: ScanEventDescs
+ */
+func scanImage(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var scanConfigIdSeq, imageObjId string
+	var err error
+	scanConfigIdSeq, err = apitypes.GetHTTPParameterValue(false, values, "ScanConfigId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	imageObjId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ImageObjId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	// Determine if imageObjId is a DockerImage or a DockerImageVersion.
+	var dockerImage DockerImage
+	var dockerImageId string
+	var dockerImageVersion DockerImageVersion
+	var dockerImageVersionId string
+	dockerImage, err = dbClient.getDockerImage(imageObjId)
+	if err == nil {
+		// User specified a DockerImage - not an image version.
+		dockerImageId = imageObjId
+		// Get most recent image version.
+		dockerImageVersionId = dockerImage.getMostRecentVersionId()
+		if dockerImageVersionId == "" { return apitypes.NewFailureDesc(http.StatusInternalServerError,
+			"Null most recent DockerImageVersion for image " + dockerImage.getName())
+		}
+		dockerImageVersion, err = dbClient.getDockerImageVersion(dockerImageVersionId)
+		if err != nil { return apitypes.NewFailureDesc(http.StatusInternalServerError,
+			"Docker image version with object Id " + dockerImageVersionId + " not found")
+		}
+	} else {
+		dockerImageVersion, err = dbClient.getDockerImageVersion(imageObjId)
+		if err != nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+			"Docker image version with object Id " + imageObjId + " not found")
+		}
+		// User specified a particular image version.
+		dockerImageVersionId = imageObjId
+		dockerImageId = dockerImageVersion.getImageObjId()
+		dockerImage, err = dbClient.getDockerImage(dockerImageId)
+		if err != nil { return apitypes.NewFailureDesc(http.StatusInternalServerError,
+			"Docker image with object Id " + dockerImageId + " not found")
+		}
+	}
+	
+	// Determine the ScanConfigs to use.
+	var scanConfigIds []string
+	if scanConfigIdSeq == "" {
+		// Obtain the linked scan configs.
+		scanConfigIds = dockerImage.getScanConfigsToUse()
+	} else {
+		// Parse the list of scan config ids.
+		scanConfigIds = strings.Split(scanConfigIdSeq, ",")
+		for _, scanConfigId := range scanConfigIds {
+			_, err = apitypes.Sanitize(scanConfigId)
+			if err != nil { return apitypes.NewFailureDescFromError(err) }
+		}
+	}
+	
+	// Reserve the scans against the quota of the image's realm, and release
+	// those that are not performed.
 	var repo Repo
-	repo, err = dbClient.getRepo(scanConfig.getRepoId())
+	repo, err = dockerImage.getRepo(dbClient)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	_, imageFilepath, err = captureFile(repo, files)
+	var realm Realm
+	realm, err = repo.getRealm(dbClient)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	if imageFilepath != "" { // a file was attached - presume that it is an image
-		fmt.Println("file attached...")
-		var flag Flag
-		flag, err = dbClient.dbCreateFlag(name, desc, repo.getId(), imageFilepath)
+	var now = time.Now()
+	failMsg = reserveRealmScans(dbClient, realm, len(scanConfigIds), now)
+	if failMsg != nil { return failMsg }
+	var scansPerformed = 0
+	defer func() { releaseRealmScans(dbClient, realm, len(scanConfigIds) - scansPerformed, now) }()
+	
+	// Perform scan with each ScanConfig.
+	var scanEventDescs apitypes.ScanEventDescs = make(apitypes.ScanEventDescs, 0)
+	for _, scanConfigId := range scanConfigIds {
+		// Check if user is authorized to use the DockerImage and the ScanConfig.
+		failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.ReadMask, dockerImageId,
+			"scanImage")
+		if failMsg != nil { return failMsg }
+		failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.ExecuteMask, scanConfigId,
+			"scanImage")
+		if failMsg != nil { return failMsg }
+		
+		// Retrieve the ScanConfig.
+		var scanConfig ScanConfig
+		scanConfig, err = dbClient.getScanConfig(scanConfigId)
 		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		err = scanConfig.setFlagId(dbClient, flag.getId())
+		if scanConfig == nil {
+			return apitypes.NewFailureDesc(http.StatusBadRequest,
+				"Scan Config with object Id " + scanConfigId + " not found")
+		}
+		
+		// Perform the scan, and record it as an event of the user.
+		var userId string = sessionToken.AuthenticatedUserid
+		var user User
+		user, err = dbClient.dbGetUserByUserId(userId)
 		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		// Add ACL entry.
-		_, err = dbClient.dbCreateACLEntry(flag.getId(), user.getId(),
-			[]bool{ true, true, true, true, true } )
+		if user == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+			"User with Id " + userId + " not found") }
+		var scanEvent ScanEvent
+		scanEvent, err = scanDockerImageVersion(dbClient, dockerImage, dockerImageVersion,
+			scanConfig, user)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		scansPerformed++
+		
+		scanEventDescs = append(scanEventDescs, scanEvent.asScanEventDesc(dbClient))
+	}
+	
+	return scanEventDescs
+}
+
+/*******************************************************************************
+ * Arguments: ImageObjId
+ * Returns: ScanEventDesc (has empty fields, if there are no events)
+ */
+func getDockerImageStatus(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var imageObjId string
+	var err error
+	imageObjId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ImageObjId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	// Determine if ImageObjId is a DockerImage or a DockerImageVersion.
+	
+	var dockerImageId string = ""
+	var dockerImage DockerImage
+	var dockerImageVersionId string = ""
+	var dockerImageVersion DockerImageVersion = nil
+	dockerImage, err = dbClient.getDockerImage(imageObjId)
+	if err == nil {
+		dockerImageId = imageObjId
+		// Get the most recent version.
+		dockerImageVersionId = dockerImage.getMostRecentVersionId()
+		dockerImageVersion, err = dbClient.getDockerImageVersion(dockerImageVersionId)
+		if err != nil { return apitypes.NewFailureDesc(http.StatusInternalServerError,
+			"Could not identify DockerImageVersion with object Id " + dockerImageVersionId)
+		}
+	} else {
+		dockerImageVersion, err = dbClient.getDockerImageVersion(imageObjId)
+		if err != nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+			"The ImageObjId is not a DockerImage or a DockerImageVersion")
+		}
+		// User specified a DockerImageVersion.
+		dockerImageVersionId = imageObjId
+		// Identify the DockerImage, in order to check the user's authorization.
+		dockerImage, err = dbClient.getDockerImage(dockerImageVersion.getImageObjId())
+		if err != nil { return apitypes.NewFailureDesc(http.StatusInternalServerError,
+			"Could not identify Docker Image for the DockerImageVersion")
+		}
+	}
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.ReadMask, dockerImageId,
+		"getDockerImageStatus")
+	if failMsg != nil { return failMsg }
+	
+	// Get the most recent ScanEvent, if any.
+	var eventId string = dockerImageVersion.getMostRecentScanEventId()
+	if eventId == "" {
+		return apitypes.NewScanEventDesc("", time.Now(), "", dockerImageVersionId,
+			"", "", nil, "", nil) // an empty ScanEventDesc
+	} else {
+		var event ScanEvent
+		event, err = dbClient.getScanEvent(eventId)
 		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		return event.asScanEventDesc(dbClient)
 	}
+}
+
+/*******************************************************************************
+ * Arguments: ScanConfigId
+ * Returns: ScanConfigDesc
+ */
+func getScanConfigDesc(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var scanConfigId string
+	var err error
+	scanConfigId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ScanConfigId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	var scanConfig ScanConfig
+	scanConfig, err = dbClient.getScanConfig(scanConfigId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.ReadMask, scanConfigId,
+		"getScanConfigDesc")
+	if failMsg != nil { return failMsg }
 	
 	return scanConfig.asScanConfigDesc(dbClient)
 }
 
 /*******************************************************************************
  * Arguments: FlagId
- * Returns: image file
+ * Returns: FlagDesc
  */
-func getFlagImage(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func getFlagDesc(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
-	
+
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
@@ -2420,365 +4062,685 @@ func getFlagImage(dbClient *InMemClient, sessionToken *apitypes.SessionToken, va
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
 	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.ReadMask, flagId,
-		"getFlagImage")
+		"getFlagDesc")
 	if failMsg != nil { return failMsg }
+	
+	return flag.asFlagDesc()
+}
 
-	var path string = flag.getSuccessImagePath()
+/*******************************************************************************
+ * Arguments: UserId
+ * Returns: EventDescBase...
+ */
+func getUserEvents(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
 	
-	return apitypes.NewFileResponse(200, path, false)
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+
+	var userId string = sessionToken.AuthenticatedUserid
+	var user User
+	var err error
+	user, err = dbClient.dbGetUserByUserId(userId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if user == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Unidentified user, " + userId) }
+	var eventIds []string = user.getEventIds()
+	
+	var eventDescs apitypes.EventDescs = make([]apitypes.EventDesc, 0)
+	for _, eventId := range eventIds {
+		var event Event
+		var err error
+		event, err = dbClient.getEvent(eventId)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		eventDescs = append(eventDescs, event.asEventDesc(dbClient))
+	}
+	
+	return eventDescs
 }
 
 /*******************************************************************************
- * Arguments: RepoId, Name, Description, image file
- * Returns: FlagDesc
+ * Arguments: ResourceId, EventTypes (optional)
+ * Returns: NotificationSubscriptionDesc
+ * Subscribe the current user to notifications of events that concern a realm,
+ * repo, or image (see Notifications.go). EventTypes is a comma separated list of
+ * the types of event of which to notify; all types if omitted. If the user
+ * already subscribes to the resource, the subscription's event types are
+ * replaced.
  */
-func defineFlag(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func subscribeToNotifications(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
 	
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
 	
-	var repoId string
+	var resourceId, eventTypeSeq string
 	var err error
-	repoId, err = apitypes.GetHTTPParameterValue(true, values, "RepoId")
+	resourceId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ResourceId")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	// If not specified, use default repo (and create if not exist).
-	var repo Repo
-	if repoId == "" {
-		repo, err = getDefaultRepoForUser(dbClient, sessionToken.AuthenticatedUserid)
-		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		repoId = repo.getId()
-	} else {
-		repo, err = dbClient.getRepo(repoId)
+	eventTypeSeq, err = apitypes.GetHTTPParameterValue(false, values, "EventTypes")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var eventTypes []string
+	eventTypes, err = parseNotificationEventTypes(eventTypeSeq)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.ReadMask, resourceId,
+		"subscribeToNotifications")
+	if failMsg != nil { return failMsg }
+	
+	var resource Resource
+	resource, err = dbClient.getResource(resourceId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if resource == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Unable to identify resource with Id " + resourceId) }
+	if ! (resource.isRealm() || resource.isRepo() || resource.isDockerImage()) {
+		return apitypes.NewFailureDesc(http.StatusBadRequest,
+			"Notifications may only be subscribed to for a realm, a repo, or an image")
+	}
+	var lineage []Resource
+	lineage, err = getResourceLineage(dbClient, resource)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var realmId = lineage[len(lineage)-1].getId()
+	
+	var user User
+	user, err = getCurrentUser(dbClient, sessionToken)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	for _, subscriptionId := range user.getNotificationSubscriptionIds() {
+		var subscription NotificationSubscription
+		subscription, err = dbClient.getNotificationSubscription(subscriptionId)
+		if err != nil { continue }  // dangling Id
+		if subscription.getResourceId() != resourceId { continue }
+		err = subscription.setEventTypes(dbClient, eventTypes)
 		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		if repo == nil { return apitypes.NewFailureDesc(http.StatusBadRequest, "Repo does not exist") }
+		return subscription.asNotificationSubscriptionDesc()
 	}
 	
-	var name string
-	name, err = apitypes.GetRequiredHTTPParameterValue(true, values, "Name")
+	var subscription NotificationSubscription
+	subscription, err = dbClient.dbCreateNotificationSubscription(user.getId(), realmId,
+		resourceId, eventTypes)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return subscription.asNotificationSubscriptionDesc()
+}
+
+/*******************************************************************************
+ * Arguments: SubscriptionId
+ * Returns: Result
+ */
+func unsubscribeFromNotifications(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
 	
-	var desc string
-	desc, err = apitypes.GetRequiredHTTPParameterValue(true, values, "Description")
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var subscriptionId string
+	var err error
+	subscriptionId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "SubscriptionId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var subscription NotificationSubscription
+	subscription, err = dbClient.getNotificationSubscription(subscriptionId)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
-	var successImagePath string
-	_, successImagePath, err = captureFile(repo, files)
+	var user User
+	user, err = getCurrentUser(dbClient, sessionToken)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	if successImagePath == "" { return apitypes.NewFailureDesc(
-		http.StatusBadRequest, "No file attached") }
+	if subscription.getUserObjId() != user.getId() { return apitypes.NewFailureDesc(
+		http.StatusForbidden, "Only the subscriber may cancel a subscription") }
 	
-	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.CreateInMask, repoId,
-		"defineFlag")
+	err = dbClient.dbDeleteNotificationSubscription(subscription)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return apitypes.NewResult(200, "Subscription cancelled")
+}
+
+/*******************************************************************************
+ * Arguments: (none)
+ * Returns: NotificationSubscriptionDesc...
+ */
+func getMyNotificationSubscriptions(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
+	
+	var user User
+	var err error
+	user, err = getCurrentUser(dbClient, sessionToken)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var descs apitypes.NotificationSubscriptionDescs = make([]*apitypes.NotificationSubscriptionDesc, 0)
+	for _, subscriptionId := range user.getNotificationSubscriptionIds() {
+		var subscription NotificationSubscription
+		subscription, err = dbClient.getNotificationSubscription(subscriptionId)
+		if err != nil { continue }  // dangling Id
+		descs = append(descs, subscription.asNotificationSubscriptionDesc())
+	}
+	return descs
+}
 
-	var flag Flag
-	flag, err = dbClient.dbCreateFlag(name, desc, repoId, successImagePath)
+/*******************************************************************************
+ * Arguments: UnreadOnly ("true" or "false", the default)
+ * Returns: NotificationDesc...
+ * Return the current user's in-app notifications, most recent first.
+ */
+func getMyNotifications(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var unreadOnlyStr string
+	var err error
+	unreadOnlyStr, err = apitypes.GetHTTPParameterValue(true, values, "UnreadOnly")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var unreadOnly = (unreadOnlyStr == "true")
 	
-	return flag.asFlagDesc()
+	var user User
+	user, err = getCurrentUser(dbClient, sessionToken)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var notificationIds = user.getNotificationIds()
+	var descs apitypes.NotificationDescs = make([]*apitypes.NotificationDesc, 0)
+	for i := len(notificationIds)-1; i >= 0; i-- {
+		var notification Notification
+		notification, err = dbClient.getNotification(notificationIds[i])
+		if err != nil { continue }  // dangling Id
+		if unreadOnly && notification.isRead() { continue }
+		descs = append(descs, notification.asNotificationDesc())
+	}
+	return descs
 }
 
 /*******************************************************************************
- * Arguments: ScanConfigId..., ImageObjId
- * Returns: ScanEventDescs
+ * Arguments: NotificationId (optional)
+ * Returns: Result
+ * Mark one of the current user's in-app notifications as read, or, if no
+ * NotificationId is given, all of them.
  */
-func scanImage(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func markNotificationsRead(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
-
+	
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
-
-	var scanConfigIdSeq, imageObjId string
+	
+	var notificationId string
 	var err error
-	scanConfigIdSeq, err = apitypes.GetHTTPParameterValue(false, values, "ScanConfigId")
-	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	imageObjId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ImageObjId")
+	notificationId, err = apitypes.GetHTTPParameterValue(true, values, "NotificationId")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
-	// Determine if imageObjId is a DockerImage or a DockerImageVersion.
-	var dockerImage DockerImage
-	var dockerImageId string
-	var dockerImageVersion DockerImageVersion
-	var dockerImageVersionId string
-	dockerImage, err = dbClient.getDockerImage(imageObjId)
-	if err == nil {
-		// User specified a DockerImage - not an image version.
-		dockerImageId = imageObjId
-		// Get most recent image version.
-		dockerImageVersionId = dockerImage.getMostRecentVersionId()
-		if dockerImageVersionId == "" { return apitypes.NewFailureDesc(http.StatusInternalServerError,
-			"Null most recent DockerImageVersion for image " + dockerImage.getName())
-		}
-		dockerImageVersion, err = dbClient.getDockerImageVersion(dockerImageVersionId)
-		if err != nil { return apitypes.NewFailureDesc(http.StatusInternalServerError,
-			"Docker image version with object Id " + dockerImageVersionId + " not found")
-		}
-	} else {
-		dockerImageVersion, err = dbClient.getDockerImageVersion(imageObjId)
-		if err != nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
-			"Docker image version with object Id " + imageObjId + " not found")
-		}
-		// User specified a particular image version.
-		dockerImageVersionId = imageObjId
-		dockerImageId = dockerImageVersion.getImageObjId()
-		dockerImage, err = dbClient.getDockerImage(dockerImageId)
-		if err != nil { return apitypes.NewFailureDesc(http.StatusInternalServerError,
-			"Docker image with object Id " + dockerImageId + " not found")
-		}
+	var user User
+	user, err = getCurrentUser(dbClient, sessionToken)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var notificationIds = user.getNotificationIds()
+	if notificationId != "" {
+		var notification Notification
+		notification, err = dbClient.getNotification(notificationId)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		if notification.getUserObjId() != user.getId() { return apitypes.NewFailureDesc(
+			http.StatusForbidden, "The notification is for another user") }
+		notificationIds = []string{ notificationId }
 	}
-	
-	// Determine the ScanConfigs to use.
-	var scanConfigIds []string
-	if scanConfigIdSeq == "" {
-		// Obtain the linked scan configs.
-		scanConfigIds = dockerImage.getScanConfigsToUse()
-	} else {
-		// Parse the list of scan config ids.
-		scanConfigIds = strings.Split(scanConfigIdSeq, ",")
-		for _, scanConfigId := range scanConfigIds {
-			_, err = apitypes.Sanitize(scanConfigId)
-			if err != nil { return apitypes.NewFailureDescFromError(err) }
-		}
+	for _, id := range notificationIds {
+		var notification Notification
+		notification, err = dbClient.getNotification(id)
+		if err != nil { continue }  // dangling Id
+		if notification.isRead() { continue }
+		err = notification.markRead(dbClient)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
 	}
+	return apitypes.NewResult(200, "Notifications marked as read")
+}
+
+/*******************************************************************************
+ * Arguments: (none)
+ * Returns: NotificationPreferencesDesc
+ */
+func getNotificationPreferences(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
 	
-	// Perform scan with each ScanConfig.
-	var scanEventDescs apitypes.ScanEventDescs = make(apitypes.ScanEventDescs, 0)
-	for _, scanConfigId := range scanConfigIds {
-		// Check if user is authorized to use the DockerImage and the ScanConfig.
-		failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.ReadMask, dockerImageId,
-			"scanImage")
-		if failMsg != nil { return failMsg }
-		failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.ExecuteMask, scanConfigId,
-			"scanImage")
-		if failMsg != nil { return failMsg }
-		
-		// Retrieve the ScanConfig.
-		var scanConfig ScanConfig
-		scanConfig, err = dbClient.getScanConfig(scanConfigId)
-		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		if scanConfig == nil {
-			return apitypes.NewFailureDesc(http.StatusBadRequest,
-				"Scan Config with object Id " + scanConfigId + " not found")
-		}
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
 	
-		// Obtain scan provider name and parameters from the ScanConfig.
-		var scanProviderName = scanConfig.getProviderName()
-		var params = map[string]string{}
-		var paramValueIds []string = scanConfig.getParameterValueIds()
-		for _, id := range paramValueIds {
-			var paramValue ParameterValue
-			paramValue, err = dbClient.getParameterValue(id)
-			if err != nil { return apitypes.NewFailureDescFromError(err) }
-			params[paramValue.getName()] = paramValue.getStringValue()
-		}
+	var user User
+	var err error
+	user, err = getCurrentUser(dbClient, sessionToken)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return newNotificationPreferencesDesc(user)
+}
+
+/*******************************************************************************
+ * Arguments: EmailNotifications, InAppNotifications, QuietHoursStart,
+ *	QuietHoursEnd, TimeZone (each optional)
+ * Returns: NotificationPreferencesDesc
+ * Change how the current user receives notifications. EmailNotifications is
+ * "immediate", "digest", or "never"; InAppNotifications is "true" or "false".
+ * Quiet hours, HH:MM, must be given together; "-" for both removes them, as "-"
+ * for TimeZone (e.g., "America/New_York") restores UTC.
+ */
+func setNotificationPreferences(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
 	
-		// Locate the scan provider.
-		fmt.Println("Getting scan service...")
-		var scanService scanners.ScanService
-		scanService = dbClient.Server.GetScanService(scanProviderName)
-		if scanService == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
-			"Unable to identify a scan service named '" + scanProviderName + "'")
-		}
-		
-		// Attach to the scan provider.
-		var scanContext scanners.ScanContext
-		scanContext, err = scanService.CreateScanContext(params)
-		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		var imageName string
-		imageName, err = dockerImageVersion.getFullName(dbClient)
-		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		var result *scanners.ScanResult
-		fmt.Println("Contacting scan service...")
-		
-		// Perform scan.
-		result, err = scanContext.ScanImage(imageName)
-		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		fmt.Println("Scanner service completed")
-		
-		// Compute score.
-		// TBD: Here we should use the scanConfig.SuccessExpression to compute the score.
-		var score string
-		score = fmt.Sprintf("%d", len(result.Vulnerabilities))
-	
-		// Construct arrays of param names and values, needed by dbCreateScanEvent.
-		var paramNames = make([]string, len(params))
-		var paramValues = make([]string, len(paramNames))
-		var i = 0
-		for name, value := range params {
-			paramNames[i] = name
-			paramValues[i] = value
-			i++
-		}
-		
-		// Create a scan event.
-		var userId string = sessionToken.AuthenticatedUserid
-		var user User
-		user, err = dbClient.dbGetUserByUserId(userId)
-		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		if user == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
-			"User with Id " + userId + " not found") }
-		var scanEvent ScanEvent
-		scanEvent, err = dbClient.dbCreateScanEvent(scanConfig.getId(), scanConfig.getProviderName(),
-			paramNames, paramValues, dockerImageVersionId, user.getId(), score, result)
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var user User
+	var err error
+	user, err = getCurrentUser(dbClient, sessionToken)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var prefs = user.getNotificationPreferences()
+	
+	var email, inApp, quietStart, quietEnd, timeZone string
+	email, err = apitypes.GetHTTPParameterValue(true, values, "EmailNotifications")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	inApp, err = apitypes.GetHTTPParameterValue(true, values, "InAppNotifications")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	quietStart, err = apitypes.GetHTTPParameterValue(true, values, "QuietHoursStart")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	quietEnd, err = apitypes.GetHTTPParameterValue(true, values, "QuietHoursEnd")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	timeZone, err = apitypes.GetHTTPParameterValue(false, values, "TimeZone")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	switch email {
+		case "": break
+		case EmailNotificationsImmediately, EmailNotificationsDigest, EmailNotificationsNever:
+			prefs.Email = email
+		default: return apitypes.NewFailureDesc(http.StatusBadRequest,
+			"Unrecognized value for EmailNotifications: " + email)
+	}
+	switch inApp {
+		case "": break
+		case "true": prefs.InApp = true
+		case "false": prefs.InApp = false
+		default: return apitypes.NewFailureDesc(http.StatusBadRequest,
+			"Unrecognized value for InAppNotifications: " + inApp)
+	}
+	if (quietStart == "") != (quietEnd == "") { return apitypes.NewFailureDesc(
+		http.StatusBadRequest, "QuietHoursStart and QuietHoursEnd must be specified together") }
+	if quietStart == "-" {
+		prefs.QuietHoursStart = 0
+		prefs.QuietHoursEnd = 0
+	} else if quietStart != "" {
+		prefs.QuietHoursStart, err = parseTimeOfDay(quietStart)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		prefs.QuietHoursEnd, err = parseTimeOfDay(quietEnd)
 		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		
-		scanEventDescs = append(scanEventDescs, scanEvent.asScanEventDesc(dbClient))
+	}
+	if timeZone == "-" {
+		prefs.TimeZone = ""
+	} else if timeZone != "" {
+		_, err = time.LoadLocation(timeZone)
+		if (err != nil) || (strings.ToLower(timeZone) == "local") { return apitypes.NewFailureDesc(
+			http.StatusBadRequest, "Unrecognized time zone: " + timeZone) }
+		prefs.TimeZone = timeZone
 	}
 	
-	return scanEventDescs
+	err = user.setNotificationPreferences(dbClient, prefs)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return newNotificationPreferencesDesc(user)
 }
 
 /*******************************************************************************
- * Arguments: ImageObjId
- * Returns: ScanEventDesc (has empty fields, if there are no events)
+ * Arguments: ResourceId, URL, EventTypes (optional), Secret (optional)
+ * Returns: apitypes.WebhookDesc
+ * Register a webhook for a realm or a repo (see Webhooks.go). EventTypes is a
+ * comma separated list; if it is omitted, the hook receives every type of event.
+ * If no Secret is given, one is generated. The secret is returned only in the
+ * response to this request.
  */
-func getDockerImageStatus(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func createWebhook(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
 	
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
-
-	var imageObjId string
+	
+	var resourceId, hookURL, eventTypeSeq, secret string
 	var err error
-	imageObjId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ImageObjId")
+	resourceId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ResourceId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	hookURL, err = apitypes.GetRequiredHTTPParameterValue(false, values, "URL")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	err = validateWebhookURL(hookURL)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	eventTypeSeq, err = apitypes.GetHTTPParameterValue(false, values, "EventTypes")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var eventTypes []string
+	eventTypes, err = parseWebhookEventTypes(eventTypeSeq)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	secret, err = apitypes.GetHTTPParameterValue(false, values, "Secret")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if secret == "" {
+		secret, err = createWebhookSecret()
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+	}
 	
-	// Determine if ImageObjId is a DockerImage or a DockerImageVersion.
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, resourceId,
+		"createWebhook")
+	if failMsg != nil { return failMsg }
 	
-	var dockerImageId string = ""
-	var dockerImage DockerImage
-	var dockerImageVersionId string = ""
-	var dockerImageVersion DockerImageVersion = nil
-	dockerImage, err = dbClient.getDockerImage(imageObjId)
-	if err == nil {
-		dockerImageId = imageObjId
-		// Get the most recent version.
-		dockerImageVersionId = dockerImage.getMostRecentVersionId()
-		dockerImageVersion, err = dbClient.getDockerImageVersion(dockerImageVersionId)
-		if err != nil { return apitypes.NewFailureDesc(http.StatusInternalServerError,
-			"Could not identify DockerImageVersion with object Id " + dockerImageVersionId)
-		}
-	} else {
-		dockerImageVersion, err = dbClient.getDockerImageVersion(imageObjId)
-		if err != nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
-			"The ImageObjId is not a DockerImage or a DockerImageVersion")
-		}
-		// User specified a DockerImageVersion.
-		dockerImageVersionId = imageObjId
-		// Identify the DockerImage, in order to check the user's authorization.
-		dockerImage, err = dbClient.getDockerImage(dockerImageVersion.getImageObjId())
-		if err != nil { return apitypes.NewFailureDesc(http.StatusInternalServerError,
-			"Could not identify Docker Image for the DockerImageVersion")
-		}
+	var resource Resource
+	resource, err = dbClient.getResource(resourceId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if resource == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Unable to identify resource with Id " + resourceId) }
+	if ! (resource.isRealm() || resource.isRepo()) {
+		return apitypes.NewFailureDesc(http.StatusBadRequest,
+			"Webhooks may only be registered for a realm or a repo")
 	}
+	var lineage []Resource
+	lineage, err = getResourceLineage(dbClient, resource)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var realmId = lineage[len(lineage)-1].getId()
 	
-	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.ReadMask, dockerImageId,
-		"getDockerImageStatus")
+	var user User
+	user, err = getCurrentUser(dbClient, sessionToken)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var webhook Webhook
+	webhook, err = dbClient.dbCreateWebhook(realmId, resourceId, hookURL, secret, eventTypes,
+		user.getId())
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return webhook.asWebhookDesc(true)
+}
+
+/*******************************************************************************
+ * Arguments: ResourceId
+ * Returns: apitypes.WebhookDescs
+ * Return the webhooks registered for a repo, or, for a realm, those registered
+ * for the realm or any of its repos.
+ */
+func getWebhooks(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
 	
-	// Get the most recent ScanEvent, if any.
-	var eventId string = dockerImageVersion.getMostRecentScanEventId()
-	if eventId == "" {
-		return apitypes.NewScanEventDesc("", time.Now(), "", dockerImageVersionId,
-			"", "", nil, "", nil) // an empty ScanEventDesc
-	} else {
-		var event ScanEvent
-		event, err = dbClient.getScanEvent(eventId)
-		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		return event.asScanEventDesc(dbClient)
+	var resourceId string
+	var err error
+	resourceId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ResourceId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, resourceId,
+		"getWebhooks")
+	if failMsg != nil { return failMsg }
+	
+	var resource Resource
+	resource, err = dbClient.getResource(resourceId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if resource == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Unable to identify resource with Id " + resourceId) }
+	var lineage []Resource
+	lineage, err = getResourceLineage(dbClient, resource)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var realm, isRealm = lineage[len(lineage)-1].(Realm)
+	if ! isRealm { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Resource " + resourceId + " does not belong to a realm") }
+	
+	var descs apitypes.WebhookDescs = make([]*apitypes.WebhookDesc, 0)
+	for _, webhookId := range realm.getWebhookIds() {
+		var webhook Webhook
+		webhook, err = dbClient.getWebhook(webhookId)
+		if err != nil { continue }  // dangling Id
+		if (! resource.isRealm()) && (webhook.getResourceId() != resourceId) { continue }
+		descs = append(descs, webhook.asWebhookDesc(false))
 	}
+	return descs
 }
 
 /*******************************************************************************
- * Arguments: ScanConfigId
- * Returns: ScanConfigDesc
+ * Arguments: WebhookId
+ * Returns: apitypes.Result
+ * Remove a webhook, and its deliveries, including those not yet made.
  */
-func getScanConfigDesc(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func deleteWebhook(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
-
+	
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
-
-	var scanConfigId string
+	
+	var webhookId string
 	var err error
-	scanConfigId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ScanConfigId")
+	webhookId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "WebhookId")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	
-	var scanConfig ScanConfig
-	scanConfig, err = dbClient.getScanConfig(scanConfigId)
+	var webhook Webhook
+	webhook, err = dbClient.getWebhook(webhookId)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
-	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.ReadMask, scanConfigId,
-		"getScanConfigDesc")
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+		webhook.getResourceId(), "deleteWebhook")
 	if failMsg != nil { return failMsg }
 	
-	return scanConfig.asScanConfigDesc(dbClient)
+	err = dbClient.dbDeleteWebhook(webhook)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return apitypes.NewResult(200, "Webhook deleted")
 }
 
 /*******************************************************************************
- * Arguments: FlagId
- * Returns: FlagDesc
+ * Arguments: WebhookId
+ * Returns: apitypes.WebhookDeliveryDescs
+ * Return the webhook's delivery log, newest first.
  */
-func getFlagDesc(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func getWebhookDeliveries(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
-
+	
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
-
-	var flagId string
+	
+	var webhookId string
 	var err error
-	flagId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "FlagId")
+	webhookId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "WebhookId")
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	
-	var flag Flag
-	flag, err = dbClient.getFlag(flagId)
+	var webhook Webhook
+	webhook, err = dbClient.getWebhook(webhookId)
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
 	
-	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.ReadMask, flagId,
-		"getFlagDesc")
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+		webhook.getResourceId(), "getWebhookDeliveries")
 	if failMsg != nil { return failMsg }
 	
-	return flag.asFlagDesc()
+	var deliveryIds = webhook.getDeliveryIds()
+	var descs apitypes.WebhookDeliveryDescs = make([]*apitypes.WebhookDeliveryDesc, 0)
+	for i := len(deliveryIds)-1; i >= 0; i-- {
+		var delivery WebhookDelivery
+		delivery, err = dbClient.getWebhookDelivery(deliveryIds[i])
+		if err != nil { continue }  // dangling Id
+		descs = append(descs, delivery.asWebhookDeliveryDesc())
+	}
+	return descs
 }
 
 /*******************************************************************************
- * Arguments: UserId
- * Returns: EventDescBase...
+ * Arguments: DeliveryId
+ * Returns: apitypes.WebhookDeliveryDesc
+ * Post a delivery again, as soon as possible, with a fresh set of attempts -
+ * typically one that failed, or that the receiver mishandled.
  */
-func getUserEvents(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+func redeliverWebhookDelivery(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
 	
 	var failMsg apitypes.RespIntfTp
 	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
 	if failMsg != nil { return failMsg }
-
-	var userId string = sessionToken.AuthenticatedUserid
-	var user User
+	
+	var deliveryId string
 	var err error
-	user, err = dbClient.dbGetUserByUserId(userId)
+	deliveryId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "DeliveryId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var delivery WebhookDelivery
+	delivery, err = dbClient.getWebhookDelivery(deliveryId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var webhook Webhook
+	webhook, err = dbClient.getWebhook(delivery.getWebhookId())
 	if err != nil { return apitypes.NewFailureDescFromError(err) }
-	if user == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
-		"Unidentified user, " + userId) }
-	var eventIds []string = user.getEventIds()
 	
-	var eventDescs apitypes.EventDescs = make([]apitypes.EventDesc, 0)
-	for _, eventId := range eventIds {
-		var event Event
-		var err error
-		event, err = dbClient.getEvent(eventId)
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+		webhook.getResourceId(), "redeliverWebhookDelivery")
+	if failMsg != nil { return failMsg }
+	
+	if delivery.getStatus() == WebhookDeliverySending { return apitypes.NewFailureDesc(
+		http.StatusConflict, "The delivery is being posted") }
+	var isPending = (delivery.getStatus() == WebhookDeliveryPending)
+	err = delivery.redeliver(dbClient)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if ! isPending {
+		var realm Realm
+		realm, err = dbClient.getRealm(delivery.getRealmId())
 		if err != nil { return apitypes.NewFailureDescFromError(err) }
-		eventDescs = append(eventDescs, event.asEventDesc(dbClient))
+		err = realm.addPendingWebhookDelivery(dbClient, delivery)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+	}
+	return delivery.asWebhookDeliveryDesc()
+}
+
+/*******************************************************************************
+ * Arguments: ResourceId, Schedule, TimeZone (optional), AllVersions (optional)
+ * Returns: apitypes.ScanScheduleDesc
+ * Schedule periodic rescans of a DockerImage, or of each image in a repo, with
+ * each image's scan configs (see ScanSchedules.go). Schedule is a cron
+ * expression, such as "0 3 * * 1" (03:00 each Monday), evaluated in TimeZone,
+ * an IANA time zone name such as "America/New_York"; the default is UTC.
+ * AllVersions is "true" to rescan each retained version of each image, or
+ * "false" (the default) to rescan only the most recent version. The scans are
+ * performed on behalf of the current user.
+ */
+func createScanSchedule(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var resourceId, schedule, timeZone, allVersionsStr string
+	var err error
+	resourceId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ResourceId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	schedule, err = apitypes.GetRequiredHTTPParameterValue(false, values, "Schedule")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	timeZone, err = apitypes.GetHTTPParameterValue(false, values, "TimeZone")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	allVersionsStr, err = apitypes.GetHTTPParameterValue(true, values, "AllVersions")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var allVersions bool
+	switch allVersionsStr {
+		case "", "false": allVersions = false
+		case "true": allVersions = true
+		default: return apitypes.NewFailureDesc(http.StatusBadRequest,
+			"Unrecognized value for AllVersions: " + allVersionsStr)
 	}
+	var nextRunTime time.Time
+	nextRunTime, err = getNextScanTime(schedule, timeZone, time.Now())
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if nextRunTime.IsZero() { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"The schedule " + schedule + " never runs") }
 	
-	return eventDescs
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask, resourceId,
+		"createScanSchedule")
+	if failMsg != nil { return failMsg }
+	
+	var resource Resource
+	resource, err = dbClient.getResource(resourceId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if resource == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Unable to identify resource with Id " + resourceId) }
+	if ! (resource.isDockerImage() || resource.isRepo()) {
+		return apitypes.NewFailureDesc(http.StatusBadRequest,
+			"Scans may only be scheduled for a Docker image or a repo")
+	}
+	var lineage []Resource
+	lineage, err = getResourceLineage(dbClient, resource)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var realmId = lineage[len(lineage)-1].getId()
+	
+	var user User
+	user, err = getCurrentUser(dbClient, sessionToken)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var scanSchedule ScanSchedule
+	scanSchedule, err = dbClient.dbCreateScanSchedule(realmId, resourceId, schedule, timeZone,
+		allVersions, user.getId(), nextRunTime)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return scanSchedule.asScanScheduleDesc()
+}
+
+/*******************************************************************************
+ * Arguments: ResourceId
+ * Returns: apitypes.ScanScheduleDescs
+ * Return the scan schedules of a DockerImage or a repo, or, for a realm, those of
+ * each of its images and repos.
+ */
+func getScanSchedules(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var resourceId string
+	var err error
+	resourceId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ResourceId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.ReadMask, resourceId,
+		"getScanSchedules")
+	if failMsg != nil { return failMsg }
+	
+	var resource Resource
+	resource, err = dbClient.getResource(resourceId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if resource == nil { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Unable to identify resource with Id " + resourceId) }
+	var lineage []Resource
+	lineage, err = getResourceLineage(dbClient, resource)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var realm, isRealm = lineage[len(lineage)-1].(Realm)
+	if ! isRealm { return apitypes.NewFailureDesc(http.StatusBadRequest,
+		"Resource " + resourceId + " does not belong to a realm") }
+	
+	var descs apitypes.ScanScheduleDescs = make([]*apitypes.ScanScheduleDesc, 0)
+	for _, scheduleId := range realm.getScanScheduleIds() {
+		var scanSchedule ScanSchedule
+		scanSchedule, err = dbClient.getScanSchedule(scheduleId)
+		if err != nil { continue }  // dangling Id
+		if (! resource.isRealm()) && (scanSchedule.getResourceId() != resourceId) { continue }
+		descs = append(descs, scanSchedule.asScanScheduleDesc())
+	}
+	return descs
 }
 
+/*******************************************************************************
+ * Arguments: ScheduleId
+ * Returns: apitypes.Result
+ * Remove a scan schedule. Scans of a run that has started are completed.
+ */
+func deleteScanSchedule(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+	
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	var scheduleId string
+	var err error
+	scheduleId, err = apitypes.GetRequiredHTTPParameterValue(true, values, "ScheduleId")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var scanSchedule ScanSchedule
+	scanSchedule, err = dbClient.getScanSchedule(scheduleId)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	
+	failMsg = authorizeHandlerAction(dbClient, sessionToken, apitypes.WriteMask,
+		scanSchedule.getResourceId(), "deleteScanSchedule")
+	if failMsg != nil { return failMsg }
+	
+	err = dbClient.dbDeleteScanSchedule(scanSchedule)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return apitypes.NewResult(200, "Scan schedule deleted")
+}
 /*******************************************************************************
  * Arguments: ImageObjId
  * Returns: Array of derived types of EventDescBase.
@@ -3285,8 +5247,10 @@ func getDockerImageVersions(dbClient *InMemClient, sessionToken *apitypes.Sessio
 }
 
 /*******************************************************************************
- * Arguments: UserInfo
+ * Arguments: UserInfo, Locale (optional)
  * Returns: UserDesc
+ * Locale selects the language of the email that SafeHarbor sends to the user
+ * (see EmailTemplates.go); "-" clears it.
  */
 func updateUserInfo(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
 	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
@@ -3325,9 +5289,23 @@ func updateUserInfo(dbClient *InMemClient, sessionToken *apitypes.SessionToken,
 		changesMade = true
 	}
 	
+	var locale string
+	locale, err = apitypes.GetHTTPParameterValue(true, values, "Locale")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if locale == "-" {
+		err = specifiedUser.setLocale(dbClient, "")
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+	} else if locale != "" {
+		locale, err = normalizeLocale(locale)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		err = specifiedUser.setLocale(dbClient, locale)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+	}
+	
+	// Set after the locale, so that verification email is in the new locale.
 	if newUserInfo.EmailAddress != "" {
 		err = EstablishEmail(dbClient.getServer().authService, dbClient,
-			dbClient.getServer().EmailService, specifiedUser.getId(), newUserInfo.EmailAddress)
+			specifiedUser.getUserId(), newUserInfo.EmailAddress)
 		if err != nil { return apitypes.NewFailureDescFromError(err) }
 		changesMade = true
 	}
@@ -3486,3 +5464,38 @@ func stopUsingScanConfigForImage(dbClient *InMemClient, sessionToken *apitypes.S
 
 	return apitypes.NewResult(200, "Scan Config removed from image")
 }
+
+/*******************************************************************************
+ * Arguments: (none)
+ * Returns: apitypes.ObjectCacheStatsDesc
+ * The statistics are of the whole server, so only a realm administrator - a
+ * user who may write some realm - may obtain them.
+ */
+func getObjectCacheStats(dbClient *InMemClient, sessionToken *apitypes.SessionToken, values url.Values,
+	files map[string][]*multipart.FileHeader) apitypes.RespIntfTp {
+
+	var failMsg apitypes.RespIntfTp
+	sessionToken, failMsg = authenticateSession(dbClient, sessionToken, values)
+	if failMsg != nil { return failMsg }
+	
+	if dbClient.getServer().Authorize {
+		var user User
+		var err error
+		user, err = getCurrentUser(dbClient, sessionToken)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		var adminRealmIds []string
+		adminRealmIds, err = dbClient.getRealmsAdministeredByUser(user.getId())
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		if len(adminRealmIds) == 0 { return apitypes.NewFailureDesc(http.StatusForbidden,
+			"Only a realm administrator may obtain the object cache statistics") }
+	}
+	
+	var cache *ObjectCache = dbClient.Persistence.objectCache
+	if cache == nil {
+		return apitypes.NewObjectCacheStatsDesc(false, 0, 0, 0, 0, 0)
+	}
+	var hits, misses, evictions, invalidations int64
+	var size int
+	hits, misses, evictions, invalidations, size = cache.getStats()
+	return apitypes.NewObjectCacheStatsDesc(true, hits, misses, evictions, invalidations, size)
+}
@@ -23,7 +23,9 @@ import (
 	"io/ioutil"
 	"time"
 	"strings"
+	"strconv"
 	"runtime/debug"	
+	"crypto/subtle"
 	//"encoding/hex"
 	
 	//"goredis"
@@ -38,6 +40,8 @@ import (
 
 const (
 	TransactionTimeoutSeconds int = 2
+	GroupNestingLockKeyPrefix = "SafeHarbor/GroupNesting/"  // followed by the realm Id
+	GroupNestingLockSeconds = 60
 )
 
 /*******************************************************************************
@@ -59,6 +63,27 @@ func (dataErr *PersistDataError) asFailureDesc() *apitypes.FailureDesc {
 	return apitypes.NewFailureDesc(http.StatusInternalServerError, dataErr.Error())
 }
 
+/*******************************************************************************
+ * Implements DataError. Indicates that a transaction was not committed because
+ * an object that it read was modified by another transaction (i.e., a redis
+ * WATCH was triggered). The request may be retried.
+ */
+type TransactionConflictError struct {
+	utilities.ServerError
+}
+
+var _ DataError = &TransactionConflictError{}
+
+func NewTransactionConflictError(msg string) *TransactionConflictError {
+	return &TransactionConflictError{
+		ServerError: *utilities.ConstructServerError(msg),
+	}
+}
+
+func (conflictErr *TransactionConflictError) asFailureDesc() *apitypes.FailureDesc {
+	return apitypes.NewFailureDesc(http.StatusConflict, conflictErr.Error())
+}
+
 /*******************************************************************************
  * Implements DBClient.
  */
@@ -130,6 +155,16 @@ func (client *InMemClient) abort() error {
 
 func (client *InMemClient) getPersistentObject(id string) (PersistObj, error) {
 	
+	var obj PersistObj
+	var err error
+	obj, err = client.getPersistentObjectIfExists(id)
+	if err != nil { return nil, err }
+	if obj == nil { return nil, utilities.ConstructUserError("Object with Id " + id + " not found") }
+	return obj, nil
+}
+
+func (client *InMemClient) getPersistentObjectIfExists(id string) (PersistObj, error) {
+	
 	if id == "" { return nil, utilities.ConstructServerError("Object Id is empty") }
 	
 	var cachedObj PersistObj = client.objectsCache[id]
@@ -139,11 +174,42 @@ func (client *InMemClient) getPersistentObject(id string) (PersistObj, error) {
 	var err error
 	obj, err = client.Persistence.getObject(client.txn, client, id)
 	if err != nil { return nil, err }
-	if obj == nil { return nil, utilities.ConstructUserError("Object with Id " + id + " not found") }
+	if obj == nil { return nil, nil }
 	client.objectsCache[id] = obj
 	return obj, nil
 }
 
+/*******************************************************************************
+ * Return the objects identified by the ids, in the same order as the ids. Objects
+ * that are not already in the transaction cache are loaded with a single batch
+ * request. An error is returned if any of the objects does not exist.
+ */
+func (client *InMemClient) getPersistentObjects(ids []string) ([]PersistObj, error) {
+	
+	var objs = make([]PersistObj, len(ids))
+	var idsToLoad = make([]string, 0, len(ids))
+	for i, id := range ids {
+		if id == "" { return nil, utilities.ConstructServerError("Object Id is empty") }
+		objs[i] = client.objectsCache[id]
+		if objs[i] == nil { idsToLoad = append(idsToLoad, id) }
+	}
+	if len(idsToLoad) == 0 { return objs, nil }
+	
+	var loadedObjs []PersistObj
+	var err error
+	loadedObjs, err = client.Persistence.getObjects(client.txn, client, idsToLoad)
+	if err != nil { return nil, err }
+	for i, obj := range loadedObjs {
+		if obj == nil { return nil, utilities.ConstructUserError(
+			"Object with Id " + idsToLoad[i] + " not found") }
+		client.objectsCache[idsToLoad[i]] = obj
+	}
+	for i, id := range ids {
+		if objs[i] == nil { objs[i] = client.objectsCache[id] }
+	}
+	return objs, nil
+}
+
 func (client *InMemClient) updateObject(obj PersistObj) error {
 	
 	// Checks that can be removed after testing.
@@ -313,18 +379,20 @@ func (client *InMemClient) ReconstitutePersistObj(id string) (*InMemPersistObj,
 }
 
 /*******************************************************************************
- * 
+ * The information about a token that was emailed to a user. Purpose is what the
+ * token may be used for: EmailVerificationPurpose or PasswordResetPurpose.
  */
 type InMemIdentityValidationInfo struct {
 	InMemPersistObj
 	UserId string
 	CreationTime time.Time
+	Purpose string
 }
 
 var _ IdentityValidationInfo = &InMemIdentityValidationInfo{}
 
 func (client *InMemClient) NewInMemIdentityValidationInfo(userId string,
-	creationTime time.Time) (*InMemIdentityValidationInfo, error) {
+	creationTime time.Time, purpose string) (*InMemIdentityValidationInfo, error) {
 	
 	var persistobj *InMemPersistObj
 	var err error
@@ -334,16 +402,17 @@ func (client *InMemClient) NewInMemIdentityValidationInfo(userId string,
 		InMemPersistObj: *persistobj,
 		UserId: userId,
 		CreationTime: creationTime,
+		Purpose: purpose,
 	}
 	return newInfo, client.updateObject(newInfo)
 }
 
 func (client *InMemClient) dbCreateIdentityValidationInfo(userId string,
-	creationTime time.Time, token string) (IdentityValidationInfo, error) {
+	creationTime time.Time, token, purpose string) (IdentityValidationInfo, error) {
 	
 	var info IdentityValidationInfo
 	var err error
-	info, err = client.NewInMemIdentityValidationInfo(userId, creationTime)
+	info, err = client.NewInMemIdentityValidationInfo(userId, creationTime, purpose)
 	if err != nil { return nil, err }
 	err = client.getPersistence().addIdentityValidationInfo(token, info.getId())
 	return info, err
@@ -371,15 +440,20 @@ func (info *InMemIdentityValidationInfo) getCreationTime() time.Time {
 	return info.CreationTime
 }
 
+func (info *InMemIdentityValidationInfo) getPurpose() string {
+	return info.Purpose
+}
+
 func (info *InMemIdentityValidationInfo) asJSON() string {
 	var json = "\"IdentityValidationInfo\": {" + info.persistObjFieldsAsJSON() + ", "
-	json = json + fmt.Sprintf("\"UserId\": \"%s\", \"CreationTime\": time %s}",
-		info.UserId, apitypes.FormatTimeAsJavascriptDate(info.CreationTime))
+	json = json + fmt.Sprintf("\"UserId\": \"%s\", \"CreationTime\": time %s, \"Purpose\": \"%s\"}",
+		info.UserId, apitypes.FormatTimeAsJavascriptDate(info.CreationTime), info.Purpose)
 	return json
 }
 
 func (client *InMemClient) ReconstituteIdentityValidationInfo(
-	id string, userId string, creationTime time.Time) (*InMemIdentityValidationInfo, error) {
+	id string, userId string, creationTime time.Time,
+	purpose string) (*InMemIdentityValidationInfo, error) {
 	
 	var persistObj *InMemPersistObj
 	var err error
@@ -389,6 +463,7 @@ func (client *InMemClient) ReconstituteIdentityValidationInfo(
 		InMemPersistObj: *persistObj,
 		UserId: userId,
 		CreationTime: creationTime,
+		Purpose: purpose,
 	}, nil
 }
 
@@ -502,7 +577,6 @@ func (client *InMemClient) setAccess(resource Resource, party Party, mask []bool
 		err = aclEntry.setPermissionMask(client, mask)
 		if err != nil { return nil, err }
 	}
-	
 	return aclEntry, nil
 }
 
@@ -525,7 +599,6 @@ func (client *InMemClient) addAccess(resource Resource, party Party, mask []bool
 		if err != nil { return nil, err }
 		//if err = client.writeBack(aclEntry); err != nil { return nil, err }
 	}
-
 	return aclEntry, nil
 }
 
@@ -555,6 +628,9 @@ func (client *InMemClient) deleteAccess(resource Resource, party Party) error {
 			// Remove from database.
 			err = client.Persistence.deleteObject(client.txn, aclEntry)
 			if err != nil { return err }
+			
+			err = queuePermissionChangeWebhookEvent(client, "delete", resource, party, nil)
+			if err != nil { return err }
 		}
 	}
 	
@@ -992,12 +1068,16 @@ func (client *InMemClient) ReconstituteParty(id string, isActive bool,
 }
 
 /*******************************************************************************
- * 
+ * A Group may contain other Groups of the same realm. GroupIds lists the groups
+ * that the group is a member of, and MemberGroupIds lists the groups that are
+ * members of it; the two are kept consistent. Membership may not be circular.
  */
 type InMemGroup struct {
 	InMemParty
 	Description string
 	UserObjIds []string
+	GroupIds []string
+	MemberGroupIds []string
 }
 
 var _ Group = &InMemGroup{}
@@ -1013,6 +1093,8 @@ func (client *InMemClient) NewInMemGroup(realmId string, name string,
 		InMemParty: *group,
 		Description: desc,
 		UserObjIds: make([]string, 0),
+		GroupIds: make([]string, 0),
+		MemberGroupIds: make([]string, 0),
 	}
 	return newGroup, client.updateObject(newGroup)
 }
@@ -1114,8 +1196,10 @@ func (group *InMemGroup) removeUser(dbClient DBClient, user User) error {
 	for i, id := range group.UserObjIds {
 		if id == userId {
 			group.UserObjIds = append(group.UserObjIds[0:i], group.UserObjIds[i+1:]...)
-			dbClient.writeBack(group)
-			return nil
+			user.removeGroupIdDeferredUpdate(group.getId())
+			var err = dbClient.writeBack(user)
+			if err != nil { return err }
+			return dbClient.writeBack(group)
 		}
 	}
 	return utilities.ConstructUserError("Did not find user in this group")
@@ -1126,6 +1210,80 @@ func (group *InMemGroup) addUser(dbClient DBClient, user User) error {
 	return dbClient.writeBack(group)
 }
 
+func (group *InMemGroup) getGroupIds() []string {
+	return group.GroupIds
+}
+
+func (group *InMemGroup) getMemberGroupIds() []string {
+	return group.MemberGroupIds
+}
+
+func (group *InMemGroup) hasMemberGroupWithId(groupId string) bool {
+	for _, id := range group.MemberGroupIds {
+		if id == groupId { return true }
+	}
+	return false
+}
+
+/*******************************************************************************
+ * Make the specified group a member of this group. Fails if that would make
+ * membership circular, i.e., if this group is already - directly or indirectly -
+ * a member of the specified group. Groups are added to the groups of a realm
+ * one transaction at a time, and the check is made against the groups as they
+ * are stored now, as well as they are in this transaction: otherwise, two
+ * concurrent additions (e.g., of A to B and of B to A) could each pass the check,
+ * and together make membership circular.
+ */
+func (group *InMemGroup) addMemberGroup(dbClient DBClient, member Group) error {
+	
+	if member.getRealmId() != group.getRealmId() {
+		return utilities.ConstructUserError(
+			"A group may only contain groups that belong to the same realm")
+	}
+	if group.hasMemberGroupWithId(member.getId()) {
+		return utilities.ConstructUserError(fmt.Sprintf(
+			"Group with object Id %s is already a member of the group", member.getId()))
+	}
+	
+	var err = dbClient.getPersistence().holdKey(dbClient.getTransactionContext(),
+		GroupNestingLockKeyPrefix + group.getRealmId(), GroupNestingLockSeconds)
+	if err != nil { return err }
+	var ancestorIds []string
+	ancestorIds, err = getCurrentAncestorGroupIds(dbClient, group.getId())
+	if err != nil { return err }
+	for _, id := range ancestorIds {
+		if id == member.getId() { return utilities.ConstructUserError(fmt.Sprintf(
+			"Group %s contains group %s: membership may not be circular",
+			member.getName(), group.getName()))
+		}
+	}
+	
+	group.MemberGroupIds = append(group.MemberGroupIds, member.getId())
+	member.addGroupIdDeferredUpdate(group.getId())
+	err = dbClient.writeBack(member)
+	if err != nil { return err }
+	return dbClient.writeBack(group)
+}
+
+func (group *InMemGroup) removeMemberGroup(dbClient DBClient, member Group) error {
+	if ! group.hasMemberGroupWithId(member.getId()) {
+		return utilities.ConstructUserError("Did not find group in this group")
+	}
+	group.MemberGroupIds = utilities.RemoveFrom(member.getId(), group.MemberGroupIds)
+	member.removeGroupIdDeferredUpdate(group.getId())
+	var err = dbClient.writeBack(member)
+	if err != nil { return err }
+	return dbClient.writeBack(group)
+}
+
+func (group *InMemGroup) addGroupIdDeferredUpdate(groupId string) {
+	group.GroupIds = append(group.GroupIds, groupId)
+}
+
+func (group *InMemGroup) removeGroupIdDeferredUpdate(groupId string) {
+	group.GroupIds = utilities.RemoveFrom(groupId, group.GroupIds)
+}
+
 func (group *InMemGroup) asGroupDesc() *apitypes.GroupDesc {
 	return apitypes.NewGroupDesc(
 		group.Id, group.RealmId, group.Name, group.Description, group.CreationTime)
@@ -1144,13 +1302,24 @@ func (group *InMemGroup) asJSON() string {
 		if i != 0 { json = json + ", " }
 		json = json + fmt.Sprintf("\"%s\"", id)
 	}
+	json = json + "], \"GroupIds\": ["
+	for i, id := range group.GroupIds {
+		if i != 0 { json = json + ", " }
+		json = json + fmt.Sprintf("\"%s\"", id)
+	}
+	json = json + "], \"MemberGroupIds\": ["
+	for i, id := range group.MemberGroupIds {
+		if i != 0 { json = json + ", " }
+		json = json + fmt.Sprintf("\"%s\"", id)
+	}
 	json = json + "]}"
 	return json
 }
 
 func (client *InMemClient) ReconstituteGroup(id string, isActive bool,
 		name string, creationTime time.Time, realmId string, aclEntryIds []string,
-		desc string, userObjIds []string) (*InMemGroup, error) {
+		desc string, userObjIds []string, groupIds []string,
+		memberGroupIds []string) (*InMemGroup, error) {
 	
 	var party *InMemParty
 	var err error
@@ -1161,9 +1330,102 @@ func (client *InMemClient) ReconstituteGroup(id string, isActive bool,
 		InMemParty: *party,
 		Description: desc,
 		UserObjIds: userObjIds,
+		GroupIds: groupIds,
+		MemberGroupIds: memberGroupIds,
 	}, nil
 }
 
+/*******************************************************************************
+ * Return the specified groups, together with every group that they belong to,
+ * directly or indirectly. Each group appears once; the specified groups come
+ * first, followed by their containing groups in order of increasing distance.
+ */
+func getEffectiveGroupIds(dbClient DBClient, groupIds []string) ([]string, error) {
+	
+	var result = make([]string, 0)
+	var visited = make(map[string]bool)
+	var pending = append([]string{}, groupIds...)
+	for len(pending) > 0 {
+		var id = pending[0]
+		pending = pending[1:]
+		if visited[id] { continue }
+		visited[id] = true
+		result = append(result, id)
+		
+		var group Group
+		var err error
+		group, err = dbClient.getGroup(id)
+		if err != nil { return nil, err }
+		pending = append(pending, group.getGroupIds()...)
+	}
+	return result, nil
+}
+
+/*******************************************************************************
+ * Return the object Ids of the group and of the groups that contain it, directly
+ * or indirectly, according both to this transaction and to the groups as they
+ * are stored now, which may include changes committed since this transaction
+ * read them.
+ */
+func getCurrentAncestorGroupIds(dbClient DBClient, groupId string) ([]string, error) {
+	
+	var result = make([]string, 0)
+	var visited = make(map[string]bool)
+	var pending = []string{ groupId }
+	for len(pending) > 0 {
+		var id = pending[0]
+		pending = pending[1:]
+		if visited[id] { continue }
+		visited[id] = true
+		result = append(result, id)
+		
+		var group Group
+		var err error
+		group, err = dbClient.getGroup(id)
+		if err != nil { return nil, err }
+		pending = append(pending, group.getGroupIds()...)
+		var obj PersistObj
+		obj, err = dbClient.getPersistence().readCurrentObject(dbClient, id)
+		if err != nil { return nil, err }
+		var current, isGroup = obj.(Group)
+		if isGroup { pending = append(pending, current.getGroupIds()...) }
+	}
+	return result, nil
+}
+
+/*******************************************************************************
+ * Return the object Ids of the users who belong to the specified group, either
+ * directly or by belonging to a group that the group contains. Each user
+ * appears once.
+ */
+func getEffectiveGroupUserObjIds(dbClient DBClient, group Group) ([]string, error) {
+	
+	var userObjIds = make([]string, 0)
+	var visitedUsers = make(map[string]bool)
+	var visitedGroups = make(map[string]bool)
+	var pending = []Group{ group }
+	for len(pending) > 0 {
+		var g = pending[0]
+		pending = pending[1:]
+		if visitedGroups[g.getId()] { continue }
+		visitedGroups[g.getId()] = true
+		
+		for _, id := range g.getUserObjIds() {
+			if visitedUsers[id] { continue }
+			visitedUsers[id] = true
+			userObjIds = append(userObjIds, id)
+		}
+		for _, id := range g.getMemberGroupIds() {
+			var member Group
+			var err error
+			member, err = dbClient.getGroup(id)
+			if err != nil { return nil, err }
+			pending = append(pending, member)
+		}
+	}
+	return userObjIds, nil
+}
+
 /*******************************************************************************
  * 
  */
@@ -1175,8 +1437,27 @@ type InMemUser struct {
 	EmailIsVerified bool
 	PasswordHash []byte
 	GroupIds []string
-	MostRecentLoginAttempts []string
+	MostRecentLoginAttempts []string  // successful logins
 	EventIds []string
+	FailedLoginAttempts []string  // since the last successful login or lockout
+	LockedUntil time.Time  // zero if the account has never been locked
+	LockoutCount int  // lockouts since the last successful login
+	TOTPSecret string  // base 32; "" if the user has no second factor (see SecondFactor.go)
+	TOTPEnabled bool  // false until enrollment is confirmed
+	TOTPLastStep int  // time step of the last code accepted, so that no code is accepted twice
+	RecoveryCodeHashes []string  // those not yet used
+	LDAPDN string  // "" unless the user was provisioned from the LDAP directory (see LDAP.go)
+	Locale string  // e.g., "fr-CA"; "" if the user has not chosen one (see EmailTemplates.go)
+	NotificationSubscriptionIds []string  // see Notifications.go
+	NotificationIds []string  // in-app notifications, oldest first
+	PendingNotificationIds []string  // to be emailed, once quiet hours end or in the digest
+	EmailNotifications string  // EmailNotificationsImmediately, EmailNotificationsDigest, or EmailNotificationsNever
+	InAppNotifications bool
+	QuietHoursStart int  // minutes after midnight, in TimeZone; no quiet hours if equal to QuietHoursEnd
+	QuietHoursEnd int
+	TimeZone string  // e.g., "Europe/Paris"; "" for UTC
+	CredentialEpoch time.Time  // sessions and password reset tokens issued before this are invalid
+	Deleted bool  // if the user was deleted (see markUserDeleted)
 }
 
 var _ User = &InMemUser{}
@@ -1198,6 +1479,25 @@ func (client *InMemClient) NewInMemUser(userId string, name string,
 		GroupIds: make([]string, 0),
 		MostRecentLoginAttempts: make([]string, 0),
 		EventIds: make([]string, 0),
+		FailedLoginAttempts: make([]string, 0),
+		LockedUntil: time.Time{},
+		LockoutCount: 0,
+		TOTPSecret: "",
+		TOTPEnabled: false,
+		TOTPLastStep: 0,
+		RecoveryCodeHashes: make([]string, 0),
+		LDAPDN: "",
+		Locale: "",
+		NotificationSubscriptionIds: make([]string, 0),
+		NotificationIds: make([]string, 0),
+		PendingNotificationIds: make([]string, 0),
+		EmailNotifications: EmailNotificationsImmediately,
+		InAppNotifications: true,
+		QuietHoursStart: 0,
+		QuietHoursEnd: 0,
+		TimeZone: "",
+		CredentialEpoch: time.Time{},
+		Deleted: false,
 	}
 	
 	return newUser, client.addUser(newUser)
@@ -1356,10 +1656,97 @@ func (user *InMemUser) addGroupIdDeferredUpdate(dbClient DBClient, groupId strin
 	return nil
 }
 
+func (user *InMemUser) removeGroupIdDeferredUpdate(groupId string) {
+	user.GroupIds = utilities.RemoveFrom(groupId, user.GroupIds)
+}
+
 func (user *InMemUser) getGroupIds() []string {
 	return user.GroupIds
 }
 
+func (user *InMemUser) getLDAPDN() string {
+	return user.LDAPDN
+}
+
+func (user *InMemUser) setLDAPDN(dbClient DBClient, dn string) error {
+	user.LDAPDN = dn
+	return dbClient.writeBack(user)
+}
+
+func (user *InMemUser) getLocale() string {
+	return user.Locale
+}
+
+func (user *InMemUser) setLocale(dbClient DBClient, locale string) error {
+	user.Locale = locale
+	return dbClient.writeBack(user)
+}
+
+func (user *InMemUser) getNotificationSubscriptionIds() []string {
+	return user.NotificationSubscriptionIds
+}
+
+func (user *InMemUser) addNotificationSubscription(dbClient DBClient,
+	subscription NotificationSubscription) error {
+	user.NotificationSubscriptionIds = append(user.NotificationSubscriptionIds, subscription.getId())
+	return dbClient.writeBack(user)
+}
+
+func (user *InMemUser) removeNotificationSubscription(dbClient DBClient,
+	subscription NotificationSubscription) error {
+	user.NotificationSubscriptionIds = utilities.RemoveFrom(subscription.getId(),
+		user.NotificationSubscriptionIds)
+	return dbClient.writeBack(user)
+}
+
+func (user *InMemUser) getNotificationIds() []string {
+	return user.NotificationIds
+}
+
+func (user *InMemUser) addNotification(dbClient DBClient, notification Notification) error {
+	user.NotificationIds = append(user.NotificationIds, notification.getId())
+	return dbClient.writeBack(user)
+}
+
+func (user *InMemUser) removeNotificationId(dbClient DBClient, id string) error {
+	user.NotificationIds = utilities.RemoveFrom(id, user.NotificationIds)
+	return dbClient.writeBack(user)
+}
+
+func (user *InMemUser) getPendingNotificationIds() []string {
+	return user.PendingNotificationIds
+}
+
+func (user *InMemUser) addPendingNotification(dbClient DBClient, notification Notification) error {
+	user.PendingNotificationIds = append(user.PendingNotificationIds, notification.getId())
+	return dbClient.writeBack(user)
+}
+
+func (user *InMemUser) clearPendingNotifications(dbClient DBClient) error {
+	user.PendingNotificationIds = make([]string, 0)
+	return dbClient.writeBack(user)
+}
+
+func (user *InMemUser) getNotificationPreferences() *NotificationPreferences {
+	return &NotificationPreferences{
+		Email: user.EmailNotifications,
+		InApp: user.InAppNotifications,
+		QuietHoursStart: user.QuietHoursStart,
+		QuietHoursEnd: user.QuietHoursEnd,
+		TimeZone: user.TimeZone,
+	}
+}
+
+func (user *InMemUser) setNotificationPreferences(dbClient DBClient,
+	prefs *NotificationPreferences) error {
+	user.EmailNotifications = prefs.Email
+	user.InAppNotifications = prefs.InApp
+	user.QuietHoursStart = prefs.QuietHoursStart
+	user.QuietHoursEnd = prefs.QuietHoursEnd
+	user.TimeZone = prefs.TimeZone
+	return dbClient.writeBack(user)
+}
+
 func (client *InMemClient) getRealmsAdministeredByUser(userObjId string) ([]string, error) {
 	// those realms for which user can edit the realm
 	
@@ -1412,15 +1799,189 @@ func (client *InMemClient) getRealmsAdministeredByUser(userObjId string) ([]stri
 func (user *InMemUser) addLoginAttempt(dbClient DBClient) {
 	var num = len(user.MostRecentLoginAttempts)
 	var max = dbClient.getServer().MaxLoginAttemptsToRetain
-	if num > max { num = num - max }
+	var first = 0
+	if num >= max { first = num - max + 1 }
 	user.MostRecentLoginAttempts = append(
-		user.MostRecentLoginAttempts[num:], fmt.Sprintf("%d", time.Now().Unix()))
+		user.MostRecentLoginAttempts[first:], fmt.Sprintf("%d", time.Now().Unix()))
 }
 
 func (user *InMemUser) getMostRecentLoginAttempts() []string {
 	return user.MostRecentLoginAttempts
 }
 
+func (user *InMemUser) getFailedLoginAttempts() []string {
+	return user.FailedLoginAttempts
+}
+
+func (user *InMemUser) getLockedUntil() time.Time {
+	return user.LockedUntil
+}
+
+func (user *InMemUser) getLockoutCount() int {
+	return user.LockoutCount
+}
+
+func (user *InMemUser) isLockedOut(now time.Time) bool {
+	return now.Before(user.LockedUntil)
+}
+
+/*******************************************************************************
+ * Record a failed login attempt. If MaxLoginAttemptsToRetain attempts have failed
+ * within LoginFailureWindow, lock the account, for a period that doubles with
+ * each successive lockout (see getLockoutDuration), and return true.
+ */
+func (user *InMemUser) recordFailedLogin(dbClient DBClient, now time.Time) (bool, error) {
+	
+	var failures = make([]string, 0)
+	for _, t := range user.FailedLoginAttempts {
+		var seconds, err = strconv.ParseInt(t, 10, 64)
+		if err != nil { continue }
+		if now.Sub(time.Unix(seconds, 0)) < LoginFailureWindow { failures = append(failures, t) }
+	}
+	failures = append(failures, fmt.Sprintf("%d", now.Unix()))
+	
+	var locked = false
+	if len(failures) >= dbClient.getServer().MaxLoginAttemptsToRetain {
+		user.LockoutCount++
+		user.LockedUntil = now.Add(getLockoutDuration(user.LockoutCount))
+		failures = make([]string, 0)
+		locked = true
+	}
+	user.FailedLoginAttempts = failures
+	return locked, dbClient.writeBack(user)
+}
+
+/*******************************************************************************
+ * Record a successful login, and forget any prior failures and lockouts.
+ */
+func (user *InMemUser) recordSuccessfulLogin(dbClient DBClient) error {
+	user.addLoginAttempt(dbClient)
+	user.FailedLoginAttempts = make([]string, 0)
+	user.LockoutCount = 0
+	return dbClient.writeBack(user)
+}
+
+/*******************************************************************************
+ * End the current lockout, if any, and forget prior failures. The lockout count
+ * is retained, so that if logins continue to fail, the next lockout is longer.
+ */
+func (user *InMemUser) unlock(dbClient DBClient) error {
+	user.FailedLoginAttempts = make([]string, 0)
+	user.LockedUntil = time.Time{}
+	return dbClient.writeBack(user)
+}
+
+func (user *InMemUser) isDeleted() bool {
+	return user.Deleted
+}
+
+/*******************************************************************************
+ * Flag the user as deleted, and free its user Id, so that another user may be
+ * created with it. The user is not removed, since events and ACL entries refer
+ * to it, but it can no longer log in, and it is ignored when looking up a user
+ * by name.
+ */
+func (client *InMemClient) markUserDeleted(user User) error {
+	var inMemUser = user.(*InMemUser)
+	inMemUser.Deleted = true
+	var err = client.writeBack(inMemUser)
+	if err != nil { return err }
+	delete(client.usersCache, user.getUserId())
+	return client.Persistence.queueRemoveUserId(client.txn, user.getUserId())
+}
+
+func (user *InMemUser) getCredentialEpoch() time.Time {
+	return user.CredentialEpoch
+}
+
+/*******************************************************************************
+ * Invalidate every session, and every password reset token, that was issued to
+ * the user before now. Since the epoch is stored with the user, this takes effect
+ * on every server that shares the database.
+ */
+func (user *InMemUser) advanceCredentialEpoch(dbClient DBClient, now time.Time) error {
+	user.CredentialEpoch = now
+	return dbClient.writeBack(user)
+}
+
+func (user *InMemUser) getTOTPSecret() string {
+	return user.TOTPSecret
+}
+
+func (user *InMemUser) isTOTPEnabled() bool {
+	return user.TOTPEnabled
+}
+
+func (user *InMemUser) getRecoveryCodeCount() int {
+	return len(user.RecoveryCodeHashes)
+}
+
+/*******************************************************************************
+ * Set a new TOTP secret, which takes effect when enableTOTP is called.
+ */
+func (user *InMemUser) beginTOTPEnrollment(dbClient DBClient, secret string) error {
+	if user.TOTPEnabled { return utilities.ConstructUserError(
+		"User " + user.UserId + " already has a second factor") }
+	user.TOTPSecret = secret
+	user.TOTPLastStep = 0
+	user.RecoveryCodeHashes = make([]string, 0)
+	return dbClient.writeBack(user)
+}
+
+func (user *InMemUser) enableTOTP(dbClient DBClient, recoveryCodeHashes []string) error {
+	if user.TOTPSecret == "" { return utilities.ConstructUserError(
+		"No second factor enrollment is in progress for user " + user.UserId) }
+	user.TOTPEnabled = true
+	user.RecoveryCodeHashes = recoveryCodeHashes
+	return dbClient.writeBack(user)
+}
+
+func (user *InMemUser) setRecoveryCodeHashes(dbClient DBClient, hashes []string) error {
+	user.RecoveryCodeHashes = hashes
+	return dbClient.writeBack(user)
+}
+
+/*******************************************************************************
+ * Remove the user's second factor, and any enrollment in progress.
+ */
+func (user *InMemUser) resetSecondFactor(dbClient DBClient) error {
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
+	user.TOTPLastStep = 0
+	user.RecoveryCodeHashes = make([]string, 0)
+	return dbClient.writeBack(user)
+}
+
+/*******************************************************************************
+ * Return true if the code is currently valid for the user's TOTP secret, and
+ * has not been accepted before.
+ */
+func (user *InMemUser) verifyTOTPCode(dbClient DBClient, code string, now time.Time) (bool, error) {
+	if user.TOTPSecret == "" { return false, nil }
+	var step, valid, err = checkTOTPCode(user.TOTPSecret, code, now, int64(user.TOTPLastStep))
+	if err != nil { return false, err }
+	if ! valid { return false, nil }
+	user.TOTPLastStep = int(step)
+	return true, dbClient.writeBack(user)
+}
+
+/*******************************************************************************
+ * If the code is one of the user's unused recovery codes, use it up and return
+ * true.
+ */
+func (user *InMemUser) useRecoveryCode(dbClient DBClient, code string) (bool, error) {
+	if ! user.TOTPEnabled { return false, nil }
+	var hash = dbClient.getServer().authService.hashRecoveryCode(code)
+	for i, h := range user.RecoveryCodeHashes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			user.RecoveryCodeHashes = append(append([]string{},
+				user.RecoveryCodeHashes[:i]...), user.RecoveryCodeHashes[i+1:]...)
+			return true, dbClient.writeBack(user)
+		}
+	}
+	return false, nil
+}
+
 func (user *InMemUser) addEventId(dbClient DBClient, id string) {
 	user.EventIds = append(user.EventIds, id)
 	dbClient.writeBack(user)
@@ -1463,7 +2024,7 @@ func (user *InMemUser) asUserDesc(dbClient DBClient) *apitypes.UserDesc {
 		adminRealmIds = make([]string, 0)
 	}
 	return apitypes.NewUserDesc(user.Id, user.UserId, user.Name, user.RealmId,
-		user.DefaultRepoId, user.EmailAddress, user.EmailIsVerified, adminRealmIds)
+		user.DefaultRepoId, user.EmailAddress, user.EmailIsVerified, adminRealmIds, user.Locale)
 }
 
 func (user *InMemUser) writeBack(dbClient DBClient) error {
@@ -1496,14 +2057,54 @@ func (user *InMemUser) asJSON() string {
 		if i != 0 { json = json + ", " }
 		json = json + "\"" + id + "\""
 	}
-	json = json + "]}"
+	json = json + "], \"FailedLoginAttempts\": ["
+	for i, a := range user.FailedLoginAttempts {
+		if i != 0 { json = json + ", " }
+		json = json + "\"" + a + "\""
+	}
+	json = json + fmt.Sprintf("], \"LockedUntil\": time %s, \"LockoutCount\": %d, " +
+		"\"TOTPSecret\": \"%s\", \"TOTPEnabled\": %s, \"TOTPLastStep\": %d, \"RecoveryCodeHashes\": [",
+		apitypes.FormatTimeAsJavascriptDate(user.LockedUntil), user.LockoutCount,
+		user.TOTPSecret, apitypes.BoolToString(user.TOTPEnabled), user.TOTPLastStep)
+	for i, h := range user.RecoveryCodeHashes {
+		if i != 0 { json = json + ", " }
+		json = json + "\"" + h + "\""
+	}
+	json = json + fmt.Sprintf("], \"LDAPDN\": \"%s\", \"Locale\": \"%s\", " +
+		"\"NotificationSubscriptionIds\": [",
+		rest.EncodeStringForJSON(user.LDAPDN), user.Locale)
+	for i, id := range user.NotificationSubscriptionIds {
+		if i != 0 { json = json + ", " }
+		json = json + "\"" + id + "\""
+	}
+	json = json + "], \"NotificationIds\": ["
+	for i, id := range user.NotificationIds {
+		if i != 0 { json = json + ", " }
+		json = json + "\"" + id + "\""
+	}
+	json = json + "], \"PendingNotificationIds\": ["
+	for i, id := range user.PendingNotificationIds {
+		if i != 0 { json = json + ", " }
+		json = json + "\"" + id + "\""
+	}
+	json = json + fmt.Sprintf("], \"EmailNotifications\": \"%s\", \"InAppNotifications\": %s, " +
+		"\"QuietHoursStart\": %d, \"QuietHoursEnd\": %d, \"TimeZone\": \"%s\", " +
+		"\"CredentialEpoch\": time %s, \"Deleted\": %s}",
+		user.EmailNotifications, apitypes.BoolToString(user.InAppNotifications),
+		user.QuietHoursStart, user.QuietHoursEnd, user.TimeZone,
+		apitypes.FormatTimeAsJavascriptDate(user.CredentialEpoch), apitypes.BoolToString(user.Deleted))
 	return json
 }
 
 func (client *InMemClient) ReconstituteUser(id string, isActive bool,
 		name string, creationTime time.Time, realmId string, aclEntryIds []string,
 		userId, defaultRepoId, emailAddr string, emailIsVerified bool, pswdHash []byte, groupIds []string,
-		loginAttmpts []string, eventIds []string) (*InMemUser, error) {
+		loginAttmpts []string, eventIds []string, failedLoginAttempts []string,
+		lockedUntil time.Time, lockoutCount int, totpSecret string, totpEnabled bool,
+		totpLastStep int, recoveryCodeHashes []string, ldapDN string, locale string,
+		notificationSubscriptionIds, notificationIds, pendingNotificationIds []string,
+		emailNotifications string, inAppNotifications bool, quietHoursStart, quietHoursEnd int,
+		timeZone string, credentialEpoch time.Time, deleted bool) (*InMemUser, error) {
 	
 	var party *InMemParty
 	var err error
@@ -1520,17 +2121,50 @@ func (client *InMemClient) ReconstituteUser(id string, isActive bool,
 		GroupIds: groupIds,
 		MostRecentLoginAttempts: loginAttmpts,
 		EventIds: eventIds,
+		FailedLoginAttempts: failedLoginAttempts,
+		LockedUntil: lockedUntil,
+		LockoutCount: lockoutCount,
+		TOTPSecret: totpSecret,
+		TOTPEnabled: totpEnabled,
+		TOTPLastStep: totpLastStep,
+		RecoveryCodeHashes: recoveryCodeHashes,
+		LDAPDN: ldapDN,
+		Locale: locale,
+		NotificationSubscriptionIds: notificationSubscriptionIds,
+		NotificationIds: notificationIds,
+		PendingNotificationIds: pendingNotificationIds,
+		EmailNotifications: emailNotifications,
+		InAppNotifications: inAppNotifications,
+		QuietHoursStart: quietHoursStart,
+		QuietHoursEnd: quietHoursEnd,
+		TimeZone: timeZone,
+		CredentialEpoch: credentialEpoch,
+		Deleted: deleted,
 	}, nil
 }
 
 /*******************************************************************************
- * 
+ * PermissionMask lists the access modes that the entry grants, and DenyMask the
+ * access modes that it denies. A mode is never both granted and denied by the
+ * same entry: setting one mask clears the corresponding modes of the other.
+ * If the granted modes were assigned by means of a Role, RoleName is the name
+ * of the role; otherwise it is "".
+ * An entry with a non-zero ExpiresAt has no effect after that time, and is then
+ * deleted by the expiry sweeper; GrantorId is the user who set the expiry, who
+ * is notified by an ACLEntryExpiryEvent.
+ * An entry that grants a party access to a resource of another realm is marked
+ * with the Id of the Invitation by which it was granted.
  */
 type InMemACLEntry struct {
 	InMemPersistObj
 	ResourceId string
 	PartyId string
 	PermissionMask []bool
+	DenyMask []bool
+	RoleName string
+	ExpiresAt time.Time  // zero if the entry does not expire
+	GrantorId string
+	InvitationId string  // "" unless the entry is cross-realm
 }
 
 var _ ACLEntry = &InMemACLEntry{}
@@ -1547,6 +2181,11 @@ func (client *InMemClient) NewInMemACLEntry(resourceId string, partyId string,
 		ResourceId: resourceId,
 		PartyId: partyId,
 		PermissionMask: permissionMask,
+		DenyMask: make([]bool, len(permissionMask)),
+		RoleName: "",
+		ExpiresAt: time.Time{},
+		GrantorId: "",
+		InvitationId: "",
 	}
 	return newACLEntry, client.updateObject(newACLEntry)
 }
@@ -1628,47 +2267,1795 @@ func (entry *InMemACLEntry) getPermissionMask() []bool {
 
 func (entry *InMemACLEntry) setPermissionMask(dbClient DBClient, mask []bool) error {
 	entry.PermissionMask = mask
+	entry.DenyMask = clearModes(entry.DenyMask, mask)
+	entry.RoleName = ""  // the mask is no longer that of a role
 	var err error = dbClient.writeBack(entry)
 	if err != nil { return err }
 	return nil
 }
 
-func (entry *InMemACLEntry) asPermissionDesc() *apitypes.PermissionDesc {
-	
-	return apitypes.NewPermissionDesc(entry.getId(), entry.ResourceId, entry.PartyId, entry.getPermissionMask())
+/*******************************************************************************
+ * Grant the specified modes, in addition to those already granted - except any
+ * that the entry denies. Unlike setPermissionMask, this leaves the entry's
+ * denials and role alone.
+ */
+func (entry *InMemACLEntry) addPermissionModes(dbClient DBClient, mask []bool) error {
+	var permissionMask = append([]bool{}, entry.PermissionMask...)
+	for i, _ := range permissionMask {
+		permissionMask[i] = permissionMask[i] || ((i < len(mask)) && mask[i] &&
+			! ((i < len(entry.DenyMask)) && entry.DenyMask[i]))
+	}
+	entry.PermissionMask = permissionMask
+	return dbClient.writeBack(entry)
 }
 
-func (entry *InMemACLEntry) writeBack(dbClient DBClient) error {
-	return dbClient.updateObject(entry)
+/*******************************************************************************
+ * Stop granting the specified modes. This leaves the entry's denials and role
+ * alone.
+ */
+func (entry *InMemACLEntry) remPermissionModes(dbClient DBClient, mask []bool) error {
+	entry.PermissionMask = clearModes(entry.PermissionMask, mask)
+	return dbClient.writeBack(entry)
 }
 
-func (entry *InMemACLEntry) asJSON() string {
+func (entry *InMemACLEntry) getDenyMask() []bool {
+	return entry.DenyMask
+}
+
+func (entry *InMemACLEntry) setDenyMask(dbClient DBClient, mask []bool) error {
+	entry.DenyMask = mask
+	var permissionMask = clearModes(entry.PermissionMask, mask)
+	for i, b := range permissionMask {
+		if b != entry.PermissionMask[i] { entry.RoleName = "" }
+	}
+	entry.PermissionMask = permissionMask
+	return dbClient.writeBack(entry)
+}
+
+func (entry *InMemACLEntry) addDenyMask(dbClient DBClient, mask []bool) error {
+	var denyMask = make([]bool, len(mask))
+	for i, _ := range mask {
+		denyMask[i] = mask[i] || ((i < len(entry.DenyMask)) && entry.DenyMask[i])
+	}
+	return entry.setDenyMask(dbClient, denyMask)
+}
+
+func (entry *InMemACLEntry) getRoleName() string {
+	return entry.RoleName
+}
+
+func (entry *InMemACLEntry) getExpiresAt() time.Time {
+	return entry.ExpiresAt
+}
+
+func (entry *InMemACLEntry) getGrantorId() string {
+	return entry.GrantorId
+}
+
+/*******************************************************************************
+ * Set the time after which the entry has no effect. A zero time removes any
+ * expiry.
+ */
+func (entry *InMemACLEntry) setExpiry(dbClient DBClient, expiresAt time.Time,
+	grantorId string) error {
+	entry.ExpiresAt = expiresAt
+	if expiresAt.IsZero() { grantorId = "" }
+	entry.GrantorId = grantorId
+	return dbClient.writeBack(entry)
+}
+
+func (entry *InMemACLEntry) getInvitationId() string {
+	return entry.InvitationId
+}
+
+func (entry *InMemACLEntry) setInvitationId(dbClient DBClient, invitationId string) error {
+	entry.InvitationId = invitationId
+	return dbClient.writeBack(entry)
+}
+
+func (entry *InMemACLEntry) hasExpired(now time.Time) bool {
+	return (! entry.ExpiresAt.IsZero()) && (! now.Before(entry.ExpiresAt))
+}
+
+/*******************************************************************************
+ * Grant the access modes of the role, in place of the modes that the entry
+ * currently grants, and record the assignment so that a change to the role's
+ * definition is applied to the entry. Modes that the entry denies remain denied.
+ */
+func (entry *InMemACLEntry) setRole(dbClient DBClient, role Role) error {
+	var err error = entry.applyRole(dbClient, role)
+	if err != nil { return err }
+	return role.addACLEntryId(dbClient, entry.getId())
+}
+
+/*******************************************************************************
+ * Grant the access modes of the role, except those that the entry denies, in
+ * place of the modes that the entry currently grants.
+ */
+func (entry *InMemACLEntry) applyRole(dbClient DBClient, role Role) error {
+	entry.PermissionMask = clearModes(role.getPermissionMask(), entry.DenyMask)
+	entry.RoleName = role.getName()
+	return dbClient.writeBack(entry)
+}
+
+func (entry *InMemACLEntry) asPermissionDesc() *apitypes.PermissionDesc {
+	
+	return apitypes.NewPermissionDesc(entry.getId(), entry.ResourceId, entry.PartyId,
+		entry.getPermissionMask(), entry.getDenyMask(), entry.RoleName, entry.ExpiresAt,
+		entry.InvitationId)
+}
+
+/*******************************************************************************
+ * Return a copy of the mask, with each mode that is set in modesToClear cleared.
+ */
+func clearModes(mask []bool, modesToClear []bool) []bool {
+	var result = make([]bool, len(mask))
+	for i, b := range mask {
+		result[i] = b && ! ((i < len(modesToClear)) && modesToClear[i])
+	}
+	return result
+}
+
+func (entry *InMemACLEntry) writeBack(dbClient DBClient) error {
+	return dbClient.updateObject(entry)
+}
+
+func (entry *InMemACLEntry) asJSON() string {
 	var json = "\"ACLEntry\": {"
 	json = json + entry.persistObjFieldsAsJSON()
 	json = json + fmt.Sprintf(
-		", \"ResourceId\": \"%s\", \"PartyId\": \"%s\", \"PermissionMask\": [",
-		entry.ResourceId, entry.PartyId)
-	for i, b := range entry.PermissionMask {
-		if i != 0 { json = json + ", " }
-		json = json + apitypes.BoolToString(b)
-	}
-	json = json + "]}"
+		", \"ResourceId\": \"%s\", \"PartyId\": \"%s\", \"PermissionMask\": [",
+		entry.ResourceId, entry.PartyId)
+	for i, b := range entry.PermissionMask {
+		if i != 0 { json = json + ", " }
+		json = json + apitypes.BoolToString(b)
+	}
+	json = json + "], \"DenyMask\": ["
+	for i, b := range entry.DenyMask {
+		if i != 0 { json = json + ", " }
+		json = json + apitypes.BoolToString(b)
+	}
+	json = json + fmt.Sprintf("], \"RoleName\": \"%s\", \"ExpiresAt\": time %s, \"GrantorId\": \"%s\", " +
+		"\"InvitationId\": \"%s\"}",
+		entry.RoleName, apitypes.FormatTimeAsJavascriptDate(entry.ExpiresAt), entry.GrantorId,
+		entry.InvitationId)
+	return json
+}
+
+func (client *InMemClient) ReconstituteACLEntry(id, resourceId, partyId string,
+	permMask []bool, denyMask []bool, roleName string, expiresAt time.Time,
+	grantorId, invitationId string) (*InMemACLEntry, error) {
+
+	var persistObj *InMemPersistObj
+	var err error
+	persistObj, err = client.ReconstitutePersistObj(id)
+	if err != nil { return nil, err }
+
+	return &InMemACLEntry{
+		InMemPersistObj: *persistObj,
+		ResourceId: resourceId,
+		PartyId: partyId,
+		PermissionMask: permMask,
+		DenyMask: denyMask,
+		RoleName: roleName,
+		ExpiresAt: expiresAt,
+		GrantorId: grantorId,
+		InvitationId: invitationId,
+	}, nil
+}
+
+/*******************************************************************************
+ * A named set of access modes, which can be assigned to a party for a resource
+ * in place of a hand-built permission mask. The built-in roles are available in
+ * every realm, and are not stored; a realm may also define its own roles. A
+ * realm-defined role keeps the Ids of the ACL entries to which it has been
+ * assigned, so that a change to its definition can be applied to each of them.
+ */
+type InMemRole struct {
+	InMemPersistObj
+	RealmId string  // "" for a built-in role
+	Name string
+	Description string
+	PermissionMask []bool
+	ACLEntryIds []string
+}
+
+var _ Role = &InMemRole{}
+
+var BuiltInRoles = []*InMemRole{
+	&InMemRole{ Name: "Viewer", Description: "May read",
+		PermissionMask: []bool{ false, true, false, false, false } },
+	&InMemRole{ Name: "Builder", Description: "May read, and build images from Dockerfiles",
+		PermissionMask: []bool{ true, true, false, true, false } },
+	&InMemRole{ Name: "Scanner", Description: "May read, and scan images",
+		PermissionMask: []bool{ false, true, false, true, false } },
+	&InMemRole{ Name: "Maintainer", Description: "May do anything except delete",
+		PermissionMask: []bool{ true, true, true, true, false } },
+	&InMemRole{ Name: "Admin", Description: "May do anything",
+		PermissionMask: []bool{ true, true, true, true, true } },
+}
+
+func getBuiltInRole(name string) *InMemRole {
+	for _, role := range BuiltInRoles {
+		if role.Name == name { return role }
+	}
+	return nil
+}
+
+func (client *InMemClient) NewInMemRole(realmId, name, desc string,
+	mask []bool) (*InMemRole, error) {
+	
+	var pers *InMemPersistObj
+	var err error
+	pers, err = client.NewInMemPersistObj()
+	if err != nil { return nil, err }
+	var newRole = &InMemRole{
+		InMemPersistObj: *pers,
+		RealmId: realmId,
+		Name: name,
+		Description: desc,
+		PermissionMask: mask,
+		ACLEntryIds: make([]string, 0),
+	}
+	return newRole, client.updateObject(newRole)
+}
+
+func (client *InMemClient) dbCreateRole(realmId, name, desc string, mask []bool) (Role, error) {
+	
+	if getBuiltInRole(name) != nil { return nil, utilities.ConstructUserError(
+		"Role " + name + " is a built-in role") }
+	var realm Realm
+	var err error
+	realm, err = client.getRealm(realmId)
+	if err != nil { return nil, err }
+	var role Role
+	role, err = realm.getRole(client, name)
+	if err != nil { return nil, err }
+	if role != nil { return nil, utilities.ConstructUserError(
+		"A role named " + name + " already exists in realm " + realm.getName()) }
+	
+	var newRole *InMemRole
+	newRole, err = client.NewInMemRole(realmId, name, desc, mask)
+	if err != nil { return nil, err }
+	err = realm.addRole(client, newRole)
+	if err != nil { return nil, err }
+	return newRole, nil
+}
+
+func (client *InMemClient) getRole(id string) (Role, error) {
+	var role Role
+	var isType bool
+	var obj PersistObj
+	var err error
+	obj, err = client.getPersistentObject(id)
+	if err != nil { return nil, err }
+	if obj == nil { return nil, utilities.ConstructUserError("Role not found") }
+	role, isType = obj.(Role)
+	if ! isType { return nil, utilities.ConstructUserError("Object with Id " + id + " is not a Role") }
+	return role, nil
+}
+
+func (role *InMemRole) getRealmId() string {
+	return role.RealmId
+}
+
+func (role *InMemRole) getName() string {
+	return role.Name
+}
+
+func (role *InMemRole) getDescription() string {
+	return role.Description
+}
+
+func (role *InMemRole) getPermissionMask() []bool {
+	return role.PermissionMask
+}
+
+func (role *InMemRole) isBuiltIn() bool {
+	return role.RealmId == ""
+}
+
+func (role *InMemRole) getACLEntryIds() []string {
+	return role.ACLEntryIds
+}
+
+func (role *InMemRole) addACLEntryId(dbClient DBClient, entryId string) error {
+	if role.isBuiltIn() { return nil }  // built-in roles cannot change
+	for _, id := range role.ACLEntryIds {
+		if id == entryId { return nil }
+	}
+	role.ACLEntryIds = append(role.ACLEntryIds, entryId)
+	return dbClient.writeBack(role)
+}
+
+/*******************************************************************************
+ * Change the description and access modes of the role, and grant the new access
+ * modes in place of the old ones in each ACL entry to which the role is
+ * assigned; modes that an entry denies remain denied. Entries that no longer
+ * exist, or that have since been given a hand-built mask or another role, are
+ * dropped from the role's list.
+ */
+func (role *InMemRole) setDefinition(dbClient DBClient, desc string, mask []bool) error {
+	
+	if role.isBuiltIn() { return utilities.ConstructUserError(
+		"Built-in role " + role.Name + " may not be changed") }
+	role.Description = desc
+	role.PermissionMask = mask
+	
+	var entryIds = make([]string, 0)
+	for _, entryId := range role.ACLEntryIds {
+		var obj PersistObj
+		var err error
+		obj, err = dbClient.getPersistentObjectIfExists(entryId)
+		if err != nil { return err }
+		if obj == nil { continue }
+		var entry, isType = obj.(*InMemACLEntry)
+		if ! isType { return utilities.ConstructServerError(fmt.Sprintf(
+			"Internal error: obj with Id %s is not an ACLEntry", entryId))
+		}
+		if entry.getRoleName() != role.Name { continue }
+		err = entry.applyRole(dbClient, role)
+		if err != nil { return err }
+		entryIds = append(entryIds, entryId)
+	}
+	role.ACLEntryIds = entryIds
+	return dbClient.writeBack(role)
+}
+
+func (role *InMemRole) asRoleDesc() *apitypes.RoleDesc {
+	return apitypes.NewRoleDesc(role.Id, role.RealmId, role.Name, role.Description,
+		role.PermissionMask, len(role.ACLEntryIds))
+}
+
+func (role *InMemRole) writeBack(dbClient DBClient) error {
+	if role.isBuiltIn() { return utilities.ConstructServerError(
+		"Internal error: built-in role " + role.Name + " is not persistent") }
+	return dbClient.updateObject(role)
+}
+
+func (role *InMemRole) asJSON() string {
+	var json = "\"Role\": {"
+	json = json + role.persistObjFieldsAsJSON()
+	json = json + fmt.Sprintf(
+		", \"RealmId\": \"%s\", \"Name\": \"%s\", \"Description\": \"%s\", \"PermissionMask\": [",
+		role.RealmId, role.Name, role.Description)
+	for i, b := range role.PermissionMask {
+		if i != 0 { json = json + ", " }
+		json = json + apitypes.BoolToString(b)
+	}
+	json = json + "], \"ACLEntryIds\": ["
+	for i, id := range role.ACLEntryIds {
+		if i != 0 { json = json + ", " }
+		json = json + "\"" + id + "\""
+	}
+	json = json + "]}"
+	return json
+}
+
+func (client *InMemClient) ReconstituteRole(id, realmId, name, desc string,
+	mask []bool, aclEntryIds []string) (*InMemRole, error) {
+
+	var persistObj *InMemPersistObj
+	var err error
+	persistObj, err = client.ReconstitutePersistObj(id)
+	if err != nil { return nil, err }
+
+	return &InMemRole{
+		InMemPersistObj: *persistObj,
+		RealmId: realmId,
+		Name: name,
+		Description: desc,
+		PermissionMask: mask,
+		ACLEntryIds: aclEntryIds,
+	}, nil
+}
+
+/*******************************************************************************
+ * An offer, made by a user of one realm, to grant a user or group of another
+ * realm access to a resource. The invitation is listed by both realms. The
+ * invitee is identified as the inviter specified it - by exactly one of
+ * InviteeUserId, InviteeEmail and InviteeGroupName - and is looked up only when
+ * the invitation is accepted, so that making an invitation does not reveal
+ * whether the other realm has such a user or group; InviteePartyId is "" until
+ * then. When an administrator of the invitee's realm accepts it, the invited
+ * access modes are
+ * granted to the invitee; AddedMask records those that the invitee did not
+ * already have. Either realm may then revoke the invitation, which removes the
+ * modes in AddedMask - and so leaves alone access that was granted otherwise,
+ * including by other invitations.
+ */
+type InMemInvitation struct {
+	InMemPersistObj
+	ResourceId string
+	InvitingRealmId string
+	InviterId string  // the user who made the invitation
+	InviteeRealmId string
+	InviteePartyId string
+	PermissionMask []bool
+	Status string
+	ACLEntryId string  // "" unless accepted
+	CreationTime time.Time
+	AddedMask []bool  // the modes that accepting the invitation granted
+	InviteeUserId string
+	InviteeEmail string
+	InviteeGroupName string
+}
+
+const (
+	InvitationPending = "pending"
+	InvitationAccepted = "accepted"
+	InvitationRejected = "rejected"
+	InvitationRevoked = "revoked"
+)
+
+var _ Invitation = &InMemInvitation{}
+
+func (client *InMemClient) NewInMemInvitation(resourceId, invitingRealmId, inviterId,
+	inviteeRealmId, inviteeUserId, inviteeEmail, inviteeGroupName string,
+	mask []bool) (*InMemInvitation, error) {
+	
+	var pers *InMemPersistObj
+	var err error
+	pers, err = client.NewInMemPersistObj()
+	if err != nil { return nil, err }
+	var newInvitation = &InMemInvitation{
+		InMemPersistObj: *pers,
+		ResourceId: resourceId,
+		InvitingRealmId: invitingRealmId,
+		InviterId: inviterId,
+		InviteeRealmId: inviteeRealmId,
+		InviteePartyId: "",
+		PermissionMask: mask,
+		Status: InvitationPending,
+		ACLEntryId: "",
+		CreationTime: time.Now(),
+		AddedMask: []bool{},
+		InviteeUserId: inviteeUserId,
+		InviteeEmail: inviteeEmail,
+		InviteeGroupName: inviteeGroupName,
+	}
+	return newInvitation, client.updateObject(newInvitation)
+}
+
+/*******************************************************************************
+ * Create a pending invitation to a user or group of the invitee realm, and add
+ * it to the invitations of both realms. Exactly one of the invitee's user Id,
+ * email address and group name must be specified.
+ */
+func (client *InMemClient) dbCreateInvitation(resourceId, inviterId, inviteeRealmId,
+	inviteeUserId, inviteeEmail, inviteeGroupName string, mask []bool) (Invitation, error) {
+	
+	var err = checkInviteeIdentified(inviteeUserId, inviteeEmail, inviteeGroupName)
+	if err != nil { return nil, err }
+	var resource Resource
+	resource, err = client.getResource(resourceId)
+	if err != nil { return nil, err }
+	var lineage []Resource
+	lineage, err = getResourceLineage(client, resource)
+	if err != nil { return nil, err }
+	var invitingRealm, isRealm = lineage[len(lineage)-1].(Realm)
+	if ! isRealm { return nil, utilities.ConstructServerError(
+		"Internal error: resource " + resourceId + " does not belong to a realm") }
+	var inviteeRealm Realm
+	inviteeRealm, err = client.getRealm(inviteeRealmId)
+	if err != nil { return nil, err }
+	if inviteeRealm.getId() == invitingRealm.getId() { return nil, utilities.ConstructUserError(
+		"The invitee belongs to the same realm as the resource; set a permission instead") }
+	
+	var newInvitation *InMemInvitation
+	newInvitation, err = client.NewInMemInvitation(resourceId, invitingRealm.getId(), inviterId,
+		inviteeRealm.getId(), inviteeUserId, inviteeEmail, inviteeGroupName, mask)
+	if err != nil { return nil, err }
+	err = invitingRealm.addInvitation(client, newInvitation)
+	if err != nil { return nil, err }
+	err = inviteeRealm.addInvitation(client, newInvitation)
+	if err != nil { return nil, err }
+	return newInvitation, nil
+}
+
+func (client *InMemClient) getInvitation(id string) (Invitation, error) {
+	var invitation Invitation
+	var isType bool
+	var obj PersistObj
+	var err error
+	obj, err = client.getPersistentObject(id)
+	if err != nil { return nil, err }
+	if obj == nil { return nil, utilities.ConstructUserError("Invitation not found") }
+	invitation, isType = obj.(Invitation)
+	if ! isType { return nil, utilities.ConstructUserError("Object with Id " + id + " is not an Invitation") }
+	return invitation, nil
+}
+
+func (invitation *InMemInvitation) getResourceId() string {
+	return invitation.ResourceId
+}
+
+func (invitation *InMemInvitation) getInvitingRealmId() string {
+	return invitation.InvitingRealmId
+}
+
+func (invitation *InMemInvitation) getInviteeRealmId() string {
+	return invitation.InviteeRealmId
+}
+
+func (invitation *InMemInvitation) getInviteePartyId() string {
+	return invitation.InviteePartyId
+}
+
+func (invitation *InMemInvitation) getStatus() string {
+	return invitation.Status
+}
+
+/*******************************************************************************
+ * Identify the invitee, and grant it the invited access modes. If the invitee
+ * does not exist, the invitation remains pending. If the invitee has no entry for
+ * the resource, one is created, and marked as cross-realm with the invitation's
+ * Id; otherwise the modes are merged into the existing entry, whose marking,
+ * denials and role are left alone - so a mode that the entry denies is not
+ * granted. Either way, the modes that accepting the invitation granted are
+ * recorded, so that revoking the invitation removes only those.
+ */
+func (invitation *InMemInvitation) accept(dbClient DBClient) (ACLEntry, error) {
+	
+	if invitation.Status != InvitationPending { return nil, utilities.ConstructUserError(
+		"Invitation is " + invitation.Status + ", not " + InvitationPending) }
+	var resource Resource
+	var err error
+	resource, err = dbClient.getResource(invitation.ResourceId)
+	if err != nil { return nil, err }
+	var inviteeRealm Realm
+	inviteeRealm, err = dbClient.getRealm(invitation.InviteeRealmId)
+	if err != nil { return nil, err }
+	var party Party
+	party, err = findInvitee(dbClient, inviteeRealm, invitation.InviteeUserId,
+		invitation.InviteeEmail, invitation.InviteeGroupName)
+	if err != nil { return nil, err }
+	var entry ACLEntry
+	entry, err = party.getACLEntryForResourceId(dbClient, resource.getId())
+	if err != nil { return nil, err }
+	var addedMask = append([]bool{}, invitation.PermissionMask...)
+	if entry == nil {
+		entry, err = dbClient.addAccess(resource, party, append([]bool{}, invitation.PermissionMask...))
+		if err != nil { return nil, err }
+		err = entry.setInvitationId(dbClient, invitation.getId())
+		if err != nil { return nil, err }
+	} else {
+		var priorMask = entry.getPermissionMask()
+		var denyMask = entry.getDenyMask()
+		for i, _ := range addedMask {
+			addedMask[i] = addedMask[i] && ! ((i < len(priorMask)) && priorMask[i]) &&
+				! ((i < len(denyMask)) && denyMask[i])
+		}
+		err = entry.addPermissionModes(dbClient, addedMask)
+		if err != nil { return nil, err }
+	}
+	err = queuePermissionChangeWebhookEvent(dbClient, "add", resource, party, entry)
+	if err != nil { return nil, err }
+	invitation.AddedMask = addedMask
+	invitation.InviteePartyId = party.getId()
+	invitation.ACLEntryId = entry.getId()
+	invitation.Status = InvitationAccepted
+	return entry, dbClient.writeBack(invitation)
+}
+
+func (invitation *InMemInvitation) reject(dbClient DBClient) error {
+	
+	if invitation.Status != InvitationPending { return utilities.ConstructUserError(
+		"Invitation is " + invitation.Status + ", not " + InvitationPending) }
+	invitation.Status = InvitationRejected
+	return dbClient.writeBack(invitation)
+}
+
+/*******************************************************************************
+ * Withdraw a pending invitation, or remove the access granted by an accepted
+ * one: the modes that accepting it added are removed from the ACL entry, and the
+ * entry is deleted if it then neither grants nor denies anything. If the entry
+ * has since been deleted, there is nothing to remove.
+ */
+func (invitation *InMemInvitation) revoke(dbClient DBClient) error {
+	
+	if (invitation.Status != InvitationPending) && (invitation.Status != InvitationAccepted) {
+		return utilities.ConstructUserError("Invitation is " + invitation.Status +
+			", and so cannot be revoked")
+	}
+	if invitation.Status == InvitationAccepted {
+		var entry ACLEntry
+		var err error
+		entry, err = dbClient.getACLEntry(invitation.ACLEntryId)
+		if err == nil {
+			var mask = clearModes(entry.getPermissionMask(), invitation.AddedMask)
+			var remaining = false
+			for i, _ := range mask {
+				remaining = remaining || mask[i] || entry.getDenyMask()[i]
+			}
+			if remaining {
+				err = entry.remPermissionModes(dbClient, invitation.AddedMask)
+				if err != nil { return err }
+			} else {
+				var resource Resource
+				resource, err = dbClient.getResource(invitation.ResourceId)
+				if err != nil { return err }
+				var party Party
+				party, err = dbClient.getParty(invitation.InviteePartyId)
+				if err != nil { return err }
+				err = dbClient.deleteAccess(resource, party)
+				if err != nil { return err }
+			}
+		}
+	}
+	invitation.Status = InvitationRevoked
+	return dbClient.writeBack(invitation)
+}
+
+func (invitation *InMemInvitation) asInvitationDesc() *apitypes.InvitationDesc {
+	return apitypes.NewInvitationDesc(invitation.Id, invitation.ResourceId,
+		invitation.InvitingRealmId, invitation.InviterId, invitation.InviteeRealmId,
+		invitation.InviteePartyId, invitation.InviteeUserId, invitation.InviteeEmail,
+		invitation.InviteeGroupName, invitation.PermissionMask, invitation.Status,
+		invitation.ACLEntryId, invitation.CreationTime)
+}
+
+func (invitation *InMemInvitation) writeBack(dbClient DBClient) error {
+	return dbClient.updateObject(invitation)
+}
+
+func (invitation *InMemInvitation) asJSON() string {
+	var json = "\"Invitation\": {"
+	json = json + invitation.persistObjFieldsAsJSON()
+	json = json + fmt.Sprintf(
+		", \"ResourceId\": \"%s\", \"InvitingRealmId\": \"%s\", \"InviterId\": \"%s\", " +
+		"\"InviteeRealmId\": \"%s\", \"InviteePartyId\": \"%s\", \"PermissionMask\": [",
+		invitation.ResourceId, invitation.InvitingRealmId, invitation.InviterId,
+		invitation.InviteeRealmId, invitation.InviteePartyId)
+	for i, b := range invitation.PermissionMask {
+		if i != 0 { json = json + ", " }
+		json = json + apitypes.BoolToString(b)
+	}
+	json = json + fmt.Sprintf("], \"Status\": \"%s\", \"ACLEntryId\": \"%s\", \"CreationTime\": time %s, " +
+		"\"AddedMask\": [",
+		invitation.Status, invitation.ACLEntryId,
+		apitypes.FormatTimeAsJavascriptDate(invitation.CreationTime))
+	for i, b := range invitation.AddedMask {
+		if i != 0 { json = json + ", " }
+		json = json + apitypes.BoolToString(b)
+	}
+	json = json + fmt.Sprintf("], \"InviteeUserId\": \"%s\", \"InviteeEmail\": \"%s\", " +
+		"\"InviteeGroupName\": \"%s\"}",
+		invitation.InviteeUserId, invitation.InviteeEmail, invitation.InviteeGroupName)
+	return json
+}
+
+func (client *InMemClient) ReconstituteInvitation(id, resourceId, invitingRealmId, inviterId,
+	inviteeRealmId, inviteePartyId string, mask []bool, status, aclEntryId string,
+	creationTime time.Time, addedMask []bool, inviteeUserId, inviteeEmail,
+	inviteeGroupName string) (*InMemInvitation, error) {
+
+	var persistObj *InMemPersistObj
+	var err error
+	persistObj, err = client.ReconstitutePersistObj(id)
+	if err != nil { return nil, err }
+
+	return &InMemInvitation{
+		InMemPersistObj: *persistObj,
+		ResourceId: resourceId,
+		InvitingRealmId: invitingRealmId,
+		InviterId: inviterId,
+		InviteeRealmId: inviteeRealmId,
+		InviteePartyId: inviteePartyId,
+		PermissionMask: mask,
+		Status: status,
+		ACLEntryId: aclEntryId,
+		CreationTime: creationTime,
+		AddedMask: addedMask,
+		InviteeUserId: inviteeUserId,
+		InviteeEmail: inviteeEmail,
+		InviteeGroupName: inviteeGroupName,
+	}, nil
+}
+
+/*******************************************************************************
+ * A message in the email outbox of a realm, waiting to be sent by the outbox
+ * worker (see EmailOutbox.go). A message is deleted once it has been sent.
+ */
+type InMemOutboundEmail struct {
+	InMemPersistObj
+	RealmId string
+	Address string
+	Subject string
+	TextMessage string
+	HTMLMessage string
+	Status string
+	Attempts int
+	NextAttemptTime time.Time  // while sending, when the worker's claim lapses
+	LastError string
+	CreationTime time.Time
+}
+
+const (
+	OutboundEmailPending = "pending"
+	OutboundEmailSending = "sending"
+	OutboundEmailFailed = "failed"  // no further attempts are made
+)
+
+var _ OutboundEmail = &InMemOutboundEmail{}
+
+func (client *InMemClient) NewInMemOutboundEmail(realmId, address, subject, textMessage,
+	htmlMessage string) (*InMemOutboundEmail, error) {
+	
+	var pers *InMemPersistObj
+	var err error
+	pers, err = client.NewInMemPersistObj()
+	if err != nil { return nil, err }
+	var now = time.Now()
+	var newEmail = &InMemOutboundEmail{
+		InMemPersistObj: *pers,
+		RealmId: realmId,
+		Address: address,
+		Subject: subject,
+		TextMessage: textMessage,
+		HTMLMessage: htmlMessage,
+		Status: OutboundEmailPending,
+		Attempts: 0,
+		NextAttemptTime: now,
+		LastError: "",
+		CreationTime: now,
+	}
+	return newEmail, client.updateObject(newEmail)
+}
+
+/*******************************************************************************
+ * Add a message to the outbox of the realm. The message is sent only if the
+ * transaction commits. The outbox is stored under a key of its own (see
+ * Persistence.getOutboundEmailIds), so that queueing a message does not write
+ * the realm.
+ */
+func (client *InMemClient) dbCreateOutboundEmail(realmId, address, subject, textMessage,
+	htmlMessage string) (OutboundEmail, error) {
+	
+	var err error
+	_, err = client.getRealm(realmId)
+	if err != nil { return nil, err }
+	var newEmail *InMemOutboundEmail
+	newEmail, err = client.NewInMemOutboundEmail(realmId, address, subject, textMessage, htmlMessage)
+	if err != nil { return nil, err }
+	err = client.Persistence.queueAddOutboundEmailId(client.txn, realmId, newEmail.getId())
+	if err != nil { return nil, err }
+	return newEmail, nil
+}
+
+/*******************************************************************************
+ * Remove the message from the outbox of its realm, and delete it.
+ */
+func (client *InMemClient) dbDeleteOutboundEmail(email OutboundEmail) error {
+	
+	var err = client.Persistence.queueRemOutboundEmailId(client.txn, email.getRealmId(),
+		email.getId())
+	if err != nil { return err }
+	return client.deleteObject(email)
+}
+
+/*******************************************************************************
+ * Return the Ids of the messages in the realm's outbox, in the order in which
+ * they were queued, as of the last commit.
+ */
+func (client *InMemClient) getOutboundEmailIds(realmId string) ([]string, error) {
+	return client.Persistence.getOutboundEmailIds(realmId)
+}
+
+func (client *InMemClient) getOutboundEmail(id string) (OutboundEmail, error) {
+	var email OutboundEmail
+	var isType bool
+	var obj PersistObj
+	var err error
+	obj, err = client.getPersistentObject(id)
+	if err != nil { return nil, err }
+	if obj == nil { return nil, utilities.ConstructUserError("Outbound email not found") }
+	email, isType = obj.(OutboundEmail)
+	if ! isType { return nil, utilities.ConstructUserError("Object with Id " + id + " is not an OutboundEmail") }
+	return email, nil
+}
+
+func (email *InMemOutboundEmail) getRealmId() string {
+	return email.RealmId
+}
+
+func (email *InMemOutboundEmail) getAddress() string {
+	return email.Address
+}
+
+func (email *InMemOutboundEmail) getSubject() string {
+	return email.Subject
+}
+
+func (email *InMemOutboundEmail) getTextMessage() string {
+	return email.TextMessage
+}
+
+func (email *InMemOutboundEmail) getHTMLMessage() string {
+	return email.HTMLMessage
+}
+
+func (email *InMemOutboundEmail) getStatus() string {
+	return email.Status
+}
+
+func (email *InMemOutboundEmail) getAttempts() int {
+	return email.Attempts
+}
+
+func (email *InMemOutboundEmail) isDue(now time.Time) bool {
+	return (email.Status != OutboundEmailFailed) && (! now.Before(email.NextAttemptTime))
+}
+
+/*******************************************************************************
+ * Record that a worker is about to attempt to send the message. If the worker
+ * has not recorded the outcome by claimExpires, the message is due again.
+ */
+func (email *InMemOutboundEmail) claim(dbClient DBClient, claimExpires time.Time) error {
+	email.Status = OutboundEmailSending
+	email.Attempts++
+	email.NextAttemptTime = claimExpires
+	return dbClient.writeBack(email)
+}
+
+/*******************************************************************************
+ * Record that an attempt to send the message failed. If nextAttemptTime is zero,
+ * no further attempt is made.
+ */
+func (email *InMemOutboundEmail) recordFailure(dbClient DBClient, errMsg string,
+	nextAttemptTime time.Time) error {
+	email.LastError = errMsg
+	if nextAttemptTime.IsZero() {
+		email.Status = OutboundEmailFailed
+	} else {
+		email.Status = OutboundEmailPending
+		email.NextAttemptTime = nextAttemptTime
+	}
+	return dbClient.writeBack(email)
+}
+
+/*******************************************************************************
+ * Make a failed message due immediately, with a fresh set of attempts.
+ */
+func (email *InMemOutboundEmail) retry(dbClient DBClient) error {
+	email.Status = OutboundEmailPending
+	email.Attempts = 0
+	email.NextAttemptTime = time.Now()
+	return dbClient.writeBack(email)
+}
+
+func (email *InMemOutboundEmail) asOutboundEmailDesc() *apitypes.OutboundEmailDesc {
+	return apitypes.NewOutboundEmailDesc(email.Id, email.RealmId, email.Address,
+		email.Subject, email.Status, email.Attempts, email.NextAttemptTime,
+		email.LastError, email.CreationTime)
+}
+
+func (email *InMemOutboundEmail) writeBack(dbClient DBClient) error {
+	return dbClient.updateObject(email)
+}
+
+func (email *InMemOutboundEmail) asJSON() string {
+	var json = "\"OutboundEmail\": {"
+	json = json + email.persistObjFieldsAsJSON()
+	json = json + fmt.Sprintf(
+		", \"RealmId\": \"%s\", \"Address\": \"%s\", \"Subject\": \"%s\", " +
+		"\"TextMessage\": \"%s\", \"HTMLMessage\": \"%s\", \"Status\": \"%s\", " +
+		"\"Attempts\": %d, \"NextAttemptTime\": time %s, \"LastError\": \"%s\", " +
+		"\"CreationTime\": time %s}",
+		email.RealmId, rest.EncodeStringForJSON(email.Address),
+		rest.EncodeStringForJSON(email.Subject), rest.EncodeStringForJSON(email.TextMessage),
+		rest.EncodeStringForJSON(email.HTMLMessage), email.Status, email.Attempts,
+		apitypes.FormatTimeAsJavascriptDate(email.NextAttemptTime),
+		rest.EncodeStringForJSON(email.LastError),
+		apitypes.FormatTimeAsJavascriptDate(email.CreationTime))
+	return json
+}
+
+func (client *InMemClient) ReconstituteOutboundEmail(id, realmId, address, subject,
+	textMessage, htmlMessage, status string, attempts int, nextAttemptTime time.Time,
+	lastError string, creationTime time.Time) (*InMemOutboundEmail, error) {
+
+	var persistObj *InMemPersistObj
+	var err error
+	persistObj, err = client.ReconstitutePersistObj(id)
+	if err != nil { return nil, err }
+
+	return &InMemOutboundEmail{
+		InMemPersistObj: *persistObj,
+		RealmId: realmId,
+		Address: address,
+		Subject: subject,
+		TextMessage: textMessage,
+		HTMLMessage: htmlMessage,
+		Status: status,
+		Attempts: attempts,
+		NextAttemptTime: nextAttemptTime,
+		LastError: lastError,
+		CreationTime: creationTime,
+	}, nil
+}
+
+/*******************************************************************************
+ * A user's request to be notified of events of the specified types that concern
+ * a realm, a repo, or an image (see Notifications.go). Each subscription is
+ * listed both by its user and by the realm of the resource, so that an event
+ * can be matched against the subscriptions of its realm only.
+ */
+type InMemNotificationSubscription struct {
+	InMemPersistObj
+	UserObjId string
+	RealmId string  // of the resource
+	ResourceId string
+	EventTypes []string
+	CreationTime time.Time
+}
+
+var _ NotificationSubscription = &InMemNotificationSubscription{}
+
+func (client *InMemClient) NewInMemNotificationSubscription(userObjId, realmId, resourceId string,
+	eventTypes []string) (*InMemNotificationSubscription, error) {
+	
+	var pers *InMemPersistObj
+	var err error
+	pers, err = client.NewInMemPersistObj()
+	if err != nil { return nil, err }
+	var newSubscription = &InMemNotificationSubscription{
+		InMemPersistObj: *pers,
+		UserObjId: userObjId,
+		RealmId: realmId,
+		ResourceId: resourceId,
+		EventTypes: eventTypes,
+		CreationTime: time.Now(),
+	}
+	return newSubscription, client.updateObject(newSubscription)
+}
+
+func (client *InMemClient) dbCreateNotificationSubscription(userObjId, realmId, resourceId string,
+	eventTypes []string) (NotificationSubscription, error) {
+	
+	var user User
+	var err error
+	user, err = client.getUser(userObjId)
+	if err != nil { return nil, err }
+	var realm Realm
+	realm, err = client.getRealm(realmId)
+	if err != nil { return nil, err }
+	var newSubscription *InMemNotificationSubscription
+	newSubscription, err = client.NewInMemNotificationSubscription(userObjId, realmId,
+		resourceId, eventTypes)
+	if err != nil { return nil, err }
+	err = user.addNotificationSubscription(client, newSubscription)
+	if err != nil { return nil, err }
+	err = realm.addNotificationSubscription(client, newSubscription)
+	if err != nil { return nil, err }
+	return newSubscription, nil
+}
+
+/*******************************************************************************
+ * Remove the subscription from the lists of its user and its realm, and delete
+ * it. The user or the realm may already have been deleted.
+ */
+func (client *InMemClient) dbDeleteNotificationSubscription(subscription NotificationSubscription) error {
+	
+	var user User
+	var err error
+	user, err = client.getUser(subscription.getUserObjId())
+	if err == nil {
+		err = user.removeNotificationSubscription(client, subscription)
+		if err != nil { return err }
+	}
+	var realm Realm
+	realm, err = client.getRealm(subscription.getRealmId())
+	if err == nil {
+		err = realm.removeNotificationSubscription(client, subscription)
+		if err != nil { return err }
+	}
+	return client.deleteObject(subscription)
+}
+
+func (client *InMemClient) getNotificationSubscription(id string) (NotificationSubscription, error) {
+	var subscription NotificationSubscription
+	var isType bool
+	var obj PersistObj
+	var err error
+	obj, err = client.getPersistentObject(id)
+	if err != nil { return nil, err }
+	if obj == nil { return nil, utilities.ConstructUserError("Notification subscription not found") }
+	subscription, isType = obj.(NotificationSubscription)
+	if ! isType { return nil, utilities.ConstructUserError(
+		"Object with Id " + id + " is not a NotificationSubscription") }
+	return subscription, nil
+}
+
+func (subscription *InMemNotificationSubscription) getUserObjId() string {
+	return subscription.UserObjId
+}
+
+func (subscription *InMemNotificationSubscription) getRealmId() string {
+	return subscription.RealmId
+}
+
+func (subscription *InMemNotificationSubscription) getResourceId() string {
+	return subscription.ResourceId
+}
+
+func (subscription *InMemNotificationSubscription) getEventTypes() []string {
+	return subscription.EventTypes
+}
+
+func (subscription *InMemNotificationSubscription) setEventTypes(dbClient DBClient,
+	eventTypes []string) error {
+	subscription.EventTypes = eventTypes
+	return dbClient.writeBack(subscription)
+}
+
+func (subscription *InMemNotificationSubscription) includesEventType(eventType string) bool {
+	for _, t := range subscription.EventTypes {
+		if t == eventType { return true }
+	}
+	return false
+}
+
+func (subscription *InMemNotificationSubscription) asNotificationSubscriptionDesc() *apitypes.NotificationSubscriptionDesc {
+	return apitypes.NewNotificationSubscriptionDesc(subscription.Id, subscription.UserObjId,
+		subscription.ResourceId, subscription.EventTypes, subscription.CreationTime)
+}
+
+func (subscription *InMemNotificationSubscription) writeBack(dbClient DBClient) error {
+	return dbClient.updateObject(subscription)
+}
+
+func (subscription *InMemNotificationSubscription) asJSON() string {
+	var json = "\"NotificationSubscription\": {"
+	json = json + subscription.persistObjFieldsAsJSON()
+	json = json + fmt.Sprintf(
+		", \"UserObjId\": \"%s\", \"RealmId\": \"%s\", \"ResourceId\": \"%s\", \"EventTypes\": [",
+		subscription.UserObjId, subscription.RealmId, subscription.ResourceId)
+	for i, t := range subscription.EventTypes {
+		if i != 0 { json = json + ", " }
+		json = json + "\"" + t + "\""
+	}
+	json = json + fmt.Sprintf("], \"CreationTime\": time %s}",
+		apitypes.FormatTimeAsJavascriptDate(subscription.CreationTime))
+	return json
+}
+
+func (client *InMemClient) ReconstituteNotificationSubscription(id, userObjId, realmId,
+	resourceId string, eventTypes []string,
+	creationTime time.Time) (*InMemNotificationSubscription, error) {
+	
+	var persistObj *InMemPersistObj
+	var err error
+	persistObj, err = client.ReconstitutePersistObj(id)
+	if err != nil { return nil, err }
+	
+	return &InMemNotificationSubscription{
+		InMemPersistObj: *persistObj,
+		UserObjId: userObjId,
+		RealmId: realmId,
+		ResourceId: resourceId,
+		EventTypes: eventTypes,
+		CreationTime: creationTime,
+	}, nil
+}
+
+/*******************************************************************************
+ * A notification of an event, for one user. A notification is retained while it
+ * is in the user's in-app list or is waiting to be emailed (see Notifications.go).
+ */
+type InMemNotification struct {
+	InMemPersistObj
+	UserObjId string
+	EventType string
+	ResourceId string  // the image, or, if there is none, the Dockerfile
+	Subject string
+	Message string
+	IsRead bool
+	CreationTime time.Time
+}
+
+var _ Notification = &InMemNotification{}
+
+func (client *InMemClient) NewInMemNotification(userObjId, eventType, resourceId, subject,
+	message string, creationTime time.Time) (*InMemNotification, error) {
+	
+	var pers *InMemPersistObj
+	var err error
+	pers, err = client.NewInMemPersistObj()
+	if err != nil { return nil, err }
+	var newNotification = &InMemNotification{
+		InMemPersistObj: *pers,
+		UserObjId: userObjId,
+		EventType: eventType,
+		ResourceId: resourceId,
+		Subject: subject,
+		Message: message,
+		IsRead: false,
+		CreationTime: creationTime,
+	}
+	return newNotification, client.updateObject(newNotification)
+}
+
+/*******************************************************************************
+ * Create a notification. The caller adds it to the user's in-app list, or to
+ * the user's pending email, or both.
+ */
+func (client *InMemClient) dbCreateNotification(userObjId, eventType, resourceId, subject,
+	message string, creationTime time.Time) (Notification, error) {
+	
+	return client.NewInMemNotification(userObjId, eventType, resourceId, subject, message,
+		creationTime)
+}
+
+func (client *InMemClient) getNotification(id string) (Notification, error) {
+	var notification Notification
+	var isType bool
+	var obj PersistObj
+	var err error
+	obj, err = client.getPersistentObject(id)
+	if err != nil { return nil, err }
+	if obj == nil { return nil, utilities.ConstructUserError("Notification not found") }
+	notification, isType = obj.(Notification)
+	if ! isType { return nil, utilities.ConstructUserError("Object with Id " + id + " is not a Notification") }
+	return notification, nil
+}
+
+func (notification *InMemNotification) getUserObjId() string {
+	return notification.UserObjId
+}
+
+func (notification *InMemNotification) getEventType() string {
+	return notification.EventType
+}
+
+func (notification *InMemNotification) getResourceId() string {
+	return notification.ResourceId
+}
+
+func (notification *InMemNotification) getSubject() string {
+	return notification.Subject
+}
+
+func (notification *InMemNotification) getMessage() string {
+	return notification.Message
+}
+
+func (notification *InMemNotification) isRead() bool {
+	return notification.IsRead
+}
+
+func (notification *InMemNotification) markRead(dbClient DBClient) error {
+	notification.IsRead = true
+	return dbClient.writeBack(notification)
+}
+
+func (notification *InMemNotification) getCreationTime() time.Time {
+	return notification.CreationTime
+}
+
+func (notification *InMemNotification) asNotificationDesc() *apitypes.NotificationDesc {
+	return apitypes.NewNotificationDesc(notification.Id, notification.EventType,
+		notification.ResourceId, notification.Subject, notification.Message,
+		notification.IsRead, notification.CreationTime)
+}
+
+func (notification *InMemNotification) writeBack(dbClient DBClient) error {
+	return dbClient.updateObject(notification)
+}
+
+func (notification *InMemNotification) asJSON() string {
+	var json = "\"Notification\": {"
+	json = json + notification.persistObjFieldsAsJSON()
+	json = json + fmt.Sprintf(
+		", \"UserObjId\": \"%s\", \"EventType\": \"%s\", \"ResourceId\": \"%s\", " +
+		"\"Subject\": \"%s\", \"Message\": \"%s\", \"IsRead\": %s, \"CreationTime\": time %s}",
+		notification.UserObjId, notification.EventType, notification.ResourceId,
+		rest.EncodeStringForJSON(notification.Subject), rest.EncodeStringForJSON(notification.Message),
+		apitypes.BoolToString(notification.IsRead),
+		apitypes.FormatTimeAsJavascriptDate(notification.CreationTime))
+	return json
+}
+
+func (client *InMemClient) ReconstituteNotification(id, userObjId, eventType, resourceId,
+	subject, message string, isRead bool, creationTime time.Time) (*InMemNotification, error) {
+	
+	var persistObj *InMemPersistObj
+	var err error
+	persistObj, err = client.ReconstitutePersistObj(id)
+	if err != nil { return nil, err }
+	
+	return &InMemNotification{
+		InMemPersistObj: *persistObj,
+		UserObjId: userObjId,
+		EventType: eventType,
+		ResourceId: resourceId,
+		Subject: subject,
+		Message: message,
+		IsRead: isRead,
+		CreationTime: creationTime,
+	}, nil
+}
+
+/*******************************************************************************
+ * A registration of a URL to which events that concern a realm or a repo are
+ * posted (see Webhooks.go). The Secret is used to sign each payload. The Ids of
+ * the hook's most recent deliveries are retained, oldest first, as its delivery
+ * log.
+ */
+type InMemWebhook struct {
+	InMemPersistObj
+	RealmId string
+	ResourceId string  // the realm, or one of its repos
+	URL string
+	Secret string
+	EventTypes []string
+	CreatorId string  // the user who registered the hook
+	CreationTime time.Time
+	DeliveryIds []string
+}
+
+var _ Webhook = &InMemWebhook{}
+
+func (client *InMemClient) NewInMemWebhook(realmId, resourceId, url, secret string,
+	eventTypes []string, creatorId string) (*InMemWebhook, error) {
+	
+	var pers *InMemPersistObj
+	var err error
+	pers, err = client.NewInMemPersistObj()
+	if err != nil { return nil, err }
+	var newWebhook = &InMemWebhook{
+		InMemPersistObj: *pers,
+		RealmId: realmId,
+		ResourceId: resourceId,
+		URL: url,
+		Secret: secret,
+		EventTypes: eventTypes,
+		CreatorId: creatorId,
+		CreationTime: time.Now(),
+		DeliveryIds: make([]string, 0),
+	}
+	return newWebhook, client.updateObject(newWebhook)
+}
+
+func (client *InMemClient) dbCreateWebhook(realmId, resourceId, url, secret string,
+	eventTypes []string, creatorId string) (Webhook, error) {
+	
+	var realm Realm
+	var err error
+	realm, err = client.getRealm(realmId)
+	if err != nil { return nil, err }
+	var newWebhook *InMemWebhook
+	newWebhook, err = client.NewInMemWebhook(realmId, resourceId, url, secret, eventTypes, creatorId)
+	if err != nil { return nil, err }
+	err = realm.addWebhook(client, newWebhook)
+	if err != nil { return nil, err }
+	return newWebhook, nil
+}
+
+/*******************************************************************************
+ * Remove the hook from its realm, and delete it and its deliveries, including
+ * those not yet made.
+ */
+func (client *InMemClient) dbDeleteWebhook(webhook Webhook) error {
+	
+	var realm Realm
+	var err error
+	realm, err = client.getRealm(webhook.getRealmId())
+	if err != nil { return err }
+	for _, deliveryId := range webhook.getDeliveryIds() {
+		var delivery WebhookDelivery
+		delivery, err = client.getWebhookDelivery(deliveryId)
+		if err != nil { continue }  // dangling Id
+		err = realm.removePendingWebhookDelivery(client, delivery)
+		if err != nil { return err }
+		err = client.deleteObject(delivery)
+		if err != nil { return err }
+	}
+	err = realm.removeWebhook(client, webhook)
+	if err != nil { return err }
+	return client.deleteObject(webhook)
+}
+
+func (client *InMemClient) getWebhook(id string) (Webhook, error) {
+	var webhook Webhook
+	var isType bool
+	var obj PersistObj
+	var err error
+	obj, err = client.getPersistentObject(id)
+	if err != nil { return nil, err }
+	if obj == nil { return nil, utilities.ConstructUserError("Webhook not found") }
+	webhook, isType = obj.(Webhook)
+	if ! isType { return nil, utilities.ConstructUserError("Object with Id " + id + " is not a Webhook") }
+	return webhook, nil
+}
+
+func (webhook *InMemWebhook) getRealmId() string {
+	return webhook.RealmId
+}
+
+func (webhook *InMemWebhook) getResourceId() string {
+	return webhook.ResourceId
+}
+
+func (webhook *InMemWebhook) getURL() string {
+	return webhook.URL
+}
+
+func (webhook *InMemWebhook) getSecret() string {
+	return webhook.Secret
+}
+
+func (webhook *InMemWebhook) getEventTypes() []string {
+	return webhook.EventTypes
+}
+
+func (webhook *InMemWebhook) getDeliveryIds() []string {
+	return webhook.DeliveryIds
+}
+
+func (webhook *InMemWebhook) addDelivery(dbClient DBClient, delivery WebhookDelivery) error {
+	webhook.DeliveryIds = append(webhook.DeliveryIds, delivery.getId())
+	return dbClient.writeBack(webhook)
+}
+
+func (webhook *InMemWebhook) removeDeliveryId(dbClient DBClient, id string) error {
+	webhook.DeliveryIds = utilities.RemoveFrom(id, webhook.DeliveryIds)
+	return dbClient.writeBack(webhook)
+}
+
+/*******************************************************************************
+ * The Secret is omitted unless includeSecret is true: it is shown only when the
+ * hook is registered.
+ */
+func (webhook *InMemWebhook) asWebhookDesc(includeSecret bool) *apitypes.WebhookDesc {
+	var secret = ""
+	if includeSecret { secret = webhook.Secret }
+	return apitypes.NewWebhookDesc(webhook.Id, webhook.RealmId, webhook.ResourceId,
+		webhook.URL, secret, webhook.EventTypes, webhook.CreatorId, webhook.CreationTime)
+}
+
+func (webhook *InMemWebhook) writeBack(dbClient DBClient) error {
+	return dbClient.updateObject(webhook)
+}
+
+func (webhook *InMemWebhook) asJSON() string {
+	var json = "\"Webhook\": {"
+	json = json + webhook.persistObjFieldsAsJSON()
+	json = json + fmt.Sprintf(
+		", \"RealmId\": \"%s\", \"ResourceId\": \"%s\", \"URL\": \"%s\", \"Secret\": \"%s\", " +
+		"\"EventTypes\": [",
+		webhook.RealmId, webhook.ResourceId, rest.EncodeStringForJSON(webhook.URL),
+		rest.EncodeStringForJSON(webhook.Secret))
+	for i, t := range webhook.EventTypes {
+		if i != 0 { json = json + ", " }
+		json = json + "\"" + t + "\""
+	}
+	json = json + fmt.Sprintf("], \"CreatorId\": \"%s\", \"CreationTime\": time %s, \"DeliveryIds\": [",
+		webhook.CreatorId, apitypes.FormatTimeAsJavascriptDate(webhook.CreationTime))
+	for i, id := range webhook.DeliveryIds {
+		if i != 0 { json = json + ", " }
+		json = json + "\"" + id + "\""
+	}
+	json = json + "]}"
+	return json
+}
+
+func (client *InMemClient) ReconstituteWebhook(id, realmId, resourceId, url, secret string,
+	eventTypes []string, creatorId string, creationTime time.Time,
+	deliveryIds []string) (*InMemWebhook, error) {
+	
+	var persistObj *InMemPersistObj
+	var err error
+	persistObj, err = client.ReconstitutePersistObj(id)
+	if err != nil { return nil, err }
+	
+	return &InMemWebhook{
+		InMemPersistObj: *persistObj,
+		RealmId: realmId,
+		ResourceId: resourceId,
+		URL: url,
+		Secret: secret,
+		EventTypes: eventTypes,
+		CreatorId: creatorId,
+		CreationTime: creationTime,
+		DeliveryIds: deliveryIds,
+	}, nil
+}
+
+/*******************************************************************************
+ * One event, to be posted, or that has been posted, to a webhook. While it is
+ * due to be posted, a delivery is also in the pending list of its realm, from
+ * which the delivery worker takes it (see Webhooks.go).
+ */
+type InMemWebhookDelivery struct {
+	InMemPersistObj
+	WebhookId string
+	RealmId string
+	EventType string
+	Payload string  // JSON
+	Status string
+	Attempts int
+	NextAttemptTime time.Time  // while sending, when the worker's claim lapses
+	ResponseStatus int  // HTTP status of the last attempt; 0 if there was no response
+	LastError string
+	CreationTime time.Time
+	CompletionTime time.Time  // zero unless delivered or failed
+}
+
+const (
+	WebhookDeliveryPending = "pending"
+	WebhookDeliverySending = "sending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed = "failed"  // no further attempts are made
+)
+
+var _ WebhookDelivery = &InMemWebhookDelivery{}
+
+func (client *InMemClient) NewInMemWebhookDelivery(webhookId, realmId, eventType,
+	payload string) (*InMemWebhookDelivery, error) {
+	
+	var pers *InMemPersistObj
+	var err error
+	pers, err = client.NewInMemPersistObj()
+	if err != nil { return nil, err }
+	var now = time.Now()
+	var newDelivery = &InMemWebhookDelivery{
+		InMemPersistObj: *pers,
+		WebhookId: webhookId,
+		RealmId: realmId,
+		EventType: eventType,
+		Payload: payload,
+		Status: WebhookDeliveryPending,
+		Attempts: 0,
+		NextAttemptTime: now,
+		ResponseStatus: 0,
+		LastError: "",
+		CreationTime: now,
+		CompletionTime: time.Time{},
+	}
+	return newDelivery, client.updateObject(newDelivery)
+}
+
+/*******************************************************************************
+ * Add a delivery of the payload to the hook's log and to its realm's pending
+ * list. The delivery is made only if the transaction commits.
+ */
+func (client *InMemClient) dbCreateWebhookDelivery(webhook Webhook, eventType,
+	payload string) (WebhookDelivery, error) {
+	
+	var realm Realm
+	var err error
+	realm, err = client.getRealm(webhook.getRealmId())
+	if err != nil { return nil, err }
+	var newDelivery *InMemWebhookDelivery
+	newDelivery, err = client.NewInMemWebhookDelivery(webhook.getId(), webhook.getRealmId(),
+		eventType, payload)
+	if err != nil { return nil, err }
+	err = webhook.addDelivery(client, newDelivery)
+	if err != nil { return nil, err }
+	err = realm.addPendingWebhookDelivery(client, newDelivery)
+	if err != nil { return nil, err }
+	return newDelivery, nil
+}
+
+func (client *InMemClient) getWebhookDelivery(id string) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	var isType bool
+	var obj PersistObj
+	var err error
+	obj, err = client.getPersistentObject(id)
+	if err != nil { return nil, err }
+	if obj == nil { return nil, utilities.ConstructUserError("Webhook delivery not found") }
+	delivery, isType = obj.(WebhookDelivery)
+	if ! isType { return nil, utilities.ConstructUserError("Object with Id " + id + " is not a WebhookDelivery") }
+	return delivery, nil
+}
+
+func (delivery *InMemWebhookDelivery) getWebhookId() string {
+	return delivery.WebhookId
+}
+
+func (delivery *InMemWebhookDelivery) getRealmId() string {
+	return delivery.RealmId
+}
+
+func (delivery *InMemWebhookDelivery) getEventType() string {
+	return delivery.EventType
+}
+
+func (delivery *InMemWebhookDelivery) getPayload() string {
+	return delivery.Payload
+}
+
+func (delivery *InMemWebhookDelivery) getStatus() string {
+	return delivery.Status
+}
+
+func (delivery *InMemWebhookDelivery) getAttempts() int {
+	return delivery.Attempts
+}
+
+func (delivery *InMemWebhookDelivery) isDue(now time.Time) bool {
+	return ((delivery.Status == WebhookDeliveryPending) || (delivery.Status == WebhookDeliverySending)) &&
+		(! now.Before(delivery.NextAttemptTime))
+}
+
+/*******************************************************************************
+ * Record that a worker is about to post the delivery. If the worker has not
+ * recorded the outcome by claimExpires, the delivery is due again.
+ */
+func (delivery *InMemWebhookDelivery) claim(dbClient DBClient, claimExpires time.Time) error {
+	delivery.Status = WebhookDeliverySending
+	delivery.Attempts++
+	delivery.NextAttemptTime = claimExpires
+	return dbClient.writeBack(delivery)
+}
+
+func (delivery *InMemWebhookDelivery) recordSuccess(dbClient DBClient, responseStatus int,
+	now time.Time) error {
+	delivery.Status = WebhookDeliveryDelivered
+	delivery.ResponseStatus = responseStatus
+	delivery.LastError = ""
+	delivery.CompletionTime = now
+	return dbClient.writeBack(delivery)
+}
+
+/*******************************************************************************
+ * Record that an attempt to post the delivery failed. If nextAttemptTime is
+ * zero, no further attempt is made.
+ */
+func (delivery *InMemWebhookDelivery) recordFailure(dbClient DBClient, responseStatus int,
+	errMsg string, nextAttemptTime, now time.Time) error {
+	delivery.ResponseStatus = responseStatus
+	delivery.LastError = errMsg
+	if nextAttemptTime.IsZero() {
+		delivery.Status = WebhookDeliveryFailed
+		delivery.CompletionTime = now
+	} else {
+		delivery.Status = WebhookDeliveryPending
+		delivery.NextAttemptTime = nextAttemptTime
+	}
+	return dbClient.writeBack(delivery)
+}
+
+/*******************************************************************************
+ * Make the delivery due immediately, with a fresh set of attempts.
+ */
+func (delivery *InMemWebhookDelivery) redeliver(dbClient DBClient) error {
+	delivery.Status = WebhookDeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptTime = time.Now()
+	delivery.CompletionTime = time.Time{}
+	return dbClient.writeBack(delivery)
+}
+
+func (delivery *InMemWebhookDelivery) asWebhookDeliveryDesc() *apitypes.WebhookDeliveryDesc {
+	return apitypes.NewWebhookDeliveryDesc(delivery.Id, delivery.WebhookId, delivery.EventType,
+		delivery.Payload, delivery.Status, delivery.Attempts, delivery.NextAttemptTime,
+		delivery.ResponseStatus, delivery.LastError, delivery.CreationTime, delivery.CompletionTime)
+}
+
+func (delivery *InMemWebhookDelivery) writeBack(dbClient DBClient) error {
+	return dbClient.updateObject(delivery)
+}
+
+func (delivery *InMemWebhookDelivery) asJSON() string {
+	var json = "\"WebhookDelivery\": {"
+	json = json + delivery.persistObjFieldsAsJSON()
+	json = json + fmt.Sprintf(
+		", \"WebhookId\": \"%s\", \"RealmId\": \"%s\", \"EventType\": \"%s\", \"Payload\": \"%s\", " +
+		"\"Status\": \"%s\", \"Attempts\": %d, \"NextAttemptTime\": time %s, " +
+		"\"ResponseStatus\": %d, \"LastError\": \"%s\", \"CreationTime\": time %s, " +
+		"\"CompletionTime\": time %s}",
+		delivery.WebhookId, delivery.RealmId, delivery.EventType,
+		rest.EncodeStringForJSON(delivery.Payload), delivery.Status, delivery.Attempts,
+		apitypes.FormatTimeAsJavascriptDate(delivery.NextAttemptTime), delivery.ResponseStatus,
+		rest.EncodeStringForJSON(delivery.LastError),
+		apitypes.FormatTimeAsJavascriptDate(delivery.CreationTime),
+		apitypes.FormatTimeAsJavascriptDate(delivery.CompletionTime))
+	return json
+}
+
+func (client *InMemClient) ReconstituteWebhookDelivery(id, webhookId, realmId, eventType,
+	payload, status string, attempts int, nextAttemptTime time.Time, responseStatus int,
+	lastError string, creationTime, completionTime time.Time) (*InMemWebhookDelivery, error) {
+	
+	var persistObj *InMemPersistObj
+	var err error
+	persistObj, err = client.ReconstitutePersistObj(id)
+	if err != nil { return nil, err }
+	
+	return &InMemWebhookDelivery{
+		InMemPersistObj: *persistObj,
+		WebhookId: webhookId,
+		RealmId: realmId,
+		EventType: eventType,
+		Payload: payload,
+		Status: status,
+		Attempts: attempts,
+		NextAttemptTime: nextAttemptTime,
+		ResponseStatus: responseStatus,
+		LastError: lastError,
+		CreationTime: creationTime,
+		CompletionTime: completionTime,
+	}, nil
+}
+
+/*******************************************************************************
+ * A schedule on which the versions of an image, or of each image in a repo, are
+ * rescanned with the image's scan configs (see ScanSchedules.go). Schedule is a
+ * cron expression, evaluated in TimeZone. If AllVersions is false, only the most
+ * recent version of each image is rescanned. The scans are performed on behalf
+ * of the user who created the schedule.
+ */
+type InMemScanSchedule struct {
+	InMemPersistObj
+	RealmId string
+	ResourceId string  // a DockerImage or a Repo
+	Schedule string
+	TimeZone string  // "" for UTC
+	AllVersions bool
+	CreatorId string
+	CreationTime time.Time
+	NextRunTime time.Time  // zero if the schedule will not run again
+	LastRunTime time.Time  // zero if the schedule has not run
+}
+
+var _ ScanSchedule = &InMemScanSchedule{}
+
+func (client *InMemClient) NewInMemScanSchedule(realmId, resourceId, schedule, timeZone string,
+	allVersions bool, creatorId string, nextRunTime time.Time) (*InMemScanSchedule, error) {
+	
+	var pers *InMemPersistObj
+	var err error
+	pers, err = client.NewInMemPersistObj()
+	if err != nil { return nil, err }
+	var newSchedule = &InMemScanSchedule{
+		InMemPersistObj: *pers,
+		RealmId: realmId,
+		ResourceId: resourceId,
+		Schedule: schedule,
+		TimeZone: timeZone,
+		AllVersions: allVersions,
+		CreatorId: creatorId,
+		CreationTime: time.Now(),
+		NextRunTime: nextRunTime,
+		LastRunTime: time.Time{},
+	}
+	return newSchedule, client.updateObject(newSchedule)
+}
+
+func (client *InMemClient) dbCreateScanSchedule(realmId, resourceId, schedule, timeZone string,
+	allVersions bool, creatorId string, nextRunTime time.Time) (ScanSchedule, error) {
+	
+	var realm Realm
+	var err error
+	realm, err = client.getRealm(realmId)
+	if err != nil { return nil, err }
+	var newSchedule *InMemScanSchedule
+	newSchedule, err = client.NewInMemScanSchedule(realmId, resourceId, schedule, timeZone,
+		allVersions, creatorId, nextRunTime)
+	if err != nil { return nil, err }
+	err = realm.addScanSchedule(client, newSchedule)
+	if err != nil { return nil, err }
+	return newSchedule, nil
+}
+
+func (client *InMemClient) dbDeleteScanSchedule(schedule ScanSchedule) error {
+	
+	var realm Realm
+	var err error
+	realm, err = client.getRealm(schedule.getRealmId())
+	if err != nil { return err }
+	err = realm.removeScanSchedule(client, schedule)
+	if err != nil { return err }
+	return client.deleteObject(schedule)
+}
+
+func (client *InMemClient) getScanSchedule(id string) (ScanSchedule, error) {
+	var schedule ScanSchedule
+	var isType bool
+	var obj PersistObj
+	var err error
+	obj, err = client.getPersistentObject(id)
+	if err != nil { return nil, err }
+	if obj == nil { return nil, utilities.ConstructUserError("Scan schedule not found") }
+	schedule, isType = obj.(ScanSchedule)
+	if ! isType { return nil, utilities.ConstructUserError("Object with Id " + id + " is not a ScanSchedule") }
+	return schedule, nil
+}
+
+func (schedule *InMemScanSchedule) getRealmId() string {
+	return schedule.RealmId
+}
+
+func (schedule *InMemScanSchedule) getResourceId() string {
+	return schedule.ResourceId
+}
+
+func (schedule *InMemScanSchedule) getSchedule() string {
+	return schedule.Schedule
+}
+
+func (schedule *InMemScanSchedule) getTimeZone() string {
+	return schedule.TimeZone
+}
+
+func (schedule *InMemScanSchedule) scansAllVersions() bool {
+	return schedule.AllVersions
+}
+
+func (schedule *InMemScanSchedule) getCreatorId() string {
+	return schedule.CreatorId
+}
+
+func (schedule *InMemScanSchedule) getNextRunTime() time.Time {
+	return schedule.NextRunTime
+}
+
+func (schedule *InMemScanSchedule) getLastRunTime() time.Time {
+	return schedule.LastRunTime
+}
+
+func (schedule *InMemScanSchedule) isDue(now time.Time) bool {
+	return (! schedule.NextRunTime.IsZero()) && (! now.Before(schedule.NextRunTime))
+}
+
+/*******************************************************************************
+ * Record that the run that was due at the schedule's NextRunTime has been taken,
+ * and set the time of the following run.
+ */
+func (schedule *InMemScanSchedule) recordRun(dbClient DBClient, nextRunTime time.Time) error {
+	schedule.LastRunTime = schedule.NextRunTime
+	schedule.NextRunTime = nextRunTime
+	return dbClient.writeBack(schedule)
+}
+
+func (schedule *InMemScanSchedule) asScanScheduleDesc() *apitypes.ScanScheduleDesc {
+	return apitypes.NewScanScheduleDesc(schedule.Id, schedule.RealmId, schedule.ResourceId,
+		schedule.Schedule, schedule.TimeZone, schedule.AllVersions, schedule.CreatorId,
+		schedule.CreationTime, schedule.NextRunTime, schedule.LastRunTime)
+}
+
+func (schedule *InMemScanSchedule) writeBack(dbClient DBClient) error {
+	return dbClient.updateObject(schedule)
+}
+
+func (schedule *InMemScanSchedule) asJSON() string {
+	var json = "\"ScanSchedule\": {"
+	json = json + schedule.persistObjFieldsAsJSON()
+	json = json + fmt.Sprintf(
+		", \"RealmId\": \"%s\", \"ResourceId\": \"%s\", \"Schedule\": \"%s\", \"TimeZone\": \"%s\", " +
+		"\"AllVersions\": %t, \"CreatorId\": \"%s\", \"CreationTime\": time %s, " +
+		"\"NextRunTime\": time %s, \"LastRunTime\": time %s}",
+		schedule.RealmId, schedule.ResourceId, rest.EncodeStringForJSON(schedule.Schedule),
+		rest.EncodeStringForJSON(schedule.TimeZone), schedule.AllVersions, schedule.CreatorId,
+		apitypes.FormatTimeAsJavascriptDate(schedule.CreationTime),
+		apitypes.FormatTimeAsJavascriptDate(schedule.NextRunTime),
+		apitypes.FormatTimeAsJavascriptDate(schedule.LastRunTime))
 	return json
 }
 
-func (client *InMemClient) ReconstituteACLEntry(id, resourceId, partyId string,
-	permMask []bool) (*InMemACLEntry, error) {
-
+func (client *InMemClient) ReconstituteScanSchedule(id, realmId, resourceId, schedule,
+	timeZone string, allVersions bool, creatorId string, creationTime, nextRunTime,
+	lastRunTime time.Time) (*InMemScanSchedule, error) {
+	
 	var persistObj *InMemPersistObj
 	var err error
 	persistObj, err = client.ReconstitutePersistObj(id)
 	if err != nil { return nil, err }
-
-	return &InMemACLEntry{
+	
+	return &InMemScanSchedule{
 		InMemPersistObj: *persistObj,
+		RealmId: realmId,
 		ResourceId: resourceId,
-		PartyId: partyId,
-		PermissionMask: permMask,
+		Schedule: schedule,
+		TimeZone: timeZone,
+		AllVersions: allVersions,
+		CreatorId: creatorId,
+		CreationTime: creationTime,
+		NextRunTime: nextRunTime,
+		LastRunTime: lastRunTime,
 	}, nil
 }
 
@@ -1683,6 +4070,13 @@ type InMemRealm struct {
 	GroupIds []string
 	RepoIds []string
 	FileDirectory string  // where this realm's files are stored
+	RoleIds []string  // the roles that the realm defines
+	InvitationIds []string  // invitations made by or to the realm
+	RequireTOTP bool  // each user must log in with a second factor; see SecondFactor.go
+	NotificationSubscriptionIds []string  // to the realm and its repos and images; see Notifications.go
+	WebhookIds []string  // of the realm and its repos; see Webhooks.go
+	PendingWebhookDeliveryIds []string  // deliveries yet to be made, of any of the realm's webhooks
+	ScanScheduleIds []string  // of the realm's images and repos; see ScanSchedules.go
 }
 
 var _ Realm = &InMemRealm{}
@@ -1700,6 +4094,13 @@ func (client *InMemClient) NewInMemRealm(realmInfo *apitypes.RealmInfo, adminUse
 		GroupIds: make([]string, 0),
 		RepoIds: make([]string, 0),
 		FileDirectory: "",
+		RoleIds: make([]string, 0),
+		InvitationIds: make([]string, 0),
+		RequireTOTP: false,
+		NotificationSubscriptionIds: make([]string, 0),
+		WebhookIds: make([]string, 0),
+		PendingWebhookDeliveryIds: make([]string, 0),
+		ScanScheduleIds: make([]string, 0),
 	}
 	return newRealm, client.addRealm(newRealm)
 }
@@ -1934,17 +4335,13 @@ func (realm *InMemRealm) getGroupIds() []string {
 	return realm.GroupIds
 }
 
+/*******************************************************************************
+ * Add the user to the realm. Names of users need not be unique - a directory or
+ * identity provider may give several users the same name - so a handler that
+ * requires a unique name must check for it (see createUser).
+ */
 func (realm *InMemRealm) addUser(dbClient DBClient, user User) error {
 	
-	// Check if user with same name already exists.
-	var u User
-	var err error
-	u, err = realm.getUserByName(dbClient, user.getName())
-	if err != nil { return err }
-	if u != nil { return utilities.ConstructUserError(
-		"A user with name " + user.getName() + " already exists in realm " + realm.getName())
-	}
-	
 	realm.UserObjIds = append(realm.UserObjIds, user.getId())
 	var inMemUser = user.(*InMemUser)
 	inMemUser.RealmId = realm.getId()
@@ -2043,6 +4440,7 @@ func (realm *InMemRealm) getUserByName(dbClient DBClient, userName string) (User
 		if ! isUser { return nil, utilities.ConstructServerError(fmt.Sprintf(
 			"Internal error: obj with Id %s is not a User", id))
 		}
+		if user.isDeleted() { continue }
 		if user.getName() == userName { return user, nil }
 	}
 	return nil, nil
@@ -2061,11 +4459,134 @@ func (realm *InMemRealm) getUserByUserId(dbClient DBClient, userId string) (User
 		if ! isUser { return nil, utilities.ConstructServerError(fmt.Sprintf(
 			"Internal error: obj with Id %s is not a User", id))
 		}
+		if user.isDeleted() { continue }
 		if user.getUserId() == userId { return user, nil }
 	}
 	return nil, nil
 }
 
+func (realm *InMemRealm) getInvitationIds() []string {
+	return realm.InvitationIds
+}
+
+func (realm *InMemRealm) addInvitation(dbClient DBClient, invitation Invitation) error {
+	realm.InvitationIds = append(realm.InvitationIds, invitation.getId())
+	return dbClient.writeBack(realm)
+}
+
+func (realm *InMemRealm) getNotificationSubscriptionIds() []string {
+	return realm.NotificationSubscriptionIds
+}
+
+func (realm *InMemRealm) addNotificationSubscription(dbClient DBClient,
+	subscription NotificationSubscription) error {
+	realm.NotificationSubscriptionIds = append(realm.NotificationSubscriptionIds, subscription.getId())
+	return dbClient.writeBack(realm)
+}
+
+func (realm *InMemRealm) removeNotificationSubscription(dbClient DBClient,
+	subscription NotificationSubscription) error {
+	realm.NotificationSubscriptionIds = utilities.RemoveFrom(subscription.getId(),
+		realm.NotificationSubscriptionIds)
+	return dbClient.writeBack(realm)
+}
+
+func (realm *InMemRealm) getWebhookIds() []string {
+	return realm.WebhookIds
+}
+
+func (realm *InMemRealm) addWebhook(dbClient DBClient, webhook Webhook) error {
+	realm.WebhookIds = append(realm.WebhookIds, webhook.getId())
+	return dbClient.writeBack(realm)
+}
+
+func (realm *InMemRealm) removeWebhook(dbClient DBClient, webhook Webhook) error {
+	realm.WebhookIds = utilities.RemoveFrom(webhook.getId(), realm.WebhookIds)
+	return dbClient.writeBack(realm)
+}
+
+func (realm *InMemRealm) getPendingWebhookDeliveryIds() []string {
+	return realm.PendingWebhookDeliveryIds
+}
+
+func (realm *InMemRealm) addPendingWebhookDelivery(dbClient DBClient, delivery WebhookDelivery) error {
+	realm.PendingWebhookDeliveryIds = append(realm.PendingWebhookDeliveryIds, delivery.getId())
+	return dbClient.writeBack(realm)
+}
+
+func (realm *InMemRealm) removePendingWebhookDelivery(dbClient DBClient, delivery WebhookDelivery) error {
+	realm.PendingWebhookDeliveryIds = utilities.RemoveFrom(delivery.getId(),
+		realm.PendingWebhookDeliveryIds)
+	return dbClient.writeBack(realm)
+}
+
+func (realm *InMemRealm) getScanScheduleIds() []string {
+	return realm.ScanScheduleIds
+}
+
+func (realm *InMemRealm) addScanSchedule(dbClient DBClient, schedule ScanSchedule) error {
+	realm.ScanScheduleIds = append(realm.ScanScheduleIds, schedule.getId())
+	return dbClient.writeBack(realm)
+}
+
+func (realm *InMemRealm) removeScanSchedule(dbClient DBClient, schedule ScanSchedule) error {
+	realm.ScanScheduleIds = utilities.RemoveFrom(schedule.getId(), realm.ScanScheduleIds)
+	return dbClient.writeBack(realm)
+}
+
+func (realm *InMemRealm) requiresTOTP() bool {
+	return realm.RequireTOTP
+}
+
+func (realm *InMemRealm) setRequireTOTP(dbClient DBClient, require bool) error {
+	realm.RequireTOTP = require
+	return dbClient.writeBack(realm)
+}
+
+func (realm *InMemRealm) getRoleIds() []string {
+	return realm.RoleIds
+}
+
+/*******************************************************************************
+ * Return the built-in role, or the role defined by the realm, that has the
+ * specified name; or nil if there is none.
+ */
+func (realm *InMemRealm) getRole(dbClient DBClient, roleName string) (Role, error) {
+	var builtIn = getBuiltInRole(roleName)
+	if builtIn != nil { return builtIn, nil }
+	for _, id := range realm.RoleIds {
+		var role Role
+		var err error
+		role, err = dbClient.getRole(id)
+		if err != nil { return nil, err }
+		if role.getName() == roleName { return role, nil }
+	}
+	return nil, nil
+}
+
+func (realm *InMemRealm) addRole(dbClient DBClient, role Role) error {
+	realm.RoleIds = append(realm.RoleIds, role.getId())
+	return dbClient.writeBack(realm)
+}
+
+/*******************************************************************************
+ * Remove a role that the realm defines. The role may not be in use.
+ */
+func (realm *InMemRealm) deleteRole(dbClient DBClient, role Role) error {
+	for _, entryId := range role.getACLEntryIds() {
+		var entry ACLEntry
+		var err error
+		entry, err = dbClient.getACLEntry(entryId)
+		if err != nil { continue }
+		if entry.getRoleName() == role.getName() { return utilities.ConstructUserError(
+			"Role " + role.getName() + " is assigned to one or more parties") }
+	}
+	realm.RoleIds = utilities.RemoveFrom(role.getId(), realm.RoleIds)
+	var err = dbClient.writeBack(realm)
+	if err != nil { return err }
+	return dbClient.deleteObject(role)
+}
+
 func (realm *InMemRealm) getGroupByName(dbClient DBClient, groupName string) (Group, error) {
 	for _, id := range realm.GroupIds {
 		var obj PersistObj
@@ -2111,8 +4632,9 @@ func (realm *InMemRealm) deleteGroup(dbClient DBClient, group Group) error {
 	err = dbClient.writeBack(realm)
 	if err != nil { return err }
 	
-	// Remove users from the group.
-	for _, userObjId := range group.getUserObjIds() {
+	// Remove users from the group. removeUser changes the group's list of users,
+	// so iterate over a copy.
+	for _, userObjId := range append([]string{}, group.getUserObjIds()...) {
 		var user User
 		var err error
 		user, err = dbClient.getUser(userObjId)
@@ -2121,6 +4643,23 @@ func (realm *InMemRealm) deleteGroup(dbClient DBClient, group Group) error {
 		if err != nil { return err }
 	}
 	
+	// Remove the group from the groups that contain it, and remove the groups
+	// that it contains.
+	for _, parentId := range append([]string{}, group.getGroupIds()...) {
+		var parent Group
+		parent, err = dbClient.getGroup(parentId)
+		if err != nil { return err }
+		err = parent.removeMemberGroup(dbClient, group)
+		if err != nil { return err }
+	}
+	for _, memberId := range append([]string{}, group.getMemberGroupIds()...) {
+		var member Group
+		member, err = dbClient.getGroup(memberId)
+		if err != nil { return err }
+		err = group.removeMemberGroup(dbClient, member)
+		if err != nil { return err }
+	}
+	
 	// Remove ACL entries referenced by the group.
 	var entryIds []string = group.getACLEntryIds()
 	var entryIdsCopy []string = make([]string, len(entryIds))
@@ -2164,7 +4703,9 @@ func (realm *InMemRealm) deleteRepo(dbClient DBClient, repo Repo) error {
 	err = dbClient.deleteAllAccessToResource(repo)
 	if err != nil { return err }
 	
-	return nil
+	// Stop counting the Repo against the Realm's quota.
+	return dbClient.getPersistence().queueSubtractFromRealmCount(
+		dbClient.getTransactionContext(), realm.getId(), RealmReposCount, 1)
 }
 
 func (realm *InMemRealm) createUniqueRepoName(dbClient DBClient, prefix string) (string, error) {
@@ -2217,14 +4758,48 @@ func (realm *InMemRealm) asJSON() string {
 		if i != 0 { json = json + ", " }
 		json = json + "\"" + id + "\""
 	}
-	json = json + fmt.Sprintf("], \"FileDirectory\": \"%s\"}", realm.FileDirectory)
+	json = json + fmt.Sprintf("], \"FileDirectory\": \"%s\", \"RoleIds\": [", realm.FileDirectory)
+	for i, id := range realm.RoleIds {
+		if i != 0 { json = json + ", " }
+		json = json + "\"" + id + "\""
+	}
+	json = json + "], \"InvitationIds\": ["
+	for i, id := range realm.InvitationIds {
+		if i != 0 { json = json + ", " }
+		json = json + "\"" + id + "\""
+	}
+	json = json + fmt.Sprintf("], \"RequireTOTP\": %s, \"NotificationSubscriptionIds\": [",
+		apitypes.BoolToString(realm.RequireTOTP))
+	for i, id := range realm.NotificationSubscriptionIds {
+		if i != 0 { json = json + ", " }
+		json = json + "\"" + id + "\""
+	}
+	json = json + "], \"WebhookIds\": ["
+	for i, id := range realm.WebhookIds {
+		if i != 0 { json = json + ", " }
+		json = json + "\"" + id + "\""
+	}
+	json = json + "], \"PendingWebhookDeliveryIds\": ["
+	for i, id := range realm.PendingWebhookDeliveryIds {
+		if i != 0 { json = json + ", " }
+		json = json + "\"" + id + "\""
+	}
+	json = json + "], \"ScanScheduleIds\": ["
+	for i, id := range realm.ScanScheduleIds {
+		if i != 0 { json = json + ", " }
+		json = json + "\"" + id + "\""
+	}
+	json = json + "]}"
 	return json
 }
 
 func (client *InMemClient) ReconstituteRealm(id string, aclEntryIds []string,
 	name, desc, parentId string, creationTime time.Time,
 	adminUserId string, orgFullName string,
-	userObjIds, groupIds, repoIds []string, fileDir string) (*InMemRealm, error) {
+	userObjIds, groupIds, repoIds []string, fileDir string, roleIds,
+	invitationIds []string, requireTOTP bool,
+	notificationSubscriptionIds, webhookIds,
+	pendingWebhookDeliveryIds, scanScheduleIds []string) (*InMemRealm, error) {
 
 	var resource *InMemResource
 	var err error
@@ -2240,6 +4815,13 @@ func (client *InMemClient) ReconstituteRealm(id string, aclEntryIds []string,
 		GroupIds: groupIds,
 		RepoIds: repoIds,
 		FileDirectory: fileDir,
+		RoleIds: roleIds,
+		InvitationIds: invitationIds,
+		RequireTOTP: requireTOTP,
+		NotificationSubscriptionIds: notificationSubscriptionIds,
+		WebhookIds: webhookIds,
+		PendingWebhookDeliveryIds: pendingWebhookDeliveryIds,
+		ScanScheduleIds: scanScheduleIds,
 	}, nil
 }
 
@@ -2565,6 +5147,11 @@ func (repo *InMemRepo) deleteDockerImage(dbClient DBClient, image DockerImage) e
 	// Remove from repo.
 	repo.DockerImageIds = utilities.RemoveFrom(image.getId(), repo.DockerImageIds)
 	
+	// Stop counting the image against the realm's quota.
+	err = dbClient.getPersistence().queueSubtractFromRealmCount(
+		dbClient.getTransactionContext(), repo.getRealmId(), RealmImagesCount, 1)
+	if err != nil { return err }
+	
 	// Remove from database.
 	err = dbClient.deleteObject(image)
 	if err != nil { return err }
@@ -3218,6 +5805,14 @@ func (image *InMemDockerImage) deleteImageVersion(dbClient DBClient, imageVersio
 	// Remove from image's list of versions.
 	image.VersionIds = utilities.RemoveFrom(imageVersion.getId(), image.VersionIds)
 	
+	// Stop counting the version against the realm's quota.
+	var repo Repo
+	repo, err = image.getRepo(dbClient)
+	if err != nil { return err }
+	err = dbClient.getPersistence().queueSubtractFromRealmCount(
+		dbClient.getTransactionContext(), repo.getRealmId(), RealmImageVersionsCount, 1)
+	if err != nil { return err }
+	
 	// Remove from database.
 	dbClient.deleteObject(imageVersion)
 	dbClient.updateObject(image)
@@ -3508,8 +6103,10 @@ func (imageVersion *InMemDockerImageVersion) asDockerImageVersionDesc(dbClient D
 	
 	var parsedDockerBuildOutput *docker.DockerBuildOutput
 	var err error
-	parsedDockerBuildOutput, err = docker.ParseBuildRESTOutput(imageVersion.DockerBuildOutput)
-	if err != nil { return nil, err }
+	if imageVersion.DockerBuildOutput != "" {  // "" if the version was pushed to the registry
+		parsedDockerBuildOutput, err = docker.ParseBuildRESTOutput(imageVersion.DockerBuildOutput)
+		if err != nil { return nil, err }
+	}
 	
 	var dockerImage DockerImage
 	dockerImage, err = dbClient.getDockerImage(imageVersion.ImageObjId)
@@ -4358,6 +6955,9 @@ func (client *InMemClient) asEventDesc(event Event) apitypes.EventDesc {
 		if isType {
 			return dockerfileExecEvent.asEventDesc(client)
 		} else {
+			var expiryEvent ACLEntryExpiryEvent
+			expiryEvent, isType = event.(ACLEntryExpiryEvent)
+			if isType { return expiryEvent.asEventDesc(client) }
 			panic("Unexpected event type: " + reflect.TypeOf(event).String())
 		}
 	}
@@ -4438,6 +7038,16 @@ func (client *InMemClient) dbCreateScanEvent(scanConfigId, providerName string,
 	imageVersion, err = client.getDockerImageVersion(imageVersionId)
 	if err != nil { return nil, err }
 	imageVersion.addScanEventId(client, scanEvent.getId())
+	
+	err = queueWebhookEventForImageVersion(client, ScanWebhookEvent, scanEvent, imageVersion,
+		map[string]interface{}{
+			"ScanConfigId": scanConfigId,
+			"ScanConfigName": scanConfig.getName(),
+			"ProviderName": providerName,
+			"Score": score,
+			"VulnerabilityCount": len(result.Vulnerabilities),
+		})
+	if err != nil { return nil, err }
 
 	fmt.Println("Created ScanEvent")
 	return scanEvent, nil
@@ -4460,6 +7070,10 @@ func (event *InMemScanEvent) getScore() string {
 	return event.Score
 }
 
+func (event *InMemScanEvent) getVulnerabilities() []*scanners.VulnerabilityDesc {
+	return event.Result.Vulnerabilities
+}
+
 func (event *InMemScanEvent) getDockerImageVersionId() string {
 	return event.DockerImageVersionId
 }
@@ -4559,9 +7173,7 @@ func (client *InMemClient) ReconstituteScanEvent(id string, when time.Time,
 	
 	// Deserialize the json for the Result.
 	var result  = &scanners.ScanResult{
-		Vulnerabilities: []*scanners.VulnerabilityDesc{
-			&scanners.VulnerabilityDesc{ "", "", "", "" },
-		},
+		Vulnerabilities: make([]*scanners.VulnerabilityDesc, len(vulnAr)),
 	}
 	for i, vuln := range vulnAr {
 		result.Vulnerabilities[i] = &scanners.VulnerabilityDesc{
@@ -4737,6 +7349,13 @@ func (client *InMemClient) dbCreateDockerfileExecEvent(dockerfileId string,
 	if err != nil { return nil, err }
 	user.addEventId(client, newDockerfileExecEvent.getId())
 	
+	err = queueWebhookEventForImageVersion(client, DockerfileExecWebhookEvent,
+		newDockerfileExecEvent, imageVersion, map[string]interface{}{
+			"DockerfileId": dockerfileId,
+			"DockerfileName": dockerfile.getName(),
+		})
+	if err != nil { return nil, err }
+	
 	return newDockerfileExecEvent, nil
 }
 
@@ -4841,6 +7460,225 @@ func (client *InMemClient) ReconstituteDockerfileExecEvent(id string, when time.
 	}, nil
 }
 
+/*******************************************************************************
+ * Records that an image version was pushed to the registry, and registered from
+ * the registry's notification (see RegistryNotifications.go), rather than built
+ * by SafeHarbor.
+ */
+type InMemImageUploadEvent struct {
+	InMemImageCreationEvent
+	Repository string
+	Tag string
+	Digest string  // of the image's manifest
+	RegistryEventId string
+}
+
+var _ ImageUploadEvent = &InMemImageUploadEvent{}
+
+func (client *InMemClient) NewInMemImageUploadEvent(imageVersionId, userObjId, repository,
+	tag, digest, registryEventId string) (*InMemImageUploadEvent, error) {
+	
+	var ev *InMemImageCreationEvent
+	var err error
+	ev, err = client.NewInMemImageCreationEvent(userObjId, imageVersionId)
+	if err != nil { return nil, err }
+	var event = &InMemImageUploadEvent{
+		InMemImageCreationEvent: *ev,
+		Repository: repository,
+		Tag: tag,
+		Digest: digest,
+		RegistryEventId: registryEventId,
+	}
+	return event, client.updateObject(event)
+}
+
+func (client *InMemClient) dbCreateImageUploadEvent(imageVersionId, userObjId, repository,
+	tag, digest, registryEventId string) (ImageUploadEvent, error) {
+	
+	var newEvent *InMemImageUploadEvent
+	var err error
+	newEvent, err = client.NewInMemImageUploadEvent(imageVersionId, userObjId, repository,
+		tag, digest, registryEventId)
+	if err != nil { return nil, err }
+	
+	// Link with ImageVersion.
+	var imageVersion DockerImageVersion
+	imageVersion, err = client.getDockerImageVersion(imageVersionId)
+	if err != nil { return nil, err }
+	imageVersion.setImageCreationEventId(newEvent.getId())
+	err = client.writeBack(imageVersion)
+	if err != nil { return nil, err }
+	
+	// Link to user.
+	var user User
+	user, err = client.getUser(userObjId)
+	if err != nil { return nil, err }
+	user.addEventId(client, newEvent.getId())
+	
+	err = queueWebhookEventForImageVersion(client, ImageUploadWebhookEvent, newEvent, imageVersion,
+		map[string]interface{}{
+			"Repository": repository,
+			"Tag": tag,
+			"Digest": digest,
+		})
+	if err != nil { return nil, err }
+	
+	return newEvent, nil
+}
+
+func (event *InMemImageUploadEvent) getRepository() string {
+	return event.Repository
+}
+
+func (event *InMemImageUploadEvent) getTag() string {
+	return event.Tag
+}
+
+func (event *InMemImageUploadEvent) getDigest() string {
+	return event.Digest
+}
+
+func (event *InMemImageUploadEvent) getRegistryEventId() string {
+	return event.RegistryEventId
+}
+
+func (event *InMemImageUploadEvent) asImageUploadEventDesc() *apitypes.ImageUploadEventDesc {
+	return apitypes.NewImageUploadEventDesc(event.Id, event.When, event.UserObjId,
+		event.ImageVersionId, event.Repository, event.Tag, event.Digest, event.RegistryEventId)
+}
+
+func (event *InMemImageUploadEvent) asEventDesc(dbClient DBClient) apitypes.EventDesc {
+	return event.asImageUploadEventDesc()
+}
+
+func (event *InMemImageUploadEvent) writeBack(dbClient DBClient) error {
+	return dbClient.updateObject(event)
+}
+
+func (event *InMemImageUploadEvent) asJSON() string {
+	var json = "\"ImageUploadEvent\": {" + event.imageCreationEventFieldsAsJSON()
+	json = json + fmt.Sprintf(", \"Repository\": \"%s\", \"Tag\": \"%s\", \"Digest\": \"%s\", " +
+		"\"RegistryEventId\": \"%s\"}", rest.EncodeStringForJSON(event.Repository),
+		rest.EncodeStringForJSON(event.Tag), rest.EncodeStringForJSON(event.Digest),
+		rest.EncodeStringForJSON(event.RegistryEventId))
+	return json
+}
+
+func (client *InMemClient) ReconstituteImageUploadEvent(id string, when time.Time,
+	userObjId, imageVersionId, repository, tag, digest,
+	registryEventId string) (*InMemImageUploadEvent, error) {
+	
+	var imgCrEvent *InMemImageCreationEvent
+	var err error
+	imgCrEvent, err = client.ReconstituteImageCreationEvent(id, when, userObjId, imageVersionId)
+	if err != nil { return nil, err }
+	
+	return &InMemImageUploadEvent{
+		InMemImageCreationEvent: *imgCrEvent,
+		Repository: repository,
+		Tag: tag,
+		Digest: digest,
+		RegistryEventId: registryEventId,
+	}, nil
+}
+
+/*******************************************************************************
+ * Records that an ACL entry reached its expiry time and was deleted. The event
+ * belongs to the user who set the expiry.
+ */
+type InMemACLEntryExpiryEvent struct {
+	InMemEvent
+	ResourceId string
+	PartyId string
+	PermissionMask []bool  // the modes that the entry granted
+}
+
+var _ ACLEntryExpiryEvent = &InMemACLEntryExpiryEvent{}
+
+func (client *InMemClient) NewInMemACLEntryExpiryEvent(userObjId, resourceId, partyId string,
+	mask []bool) (*InMemACLEntryExpiryEvent, error) {
+	
+	var event *InMemEvent
+	var err error
+	event, err = client.NewInMemEvent(userObjId)
+	if err != nil { return nil, err }
+	var newEvent = &InMemACLEntryExpiryEvent{
+		InMemEvent: *event,
+		ResourceId: resourceId,
+		PartyId: partyId,
+		PermissionMask: mask,
+	}
+	return newEvent, client.updateObject(newEvent)
+}
+
+/*******************************************************************************
+ * Create an event recording the expiry of the ACL entry, and add it to the
+ * events of the user who set the expiry, if that user still exists.
+ */
+func (client *InMemClient) dbCreateACLEntryExpiryEvent(entry ACLEntry) (ACLEntryExpiryEvent, error) {
+	
+	var newEvent *InMemACLEntryExpiryEvent
+	var err error
+	newEvent, err = client.NewInMemACLEntryExpiryEvent(entry.getGrantorId(),
+		entry.getResourceId(), entry.getPartyId(), entry.getPermissionMask())
+	if err != nil { return nil, err }
+	if entry.getGrantorId() != "" {
+		var grantor User
+		grantor, err = client.getUser(entry.getGrantorId())
+		if (err == nil) && (grantor != nil) { grantor.addEventId(client, newEvent.getId()) }
+	}
+	return newEvent, nil
+}
+
+func (event *InMemACLEntryExpiryEvent) getResourceId() string {
+	return event.ResourceId
+}
+
+func (event *InMemACLEntryExpiryEvent) getPartyId() string {
+	return event.PartyId
+}
+
+func (event *InMemACLEntryExpiryEvent) getPermissionMask() []bool {
+	return event.PermissionMask
+}
+
+func (event *InMemACLEntryExpiryEvent) asEventDesc(dbClient DBClient) apitypes.EventDesc {
+	return apitypes.NewACLEntryExpiryEventDesc(event.Id, event.When, event.UserObjId,
+		event.ResourceId, event.PartyId, event.PermissionMask)
+}
+
+func (event *InMemACLEntryExpiryEvent) writeBack(dbClient DBClient) error {
+	return dbClient.updateObject(event)
+}
+
+func (event *InMemACLEntryExpiryEvent) asJSON() string {
+	var json = "\"ACLEntryExpiryEvent\": {" + event.eventFieldsAsJSON()
+	json = json + fmt.Sprintf(", \"ResourceId\": \"%s\", \"PartyId\": \"%s\", \"PermissionMask\": [",
+		event.ResourceId, event.PartyId)
+	for i, b := range event.PermissionMask {
+		if i != 0 { json = json + ", " }
+		json = json + apitypes.BoolToString(b)
+	}
+	json = json + "]}"
+	return json
+}
+
+func (client *InMemClient) ReconstituteACLEntryExpiryEvent(id string, when time.Time,
+	userObjId, resourceId, partyId string, mask []bool) (*InMemACLEntryExpiryEvent, error) {
+
+	var event *InMemEvent
+	var err error
+	event, err = client.ReconstituteEvent(id, when, userObjId)
+	if err != nil { return nil, err }
+	
+	return &InMemACLEntryExpiryEvent{
+		InMemEvent: *event,
+		ResourceId: resourceId,
+		PartyId: partyId,
+		PermissionMask: mask,
+	}, nil
+}
+
 /*******************************************************************************
  * 
  */
@@ -0,0 +1,405 @@
+/*******************************************************************************
+ * Authentication of users against an LDAP directory, such as Active Directory.
+ *
+ * If LDAP is configured, authenticate verifies the password of a user who is
+ * not known to SafeHarbor, or who was provisioned from the directory, by
+ * binding to the directory as the user. The first time that a directory user
+ * logs in, a SafeHarbor user is created for the user, in the realm to which the
+ * user's directory groups are mapped (GroupRealms), or else in the configured
+ * Realm. Such users are marked with their distinguished name (DN), and have no
+ * usable SafeHarbor password. Users created in SafeHarbor are authenticated as
+ * before.
+ *
+ * Membership of directory groups is synchronized into the SafeHarbor groups of
+ * the same name, every SyncInterval seconds: a directory user is added to, or
+ * removed from, each group of the user's realm according to the directory, and
+ * a group is created if it does not exist but has members in the realm. The
+ * membership of users who were not provisioned from the directory is never
+ * changed. If several servers share the database, only the one that claims
+ * LDAPSyncClaimKey performs each synchronization. A realm that cannot be
+ * synchronized is logged and skipped.
+ *
+ * A server may return the members of a large group in ranges (Active Directory
+ * returns at most 1500 values of an attribute at a time, as member;range=0-1499),
+ * in which case the remaining ranges are requested. If the members of a group
+ * cannot all be retrieved, members are added to the group, but none is removed.
+ *
+ * Passwords are never sent in the clear: with an ldap:// URL, the connection is
+ * upgraded with StartTLS before the first bind. The directory's certificate is
+ * verified against the system's certificate authorities, or against those in
+ * CACertFile, if configured.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	
+	"utilities"
+)
+
+const (
+	DefaultLDAPSyncInterval = 900  // seconds
+	DefaultLDAPUserFilter = "(uid=%s)"
+	DefaultLDAPGroupFilter = "(objectClass=groupOfNames)"
+	LDAPSyncClaimKey = "SafeHarbor/LDAPSync"
+)
+
+/*******************************************************************************
+ * The LDAP configuration. UserFilter selects a user's entry: %s is replaced by
+ * the user Id (for Active Directory, use (sAMAccountName=%s)). GroupFilter
+ * selects the groups to be synchronized, each of which lists the DNs of its
+ * members in GroupMemberAttribute.
+ */
+type LDAPConfig struct {
+	URL string  // ldap://host[:port] or ldaps://host[:port]
+	BindDN string  // the service account with which users and groups are found
+	BindPassword string
+	UserBaseDN string
+	UserFilter string
+	UserNameAttribute string
+	EmailAttribute string
+	GroupBaseDN string
+	GroupFilter string
+	GroupNameAttribute string
+	GroupMemberAttribute string
+	Realm string  // the name of the realm into which users are provisioned
+	GroupRealms map[string]string  // maps a group name to a realm name, overriding Realm
+	SyncInterval int  // seconds between group synchronizations
+	CACertFile string  // PEM certificates of the CAs that may sign the directory's certificate; "" for the system's
+	rootCAs *x509.CertPool  // loaded from CACertFile; nil for the system's
+}
+
+/*******************************************************************************
+ * A directory group, and the DNs of its members.
+ */
+type LDAPGroup struct {
+	Name string
+	MemberDNs []string
+	Truncated bool  // if MemberDNs may lack some of the members
+}
+
+/*******************************************************************************
+ * Verify the user's password by binding to the directory as the user. Return
+ * the user's entry, or nil if the user is not found or the password is wrong.
+ */
+func (client *LDAPClient) authenticateUser(userId, pswd string) (*LDAPEntry, error) {
+	
+	// A bind with an empty password is an unauthenticated bind, which succeeds.
+	if pswd == "" { return nil, nil }
+	
+	var conn, err = client.connectAsService()
+	if err != nil { return nil, err }
+	defer conn.close()
+	var entries []*LDAPEntry
+	entries, err = conn.search(client.config.UserBaseDN,
+		strings.Replace(client.config.UserFilter, "%s", escapeLDAPFilterValue(userId), -1),
+		[]string{ client.config.UserNameAttribute, client.config.EmailAttribute })
+	if err != nil { return nil, err }
+	if len(entries) != 1 { return nil, nil }  // unknown, or ambiguous
+	
+	var valid bool
+	valid, err = conn.bind(entries[0].DN, pswd)
+	if err != nil { return nil, err }
+	if ! valid { return nil, nil }
+	return entries[0], nil
+}
+
+/*******************************************************************************
+ * Return each group that GroupFilter selects.
+ */
+func (client *LDAPClient) getGroups() ([]*LDAPGroup, error) {
+	
+	var conn, err = client.connectAsService()
+	if err != nil { return nil, err }
+	defer conn.close()
+	var entries []*LDAPEntry
+	entries, err = conn.search(client.config.GroupBaseDN, client.config.GroupFilter,
+		[]string{ client.config.GroupNameAttribute, client.config.GroupMemberAttribute })
+	if err != nil { return nil, err }
+	
+	var groups = make([]*LDAPGroup, 0)
+	for _, entry := range entries {
+		var name = entry.getAttribute(client.config.GroupNameAttribute)
+		if name == "" { continue }
+		var memberDNs = append([]string{}, entry.getAttributeValues(client.config.GroupMemberAttribute)...)
+		var rangeDNs []string
+		var truncated bool
+		rangeDNs, truncated, err = conn.getRangedAttributeValues(entry, client.config.GroupMemberAttribute)
+		if err != nil { return nil, err }
+		memberDNs = append(memberDNs, rangeDNs...)
+		groups = append(groups, &LDAPGroup{ Name: name, MemberDNs: memberDNs, Truncated: truncated })
+	}
+	return groups, nil
+}
+
+/*******************************************************************************
+ * If the entry has a range of the values of the attribute - in an attribute
+ * named, for example, member;range=0-1499 - request the remaining ranges, and
+ * return the values of all of them. Return true if the ranges end before the
+ * last value, as indicated by a range whose end is "*".
+ */
+func (conn *ldapConnection) getRangedAttributeValues(entry *LDAPEntry, attribute string) ([]string, bool, error) {
+	
+	var values = make([]string, 0)
+	var rangeValues, end = getLDAPAttributeRange(entry, attribute)
+	for end != "" {
+		values = append(values, rangeValues...)
+		if end == "*" { return values, false, nil }
+		var last, err = strconv.Atoi(end)
+		if err != nil { return values, true, nil }
+		var entries []*LDAPEntry
+		entries, err = conn.searchScope(entry.DN, ldapScopeBaseObject, "(objectClass=*)",
+			[]string{ fmt.Sprintf("%s;range=%d-*", attribute, last + 1) })
+		if err != nil { return nil, true, err }
+		if len(entries) != 1 { return values, true, nil }
+		var nextEnd string
+		rangeValues, nextEnd = getLDAPAttributeRange(entries[0], attribute)
+		if nextEnd == "" { return values, true, nil }  // the server did not return the next range
+		end = nextEnd
+	}
+	return values, false, nil  // the entry has no range of values
+}
+
+/*******************************************************************************
+ * Return the values of the entry's range of values of the attribute, and the
+ * end of the range - a number, or "*" if the range includes the last value - or
+ * "" if the entry has no range of values of the attribute.
+ */
+func getLDAPAttributeRange(entry *LDAPEntry, attribute string) ([]string, string) {
+	
+	var prefix = strings.ToLower(attribute) + ";range="
+	for name, values := range entry.Attributes {
+		if ! strings.HasPrefix(name, prefix) { continue }
+		var bounds = strings.SplitN(strings.TrimPrefix(name, prefix), "-", 2)
+		if len(bounds) != 2 { continue }
+		return values, bounds[1]
+	}
+	return nil, ""
+}
+
+func (client *LDAPClient) connectAsService() (*ldapConnection, error) {
+	
+	var conn, err = client.connect()
+	if err != nil { return nil, err }
+	var valid bool
+	valid, err = conn.bind(client.config.BindDN, client.config.BindPassword)
+	if err == nil && ! valid {
+		err = utilities.ConstructServerError("LDAP server rejected the credentials of " + client.config.BindDN)
+	}
+	if err != nil {
+		conn.close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+/*******************************************************************************
+ * Return the name of the realm into which a user who belongs to the specified
+ * groups is provisioned.
+ */
+func (config *LDAPConfig) getRealmName(groups []*LDAPGroup) string {
+	for _, group := range groups {
+		var realmName, found = config.GroupRealms[group.Name]
+		if found { return realmName }
+	}
+	return config.Realm
+}
+
+/*******************************************************************************
+ * Return the groups that have the specified member. DNs are compared without
+ * regard to case.
+ */
+func getLDAPGroupsWithMember(groups []*LDAPGroup, dn string) []*LDAPGroup {
+	var memberOf = make([]*LDAPGroup, 0)
+	for _, group := range groups {
+		for _, memberDN := range group.MemberDNs {
+			if strings.EqualFold(memberDN, dn) {
+				memberOf = append(memberOf, group)
+				break
+			}
+		}
+	}
+	return memberOf
+}
+
+/*******************************************************************************
+ * Authenticate the user against the directory. If the user has not logged in
+ * before, create the user, and add the user to the groups of which the user is
+ * a member. Return nil if the credentials are not valid.
+ */
+func authenticateLDAPUser(dbClient DBClient, ldapClient *LDAPClient,
+	userId, pswd string) (User, error) {
+	
+	var entry, err = ldapClient.authenticateUser(userId, pswd)
+	if err != nil { return nil, err }
+	if entry == nil { return nil, nil }
+	var user User
+	user, err = dbClient.dbGetUserByUserId(userId)
+	if err != nil { return nil, err }
+	if user != nil { return user, nil }
+	
+	var groups []*LDAPGroup
+	groups, err = ldapClient.getGroups()
+	if err != nil { return nil, err }
+	var memberOf = getLDAPGroupsWithMember(groups, entry.DN)
+	var realmName = ldapClient.config.getRealmName(memberOf)
+	var realmId string
+	realmId, err = dbClient.getPersistence().GetRealmObjIdByRealmName(realmName)
+	if err != nil { return nil, err }
+	if realmId == "" { return nil, utilities.ConstructServerError(
+		"Realm " + realmName + ", into which LDAP users are provisioned, does not exist") }
+	
+	// The user is authenticated by the directory, so the SafeHarbor password is
+	// random, and is never disclosed.
+	var randomBytes = make([]byte, 32)
+	_, err = rand.Read(randomBytes)
+	if err != nil { return nil, err }
+	var name = entry.getAttribute(ldapClient.config.UserNameAttribute)
+	if name == "" { name = userId }
+	var email = entry.getAttribute(ldapClient.config.EmailAttribute)
+	user, err = dbClient.dbCreateUser(userId, name, email, hex.EncodeToString(randomBytes), realmId)
+	if err != nil { return nil, err }
+	err = user.setLDAPDN(dbClient, entry.DN)
+	if err != nil { return nil, err }
+	if email != "" {
+		err = user.flagEmailAsVerified(dbClient, email)  // the directory is trusted
+		if err != nil { return nil, err }
+	}
+	fmt.Println("Provisioned LDAP user " + userId + " in realm " + realmName)
+	
+	var realm Realm
+	realm, err = dbClient.getRealm(realmId)
+	if err != nil { return nil, err }
+	_, _, err = syncLDAPGroupsForRealm(dbClient, realm, memberOf)
+	if err != nil { return nil, err }
+	return user, nil
+}
+
+/*******************************************************************************
+ * Synchronize directory group membership every SyncInterval seconds, until the
+ * process exits. A server synchronizes only if it claims LDAPSyncClaimKey, which
+ * expires after the interval, so that servers that share the database do not
+ * each synchronize.
+ */
+func (server *Server) syncLDAPGroupsPeriodically() {
+	
+	var interval = server.Config.LDAP.SyncInterval
+	if interval <= 0 { interval = DefaultLDAPSyncInterval }
+	for {
+		var claimed, err = server.persistence.claimKey(LDAPSyncClaimKey, interval)
+		if err != nil { fmt.Println("While claiming LDAP group synchronization: " + err.Error()) }
+		if claimed {
+			var added, removed int
+			added, removed, err = server.syncLDAPGroups()
+			if err != nil { fmt.Println("While synchronizing LDAP groups: " + err.Error()) }
+			if (added > 0) || (removed > 0) { fmt.Println(fmt.Sprintf(
+				"LDAP group synchronization added %d and removed %d group members", added, removed)) }
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+/*******************************************************************************
+ * Synchronize the groups of each realm with the directory. Each realm is
+ * synchronized in its own transaction. A realm that cannot be synchronized is
+ * logged and skipped. Return the numbers of members added and removed.
+ */
+func (server *Server) syncLDAPGroups() (int, int, error) {
+	
+	var groups, err = server.ldapClient.getGroups()
+	if err != nil { return 0, 0, err }
+	var dbClient *InMemClient
+	dbClient, err = NewInMemClient(server)
+	if err != nil { return 0, 0, err }
+	var realmIds []string
+	realmIds, err = dbClient.dbGetAllRealmIds()
+	dbClient.abort()
+	if err != nil { return 0, 0, err }
+	
+	var totalAdded, totalRemoved = 0, 0
+	for _, realmId := range realmIds {
+		dbClient, err = NewInMemClient(server)
+		if err != nil { return totalAdded, totalRemoved, err }
+		var realm Realm
+		var added, removed int
+		realm, err = dbClient.getRealm(realmId)
+		if err == nil { added, removed, err = syncLDAPGroupsForRealm(dbClient, realm, groups) }
+		if (err != nil) || ((added == 0) && (removed == 0)) {
+			dbClient.abort()
+			if err != nil { fmt.Println("While synchronizing LDAP groups of realm " + realmId + ": " + err.Error()) }
+			continue
+		}
+		err = dbClient.commit()
+		if err != nil {
+			fmt.Println("While synchronizing LDAP groups of realm " + realmId + ": " + err.Error())
+			continue
+		}
+		totalAdded = totalAdded + added
+		totalRemoved = totalRemoved + removed
+	}
+	return totalAdded, totalRemoved, nil
+}
+
+/*******************************************************************************
+ * Make the membership, among the realm's directory users, of each of the
+ * realm's groups that has the name of a directory group agree with the
+ * directory. Return the numbers of members added and removed.
+ */
+func syncLDAPGroupsForRealm(dbClient DBClient, realm Realm, groups []*LDAPGroup) (int, int, error) {
+	
+	// Identify the realm's directory users.
+	var usersByDN = make(map[string]User)
+	for _, userObjId := range realm.getUserObjIds() {
+		var user, err = dbClient.getUser(userObjId)
+		if err != nil { return 0, 0, err }
+		if user.getLDAPDN() != "" { usersByDN[strings.ToLower(user.getLDAPDN())] = user }
+	}
+	if len(usersByDN) == 0 { return 0, 0, nil }
+	
+	var added, removed = 0, 0
+	for _, ldapGroup := range groups {
+		var members = make(map[string]User)
+		for _, dn := range ldapGroup.MemberDNs {
+			var user = usersByDN[strings.ToLower(dn)]
+			if user != nil { members[user.getId()] = user }
+		}
+		
+		var group, err = realm.getGroupByName(dbClient, ldapGroup.Name)
+		if err != nil { return added, removed, err }
+		if group == nil {
+			if len(members) == 0 { continue }
+			group, err = dbClient.dbCreateGroup(realm.getId(), ldapGroup.Name,
+				"Synchronized from LDAP group " + ldapGroup.Name)
+			if err != nil { return added, removed, err }
+		}
+		
+		for _, user := range members {
+			if group.hasUserWithId(dbClient, user.getId()) { continue }
+			err = group.addUserId(dbClient, user.getId())
+			if err != nil { return added, removed, err }
+			added++
+		}
+		if ldapGroup.Truncated {
+			fmt.Println("Not removing members of group " + ldapGroup.Name +
+				", as not all of the members of the LDAP group could be retrieved")
+			continue
+		}
+		for _, user := range usersByDN {
+			if _, isMember := members[user.getId()]; isMember { continue }
+			if ! group.hasUserWithId(dbClient, user.getId()) { continue }
+			err = group.removeUser(dbClient, user)
+			if err != nil { return added, removed, err }
+			removed++
+		}
+	}
+	return added, removed, nil
+}
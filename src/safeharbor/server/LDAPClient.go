@@ -0,0 +1,628 @@
+/*******************************************************************************
+ * A minimal LDAP (version 3) client: just enough of the protocol (RFC 4511) to
+ * bind with a password and to search, which is all that LDAP authentication and
+ * group synchronization (see LDAP.go) require. Messages are encoded with the
+ * basic encoding rules (BER) of ASN.1. Search filters are given in the string
+ * form of RFC 4515; of the filter types, and, or, not, equality, and presence
+ * are supported.
+ *
+ * Each operation of LDAPClient uses its own connection, which is closed when
+ * the operation completes. Connections are always encrypted: an ldap://
+ * connection is upgraded with the StartTLS extended operation (RFC 4511, section
+ * 4.14) before any other request is sent. Each request, and each response, must
+ * be transferred within LDAPTimeout; a search may take longer in all.
+ *
+ * Searches retrieve their results in pages (RFC 2696), so that a server that
+ * limits the number of entries that a search returns - Active Directory returns
+ * at most 1000 - returns all of them. A server that does not support paging
+ * ignores the request for it.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+	
+	"utilities"
+)
+
+const (
+	LDAPTimeout = 10 * time.Second
+	MaxLDAPMessageSize = 16 * 1024 * 1024
+	LDAPPageSize = 500  // entries per page of a search; see search
+	
+	// BER identifier octets: class, constructed flag, and universal tags.
+	berApplication byte = 0x40
+	berContext byte = 0x80
+	berConstructed byte = 0x20
+	berTagBoolean byte = 0x01
+	berTagInteger byte = 0x02
+	berTagOctetString byte = 0x04
+	berTagEnumerated byte = 0x0a
+	berTagSequence byte = 0x10
+	berTagSet byte = 0x11
+	
+	// LDAP protocol operations, which are application tags.
+	ldapBindRequest byte = 0
+	ldapBindResponse byte = 1
+	ldapUnbindRequest byte = 2
+	ldapSearchRequest byte = 3
+	ldapSearchResultEntry byte = 4
+	ldapSearchResultDone byte = 5
+	ldapSearchResultReference byte = 19
+	ldapExtendedRequest byte = 23
+	ldapExtendedResponse byte = 24
+	
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+	ldapPagedResultsOID = "1.2.840.113556.1.4.319"
+	ldapControls byte = 0  // the context tag of the controls of a message
+	
+	// Filter choices, which are context tags.
+	ldapFilterAnd byte = 0
+	ldapFilterOr byte = 1
+	ldapFilterNot byte = 2
+	ldapFilterEqualityMatch byte = 3
+	ldapFilterPresent byte = 7
+	
+	ldapResultSuccess = 0
+	ldapResultInvalidCredentials = 49
+	ldapScopeBaseObject = 0
+	ldapScopeWholeSubtree = 2
+)
+
+type LDAPClient struct {
+	config *LDAPConfig
+}
+
+/*******************************************************************************
+ * An entry returned by a search. Attributes are keyed on the lower case
+ * attribute name, since attribute names are not case sensitive.
+ */
+type LDAPEntry struct {
+	DN string
+	Attributes map[string][]string
+}
+
+func NewLDAPClient(config *LDAPConfig) *LDAPClient {
+	return &LDAPClient{
+		config: config,
+	}
+}
+
+func (entry *LDAPEntry) getAttributeValues(name string) []string {
+	return entry.Attributes[strings.ToLower(name)]
+}
+
+/*******************************************************************************
+ * Return the first value of the attribute, or "" if it has none.
+ */
+func (entry *LDAPEntry) getAttribute(name string) string {
+	var values = entry.getAttributeValues(name)
+	if len(values) == 0 { return "" }
+	return values[0]
+}
+
+/*******************************************************************************
+ * An open connection to the LDAP server.
+ */
+type ldapConnection struct {
+	conn net.Conn
+	reader *bufio.Reader
+	nextMessageId int
+}
+
+/*******************************************************************************
+ * Connect to the server identified by the configured URL, which is either
+ * ldap://host[:port] or ldaps://host[:port]. An ldap:// connection is upgraded
+ * with StartTLS; if the server does not support it, the connection fails.
+ */
+func (client *LDAPClient) connect() (*ldapConnection, error) {
+	
+	var serverURL *url.URL
+	var err error
+	serverURL, err = url.Parse(client.config.URL)
+	if err != nil { return nil, utilities.ConstructServerError("LDAP URL is malformed: " + err.Error()) }
+	var host = serverURL.Host
+	var tlsConfig = &tls.Config{
+		ServerName: serverURL.Hostname(),
+		RootCAs: client.config.rootCAs,
+	}
+	var conn net.Conn
+	switch serverURL.Scheme {
+		case "ldap":
+			if serverURL.Port() == "" { host = host + ":389" }
+			conn, err = net.DialTimeout("tcp", host, LDAPTimeout)
+		case "ldaps":
+			if serverURL.Port() == "" { host = host + ":636" }
+			conn, err = tls.DialWithDialer(&net.Dialer{ Timeout: LDAPTimeout }, "tcp", host, tlsConfig)
+		default:
+			return nil, utilities.ConstructServerError("LDAP URL scheme must be ldap or ldaps")
+	}
+	if err != nil { return nil, utilities.ConstructServerError("When connecting to LDAP server: " + err.Error()) }
+	var lc = &ldapConnection{
+		conn: conn,
+		reader: bufio.NewReader(conn),
+		nextMessageId: 1,
+	}
+	if serverURL.Scheme == "ldap" {
+		err = lc.startTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return lc, nil
+}
+
+/*******************************************************************************
+ * Upgrade the connection to TLS, by means of the StartTLS extended operation.
+ * This must be done before any other request is sent.
+ */
+func (lc *ldapConnection) startTLS(tlsConfig *tls.Config) error {
+	
+	var messageId, err = lc.send(berConstruct(berApplication | ldapExtendedRequest,
+		berEncode(berContext | 0, []byte(ldapStartTLSOID))))
+	if err != nil { return err }
+	var op *berElement
+	op, err = lc.receive(messageId)
+	if err != nil { return err }
+	if ! op.isApplication(ldapExtendedResponse) { return utilities.ConstructServerError(
+		"Unexpected response from LDAP server to StartTLS request") }
+	var code int
+	var message string
+	code, message, err = getLDAPResult(op)
+	if err != nil { return err }
+	if code != ldapResultSuccess { return utilities.ConstructServerError(fmt.Sprintf(
+		"LDAP server refused StartTLS with result %d: %s", code, message)) }
+	
+	var tlsConn = tls.Client(lc.conn, tlsConfig)
+	err = tlsConn.Handshake()
+	if err != nil { return utilities.ConstructServerError("When starting TLS with LDAP server: " + err.Error()) }
+	lc.conn = tlsConn
+	lc.reader = bufio.NewReader(tlsConn)
+	return nil
+}
+
+func (lc *ldapConnection) close() {
+	lc.send(berEncode(berApplication | ldapUnbindRequest, []byte{}))
+	lc.conn.Close()
+}
+
+/*******************************************************************************
+ * Send a request, with the specified controls, if any, and return its message Id.
+ */
+func (lc *ldapConnection) send(op []byte, controls ...[]byte) (int, error) {
+	
+	var messageId = lc.nextMessageId
+	lc.nextMessageId++
+	var parts = [][]byte{ berInteger(berTagInteger, messageId), op }
+	if len(controls) > 0 { parts = append(parts, berConstruct(berContext | ldapControls, controls...)) }
+	lc.conn.SetDeadline(time.Now().Add(LDAPTimeout))
+	var _, err = lc.conn.Write(berConstruct(berTagSequence, parts...))
+	if err != nil { return 0, utilities.ConstructServerError("When writing to LDAP server: " + err.Error()) }
+	return messageId, nil
+}
+
+/*******************************************************************************
+ * Read the next response to the specified request, and return its protocol
+ * operation.
+ */
+func (lc *ldapConnection) receive(messageId int) (*berElement, error) {
+	
+	var msg, err = lc.receiveMessage(messageId)
+	if err != nil { return nil, err }
+	return msg.children[1], nil
+}
+
+/*******************************************************************************
+ * Read the next response to the specified request, and return the whole
+ * message, which includes the response's controls, if any.
+ */
+func (lc *ldapConnection) receiveMessage(messageId int) (*berElement, error) {
+	
+	lc.conn.SetDeadline(time.Now().Add(LDAPTimeout))
+	var msg, err = berRead(lc.reader)
+	if err != nil { return nil, utilities.ConstructServerError("When reading from LDAP server: " + err.Error()) }
+	if (msg.identifier != berConstructed | berTagSequence) || (len(msg.children) < 2) {
+		return nil, utilities.ConstructServerError("Malformed message from LDAP server")
+	}
+	var id = msg.children[0].asInt()
+	if id == 0 { return nil, utilities.ConstructServerError("LDAP server ended the connection") }
+	if id != messageId { return nil, utilities.ConstructServerError(fmt.Sprintf(
+		"LDAP server responded to message %d, but %d was expected", id, messageId)) }
+	return msg, nil
+}
+
+/*******************************************************************************
+ * Authenticate the connection as the specified DN. Return false if the server
+ * rejects the credentials, and an error if the bind fails for another reason.
+ */
+func (lc *ldapConnection) bind(dn, pswd string) (bool, error) {
+	
+	var messageId, err = lc.send(berConstruct(berApplication | ldapBindRequest,
+		berInteger(berTagInteger, 3),  // protocol version
+		berString(dn),
+		berEncode(berContext | 0, []byte(pswd))))  // simple authentication
+	if err != nil { return false, err }
+	var op *berElement
+	op, err = lc.receive(messageId)
+	if err != nil { return false, err }
+	if ! op.isApplication(ldapBindResponse) { return false, utilities.ConstructServerError(
+		"Unexpected response from LDAP server to bind request") }
+	var code int
+	var message string
+	code, message, err = getLDAPResult(op)
+	if err != nil { return false, err }
+	if code == ldapResultSuccess { return true, nil }
+	if code == ldapResultInvalidCredentials { return false, nil }
+	return false, utilities.ConstructServerError(fmt.Sprintf(
+		"LDAP bind failed with result %d: %s", code, message))
+}
+
+/*******************************************************************************
+ * Return each entry within the subtree rooted at the base DN that matches the
+ * filter, with the specified attributes. Referrals are not followed.
+ */
+func (lc *ldapConnection) search(baseDN, filter string, attributes []string) ([]*LDAPEntry, error) {
+	return lc.searchScope(baseDN, ldapScopeWholeSubtree, filter, attributes)
+}
+
+/*******************************************************************************
+ * Return each entry within the scope - the base DN itself, or the subtree rooted
+ * at it - that matches the filter, with the specified attributes. The entries are
+ * requested LDAPPageSize at a time, until the server returns no cookie with
+ * which to request more.
+ */
+func (lc *ldapConnection) searchScope(baseDN string, scope int, filter string,
+	attributes []string) ([]*LDAPEntry, error) {
+	
+	var encodedFilter, err = encodeLDAPFilter(filter)
+	if err != nil { return nil, err }
+	var attributeList = make([][]byte, 0)
+	for _, attribute := range attributes {
+		if attribute != "" { attributeList = append(attributeList, berString(attribute)) }
+	}
+	var request = berConstruct(berApplication | ldapSearchRequest,
+		berString(baseDN),
+		berInteger(berTagEnumerated, scope),
+		berInteger(berTagEnumerated, 0),  // never dereference aliases
+		berInteger(berTagInteger, 0),  // no size limit
+		berInteger(berTagInteger, 0),  // no time limit
+		berBoolean(false),  // return values, not just types
+		encodedFilter,
+		berConstruct(berTagSequence, attributeList...))
+	
+	var entries = make([]*LDAPEntry, 0)
+	var cookie = ""
+	for {
+		var messageId int
+		messageId, err = lc.send(request, newLDAPPagedResultsControl(LDAPPageSize, cookie))
+		if err != nil { return nil, err }
+		for {
+			var msg *berElement
+			msg, err = lc.receiveMessage(messageId)
+			if err != nil { return nil, err }
+			var op = msg.children[1]
+			if op.isApplication(ldapSearchResultEntry) {
+				var entry *LDAPEntry
+				entry, err = parseLDAPEntry(op)
+				if err != nil { return nil, err }
+				entries = append(entries, entry)
+			} else if op.isApplication(ldapSearchResultReference) {
+				continue
+			} else if op.isApplication(ldapSearchResultDone) {
+				var code int
+				var message string
+				code, message, err = getLDAPResult(op)
+				if err != nil { return nil, err }
+				if code != ldapResultSuccess { return nil, utilities.ConstructServerError(fmt.Sprintf(
+					"LDAP search failed with result %d: %s", code, message)) }
+				cookie, err = getLDAPPagedResultsCookie(msg)
+				if err != nil { return nil, err }
+				break
+			} else {
+				return nil, utilities.ConstructServerError("Unexpected response from LDAP server to search request")
+			}
+		}
+		if cookie == "" { return entries, nil }
+	}
+}
+
+/*******************************************************************************
+ * Return a paged results control (RFC 2696), which requests the page that
+ * follows the one that the server identified with the cookie - or, if the
+ * cookie is "", the first page.
+ */
+func newLDAPPagedResultsControl(pageSize int, cookie string) []byte {
+	return berConstruct(berTagSequence,
+		berString(ldapPagedResultsOID),
+		berBoolean(false),  // not critical: a server that does not support paging returns every entry
+		berString(string(berConstruct(berTagSequence,
+			berInteger(berTagInteger, pageSize), berString(cookie)))))
+}
+
+/*******************************************************************************
+ * Return the cookie of the paged results control of a SearchResultDone message,
+ * or "" if there is no such control, or no more pages.
+ */
+func getLDAPPagedResultsCookie(msg *berElement) (string, error) {
+	
+	if len(msg.children) < 3 { return "", nil }
+	for _, control := range msg.children[2].children {
+		if (len(control.children) < 2) || (control.children[0].asString() != ldapPagedResultsOID) { continue }
+		var value = control.children[len(control.children)-1]  // the criticality is optional
+		var pagedResults, _, err = berDecode(value.content)
+		if (err != nil) || (len(pagedResults.children) < 2) {
+			return "", utilities.ConstructServerError("Malformed paged results control from LDAP server")
+		}
+		return pagedResults.children[1].asString(), nil
+	}
+	return "", nil
+}
+
+/*******************************************************************************
+ * Return the result code and diagnostic message of an LDAPResult.
+ */
+func getLDAPResult(op *berElement) (int, string, error) {
+	if len(op.children) < 3 { return 0, "", utilities.ConstructServerError(
+		"Malformed result from LDAP server") }
+	return op.children[0].asInt(), op.children[2].asString(), nil
+}
+
+func parseLDAPEntry(op *berElement) (*LDAPEntry, error) {
+	
+	if len(op.children) < 2 { return nil, utilities.ConstructServerError(
+		"Malformed search result entry from LDAP server") }
+	var entry = &LDAPEntry{
+		DN: op.children[0].asString(),
+		Attributes: make(map[string][]string),
+	}
+	for _, attribute := range op.children[1].children {
+		if len(attribute.children) < 2 { return nil, utilities.ConstructServerError(
+			"Malformed attribute in search result entry from LDAP server") }
+		var values = make([]string, 0)
+		for _, value := range attribute.children[1].children { values = append(values, value.asString()) }
+		entry.Attributes[strings.ToLower(attribute.children[0].asString())] = values
+	}
+	return entry, nil
+}
+
+/****************************** Search filters ********************************/
+
+/*******************************************************************************
+ * Encode a search filter, given in the string form of RFC 4515.
+ */
+func encodeLDAPFilter(filter string) ([]byte, error) {
+	
+	var encoded, rest, err = parseLDAPFilter(strings.TrimSpace(filter))
+	if err != nil { return nil, err }
+	if rest != "" { return nil, utilities.ConstructServerError("LDAP filter has trailing characters: " + filter) }
+	return encoded, nil
+}
+
+/*******************************************************************************
+ * Encode the filter at the start of the string, and return the rest of the string.
+ */
+func parseLDAPFilter(filter string) ([]byte, string, error) {
+	
+	var malformed = utilities.ConstructServerError("Malformed LDAP filter: " + filter)
+	if ! strings.HasPrefix(filter, "(") || (len(filter) < 2) { return nil, "", malformed }
+	filter = filter[1:]
+	switch filter[0] {
+		case '&', '|':
+			var tag = ldapFilterAnd
+			if filter[0] == '|' { tag = ldapFilterOr }
+			filter = filter[1:]
+			var children = make([][]byte, 0)
+			for strings.HasPrefix(filter, "(") {
+				var child []byte
+				var err error
+				child, filter, err = parseLDAPFilter(filter)
+				if err != nil { return nil, "", err }
+				children = append(children, child)
+			}
+			if ! strings.HasPrefix(filter, ")") { return nil, "", malformed }
+			return berConstruct(berContext | tag, children...), filter[1:], nil
+		case '!':
+			var child, rest, err = parseLDAPFilter(filter[1:])
+			if err != nil { return nil, "", err }
+			if ! strings.HasPrefix(rest, ")") { return nil, "", malformed }
+			return berConstruct(berContext | ldapFilterNot, child), rest[1:], nil
+	}
+	
+	var end = strings.Index(filter, ")")
+	if end < 0 { return nil, "", malformed }
+	var item = filter[:end]
+	var equals = strings.Index(item, "=")
+	if equals <= 0 { return nil, "", malformed }
+	var attribute = item[:equals]
+	var value = item[equals+1:]
+	if strings.ContainsAny(attribute, "~<>:") { return nil, "", utilities.ConstructServerError(
+		"Only equality and presence LDAP filters are supported: " + item) }
+	if value == "*" { return berEncode(berContext | ldapFilterPresent, []byte(attribute)), filter[end+1:], nil }
+	if strings.Contains(value, "*") { return nil, "", utilities.ConstructServerError(
+		"Substring LDAP filters are not supported: " + item) }
+	var decoded, err = unescapeLDAPFilterValue(value)
+	if err != nil { return nil, "", err }
+	return berConstruct(berContext | ldapFilterEqualityMatch, berString(attribute),
+		berEncode(berTagOctetString, decoded)), filter[end+1:], nil
+}
+
+/*******************************************************************************
+ * Escape the characters of the value that are special in a search filter, so
+ * that the value may be inserted into a filter (RFC 4515, section 3).
+ */
+func escapeLDAPFilterValue(value string) string {
+	var escaped = ""
+	for i := 0; i < len(value); i++ {
+		var c = value[i]
+		if (c == '*') || (c == '(') || (c == ')') || (c == '\\') || (c == 0) {
+			escaped = escaped + fmt.Sprintf("\\%02x", c)
+		} else {
+			escaped = escaped + string(c)
+		}
+	}
+	return escaped
+}
+
+func unescapeLDAPFilterValue(value string) ([]byte, error) {
+	var decoded = make([]byte, 0)
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			decoded = append(decoded, value[i])
+			continue
+		}
+		if i + 2 >= len(value) { return nil, utilities.ConstructServerError(
+			"Malformed escape in LDAP filter value: " + value) }
+		var b, err = hex.DecodeString(value[i+1:i+3])
+		if err != nil { return nil, utilities.ConstructServerError(
+			"Malformed escape in LDAP filter value: " + value) }
+		decoded = append(decoded, b[0])
+		i = i + 2
+	}
+	return decoded, nil
+}
+
+/********************************* BER ****************************************/
+
+/*******************************************************************************
+ * A decoded BER element. Only single octet tags are supported, which suffice
+ * for LDAP.
+ */
+type berElement struct {
+	identifier byte  // class, constructed flag, and tag
+	content []byte
+	children []*berElement  // if constructed
+}
+
+func (elt *berElement) isApplication(tag byte) bool {
+	return (elt.identifier & 0xc0 == berApplication) && (elt.identifier & 0x1f == tag)
+}
+
+func (elt *berElement) asString() string {
+	return string(elt.content)
+}
+
+/*******************************************************************************
+ * Return the value of a non-negative integer or enumerated element.
+ */
+func (elt *berElement) asInt() int {
+	var n = 0
+	for _, b := range elt.content { n = (n << 8) | int(b) }
+	return n
+}
+
+func berEncode(identifier byte, content []byte) []byte {
+	var encoded = []byte{ identifier }
+	var length = len(content)
+	if length < 0x80 {
+		encoded = append(encoded, byte(length))
+	} else {
+		var lengthBytes = make([]byte, 0)
+		for n := length; n > 0; n = n >> 8 { lengthBytes = append([]byte{ byte(n) }, lengthBytes...) }
+		encoded = append(encoded, 0x80 | byte(len(lengthBytes)))
+		encoded = append(encoded, lengthBytes...)
+	}
+	return append(encoded, content...)
+}
+
+func berConstruct(identifier byte, children ...[]byte) []byte {
+	var content = make([]byte, 0)
+	for _, child := range children { content = append(content, child...) }
+	return berEncode(identifier | berConstructed, content)
+}
+
+func berString(s string) []byte {
+	return berEncode(berTagOctetString, []byte(s))
+}
+
+/*******************************************************************************
+ * Encode a non-negative integer, in the fewest octets.
+ */
+func berInteger(identifier byte, n int) []byte {
+	var content = []byte{ byte(n) }
+	for n = n >> 8; n > 0; n = n >> 8 { content = append([]byte{ byte(n) }, content...) }
+	if content[0] & 0x80 != 0 { content = append([]byte{ 0 }, content...) }
+	return berEncode(identifier, content)
+}
+
+func berBoolean(b bool) []byte {
+	if b { return berEncode(berTagBoolean, []byte{ 0xff }) }
+	return berEncode(berTagBoolean, []byte{ 0 })
+}
+
+/*******************************************************************************
+ * Decode the element at the start of the data, and return it and its length.
+ */
+func berDecode(data []byte) (*berElement, int, error) {
+	
+	var truncated = utilities.ConstructServerError("Truncated BER element")
+	if len(data) < 2 { return nil, 0, truncated }
+	var identifier = data[0]
+	if identifier & 0x1f == 0x1f { return nil, 0, utilities.ConstructServerError(
+		"Multiple octet BER tags are not supported") }
+	var length = int(data[1])
+	var pos = 2
+	if length & 0x80 != 0 {
+		var n = length & 0x7f
+		if (n == 0) || (n > 4) { return nil, 0, utilities.ConstructServerError(
+			"Unsupported BER length encoding") }
+		if len(data) < pos + n { return nil, 0, truncated }
+		length = 0
+		for _, b := range data[pos:pos+n] { length = (length << 8) | int(b) }
+		pos = pos + n
+	}
+	if (length < 0) || (len(data) < pos + length) { return nil, 0, truncated }
+	
+	var elt = &berElement{ identifier: identifier, content: data[pos:pos+length] }
+	if identifier & berConstructed != 0 {
+		var rest = elt.content
+		for len(rest) > 0 {
+			var child, n, err = berDecode(rest)
+			if err != nil { return nil, 0, err }
+			elt.children = append(elt.children, child)
+			rest = rest[n:]
+		}
+	}
+	return elt, pos + length, nil
+}
+
+/*******************************************************************************
+ * Read one complete element from the stream.
+ */
+func berRead(reader *bufio.Reader) (*berElement, error) {
+	
+	var header = make([]byte, 2)
+	var _, err = io.ReadFull(reader, header)
+	if err != nil { return nil, err }
+	var length = int(header[1])
+	if length & 0x80 != 0 {
+		var n = length & 0x7f
+		if (n == 0) || (n > 4) { return nil, utilities.ConstructServerError(
+			"Unsupported BER length encoding") }
+		var lengthBytes = make([]byte, n)
+		_, err = io.ReadFull(reader, lengthBytes)
+		if err != nil { return nil, err }
+		header = append(header, lengthBytes...)
+		length = 0
+		for _, b := range lengthBytes { length = (length << 8) | int(b) }
+	}
+	if (length < 0) || (length > MaxLDAPMessageSize) { return nil, utilities.ConstructServerError(
+		"LDAP message is too large") }
+	var content = make([]byte, length)
+	_, err = io.ReadFull(reader, content)
+	if err != nil { return nil, err }
+	var elt *berElement
+	elt, _, err = berDecode(append(header, content...))
+	return elt, err
+}
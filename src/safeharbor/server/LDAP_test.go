@@ -0,0 +1,427 @@
+package server
+
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*******************************************************************************
+ * These tests run LDAPClient against an in-process stand-in for an LDAP
+ * server, which supports StartTLS, simple binds and searches of a small
+ * directory. Like a directory that requires confidentiality, it refuses binds
+ * over an unencrypted connection. Like Active Directory, it can be made to
+ * return a few entries per page, and a few values of an attribute per range.
+ */
+
+const (
+	ldapResultOperationsError = 1
+	ldapResultConfidentialityRequired = 13
+	
+	testBaseDN = "dc=example,dc=com"
+	testServiceDN = "cn=admin,dc=example,dc=com"
+	testAliceDN = "uid=alice,ou=people,dc=example,dc=com"
+	testBobDN = "uid=bob,ou=people,dc=example,dc=com"
+	testDevelopersDN = "cn=developers,ou=groups,dc=example,dc=com"
+	testAuditorsDN = "cn=auditors,ou=groups,dc=example,dc=com"
+)
+
+func Test_LDAPUsersAreProvisionedAndTheirGroupsSynchronized(testContext *testing.T) {
+	
+	var directory = newTestDirectory(testContext)
+	var f = newTestDB(testContext)
+	var ldapClient = newTestLDAPClient(directory, f)
+	
+	for _, pswd := range []string{ "wrong", "" } {
+		var user, err = authenticateLDAPUser(f.client, ldapClient, "alice", pswd)
+		if err != nil { testContext.Fatal(err) }
+		if user != nil { testContext.Errorf("Expected password %q to be rejected", pswd) }
+	}
+	// A certificate that is not trusted is refused.
+	var untrusting = *ldapClient.config
+	untrusting.rootCAs = x509.NewCertPool()
+	var _, err = authenticateLDAPUser(f.client, NewLDAPClient(&untrusting), "alice", "wonderland")
+	if err == nil { testContext.Error("Expected a directory with an untrusted certificate to be refused") }
+	
+	var user User
+	user, err = authenticateLDAPUser(f.client, ldapClient, "*", "wonderland")
+	if err != nil { testContext.Fatal(err) }
+	if user != nil { testContext.Error("Expected the user Id to be escaped in the filter") }
+	
+	var alice User
+	alice, err = authenticateLDAPUser(f.client, ldapClient, "alice", "wonderland")
+	if err != nil { testContext.Fatal(err) }
+	if alice == nil { testContext.Fatal("Expected alice to be authenticated") }
+	if (alice.getLDAPDN() != testAliceDN) || (alice.getRealmId() != f.realm.getId()) ||
+		(alice.getName() != "Alice Liddell") || ! alice.emailIsVerified() {
+		testContext.Error("Expected alice to be provisioned from her directory entry")
+	}
+	expectMembership(testContext, f, alice, "developers", true)
+	expectMembership(testContext, f, alice, "auditors", false)
+	
+	// A local member of a synchronized group is left alone.
+	var developers Group
+	developers, err = f.realm.getGroupByName(f.client, "developers")
+	if err != nil { testContext.Fatal(err) }
+	err = developers.addUserId(f.client, f.user.getId())
+	if err != nil { testContext.Fatal(err) }
+	
+	directory.setMembers(testDevelopersDN, testBobDN)
+	directory.setMembers(testAuditorsDN, testAliceDN, testBobDN)
+	var groups []*LDAPGroup
+	groups, err = ldapClient.getGroups()
+	if err != nil { testContext.Fatal(err) }
+	var added, removed int
+	added, removed, err = syncLDAPGroupsForRealm(f.client, f.realm, groups)
+	if err != nil { testContext.Fatal(err) }
+	if (added != 1) || (removed != 1) {
+		testContext.Errorf("Expected one member added and one removed, but got %d and %d", added, removed)
+	}
+	expectMembership(testContext, f, alice, "developers", false)
+	expectMembership(testContext, f, alice, "auditors", true)
+	expectMembership(testContext, f, f.user, "developers", true)
+}
+
+func Test_LDAPSearchesArePagedAndRangedMembersRetrieved(testContext *testing.T) {
+	
+	var directory = newTestDirectory(testContext)
+	directory.pageSize = 1
+	directory.maxValues = 1
+	var f = newTestDB(testContext)
+	var ldapClient = newTestLDAPClient(directory, f)
+	directory.setMembers(testDevelopersDN, testAliceDN, testBobDN)
+	
+	var groups, err = ldapClient.getGroups()
+	if err != nil { testContext.Fatal(err) }
+	if len(groups) != 2 { testContext.Fatalf("Expected both groups over two pages, but got %d", len(groups)) }
+	for _, group := range groups {
+		if group.Truncated { testContext.Errorf("Expected all members of %s to be retrieved", group.Name) }
+		if (group.Name == "developers") && (len(group.MemberDNs) != 2) {
+			testContext.Errorf("Expected both ranges of members of developers, but got %v", group.MemberDNs)
+		}
+	}
+	
+	// If a directory does not return the remaining ranges, no member is removed.
+	var alice User
+	alice, err = authenticateLDAPUser(f.client, ldapClient, "alice", "wonderland")
+	if err != nil { testContext.Fatal(err) }
+	if alice == nil { testContext.Fatal("Expected alice to be authenticated") }
+	expectMembership(testContext, f, alice, "developers", true)
+	directory.setMembers(testDevelopersDN, testBobDN, testAliceDN)
+	directory.omitRanges = true
+	groups, err = ldapClient.getGroups()
+	if err != nil { testContext.Fatal(err) }
+	var removed int
+	_, removed, err = syncLDAPGroupsForRealm(f.client, f.realm, groups)
+	if err != nil { testContext.Fatal(err) }
+	if removed != 0 { testContext.Errorf("Expected no member to be removed from a truncated group, but got %d", removed) }
+	expectMembership(testContext, f, alice, "developers", true)
+}
+
+func newTestLDAPClient(directory *testDirectory, f *testDB) *LDAPClient {
+	return NewLDAPClient(&LDAPConfig{
+		URL: "ldap://" + directory.listener.Addr().String(),
+		BindDN: testServiceDN,
+		BindPassword: "secret",
+		UserBaseDN: "ou=people," + testBaseDN,
+		UserFilter: DefaultLDAPUserFilter,
+		UserNameAttribute: "cn",
+		EmailAttribute: "mail",
+		GroupBaseDN: "ou=groups," + testBaseDN,
+		GroupFilter: DefaultLDAPGroupFilter,
+		GroupNameAttribute: "cn",
+		GroupMemberAttribute: "member",
+		Realm: f.realm.getName(),
+		rootCAs: directory.rootCAs,
+	})
+}
+
+func expectMembership(testContext *testing.T, f *testDB, user User,
+	groupName string, expected bool) {
+	
+	var group, err = f.realm.getGroupByName(f.client, groupName)
+	if err != nil { testContext.Fatal(err) }
+	user, err = f.client.getUser(user.getId())
+	if err != nil { testContext.Fatal(err) }
+	var isMember = (group != nil) && group.hasUserWithId(f.client, user.getId())
+	var listed = false
+	for _, id := range user.getGroupIds() {
+		if (group != nil) && (id == group.getId()) { listed = true }
+	}
+	if (isMember != expected) || (listed != expected) {
+		testContext.Errorf("Expected membership of %s in %s to be %v", user.getUserId(), groupName, expected)
+	}
+}
+
+/*******************************************************************************
+ * The stand-in LDAP server.
+ */
+type testDirectory struct {
+	listener net.Listener
+	tlsConfig *tls.Config
+	rootCAs *x509.CertPool  // trusts the directory's certificate
+	lock sync.Mutex
+	entries map[string]map[string][]string  // attributes of each DN
+	passwords map[string]string
+	pageSize int  // if not 0, the most entries returned per page
+	maxValues int  // if not 0, the most values of an attribute returned per range
+	omitRanges bool  // if requests for a range of values are ignored
+}
+
+func newTestDirectory(testContext *testing.T) *testDirectory {
+	
+	var listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { testContext.Fatal(err) }
+	testContext.Cleanup(func() { listener.Close() })
+	var certificate tls.Certificate
+	var rootCAs *x509.CertPool
+	certificate, rootCAs = newTestCertificate(testContext)
+	var directory = &testDirectory{
+		listener: listener,
+		tlsConfig: &tls.Config{ Certificates: []tls.Certificate{ certificate } },
+		rootCAs: rootCAs,
+		entries: map[string]map[string][]string{
+			testAliceDN: { "objectClass": { "inetOrgPerson" }, "uid": { "alice" },
+				"cn": { "Alice Liddell" }, "mail": { "alice@example.com" } },
+			testBobDN: { "objectClass": { "inetOrgPerson" }, "uid": { "bob" },
+				"cn": { "Bob Cratchit" }, "mail": { "bob@example.com" } },
+			testDevelopersDN: { "objectClass": { "groupOfNames" }, "cn": { "developers" },
+				"member": { testAliceDN } },
+			testAuditorsDN: { "objectClass": { "groupOfNames" }, "cn": { "auditors" },
+				"member": { testBobDN } },
+		},
+		passwords: map[string]string{
+			testServiceDN: "secret",
+			testAliceDN: "wonderland",
+			testBobDN: "humbug",
+		},
+	}
+	go func() {
+		for {
+			var conn, err = listener.Accept()
+			if err != nil { return }
+			go directory.serve(conn)
+		}
+	}()
+	return directory
+}
+
+/*******************************************************************************
+ * Create a self-signed certificate for 127.0.0.1, and a pool that trusts it.
+ */
+func newTestCertificate(testContext *testing.T) (tls.Certificate, *x509.CertPool) {
+	
+	var key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil { testContext.Fatal(err) }
+	var template = &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IPAddresses: []net.IP{ net.ParseIP("127.0.0.1") },
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{ x509.ExtKeyUsageServerAuth },
+		BasicConstraintsValid: true,
+		IsCA: true,
+	}
+	var der []byte
+	der, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil { testContext.Fatal(err) }
+	var parsed *x509.Certificate
+	parsed, err = x509.ParseCertificate(der)
+	if err != nil { testContext.Fatal(err) }
+	var pool = x509.NewCertPool()
+	pool.AddCert(parsed)
+	return tls.Certificate{ Certificate: [][]byte{ der }, PrivateKey: key }, pool
+}
+
+func (directory *testDirectory) setMembers(groupDN string, memberDNs ...string) {
+	directory.lock.Lock()
+	defer directory.lock.Unlock()
+	directory.entries[groupDN]["member"] = memberDNs
+}
+
+func (directory *testDirectory) serve(conn net.Conn) {
+	
+	defer func() { conn.Close() }()
+	var reader = bufio.NewReader(conn)
+	var encrypted = false
+	for {
+		var msg, err = berRead(reader)
+		if err != nil { return }
+		var messageId = msg.children[0].asInt()
+		var op = msg.children[1]
+		var respond = func(response []byte) {
+			conn.Write(berConstruct(berTagSequence, berInteger(berTagInteger, messageId), response))
+		}
+		if op.isApplication(ldapUnbindRequest) { return }
+		if op.isApplication(ldapExtendedRequest) {
+			var code = ldapResultSuccess
+			if encrypted || (op.children[0].asString() != ldapStartTLSOID) { code = ldapResultOperationsError }
+			respond(berConstruct(berApplication | ldapExtendedResponse,
+				berInteger(berTagEnumerated, code), berString(""), berString("")))
+			if code != ldapResultSuccess { continue }
+			var tlsConn = tls.Server(conn, directory.tlsConfig)
+			if tlsConn.Handshake() != nil { return }
+			conn = tlsConn
+			reader = bufio.NewReader(conn)
+			encrypted = true
+			continue
+		}
+		if op.isApplication(ldapBindRequest) && ! encrypted {
+			respond(berConstruct(berApplication | ldapBindResponse,
+				berInteger(berTagEnumerated, ldapResultConfidentialityRequired), berString(""), berString("")))
+			continue
+		}
+		if op.isApplication(ldapBindRequest) {
+			var dn = op.children[1].asString()
+			var pswd = op.children[2].asString()
+			var code = ldapResultInvalidCredentials
+			directory.lock.Lock()
+			if (pswd != "") && (directory.passwords[dn] == pswd) { code = ldapResultSuccess }
+			if (dn == "") && (pswd == "") { code = ldapResultSuccess }  // anonymous
+			directory.lock.Unlock()
+			respond(berConstruct(berApplication | ldapBindResponse,
+				berInteger(berTagEnumerated, code), berString(""), berString("")))
+			continue
+		}
+		if op.isApplication(ldapSearchRequest) {
+			var baseDN = strings.ToLower(op.children[0].asString())
+			var scope = op.children[1].asInt()
+			var filter = op.children[6]
+			var requested = make([]string, 0)
+			for _, attribute := range op.children[7].children {
+				requested = append(requested, attribute.asString())
+			}
+			var pageSize, offset = getTestPagedResultsControl(msg)
+			directory.lock.Lock()
+			var dns = make([]string, 0)
+			for dn, attributes := range directory.entries {
+				if (scope == ldapScopeBaseObject) && (strings.ToLower(dn) != baseDN) { continue }
+				if ! strings.HasSuffix(strings.ToLower(dn), baseDN) { continue }
+				if ! matchesTestFilter(filter, attributes) { continue }
+				dns = append(dns, dn)
+			}
+			sort.Strings(dns)
+			if (directory.pageSize > 0) && ((pageSize == 0) || (pageSize > directory.pageSize)) {
+				pageSize = directory.pageSize
+			}
+			var cookie = ""
+			if offset > len(dns) { offset = len(dns) }
+			dns = dns[offset:]
+			if (pageSize > 0) && (len(dns) > pageSize) {
+				dns = dns[:pageSize]
+				cookie = strconv.Itoa(offset + pageSize)
+			}
+			for _, dn := range dns {
+				var attributeList = make([][]byte, 0)
+				for _, name := range requested {
+					var returnedName, values = directory.getTestAttributeValues(dn, name)
+					if returnedName == "" { continue }
+					var encoded = make([][]byte, 0)
+					for _, value := range values { encoded = append(encoded, berString(value)) }
+					attributeList = append(attributeList, berConstruct(berTagSequence,
+						berString(returnedName), berConstruct(berTagSet, encoded...)))
+				}
+				respond(berConstruct(berApplication | ldapSearchResultEntry, berString(dn),
+					berConstruct(berTagSequence, attributeList...)))
+			}
+			directory.lock.Unlock()
+			var done = berConstruct(berApplication | ldapSearchResultDone,
+				berInteger(berTagEnumerated, ldapResultSuccess), berString(""), berString(""))
+			if pageSize == 0 {
+				respond(done)
+				continue
+			}
+			conn.Write(berConstruct(berTagSequence, berInteger(berTagInteger, messageId), done,
+				berConstruct(berContext | ldapControls, berConstruct(berTagSequence,
+					berString(ldapPagedResultsOID),
+					berString(string(berConstruct(berTagSequence,
+						berInteger(berTagInteger, 0), berString(cookie))))))))
+			continue
+		}
+		return
+	}
+}
+
+/*******************************************************************************
+ * Return the page size and the offset, from the cookie, of the paged results
+ * control of a search request, or 0 and 0 if there is no such control.
+ */
+func getTestPagedResultsControl(msg *berElement) (int, int) {
+	
+	if len(msg.children) < 3 { return 0, 0 }
+	for _, control := range msg.children[2].children {
+		if control.children[0].asString() != ldapPagedResultsOID { continue }
+		var value, _, err = berDecode(control.children[len(control.children)-1].content)
+		if err != nil { return 0, 0 }
+		var offset, _ = strconv.Atoi(value.children[1].asString())
+		return value.children[0].asInt(), offset
+	}
+	return 0, 0
+}
+
+/*******************************************************************************
+ * Return the name under which to return the requested attribute of the entry -
+ * for a range of values, such as member;range=0-0 - and its values; or "" if
+ * the attribute is not to be returned. The directory's lock must be held.
+ */
+func (directory *testDirectory) getTestAttributeValues(dn, requested string) (string, []string) {
+	
+	var name = requested
+	var start = 0
+	var ranged = false
+	if parts := strings.SplitN(requested, ";range=", 2); len(parts) == 2 {
+		if directory.omitRanges { return "", nil }
+		name = parts[0]
+		start, _ = strconv.Atoi(strings.TrimSuffix(parts[1], "-*"))
+		ranged = true
+	}
+	var values = directory.entries[dn][name]
+	if start > len(values) { start = len(values) }
+	values = values[start:]
+	if (directory.maxValues > 0) && (len(values) > directory.maxValues) {
+		return fmt.Sprintf("%s;range=%d-%d", name, start, start + directory.maxValues - 1),
+			values[:directory.maxValues]
+	}
+	if ranged { return fmt.Sprintf("%s;range=%d-*", name, start), values }
+	return name, values
+}
+
+func matchesTestFilter(filter *berElement, attributes map[string][]string) bool {
+	
+	switch filter.identifier & 0x1f {
+		case ldapFilterAnd:
+			for _, child := range filter.children {
+				if ! matchesTestFilter(child, attributes) { return false }
+			}
+			return true
+		case ldapFilterOr:
+			for _, child := range filter.children {
+				if matchesTestFilter(child, attributes) { return true }
+			}
+			return false
+		case ldapFilterNot:
+			return ! matchesTestFilter(filter.children[0], attributes)
+		case ldapFilterEqualityMatch:
+			for _, value := range attributes[filter.children[0].asString()] {
+				if strings.EqualFold(value, filter.children[1].asString()) { return true }
+			}
+			return false
+		case ldapFilterPresent:
+			return len(attributes[filter.asString()]) > 0
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+/*******************************************************************************
+ * Lockout of user accounts after repeated failed logins. When
+ * MaxLoginAttemptsToRetain logins for a user fail within LoginFailureWindow, the
+ * account is locked, and the user and the administrator of the user's realm are
+ * notified by email. The first lockout lasts InitialLockoutDuration, and each
+ * subsequent lockout, until the user logs in successfully, lasts twice as long
+ * as the one before, up to MaxLockoutDuration. An administrator of the realm can
+ * end a lockout early (see the unlockUser handler).
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	LoginFailureWindow = 600 * time.Second
+	InitialLockoutDuration = 60 * time.Second
+	MaxLockoutDuration = 24 * time.Hour
+)
+
+/*******************************************************************************
+ * Return how long the account is locked for its lockoutCount'th lockout.
+ */
+func getLockoutDuration(lockoutCount int) time.Duration {
+	
+	var duration = InitialLockoutDuration
+	for i := 1; i < lockoutCount; i++ {
+		duration = duration * 2
+		if duration >= MaxLockoutDuration { return MaxLockoutDuration }
+	}
+	return duration
+}
+
+/*******************************************************************************
+ * Record a failed login for the user, in a transaction of its own: the
+ * transaction of the authenticate request is aborted, because the request fails.
+ * If the failure locks the account, notify the user and the realm administrator.
+ * Return true if the account is now locked.
+ */
+func (server *Server) recordFailedLoginAttempt(userObjId string) (bool, error) {
+	
+	var locked bool
+	var user User
+	var err = server.performInTransaction("failed login", func(dbClient *InMemClient) (bool, error) {
+		var err error
+		user, err = dbClient.getUser(userObjId)
+		if err != nil { return false, err }
+		locked, err = user.recordFailedLogin(dbClient, time.Now())
+		return true, err
+	})
+	if err != nil { return false, err }
+	
+	if locked { server.LoginAlert(user) }
+	return locked, nil
+}
+
+/*******************************************************************************
+ * Send the messages that notify the user, and the administrator of the user's
+ * realm, that the user's account has been locked, by adding them to the email
+ * outbox in a transaction of their own. Failures are logged, but are otherwise
+ * ignored.
+ */
+func (server *Server) sendLockoutNotifications(user User) {
+	
+	var dbClient *InMemClient
+	var err error
+	dbClient, err = NewInMemClient(server)
+	if err != nil { fmt.Println(err.Error()); return }
+	
+	// Each recipient receives the message in the recipient's own locale.
+	var recipients = []User{ user }
+	var realmName string
+	var realm Realm
+	realm, err = dbClient.getRealm(user.getRealmId())
+	if err != nil { fmt.Println(err.Error()) }
+	if realm != nil {
+		realmName = realm.getName()
+		var admin User
+		admin, err = dbClient.dbGetUserByUserId(realm.getAdminUserId())
+		if err != nil { fmt.Println(err.Error()) }
+		if (admin != nil) && (admin.getId() != user.getId()) {
+			recipients = append(recipients, admin)
+		}
+	}
+	
+	for _, recipient := range recipients {
+		if recipient.getEmailAddress() == "" { continue }
+		var vars = newEmailVariables(server, recipient, realmName)
+		vars["LockedUserId"] = user.getUserId()
+		vars["LockedUntil"] = user.getLockedUntil().Format(time.RFC1123)
+		err = queueTemplatedEmail(dbClient, recipient.getEmailAddress(),
+			AccountLockedTemplate, recipient, realmName, vars)
+		if err != nil {
+			fmt.Println("While sending lockout notification: " + err.Error())
+			dbClient.abort()
+			return
+		}
+	}
+	err = dbClient.commit()
+	if err != nil { fmt.Println("While sending lockout notification: " + err.Error()) }
+}
@@ -0,0 +1,44 @@
+package server
+
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_RepeatedFailedLoginsLockTheAccountForLongerEachTime(testContext *testing.T) {
+	
+	var f = newTestDB(testContext)
+	var now = time.Now()
+	var locked bool
+	var err error
+	for i := 1; i <= f.server.MaxLoginAttemptsToRetain; i++ {
+		locked, err = f.user.recordFailedLogin(f.client, now)
+		if err != nil { testContext.Fatal(err) }
+		if locked != (i == f.server.MaxLoginAttemptsToRetain) {
+			testContext.Fatalf("After %d failures, expected locked=%v", i, ! locked)
+		}
+	}
+	if f.user.getLockedUntil() != now.Add(InitialLockoutDuration) {
+		testContext.Errorf("Expected the first lockout to last %v", InitialLockoutDuration)
+	}
+	if ! f.user.isLockedOut(now) { testContext.Error("Expected the account to be locked") }
+	
+	err = f.user.unlock(f.client)
+	if err != nil { testContext.Fatal(err) }
+	if f.user.isLockedOut(now) { testContext.Error("Expected unlock to end the lockout") }
+	for i := 1; i <= f.server.MaxLoginAttemptsToRetain; i++ {
+		_, err = f.user.recordFailedLogin(f.client, now)
+		if err != nil { testContext.Fatal(err) }
+	}
+	if f.user.getLockedUntil() != now.Add(2 * InitialLockoutDuration) {
+		testContext.Error("Expected the second lockout to last twice as long as the first")
+	}
+	
+	err = f.user.unlock(f.client)
+	if err != nil { testContext.Fatal(err) }
+	err = f.user.recordSuccessfulLogin(f.client)
+	if err != nil { testContext.Fatal(err) }
+	if f.user.getLockoutCount() != 0 { testContext.Error("Expected a successful login to reset the lockout count") }
+	if getLockoutDuration(1000) != MaxLockoutDuration { testContext.Error("Expected lockouts to be capped") }
+}
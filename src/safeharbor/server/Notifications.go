@@ -0,0 +1,538 @@
+/*******************************************************************************
+ * Notifications of scan and build outcomes. A user may subscribe to a realm, a
+ * repo, or an image, for any of the event types listed in NotificationEventTypes;
+ * a subscription to a realm or a repo applies to each of its images. When such
+ * an event occurs, each subscriber who may read the image is notified, once,
+ * however many of the user's subscriptions match.
+ *
+ * A notification is delivered in-app - it is added to the user's list, which is
+ * retrieved with getNotifications - and by email, according to the user's
+ * preferences (see NotificationPreferences). Email is sent immediately, through
+ * the email outbox (see EmailOutbox.go), unless it is quiet hours for the user or
+ * the user has chosen a daily digest; the notification is then held, and a
+ * background worker sends the held notifications together, in one message, once
+ * quiet hours end, or, for a digest, at NotificationDigestHour in the user's time
+ * zone. Of the servers that share the database, only one sends a realm's digests
+ * in each poll interval: the one that claims the realm's
+ * NotificationDigestClaimKeyPrefix key.
+ *
+ * The events of a failed scan or build are recorded in a transaction of their
+ * own, since the transaction of the failed request is aborted.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	
+	"scanners"
+	
+	"safeharbor/apitypes"
+	"utilities"
+)
+
+const (
+	// Event types.
+	ScanFailedNotification = "ScanFailed"
+	ScoreWorsenedNotification = "ScoreWorsened"  // more vulnerabilities than the previous scan
+	NewCriticalVulnerabilityNotification = "NewCriticalVulnerability"
+	BuildFailedNotification = "BuildFailed"
+	
+	// Values of NotificationPreferences.Email.
+	EmailNotificationsImmediately = "immediate"
+	EmailNotificationsDigest = "digest"
+	EmailNotificationsNever = "never"
+	
+	// The names of the notification email templates (see EmailTemplates.go).
+	NotificationTemplate = "notification"
+	NotificationDigestTemplate = "notification-digest"
+	
+	MaxInAppNotifications = 100  // per user; the oldest are discarded
+	NotificationDigestHour = 8  // in the user's time zone
+	DefaultNotificationPollInterval = 300  // seconds
+	NotificationDigestClaimKeyPrefix = "SafeHarbor/NotificationDigests/"
+)
+
+var NotificationEventTypes = []string{ ScanFailedNotification, ScoreWorsenedNotification,
+	NewCriticalVulnerabilityNotification, BuildFailedNotification }
+
+/*******************************************************************************
+ * How a user receives notifications. Quiet hours are in minutes after midnight,
+ * in TimeZone; there are none if QuietHoursStart equals QuietHoursEnd.
+ */
+type NotificationPreferences struct {
+	Email string  // EmailNotificationsImmediately, EmailNotificationsDigest, or EmailNotificationsNever
+	InApp bool
+	QuietHoursStart int
+	QuietHoursEnd int
+	TimeZone string  // "" for UTC
+}
+
+/*******************************************************************************
+ * Return the time zone of the preferences. A time zone that is not known to this
+ * server is treated as UTC.
+ */
+func (prefs *NotificationPreferences) getLocation() *time.Location {
+	
+	var location, err = time.LoadLocation(prefs.TimeZone)
+	if err != nil { return time.UTC }
+	return location
+}
+
+func (prefs *NotificationPreferences) isQuietTime(now time.Time) bool {
+	
+	if prefs.QuietHoursStart == prefs.QuietHoursEnd { return false }
+	var local = now.In(prefs.getLocation())
+	var minutes = local.Hour() * 60 + local.Minute()
+	if prefs.QuietHoursStart < prefs.QuietHoursEnd {
+		return (minutes >= prefs.QuietHoursStart) && (minutes < prefs.QuietHoursEnd)
+	}
+	return (minutes >= prefs.QuietHoursStart) || (minutes < prefs.QuietHoursEnd)  // spans midnight
+}
+
+/*******************************************************************************
+ * Return the time of the first digest after the specified time.
+ */
+func (prefs *NotificationPreferences) getNextDigestTime(since time.Time) time.Time {
+	
+	var local = since.In(prefs.getLocation())
+	var digestTime = time.Date(local.Year(), local.Month(), local.Day(),
+		NotificationDigestHour, 0, 0, 0, local.Location())
+	if ! digestTime.After(local) { digestTime = digestTime.AddDate(0, 0, 1) }
+	return digestTime
+}
+
+/*******************************************************************************
+ * Parse a comma separated list of event types. An empty list means all types.
+ */
+func parseNotificationEventTypes(eventTypeSeq string) ([]string, error) {
+	
+	if eventTypeSeq == "" { return append([]string{}, NotificationEventTypes...), nil }
+	var eventTypes = make([]string, 0)
+	for _, eventType := range strings.Split(eventTypeSeq, ",") {
+		eventType = strings.TrimSpace(eventType)
+		var known = false
+		for _, t := range NotificationEventTypes { if t == eventType { known = true } }
+		if ! known { return nil, utilities.ConstructUserError(
+			"Unrecognized notification event type: " + eventType + "; expected one of " +
+			strings.Join(NotificationEventTypes, ", ")) }
+		eventTypes = append(eventTypes, eventType)
+	}
+	return eventTypes, nil
+}
+
+/*******************************************************************************
+ * Parse a time of day, HH:MM, and return it in minutes after midnight.
+ */
+func parseTimeOfDay(value string) (int, error) {
+	
+	var parts = strings.Split(value, ":")
+	if len(parts) == 2 {
+		var hours, err1 = strconv.Atoi(parts[0])
+		var minutes, err2 = strconv.Atoi(parts[1])
+		if (err1 == nil) && (err2 == nil) && (hours >= 0) && (hours < 24) &&
+			(minutes >= 0) && (minutes < 60) {
+			return hours * 60 + minutes, nil
+		}
+	}
+	return 0, utilities.ConstructUserError("Time of day " + value + " is not of the form HH:MM")
+}
+
+func formatTimeOfDay(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes / 60, minutes % 60)
+}
+
+func newNotificationPreferencesDesc(user User) *apitypes.NotificationPreferencesDesc {
+	
+	var prefs = user.getNotificationPreferences()
+	var quietHoursStart, quietHoursEnd string
+	if prefs.QuietHoursStart != prefs.QuietHoursEnd {
+		quietHoursStart = formatTimeOfDay(prefs.QuietHoursStart)
+		quietHoursEnd = formatTimeOfDay(prefs.QuietHoursEnd)
+	}
+	return apitypes.NewNotificationPreferencesDesc(user.getId(), prefs.Email, prefs.InApp,
+		quietHoursStart, quietHoursEnd, prefs.TimeZone)
+}
+
+/*******************************************************************************
+ * Notify each user who subscribes to the event type for the resource or for a
+ * resource that contains it, and who may read the resource.
+ */
+func notifySubscribers(dbClient DBClient, eventType string, resource Resource,
+	subject, message string) error {
+	
+	var lineage []Resource
+	var err error
+	lineage, err = getResourceLineage(dbClient, resource)
+	if err != nil { return err }
+	var realm, isRealm = lineage[len(lineage)-1].(Realm)
+	if ! isRealm { return utilities.ConstructServerError(
+		"Internal error: resource " + resource.getId() + " does not belong to a realm") }
+	
+	var notified = make(map[string]bool)
+	for _, subscriptionId := range realm.getNotificationSubscriptionIds() {
+		var subscription NotificationSubscription
+		subscription, err = dbClient.getNotificationSubscription(subscriptionId)
+		if err != nil { continue }  // dangling Id
+		if ! subscription.includesEventType(eventType) { continue }
+		if notified[subscription.getUserObjId()] { continue }
+		var applies = false
+		for _, r := range lineage {
+			if r.getId() == subscription.getResourceId() { applies = true }
+		}
+		if ! applies { continue }
+		
+		var user User
+		user, err = dbClient.getUser(subscription.getUserObjId())
+		if err != nil { continue }  // the user has been deleted
+		if ! user.isActive() { continue }
+		if dbClient.getServer().Authorize {
+			var canRead bool
+			canRead, err = userCanRead(dbClient, user, lineage)
+			if err != nil { return err }
+			if ! canRead { continue }
+		}
+		notified[user.getId()] = true
+		err = deliverNotification(dbClient, user, eventType, resource.getId(), subject,
+			message, time.Now())
+		if err != nil { return err }
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Return true if the user may read the first resource of the lineage.
+ */
+func userCanRead(dbClient DBClient, user User, lineage []Resource) (bool, error) {
+	return userHasPermissions(dbClient, user, lineage, apitypes.ReadMask)
+}
+
+/*******************************************************************************
+ * Return true if the user has each of the permissions of requiredMask for the
+ * first resource of the lineage.
+ */
+func userHasPermissions(dbClient DBClient, user User, lineage []Resource,
+	requiredMask []bool) (bool, error) {
+	
+	var parties []Party
+	var err error
+	parties, err = getEffectiveParties(dbClient, user)
+	if err != nil { return false, err }
+	var mask []bool
+	mask, err = getEffectiveMask(dbClient, parties, lineage)
+	if err != nil { return false, err }
+	for i, required := range requiredMask {
+		if required && (! mask[i]) { return false, nil }
+	}
+	return true, nil
+}
+
+/*******************************************************************************
+ * Deliver a notification to the user, according to the user's preferences.
+ */
+func deliverNotification(dbClient DBClient, user User, eventType, resourceId, subject,
+	message string, now time.Time) error {
+	
+	var prefs = user.getNotificationPreferences()
+	var sendEmail = (prefs.Email != EmailNotificationsNever) && (user.getEmailAddress() != "")
+	var holdEmail = sendEmail &&
+		((prefs.Email == EmailNotificationsDigest) || prefs.isQuietTime(now))
+	
+	var err error
+	if sendEmail && (! holdEmail) {
+		var realmName = getRealmNameForEmail(dbClient, user)
+		var vars = newEmailVariables(dbClient.getServer(), user, realmName)
+		vars["Subject"] = subject
+		vars["Message"] = message
+		vars["EventType"] = eventType
+		err = queueTemplatedEmail(dbClient, user.getEmailAddress(), NotificationTemplate,
+			user, realmName, vars)
+		if err != nil { return err }
+	}
+	if (! prefs.InApp) && (! holdEmail) { return nil }
+	
+	var notification Notification
+	notification, err = dbClient.dbCreateNotification(user.getId(), eventType, resourceId,
+		subject, message, now)
+	if err != nil { return err }
+	if holdEmail {
+		err = user.addPendingNotification(dbClient, notification)
+		if err != nil { return err }
+	}
+	if prefs.InApp {
+		err = user.addNotification(dbClient, notification)
+		if err != nil { return err }
+		
+		// Discard the oldest notifications, unless they are yet to be emailed.
+		var notificationIds = user.getNotificationIds()
+		for i := 0; i < len(notificationIds) - MaxInAppNotifications; i++ {
+			err = removeInAppNotification(dbClient, user, notificationIds[i])
+			if err != nil { return err }
+		}
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Remove the notification from the user's in-app list, and delete it unless it
+ * is waiting to be emailed.
+ */
+func removeInAppNotification(dbClient DBClient, user User, notificationId string) error {
+	
+	var err = user.removeNotificationId(dbClient, notificationId)
+	if err != nil { return err }
+	for _, id := range user.getPendingNotificationIds() {
+		if id == notificationId { return nil }
+	}
+	return deleteNotification(dbClient, notificationId)
+}
+
+func deleteNotification(dbClient DBClient, notificationId string) error {
+	
+	var notification, err = dbClient.getNotification(notificationId)
+	if err != nil { return nil }  // already deleted
+	return dbClient.deleteObject(notification)
+}
+
+/*******************************************************************************
+ * In a transaction of its own, notify the subscribers to the resource of an
+ * event. Failures are logged, but are otherwise ignored.
+ */
+func (server *Server) notifySubscribersSeparately(eventType, resourceId, subject, message string) {
+	
+	var err = server.performInTransaction(eventType + " notifications", func(dbClient *InMemClient) (bool, error) {
+		var resource, err = dbClient.getResource(resourceId)
+		if err != nil { return false, err }
+		if resource == nil { return false, utilities.ConstructServerError(
+			"Resource with Id " + resourceId + " not found") }
+		return true, notifySubscribers(dbClient, eventType, resource, subject, message)
+	})
+	if err != nil { fmt.Println("While sending " + eventType + " notifications: " + err.Error()) }
+}
+
+/*******************************************************************************
+ * Return the most recent scan of the image version with the scan config, or, if
+ * the version has not been scanned with it, the most recent scan of any version
+ * of the image with it, or nil if there is none. A rescan of a version (see
+ * ScanSchedules.go) is thus compared with the version's own previous scan.
+ */
+func getPreviousScanEvent(dbClient DBClient, dockerImage DockerImage,
+	dockerImageVersion DockerImageVersion, scanConfigId string) (ScanEvent, error) {
+	
+	var previous, previousOfVersion ScanEvent
+	for _, versionId := range dockerImage.getImageVersionIds() {
+		var version DockerImageVersion
+		var err error
+		version, err = dbClient.getDockerImageVersion(versionId)
+		if err != nil { return nil, err }
+		for _, eventId := range version.getScanEventIds() {
+			var event ScanEvent
+			event, err = dbClient.getScanEvent(eventId)
+			if err != nil { return nil, err }
+			if event.getScanConfigId() != scanConfigId { continue }
+			if (previous == nil) || event.getWhen().After(previous.getWhen()) { previous = event }
+			if (versionId == dockerImageVersion.getId()) &&
+				((previousOfVersion == nil) || event.getWhen().After(previousOfVersion.getWhen())) {
+				previousOfVersion = event
+			}
+		}
+	}
+	if previousOfVersion != nil { return previousOfVersion, nil }
+	return previous, nil
+}
+
+/*******************************************************************************
+ * Return true if the vulnerability is of critical priority. Scanners that rank
+ * vulnerabilities above critical (Clair's Defcon1) are included.
+ */
+func isCriticalVulnerability(vuln *scanners.VulnerabilityDesc) bool {
+	var priority = strings.ToLower(vuln.Priority)
+	return (priority == "critical") || (priority == "defcon1")
+}
+
+/*******************************************************************************
+ * Notify the subscribers to the image if the scan found more vulnerabilities than
+ * the previous scan with the same scan config, or found critical vulnerabilities
+ * that the previous scan did not. previous is nil if there was no previous scan.
+ */
+func notifyScanOutcome(dbClient DBClient, dockerImage DockerImage, imageName string,
+	scanConfig ScanConfig, scanEvent, previous ScanEvent) error {
+	
+	var err error
+	if previous != nil {
+		var score, err1 = strconv.Atoi(scanEvent.getScore())
+		var previousScore, err2 = strconv.Atoi(previous.getScore())
+		if (err1 == nil) && (err2 == nil) && (score > previousScore) {
+			err = notifySubscribers(dbClient, ScoreWorsenedNotification, dockerImage,
+				"Scan of " + imageName + " is worse than before",
+				fmt.Sprintf("The scan of %s with scan config %s found %d vulnerabilities; " +
+					"the previous scan found %d.", imageName, scanConfig.getName(),
+					score, previousScore))
+			if err != nil { return err }
+		}
+	}
+	
+	var known = make(map[string]bool)
+	if previous != nil {
+		for _, vuln := range previous.getVulnerabilities() { known[vuln.VCE_ID] = true }
+	}
+	var newIds = make([]string, 0)
+	for _, vuln := range scanEvent.getVulnerabilities() {
+		if isCriticalVulnerability(vuln) && (! known[vuln.VCE_ID]) {
+			newIds = append(newIds, vuln.VCE_ID)
+			known[vuln.VCE_ID] = true
+		}
+	}
+	if len(newIds) == 0 { return nil }
+	return notifySubscribers(dbClient, NewCriticalVulnerabilityNotification, dockerImage,
+		"New critical vulnerabilities in " + imageName,
+		fmt.Sprintf("The scan of %s with scan config %s found critical vulnerabilities " +
+			"that were not found before: %s.", imageName, scanConfig.getName(),
+			strings.Join(newIds, ", ")))
+}
+
+/*******************************************************************************
+ * Email the notifications that are held for each user of any realm, if they are
+ * due, every NotificationPollInterval seconds, until the process exits.
+ */
+func (server *Server) sendNotificationDigestsPeriodically() {
+	
+	var interval = server.getNotificationPollInterval()
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		var count, err = server.sendNotificationDigests()
+		if err != nil { fmt.Println("While sending notification digests: " + err.Error()) }
+		if count > 0 { fmt.Println(fmt.Sprintf("Queued %d notification digests", count)) }
+	}
+}
+
+/*******************************************************************************
+ * Return the number of seconds between polls for digests that are due.
+ */
+func (server *Server) getNotificationPollInterval() int {
+	var interval = server.Config.NotificationPollInterval
+	if interval <= 0 { interval = DefaultNotificationPollInterval }
+	return interval
+}
+
+/*******************************************************************************
+ * Queue the digests that are due, for the users of all realms, and return the
+ * number queued. A realm whose digests cannot be queued is logged and skipped.
+ */
+func (server *Server) sendNotificationDigests() (int, error) {
+	
+	var dbClient *InMemClient
+	var err error
+	dbClient, err = NewInMemClient(server)
+	if err != nil { return 0, err }
+	var realmIds []string
+	realmIds, err = dbClient.dbGetAllRealmIds()
+	dbClient.abort()
+	if err != nil { return 0, err }
+	
+	var total = 0
+	for _, realmId := range realmIds {
+		var count int
+		count, err = server.sendNotificationDigestsForRealm(realmId, time.Now())
+		if err != nil {
+			fmt.Println("While sending notification digests for realm " + realmId + ": " + err.Error())
+			continue
+		}
+		total = total + count
+	}
+	return total, nil
+}
+
+/*******************************************************************************
+ * In a transaction of its own, queue the digests of the realm's users that are
+ * due as of now, and return the number queued. Nothing is queued unless this
+ * server claims the realm's digests for the poll interval, so that servers that
+ * share the database do not each queue the same digests.
+ */
+func (server *Server) sendNotificationDigestsForRealm(realmId string, now time.Time) (int, error) {
+	
+	var claimed, err = server.persistence.claimKey(NotificationDigestClaimKeyPrefix + realmId,
+		server.getNotificationPollInterval())
+	if err != nil { return 0, err }
+	if ! claimed { return 0, nil }  // another server is sending them
+	
+	var count int
+	err = server.performInTransaction("notification digests", func(dbClient *InMemClient) (bool, error) {
+		count = 0
+		var realm, err = dbClient.getRealm(realmId)
+		if err != nil { return false, err }
+		for _, userObjId := range realm.getUserObjIds() {
+			var user User
+			user, err = dbClient.getUser(userObjId)
+			if err != nil { continue }  // dangling Id
+			if len(user.getPendingNotificationIds()) == 0 { continue }
+			var sent bool
+			sent, err = sendNotificationDigest(dbClient, user, now)
+			if err != nil { return false, err }
+			if sent { count++ }
+		}
+		return count > 0, nil
+	})
+	if err != nil { return 0, err }
+	return count, nil
+}
+
+/*******************************************************************************
+ * If the notifications that are held for the user are due to be emailed, queue
+ * them, in one message, and return true. They are due once quiet hours have
+ * ended, and, if the user has chosen a digest, at the first digest time after
+ * the oldest of them. If the user no longer wants email, they are discarded.
+ */
+func sendNotificationDigest(dbClient DBClient, user User, now time.Time) (bool, error) {
+	
+	var prefs = user.getNotificationPreferences()
+	var pendingIds = user.getPendingNotificationIds()
+	var notifications = make([]Notification, 0)
+	for _, id := range pendingIds {
+		var notification, err = dbClient.getNotification(id)
+		if err != nil { continue }  // dangling Id
+		notifications = append(notifications, notification)
+	}
+	
+	var send = (prefs.Email != EmailNotificationsNever) && (user.getEmailAddress() != "") &&
+		(len(notifications) > 0)
+	if send {
+		if prefs.isQuietTime(now) { return false, nil }
+		if (prefs.Email == EmailNotificationsDigest) &&
+			now.Before(prefs.getNextDigestTime(notifications[0].getCreationTime())) {
+			return false, nil
+		}
+		var realmName = getRealmNameForEmail(dbClient, user)
+		var vars = newEmailVariables(dbClient.getServer(), user, realmName)
+		var items = make([]map[string]interface{}, 0)
+		for _, notification := range notifications {
+			items = append(items, map[string]interface{}{
+				"Subject": notification.getSubject(),
+				"Message": notification.getMessage(),
+				"EventType": notification.getEventType(),
+				"Time": notification.getCreationTime().In(prefs.getLocation()).Format(time.RFC1123),
+			})
+		}
+		vars["Notifications"] = items
+		vars["Count"] = len(items)
+		var err = queueTemplatedEmail(dbClient, user.getEmailAddress(), NotificationDigestTemplate,
+			user, realmName, vars)
+		if err != nil { return false, err }
+	}
+	
+	var err = user.clearPendingNotifications(dbClient)
+	if err != nil { return false, err }
+	var inApp = make(map[string]bool)
+	for _, id := range user.getNotificationIds() { inApp[id] = true }
+	for _, id := range pendingIds {
+		if inApp[id] { continue }
+		err = deleteNotification(dbClient, id)
+		if err != nil { return false, err }
+	}
+	return send, nil
+}
@@ -0,0 +1,78 @@
+package server
+
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_QuietHoursMaySpanMidnight(testContext *testing.T) {
+	
+	var prefs = &NotificationPreferences{ QuietHoursStart: 22 * 60, QuietHoursEnd: 7 * 60,
+		TimeZone: "America/New_York" }
+	var location = prefs.getLocation()
+	var expectedQuiet = map[int]bool{ 21: false, 22: true, 2: true, 7: false, 12: false }
+	for hour, expected := range expectedQuiet {
+		var t = time.Date(2016, time.March, 1, hour, 30, 0, 0, location)
+		if prefs.isQuietTime(t) != expected {
+			testContext.Errorf("Expected quiet time at %d:30 to be %v", hour, expected)
+		}
+	}
+	var next = prefs.getNextDigestTime(time.Date(2016, time.March, 1, 9, 0, 0, 0, location))
+	if ! next.Equal(time.Date(2016, time.March, 2, NotificationDigestHour, 0, 0, 0, location)) {
+		testContext.Errorf("Expected the next digest the following morning, but got %s", next)
+	}
+}
+
+func Test_SubscribersAreNotifiedInAppAndByEmail(testContext *testing.T) {
+	
+	var f = newTestDB(testContext)
+	f.server.EmailDriver = &stubEmailDriver{}
+	var _, err = f.client.dbCreateNotificationSubscription(f.user.getId(), f.realm.getId(),
+		f.repo.getId(), []string{ BuildFailedNotification })
+	if err != nil { testContext.Fatal(err) }
+	
+	err = notifySubscribers(f.client, BuildFailedNotification, f.dockerfile, "Build failed", "Oops")
+	if err != nil { testContext.Fatal(err) }
+	err = notifySubscribers(f.client, ScanFailedNotification, f.dockerfile, "Scan failed", "Oops")
+	if err != nil { testContext.Fatal(err) }
+	err = notifySubscribers(f.client, BuildFailedNotification, f.otherDockerfile, "Build failed", "Oops")
+	if err != nil { testContext.Fatal(err) }
+	if (len(f.user.getNotificationIds()) != 1) || (len(getOutboxIds(testContext, f)) != 1) {
+		testContext.Fatalf("Expected one notification, in-app and by email, but found %d and %d",
+			len(f.user.getNotificationIds()), len(getOutboxIds(testContext, f)))
+	}
+	
+	// With a digest, email is held until the digest time.
+	var prefs = f.user.getNotificationPreferences()
+	prefs.Email = EmailNotificationsDigest
+	prefs.InApp = false
+	err = f.user.setNotificationPreferences(f.client, prefs)
+	if err != nil { testContext.Fatal(err) }
+	var now = time.Now()
+	err = deliverNotification(f.client, f.user, BuildFailedNotification, f.dockerfile.getId(),
+		"Build failed again", "Oops", now)
+	if err != nil { testContext.Fatal(err) }
+	if (len(f.user.getPendingNotificationIds()) != 1) || (len(getOutboxIds(testContext, f)) != 1) {
+		testContext.Fatal("Expected the notification to be held for the digest")
+	}
+	var pendingId = f.user.getPendingNotificationIds()[0]
+	var digestTime = prefs.getNextDigestTime(now)
+	var count int
+	count, err = f.server.sendNotificationDigestsForRealm(f.realm.getId(), digestTime.Add(-time.Minute))
+	if err != nil { testContext.Fatal(err) }
+	if count != 0 { testContext.Error("Expected no digest before the digest time") }
+	count, err = f.server.sendNotificationDigestsForRealm(f.realm.getId(), digestTime)
+	if err != nil { testContext.Fatal(err) }
+	if (count != 1) || (len(f.user.getPendingNotificationIds()) != 0) ||
+		(len(getOutboxIds(testContext, f)) != 2) {
+		testContext.Error("Expected the digest to be queued at the digest time")
+	}
+	
+	// The digest was sent in a transaction of its own, so look in a new one.
+	var dbClient *InMemClient
+	dbClient, err = NewInMemClient(f.server)
+	if err != nil { testContext.Fatal(err) }
+	_, err = dbClient.getNotification(pendingId)
+	if err == nil { testContext.Error("Expected an emailed notification that is not in-app to be deleted") }
+}
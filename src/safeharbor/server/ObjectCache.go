@@ -0,0 +1,239 @@
+/*******************************************************************************
+ * A process-wide cache of persistent objects, invalidated via redis pub/sub.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"container/list"
+	"strings"
+	"time"
+	
+	"goredis"
+)
+
+const (
+	ObjectCacheInvalidationChannel = "SafeHarbor/ObjectCacheInvalidation"
+	DefaultObjectCacheSize = 10000
+)
+
+/*******************************************************************************
+ * The types of object that are never cached: those on which access decisions
+ * are based - ACL entries, users, groups, realms (whose policies and roles apply
+ * to what they contain), roles and invitations. Since invalidation of other
+ * servers' caches is asynchronous, a cached copy may briefly outlive a change,
+ * but a permission that has been revoked, or a user that has been disabled, must
+ * take effect on every server immediately.
+ */
+var uncachedObjectTypes = map[string]bool{
+	"ACLEntry": true,
+	"User": true,
+	"Group": true,
+	"Realm": true,
+	"Role": true,
+	"Invitation": true,
+}
+
+/*******************************************************************************
+ * A cache of the serialized (JSON) form of persistent objects, so that requests
+ * do not each have to re-read the same repo, image and other objects from redis.
+ * The cache holds JSON rather than reconstituted objects, because handlers
+ * modify the objects that they obtain, and a handler's transaction may be
+ * aborted: each request therefore still gets its own copy. The cache is
+ * bounded: when it is full, the least recently used entry is evicted. Each entry
+ * records the object's version, so that a transaction can check that a cached
+ * object is current once it has watched it (see getObjects).
+ */
+type ObjectCache struct {
+	maxEntries int
+	lock sync.Mutex
+	entries map[string]*list.Element  // maps object id to element of lru
+	lru *list.List  // most recently used entries are at the front
+	generation uint64  // incremented whenever any entry is invalidated
+	
+	hits int64
+	misses int64
+	evictions int64
+	invalidations int64
+}
+
+type objectCacheEntry struct {
+	id string
+	json string
+	version string  // the object's version when the JSON was read
+}
+
+func NewObjectCache(maxEntries int) *ObjectCache {
+	if maxEntries <= 0 { maxEntries = DefaultObjectCacheSize }
+	return &ObjectCache{
+		maxEntries: maxEntries,
+		entries: make(map[string]*list.Element),
+		lru: list.New(),
+	}
+}
+
+/*******************************************************************************
+ * Return the cached JSON for the object, the version of the object from which
+ * it was read, and true; or "", "" and false if the object is not in the cache.
+ * The JSON may be stale: a caller that is to use it in a transaction must watch
+ * the object and then check that its stored version is still the one returned.
+ */
+func (cache *ObjectCache) get(id string) (string, string, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	
+	var elt = cache.entries[id]
+	if elt == nil {
+		atomic.AddInt64(&cache.misses, 1)
+		return "", "", false
+	}
+	cache.lru.MoveToFront(elt)
+	atomic.AddInt64(&cache.hits, 1)
+	var entry = elt.Value.(*objectCacheEntry)
+	return entry.json, entry.version, true
+}
+
+/*******************************************************************************
+ * Return the current generation of the cache. A caller that reads an object from
+ * the database must obtain the generation before reading, and pass it to put, so
+ * that a value that was read before a concurrent invalidation is not cached.
+ */
+func (cache *ObjectCache) getGeneration() uint64 {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.generation
+}
+
+/*******************************************************************************
+ * Add the JSON for the object, which is of the specified type and was read at
+ * the specified version, to the cache, unless the type is never cached, the
+ * version is not known, or an invalidation has occurred since the specified
+ * generation.
+ */
+func (cache *ObjectCache) put(id string, typeName string, json string, version string,
+	generation uint64) {
+	if uncachedObjectTypes[typeName] || (version == "") { return }
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	
+	if generation != cache.generation { return }
+	
+	var elt = cache.entries[id]
+	if elt != nil {
+		elt.Value.(*objectCacheEntry).json = json
+		elt.Value.(*objectCacheEntry).version = version
+		cache.lru.MoveToFront(elt)
+		return
+	}
+	cache.entries[id] = cache.lru.PushFront(&objectCacheEntry{ id: id, json: json, version: version })
+	
+	for cache.lru.Len() > cache.maxEntries {
+		var oldest = cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*objectCacheEntry).id)
+		atomic.AddInt64(&cache.evictions, 1)
+	}
+}
+
+/*******************************************************************************
+ * Remove the specified objects from the cache.
+ */
+func (cache *ObjectCache) invalidate(ids ...string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	
+	cache.generation++
+	for _, id := range ids {
+		var elt = cache.entries[id]
+		if elt == nil { continue }
+		cache.lru.Remove(elt)
+		delete(cache.entries, id)
+		atomic.AddInt64(&cache.invalidations, 1)
+	}
+}
+
+/*******************************************************************************
+ * Remove all objects from the cache.
+ */
+func (cache *ObjectCache) clear() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	
+	cache.generation++
+	atomic.AddInt64(&cache.invalidations, int64(cache.lru.Len()))
+	cache.entries = make(map[string]*list.Element)
+	cache.lru.Init()
+}
+
+/*******************************************************************************
+ * Return the number of hits, misses, evictions, and invalidations since the
+ * server started, and the number of objects that are currently cached.
+ */
+func (cache *ObjectCache) getStats() (hits, misses, evictions, invalidations int64, size int) {
+	cache.lock.Lock()
+	size = cache.lru.Len()
+	cache.lock.Unlock()
+	return atomic.LoadInt64(&cache.hits), atomic.LoadInt64(&cache.misses),
+		atomic.LoadInt64(&cache.evictions), atomic.LoadInt64(&cache.invalidations), size
+}
+
+/*******************************************************************************
+ * Notify all servers that share the database - including this one - that the
+ * specified objects have changed, after a transaction that updates or deletes
+ * them commits. This server's cache is updated immediately; that of other
+ * servers asynchronously and best-effort: there is a short window, after a
+ * commit, during which another server may still read the prior value, and if
+ * the publication fails, the prior value may be read until the entry is
+ * evicted. A transaction that writes is not affected, since it checks the
+ * versions of the cached objects that it reads.
+ */
+func (cache *ObjectCache) publishInvalidation(redisClient *goredis.Redis, ids []string) {
+	if len(ids) == 0 { return }
+	cache.invalidate(ids...)
+	if redisClient == nil { return }
+	var _, err = redisClient.Publish(ObjectCacheInvalidationChannel, strings.Join(ids, " "))
+	if err != nil {
+		// Other servers may now hold stale objects until their entries are
+		// evicted; there is nothing that we can do about it here.
+		fmt.Println("Unable to publish cache invalidation: " + err.Error())
+	}
+}
+
+/*******************************************************************************
+ * Subscribe to invalidations that are published by other servers. This runs
+ * until the process exits: if the subscription fails, the entire cache is
+ * cleared (since invalidations may have been missed) and the subscription is
+ * re-established.
+ */
+func (cache *ObjectCache) listenForInvalidations(redisClient *goredis.Redis) {
+	for {
+		var err = cache.receiveInvalidations(redisClient)
+		fmt.Println("Cache invalidation subscription ended: " + err.Error())
+		cache.clear()
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (cache *ObjectCache) receiveInvalidations(redisClient *goredis.Redis) error {
+	var pubSub *goredis.PubSub
+	var err error
+	pubSub, err = redisClient.PubSub()
+	if err != nil { return err }
+	defer pubSub.Close()
+	
+	err = pubSub.Subscribe(ObjectCacheInvalidationChannel)
+	if err != nil { return err }
+	
+	for {
+		var msg []string
+		msg, err = pubSub.Receive()
+		if err != nil { return err }
+		if (len(msg) != 3) || (msg[0] != "message") { continue }
+		cache.invalidate(strings.Fields(msg[2])...)
+	}
+}
@@ -0,0 +1,702 @@
+/*******************************************************************************
+ * The format in which persistent objects are stored in redis.
+ *
+ * Each object is stored as a redis hash, keyed on ObjectIdPrefix + <object Id>.
+ * The hash contains the object's type name (field "_type"), the names of its
+ * fields in the order in which they appear in the object's JSON (field
+ * "_fields"), a value that changes whenever the object is written (field
+ * "_version"), and the JSON value of each scalar field. A field whose value is a
+ * list of strings - e.g., a list of event Ids or ACL entry Ids - is instead
+ * stored in a redis list, keyed on <object key> + "/" + <field name>; in the
+ * "_fields" value, the names of such fields are prefixed with "@".
+ *
+ * When an object is updated, only the hash fields whose values have changed are
+ * written, and list elements are pushed or removed individually. Appending an Id
+ * to a list therefore does not rewrite the object. A transaction watches the
+ * lists of the objects that it reads, as well as their hashes, so that a
+ * decision made from the contents of a list - e.g., a count, or whether an Id
+ * is present - conflicts with a concurrent change to the list.
+ *
+ * Prior to this format, each object was stored as a single JSON string; see
+ * migrateObjectsToHashes.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"fmt"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"strconv"
+	"time"
+	
+	"goredis"
+	
+	"utilities"
+)
+
+const (
+	ObjectTypeFieldName = "_type"
+	ObjectFieldsFieldName = "_fields"
+	ObjectVersionFieldName = "_version"
+	ListFieldMarker = "@"
+	SchemaVersionKey = "SchemaVersion"
+	SchemaMigrationLockKey = "SchemaMigrationLock"
+	SchemaMigrationLockSeconds = 3600  // a migration that takes longer is taken over
+	CurrentSchemaVersion = 2  // version 1 stored each object as a JSON string
+)
+
+/*******************************************************************************
+ * Read the hash and the lists of each object identified by KEYS, atomically.
+ * For each key, returns an empty array if the object does not exist; otherwise
+ * returns an array consisting of the HGETALL result, followed by the name and
+ * the LRANGE result of each list field.
+ */
+const readObjectsScript = `
+local results = {}
+for k, key in ipairs(KEYS) do
+	local result = {}
+	local hash = redis.call('HGETALL', key)
+	if #hash > 0 then
+		table.insert(result, hash)
+		local fields = ''
+		for i = 1, #hash, 2 do
+			if hash[i] == '_fields' then fields = hash[i+1] end
+		end
+		for name in string.gmatch(fields, '@([^,]+)') do
+			table.insert(result, name)
+			table.insert(result, redis.call('LRANGE', key .. '/' .. name, 0, -1))
+		end
+	end
+	results[k] = result
+end
+return results
+`
+
+/*******************************************************************************
+ * Return the version of each object identified by KEYS, or an empty string for
+ * an object that does not exist or has never been written with a version.
+ */
+const readObjectVersionsScript = `
+local results = {}
+for k, key in ipairs(KEYS) do
+	results[k] = redis.call('HGET', key, '_version') or ''
+end
+return results
+`
+
+/*******************************************************************************
+ * Convert the object identified by KEYS[1] from a JSON string to a hash, provided
+ * that it is still the JSON string ARGV[1]. ARGV[2] is the number of hash
+ * arguments (field names and values) that follow it; then, for each list field,
+ * whose key is the next of KEYS, there is the number of elements followed by
+ * the elements. Returns 1 if the object was converted, 0 if it is no longer
+ * stored as a string, and -1 if the string has changed.
+ */
+const migrateObjectScript = `
+if redis.call('TYPE', KEYS[1])['ok'] ~= 'string' then return 0 end
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then return -1 end
+redis.call('DEL', KEYS[1])
+local a = 2
+local n = tonumber(ARGV[a])
+redis.call('HMSET', KEYS[1], unpack(ARGV, a+1, a+n))
+a = a + n + 1
+for k = 2, #KEYS do
+	redis.call('DEL', KEYS[k])
+	n = tonumber(ARGV[a])
+	for i = a+1, a+n, 1000 do
+		redis.call('RPUSH', KEYS[k], unpack(ARGV, i, math.min(i+999, a+n)))
+	end
+	a = a + n + 1
+end
+return 1
+`
+
+/*******************************************************************************
+ * Fields that have been added to a type after objects of that type may already
+ * have been stored, and the JSON value to assume for an object that was stored
+ * without the field. A type's added fields must be the last fields of its JSON,
+ * in the order listed here, since objects are reconstituted positionally.
+ */
+type addedField struct {
+	name string
+	defaultValue string
+}
+
+var addedFields = map[string][]addedField{
+	"Group": []addedField{ { "GroupIds", "[]" }, { "MemberGroupIds", "[]" } },
+	"ACLEntry": []addedField{ { "DenyMask", "[false, false, false, false, false]" },
+		{ "RoleName", "\"\"" }, { "ExpiresAt", "time \"0001-01-01T00:00:00Z\"" },
+		{ "GrantorId", "\"\"" }, { "InvitationId", "\"\"" } },
+	"Realm": []addedField{ { "RoleIds", "[]" }, { "InvitationIds", "[]" },
+		{ "RequireTOTP", "false" },
+		{ "NotificationSubscriptionIds", "[]" },
+		{ "WebhookIds", "[]" }, { "PendingWebhookDeliveryIds", "[]" },
+		{ "ScanScheduleIds", "[]" } },
+	"User": []addedField{ { "FailedLoginAttempts", "[]" },
+		{ "LockedUntil", "time \"0001-01-01T00:00:00Z\"" }, { "LockoutCount", "0" },
+		{ "TOTPSecret", "\"\"" }, { "TOTPEnabled", "false" }, { "TOTPLastStep", "0" },
+		{ "RecoveryCodeHashes", "[]" }, { "LDAPDN", "\"\"" },
+		{ "Locale", "\"\"" }, { "NotificationSubscriptionIds", "[]" },
+		{ "NotificationIds", "[]" }, { "PendingNotificationIds", "[]" },
+		{ "EmailNotifications", "\"immediate\"" }, { "InAppNotifications", "true" },
+		{ "QuietHoursStart", "0" }, { "QuietHoursEnd", "0" }, { "TimeZone", "\"\"" },
+		{ "CredentialEpoch", "time \"0001-01-01T00:00:00Z\"" }, { "Deleted", "false" } },
+	"IdentityValidationInfo": []addedField{ { "Purpose", "\"VerifyEmail\"" } },
+}
+
+/*******************************************************************************
+ * An object in the form in which it is stored in redis. Values are JSON text, as
+ * produced by the object's asJSON method.
+ */
+type storedObject struct {
+	typeName string
+	fieldNames []string  // in JSON order
+	scalarFields map[string]string  // maps field name to JSON value
+	listFields map[string][]string  // maps field name to JSON value of each element
+	version string  // "" if not known
+}
+
+/*******************************************************************************
+ * Split the JSON for an object, as produced by its asJSON method, into the form
+ * in which it is stored.
+ */
+func newStoredObjectFromJSON(json string) (*storedObject, error) {
+	
+	var typeName string
+	var fieldNames, values []string
+	var err error
+	typeName, fieldNames, values, err = splitJSONObject(json)
+	if err != nil { return nil, err }
+	
+	var stored = &storedObject{
+		typeName: typeName,
+		fieldNames: fieldNames,
+		scalarFields: make(map[string]string),
+		listFields: make(map[string][]string),
+	}
+	for i, fieldName := range fieldNames {
+		var elements []string
+		var isStringList bool
+		elements, isStringList, err = splitJSONStringArray(values[i])
+		if err != nil { return nil, err }
+		if isStringList {
+			stored.listFields[fieldName] = elements
+		} else {
+			stored.scalarFields[fieldName] = values[i]
+		}
+	}
+	return stored, nil
+}
+
+/*******************************************************************************
+ * Build a storedObject from the result of readObjectsScript for one key. Returns
+ * nil if the object does not exist.
+ */
+func newStoredObjectFromReply(reply *goredis.Reply) (*storedObject, error) {
+	
+	var parts []*goredis.Reply
+	var err error
+	parts, err = reply.MultiValue()
+	if err != nil { return nil, err }
+	if len(parts) == 0 { return nil, nil }
+	
+	var hash map[string]string
+	hash, err = parts[0].HashValue()
+	if err != nil { return nil, err }
+	
+	var stored = &storedObject{
+		typeName: hash[ObjectTypeFieldName],
+		fieldNames: make([]string, 0),
+		scalarFields: make(map[string]string),
+		listFields: make(map[string][]string),
+		version: hash[ObjectVersionFieldName],
+	}
+	if stored.typeName == "" { return nil, utilities.ConstructServerError(
+		"Stored object has no type") }
+	
+	for _, name := range strings.Split(hash[ObjectFieldsFieldName], ",") {
+		if name == "" { continue }
+		if strings.HasPrefix(name, ListFieldMarker) {
+			name = strings.TrimPrefix(name, ListFieldMarker)
+			stored.listFields[name] = make([]string, 0)
+		} else {
+			stored.scalarFields[name] = hash[name]
+		}
+		stored.fieldNames = append(stored.fieldNames, name)
+	}
+	
+	for i := 1; i+1 < len(parts); i += 2 {
+		var name string
+		var elements []string
+		name, err = parts[i].StringValue()
+		if err != nil { return nil, err }
+		elements, err = parts[i+1].ListValue()
+		if err != nil { return nil, err }
+		if elements == nil { elements = make([]string, 0) }
+		stored.listFields[name] = elements
+	}
+	
+	return stored, nil
+}
+
+/*******************************************************************************
+ * Reassemble the object's JSON, in the format produced by its asJSON method.
+ */
+func (stored *storedObject) asJSON() string {
+	
+	var json = "\"" + stored.typeName + "\": {"
+	for i, fieldName := range stored.fieldNames {
+		if i > 0 { json = json + ", " }
+		json = json + "\"" + fieldName + "\": "
+		var elements, isList = stored.listFields[fieldName]
+		if isList {
+			json = json + "[" + strings.Join(elements, ", ") + "]"
+		} else {
+			json = json + stored.scalarFields[fieldName]
+		}
+	}
+	for _, field := range addedFields[stored.typeName] {
+		if stored.hasField(field.name) { continue }
+		json = json + ", \"" + field.name + "\": " + field.defaultValue
+	}
+	return json + "}"
+}
+
+func (stored *storedObject) hasField(fieldName string) bool {
+	for _, name := range stored.fieldNames {
+		if name == fieldName { return true }
+	}
+	return false
+}
+
+/*******************************************************************************
+ * Return the value of the "_fields" hash field.
+ */
+func (stored *storedObject) fieldsDescriptor() string {
+	var names = make([]string, len(stored.fieldNames))
+	for i, fieldName := range stored.fieldNames {
+		if _, isList := stored.listFields[fieldName]; isList {
+			names[i] = ListFieldMarker + fieldName
+		} else {
+			names[i] = fieldName
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+/*******************************************************************************
+ * Return the keys under which the object is stored: that of its hash, and that
+ * of each of its list fields.
+ */
+func (stored *storedObject) keys(id string) []string {
+	var keys = []string{ objectKey(id) }
+	for _, fieldName := range stored.fieldNames {
+		if _, isList := stored.listFields[fieldName]; isList {
+			keys = append(keys, objectListKey(id, fieldName))
+		}
+	}
+	return keys
+}
+
+func objectKey(id string) string {
+	return ObjectIdPrefix + id
+}
+
+func objectListKey(id string, fieldName string) string {
+	return ObjectIdPrefix + id + "/" + fieldName
+}
+
+/*******************************************************************************
+ * Queue, in the transaction, the commands needed to change the stored object
+ * from its prior state to its new state. If the prior state is not known (nil),
+ * the object is written in its entirety. If anything changes, the object is
+ * given a new version, so that a cached copy of the object can be recognized as
+ * stale (see getObjects).
+ */
+func queueObjectWrite(t commandQueue, id string, prior *storedObject,
+	stored *storedObject) error {
+	
+	var key = objectKey(id)
+	var changed = false
+	var err error
+	
+	// Scalar fields.
+	var args = []interface{}{ "HMSET", key }
+	if (prior == nil) || (prior.typeName != stored.typeName) {
+		changed = true
+		err = t.Command("DEL", key)
+		if err != nil { return err }
+		args = append(args, ObjectTypeFieldName, stored.typeName)
+		prior = nil
+	}
+	var descriptor = stored.fieldsDescriptor()
+	if (prior == nil) || (prior.fieldsDescriptor() != descriptor) {
+		args = append(args, ObjectFieldsFieldName, descriptor)
+	}
+	for fieldName, value := range stored.scalarFields {
+		if (prior == nil) || (prior.scalarFields[fieldName] != value) {
+			args = append(args, fieldName, value)
+		}
+	}
+	if len(args) > 2 {
+		changed = true
+		err = t.Command(args...)
+		if err != nil { return err }
+	}
+	if prior != nil {
+		for fieldName, _ := range prior.scalarFields {
+			if _, isScalar := stored.scalarFields[fieldName]; ! isScalar {
+				changed = true
+				err = t.Command("HDEL", key, fieldName)
+				if err != nil { return err }
+			}
+		}
+	}
+	
+	// List fields.
+	for fieldName, elements := range stored.listFields {
+		var listKey = objectListKey(id, fieldName)
+		var priorElements []string
+		var priorIsList bool
+		if prior != nil { priorElements, priorIsList = prior.listFields[fieldName] }
+		if ! priorIsList {
+			changed = true
+			err = t.Command("DEL", listKey)
+			if err != nil { return err }
+			priorElements = []string{}
+		}
+		var added, removed = diffLists(priorElements, elements)
+		for _, element := range removed {
+			changed = true
+			err = t.Command("LREM", listKey, 1, element)
+			if err != nil { return err }
+		}
+		if len(added) > 0 {
+			changed = true
+			err = t.Command("RPUSH", listKey, added)
+			if err != nil { return err }
+		}
+	}
+	if prior != nil {
+		for fieldName, _ := range prior.listFields {
+			if _, isList := stored.listFields[fieldName]; ! isList {
+				changed = true
+				err = t.Command("DEL", objectListKey(id, fieldName))
+				if err != nil { return err }
+			}
+		}
+	}
+	
+	if changed {
+		stored.version, err = newObjectVersion()
+		if err != nil { return err }
+		err = t.Command("HSET", key, ObjectVersionFieldName, stored.version)
+		if err != nil { return err }
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Return a new, random object version. Versions are random rather than counted,
+ * so that an object that is deleted and then written again does not repeat a
+ * version that may still be cached.
+ */
+func newObjectVersion() (string, error) {
+	var randomBytes = make([]byte, 8)
+	var _, err = rand.Read(randomBytes)
+	if err != nil { return "", err }
+	return hex.EncodeToString(randomBytes), nil
+}
+
+/*******************************************************************************
+ * Queue, in the transaction, the commands needed to delete the stored object.
+ */
+func queueObjectDelete(t commandQueue, id string, storedStates ...*storedObject) error {
+	
+	var keys = []string{ objectKey(id) }
+	for _, stored := range storedStates {
+		if stored == nil { continue }
+		for fieldName, _ := range stored.listFields {
+			keys = append(keys, objectListKey(id, fieldName))
+		}
+	}
+	return t.Command("DEL", keys)
+}
+
+/*******************************************************************************
+ * Return the elements that are in the new list but not the old list, and the
+ * elements that are in the old list but not the new list. Duplicates are
+ * counted, so that the result can be applied with RPUSH and LREM.
+ */
+func diffLists(oldList, newList []string) (added []string, removed []string) {
+	
+	var counts = make(map[string]int)
+	for _, element := range oldList { counts[element]++ }
+	for _, element := range newList {
+		if counts[element] > 0 {
+			counts[element]--
+		} else {
+			added = append(added, element)
+		}
+	}
+	for _, element := range oldList {
+		if counts[element] > 0 {
+			counts[element]--
+			removed = append(removed, element)
+		}
+	}
+	return added, removed
+}
+
+/*******************************************************************************
+ * Read the specified objects from redis in a single round trip. An element of
+ * the result is nil if there is no object with the corresponding id.
+ */
+func (persist *Persistence) readStoredObjects(ids []string) ([]*storedObject, error) {
+	
+	var keys = make([]string, len(ids))
+	for i, id := range ids { keys[i] = objectKey(id) }
+	
+	var reply *goredis.Reply
+	var err error
+	reply, err = persist.RedisClient.Eval(readObjectsScript, keys, []string{})
+	if err != nil { return nil, err }
+	return newStoredObjectsFromReply(reply, len(ids))
+}
+
+/*******************************************************************************
+ * Watch, in the transaction, the specified keys and the specified objects, and
+ * then read the objects. The list fields of an object are stored under keys of
+ * their own, which are not known until the object has been read, unless the
+ * transaction has read the object before (known). An object that turns out to
+ * have list fields that were not watched is therefore read again after they are
+ * watched, so that every value returned was read after its key was watched.
+ * Returns the objects, as readStoredObjects does, and the number of round trips
+ * to redis.
+ */
+func readWatchedObjects(t *redisTransaction, watchKeys []string, ids []string,
+	known map[string]*storedObject) ([]*storedObject, int, error) {
+	
+	var watched = make(map[string]bool)
+	for _, id := range ids {
+		watchKeys = append(watchKeys, objectKey(id))
+		if known[id] != nil { watchKeys = append(watchKeys, known[id].keys(id)...) }
+	}
+	
+	var storedObjs = make([]*storedObject, len(ids))
+	var indexes = make([]int, len(ids))
+	for i := range ids { indexes[i] = i }
+	var roundTrips int
+	for len(indexes) > 0 {
+		var keys = make([]string, len(indexes))
+		for j, i := range indexes { keys[j] = objectKey(ids[i]) }
+		for _, key := range watchKeys { watched[key] = true }
+		
+		var reply *goredis.Reply
+		var err error
+		reply, err = t.WatchAndEval(watchKeys, readObjectsScript, keys, []string{})
+		roundTrips++
+		if err != nil { return nil, roundTrips, err }
+		var values []*storedObject
+		values, err = newStoredObjectsFromReply(reply, len(indexes))
+		if err != nil { return nil, roundTrips, err }
+		
+		// Re-read the objects that have list fields that were not watched.
+		var unwatchedIndexes = make([]int, 0)
+		watchKeys = make([]string, 0)
+		for j, i := range indexes {
+			storedObjs[i] = values[j]
+			if values[j] == nil { continue }
+			var unwatched = false
+			for _, key := range values[j].keys(ids[i]) {
+				if watched[key] { continue }
+				watchKeys = append(watchKeys, key)
+				unwatched = true
+			}
+			if unwatched { unwatchedIndexes = append(unwatchedIndexes, i) }
+		}
+		indexes = unwatchedIndexes
+	}
+	return storedObjs, roundTrips, nil
+}
+
+/*******************************************************************************
+ * Watch, in the transaction, the specified keys, and then read the version of
+ * each of the specified objects, in a single round trip. The version of an
+ * object that does not exist is "".
+ */
+func readWatchedVersions(t *redisTransaction, watchKeys []string, ids []string) ([]string, error) {
+	
+	var keys = make([]string, len(ids))
+	for i, id := range ids { keys[i] = objectKey(id) }
+	
+	var reply *goredis.Reply
+	var err error
+	reply, err = t.WatchAndEval(watchKeys, readObjectVersionsScript, keys, []string{})
+	if err != nil { return nil, err }
+	var results []*goredis.Reply
+	results, err = reply.MultiValue()
+	if err != nil { return nil, err }
+	if len(results) != len(ids) { return nil, utilities.ConstructServerError(
+		"Unexpected number of object versions returned by redis") }
+	
+	var versions = make([]string, len(ids))
+	for i, result := range results {
+		versions[i], err = result.StringValue()
+		if err != nil { return nil, err }
+	}
+	return versions, nil
+}
+
+/*******************************************************************************
+ * Build a storedObject for each of the results of readObjectsScript.
+ */
+func newStoredObjectsFromReply(reply *goredis.Reply, count int) ([]*storedObject, error) {
+	
+	var results []*goredis.Reply
+	var err error
+	results, err = reply.MultiValue()
+	if err != nil { return nil, err }
+	if len(results) != count { return nil, utilities.ConstructServerError(
+		"Unexpected number of objects returned by redis") }
+	
+	var storedObjs = make([]*storedObject, count)
+	for i, result := range results {
+		storedObjs[i], err = newStoredObjectFromReply(result)
+		if err != nil { return nil, err }
+	}
+	return storedObjs, nil
+}
+
+/*******************************************************************************
+ * Convert every object that is stored as a JSON string (schema version 1) to the
+ * hash format. This is called at startup. If several servers start at the same
+ * time, only one performs the migration; the others wait for it to complete. The
+ * lock expires, so that if the server performing the migration stops, one of
+ * the waiting servers takes it over. Objects that were converted before it
+ * stopped are skipped.
+ */
+func (persist *Persistence) migrateObjectsToHashes() error {
+	
+	var version int
+	var err error
+	version, err = persist.readSchemaVersion()
+	if err != nil { return err }
+	if version >= CurrentSchemaVersion { return nil }
+	
+	var acquired bool
+	acquired, err = persist.claimKey(SchemaMigrationLockKey, SchemaMigrationLockSeconds)
+	if err != nil { return err }
+	if ! acquired {
+		fmt.Println("Waiting for another server to migrate the database...")
+		var deadline = time.Now().Add(2 * SchemaMigrationLockSeconds * time.Second)
+		for ! acquired {
+			if time.Now().After(deadline) { return utilities.ConstructServerError(
+				"Timed out waiting for another server to migrate the database") }
+			time.Sleep(time.Second)
+			version, err = persist.readSchemaVersion()
+			if err != nil { return err }
+			if version >= CurrentSchemaVersion { return nil }
+			
+			// If the lock has expired, the other server has stopped: take over.
+			acquired, err = persist.claimKey(SchemaMigrationLockKey, SchemaMigrationLockSeconds)
+			if err != nil { return err }
+		}
+		fmt.Println("Taking over the migration of the database")
+	}
+	
+	fmt.Println("Migrating objects to schema version", CurrentSchemaVersion)
+	var numMigrated = 0
+	var cursor uint64 = 0
+	for {
+		var keys []string
+		cursor, keys, err = persist.RedisClient.Scan(cursor, ObjectIdPrefix + "*", 1000)
+		if err != nil { return err }
+		for _, key := range keys {
+			var id = strings.TrimPrefix(key, ObjectIdPrefix)
+			if strings.Contains(id, "/") { continue }  // a list field
+			var migrated bool
+			migrated, err = persist.migrateObjectToHash(id)
+			if err != nil { return err }
+			if migrated { numMigrated++ }
+		}
+		if cursor == 0 { break }
+	}
+	
+	err = persist.RedisClient.Set(SchemaVersionKey,
+		strconv.Itoa(CurrentSchemaVersion), 0, 0, false, false)
+	if err != nil { return err }
+	_, err = persist.RedisClient.Del(SchemaMigrationLockKey)
+	if err != nil { return err }
+	fmt.Println(fmt.Sprintf("Migrated %d objects", numMigrated))
+	return nil
+}
+
+/*******************************************************************************
+ * Convert the specified object to the hash format, if it is stored as a JSON
+ * string. Returns true if the object was converted. The object and its list
+ * fields are written by a script, which checks that the JSON string has not
+ * changed since it was read. If the string has changed, the conversion is
+ * retried.
+ */
+func (persist *Persistence) migrateObjectToHash(id string) (bool, error) {
+	
+	var key = objectKey(id)
+	for attempt := 0; ; attempt++ {
+		var keyType string
+		var err error
+		keyType, err = persist.RedisClient.Type(key)
+		if err != nil { return false, err }
+		if keyType != "string" { return false, nil }
+		
+		var bytes []byte
+		bytes, err = persist.RedisClient.Get(key)
+		if err != nil { return false, err }
+		var stored *storedObject
+		stored, err = newStoredObjectFromJSON(string(bytes))
+		if err != nil { return false, utilities.ConstructServerError(
+			"Unable to migrate object " + id + ": " + err.Error()) }
+		
+		var hashArgs = []string{ ObjectTypeFieldName, stored.typeName,
+			ObjectFieldsFieldName, stored.fieldsDescriptor() }
+		for fieldName, value := range stored.scalarFields {
+			hashArgs = append(hashArgs, fieldName, value)
+		}
+		var keys = []string{ key }
+		var args = []string{ string(bytes), strconv.Itoa(len(hashArgs)) }
+		args = append(args, hashArgs...)
+		for fieldName, elements := range stored.listFields {
+			keys = append(keys, objectListKey(id, fieldName))
+			args = append(args, strconv.Itoa(len(elements)))
+			args = append(args, elements...)
+		}
+		
+		var reply *goredis.Reply
+		reply, err = persist.RedisClient.Eval(migrateObjectScript, keys, args)
+		if err != nil { return false, err }
+		var result int64
+		result, err = reply.IntegerValue()
+		if err != nil { return false, err }
+		if result >= 0 { return (result == 1), nil }
+		if attempt >= MaxTransactionRetries { return false, utilities.ConstructServerError(
+			"Unable to migrate object " + id + ": it is being changed concurrently") }
+	}
+}
+
+/*******************************************************************************
+ * Return the schema version of the database. A database that has no version
+ * predates versioning, and is version 1.
+ */
+func (persist *Persistence) readSchemaVersion() (int, error) {
+	
+	var bytes []byte
+	var err error
+	bytes, err = persist.RedisClient.Get(SchemaVersionKey)
+	if err != nil { return 0, err }
+	if len(bytes) == 0 { return 1, nil }
+	return strconv.Atoi(string(bytes))
+}
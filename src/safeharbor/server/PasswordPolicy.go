@@ -0,0 +1,95 @@
+/*******************************************************************************
+ * The rules that a new password must satisfy. A password must have at least
+ * PasswordMinLength and at most PasswordMaxLength characters, must differ from
+ * the user Id, and must not appear in the breached password file, if one is
+ * configured. Each line of that file is either a password or, as in the lists
+ * that are published of passwords exposed by breaches, the hexadecimal SHA-1
+ * hash of a password, optionally followed by a colon and a count.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+	
+	"utilities"
+)
+
+const (
+	DefaultPasswordMinLength = 8
+	DefaultPasswordMaxLength = 256
+)
+
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	breachedHashes map[string]struct{}  // upper case hexadecimal SHA-1 hashes
+}
+
+func NewPasswordPolicy(config *Configuration) (*PasswordPolicy, error) {
+	
+	var policy = &PasswordPolicy{
+		MinLength: config.PasswordMinLength,
+		MaxLength: config.PasswordMaxLength,
+		breachedHashes: make(map[string]struct{}),
+	}
+	if policy.MinLength <= 0 { policy.MinLength = DefaultPasswordMinLength }
+	if policy.MaxLength <= 0 { policy.MaxLength = DefaultPasswordMaxLength }
+	if config.BreachedPasswordFile == "" { return policy, nil }
+	
+	var file *os.File
+	var err error
+	file, err = os.Open(config.BreachedPasswordFile)
+	if err != nil { return nil, err }
+	defer file.Close()
+	var scanner = bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line = strings.TrimRight(scanner.Text(), "\r")
+		if line == "" { continue }
+		var hash = strings.SplitN(line, ":", 2)[0]
+		if isSHA1Hex(hash) {
+			policy.breachedHashes[strings.ToUpper(hash)] = struct{}{}
+		} else {
+			policy.breachedHashes[hashPassword(line)] = struct{}{}
+		}
+	}
+	err = scanner.Err()
+	if err != nil { return nil, err }
+	fmt.Println(fmt.Sprintf("Loaded %d breached passwords", len(policy.breachedHashes)))
+	return policy, nil
+}
+
+/*******************************************************************************
+ * Return a user error that explains why the password may not be used, or nil
+ * if it may.
+ */
+func (policy *PasswordPolicy) check(userId, pswd string) error {
+	
+	var length = utf8.RuneCountInString(pswd)
+	if length < policy.MinLength { return utilities.ConstructUserError(fmt.Sprintf(
+		"Password must have at least %d characters", policy.MinLength)) }
+	if length > policy.MaxLength { return utilities.ConstructUserError(fmt.Sprintf(
+		"Password may have at most %d characters", policy.MaxLength)) }
+	if strings.EqualFold(pswd, userId) { return utilities.ConstructUserError(
+		"Password may not be the same as the user Id") }
+	var _, breached = policy.breachedHashes[hashPassword(pswd)]
+	if breached { return utilities.ConstructUserError(
+		"Password is known to have been exposed in a data breach; choose another") }
+	return nil
+}
+
+func hashPassword(pswd string) string {
+	return fmt.Sprintf("%X", sha1.Sum([]byte(pswd)))
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != 2 * sha1.Size { return false }
+	return len(strings.Trim(s, "0123456789abcdefABCDEF")) == 0
+}
@@ -0,0 +1,56 @@
+package server
+
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func Test_PasswordPolicyRejectsShortLongUserIdAndBreachedPasswords(testContext *testing.T) {
+	
+	// The breached file lists one password in clear, and one by its SHA-1 hash,
+	// with a count, as in the published lists.
+	var breachedFile = filepath.Join(testContext.TempDir(), "breached.txt")
+	var err = ioutil.WriteFile(breachedFile, []byte("letmein123\r\n\n" +
+		hashPassword("correcthorse") + ":42\n"), 0600)
+	if err != nil { testContext.Fatal(err) }
+	var policy *PasswordPolicy
+	policy, err = NewPasswordPolicy(&Configuration{ PasswordMinLength: 10, PasswordMaxLength: 20,
+		BreachedPasswordFile: breachedFile })
+	if err != nil { testContext.Fatal(err) }
+	
+	for _, tc := range []struct {
+		userId string
+		pswd string
+		allowed bool
+	}{
+		{ "jdoe", "123456789", false },  // too short
+		{ "jdoe", "1234567890", true },  // the minimum length
+		{ "jdoe", "ééééééééé", false },  // characters, not bytes, are counted
+		{ "jdoe", "éééééééééé", true },
+		{ "jdoe", "12345678901234567890", true },  // the maximum length
+		{ "jdoe", "123456789012345678901", false },  // too long
+		{ "longuserid", "LongUserId", false },  // the user Id, in any case
+		{ "jdoe", "letmein123", false },  // breached, listed in clear
+		{ "jdoe", "correcthorse", false },  // breached, listed by hash
+		{ "jdoe", "CorrectHorse", true },  // hashes are of the exact password
+	} {
+		var err = policy.check(tc.userId, tc.pswd)
+		if (err == nil) != tc.allowed {
+			testContext.Errorf("For user %s and password %q, expected allowed=%v, but got %v",
+				tc.userId, tc.pswd, tc.allowed, err)
+		}
+	}
+}
+
+func Test_PasswordPolicyDefaults(testContext *testing.T) {
+	
+	var policy, err = NewPasswordPolicy(&Configuration{})
+	if err != nil { testContext.Fatal(err) }
+	if (policy.MinLength != DefaultPasswordMinLength) || (policy.MaxLength != DefaultPasswordMaxLength) {
+		testContext.Errorf("Expected the default limits, but got %d and %d", policy.MinLength, policy.MaxLength)
+	}
+	if policy.check("jdoe", "1234567") == nil { testContext.Error("Expected a short password to be rejected") }
+	if policy.check("jdoe", "12345678") != nil { testContext.Error("Expected a password to be allowed") }
+}
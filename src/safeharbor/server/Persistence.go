@@ -14,12 +14,14 @@ package server
 
 import (
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"errors"
 	"strconv"
 	"reflect"
 	"os"
-	//"time"
+	"time"
+	"crypto/rand"
 	"runtime/debug"	
 	
 	"goredis"
@@ -35,7 +37,12 @@ const (
 	RealmHashName = "realms"
 	UserHashName = "users"
 	EmailTokenHashName = "EmailTokens"
-	GloballyUniqueId = "UniqueId"
+	OutboxKeyPrefix = "outbox/"  // followed by a realm Id; see getOutboundEmailIds
+	ScanCountKeyPrefix = "ScanCount/"  // followed by <realm Id>/<UTC date>; see addToScanCount
+	ScanCountKeySeconds = 2 * 24 * 60 * 60
+	RealmCountKeyPrefix = "RealmCount/"  // followed by <realm Id>/<resource>; see reserveRealmCounts
+	ObjectIdAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"  // Crockford base 32
+	ObjectIdLength = 26
 )
 
 /*******************************************************************************
@@ -45,13 +52,20 @@ type Persistence struct {
 	Server *Server
 	InMemoryOnly bool
 	RedisClient *goredis.Redis
-	uniqueId int64
+	inMemoryCounter int64  // for incrementDatabaseKey, if InMemoryOnly
+	objectCache *ObjectCache  // shared by all transactions; nil if caching is disabled
+	objectRoundTrips int64  // number of redis requests made to read objects
 	
 	// Only use this for in-memory only testing.
 	allObjects map[string]PersistObj  // maps object id to PersistObj
 	allUserIds map[string]string  // maps user id to User obj Id
 	realmMap map[string]string  // maps realm name to Realm obj Id
 	emailTokenMap map[string]string  // maps email verification token to IdentityValidationInfo ojb Id
+	outboxes map[string][]string  // maps realm obj Id to the Ids of its OutboundEmails
+	scanCounts map[string]int  // maps scan count key to count
+	scanCountLock sync.Mutex  // makes updates of scanCounts atomic, as INCRBY is
+	realmCounts map[string]int  // maps realm count key to count
+	realmCountLock sync.Mutex  // makes updates of realmCounts atomic, as the scripts are
 }
 
 func NewPersistence(server *Server, redisClient *goredis.Redis) (*Persistence, error) {
@@ -64,13 +78,22 @@ func NewPersistence(server *Server, redisClient *goredis.Redis) (*Persistence, e
 	var err error = persist.init()
 	if err != nil { return nil, err }
 	
+	if (! persist.InMemoryOnly) && (! server.NoCache) {
+		persist.objectCache = NewObjectCache(server.Config.ObjectCacheSize)
+		go persist.objectCache.listenForInvalidations(redisClient)
+	}
+	
 	return persist, nil
 }
 
 type GoRedisTransactionWrapper struct {
 	Persistence *Persistence
-	GoRedisTransaction *goredis.Transaction
+	GoRedisTransaction *redisTransaction
 	UserId string
+	modifiedObjIds []string  // objects updated or deleted by this transaction
+	storedObjects map[string]*storedObject  // stored form of each object read or written
+	heldKeys []string  // keys claimed until the transaction ends; see holdKey
+	realmCountReservations []realmCountReservation  // see reserveRealmCounts
 }
 
 var _ TxnContext = &GoRedisTransactionWrapper{}
@@ -83,43 +106,234 @@ func (txn *GoRedisTransactionWrapper) getUserId() string {
 	return txn.UserId
 }
 
+/*******************************************************************************
+ * Execute the queued commands. If any watched key was modified by another
+ * client since it was watched, redis discards the queued commands and returns
+ * a null reply; in that case, a TransactionConflictError is returned so that
+ * the caller may retry the entire transaction.
+ */
 func (txn *GoRedisTransactionWrapper) commit() error {
 	var err error
-	var t *goredis.Transaction = getRedisTransaction(txn)
-	_, err = t.Exec()
+	var t *redisTransaction = getRedisTransaction(txn)
+	var replies []*goredis.Reply
+	replies, err = t.Exec()
 	t.Close()
+	txn.Persistence.releaseKeys(txn.heldKeys)
+	if (err != nil) || (replies == nil) {
+		txn.Persistence.releaseRealmCounts(txn.realmCountReservations)
+	}
 	
 	if txn.Persistence.Server.NoCache {
 		txn.Persistence.clearCache()
 	}
 	
+	if (err == nil) && (replies == nil) {
+		return NewTransactionConflictError(
+			"Transaction aborted: data was modified by another request")
+	}
+	
+	// Objects that were written may now be stale in the object caches of
+	// this and other servers.
+	if (err == nil) && (txn.Persistence.objectCache != nil) {
+		txn.Persistence.objectCache.publishInvalidation(
+			txn.Persistence.RedisClient, txn.modifiedObjIds)
+	}
+	
 	return err
 }
 
 func (txn *GoRedisTransactionWrapper) abort() error {
 	var err error
-	var t *goredis.Transaction = getRedisTransaction(txn)
+	var t *redisTransaction = getRedisTransaction(txn)
 	err = t.Discard()
 	t.Close()
+	txn.Persistence.releaseKeys(txn.heldKeys)
+	txn.Persistence.releaseRealmCounts(txn.realmCountReservations)
 	return err
 }
 
 func (persist *Persistence) NewTxnContext() (TxnContext, error) {
-	var goRedisTxn *goredis.Transaction
+	var goRedisTxn *redisTransaction
 	var err error
 	
 	if ! persist.InMemoryOnly {
 	if persist.RedisClient == nil { return nil, utilities.ConstructServerError("Redis not configured") }
-		goRedisTxn, err = persist.RedisClient.Transaction()
+		goRedisTxn, err = newRedisTransaction(persist.RedisClient)
 		if err != nil { return nil, err }
 	}
 	
 	return &GoRedisTransactionWrapper{
 		Persistence: persist,
 		GoRedisTransaction: goRedisTxn,
+		storedObjects: make(map[string]*storedObject),
 	}, nil
 }
 
+/*******************************************************************************
+ * A redis transaction, on a connection of its own. (The goredis Transaction sends
+ * MULTI when it is created, and redis refuses WATCH after MULTI, so it cannot
+ * watch the objects that are read.) Keys are watched as objects are read, and
+ * writes are held until the transaction is executed, when they are sent between
+ * MULTI and EXEC. Every object that the transaction reads is therefore watched,
+ * whether it is read before or after the transaction's first write.
+ */
+type redisTransaction struct {
+	pipeline *goredis.Pipelined
+	queued [][]interface{}  // commands to be sent between MULTI and EXEC
+	watching bool  // whether any key has been watched
+}
+
+/*******************************************************************************
+ * The commands that may be queued in a transaction.
+ */
+type commandQueue interface {
+	Command(args ...interface{}) error
+}
+
+var _ commandQueue = &redisTransaction{}
+
+func newRedisTransaction(redisClient *goredis.Redis) (*redisTransaction, error) {
+	var pipeline, err = redisClient.Pipelining()
+	if err != nil { return nil, err }
+	return &redisTransaction{ pipeline: pipeline }, nil
+}
+
+/*******************************************************************************
+ * Return the arguments of a command, with slice arguments expanded, as goredis
+ * does.
+ */
+func expandCommandArgs(args ...interface{}) []interface{} {
+	var expanded = make([]interface{}, 0, len(args))
+	for _, arg := range args {
+		switch values := arg.(type) {
+			case []string: for _, value := range values { expanded = append(expanded, value) }
+			case []interface{}: expanded = append(expanded, values...)
+			default: expanded = append(expanded, arg)
+		}
+	}
+	return expanded
+}
+
+/*******************************************************************************
+ * Send the commands on the transaction's connection, in a single round trip, and
+ * return their replies. An error reply is returned as an error.
+ */
+func (t *redisTransaction) execute(commands ...[]interface{}) ([]*goredis.Reply, error) {
+	var err error
+	for _, command := range commands {
+		err = t.pipeline.Command(expandCommandArgs(command...)...)
+		if err != nil { return nil, err }
+	}
+	var replies = make([]*goredis.Reply, len(commands))
+	for i := range commands {
+		replies[i], err = t.pipeline.Receive()
+		if err != nil { return nil, err }
+	}
+	for _, reply := range replies {
+		if reply.Type == goredis.ErrorReply { return nil, errors.New(reply.Error) }
+	}
+	return replies, nil
+}
+
+/*******************************************************************************
+ * Watch the specified keys.
+ */
+func (t *redisTransaction) Watch(keys ...string) error {
+	if len(keys) == 0 { return nil }
+	var _, err = t.execute([]interface{}{ "WATCH", keys })
+	if err != nil { return err }
+	t.watching = true
+	return nil
+}
+
+/*******************************************************************************
+ * Watch the specified keys, and then run the script, in a single round trip.
+ * Returns the script's reply.
+ */
+func (t *redisTransaction) WatchAndEval(watchKeys []string, script string,
+	keys []string, args []string) (*goredis.Reply, error) {
+	
+	var commands = make([][]interface{}, 0, 2)
+	if len(watchKeys) > 0 {
+		commands = append(commands, []interface{}{ "WATCH", watchKeys })
+	}
+	commands = append(commands, []interface{}{ "EVAL", script, len(keys), keys, args })
+	var replies, err = t.execute(commands...)
+	if err != nil { return nil, err }
+	if len(watchKeys) > 0 { t.watching = true }
+	return replies[len(replies)-1], nil
+}
+
+/*******************************************************************************
+ * Queue a command, to be performed when the transaction is executed.
+ */
+func (t *redisTransaction) Command(args ...interface{}) error {
+	t.queued = append(t.queued, args)
+	return nil
+}
+
+/*******************************************************************************
+ * Perform the queued commands, and return their replies. If a watched key was
+ * modified since it was watched, nothing is performed and the replies are nil.
+ */
+func (t *redisTransaction) Exec() ([]*goredis.Reply, error) {
+	var queued = t.queued
+	t.queued = nil
+	if len(queued) == 0 {
+		if t.watching {
+			t.watching = false
+			var _, err = t.execute([]interface{}{ "UNWATCH" })
+			if err != nil { return nil, err }
+		}
+		return []*goredis.Reply{}, nil
+	}
+	t.watching = false
+	
+	// Send MULTI, the commands and EXEC together. Redis replies QUEUED to each
+	// command, or an error if the command is malformed, in which case EXEC
+	// fails and none of the commands are performed.
+	var err = t.pipeline.Command("MULTI")
+	if err != nil { return nil, err }
+	for _, command := range queued {
+		err = t.pipeline.Command(expandCommandArgs(command...)...)
+		if err != nil { return nil, err }
+	}
+	err = t.pipeline.Command("EXEC")
+	if err != nil { return nil, err }
+	var queueErr error
+	var reply *goredis.Reply
+	for i := 0; i < len(queued) + 1; i++ {
+		reply, err = t.pipeline.Receive()
+		if err != nil { return nil, err }
+		if (reply.Type == goredis.ErrorReply) && (queueErr == nil) {
+			queueErr = errors.New(reply.Error)
+		}
+	}
+	reply, err = t.pipeline.Receive()
+	if err != nil { return nil, err }
+	if queueErr != nil { return nil, queueErr }
+	if reply.Type == goredis.ErrorReply { return nil, errors.New(reply.Error) }
+	return reply.MultiValue()
+}
+
+/*******************************************************************************
+ * Discard the queued commands, and stop watching.
+ */
+func (t *redisTransaction) Discard() error {
+	t.queued = nil
+	if ! t.watching { return nil }
+	t.watching = false
+	var _, err = t.execute([]interface{}{ "UNWATCH" })
+	return err
+}
+
+/*******************************************************************************
+ * Return the connection to the pool.
+ */
+func (t *redisTransaction) Close() {
+	t.pipeline.Close()
+}
+
 /*******************************************************************************
  * Delete all persistent data - but do not delete in-memory data or data that is
  * in another repository such as a docker registry.
@@ -220,6 +434,286 @@ func (persist *Persistence) remIdentityValidationInfo(token string) error {
 	return nil
 }
 
+/*******************************************************************************
+ * Remove the token, when the transaction commits.
+ */
+func (persist *Persistence) queueRemIdentityValidationInfo(txn TxnContext, token string) error {
+	
+	if persist.InMemoryOnly {
+		persist.emailTokenMap[token] = ""
+		return nil
+	}
+	return getRedisTransaction(txn).Command("HDEL", EmailTokenHashName, token)
+}
+
+/*******************************************************************************
+ * Return the Ids of the OutboundEmails in the outbox of the realm, in the order
+ * in which they were added. Each outbox is a redis list, keyed on OutboxKeyPrefix
+ * + <realm Id>, rather than a field of the realm, so that the many transactions
+ * that queue or send email do not write, and so conflict on, the realm.
+ */
+func (persist *Persistence) getOutboundEmailIds(realmId string) ([]string, error) {
+	
+	if persist.InMemoryOnly {
+		return append([]string{}, persist.outboxes[realmId]...), nil
+	}
+	return persist.RedisClient.LRange(OutboxKeyPrefix + realmId, 0, -1)
+}
+
+/*******************************************************************************
+ * Add the OutboundEmail to the outbox of the realm, when the transaction commits.
+ */
+func (persist *Persistence) queueAddOutboundEmailId(txn TxnContext, realmId, emailId string) error {
+	
+	if persist.InMemoryOnly {
+		persist.outboxes[realmId] = append(persist.outboxes[realmId], emailId)
+		return nil
+	}
+	return getRedisTransaction(txn).Command("RPUSH", OutboxKeyPrefix + realmId, emailId)
+}
+
+/*******************************************************************************
+ * Remove the OutboundEmail from the outbox of the realm, when the transaction
+ * commits.
+ */
+func (persist *Persistence) queueRemOutboundEmailId(txn TxnContext, realmId, emailId string) error {
+	
+	if persist.InMemoryOnly {
+		persist.outboxes[realmId] = utilities.RemoveFrom(emailId, persist.outboxes[realmId])
+		return nil
+	}
+	return getRedisTransaction(txn).Command("LREM", OutboxKeyPrefix + realmId, 0, emailId)
+}
+
+/*******************************************************************************
+ * Add the specified number, which may be negative, to the number of scans of the
+ * realm's images on the (UTC) day of the specified time, and return the new
+ * number. Each day's count is a redis key, which a script updates atomically,
+ * and which expires once the day is over.
+ */
+func (persist *Persistence) addToScanCount(realmId string, day time.Time, scans int) (int, error) {
+	
+	var key = scanCountKey(realmId, day)
+	if persist.InMemoryOnly {
+		persist.scanCountLock.Lock()
+		defer persist.scanCountLock.Unlock()
+		persist.scanCounts[key] = persist.scanCounts[key] + scans
+		return persist.scanCounts[key], nil
+	}
+	var reply, err = persist.RedisClient.Eval(addToScanCountScript, []string{ key },
+		[]string{ strconv.Itoa(scans), strconv.Itoa(ScanCountKeySeconds) })
+	if err != nil { return 0, err }
+	var count int64
+	count, err = reply.IntegerValue()
+	if err != nil { return 0, err }
+	return int(count), nil
+}
+
+/*******************************************************************************
+ * Add ARGV[1] to the count at KEYS[1], and set the key to expire in ARGV[2]
+ * seconds, together, so that a count never lacks an expiry.
+ */
+const addToScanCountScript = `
+local count = redis.call('INCRBY', KEYS[1], ARGV[1])
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+return count
+`
+
+/*******************************************************************************
+ * Return the number of scans of the realm's images on the (UTC) day of the
+ * specified time.
+ */
+func (persist *Persistence) getScanCount(realmId string, day time.Time) (int, error) {
+	
+	var key = scanCountKey(realmId, day)
+	if persist.InMemoryOnly {
+		persist.scanCountLock.Lock()
+		defer persist.scanCountLock.Unlock()
+		return persist.scanCounts[key], nil
+	}
+	var bytes, err = persist.RedisClient.Get(key)
+	if err != nil { return 0, err }
+	if len(bytes) == 0 { return 0, nil }
+	return strconv.Atoi(string(bytes))
+}
+
+func scanCountKey(realmId string, day time.Time) string {
+	return ScanCountKeyPrefix + realmId + "/" + day.UTC().Format("2006-01-02")
+}
+
+/*******************************************************************************
+ * Add ARGV[2i-1] to the count at KEYS[i], for each i, unless ARGV[2i] is
+ * positive and the new count would exceed it. The counts are changed only if
+ * all of them may be. Returns { 2, 0 } if the counts were changed, { 1, i } if
+ * the count at KEYS[i] would exceed its limit, and { 0, i } if there is no count
+ * at KEYS[i].
+ */
+const reserveRealmCountsScript = `
+for i, key in ipairs(KEYS) do
+	local count = redis.call('GET', key)
+	if not count then return { 0, i } end
+	local limit = tonumber(ARGV[2*i])
+	if (limit > 0) and (tonumber(count) + tonumber(ARGV[2*i-1]) > limit) then return { 1, i } end
+end
+for i, key in ipairs(KEYS) do
+	redis.call('INCRBY', key, ARGV[2*i-1])
+end
+return { 2, 0 }
+`
+
+/*******************************************************************************
+ * Subtract ARGV[1] from the count at KEYS[1], if there is a count.
+ */
+const subtractFromRealmCountScript = `
+if redis.call('EXISTS', KEYS[1]) == 0 then return 0 end
+return redis.call('DECRBY', KEYS[1], ARGV[1])
+`
+
+/*******************************************************************************
+ * A number that a transaction has added to a realm count, and that is to be
+ * subtracted if the transaction does not commit.
+ */
+type realmCountReservation struct {
+	key string
+	amount int
+}
+
+/*******************************************************************************
+ * Add the specified amounts to the realm's counts of the specified resources,
+ * unless a limit is positive and the resource's count would exceed it. The
+ * counts are checked and changed together, atomically, so that concurrent
+ * requests, on any server, cannot together exceed a limit. If the transaction
+ * does not commit, the amounts are subtracted again. Returns the resource whose
+ * count would exceed its limit, if any, in which case nothing is changed. If a
+ * resource has no count yet, nothing is changed, and the resource is returned
+ * as missing; see initRealmCount.
+ */
+func (persist *Persistence) reserveRealmCounts(txn TxnContext, realmId string,
+	resources []string, amounts []int, limits []int) (missing string, exceeded string, err error) {
+	
+	var keys = make([]string, len(resources))
+	var args = make([]string, 0, 2 * len(resources))
+	for i, resource := range resources {
+		keys[i] = realmCountKey(realmId, resource)
+		args = append(args, strconv.Itoa(amounts[i]), strconv.Itoa(limits[i]))
+	}
+	
+	var status, index int
+	if persist.InMemoryOnly {
+		persist.realmCountLock.Lock()
+		defer persist.realmCountLock.Unlock()
+		status = 2
+		for i, key := range keys {
+			var count, exists = persist.realmCounts[key]
+			if ! exists { status, index = 0, i+1; break }
+			if (limits[i] > 0) && (count + amounts[i] > limits[i]) { status, index = 1, i+1; break }
+		}
+		if status == 2 {
+			for i, key := range keys { persist.realmCounts[key] = persist.realmCounts[key] + amounts[i] }
+		}
+	} else {
+		var reply *goredis.Reply
+		reply, err = persist.RedisClient.Eval(reserveRealmCountsScript, keys, args)
+		if err != nil { return "", "", err }
+		var values []*goredis.Reply
+		values, err = reply.MultiValue()
+		if err != nil { return "", "", err }
+		if len(values) != 2 { return "", "", utilities.ConstructServerError(
+			"Unexpected reply from redis while reserving realm counts") }
+		var value int64
+		value, err = values[0].IntegerValue()
+		if err != nil { return "", "", err }
+		status = int(value)
+		value, err = values[1].IntegerValue()
+		if err != nil { return "", "", err }
+		index = int(value)
+	}
+	
+	switch status {
+		case 0: return resources[index-1], "", nil
+		case 1: return "", resources[index-1], nil
+	}
+	if ! persist.InMemoryOnly {
+		var wrapper = txn.(*GoRedisTransactionWrapper)
+		for i, key := range keys {
+			wrapper.realmCountReservations = append(wrapper.realmCountReservations,
+				realmCountReservation{ key: key, amount: amounts[i] })
+		}
+	}
+	return "", "", nil
+}
+
+/*******************************************************************************
+ * Set the realm's count of the resource, unless it has been set already.
+ */
+func (persist *Persistence) initRealmCount(realmId, resource string, count int) error {
+	
+	var key = realmCountKey(realmId, resource)
+	if persist.InMemoryOnly {
+		persist.realmCountLock.Lock()
+		defer persist.realmCountLock.Unlock()
+		if _, exists := persist.realmCounts[key]; ! exists { persist.realmCounts[key] = count }
+		return nil
+	}
+	var _, err = persist.RedisClient.ExecuteCommand("SET", key, count, "NX")
+	return err
+}
+
+/*******************************************************************************
+ * Return the realm's count of the resource, or -1 if it has not been set.
+ */
+func (persist *Persistence) getRealmCount(realmId, resource string) (int, error) {
+	
+	var key = realmCountKey(realmId, resource)
+	if persist.InMemoryOnly {
+		persist.realmCountLock.Lock()
+		defer persist.realmCountLock.Unlock()
+		var count, exists = persist.realmCounts[key]
+		if ! exists { return -1, nil }
+		return count, nil
+	}
+	var bytes, err = persist.RedisClient.Get(key)
+	if err != nil { return 0, err }
+	if len(bytes) == 0 { return -1, nil }
+	return strconv.Atoi(string(bytes))
+}
+
+/*******************************************************************************
+ * Subtract the specified amount from the realm's count of the resource, when
+ * the transaction commits - e.g., because the transaction deletes the resource.
+ */
+func (persist *Persistence) queueSubtractFromRealmCount(txn TxnContext, realmId,
+	resource string, amount int) error {
+	
+	var key = realmCountKey(realmId, resource)
+	if persist.InMemoryOnly {
+		persist.realmCountLock.Lock()
+		defer persist.realmCountLock.Unlock()
+		if _, exists := persist.realmCounts[key]; exists {
+			persist.realmCounts[key] = persist.realmCounts[key] - amount
+		}
+		return nil
+	}
+	return getRedisTransaction(txn).Command("EVAL", subtractFromRealmCountScript, 1,
+		key, amount)
+}
+
+/*******************************************************************************
+ * Subtract the reserved amounts, of a transaction that did not commit.
+ */
+func (persist *Persistence) releaseRealmCounts(reservations []realmCountReservation) {
+	
+	for _, reservation := range reservations {
+		var _, err = persist.RedisClient.Eval(subtractFromRealmCountScript,
+			[]string{ reservation.key }, []string{ strconv.Itoa(reservation.amount) })
+		if err != nil { fmt.Println("While releasing " + reservation.key + ": " + err.Error()) }
+	}
+}
+
+func realmCountKey(realmId, resource string) string {
+	return RealmCountKeyPrefix + realmId + "/" + resource
+}
+
 /*******************************************************************************
  * Note: We assume that a user''s user-id is not changed once it has been set.
  */
@@ -238,6 +732,18 @@ func (persist *Persistence) GetUserObjIdByUserId(txn TxnContext, userId string)
 	}
 }
 
+/*******************************************************************************
+ * Remove the user Id from the map of user Ids to users, when the transaction
+ * commits, so that another user may be created with it.
+ */
+func (persist *Persistence) queueRemoveUserId(txn TxnContext, userId string) error {
+	if persist.InMemoryOnly {
+		delete(persist.allUserIds, userId)
+		return nil
+	}
+	return getRedisTransaction(txn).Command("HDEL", UserHashName, userId)
+}
+
 /*******************************************************************************
  * 
  */
@@ -311,30 +817,133 @@ func (persist *Persistence) printDatabase() {
 
 /*******************************************************************************
  * Create a globally unique id, to be used to uniquely identify a new persistent
- * object. The creation of the id must be done atomically.
+ * object. Ids must not be guessable, since clients can probe for objects by Id;
+ * they therefore consist of the creation time in milliseconds (so that ids sort
+ * by creation time) followed by 80 random bits, encoded in Crockford base 32 -
+ * 26 characters that are safe for use in URLs and file names. Objects that were
+ * created before this scheme have numeric ids, which remain valid: ids must be
+ * treated as opaque strings.
  */
 func (persist *Persistence) createUniqueDbObjectId() (string, error) {
-	return persist.incrementDatabaseKey(GloballyUniqueId)
+	
+	var randomBytes = make([]byte, 10)
+	var _, err = rand.Read(randomBytes)
+	if err != nil { return "", err }
+	
+	var millis = uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	var id = make([]byte, ObjectIdLength)
+	for i := 9; i >= 0; i-- {  // 48-bit timestamp, 5 bits per character
+		id[i] = ObjectIdAlphabet[millis & 0x1f]
+		millis >>= 5
+	}
+	var bits uint
+	var buffer uint
+	var pos = 10
+	for _, b := range randomBytes {
+		buffer = (buffer << 8) | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			id[pos] = ObjectIdAlphabet[(buffer >> bits) & 0x1f]
+			pos++
+		}
+	}
+	return string(id), nil
 }
 
 /*******************************************************************************
- * Atomically increment the specified database key value.
+ * Atomically increment the specified database key value. If InMemoryOnly, all
+ * keys share one counter, which suffices for the values to be unique.
  */
 func (persist *Persistence) incrementDatabaseKey(keyname string) (string, error) {
 	
 	var id int64
 	if persist.InMemoryOnly {
-		id = atomic.AddInt64(&persist.uniqueId, 1)
+		id = atomic.AddInt64(&persist.inMemoryCounter, 1)
 	} else {
 		var err error
 		id, err = persist.RedisClient.Incr(keyname)
 		if err != nil { return "", err }
 	}
-	
-	persist.uniqueId = id
 	return fmt.Sprintf("%d", id), nil
 }
 
+/*******************************************************************************
+ * Set the key, to expire after the specified number of seconds, unless it is
+ * already set. Return true if it was set: that is, if this server, rather than
+ * another that shares the database, has claimed whatever the key stands for.
+ * The key and its expiry are set by a single SET ... EX ... NX, so that a server
+ * that stops between the two cannot leave a claim that never expires.
+ */
+func (persist *Persistence) claimKey(keyname string, seconds int) (bool, error) {
+	
+	if persist.InMemoryOnly { return true, nil }
+	var hostname, _ = os.Hostname()
+	var reply *goredis.Reply
+	var err error
+	reply, err = persist.RedisClient.ExecuteCommand("SET", keyname,
+		fmt.Sprintf("%s:%d", hostname, os.Getpid()), "EX", seconds, "NX")
+	if err != nil { return false, err }
+	if reply.Type == goredis.BulkReply { return false, nil }  // nil reply: already set
+	err = reply.OKValue()
+	if err != nil { return false, err }
+	return true, nil
+}
+
+/*******************************************************************************
+ * Claim the key (see claimKey) until the transaction is committed or aborted, so
+ * that transactions that hold the same key are performed one at a time. If
+ * another transaction holds the key, wait for it, retrying up to
+ * MaxTransactionRetries times, and then return a TransactionConflictError. The
+ * expiry matters only if the server stops before the transaction ends. A
+ * transaction may hold the same key more than once.
+ */
+func (persist *Persistence) holdKey(txn TxnContext, keyname string, seconds int) error {
+	
+	if persist.InMemoryOnly { return nil }
+	var wrapper = txn.(*GoRedisTransactionWrapper)
+	for _, key := range wrapper.heldKeys {
+		if key == keyname { return nil }
+	}
+	for attempt := 0; ; attempt++ {
+		var claimed, err = persist.claimKey(keyname, seconds)
+		if err != nil { return err }
+		if claimed {
+			wrapper.heldKeys = append(wrapper.heldKeys, keyname)
+			return nil
+		}
+		if attempt >= MaxTransactionRetries { return NewTransactionConflictError(
+			"Transaction aborted: " + keyname + " is held by another request") }
+		time.Sleep(transactionRetryDelay(attempt))
+	}
+}
+
+func (persist *Persistence) releaseKeys(keynames []string) {
+	
+	if len(keynames) == 0 { return }
+	var _, err = persist.RedisClient.Del(keynames...)
+	if err != nil { fmt.Println("While releasing " + fmt.Sprint(keynames) + ": " + err.Error()) }
+}
+
+/*******************************************************************************
+ * Return the object as it is now stored, or nil if there is no such object. The
+ * transaction's and the server's caches are bypassed, and the transaction is not
+ * affected: changes that it has made but not yet committed are not reflected.
+ */
+func (persist *Persistence) readCurrentObject(factory interface{}, id string) (PersistObj, error) {
+	
+	if persist.InMemoryOnly { return persist.allObjects[id], nil }
+	var storedObjs, err = persist.readStoredObjects([]string{ id })
+	if err != nil { return nil, err }
+	if storedObjs[0] == nil { return nil, nil }
+	var obj interface{}
+	_, obj, err = ReconstituteObject(factory, storedObjs[0].asJSON())
+	if err != nil { return nil, err }
+	var persistObj, isType = obj.(PersistObj)
+	if ! isType { return nil, utilities.ConstructServerError("Object is not a PersistObj") }
+	return persistObj, nil
+}
+
 /*******************************************************************************
  * Write an object to the database - making the object persistent.
  * If the object is not already in the database, create it.
@@ -344,19 +953,25 @@ func (persist *Persistence) updateObject(txn TxnContext, obj PersistObj) error {
 	if persist.InMemoryOnly {
 		persist.allObjects[obj.getId()] = obj
 	} else {
-		// Serialize (marshall) the object to JSON, and store it in redis using the
-		// object's Id as the key. When the object is written out, it will be
-		// written as,
+		// Serialize (marshall) the object to JSON, as,
 		//    "<typename>": { <object fields> }
-		// so that getPersistentObject will later be able to map the JSON to the
-		// appropriate go type, using reflection.
+		// and then split the JSON into the fields that are stored in redis (see
+		// ObjectHashes.go), so that getPersistentObject will later be able to
+		// reassemble the JSON and map it to the appropriate go type, using
+		// reflection. Only the fields that have changed since the object was
+		// read in this transaction are written.
 		
-		var key string = ObjectIdPrefix + obj.getId()
-		var json = obj.asJSON()
-		//fmt.Println("Writing Object Id " + key + " value: " + json)
-		var err = getRedisTransaction(txn).Command("SET", key, json)
+		var stored *storedObject
+		var err error
+		stored, err = newStoredObjectFromJSON(obj.asJSON())
+		if err != nil { return err }
+		var wrapper = txn.(*GoRedisTransactionWrapper)
+		err = queueObjectWrite(getRedisTransaction(txn), obj.getId(),
+			wrapper.storedObjects[obj.getId()], stored)
 		if err != nil { debug.PrintStack() }
 		if err != nil { return err }
+		wrapper.storedObjects[obj.getId()] = stored
+		recordModifiedObject(txn, obj.getId())
 	}
 	return nil
 }
@@ -370,10 +985,17 @@ func (persist *Persistence) deleteObject(txn TxnContext, obj PersistObj) error {
 	if persist.InMemoryOnly {
 		persist.allObjects[obj.getId()] = nil
 	} else {
+		var stored *storedObject
 		var err error
-		err = getRedisTransaction(txn).Command("DEL", ObjectIdPrefix + obj.getId())
+		stored, err = newStoredObjectFromJSON(obj.asJSON())
+		if err != nil { return err }
+		var wrapper = txn.(*GoRedisTransactionWrapper)
+		err = queueObjectDelete(getRedisTransaction(txn), obj.getId(),
+			wrapper.storedObjects[obj.getId()], stored)
 		if err != nil { return err }
+		delete(wrapper.storedObjects, obj.getId())
 		persist.allObjects[obj.getId()] = nil
+		recordModifiedObject(txn, obj.getId())
 	}
 	return nil
 }
@@ -389,46 +1011,135 @@ func (persist *Persistence) getObject(txn TxnContext, factory interface{}, id st
 	if persist.InMemoryOnly {
 		return persist.allObjects[id], nil
 	} else {
-		
-		// Set a watch on the object so that if it changes, the transaction will
-		// fail. Note that we cannot retrieve the value as part of the transaction,
-		// and so we are relying on the fact that the watch is set before we read
-		// the value.
+		var persistObjs []PersistObj
 		var err error
-		if ! persist.InMemoryOnly {
-			err = getRedisTransaction(txn).Watch(ObjectIdPrefix + id)
-			if err != nil { debug.PrintStack() }
+		persistObjs, err = persist.getObjects(txn, factory, []string{ id })
+		if err != nil { return nil, err }
+		return persistObjs[0], nil
+	}
+}
+
+/*******************************************************************************
+ * Return the persistent objects that are identified by the specified unique ids,
+ * in the same order as the ids. An element of the result is nil if there is no
+ * object with the corresponding id. The objects are watched, and those that are
+ * not in the object cache are read, in a single round trip to redis regardless
+ * of the number of objects; a second round trip is needed only to watch list
+ * fields that the transaction did not know of before the read.
+ *
+ * A cached object may be stale, since invalidations reach the cache only after
+ * the transaction that made the change has committed. A cached object is
+ * therefore used only if, after it has been watched, its stored version is
+ * found to be the cached version; otherwise, the transaction could write back
+ * a value that has since been replaced, and EXEC would not detect the conflict.
+ * Checking the versions costs a round trip, but a much smaller one than reading
+ * the objects; objects whose versions have changed are then read.
+ */
+func (persist *Persistence) getObjects(txn TxnContext, factory interface{},
+	ids []string) ([]PersistObj, error) {
+	
+	var persistObjs = make([]PersistObj, len(ids))
+	if len(ids) == 0 { return persistObjs, nil }
+	
+	if persist.InMemoryOnly {
+		for i, id := range ids {
+			persistObjs[i] = persist.allObjects[id]
+		}
+		return persistObjs, nil
+	}
+	
+	// Obtain the JSON for each object - from the object cache if possible.
+	var wrapper = txn.(*GoRedisTransactionWrapper)
+	var jsons = make([]string, len(ids))
+	var storedObjs = make([]*storedObject, len(ids))
+	var cachedIndexes = make([]int, 0, len(ids))
+	var cachedIds = make([]string, 0, len(ids))
+	var cachedKeys = make([]string, 0)
+	var uncachedIndexes = make([]int, 0, len(ids))
+	var uncachedIds = make([]string, 0, len(ids))
+	var err error
+	for i, id := range ids {
+		var version string
+		var cached bool
+		if persist.objectCache != nil {
+			jsons[i], version, cached = persist.objectCache.get(id)
+		}
+		if cached {
+			storedObjs[i], err = newStoredObjectFromJSON(jsons[i])
 			if err != nil { return nil, err }
+			storedObjs[i].version = version
+			cachedIndexes = append(cachedIndexes, i)
+			cachedIds = append(cachedIds, id)
+			cachedKeys = append(cachedKeys, storedObjs[i].keys(id)...)
+		} else {
+			uncachedIndexes = append(uncachedIndexes, i)
+			uncachedIds = append(uncachedIds, id)
 		}
-		
-		// Read JSON from the database, using the id as the key; then deserialize
-		// (unmarshall) the JSON into an object. The outermost JSON object will be
-		// a field name - that field name is the name of the go object type; reflection
-		// will be used to identify the go type, and set the fields in the type using
-		// values from the hashmap that is built by the unmarshalling.
-		
-		var bytes []byte
-		
-		// Read the value of the object from the database. This is done outside
-		// of the transaction, because Redis does not allow one to read a value
-		// as part of a transaction and then act on that value within the
-		// transaction.
-		bytes, err = persist.RedisClient.Get(ObjectIdPrefix + id)
+	}
+	
+	// Set a watch on each object, and on each of its list fields, so that if
+	// it changes, the transaction will fail. Then check that each cached
+	// object is current: those that are not are read along with the objects
+	// that were not cached, after they are watched (see readWatchedObjects).
+	var t = getRedisTransaction(txn)
+	if len(cachedIds) > 0 {
+		var versions []string
+		versions, err = readWatchedVersions(t, cachedKeys, cachedIds)
+		atomic.AddInt64(&persist.objectRoundTrips, 1)
+		if err != nil { debug.PrintStack() }
 		if err != nil { return nil, err }
-		if bytes == nil { return nil, nil }
-		if len(bytes) == 0 { return nil, nil }
+		for j, i := range cachedIndexes {
+			if versions[j] == storedObjs[i].version { continue }
+			jsons[i] = ""
+			storedObjs[i] = nil
+			uncachedIndexes = append(uncachedIndexes, i)
+			uncachedIds = append(uncachedIds, ids[i])
+		}
+	}
+	if len(uncachedIds) > 0 {
+		var generation uint64
+		if persist.objectCache != nil { generation = persist.objectCache.getGeneration() }
 		
+		var values []*storedObject
+		var roundTrips int
+		values, roundTrips, err = readWatchedObjects(t, []string{}, uncachedIds,
+			wrapper.storedObjects)
+		atomic.AddInt64(&persist.objectRoundTrips, int64(roundTrips))
+		if err != nil { debug.PrintStack() }
+		if err != nil { return nil, err }
+		for j, i := range uncachedIndexes {
+			if values[j] == nil { continue }
+			storedObjs[i] = values[j]
+			jsons[i] = values[j].asJSON()
+			if persist.objectCache != nil {
+				persist.objectCache.put(ids[i], values[j].typeName, jsons[i],
+					values[j].version, generation)
+			}
+		}
+	}
+	
+	// Deserialize each object. Remember the stored form of each, so that when
+	// it is updated, only the changes need to be written.
+	for i, json := range jsons {
+		if json == "" { continue }
+		wrapper.storedObjects[ids[i]] = storedObjs[i]
 		var obj interface{}
-		_, obj, err = ReconstituteObject(factory, string(bytes))
+		_, obj, err = ReconstituteObject(factory, json)
 		if err != nil { return nil, err }
-		
-		var persistObj PersistObj
 		var isType bool
-		persistObj, isType = obj.(PersistObj)
+		persistObjs[i], isType = obj.(PersistObj)
 		if ! isType { return nil, utilities.ConstructServerError("Object is not a PersistObj") }
-		
-		return persistObj, nil
 	}
+	
+	return persistObjs, nil
+}
+
+/*******************************************************************************
+ * Return the number of requests that have been made to redis in order to read
+ * objects. Used to measure the effect of batching.
+ */
+func (persist *Persistence) getObjectRoundTripCount() int64 {
+	return atomic.LoadInt64(&persist.objectRoundTrips)
 }
 
 /*******************************************************************************
@@ -533,9 +1244,9 @@ func (persist *Persistence) init() error {
 	
 	persist.resetInMemoryState()
 	
-	if persist.InMemoryOnly {
-		var err = persist.loadCoreData()
-		if err != nil { return utilities.ConstructServerError("Unable to load database state: " + err.Error()) }
+	if ! persist.InMemoryOnly {
+		var err = persist.migrateObjectsToHashes()
+		if err != nil { return utilities.ConstructServerError("Unable to migrate database: " + err.Error()) }
 	}
 	
 	/*
@@ -559,68 +1270,28 @@ func (persist *Persistence) init() error {
 
 
 
-/*******************************************************************************
- * Load core database state.
- * If the data is not present in the database, it should be created and written out.
- */
-func (persist *Persistence) loadCoreData() error {
-	fmt.Println("Loading core database state...")
-	var id int64
-	var err error
-	id, err = persist.readUniqueId()  // returns 0 if database is "virgin"
-	if err != nil { return err }
-	if id == 0 {
-		err = persist.RedisClient.Set(
-			"UniqueId", fmt.Sprintf("%d", persist.uniqueId), 0, 0, false, false)
-		if err != nil { return err }
-	} else {
-		persist.uniqueId = id
-	}
-	
-	fmt.Println("...completing loading database state.")
-	return nil
-}
-
-/*******************************************************************************
- * Return the current value of the unique object Id generator.
- */
-func (persist *Persistence) readUniqueId() (int64, error) {
-	if persist.InMemoryOnly {
-		return persist.uniqueId, nil
-	} else {
-		var bytes []byte
-		var err error
-		bytes, err = persist.RedisClient.Get("UniqueId")
-		if err != nil { return 0, err }
-		var str = string(bytes)
-		if str == "" { return 0, nil }
-		var id int64
-		id, err = strconv.ParseInt(str, 10, 64)
-		if err != nil { return 0, err }
-		fmt.Println(fmt.Sprintf("Read unique Id %s from database", id))
-		return id, nil
-	}
-}
-
 /*******************************************************************************
  * Initialize the in-memory state of the database. This is normally called on
  * startup, of if the database connection must be re-established. Persistent
  * state is not modified.
  */
 func (persist *Persistence) resetInMemoryState() {
-	persist.uniqueId = 100000005
 	persist.clearCache()
 }
 
 /*******************************************************************************
  * Clear all objects in the in-memory cache, so that future requests will have
- * to reload the data. Do not reset the uniqueId value.
+ * to reload the data.
  */
 func (persist *Persistence) clearCache() {
 	persist.realmMap = make(map[string]string)
 	persist.allObjects = make(map[string]PersistObj)
 	persist.allUserIds = make(map[string]string)
 	persist.emailTokenMap = make(map[string]string)
+	persist.outboxes = make(map[string][]string)
+	persist.scanCounts = make(map[string]int)
+	persist.realmCounts = make(map[string]int)
+	if persist.objectCache != nil { persist.objectCache.clear() }
 }
 
 /*******************************************************************************
@@ -638,16 +1309,28 @@ func (persist *Persistence) clearDatabase() error {
 		return utilities.ConstructServerError(fmt.Sprintf(
 			"Database not deleted: %d keys remain", nkeys))
 	}
-	return nil
+	
+	// The database is empty, and so does not need to be migrated.
+	return persist.RedisClient.Set(SchemaVersionKey,
+		strconv.Itoa(CurrentSchemaVersion), 0, 0, false, false)
 }
 
 /*******************************************************************************
  * 
  */
-func getRedisTransaction(txn TxnContext) *goredis.Transaction {
+func getRedisTransaction(txn TxnContext) *redisTransaction {
 	return txn.(*GoRedisTransactionWrapper).GoRedisTransaction
 }
 
+/*******************************************************************************
+ * Note that the transaction writes the specified object, so that the object can
+ * be removed from object caches when the transaction commits.
+ */
+func recordModifiedObject(txn TxnContext, id string) {
+	var wrapper = txn.(*GoRedisTransactionWrapper)
+	wrapper.modifiedObjIds = append(wrapper.modifiedObjIds, id)
+}
+
 /*******************************************************************************
  * Construct an object as defined by the specified JSON string. Returns the
  * name of the object type and the object, or an error. The factory has
@@ -0,0 +1,286 @@
+package server
+
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"os"
+	"time"
+	
+	"goredis"
+	
+	"safeharbor/apitypes"
+)
+
+/*******************************************************************************
+ * Connect to the test redis server, and empty it. These tests need a redis
+ * server that may be written to: set SAFEHARBOR_TEST_REDIS to its host:port.
+ * Database 15 of that server is used. Returns a Server that is configured to
+ * use that redis server (without caching objects).
+ */
+func newTestRedisServer(t testing.TB) *Server {
+	
+	var address = os.Getenv("SAFEHARBOR_TEST_REDIS")
+	if address == "" { t.Skip("SAFEHARBOR_TEST_REDIS not set") }
+	
+	var redisClient *goredis.Redis
+	var err error
+	redisClient, err = goredis.Dial(&goredis.DialConfig{
+		Network: "tcp",
+		Address: address,
+		Database: 15,
+		Timeout: 5 * time.Second,
+		MaxIdle: 1,
+	})
+	if err != nil { t.Fatal(err) }
+	err = redisClient.FlushDB()
+	if err != nil { t.Fatal(err) }
+	
+	var server = &Server{
+		Config: &Configuration{},
+		NoCache: true,
+		MaxLoginAttemptsToRetain: 5,
+	}
+	var persist = &Persistence{
+		Server: server,
+		RedisClient: redisClient,
+	}
+	server.persistence = persist
+	persist.resetInMemoryState()
+	
+	return server
+}
+
+/*******************************************************************************
+ * Two clients that read the same object both try to update it: the first to
+ * commit wins, and the other's transaction conflicts. A request that keeps
+ * conflicting in that way is retried by the dispatcher, and then fails with
+ * a 409.
+ */
+func Test_ConflictingTransactionsAreDetectedAndRetried(testContext *testing.T) {
+	
+	var server = newTestRedisServer(testContext)
+	var newClient = func() *InMemClient {
+		var client, err = NewInMemClient(server)
+		if err != nil { testContext.Fatal(err) }
+		return client
+	}
+	
+	var creator = newClient()
+	var created, err = creator.NewInMemACLEntry("resource", "party",
+		[]bool{true, true, false, false, false})
+	if err != nil { testContext.Fatal(err) }
+	var id = created.getId()
+	err = creator.commit()
+	if err != nil { testContext.Fatal(err) }
+	
+	// Each update toggles one mode, so that each one writes the entry.
+	var toggleMode = func(client *InMemClient, entry ACLEntry) error {
+		var mask = make([]bool, 5)
+		copy(mask, entry.getPermissionMask())
+		mask[2] = ! mask[2]
+		return entry.setPermissionMask(client, mask)
+	}
+	var updateEntry = func(client *InMemClient) error {
+		var entry, err = client.getACLEntry(id)
+		if err != nil { return err }
+		return toggleMode(client, entry)
+	}
+	
+	var first = newClient()
+	var second = newClient()
+	err = updateEntry(first)
+	if err != nil { testContext.Fatal(err) }
+	var secondEntry ACLEntry
+	secondEntry, err = second.getACLEntry(id)
+	if err != nil { testContext.Fatal(err) }
+	err = first.commit()
+	if err != nil { testContext.Fatal(err) }
+	err = toggleMode(second, secondEntry)
+	if err != nil { testContext.Fatal(err) }
+	err = second.commit()
+	if _, isConflict := err.(*TransactionConflictError); ! isConflict {
+		testContext.Fatalf("Expected a TransactionConflictError, but got %v", err)
+	}
+	
+	// A request whose object is updated by another client while it runs.
+	var dispatcher = NewDispatcher()
+	var attempts int
+	var interfereUntil int
+	var invoke = func() (apitypes.RespIntfTp, error) {
+		attempts++
+		var client = newClient()
+		var entry, err = client.getACLEntry(id)
+		if err != nil { client.abort(); return nil, err }
+		if attempts <= interfereUntil {
+			var other = newClient()
+			err = updateEntry(other)
+			if err != nil { other.abort(); client.abort(); return nil, err }
+			err = other.commit()
+			if err != nil { client.abort(); return nil, err }
+		}
+		err = toggleMode(client, entry)
+		if err != nil { client.abort(); return nil, err }
+		err = client.commit()
+		if err != nil { return nil, err }
+		return apitypes.NewResult(200, "done"), nil
+	}
+	
+	attempts, interfereUntil = 0, 1
+	_, err = dispatcher.invokeWithRetries("setPermission", invoke)
+	if err != nil { testContext.Fatal(err) }
+	if attempts != 2 { testContext.Errorf("Expected 2 attempts, but there were %d", attempts) }
+	
+	attempts, interfereUntil = 0, 100
+	_, err = dispatcher.invokeWithRetries("setPermission", invoke)
+	if attempts != MaxTransactionRetries + 1 {
+		testContext.Errorf("Expected %d attempts, but there were %d", MaxTransactionRetries + 1, attempts)
+	}
+	var conflictErr, isConflict = err.(*TransactionConflictError)
+	if ! isConflict { testContext.Fatalf("Expected a TransactionConflictError, but got %v", err) }
+	if conflictErr.asFailureDesc().HTTPStatusCode != http.StatusConflict {
+		testContext.Error("Expected a conflict to be reported as a 409")
+	}
+}
+
+/*******************************************************************************
+ * A transaction that reads a list field - even after it has queued a write -
+ * conflicts with another transaction that changes the list.
+ */
+func Test_ChangesToListsThatWereReadAreDetected(testContext *testing.T) {
+	
+	var server = newTestRedisServer(testContext)
+	var newClient = func() *InMemClient {
+		var client, err = NewInMemClient(server)
+		if err != nil { testContext.Fatal(err) }
+		return client
+	}
+	
+	var creator = newClient()
+	var group, err = creator.NewInMemGroup("realm", "group", "")
+	if err != nil { testContext.Fatal(err) }
+	var groupId = group.getId()
+	err = creator.commit()
+	if err != nil { testContext.Fatal(err) }
+	
+	// The first client queues a write, and then reads the group's members.
+	var first = newClient()
+	_, err = first.NewInMemACLEntry("resource", "party", []bool{true, false, false, false, false})
+	if err != nil { testContext.Fatal(err) }
+	var firstGroup Group
+	firstGroup, err = first.getGroup(groupId)
+	if err != nil { testContext.Fatal(err) }
+	if len(firstGroup.getUserObjIds()) != 0 { testContext.Fatal("Expected the group to be empty") }
+	
+	// The second client adds a member, and commits first.
+	var second = newClient()
+	var secondGroup Group
+	secondGroup, err = second.getGroup(groupId)
+	if err != nil { testContext.Fatal(err) }
+	var inMemGroup = secondGroup.(*InMemGroup)
+	inMemGroup.UserObjIds = append(inMemGroup.UserObjIds, "member")
+	err = second.updateObject(inMemGroup)
+	if err != nil { testContext.Fatal(err) }
+	err = second.commit()
+	if err != nil { testContext.Fatal(err) }
+	
+	err = first.commit()
+	if _, isConflict := err.(*TransactionConflictError); ! isConflict {
+		testContext.Fatalf("Expected a TransactionConflictError, but got %v", err)
+	}
+}
+
+func Test_ObjectIdsAreOpaqueStrings(testContext *testing.T) {
+	
+	var f = newTestDB(testContext)
+	var ids = []string{ f.realm.getId(), f.user.getId(), f.repo.getId(), f.dockerfile.getId() }
+	var seen = make(map[string]bool)
+	for _, id := range ids {
+		if len(id) != ObjectIdLength { testContext.Errorf("Id %s is not %d characters", id, ObjectIdLength) }
+		if seen[id] { testContext.Errorf("Id %s was assigned twice", id) }
+		seen[id] = true
+	}
+	
+	// Response types carry ids as JSON strings, never as numbers.
+	var desc map[string]interface{}
+	var err = json.Unmarshal([]byte(f.repo.asRepoDesc().AsJSON()), &desc)
+	if err != nil { testContext.Fatal(err) }
+	if id, isString := desc["Id"].(string); (! isString) || (id != f.repo.getId()) {
+		testContext.Errorf("Expected the Id %s as a string, but got %v", f.repo.getId(), desc["Id"])
+	}
+	var dockerfileIds, isArray = desc["DockerfileIds"].([]interface{})
+	if (! isArray) || (len(dockerfileIds) != 1) || (dockerfileIds[0] != f.dockerfile.getId()) {
+		testContext.Errorf("Expected the Dockerfile Ids as strings, but got %v", desc["DockerfileIds"])
+	}
+}
+
+/*******************************************************************************
+ * These benchmarks compare the number of redis round trips needed to load a set
+ * of objects one at a time with the number needed to load them as a batch. Like
+ * the transaction tests above, they need SAFEHARBOR_TEST_REDIS.
+ */
+const NumberOfBenchmarkObjects = 200
+
+func BenchmarkGetObjectsOneAtATime(b *testing.B) {
+	
+	var server, ids = createBenchmarkObjects(b, NumberOfBenchmarkObjects)
+	var persist = server.persistence
+	var startCount = persist.getObjectRoundTripCount()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var client, err = NewInMemClient(server)
+		if err != nil { b.Fatal(err) }
+		for _, id := range ids {
+			_, err = client.getPersistentObject(id)
+			if err != nil { b.Fatal(err) }
+		}
+		client.abort()
+	}
+	b.StopTimer()
+	reportRoundTrips(b, persist.getObjectRoundTripCount() - startCount)
+}
+
+func BenchmarkGetObjectsBatched(b *testing.B) {
+	
+	var server, ids = createBenchmarkObjects(b, NumberOfBenchmarkObjects)
+	var persist = server.persistence
+	var startCount = persist.getObjectRoundTripCount()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var client, err = NewInMemClient(server)
+		if err != nil { b.Fatal(err) }
+		_, err = client.getPersistentObjects(ids)
+		if err != nil { b.Fatal(err) }
+		client.abort()
+	}
+	b.StopTimer()
+	reportRoundTrips(b, persist.getObjectRoundTripCount() - startCount)
+}
+
+/*******************************************************************************
+ * Connect to the test redis server, and write the specified number of ACL
+ * entries to it. Returns a Server that is configured to use that redis server,
+ * and the Ids of the ACL entries.
+ */
+func createBenchmarkObjects(b *testing.B, numObjects int) (*Server, []string) {
+	
+	var server = newTestRedisServer(b)
+	var client, err = NewInMemClient(server)
+	if err != nil { b.Fatal(err) }
+	var ids = make([]string, numObjects)
+	for i := 0; i < numObjects; i++ {
+		var entry *InMemACLEntry
+		entry, err = client.NewInMemACLEntry("resource", "party", []bool{true, true, false, false, false})
+		if err != nil { b.Fatal(err) }
+		ids[i] = entry.getId()
+	}
+	err = client.commit()
+	if err != nil { b.Fatal(err) }
+	
+	return server, ids
+}
+
+func reportRoundTrips(b *testing.B, roundTrips int64) {
+	b.ReportMetric(float64(roundTrips) / float64(b.N), "roundtrips/op")
+}
@@ -0,0 +1,309 @@
+/*******************************************************************************
+ * Per-realm quotas. The configuration may specify, for each realm (by name), a
+ * limit on the number of repos, images, and image versions that the realm may
+ * contain, on the number of bytes stored in the realm's file directory, and on
+ * the number of scans of the realm's images per (UTC) day. A realm that has no
+ * entry, or whose entry omits a limit, is subject to the limit given by the
+ * Default entry, if any. A limit of zero means that the resource is unlimited.
+ * The handlers reserve what they create against the quotas before creating it,
+ * and respond with StatusForbidden if the action would exceed a quota.
+ *
+ * Repos, images, and image versions are counted by a redis counter for each
+ * realm and resource, which is checked and incremented atomically when they are
+ * reserved, decremented if the reserving transaction does not commit, and
+ * decremented when they are deleted; so concurrent requests, on any server,
+ * cannot together exceed a quota. A realm's counters are set, by tallying what
+ * the realm contains, the first time that they are needed.
+ *
+ * Scans are counted by a redis counter for each realm and day, which is
+ * incremented when scans are reserved, before they are performed, and
+ * decremented for reserved scans that are not performed; so concurrent requests,
+ * on any server, cannot together exceed MaxScansPerDay.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+	
+	"safeharbor/apitypes"
+	
+	"utilities"
+)
+
+const DefaultRealmQuotaName = "Default"
+const UnsetQuota = -1  // the limit is taken from the Default entry
+
+// Resources that are counted for each realm; see reserveRealmQuota.
+const (
+	RealmReposCount = "Repos"
+	RealmImagesCount = "Images"
+	RealmImageVersionsCount = "ImageVersions"
+)
+
+type RealmQuota struct {
+	MaxRepos int
+	MaxImages int
+	MaxImageVersions int
+	MaxStoredBytes int64
+	MaxScansPerDay int
+}
+
+/*******************************************************************************
+ * The amount of each resource that is subject to a quota that a realm uses.
+ */
+type RealmUsage struct {
+	Repos int
+	Images int
+	ImageVersions int
+	StoredBytes int64
+	ScansToday int  // since midnight, UTC
+}
+
+/*******************************************************************************
+ * Return the quotas that apply to the specified realm.
+ */
+func getRealmQuota(config *Configuration, realm Realm) *RealmQuota {
+	
+	var quota = &RealmQuota{}
+	var defaultQuota = config.RealmQuotas[DefaultRealmQuotaName]
+	var realmQuota = config.RealmQuotas[realm.getName()]
+	for _, q := range []*RealmQuota{ defaultQuota, realmQuota } {  // realm entry overrides
+		if q == nil { continue }
+		if q.MaxRepos != UnsetQuota { quota.MaxRepos = q.MaxRepos }
+		if q.MaxImages != UnsetQuota { quota.MaxImages = q.MaxImages }
+		if q.MaxImageVersions != UnsetQuota { quota.MaxImageVersions = q.MaxImageVersions }
+		if q.MaxStoredBytes != UnsetQuota { quota.MaxStoredBytes = q.MaxStoredBytes }
+		if q.MaxScansPerDay != UnsetQuota { quota.MaxScansPerDay = q.MaxScansPerDay }
+	}
+	return quota
+}
+
+/*******************************************************************************
+ * Return the amount of each resource that the realm uses.
+ */
+func computeRealmUsage(dbClient DBClient, realm Realm) (*RealmUsage, error) {
+	
+	var persist = dbClient.getPersistence()
+	var usage = &RealmUsage{}
+	var counts = []*int{ &usage.Repos, &usage.Images, &usage.ImageVersions }
+	var err error
+	for i, resource := range realmCountedResources {
+		*counts[i], err = persist.getRealmCount(realm.getId(), resource)
+		if err != nil { return nil, err }
+		if *counts[i] >= 0 { continue }
+		err = initRealmCounts(dbClient, realm)
+		if err != nil { return nil, err }
+		*counts[i], err = persist.getRealmCount(realm.getId(), resource)
+		if err != nil { return nil, err }
+	}
+	usage.StoredBytes, err = getDirectorySize(realm.getFileDirectory())
+	if err != nil { return nil, err }
+	usage.ScansToday, err = persist.getScanCount(realm.getId(), time.Now())
+	if err != nil { return nil, err }
+	return usage, nil
+}
+
+var realmCountedResources = []string{ RealmReposCount, RealmImagesCount, RealmImageVersionsCount }
+
+/*******************************************************************************
+ * Set the realm's counts of repos, images, and image versions, by tallying what
+ * the realm contains - unless they have been set already. This is needed only
+ * once for each realm, as the counts are maintained thereafter.
+ */
+func initRealmCounts(dbClient DBClient, realm Realm) error {
+	
+	var repos, images, imageVersions int
+	var err error
+	for _, repoId := range realm.getRepoIds() {
+		var repo Repo
+		repo, err = dbClient.getRepo(repoId)
+		if err != nil { return err }
+		repos++
+		for _, imageId := range repo.getDockerImageIds() {
+			var image DockerImage
+			image, err = dbClient.getDockerImage(imageId)
+			if err != nil { return err }
+			images++
+			imageVersions = imageVersions + len(image.getImageVersionIds())
+		}
+	}
+	var persist = dbClient.getPersistence()
+	for i, count := range []int{ repos, images, imageVersions } {
+		err = persist.initRealmCount(realm.getId(), realmCountedResources[i], count)
+		if err != nil { return err }
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Return the total size of the regular files within the directory tree.
+ */
+func getDirectorySize(path string) (int64, error) {
+	
+	if path == "" { return 0, nil }
+	var size int64 = 0
+	var err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil { return err }
+		if info.Mode().IsRegular() { size = size + info.Size() }
+		return nil
+	})
+	if os.IsNotExist(err) { return 0, nil }
+	return size, err
+}
+
+/*******************************************************************************
+ * Count the specified numbers of repos, images, and image versions, which the
+ * transaction of dbClient is to create, against the realm's quotas. If that
+ * would exceed a quota, nothing is counted, and a response that says which quota
+ * would be exceeded is returned. If the transaction does not commit, the counts
+ * are restored. Scans are reserved by reserveRealmScans.
+ */
+func reserveRealmQuota(dbClient DBClient, realm Realm, newRepos, newImages,
+	newImageVersions int) apitypes.RespIntfTp {
+	
+	var quota = getRealmQuota(dbClient.getServer().Config, realm)
+	return reserveRealmResources(dbClient, realm, []int{ newRepos, newImages, newImageVersions },
+		[]int{ quota.MaxRepos, quota.MaxImages, quota.MaxImageVersions })
+}
+
+/*******************************************************************************
+ * Count the specified numbers of repos, images, and image versions against the
+ * realm, without limit - for what is created regardless of the realm's quotas.
+ */
+func countRealmResources(dbClient DBClient, realm Realm, newRepos, newImages,
+	newImageVersions int) error {
+	
+	var failMsg = reserveRealmResources(dbClient, realm, []int{ newRepos, newImages, newImageVersions },
+		[]int{ 0, 0, 0 })
+	if failMsg == nil { return nil }
+	return utilities.ConstructServerError("While counting the resources of realm " +
+		realm.getName() + ": " + failMsg.(*apitypes.FailureDesc).HTTPReasonPhrase)
+}
+
+func reserveRealmResources(dbClient DBClient, realm Realm, amounts []int, limits []int) apitypes.RespIntfTp {
+	
+	var persist = dbClient.getPersistence()
+	for {
+		var missing, exceeded, err = persist.reserveRealmCounts(dbClient.getTransactionContext(),
+			realm.getId(), realmCountedResources, amounts, limits)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		switch exceeded {
+			case RealmReposCount: return newQuotaFailure(realm, "repos", limits[0])
+			case RealmImagesCount: return newQuotaFailure(realm, "images", limits[1])
+			case RealmImageVersionsCount: return newQuotaFailure(realm, "image versions", limits[2])
+		}
+		if missing == "" { return nil }
+		err = initRealmCounts(dbClient, realm)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+	}
+}
+
+/*******************************************************************************
+ * Count the specified number of scans, to be performed now, against the realm's
+ * MaxScansPerDay. If that would exceed the quota, the scans are not counted, and
+ * a response that says so is returned. The caller must release, with
+ * releaseRealmScans and the same time, any of the scans that it does not perform.
+ */
+func reserveRealmScans(dbClient DBClient, realm Realm, newScans int, now time.Time) apitypes.RespIntfTp {
+	
+	var quota = getRealmQuota(dbClient.getServer().Config, realm)
+	var count, err = dbClient.getPersistence().addToScanCount(realm.getId(), now, newScans)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if (quota.MaxScansPerDay > 0) && (count > quota.MaxScansPerDay) {
+		releaseRealmScans(dbClient, realm, newScans, now)
+		return newQuotaFailure(realm, "scans per day", quota.MaxScansPerDay)
+	}
+	return nil
+}
+
+func releaseRealmScans(dbClient DBClient, realm Realm, scans int, reserved time.Time) {
+	
+	if scans == 0 { return }
+	var _, err = dbClient.getPersistence().addToScanCount(realm.getId(), reserved, -scans)
+	if err != nil { fmt.Println("While releasing scans of realm " + realm.getName() + ": " + err.Error()) }
+}
+
+/*******************************************************************************
+ * Check that the realm's file directory, which already includes the file at the
+ * specified path, does not exceed the realm's quota. If it does, remove the file
+ * and return a response that says so.
+ */
+func checkStoredBytesQuota(dbClient DBClient, realm Realm, path string) apitypes.RespIntfTp {
+	
+	var quota = getRealmQuota(dbClient.getServer().Config, realm)
+	if quota.MaxStoredBytes == 0 { return nil }
+	var size int64
+	var err error
+	size, err = getDirectorySize(realm.getFileDirectory())
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if size <= quota.MaxStoredBytes { return nil }
+	os.Remove(path)
+	return apitypes.NewFailureDesc(http.StatusForbidden, fmt.Sprintf(
+		"Quota exceeded: realm %s may store at most %d bytes", realm.getName(),
+		quota.MaxStoredBytes))
+}
+
+/*******************************************************************************
+ * Perform checkStoredBytesQuota for the realm that contains the repo.
+ */
+func checkRepoStoredBytesQuota(dbClient DBClient, repo Repo, path string) apitypes.RespIntfTp {
+	
+	var realm Realm
+	var err error
+	realm, err = repo.getRealm(dbClient)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	return checkStoredBytesQuota(dbClient, realm, path)
+}
+
+/*******************************************************************************
+ * Check that another realm may be created without exceeding MaxRealms.
+ */
+func checkRealmCount(dbClient DBClient) apitypes.RespIntfTp {
+	
+	var maxRealms = dbClient.getServer().Config.MaxRealms
+	if maxRealms <= 0 { return nil }
+	var realmIds []string
+	var err error
+	realmIds, err = dbClient.dbGetAllRealmIds()
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	if len(realmIds) < maxRealms { return nil }
+	return apitypes.NewFailureDesc(http.StatusForbidden, fmt.Sprintf(
+		"Quota exceeded: at most %d realms may be created", maxRealms))
+}
+
+func newQuotaFailure(realm Realm, what string, limit int) apitypes.RespIntfTp {
+	return apitypes.NewFailureDesc(http.StatusForbidden, fmt.Sprintf(
+		"Quota exceeded: realm %s may have at most %d %s", realm.getName(), limit, what))
+}
+
+/*******************************************************************************
+ * Reserve, against the quotas of the repo's realm, what building the Dockerfile
+ * with the ImageName given by the values will create: a new version of the
+ * image, and the image if it does not exist.
+ */
+func reserveBuildQuota(dbClient DBClient, repo Repo, values url.Values) apitypes.RespIntfTp {
+	
+	var realm Realm
+	var err error
+	realm, err = repo.getRealm(dbClient)
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var imageName string
+	imageName, err = apitypes.GetHTTPParameterValue(true, values, "ImageName")
+	if err != nil { return apitypes.NewFailureDescFromError(err) }
+	var newImages = 1
+	if imageName != "" {
+		var image DockerImage
+		image, err = repo.getDockerImageByName(dbClient, imageName)
+		if err != nil { return apitypes.NewFailureDescFromError(err) }
+		if image != nil { newImages = 0 }
+	}
+	return reserveRealmQuota(dbClient, realm, 0, newImages, 1)
+}
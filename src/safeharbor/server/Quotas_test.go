@@ -0,0 +1,188 @@
+package server
+
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_RealmQuotaEntriesOverrideTheDefault(testContext *testing.T) {
+	
+	var f = newTestDB(testContext)
+	f.server.Config.RealmQuotas = map[string]*RealmQuota{
+		DefaultRealmQuotaName: &RealmQuota{ MaxRepos: 5, MaxImages: 10, MaxImageVersions: UnsetQuota,
+			MaxStoredBytes: 1000, MaxScansPerDay: 20 },
+		"testrealm": &RealmQuota{ MaxRepos: UnsetQuota, MaxImages: 3, MaxImageVersions: 4,
+			MaxStoredBytes: 0, MaxScansPerDay: UnsetQuota },
+	}
+	var quota = getRealmQuota(f.server.Config, f.realm)
+	var expected = RealmQuota{ MaxRepos: 5, MaxImages: 3, MaxImageVersions: 4,
+		MaxStoredBytes: 0, MaxScansPerDay: 20 }
+	if *quota != expected { testContext.Errorf("Expected %+v, but got %+v", expected, *quota) }
+	
+	// Without a Default entry, an unset limit is no limit.
+	delete(f.server.Config.RealmQuotas, DefaultRealmQuotaName)
+	quota = getRealmQuota(f.server.Config, f.realm)
+	expected = RealmQuota{ MaxImages: 3, MaxImageVersions: 4 }
+	if *quota != expected { testContext.Errorf("Expected %+v, but got %+v", expected, *quota) }
+}
+
+func Test_RealmQuotasLimitReposImagesAndVersions(testContext *testing.T) {
+	
+	// The fixture's realm has two repos, one image, and one image version.
+	var newFixture = func() *testDB {
+		var f = newTestDB(testContext)
+		var image, err = f.client.dbCreateDockerImage(f.repo.getId(), "imagea", "")
+		if err != nil { testContext.Fatal(err) }
+		_, err = f.client.dbCreateDockerImageVersion("v1", image.getId(), time.Now(), "",
+			[]byte("digest-v1"), nil)
+		if err != nil { testContext.Fatal(err) }
+		return f
+	}
+	
+	for _, test := range []struct{
+		quota RealmQuota
+		newRepos, newImages, newImageVersions int
+		allowed bool
+	}{
+		{ RealmQuota{ MaxRepos: 2 }, 1, 0, 0, false },
+		{ RealmQuota{ MaxRepos: 3 }, 1, 0, 0, true },
+		{ RealmQuota{ MaxRepos: 2 }, 0, 1, 1, true },
+		{ RealmQuota{ MaxImages: 1 }, 0, 1, 0, false },
+		{ RealmQuota{ MaxImages: 2 }, 0, 1, 0, true },
+		{ RealmQuota{ MaxImageVersions: 1 }, 0, 0, 1, false },
+		{ RealmQuota{ MaxImageVersions: 2 }, 0, 0, 1, true },
+		{ RealmQuota{}, 100, 100, 100, true },  // zero is unlimited
+		{ RealmQuota{ MaxRepos: UnsetQuota, MaxImages: UnsetQuota,
+			MaxImageVersions: UnsetQuota }, 100, 100, 100, true },
+	} {
+		var f = newFixture()
+		var quota = test.quota
+		f.server.Config.RealmQuotas = map[string]*RealmQuota{ "testrealm": &quota }
+		var failMsg = reserveRealmQuota(f.client, f.realm, test.newRepos, test.newImages,
+			test.newImageVersions)
+		if (failMsg == nil) != test.allowed {
+			testContext.Errorf("With quota %+v, expected adding %d repos, %d images, and %d versions to be allowed: %v",
+				test.quota, test.newRepos, test.newImages, test.newImageVersions, test.allowed)
+		}
+		
+		// What is reserved is counted; what is refused is not.
+		var usage, err = computeRealmUsage(f.client, f.realm)
+		if err != nil { testContext.Fatal(err) }
+		var expected = RealmUsage{ Repos: 2, Images: 1, ImageVersions: 1 }
+		if test.allowed {
+			expected.Repos = expected.Repos + test.newRepos
+			expected.Images = expected.Images + test.newImages
+			expected.ImageVersions = expected.ImageVersions + test.newImageVersions
+		}
+		if (usage.Repos != expected.Repos) || (usage.Images != expected.Images) ||
+			(usage.ImageVersions != expected.ImageVersions) {
+			testContext.Errorf("With quota %+v, expected usage %+v, but got %+v", test.quota, expected, *usage)
+		}
+	}
+}
+
+func Test_ReposAreReservedAtomicallyAgainstTheQuota(testContext *testing.T) {
+	
+	var f = newTestDB(testContext)
+	f.server.Config.RealmQuotas = map[string]*RealmQuota{ "testrealm": &RealmQuota{ MaxRepos: 5 } }
+	var _, err = computeRealmUsage(f.client, f.realm)  // sets the realm's counts
+	if err != nil { testContext.Fatal(err) }
+	
+	// The realm has two repos: of ten concurrent reservations, only three succeed.
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var reserved = 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reserveRealmQuota(f.client, f.realm, 1, 0, 0) != nil { return }
+			lock.Lock()
+			reserved++
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+	var count int
+	count, err = f.server.persistence.getRealmCount(f.realm.getId(), RealmReposCount)
+	if err != nil { testContext.Fatal(err) }
+	if (reserved != 3) || (count != 5) {
+		testContext.Errorf("Expected 3 repos to be reserved, but %d were, and the count is %d", reserved, count)
+	}
+	
+	// Deleted repos are no longer counted.
+	err = f.server.persistence.queueSubtractFromRealmCount(f.client.getTransactionContext(),
+		f.realm.getId(), RealmReposCount, 1)
+	if err != nil { testContext.Fatal(err) }
+	if reserveRealmQuota(f.client, f.realm, 1, 0, 0) != nil { testContext.Error("Expected 5 repos to be allowed") }
+}
+
+func Test_StoredBytesQuotaRemovesTheFileThatExceedsIt(testContext *testing.T) {
+	
+	var f = newTestDB(testContext)
+	var dir = f.realm.getFileDirectory()
+	if dir == "" { testContext.Fatal("Expected the realm to have a file directory") }
+	var path = filepath.Join(dir, "upload")
+	var err = ioutil.WriteFile(path, make([]byte, 100), 0600)
+	if err != nil { testContext.Fatal(err) }
+	
+	f.server.Config.RealmQuotas = map[string]*RealmQuota{ "testrealm": &RealmQuota{ MaxStoredBytes: 100 } }
+	if failMsg := checkStoredBytesQuota(f.client, f.realm, path); failMsg != nil {
+		testContext.Fatalf("Expected 100 bytes to be allowed: %v", failMsg)
+	}
+	f.server.Config.RealmQuotas["testrealm"].MaxStoredBytes = 99
+	if failMsg := checkStoredBytesQuota(f.client, f.realm, path); failMsg == nil {
+		testContext.Error("Expected 100 bytes to exceed the quota")
+	}
+	if _, err = os.Stat(path); ! os.IsNotExist(err) {
+		testContext.Error("Expected the file that exceeded the quota to be removed")
+	}
+}
+
+func Test_ScansAreReservedAtomicallyAgainstTheDailyQuota(testContext *testing.T) {
+	
+	var f = newTestDB(testContext)
+	f.server.Config.RealmQuotas = map[string]*RealmQuota{ "testrealm": &RealmQuota{ MaxScansPerDay: 5 } }
+	var now = time.Date(2016, time.March, 6, 23, 59, 0, 0, time.UTC)
+	
+	// Of ten concurrent reservations, only five succeed.
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var reserved = 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reserveRealmScans(f.client, f.realm, 1, now) != nil { return }
+			lock.Lock()
+			reserved++
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+	var count, err = f.server.persistence.getScanCount(f.realm.getId(), now)
+	if err != nil { testContext.Fatal(err) }
+	if (reserved != 5) || (count != 5) {
+		testContext.Errorf("Expected 5 scans to be reserved, but %d were, and the count is %d", reserved, count)
+	}
+	
+	// Scans that are not performed are released; the next day has a count of its own.
+	releaseRealmScans(f.client, f.realm, 2, now)
+	if reserveRealmScans(f.client, f.realm, 3, now) == nil { testContext.Error("Expected 6 scans to exceed the quota") }
+	if reserveRealmScans(f.client, f.realm, 2, now) != nil { testContext.Error("Expected 5 scans to be allowed") }
+	if reserveRealmScans(f.client, f.realm, 5, now.Add(time.Minute)) != nil {
+		testContext.Error("Expected the quota to apply to each day separately")
+	}
+	
+	// An unset quota is unlimited, but scans are still counted.
+	f.server.Config.RealmQuotas["testrealm"].MaxScansPerDay = UnsetQuota
+	if reserveRealmScans(f.client, f.realm, 100, now) != nil { testContext.Error("Expected an unset quota to be unlimited") }
+	count, err = f.server.persistence.getScanCount(f.realm.getId(), now)
+	if err != nil { testContext.Fatal(err) }
+	if count != 105 { testContext.Errorf("Expected 105 scans to be counted, but the count is %d", count) }
+}
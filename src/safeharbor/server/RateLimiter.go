@@ -0,0 +1,345 @@
+/*******************************************************************************
+ * Rate limiting of requests, with token buckets shared through redis.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	
+	"goredis"
+	
+	"safeharbor/apitypes"
+)
+
+const RateLimitKeyPrefix = "SafeHarbor/RateLimit/"
+const RateLimitSweepInterval = time.Minute
+
+/*******************************************************************************
+ * The cost of each method for which the cost is not one token, so that methods
+ * that launch expensive external work - builds and scans - and methods that are
+ * targets for password guessing can be limited more strictly than the others.
+ * These may be overridden by the Costs entry of the RateLimits configuration.
+ */
+var DefaultRequestCosts = map[string]int{
+	"authenticate": 10,
+	"verifySecondFactor": 10,
+	"createRealmAnon": 20,
+	"createUser": 10,
+	"requestPasswordReset": 20,
+	"resetPassword": 10,
+	"execDockerfile": 30,
+	"addAndExecDockerfile": 30,
+	"scanImage": 30,
+	"downloadImage": 10,
+}
+
+/*******************************************************************************
+ * A bucket holds at most Burst tokens, and is refilled at Rate tokens per second.
+ */
+type TokenBucketLimit struct {
+	Rate float64  // tokens added per second
+	Burst float64  // capacity of the bucket
+}
+
+/*******************************************************************************
+ * The RateLimits configuration. A nil limit means that requests are not limited
+ * by the corresponding bucket.
+ */
+type RateLimitConfig struct {
+	User *TokenBucketLimit
+	Session *TokenBucketLimit
+	IP *TokenBucketLimit
+	TargetUser *TokenBucketLimit  // the user that a login or password reset names
+	Costs map[string]int  // keyed on method name; the default cost is one token
+	TrustForwardedFor bool  // if true, the client IP is taken from X-Forwarded-For
+	ProxyHops int  // the number of trusted proxies that append to X-Forwarded-For; default 1
+}
+
+/*******************************************************************************
+ * Each request draws tokens from up to four token buckets: one for the
+ * authenticated user, one for the session (API token) that the request presents,
+ * and one for the client IP address (see checkClient); and, for a method that
+ * logs in as or resets the password of a user, one for that user (see
+ * checkTargetUser), so that guessing a user's password from many addresses is
+ * limited as well. Every request is checked, including SCIM requests and the
+ * registry's notifications (see Server.dispatch).
+ */
+type RateLimiter struct {
+	config *RateLimitConfig
+	redisClient *goredis.Redis  // nil if the buckets are kept in this process
+	lock sync.Mutex
+	buckets map[string]*tokenBucket
+	lastSweep time.Time  // when refilled buckets were last evicted
+}
+
+type tokenBucket struct {
+	tokens float64
+	time time.Time  // when tokens was computed
+	refilled time.Time  // when the bucket will be full, after which it may be evicted
+}
+
+/*******************************************************************************
+ * For each bucket, identified by KEYS[i], ARGV[2i+1] is its rate and ARGV[2i+2]
+ * is its burst; ARGV[1] is the current time in milliseconds, and ARGV[2] is the
+ * cost of the request. If every bucket holds enough tokens, draw the cost from
+ * each and return 0; otherwise, return the number of milliseconds after which
+ * they all will.
+ */
+const takeTokensScript = `
+local now = tonumber(ARGV[1])
+local cost = tonumber(ARGV[2])
+local tokens = {}
+local wait = 0
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[2*i + 1])
+	local burst = tonumber(ARGV[2*i + 2])
+	local c = math.min(cost, burst)
+	local state = redis.call('HMGET', key, 'tokens', 'time')
+	local t = tonumber(state[1])
+	local last = tonumber(state[2])
+	if (t == nil) or (last == nil) then
+		t = burst
+		last = now
+	end
+	t = math.min(burst, t + math.max(0, now - last) * rate / 1000)
+	tokens[i] = t
+	if t < c then
+		wait = math.max(wait, math.ceil((c - t) * 1000 / rate))
+	end
+end
+if wait > 0 then return wait end
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[2*i + 1])
+	local burst = tonumber(ARGV[2*i + 2])
+	redis.call('HMSET', key, 'tokens', tostring(tokens[i] - math.min(cost, burst)),
+		'time', ARGV[1])
+	redis.call('PEXPIRE', key, math.ceil(burst * 1000 / rate) + 1000)
+end
+return 0
+`
+
+func NewRateLimiter(config *RateLimitConfig, redisClient *goredis.Redis) *RateLimiter {
+	return &RateLimiter{
+		config: config,
+		redisClient: redisClient,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+/*******************************************************************************
+ * Return the cost, in tokens, of a request for the specified method.
+ */
+func (limiter *RateLimiter) getCost(reqName string) int {
+	var cost, found = limiter.config.Costs[reqName]
+	if found { return cost }
+	cost, found = DefaultRequestCosts[reqName]
+	if found { return cost }
+	return 1
+}
+
+/*******************************************************************************
+ * Determine whether the client may make the request: that is, whether the
+ * buckets of the authenticated user, the session, and the client IP address
+ * hold enough tokens. If so, draw its cost from each of those buckets and return
+ * zero; otherwise, return how long the client should wait before retrying. The
+ * session is identified by the session token, if any, or else by the SessionId
+ * parameter (see authenticateSession). This is checked before the body of the
+ * request is read, so the values are only those of the query string.
+ */
+func (limiter *RateLimiter) checkClient(authService *AuthService, reqName string,
+	sessionToken *apitypes.SessionToken, values url.Values, clientIP string) time.Duration {
+	
+	if (sessionToken == nil) && (len(values["SessionId"]) > 0) && (values["SessionId"][0] != "") {
+		sessionToken = authService.identifySession(values["SessionId"][0])
+	}
+	
+	var keys = make([]string, 0)
+	var limits = make([]*TokenBucketLimit, 0)
+	if sessionToken != nil {
+		if limiter.config.User != nil {
+			keys = append(keys, RateLimitKeyPrefix + "User/" + sessionToken.AuthenticatedUserid)
+			limits = append(limits, limiter.config.User)
+		}
+		if limiter.config.Session != nil {
+			keys = append(keys, RateLimitKeyPrefix + "Session/" + sessionToken.UniqueSessionId)
+			limits = append(limits, limiter.config.Session)
+		}
+	}
+	if (limiter.config.IP != nil) && (clientIP != "") {
+		keys = append(keys, RateLimitKeyPrefix + "IP/" + clientIP)
+		limits = append(limits, limiter.config.IP)
+	}
+	return limiter.takeTokens(reqName, keys, limits)
+}
+
+/*******************************************************************************
+ * Determine whether the request may proceed, given the user that it logs in as
+ * or resets the password of, if any (see getTargetUserId); if so, draw its cost
+ * from that user's bucket and return zero. This is checked after the values of
+ * the request, which may be in its body, have been read.
+ */
+func (limiter *RateLimiter) checkTargetUser(authService *AuthService, reqName string,
+	values url.Values) time.Duration {
+	
+	if limiter.config.TargetUser == nil { return 0 }
+	var targetUserId = getTargetUserId(authService, reqName, values)
+	if targetUserId == "" { return 0 }
+	return limiter.takeTokens(reqName,
+		[]string{ RateLimitKeyPrefix + "TargetUser/" + targetUserId },
+		[]*TokenBucketLimit{ limiter.config.TargetUser })
+}
+
+/*******************************************************************************
+ * Draw the cost of the request from each of the specified buckets, if every one
+ * of them holds enough tokens, and return zero; otherwise, draw no tokens, and
+ * return how long the client should wait before retrying. If redis cannot be
+ * reached, the request is allowed: the rate limiter is not a reason to deny
+ * service.
+ */
+func (limiter *RateLimiter) takeTokens(reqName string, keys []string,
+	limits []*TokenBucketLimit) time.Duration {
+	
+	if len(keys) == 0 { return 0 }
+	var cost = limiter.getCost(reqName)
+	if cost <= 0 { return 0 }
+	var now = time.Now()
+	if limiter.redisClient == nil {
+		return limiter.takeTokensInProcess(keys, limits, cost, now)
+	}
+	var wait, err = limiter.takeTokensInRedis(keys, limits, cost, now)
+	if err != nil {
+		fmt.Println("Rate limiter could not reach redis; allowing request: " + err.Error())
+		return 0
+	}
+	return wait
+}
+
+/*******************************************************************************
+ * Return the user Id of the user that the request would log in as or reset the
+ * password of, or "" if the method is not one that does so. For
+ * verifySecondFactor, that is the user of the login challenge.
+ */
+func getTargetUserId(authService *AuthService, reqName string, values url.Values) string {
+	
+	switch reqName {
+		case "authenticate", "requestPasswordReset":
+			return values.Get("UserId")
+		case "verifySecondFactor":
+			var challengeId = values.Get("ChallengeId")
+			if (authService == nil) || (challengeId == "") { return "" }
+			var challenge = authService.getLoginChallenge(challengeId)
+			if challenge == nil { return "" }
+			return challenge.UserId
+	}
+	return ""
+}
+
+/*******************************************************************************
+ * Perform takeTokensScript. The buckets are stored in redis, so that SafeHarbor
+ * servers that share the database also share the buckets, and the script checks
+ * and draws from them atomically. A bucket expires once it has refilled.
+ */
+func (limiter *RateLimiter) takeTokensInRedis(keys []string, limits []*TokenBucketLimit,
+	cost int, now time.Time) (time.Duration, error) {
+	
+	var args = []string{
+		fmt.Sprintf("%d", now.UnixNano() / int64(time.Millisecond)),
+		fmt.Sprintf("%d", cost),
+	}
+	for _, limit := range limits {
+		args = append(args, fmt.Sprintf("%g", limit.Rate), fmt.Sprintf("%g", limit.Burst))
+	}
+	var reply *goredis.Reply
+	var err error
+	reply, err = limiter.redisClient.Eval(takeTokensScript, keys, args)
+	if err != nil { return 0, err }
+	var waitMs int64
+	waitMs, err = reply.IntegerValue()
+	if err != nil { return 0, err }
+	return time.Duration(waitMs) * time.Millisecond, nil
+}
+
+/*******************************************************************************
+ * The equivalent of takeTokensScript, for buckets that are kept in this process,
+ * when the server is running in-memory only. A bucket that has refilled is the
+ * same as one that does not exist, and so such buckets are evicted, every
+ * RateLimitSweepInterval.
+ */
+func (limiter *RateLimiter) takeTokensInProcess(keys []string, limits []*TokenBucketLimit,
+	cost int, now time.Time) time.Duration {
+	
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	
+	if now.Sub(limiter.lastSweep) >= RateLimitSweepInterval {
+		for key, bucket := range limiter.buckets {
+			if ! now.Before(bucket.refilled) { delete(limiter.buckets, key) }
+		}
+		limiter.lastSweep = now
+	}
+	
+	var wait time.Duration = 0
+	var tokens = make([]float64, len(keys))
+	for i, key := range keys {
+		var limit = limits[i]
+		var c = math.Min(float64(cost), limit.Burst)
+		var t = limit.Burst
+		var bucket = limiter.buckets[key]
+		if bucket != nil {
+			var elapsed = now.Sub(bucket.time).Seconds()
+			if elapsed < 0 { elapsed = 0 }
+			t = math.Min(limit.Burst, bucket.tokens + elapsed * limit.Rate)
+		}
+		tokens[i] = t
+		if t < c {
+			var w = time.Duration(math.Ceil((c - t) * 1000 / limit.Rate)) * time.Millisecond
+			if w > wait { wait = w }
+		}
+	}
+	if wait > 0 { return wait }
+	
+	for i, key := range keys {
+		var remaining = tokens[i] - math.Min(float64(cost), limits[i].Burst)
+		limiter.buckets[key] = &tokenBucket{
+			tokens: remaining,
+			time: now,
+			refilled: now.Add(time.Duration(math.Ceil((limits[i].Burst - remaining) * 1000 /
+				limits[i].Rate)) * time.Millisecond),
+		}
+	}
+	return 0
+}
+
+/*******************************************************************************
+ * Return the IP address of the client that made the request. If the server is
+ * behind ProxyHops proxies (TrustForwardedFor), each of which appends the
+ * address from which it received the request to the X-Forwarded-For header, that
+ * is the address appended by the outermost of them: the ProxyHops'th from the
+ * right. The addresses to the left of it are supplied by the client, and so are
+ * not trusted. Otherwise, it is the remote address of the connection.
+ */
+func (limiter *RateLimiter) getClientIP(httpReq *http.Request) string {
+	
+	if limiter.config.TrustForwardedFor {
+		var hops = limiter.config.ProxyHops
+		if hops < 1 { hops = 1 }
+		var addresses = strings.Split(strings.Join(httpReq.Header["X-Forwarded-For"], ","), ",")
+		if len(addresses) >= hops {
+			var address = strings.TrimSpace(addresses[len(addresses) - hops])
+			if address != "" { return address }
+		}
+	}
+	var host, _, err = net.SplitHostPort(httpReq.RemoteAddr)
+	if err != nil { return httpReq.RemoteAddr }
+	return host
+}
@@ -0,0 +1,177 @@
+package server
+
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+	
+	"goredis"
+	
+	"safeharbor/apitypes"
+)
+
+func Test_RateLimiterBucketsRefillUpToTheBurst(testContext *testing.T) {
+	
+	var limit = &TokenBucketLimit{ Rate: 2, Burst: 4 }
+	var limiter = NewRateLimiter(&RateLimitConfig{ IP: limit }, nil)
+	var keys = []string{ RateLimitKeyPrefix + "IP/10.0.0.1" }
+	var limits = []*TokenBucketLimit{ limit }
+	var now = time.Date(2016, time.March, 6, 12, 0, 0, 0, time.UTC)
+	
+	for i := 0; i < 4; i++ {
+		if wait := limiter.takeTokensInProcess(keys, limits, 1, now); wait != 0 {
+			testContext.Fatalf("Expected request %d of the burst to be allowed, but the wait is %s", i + 1, wait)
+		}
+	}
+	if wait := limiter.takeTokensInProcess(keys, limits, 1, now); wait != 500 * time.Millisecond {
+		testContext.Errorf("Expected a wait of one token, at two per second, but the wait is %s", wait)
+	}
+	if wait := limiter.takeTokensInProcess(keys, limits, 1, now.Add(500 * time.Millisecond)); wait != 0 {
+		testContext.Errorf("Expected a token to have been added, but the wait is %s", wait)
+	}
+	
+	// After a long wait, the bucket holds no more than the burst.
+	now = now.Add(time.Hour)
+	if wait := limiter.takeTokensInProcess(keys, limits, 3, now); wait != 0 {
+		testContext.Errorf("Expected the bucket to have refilled, but the wait is %s", wait)
+	}
+	if wait := limiter.takeTokensInProcess(keys, limits, 2, now); wait != 500 * time.Millisecond {
+		testContext.Errorf("Expected the bucket to hold one token, but the wait is %s", wait)
+	}
+	
+	// A request whose cost exceeds the burst draws the whole bucket.
+	if wait := limiter.takeTokensInProcess(keys, limits, 10, now.Add(time.Hour)); wait != 0 {
+		testContext.Errorf("Expected a costly request to be allowed when the bucket is full, but the wait is %s", wait)
+	}
+}
+
+func Test_RateLimiterRejectsUnlessEveryBucketHasTokens(testContext *testing.T) {
+	
+	var config = &RateLimitConfig{
+		User: &TokenBucketLimit{ Rate: 1, Burst: 100 },
+		IP: &TokenBucketLimit{ Rate: 1, Burst: 20 },
+		Costs: map[string]int{ "scanImage": 15, "getRealmDesc": 0 },
+	}
+	var limiter = NewRateLimiter(config, nil)
+	var sessionToken = apitypes.NewSessionToken("session1", "jdoe")
+	var values = url.Values{}
+	if limiter.checkClient(nil, "scanImage", sessionToken, values, "10.0.0.1") != 0 {
+		testContext.Fatal("Expected the first scan to be allowed")
+	}
+	if limiter.checkClient(nil, "scanImage", sessionToken, values, "10.0.0.1") == 0 {
+		testContext.Error("Expected the IP bucket to reject a second scan")
+	}
+	if limiter.checkClient(nil, "scanImage", sessionToken, values, "10.0.0.2") != 0 {
+		testContext.Error("Expected a scan from another address to be allowed")
+	}
+	if limiter.checkClient(nil, "getRealmDesc", sessionToken, values, "10.0.0.1") != 0 {
+		testContext.Error("Expected a request that costs nothing to be allowed")
+	}
+	if limiter.getCost("authenticate") != DefaultRequestCosts["authenticate"] {
+		testContext.Error("Expected the default cost of a method that is not configured")
+	}
+}
+
+func Test_RateLimiterEvictsRefilledBuckets(testContext *testing.T) {
+	
+	var limit = &TokenBucketLimit{ Rate: 1, Burst: 10 }
+	var limiter = NewRateLimiter(&RateLimitConfig{ IP: limit }, nil)
+	var now = time.Date(2016, time.March, 6, 12, 0, 0, 0, time.UTC)
+	limiter.takeTokensInProcess([]string{ "a" }, []*TokenBucketLimit{ limit }, 1, now)
+	limiter.takeTokensInProcess([]string{ "b" }, []*TokenBucketLimit{ limit }, 10, now.Add(55 * time.Second))
+	
+	// At the next sweep, a has refilled, but b has not.
+	limiter.takeTokensInProcess([]string{ "c" }, []*TokenBucketLimit{ limit }, 1,
+		now.Add(RateLimitSweepInterval + time.Second))
+	if (limiter.buckets["a"] != nil) || (limiter.buckets["b"] == nil) || (len(limiter.buckets) != 2) {
+		testContext.Errorf("Expected only the refilled bucket to be evicted, but %d remain", len(limiter.buckets))
+	}
+}
+
+func Test_RateLimiterAllowsRequestsWhenRedisFails(testContext *testing.T) {
+	
+	// A stand-in for redis that fails every command.
+	var listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { testContext.Fatal(err) }
+	defer listener.Close()
+	go func() {
+		for {
+			var conn, err = listener.Accept()
+			if err != nil { return }
+			go func() {
+				defer conn.Close()
+				var reader = bufio.NewReader(conn)
+				for {
+					var line, err = reader.ReadString('\n')
+					if err != nil { return }
+					if line[0] == '*' { conn.Write([]byte("-ERR unavailable\r\n")) }
+				}
+			}()
+		}
+	}()
+	var redisClient *goredis.Redis
+	redisClient, err = goredis.Dial(&goredis.DialConfig{ Network: "tcp", Address: listener.Addr().String() })
+	if err != nil { testContext.Fatal(err) }
+	
+	var limiter = NewRateLimiter(&RateLimitConfig{ IP: &TokenBucketLimit{ Rate: 0.001, Burst: 1 } }, redisClient)
+	for i := 0; i < 3; i++ {
+		if wait := limiter.checkClient(nil, "authenticate", nil, url.Values{}, "10.0.0.1"); wait != 0 {
+			testContext.Fatalf("Expected the request to be allowed, but the wait is %s", wait)
+		}
+	}
+}
+
+func Test_RateLimiterTakesTheClientIPFromTheTrustedProxies(testContext *testing.T) {
+	
+	var httpReq, _ = http.NewRequest("GET", "/getRealmDesc", nil)
+	httpReq.RemoteAddr = "10.0.0.9:4321"
+	httpReq.Header.Add("X-Forwarded-For", "6.6.6.6, 1.2.3.4")
+	httpReq.Header.Add("X-Forwarded-For", "10.0.0.8")
+	
+	var limiter = NewRateLimiter(&RateLimitConfig{}, nil)
+	if ip := limiter.getClientIP(httpReq); ip != "10.0.0.9" {
+		testContext.Errorf("Expected the remote address, unless X-Forwarded-For is trusted, but got %s", ip)
+	}
+	limiter = NewRateLimiter(&RateLimitConfig{ TrustForwardedFor: true }, nil)
+	if ip := limiter.getClientIP(httpReq); ip != "10.0.0.8" {
+		testContext.Errorf("Expected the address appended by the proxy, but got %s", ip)
+	}
+	limiter = NewRateLimiter(&RateLimitConfig{ TrustForwardedFor: true, ProxyHops: 2 }, nil)
+	if ip := limiter.getClientIP(httpReq); ip != "1.2.3.4" {
+		testContext.Errorf("Expected the address appended by the outer proxy, but got %s", ip)
+	}
+	limiter = NewRateLimiter(&RateLimitConfig{ TrustForwardedFor: true, ProxyHops: 4 }, nil)
+	if ip := limiter.getClientIP(httpReq); ip != "10.0.0.9" {
+		testContext.Errorf("Expected the remote address when there are fewer addresses than hops, but got %s", ip)
+	}
+}
+
+func Test_RateLimiterLimitsLoginsAsAUserFromAnyAddress(testContext *testing.T) {
+	
+	var authService = NewAuthService("SafeHarbor", "", 0, nil, "test salt")
+	var config = &RateLimitConfig{
+		IP: &TokenBucketLimit{ Rate: 1, Burst: 100 },
+		TargetUser: &TokenBucketLimit{ Rate: 0.001, Burst: 10 },
+	}
+	var limiter = NewRateLimiter(config, nil)
+	var values = url.Values{ "UserId": []string{ "jdoe" } }
+	if limiter.checkTargetUser(authService, "authenticate", values) != 0 {
+		testContext.Fatal("Expected the first login to be allowed")
+	}
+	if limiter.checkTargetUser(authService, "requestPasswordReset", values) == 0 {
+		testContext.Error("Expected a password reset for the same user, from another address, to be rejected")
+	}
+	var challengeId = authService.createLoginChallenge("jdoe", false)
+	values = url.Values{ "ChallengeId": []string{ challengeId } }
+	if limiter.checkTargetUser(authService, "verifySecondFactor", values) == 0 {
+		testContext.Error("Expected a second factor for the same user, from another address, to be rejected")
+	}
+	values = url.Values{ "UserId": []string{ "other" } }
+	if limiter.checkTargetUser(authService, "authenticate", values) != 0 {
+		testContext.Error("Expected a login as another user to be allowed")
+	}
+}
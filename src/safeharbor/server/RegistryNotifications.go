@@ -0,0 +1,405 @@
+/*******************************************************************************
+ * Registration and scanning of images that are pushed directly to the registry.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+	
+	"scanners"
+	"utilities"
+	
+	"safeharbor/apitypes"
+)
+
+const (
+	RegistryNotificationPath = "registry/notifications"
+	RegistryNotificationMaxRequestSize = 1024 * 1024  // bytes
+	PushedImageScanWorkers = 2
+	PushedImageScanQueueSize = 1000
+)
+
+/*******************************************************************************
+ * An envelope of events, as the registry posts it. Only the fields that are used
+ * are declared.
+ */
+type RegistryEventEnvelope struct {
+	Events []*RegistryEvent `json:"events"`
+}
+
+type RegistryEvent struct {
+	Id string `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Action string `json:"action"`  // "push", "pull", or "delete"
+	Target struct {
+		MediaType string `json:"mediaType"`
+		Digest string `json:"digest"`
+		Repository string `json:"repository"`
+		Tag string `json:"tag"`  // "" unless a manifest was pushed by tag
+	} `json:"target"`
+	Actor struct {
+		Name string `json:"name"`  // "" if the push was anonymous
+	} `json:"actor"`
+}
+
+/*******************************************************************************
+ * A scan of a pushed image version, or a scheduled scan, waiting to be performed.
+ */
+type pushedImageScan struct {
+	imageVersionId string
+	scanConfigId string
+	userObjId string
+	imageName string  // <repository>:<tag>, for messages
+}
+
+/*******************************************************************************
+ * Return true if the event is the push of a tagged manifest - as opposed to, for
+ * example, the push of one of the image's layers.
+ */
+func (event *RegistryEvent) isPushOfTaggedManifest() bool {
+	return (event.Action == "push") && (event.Target.Tag != "") &&
+		strings.Contains(event.Target.MediaType, "manifest")
+}
+
+/*******************************************************************************
+ * Split the name of a registry repository into the names of the SafeHarbor
+ * realm, repo, and image. This is the inverse of docker.ConstructDockerImageName.
+ */
+func parseDockerImageName(repository string) (realmName, repoName, imageName string, err error) {
+	
+	var parts = strings.Split(repository, "/")
+	if len(parts) != 3 {
+		return "", "", "", utilities.ConstructUserError("Repository " + repository +
+			" is not of the form <realm>/<repo>/<image>")
+	}
+	for _, part := range parts {
+		if part == "" { return "", "", "", utilities.ConstructUserError(
+			"Repository " + repository + " is not of the form <realm>/<repo>/<image>") }
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+/*******************************************************************************
+ * Entry point for the registry's notifications. Images that are pushed directly
+ * to the registry, rather than built by SafeHarbor, are registered when the
+ * registry notifies SafeHarbor of the push, and are then scanned automatically.
+ *
+ * The registry is configured (see https://docs.docker.com/registry/notifications/)
+ * with an endpoint whose URL is <SafeHarbor base URL>/registry/notifications, and
+ * whose headers include "Authorization: Bearer <token>", where the token is the
+ * REGISTRY_NOTIFICATION_TOKEN of the SafeHarbor configuration; if that is not
+ * set, notifications are not accepted. The registry posts envelopes of events
+ * (media type application/vnd.docker.distribution.events.v1+json), and retries
+ * an envelope until it is accepted, so that an event may be received more than
+ * once.
+ */
+func (server *Server) dispatchRegistryNotification(writer http.ResponseWriter, httpReq *http.Request) {
+	
+	var token = server.Config.RegistryNotificationToken
+	if token == "" {
+		http.Error(writer, "Registry notifications are not enabled", http.StatusNotFound)
+		return
+	}
+	if strings.ToUpper(httpReq.Method) != "POST" {
+		http.Error(writer, "Registry notifications must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+	var authorization = httpReq.Header.Get("Authorization")
+	var presented = ""
+	if strings.HasPrefix(strings.ToLower(authorization), "bearer ") {
+		presented = strings.TrimSpace(authorization[len("bearer "):])
+	}
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+		http.Error(writer, "Missing or invalid bearer token", http.StatusUnauthorized)
+		return
+	}
+	
+	var body, err = ioutil.ReadAll(io.LimitReader(httpReq.Body, RegistryNotificationMaxRequestSize + 1))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > RegistryNotificationMaxRequestSize {
+		http.Error(writer, "Request body is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var envelope RegistryEventEnvelope
+	err = json.Unmarshal(body, &envelope)
+	if err != nil {
+		http.Error(writer, "Request body is not an envelope of registry events", http.StatusBadRequest)
+		return
+	}
+	
+	for _, event := range envelope.Events {
+		if (event == nil) || (! event.isPushOfTaggedManifest()) { continue }
+		err = server.registerPushedImage(event)
+		if err == nil { continue }
+		if utilities.IsUserErr(err) {
+			// The registry would retry the envelope to no avail.
+			fmt.Println("Ignoring push of " + event.Target.Repository + ":" + event.Target.Tag +
+				": " + err.Error())
+			continue
+		}
+		// Let the registry retry the envelope. Events that have been registered
+		// are recognized as such when they are received again.
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+/*******************************************************************************
+ * In a transaction of its own, register the image version that the event
+ * reports, and then queue its scans.
+ */
+func (server *Server) registerPushedImage(event *RegistryEvent) error {
+	
+	var imageVersion DockerImageVersion
+	var user User
+	var scanConfigIds []string
+	var err = server.performInTransaction("registry push", func(dbClient *InMemClient) (bool, error) {
+		var err error
+		imageVersion, user, scanConfigIds, err = registerPushedImageVersion(dbClient, event)
+		return imageVersion != nil, err  // nil if already registered, or over quota
+	})
+	if (err != nil) || (imageVersion == nil) { return err }
+	
+	fmt.Println("Registered " + event.Target.Repository + ":" + event.Target.Tag +
+		", pushed to the registry")
+	for _, scanConfigId := range scanConfigIds {
+		server.queueScan(&pushedImageScan{
+			imageVersionId: imageVersion.getId(),
+			scanConfigId: scanConfigId,
+			userObjId: user.getId(),
+			imageName: event.Target.Repository + ":" + event.Target.Tag,
+		})
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Queue the scan, to be performed by one of the PushedImageScanWorkers scan
+ * workers (see scanPushedImages). Return false if it is not queued because
+ * PushedImageScanQueueSize scans are already waiting.
+ */
+func (server *Server) queueScan(scan *pushedImageScan) bool {
+	select {
+		case server.pushedImageScans <- scan:
+			return true
+		default:  // the queue is full
+			fmt.Println("Not scanning " + scan.imageName + " with scan config " + scan.scanConfigId +
+				": too many scans are waiting")
+			return false
+	}
+}
+
+/*******************************************************************************
+ * Perform queued scans - of pushed images, and scheduled scans - until the
+ * process exits.
+ */
+func (server *Server) scanPushedImages() {
+	
+	for scan := range server.pushedImageScans {
+		var err = server.scanImageVersionSeparately(scan.imageVersionId, scan.scanConfigId,
+			scan.userObjId)
+		if err != nil { fmt.Println("While scanning " + scan.imageName + ": " + err.Error()) }
+	}
+}
+
+/*******************************************************************************
+ * Create the image version that the event reports, with its ImageUploadEvent,
+ * and return it, the user to whom the event belongs, and the scan configs with
+ * which it should be scanned (see DockerImage.getScanConfigsToUse). If the
+ * version has already been registered, or if registering it would exceed the
+ * realm's quota of images or image versions, return a nil version. (The image
+ * remains in the registry, but SafeHarbor does not know of it.)
+ *
+ * The repository must be named as SafeHarbor names the images that it builds -
+ * <realm>/<repo>/<image> (see docker.ConstructDockerImageName); a push to one
+ * that does not name an existing realm and repo is ignored. The image is created
+ * if the repo does not yet have it, and the version is the pushed tag. The event
+ * belongs to the user who pushed the image, or, if that is not a user of the
+ * realm, to the realm's administrator. The pusher is identified by the name that
+ * the registry reports, which is taken to be a SafeHarbor user Id: the registry
+ * must therefore authenticate its users against SafeHarbor (its token auth
+ * service), so that the names it reports are those of SafeHarbor users;
+ * otherwise a registry user whose name happens to equal a SafeHarbor user Id
+ * would be credited with that user's pushes.
+ */
+func registerPushedImageVersion(dbClient DBClient, event *RegistryEvent) (
+	DockerImageVersion, User, []string, error) {
+	
+	var realmName, repoName, imageName string
+	var err error
+	realmName, repoName, imageName, err = parseDockerImageName(event.Target.Repository)
+	if err != nil { return nil, nil, nil, err }
+	err = nameConformsToSafeHarborImageNameRules(imageName)
+	if err != nil { return nil, nil, nil, err }
+	
+	var realmId string
+	realmId, err = dbClient.getPersistence().GetRealmObjIdByRealmName(realmName)
+	if err != nil { return nil, nil, nil, err }
+	if realmId == "" { return nil, nil, nil, utilities.ConstructUserError(
+		"There is no realm named " + realmName) }
+	var realm Realm
+	realm, err = dbClient.getRealm(realmId)
+	if err != nil { return nil, nil, nil, err }
+	var repo Repo
+	repo, err = realm.getRepoByName(dbClient, repoName)
+	if err != nil { return nil, nil, nil, err }
+	if repo == nil { return nil, nil, nil, utilities.ConstructUserError(
+		"Realm " + realmName + " has no repo named " + repoName) }
+	
+	// Attribute the push to the user who made it, if that is a user of the realm.
+	// The registry's user names are SafeHarbor user Ids (see the top of this file).
+	var user User
+	if event.Actor.Name != "" {
+		user, err = realm.getUserByUserId(dbClient, event.Actor.Name)
+		if err != nil { return nil, nil, nil, err }
+	}
+	if user == nil {
+		// The realm's AdminUserId is a user Id or, for some realms, a user object Id.
+		user, err = realm.getUserByUserId(dbClient, realm.getAdminUserId())
+		if err != nil { return nil, nil, nil, err }
+		if (user == nil) && (realm.getAdminUserId() != "") {
+			var obj PersistObj
+			obj, err = dbClient.getPersistentObject(realm.getAdminUserId())
+			if err != nil { return nil, nil, nil, err }
+			user, _ = obj.(User)
+		}
+	}
+	if user == nil { return nil, nil, nil, utilities.ConstructUserError(
+		"There is no user of realm " + realmName + " to whom to attribute the push") }
+	
+	var dockerImage DockerImage
+	dockerImage, err = repo.getDockerImageByName(dbClient, imageName)
+	if err != nil { return nil, nil, nil, err }
+	var newImages = 1
+	if dockerImage != nil {
+		newImages = 0
+		for _, versionId := range dockerImage.getImageVersionIds() {
+			var version DockerImageVersion
+			version, err = dbClient.getDockerImageVersion(versionId)
+			if err != nil { return nil, nil, nil, err }
+			if (version.getVersion() == event.Target.Tag) &&
+				(string(version.getDigest()) == event.Target.Digest) {
+				return nil, nil, nil, nil
+			}
+		}
+	}
+	
+	var failMsg = reserveRealmQuota(dbClient, realm, 0, newImages, 1)
+	if failMsg != nil {
+		var reason = "the realm's quota would be exceeded"
+		var failureDesc, isType = failMsg.(*apitypes.FailureDesc)
+		if isType { reason = failureDesc.HTTPReasonPhrase }
+		fmt.Println("Not registering " + event.Target.Repository + ":" + event.Target.Tag +
+			", pushed to the registry: " + reason)
+		return nil, nil, nil, nil
+	}
+	if dockerImage == nil {
+		dockerImage, err = dbClient.dbCreateDockerImage(repo.getId(), imageName,
+			"Pushed to the registry")
+		if err != nil { return nil, nil, nil, err }
+	}
+	
+	var creationTime = event.Timestamp
+	if creationTime.IsZero() { creationTime = time.Now() }
+	var imageVersion DockerImageVersion
+	imageVersion, err = dbClient.dbCreateDockerImageVersion(event.Target.Tag, dockerImage.getId(),
+		creationTime, "", []byte(event.Target.Digest), nil)
+	if err != nil { return nil, nil, nil, err }
+	_, err = dbClient.dbCreateImageUploadEvent(imageVersion.getId(), user.getId(),
+		event.Target.Repository, event.Target.Tag, event.Target.Digest, event.Id)
+	if err != nil { return nil, nil, nil, err }
+	return imageVersion, user, dockerImage.getScanConfigsToUse(), nil
+}
+
+/*******************************************************************************
+ * The objects involved in a scan of an image version.
+ */
+type imageVersionScan struct {
+	realm Realm
+	dockerImage DockerImage
+	imageVersion DockerImageVersion
+	imageName string
+	scanConfig ScanConfig
+	params map[string]string
+	user User
+}
+
+/*******************************************************************************
+ * Scan the image version with the scan config, on behalf of the user, provided
+ * that the scan is within the quota of the image's realm. The scanner is run
+ * outside of any transaction, since a scan takes long enough that objects that
+ * the transaction read are likely to be written by another request in the
+ * meantime. The result is then recorded in a short transaction of its own, which
+ * is retried if it conflicts, so that the scan is not lost.
+ */
+func (server *Server) scanImageVersionSeparately(imageVersionId, scanConfigId,
+	userObjId string) error {
+	
+	var dbClient *InMemClient
+	var err error
+	dbClient, err = NewInMemClient(server)
+	if err != nil { return err }
+	var scan *imageVersionScan
+	scan, err = getImageVersionScan(dbClient, imageVersionId, scanConfigId, userObjId)
+	var now = time.Now()
+	if (err == nil) && (reserveRealmScans(dbClient, scan.realm, 1, now) != nil) {
+		err = utilities.ConstructUserError("The scan would exceed the quota of realm " +
+			scan.realm.getName())
+	}
+	dbClient.abort()
+	if err != nil { return err }
+	var params = scan.params
+	var result *scanners.ScanResult
+	result, err = runScanner(server, scan.dockerImage, scan.imageName, scan.scanConfig, params)
+	if err != nil {
+		releaseRealmScans(dbClient, scan.realm, 1, now)
+		return err
+	}
+	
+	return server.performInTransaction("scan result", func(dbClient *InMemClient) (bool, error) {
+		var scan, err = getImageVersionScan(dbClient, imageVersionId, scanConfigId, userObjId)
+		if err != nil { return false, err }
+		_, err = recordScanResult(dbClient, scan.dockerImage, scan.imageVersion,
+			scan.imageName, scan.scanConfig, params, scan.user, result)
+		return true, err
+	})
+}
+
+func getImageVersionScan(dbClient DBClient, imageVersionId, scanConfigId, userObjId string) (
+	*imageVersionScan, error) {
+	
+	var scan = &imageVersionScan{}
+	var err error
+	scan.imageVersion, err = dbClient.getDockerImageVersion(imageVersionId)
+	if err != nil { return nil, err }
+	scan.dockerImage, err = dbClient.getDockerImage(scan.imageVersion.getImageObjId())
+	if err != nil { return nil, err }
+	var repo Repo
+	repo, err = scan.dockerImage.getRepo(dbClient)
+	if err != nil { return nil, err }
+	scan.realm, err = repo.getRealm(dbClient)
+	if err != nil { return nil, err }
+	scan.scanConfig, err = dbClient.getScanConfig(scanConfigId)
+	if err != nil { return nil, err }
+	scan.user, err = dbClient.getUser(userObjId)
+	if err != nil { return nil, err }
+	scan.imageName, err = scan.imageVersion.getFullName(dbClient)
+	if err != nil { return nil, err }
+	scan.params, err = getScanParameters(dbClient, scan.scanConfig)
+	if err != nil { return nil, err }
+	return scan, nil
+}
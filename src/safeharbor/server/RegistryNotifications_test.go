@@ -0,0 +1,159 @@
+package server
+
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testRegistryEnvelope = `{"events": [
+	{"id": "event-1", "timestamp": "2016-03-01T10:00:00Z", "action": "push",
+		"target": {"mediaType": "application/octet-stream", "digest": "sha256:layer",
+			"repository": "testrealm/repoa/pushed"}},
+	{"id": "event-2", "timestamp": "2016-03-01T10:00:01Z", "action": "push",
+		"target": {"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+			"digest": "sha256:manifest", "repository": "testrealm/repoa/pushed", "tag": "v1"},
+		"actor": {"name": "jdoe"}},
+	{"id": "event-3", "timestamp": "2016-03-01T10:00:02Z", "action": "push",
+		"target": {"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+			"digest": "sha256:other", "repository": "norealm/repoa/pushed", "tag": "v1"}}
+]}`
+
+func postRegistryNotification(server *Server, token, body string) int {
+	var request = httptest.NewRequest("POST", "/" + RegistryNotificationPath, strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer " + token)
+	var recorder = httptest.NewRecorder()
+	server.dispatchRegistryNotification(recorder, request)
+	return recorder.Code
+}
+
+func Test_RegistryPushRegistersImageVersion(testContext *testing.T) {
+	
+	var f = newTestDB(testContext)
+	f.server.Config.RegistryNotificationToken = "registry-token"
+	if status := postRegistryNotification(f.server, "wrong", testRegistryEnvelope); status != http.StatusUnauthorized {
+		testContext.Errorf("Expected an invalid token to be rejected, but the status is %d", status)
+	}
+	
+	// Post the envelope twice, as the registry may.
+	for i := 0; i < 2; i++ {
+		var status = postRegistryNotification(f.server, "registry-token", testRegistryEnvelope)
+		if status != http.StatusOK { testContext.Fatalf("Expected the envelope to be accepted, but the status is %d", status) }
+	}
+	var image, err = f.repo.getDockerImageByName(f.client, "pushed")
+	if err != nil { testContext.Fatal(err) }
+	if image == nil { testContext.Fatal("Expected the pushed image to be registered") }
+	if len(image.getImageVersionIds()) != 1 {
+		testContext.Fatalf("Expected one version, but found %d", len(image.getImageVersionIds()))
+	}
+	var version DockerImageVersion
+	version, err = f.client.getDockerImageVersion(image.getImageVersionIds()[0])
+	if err != nil { testContext.Fatal(err) }
+	if (version.getVersion() != "v1") || (string(version.getDigest()) != "sha256:manifest") {
+		testContext.Errorf("Unexpected version %s with digest %s", version.getVersion(), string(version.getDigest()))
+	}
+	var event Event
+	event, err = f.client.getEvent(version.getImageCreationEventId())
+	if err != nil { testContext.Fatal(err) }
+	var uploadEvent, isType = event.(ImageUploadEvent)
+	if (! isType) || (uploadEvent.getUserObjId() != f.user.getId()) ||
+		(uploadEvent.getRegistryEventId() != "event-2") {
+		testContext.Error("Expected an ImageUploadEvent of the user who pushed the image")
+	}
+	
+	// A new push of the tag is a new version.
+	var envelope = strings.Replace(testRegistryEnvelope, "sha256:manifest", "sha256:manifest2", 1)
+	if status := postRegistryNotification(f.server, "registry-token", envelope); status != http.StatusOK {
+		testContext.Fatalf("Expected the envelope to be accepted, but the status is %d", status)
+	}
+	if len(image.getImageVersionIds()) != 2 {
+		testContext.Errorf("Expected two versions, but found %d", len(image.getImageVersionIds()))
+	}
+}
+
+func Test_ParseDockerImageName(testContext *testing.T) {
+	
+	var realmName, repoName, imageName, err = parseDockerImageName("realma/repoa/imagea")
+	if (err != nil) || (realmName != "realma") || (repoName != "repoa") || (imageName != "imagea") {
+		testContext.Errorf("Unexpected parse: %s, %s, %s, %v", realmName, repoName, imageName, err)
+	}
+	for _, name := range []string{ "imagea", "repoa/imagea", "a/b/c/d", "realma//imagea" } {
+		_, _, _, err = parseDockerImageName(name)
+		if err == nil { testContext.Errorf("Expected %s to be rejected", name) }
+	}
+}
+
+func Test_PushedImageScansAreQueuedUpToTheLimit(testContext *testing.T) {
+	
+	var f = newTestDB(testContext)
+	f.server.Config.RegistryNotificationToken = "registry-token"
+	f.server.pushedImageScans = make(chan *pushedImageScan, 1)
+	var image, err = f.client.dbCreateDockerImage(f.repo.getId(), "pushed", "")
+	if err != nil { testContext.Fatal(err) }
+	var scanConfig ScanConfig
+	scanConfig, err = f.client.dbCreateScanConfig("configa", "", f.repo.getId(), "clair", nil, "", "")
+	if err != nil { testContext.Fatal(err) }
+	image.addScanConfigIdToList(scanConfig.getId())
+	err = image.writeBack(f.client)
+	if err != nil { testContext.Fatal(err) }
+	
+	// The second push finds the queue full, but is registered nonetheless.
+	for _, digest := range []string{ "sha256:manifest", "sha256:manifest2" } {
+		var envelope = strings.Replace(testRegistryEnvelope, "sha256:manifest", digest, 1)
+		if status := postRegistryNotification(f.server, "registry-token", envelope); status != http.StatusOK {
+			testContext.Fatalf("Expected the envelope to be accepted, but the status is %d", status)
+		}
+	}
+	if len(image.getImageVersionIds()) != 2 {
+		testContext.Fatalf("Expected two versions, but found %d", len(image.getImageVersionIds()))
+	}
+	if len(f.server.pushedImageScans) != 1 { testContext.Fatalf(
+		"Expected one queued scan, but found %d", len(f.server.pushedImageScans)) }
+	var scan = <-f.server.pushedImageScans
+	if (scan.imageVersionId != image.getImageVersionIds()[0]) ||
+		(scan.scanConfigId != scanConfig.getId()) || (scan.userObjId != f.user.getId()) {
+		testContext.Errorf("Unexpected queued scan %+v", *scan)
+	}
+}
+
+func Test_RegistryPushesBeyondTheRealmQuotaAreNotRegistered(testContext *testing.T) {
+	
+	var f = newTestDB(testContext)
+	f.server.Config.RegistryNotificationToken = "registry-token"
+	
+	// The fixture's realm has no image versions, and so may add one.
+	var quota = &RealmQuota{ MaxImageVersions: 1 }
+	f.server.Config.RealmQuotas = map[string]*RealmQuota{ "testrealm": quota }
+	if status := postRegistryNotification(f.server, "registry-token", testRegistryEnvelope); status != http.StatusOK {
+		testContext.Fatalf("Expected the envelope to be accepted, but the status is %d", status)
+	}
+	var image, err = f.repo.getDockerImageByName(f.client, "pushed")
+	if err != nil { testContext.Fatal(err) }
+	if (image == nil) || (len(image.getImageVersionIds()) != 1) {
+		testContext.Fatal("Expected the first push to be registered")
+	}
+	
+	// A second version would exceed MaxImageVersions: the push is accepted, but
+	// not registered.
+	var envelope = strings.Replace(testRegistryEnvelope, "sha256:manifest", "sha256:manifest2", 1)
+	if status := postRegistryNotification(f.server, "registry-token", envelope); status != http.StatusOK {
+		testContext.Fatalf("Expected the envelope to be accepted, but the status is %d", status)
+	}
+	if len(image.getImageVersionIds()) != 1 {
+		testContext.Errorf("Expected the version quota to be enforced, but found %d versions",
+			len(image.getImageVersionIds()))
+	}
+	
+	// Nor may a new image be added beyond MaxImages.
+	quota.MaxImages, quota.MaxImageVersions = 1, 0
+	envelope = strings.Replace(testRegistryEnvelope, "repoa/pushed\", \"tag", "repoa/another\", \"tag", 1)
+	if status := postRegistryNotification(f.server, "registry-token", envelope); status != http.StatusOK {
+		testContext.Fatalf("Expected the envelope to be accepted, but the status is %d", status)
+	}
+	var another DockerImage
+	another, err = f.repo.getDockerImageByName(f.client, "another")
+	if err != nil { testContext.Fatal(err) }
+	if another != nil { testContext.Error("Expected the image quota to be enforced") }
+}
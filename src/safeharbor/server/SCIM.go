@@ -0,0 +1,910 @@
+/*******************************************************************************
+ * SCIM 2.0 (RFC 7643 and RFC 7644) provisioning of users and groups by an
+ * identity provider.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	
+	"utilities"
+)
+
+const (
+	SCIMPathPrefix = "scim/v2"
+	SCIMContentType = "application/scim+json"
+	SCIMUserSchema = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SCIMGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	SCIMServiceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	SCIMResourceTypeSchema = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	SCIMListResponseSchema = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SCIMPatchOpSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SCIMErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+	SCIMMaxResults = 200  // per page of a list
+	SCIMMaxRequestSize = 1024 * 1024  // bytes
+	SCIMMinTokenLength = 16
+)
+
+/*******************************************************************************
+ * The SCIM configuration: the bearer token of each realm whose users and groups
+ * are provisioned through SCIM. An identity provider that presents a realm's
+ * token manages only the users and groups of that realm, and the users that it
+ * creates are created there.
+ */
+type SCIMConfig struct {
+	Tokens map[string]string  // maps a realm name to its token
+}
+
+/*******************************************************************************
+ * A SCIM request, as it is passed to a SCIM handler.
+ */
+type SCIMRequest struct {
+	Method string
+	ResourceType string  // Users, Groups, ServiceProviderConfig, or ResourceTypes
+	Id string  // "" if the request is for the collection
+	Query url.Values
+	Body map[string]interface{}  // nil unless the method is POST, PUT, or PATCH
+	BaseURL string  // the URL of the SCIM endpoints
+}
+
+/*******************************************************************************
+ * The response to a SCIM request. If Resource is nil, the response has no body.
+ */
+type SCIMResponse struct {
+	Status int
+	Resource map[string]interface{}
+	Location string  // "" unless a resource was created
+}
+
+/*******************************************************************************
+ * A SCIM error response. ScimType is one of the error types of RFC 7644, section
+ * 3.12, or "".
+ */
+type SCIMError struct {
+	Status int
+	ScimType string
+	Detail string
+}
+
+func newSCIMError(status int, scimType, detail string) *SCIMError {
+	return &SCIMError{ Status: status, ScimType: scimType, Detail: detail }
+}
+
+func (scimErr *SCIMError) Error() string {
+	return scimErr.Detail
+}
+
+/*******************************************************************************
+ * All SCIM handler functions are of this type. The realm is that of the bearer
+ * token.
+ */
+type SCIMHandlerFuncType func(*InMemClient, Realm, *SCIMRequest) (*SCIMResponse, error)
+
+/*******************************************************************************
+ * Return the name of the realm whose token is the specified token, or "" if
+ * there is none. Every token is compared, in constant time.
+ */
+func (config *SCIMConfig) getRealmName(token string) string {
+	var realmName = ""
+	for name, realmToken := range config.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(realmToken)) == 1 { realmName = name }
+	}
+	return realmName
+}
+
+/*******************************************************************************
+ * Respond to a SCIM request that exceeds the client's rate limit (see
+ * Server.dispatch).
+ */
+func writeSCIMTooManyRequests(writer http.ResponseWriter, retryAfter time.Duration) {
+	var seconds = int64((retryAfter + time.Second - 1) / time.Second)
+	writer.Header().Set("Retry-After", fmt.Sprintf("%d", seconds))
+	writeSCIMError(writer, newSCIMError(http.StatusTooManyRequests, "", fmt.Sprintf(
+		"Rate limit exceeded; retry after %d seconds", seconds)))
+}
+
+/*******************************************************************************
+ * Perform a SCIM request. The path is the part of the URL path that follows
+ * SCIMPathPrefix. Unlike the other methods, the SCIM endpoints are REST
+ * resources: Users and Groups support GET (with filter, startIndex, count,
+ * attributes, and excludedAttributes), POST, PUT, PATCH, and DELETE, and are
+ * described by ServiceProviderConfig and ResourceTypes. Requests and responses
+ * are SCIM JSON. Like the other methods, a request is performed within a
+ * transaction, and re-run if the transaction conflicts with that of another
+ * request: SCIM handlers have no effects outside of the database.
+ */
+func (server *Server) dispatchSCIM(writer http.ResponseWriter, httpReq *http.Request, path string) {
+	
+	if server.Config.SCIM == nil {
+		writeSCIMError(writer, newSCIMError(http.StatusNotFound, "", "SCIM provisioning is not enabled"))
+		return
+	}
+	
+	// Identify the realm by the bearer token.
+	var token = ""
+	var authorization = httpReq.Header.Get("Authorization")
+	if strings.HasPrefix(strings.ToLower(authorization), "bearer ") {
+		token = strings.TrimSpace(authorization[len("bearer "):])
+	}
+	var realmName = ""
+	if token != "" { realmName = server.Config.SCIM.getRealmName(token) }
+	if realmName == "" {
+		writer.Header().Set("WWW-Authenticate", "Bearer realm=\"SafeHarbor SCIM\"")
+		writeSCIMError(writer, newSCIMError(http.StatusUnauthorized, "", "Missing or invalid bearer token"))
+		return
+	}
+	
+	var request = &SCIMRequest{
+		Method: strings.ToUpper(httpReq.Method),
+		Query: httpReq.URL.Query(),
+		BaseURL: server.GetBasePublicURL() + "/" + SCIMPathPrefix,
+	}
+	var segments = strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) > 2 {
+		writeSCIMError(writer, newSCIMError(http.StatusNotFound, "", "No SCIM resource " + path))
+		return
+	}
+	request.ResourceType = segments[0]
+	if len(segments) == 2 { request.Id = segments[1] }
+	var handler, scimErr = getSCIMHandler(request)
+	if scimErr != nil {
+		writeSCIMError(writer, scimErr)
+		return
+	}
+	
+	var err error
+	if (request.Method == "POST") || (request.Method == "PUT") || (request.Method == "PATCH") {
+		var body []byte
+		body, err = ioutil.ReadAll(io.LimitReader(httpReq.Body, SCIMMaxRequestSize + 1))
+		if err != nil {
+			writeSCIMError(writer, newSCIMError(http.StatusBadRequest, "", err.Error()))
+			return
+		}
+		if len(body) > SCIMMaxRequestSize {
+			writeSCIMError(writer, newSCIMError(http.StatusRequestEntityTooLarge, "",
+				"Request body is too large"))
+			return
+		}
+		err = json.Unmarshal(body, &request.Body)
+		if (err != nil) || (request.Body == nil) {
+			writeSCIMError(writer, newSCIMError(http.StatusBadRequest, "invalidSyntax",
+				"Request body is not a JSON object"))
+			return
+		}
+	}
+	
+	var realmId string
+	realmId, err = server.persistence.GetRealmObjIdByRealmName(realmName)
+	if (err == nil) && (realmId == "") { err = utilities.ConstructServerError(
+		"Realm " + realmName + ", for which SCIM is configured, does not exist") }
+	if err != nil {
+		writeSCIMError(writer, asSCIMError(err))
+		return
+	}
+	
+	var response *SCIMResponse
+	err = server.performInTransaction("SCIM request", func(dbClient *InMemClient) (bool, error) {
+		var realm, err = dbClient.getRealm(realmId)
+		if err != nil { return false, err }
+		response, err = handler(dbClient, realm, request)
+		return true, err
+	})
+	if err != nil {
+		writeSCIMError(writer, asSCIMError(err))
+		return
+	}
+	writeSCIMResponse(writer, response)
+}
+
+/*******************************************************************************
+ * Return the handler for the request's method and resource.
+ */
+func getSCIMHandler(request *SCIMRequest) (SCIMHandlerFuncType, *SCIMError) {
+	
+	var handlers map[string]SCIMHandlerFuncType
+	switch request.ResourceType {
+		case "Users":
+			if request.Id == "" {
+				handlers = map[string]SCIMHandlerFuncType{ "GET": scimListUsers, "POST": scimCreateUser }
+			} else {
+				handlers = map[string]SCIMHandlerFuncType{ "GET": scimGetUser, "PUT": scimReplaceUser,
+					"PATCH": scimPatchUser, "DELETE": scimDeleteUser }
+			}
+		case "Groups":
+			if request.Id == "" {
+				handlers = map[string]SCIMHandlerFuncType{ "GET": scimListGroups, "POST": scimCreateGroup }
+			} else {
+				handlers = map[string]SCIMHandlerFuncType{ "GET": scimGetGroup, "PUT": scimReplaceGroup,
+					"PATCH": scimPatchGroup, "DELETE": scimDeleteGroup }
+			}
+		case "ServiceProviderConfig":
+			if request.Id == "" {
+				handlers = map[string]SCIMHandlerFuncType{ "GET": scimGetServiceProviderConfig }
+			}
+		case "ResourceTypes":
+			handlers = map[string]SCIMHandlerFuncType{ "GET": scimGetResourceTypes }
+	}
+	if handlers == nil { return nil, newSCIMError(http.StatusNotFound, "",
+		"No SCIM resource " + request.ResourceType + "/" + request.Id) }
+	var handler = handlers[request.Method]
+	if handler == nil { return nil, newSCIMError(http.StatusMethodNotAllowed, "",
+		request.Method + " is not supported for " + request.ResourceType) }
+	return handler, nil
+}
+
+/*******************************************************************************
+ * Convert an error into a SCIM error. User errors are reported as invalid
+ * values.
+ */
+func asSCIMError(err error) *SCIMError {
+	var scimErr, isType = err.(*SCIMError)
+	if isType { return scimErr }
+	var conflictErr, isConflict = err.(*TransactionConflictError)
+	if isConflict {
+		var failureDesc = conflictErr.asFailureDesc()
+		return newSCIMError(failureDesc.HTTPStatusCode, "", failureDesc.HTTPReasonPhrase)
+	}
+	if utilities.IsUserErr(err) { return newSCIMError(http.StatusBadRequest, "invalidValue", err.Error()) }
+	return newSCIMError(http.StatusInternalServerError, "", err.Error())
+}
+
+func writeSCIMResponse(writer http.ResponseWriter, response *SCIMResponse) {
+	
+	if response.Location != "" { writer.Header().Set("Location", response.Location) }
+	if response.Resource == nil {
+		writer.WriteHeader(response.Status)
+		return
+	}
+	var body, err = json.Marshal(response.Resource)
+	if err != nil {
+		writeSCIMError(writer, newSCIMError(http.StatusInternalServerError, "", err.Error()))
+		return
+	}
+	writer.Header().Set("Content-Type", SCIMContentType)
+	writer.WriteHeader(response.Status)
+	writer.Write(body)
+}
+
+func writeSCIMError(writer http.ResponseWriter, scimErr *SCIMError) {
+	
+	var resource = map[string]interface{}{
+		"schemas": []interface{}{ SCIMErrorSchema },
+		"status": fmt.Sprintf("%d", scimErr.Status),
+		"detail": scimErr.Detail,
+	}
+	if scimErr.ScimType != "" { resource["scimType"] = scimErr.ScimType }
+	var body, _ = json.Marshal(resource)
+	writer.Header().Set("Content-Type", SCIMContentType)
+	writer.WriteHeader(scimErr.Status)
+	writer.Write(body)
+	fmt.Println("SCIM error: " + scimErr.Detail)
+}
+
+/*******************************************************************************
+ * Users. A SCIM User is a SafeHarbor User. Its userName is the user Id, which
+ * cannot be changed; its displayName is the user's name, which need not be
+ * unique; its primary email address is the user's email address, which is
+ * trusted, and thus verified; and active is whether the user may log in (see
+ * setActive).
+ */
+
+func scimListUsers(dbClient *InMemClient, realm Realm, request *SCIMRequest) (*SCIMResponse, error) {
+	
+	var resources = make([]map[string]interface{}, 0)
+	for _, userObjId := range realm.getUserObjIds() {
+		var user, err = dbClient.getUser(userObjId)
+		if err != nil { return nil, err }
+		if user.isDeleted() { continue }
+		var resource map[string]interface{}
+		resource, err = userAsSCIMResource(dbClient, user, request.BaseURL)
+		if err != nil { return nil, err }
+		resources = append(resources, resource)
+	}
+	return listSCIMResources(resources, request)
+}
+
+func scimGetUser(dbClient *InMemClient, realm Realm, request *SCIMRequest) (*SCIMResponse, error) {
+	
+	var user, err = getSCIMUser(dbClient, realm, request.Id)
+	if err != nil { return nil, err }
+	return scimUserResponse(dbClient, user, request, http.StatusOK)
+}
+
+/*******************************************************************************
+ * A user who is created without a password is given a random one, which the user
+ * must reset (see requestPasswordReset) before logging in with a password.
+ */
+func scimCreateUser(dbClient *InMemClient, realm Realm, request *SCIMRequest) (*SCIMResponse, error) {
+	
+	var userId = getSCIMString(request.Body, "userName")
+	if userId == "" { return nil, newSCIMError(http.StatusBadRequest, "invalidValue", "userName is required") }
+	var user, err = dbClient.dbGetUserByUserId(userId)
+	if err != nil { return nil, err }
+	if user != nil { return nil, newSCIMError(http.StatusConflict, "uniqueness",
+		"A user with userName " + userId + " already exists") }
+	var name = getSCIMUserName(request.Body, "")
+	if name == "" { name = userId }
+	
+	var pswd = getSCIMString(request.Body, "password")
+	if pswd == "" {
+		var randomBytes = make([]byte, 32)
+		_, err = rand.Read(randomBytes)
+		if err != nil { return nil, err }
+		pswd = hex.EncodeToString(randomBytes)
+	} else {
+		err = dbClient.getServer().checkPasswordPolicy(userId, pswd)
+		if err != nil { return nil, err }
+	}
+	var email = getSCIMPrimaryEmail(request.Body)
+	user, err = dbClient.dbCreateUser(userId, name, email, pswd, realm.getId())
+	if err != nil { return nil, err }
+	if email != "" {
+		err = user.flagEmailAsVerified(dbClient, email)  // the identity provider is trusted
+		if err != nil { return nil, err }
+	}
+	var active, present bool
+	active, present, err = getSCIMBool(request.Body, "active")
+	if err != nil { return nil, err }
+	if present && ! active {
+		err = dbClient.setActive(user, false)
+		if err != nil { return nil, err }
+	}
+	fmt.Println("Provisioned user " + userId + " in realm " + realm.getName() + " through SCIM")
+	
+	var response *SCIMResponse
+	response, err = scimUserResponse(dbClient, user, request, http.StatusCreated)
+	if err != nil { return nil, err }
+	response.Location = request.BaseURL + "/Users/" + user.getId()
+	return response, nil
+}
+
+func scimReplaceUser(dbClient *InMemClient, realm Realm, request *SCIMRequest) (*SCIMResponse, error) {
+	
+	var user, err = getSCIMUser(dbClient, realm, request.Id)
+	if err != nil { return nil, err }
+	err = applySCIMUser(dbClient, user, request.Body)
+	if err != nil { return nil, err }
+	return scimUserResponse(dbClient, user, request, http.StatusOK)
+}
+
+/*******************************************************************************
+ * Apply the operations to the user's SCIM resource, and then update the user
+ * as for PUT.
+ */
+func scimPatchUser(dbClient *InMemClient, realm Realm, request *SCIMRequest) (*SCIMResponse, error) {
+	
+	var user, err = getSCIMUser(dbClient, realm, request.Id)
+	if err != nil { return nil, err }
+	var resource map[string]interface{}
+	resource, err = userAsSCIMResource(dbClient, user, request.BaseURL)
+	if err != nil { return nil, err }
+	err = applySCIMPatch(resource, request.Body)
+	if err != nil { return nil, err }
+	err = applySCIMUser(dbClient, user, resource)
+	if err != nil { return nil, err }
+	return scimUserResponse(dbClient, user, request, http.StatusOK)
+}
+
+/*******************************************************************************
+ * Deactivate the user, remove it from its groups, and flag it as deleted (see
+ * markUserDeleted), rather than removing it, since events and access refer to
+ * the user. A deleted user is no longer found through SCIM, and its userName
+ * may be given to a new user.
+ */
+func scimDeleteUser(dbClient *InMemClient, realm Realm, request *SCIMRequest) (*SCIMResponse, error) {
+	
+	var user, err = getSCIMUser(dbClient, realm, request.Id)
+	if err != nil { return nil, err }
+	for _, groupId := range append([]string{}, user.getGroupIds()...) {
+		var group Group
+		group, err = dbClient.getGroup(groupId)
+		if err != nil { return nil, err }
+		err = group.removeUser(dbClient, user)
+		if err != nil { return nil, err }
+	}
+	if user.isActive() {
+		err = dbClient.setActive(user, false)
+		if err != nil { return nil, err }
+		err = dbClient.getServer().authService.invalidateSessionsForUser(dbClient, user)
+		if err != nil { return nil, err }
+	}
+	err = dbClient.markUserDeleted(user)
+	if err != nil { return nil, err }
+	fmt.Println("Deleted user " + user.getUserId() + " through SCIM")
+	return &SCIMResponse{ Status: http.StatusNoContent }, nil
+}
+
+/*******************************************************************************
+ * Return the specified user, or a Not Found error if it is not a user of the
+ * realm, or has been deleted.
+ */
+func getSCIMUser(dbClient DBClient, realm Realm, userObjId string) (User, error) {
+	for _, id := range realm.getUserObjIds() {
+		if id != userObjId { continue }
+		var user, err = dbClient.getUser(userObjId)
+		if err != nil { return nil, err }
+		if user.isDeleted() { break }
+		return user, nil
+	}
+	return nil, newSCIMError(http.StatusNotFound, "", "User " + userObjId + " not found")
+}
+
+func scimUserResponse(dbClient DBClient, user User, request *SCIMRequest,
+	status int) (*SCIMResponse, error) {
+	
+	var resource, err = userAsSCIMResource(dbClient, user, request.BaseURL)
+	if err != nil { return nil, err }
+	return &SCIMResponse{ Status: status, Resource: projectSCIMResource(resource, request.Query) }, nil
+}
+
+/*******************************************************************************
+ * Update the user to agree with the SCIM resource. Attributes that are read-only,
+ * or that SafeHarbor does not store, are ignored; the password is set only if
+ * the resource has one.
+ */
+func applySCIMUser(dbClient DBClient, user User, resource map[string]interface{}) error {
+	
+	var userId = getSCIMString(resource, "userName")
+	if (userId != "") && (userId != user.getUserId()) { return newSCIMError(http.StatusBadRequest,
+		"mutability", "userName cannot be changed") }
+	
+	var err error
+	var name = getSCIMUserName(resource, user.getName())
+	if name != user.getName() {
+		user.setNameDeferredUpdate(name)
+		err = dbClient.writeBack(user)
+		if err != nil { return err }
+	}
+	
+	var email = getSCIMPrimaryEmail(resource)
+	if email != user.getEmailAddress() {
+		err = user.setUnverifiedEmailAddress(dbClient, email)
+		if err != nil { return err }
+		if email != "" {
+			err = user.flagEmailAsVerified(dbClient, email)
+			if err != nil { return err }
+		}
+	}
+	
+	var pswd = getSCIMString(resource, "password")
+	if pswd != "" {
+		if user.getLDAPDN() != "" { return newSCIMError(http.StatusBadRequest, "mutability",
+			"The password of a user who is authenticated by the LDAP directory cannot be set") }
+		err = dbClient.getServer().checkPasswordPolicy(user.getUserId(), pswd)
+		if err != nil { return err }
+		err = user.setPassword(dbClient, pswd)
+		if err != nil { return err }
+	}
+	
+	var active, present bool
+	active, present, err = getSCIMBool(resource, "active")
+	if err != nil { return err }
+	if present && (active != user.isActive()) {
+		err = dbClient.setActive(user, active)
+		if err != nil { return err }
+		if ! active {
+			err = dbClient.getServer().authService.invalidateSessionsForUser(dbClient, user)
+			if err != nil { return err }
+		}
+	}
+	return nil
+}
+
+func userAsSCIMResource(dbClient DBClient, user User, baseURL string) (map[string]interface{}, error) {
+	
+	var groups = make([]interface{}, 0)
+	for _, groupId := range user.getGroupIds() {
+		var group, err = dbClient.getGroup(groupId)
+		if err != nil { return nil, err }
+		groups = append(groups, map[string]interface{}{
+			"value": groupId,
+			"display": group.getName(),
+			"$ref": baseURL + "/Groups/" + groupId,
+		})
+	}
+	var emails = make([]interface{}, 0)
+	if user.getEmailAddress() != "" {
+		emails = append(emails, map[string]interface{}{
+			"value": user.getEmailAddress(),
+			"type": "work",
+			"primary": true,
+		})
+	}
+	return map[string]interface{}{
+		"schemas": []interface{}{ SCIMUserSchema },
+		"id": user.getId(),
+		"userName": user.getUserId(),
+		"displayName": user.getName(),
+		"name": map[string]interface{}{ "formatted": user.getName() },
+		"emails": emails,
+		"active": user.isActive(),
+		"groups": groups,
+		"meta": newSCIMMeta("User", user.getCreationTime(), baseURL + "/Users/" + user.getId()),
+	}, nil
+}
+
+/*******************************************************************************
+ * Return the name that the resource gives the user: its displayName, its
+ * name.formatted, or its name.givenName and name.familyName - the first of these
+ * that differs from the current name, since a PATCH may have changed any of
+ * them. Return the current name if none differs.
+ */
+func getSCIMUserName(resource map[string]interface{}, currentName string) string {
+	
+	var candidates = []string{ getSCIMString(resource, "displayName") }
+	var obj, _ = getSCIMAttribute(resource, "name")
+	var name, isComplex = obj.(map[string]interface{})
+	if isComplex {
+		candidates = append(candidates, getSCIMString(name, "formatted"), strings.TrimSpace(
+			getSCIMString(name, "givenName") + " " + getSCIMString(name, "familyName")))
+	}
+	for _, candidate := range candidates {
+		if (candidate != "") && (candidate != currentName) { return candidate }
+	}
+	return currentName
+}
+
+/*******************************************************************************
+ * Return the primary email address of the resource, or else its first email
+ * address, or "" if it has none.
+ */
+func getSCIMPrimaryEmail(resource map[string]interface{}) string {
+	
+	var obj, _ = getSCIMAttribute(resource, "emails")
+	var emails, _ = obj.([]interface{})
+	var email = ""
+	for _, element := range emails {
+		var complex, isComplex = element.(map[string]interface{})
+		if ! isComplex { continue }
+		var value = getSCIMString(complex, "value")
+		if value == "" { continue }
+		var primary, _, _ = getSCIMBool(complex, "primary")
+		if primary { return value }
+		if email == "" { email = value }
+	}
+	return email
+}
+
+/*******************************************************************************
+ * Groups. A SCIM Group is a SafeHarbor Group, the members of which are the
+ * group's users and the groups that it contains.
+ */
+
+func scimListGroups(dbClient *InMemClient, realm Realm, request *SCIMRequest) (*SCIMResponse, error) {
+	
+	var resources = make([]map[string]interface{}, 0)
+	for _, groupId := range realm.getGroupIds() {
+		var group, err = dbClient.getGroup(groupId)
+		if err != nil { return nil, err }
+		var resource map[string]interface{}
+		resource, err = groupAsSCIMResource(dbClient, group, request.BaseURL)
+		if err != nil { return nil, err }
+		resources = append(resources, resource)
+	}
+	return listSCIMResources(resources, request)
+}
+
+func scimGetGroup(dbClient *InMemClient, realm Realm, request *SCIMRequest) (*SCIMResponse, error) {
+	
+	var group, err = getSCIMGroup(dbClient, realm, request.Id)
+	if err != nil { return nil, err }
+	return scimGroupResponse(dbClient, group, request, http.StatusOK)
+}
+
+func scimCreateGroup(dbClient *InMemClient, realm Realm, request *SCIMRequest) (*SCIMResponse, error) {
+	
+	var name = getSCIMString(request.Body, "displayName")
+	if name == "" { return nil, newSCIMError(http.StatusBadRequest, "invalidValue", "displayName is required") }
+	var group, err = realm.getGroupByName(dbClient, name)
+	if err != nil { return nil, err }
+	if group != nil { return nil, newSCIMError(http.StatusConflict, "uniqueness",
+		"A group named " + name + " already exists in realm " + realm.getName()) }
+	group, err = dbClient.dbCreateGroup(realm.getId(), name, "Provisioned through SCIM")
+	if err != nil { return nil, err }
+	err = applySCIMGroup(dbClient, realm, group, request.Body)
+	if err != nil { return nil, err }
+	
+	var response *SCIMResponse
+	response, err = scimGroupResponse(dbClient, group, request, http.StatusCreated)
+	if err != nil { return nil, err }
+	response.Location = request.BaseURL + "/Groups/" + group.getId()
+	return response, nil
+}
+
+func scimReplaceGroup(dbClient *InMemClient, realm Realm, request *SCIMRequest) (*SCIMResponse, error) {
+	
+	var group, err = getSCIMGroup(dbClient, realm, request.Id)
+	if err != nil { return nil, err }
+	err = applySCIMGroup(dbClient, realm, group, request.Body)
+	if err != nil { return nil, err }
+	return scimGroupResponse(dbClient, group, request, http.StatusOK)
+}
+
+func scimPatchGroup(dbClient *InMemClient, realm Realm, request *SCIMRequest) (*SCIMResponse, error) {
+	
+	var group, err = getSCIMGroup(dbClient, realm, request.Id)
+	if err != nil { return nil, err }
+	var resource map[string]interface{}
+	resource, err = groupAsSCIMResource(dbClient, group, request.BaseURL)
+	if err != nil { return nil, err }
+	err = applySCIMPatch(resource, request.Body)
+	if err != nil { return nil, err }
+	err = applySCIMGroup(dbClient, realm, group, resource)
+	if err != nil { return nil, err }
+	return scimGroupResponse(dbClient, group, request, http.StatusOK)
+}
+
+func scimDeleteGroup(dbClient *InMemClient, realm Realm, request *SCIMRequest) (*SCIMResponse, error) {
+	
+	var group, err = getSCIMGroup(dbClient, realm, request.Id)
+	if err != nil { return nil, err }
+	err = realm.deleteGroup(dbClient, group)
+	if err != nil { return nil, err }
+	fmt.Println("Deleted group " + group.getName() + " through SCIM")
+	return &SCIMResponse{ Status: http.StatusNoContent }, nil
+}
+
+/*******************************************************************************
+ * Return the specified group, or a Not Found error if it is not a group of the
+ * realm.
+ */
+func getSCIMGroup(dbClient DBClient, realm Realm, groupId string) (Group, error) {
+	for _, id := range realm.getGroupIds() {
+		if id == groupId { return dbClient.getGroup(groupId) }
+	}
+	return nil, newSCIMError(http.StatusNotFound, "", "Group " + groupId + " not found")
+}
+
+func scimGroupResponse(dbClient DBClient, group Group, request *SCIMRequest,
+	status int) (*SCIMResponse, error) {
+	
+	var resource, err = groupAsSCIMResource(dbClient, group, request.BaseURL)
+	if err != nil { return nil, err }
+	return &SCIMResponse{ Status: status, Resource: projectSCIMResource(resource, request.Query) }, nil
+}
+
+/*******************************************************************************
+ * Update the group to agree with the SCIM resource: its name, and its members,
+ * each of which is a user or a group of the realm.
+ */
+func applySCIMGroup(dbClient DBClient, realm Realm, group Group, resource map[string]interface{}) error {
+	
+	var name = getSCIMString(resource, "displayName")
+	if name == "" { return newSCIMError(http.StatusBadRequest, "invalidValue", "displayName is required") }
+	var err error
+	if name != group.getName() {
+		var other Group
+		other, err = realm.getGroupByName(dbClient, name)
+		if err != nil { return err }
+		if other != nil { return newSCIMError(http.StatusConflict, "uniqueness",
+			"A group named " + name + " already exists in realm " + realm.getName()) }
+		group.setNameDeferredUpdate(name)
+		err = dbClient.writeBack(group)
+		if err != nil { return err }
+	}
+	
+	// Add the members that the group does not have.
+	var memberIds = make(map[string]bool)
+	for _, value := range getSCIMValues(resource, "members.value", false) {
+		var memberId = fmt.Sprint(value)
+		memberIds[memberId] = true
+		if realm.hasUserWithId(dbClient, memberId) {
+			if group.hasUserWithId(dbClient, memberId) { continue }
+			err = group.addUserId(dbClient, memberId)
+			if err != nil { return err }
+		} else if realm.hasGroupWithId(dbClient, memberId) {
+			if group.hasMemberGroupWithId(memberId) { continue }
+			var member Group
+			member, err = dbClient.getGroup(memberId)
+			if err != nil { return err }
+			err = group.addMemberGroup(dbClient, member)
+			if err != nil { return err }
+		} else {
+			return newSCIMError(http.StatusBadRequest, "invalidValue",
+				"Member " + memberId + " is not a user or group of realm " + realm.getName())
+		}
+	}
+	
+	// Remove the members that the resource does not have.
+	for _, userObjId := range append([]string{}, group.getUserObjIds()...) {
+		if memberIds[userObjId] { continue }
+		var user User
+		user, err = dbClient.getUser(userObjId)
+		if err != nil { return err }
+		err = group.removeUser(dbClient, user)
+		if err != nil { return err }
+	}
+	for _, groupId := range append([]string{}, group.getMemberGroupIds()...) {
+		if memberIds[groupId] { continue }
+		var member Group
+		member, err = dbClient.getGroup(groupId)
+		if err != nil { return err }
+		err = group.removeMemberGroup(dbClient, member)
+		if err != nil { return err }
+	}
+	return nil
+}
+
+func groupAsSCIMResource(dbClient DBClient, group Group, baseURL string) (map[string]interface{}, error) {
+	
+	var members = make([]interface{}, 0)
+	for _, userObjId := range group.getUserObjIds() {
+		var user, err = dbClient.getUser(userObjId)
+		if err != nil { return nil, err }
+		members = append(members, map[string]interface{}{
+			"value": userObjId,
+			"display": user.getUserId(),
+			"type": "User",
+			"$ref": baseURL + "/Users/" + userObjId,
+		})
+	}
+	for _, groupId := range group.getMemberGroupIds() {
+		var member, err = dbClient.getGroup(groupId)
+		if err != nil { return nil, err }
+		members = append(members, map[string]interface{}{
+			"value": groupId,
+			"display": member.getName(),
+			"type": "Group",
+			"$ref": baseURL + "/Groups/" + groupId,
+		})
+	}
+	return map[string]interface{}{
+		"schemas": []interface{}{ SCIMGroupSchema },
+		"id": group.getId(),
+		"displayName": group.getName(),
+		"members": members,
+		"meta": newSCIMMeta("Group", group.getCreationTime(), baseURL + "/Groups/" + group.getId()),
+	}, nil
+}
+
+/*******************************************************************************
+ * Discovery.
+ */
+
+func scimGetServiceProviderConfig(dbClient *InMemClient, realm Realm,
+	request *SCIMRequest) (*SCIMResponse, error) {
+	
+	return &SCIMResponse{ Status: http.StatusOK, Resource: map[string]interface{}{
+		"schemas": []interface{}{ SCIMServiceProviderConfigSchema },
+		"patch": map[string]interface{}{ "supported": true },
+		"bulk": map[string]interface{}{ "supported": false, "maxOperations": 0, "maxPayloadSize": 0 },
+		"filter": map[string]interface{}{ "supported": true, "maxResults": SCIMMaxResults },
+		"changePassword": map[string]interface{}{ "supported": true },
+		"sort": map[string]interface{}{ "supported": false },
+		"etag": map[string]interface{}{ "supported": false },
+		"authenticationSchemes": []interface{}{
+			map[string]interface{}{
+				"type": "oauthbearertoken",
+				"name": "OAuth Bearer Token",
+				"description": "The bearer token that is configured for the realm",
+			},
+		},
+		"meta": map[string]interface{}{
+			"resourceType": "ServiceProviderConfig",
+			"location": request.BaseURL + "/ServiceProviderConfig",
+		},
+	}}, nil
+}
+
+func scimGetResourceTypes(dbClient *InMemClient, realm Realm,
+	request *SCIMRequest) (*SCIMResponse, error) {
+	
+	var resourceTypes = []map[string]interface{}{
+		newSCIMResourceType("User", "/Users", SCIMUserSchema, request.BaseURL),
+		newSCIMResourceType("Group", "/Groups", SCIMGroupSchema, request.BaseURL),
+	}
+	if request.Id == "" { return listSCIMResources(resourceTypes, request) }
+	for _, resourceType := range resourceTypes {
+		if resourceType["id"] == request.Id { return &SCIMResponse{ Status: http.StatusOK,
+			Resource: resourceType }, nil }
+	}
+	return nil, newSCIMError(http.StatusNotFound, "", "No resource type " + request.Id)
+}
+
+func newSCIMResourceType(name, endpoint, schema, baseURL string) map[string]interface{} {
+	return map[string]interface{}{
+		"schemas": []interface{}{ SCIMResourceTypeSchema },
+		"id": name,
+		"name": name,
+		"endpoint": endpoint,
+		"schema": schema,
+		"meta": map[string]interface{}{
+			"resourceType": "ResourceType",
+			"location": baseURL + "/ResourceTypes/" + name,
+		},
+	}
+}
+
+func newSCIMMeta(resourceType string, created time.Time, location string) map[string]interface{} {
+	return map[string]interface{}{
+		"resourceType": resourceType,
+		"created": created.UTC().Format(time.RFC3339),
+		"location": location,
+	}
+}
+
+/*******************************************************************************
+ * Return a list response of the resources that match the request's filter,
+ * paged according to its startIndex (which is one-based) and count.
+ */
+func listSCIMResources(resources []map[string]interface{}, request *SCIMRequest) (*SCIMResponse, error) {
+	
+	var filterString = request.Query.Get("filter")
+	if filterString != "" {
+		var filter, err = parseSCIMFilter(filterString)
+		if err != nil { return nil, err }
+		var matching = make([]map[string]interface{}, 0)
+		for _, resource := range resources {
+			if filter.matches(resource) { matching = append(matching, resource) }
+		}
+		resources = matching
+	}
+	
+	var startIndex, count = 1, SCIMMaxResults
+	var err error
+	if request.Query.Get("startIndex") != "" {
+		startIndex, err = strconv.Atoi(request.Query.Get("startIndex"))
+		if err != nil { return nil, newSCIMError(http.StatusBadRequest, "invalidValue",
+			"startIndex is not an integer") }
+		if startIndex < 1 { startIndex = 1 }
+	}
+	if request.Query.Get("count") != "" {
+		count, err = strconv.Atoi(request.Query.Get("count"))
+		if err != nil { return nil, newSCIMError(http.StatusBadRequest, "invalidValue",
+			"count is not an integer") }
+		if count < 0 { count = 0 }
+		if count > SCIMMaxResults { count = SCIMMaxResults }
+	}
+	var page = make([]interface{}, 0)
+	for i := startIndex - 1; (i < len(resources)) && (len(page) < count); i++ {
+		page = append(page, projectSCIMResource(resources[i], request.Query))
+	}
+	return &SCIMResponse{ Status: http.StatusOK, Resource: map[string]interface{}{
+		"schemas": []interface{}{ SCIMListResponseSchema },
+		"totalResults": len(resources),
+		"startIndex": startIndex,
+		"itemsPerPage": len(page),
+		"Resources": page,
+	}}, nil
+}
+
+/*******************************************************************************
+ * Return the resource with only the attributes that the request's attributes
+ * parameter lists, or without those that its excludedAttributes parameter
+ * lists. Each is a comma-separated list, of which only the top-level attribute
+ * of each entry is considered. The id and schemas are always returned.
+ */
+func projectSCIMResource(resource map[string]interface{}, query url.Values) map[string]interface{} {
+	
+	var names = make(map[string]bool)
+	var include = (query.Get("attributes") != "")
+	var list = query.Get("excludedAttributes")
+	if include { list = query.Get("attributes") }
+	if list == "" { return resource }
+	for _, path := range strings.Split(list, ",") {
+		var name = trimSCIMSchema(strings.TrimSpace(path))
+		name = strings.Split(name, ".")[0]
+		names[strings.ToLower(name)] = true
+	}
+	var projection = make(map[string]interface{})
+	for name, value := range resource {
+		if (name == "id") || (name == "schemas") || (names[strings.ToLower(name)] == include) {
+			projection[name] = value
+		}
+	}
+	return projection
+}
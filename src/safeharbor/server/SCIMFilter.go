@@ -0,0 +1,511 @@
+/*******************************************************************************
+ * SCIM filters (RFC 7644, section 3.4.2.2), PATCH operations (section 3.5.2),
+ * and access to the attributes of SCIM resources, which are represented as
+ * they are decoded from JSON.
+ *
+ * A filter is made of comparisons (eq, ne, co, sw, ew, gt, ge, lt, le, and pr),
+ * the logical operators and, or, and not, parentheses, and value paths, such as
+ * emails[type eq "work"], which match a multi-valued attribute any element of
+ * which matches the bracketed filter. Attribute names are not case sensitive,
+ * and may be qualified by a schema URN; values are compared without regard to
+ * case.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var scimComparisonOperators = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true,
+	"gt": true, "ge": true, "lt": true, "le": true,
+}
+
+/*******************************************************************************
+ * A parsed filter. Op is "and", "or", or "not", which apply to the children;
+ * "[]", a value path, whose child applies to the elements of the attribute; or
+ * a comparison of the attribute with the value.
+ */
+type scimFilter struct {
+	op string
+	attribute string
+	value string
+	isNull bool  // the value is null
+	children []*scimFilter
+}
+
+type scimFilterParser struct {
+	tokens []string
+	position int
+}
+
+func newSCIMFilterError(detail string) *SCIMError {
+	return newSCIMError(http.StatusBadRequest, "invalidFilter", detail)
+}
+
+/*******************************************************************************
+ * Parse the filter.
+ */
+func parseSCIMFilter(filterString string) (*scimFilter, error) {
+	
+	var tokens, err = tokenizeSCIMFilter(filterString)
+	if err != nil { return nil, err }
+	var parser = &scimFilterParser{ tokens: tokens }
+	var filter *scimFilter
+	filter, err = parser.parseOr()
+	if err != nil { return nil, err }
+	if parser.position < len(tokens) { return nil, newSCIMFilterError(
+		"Unexpected " + parser.peek() + " in filter") }
+	return filter, nil
+}
+
+/*******************************************************************************
+ * Split the filter into parentheses, brackets, quoted strings (including their
+ * quotes), and words.
+ */
+func tokenizeSCIMFilter(filterString string) ([]string, error) {
+	
+	var tokens = make([]string, 0)
+	for i := 0; i < len(filterString); {
+		var c = filterString[i]
+		if (c == ' ') || (c == '\t') {
+			i++
+		} else if strings.IndexByte("()[]", c) >= 0 {
+			tokens = append(tokens, string(c))
+			i++
+		} else if c == '"' {
+			var j = i + 1
+			for (j < len(filterString)) && (filterString[j] != '"') {
+				if filterString[j] == '\\' { j++ }
+				j++
+			}
+			if j >= len(filterString) { return nil, newSCIMFilterError("Unterminated string in filter") }
+			tokens = append(tokens, filterString[i:j+1])
+			i = j + 1
+		} else {
+			var j = i
+			for (j < len(filterString)) && (strings.IndexByte(" \t()[]\"", filterString[j]) < 0) { j++ }
+			tokens = append(tokens, filterString[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func (parser *scimFilterParser) peek() string {
+	if parser.position < len(parser.tokens) { return parser.tokens[parser.position] }
+	return ""
+}
+
+func (parser *scimFilterParser) next() string {
+	var token = parser.peek()
+	parser.position++
+	return token
+}
+
+func (parser *scimFilterParser) expect(token string) error {
+	if parser.next() != token { return newSCIMFilterError("Expected " + token + " in filter") }
+	return nil
+}
+
+func (parser *scimFilterParser) parseOr() (*scimFilter, error) {
+	
+	var left, err = parser.parseAnd()
+	if err != nil { return nil, err }
+	for strings.EqualFold(parser.peek(), "or") {
+		parser.next()
+		var right *scimFilter
+		right, err = parser.parseAnd()
+		if err != nil { return nil, err }
+		left = &scimFilter{ op: "or", children: []*scimFilter{ left, right } }
+	}
+	return left, nil
+}
+
+func (parser *scimFilterParser) parseAnd() (*scimFilter, error) {
+	
+	var left, err = parser.parseFactor()
+	if err != nil { return nil, err }
+	for strings.EqualFold(parser.peek(), "and") {
+		parser.next()
+		var right *scimFilter
+		right, err = parser.parseFactor()
+		if err != nil { return nil, err }
+		left = &scimFilter{ op: "and", children: []*scimFilter{ left, right } }
+	}
+	return left, nil
+}
+
+/*******************************************************************************
+ * Parse a negation, a parenthesized filter, a value path, or a comparison.
+ */
+func (parser *scimFilterParser) parseFactor() (*scimFilter, error) {
+	
+	var token = parser.next()
+	if token == "" { return nil, newSCIMFilterError("Incomplete filter") }
+	var err error
+	var child *scimFilter
+	if strings.EqualFold(token, "not") || (token == "(") {
+		if token != "(" {
+			err = parser.expect("(")
+			if err != nil { return nil, err }
+		}
+		child, err = parser.parseOr()
+		if err != nil { return nil, err }
+		err = parser.expect(")")
+		if err != nil { return nil, err }
+		if token == "(" { return child, nil }
+		return &scimFilter{ op: "not", children: []*scimFilter{ child } }, nil
+	}
+	if strings.IndexAny(token, "()[]\"") >= 0 { return nil, newSCIMFilterError(
+		"Expected an attribute, but found " + token) }
+	
+	var filter = &scimFilter{ attribute: trimSCIMSchema(token) }
+	if parser.peek() == "[" {
+		parser.next()
+		child, err = parser.parseOr()
+		if err != nil { return nil, err }
+		err = parser.expect("]")
+		if err != nil { return nil, err }
+		filter.op = "[]"
+		filter.children = []*scimFilter{ child }
+		return filter, nil
+	}
+	filter.op = strings.ToLower(parser.next())
+	if filter.op == "pr" { return filter, nil }
+	if ! scimComparisonOperators[filter.op] { return nil, newSCIMFilterError(
+		"Unsupported filter operator " + filter.op) }
+	
+	// The value is a string, true, false, null, or a number.
+	token = parser.next()
+	if strings.HasPrefix(token, "\"") {
+		err = json.Unmarshal([]byte(token), &filter.value)
+		if err != nil { return nil, newSCIMFilterError("Malformed string " + token + " in filter") }
+	} else if strings.EqualFold(token, "true") || strings.EqualFold(token, "false") {
+		filter.value = strings.ToLower(token)
+	} else if strings.EqualFold(token, "null") {
+		filter.isNull = true
+	} else if _, err = strconv.ParseFloat(token, 64); (token != "") && (err == nil) {
+		filter.value = token
+	} else {
+		return nil, newSCIMFilterError("Expected a value after " + filter.op + " in filter")
+	}
+	return filter, nil
+}
+
+/*******************************************************************************
+ * Return true if the resource (or element of a multi-valued attribute) matches
+ * the filter. A comparison matches if any value of the attribute satisfies it.
+ */
+func (filter *scimFilter) matches(resource map[string]interface{}) bool {
+	
+	switch filter.op {
+		case "and":
+			return filter.children[0].matches(resource) && filter.children[1].matches(resource)
+		case "or":
+			return filter.children[0].matches(resource) || filter.children[1].matches(resource)
+		case "not":
+			return ! filter.children[0].matches(resource)
+		case "[]":
+			for _, value := range getSCIMValues(resource, filter.attribute, false) {
+				var element, isComplex = value.(map[string]interface{})
+				if isComplex && filter.children[0].matches(element) { return true }
+			}
+			return false
+	}
+	
+	var values = getSCIMValues(resource, filter.attribute, true)
+	if filter.op == "pr" { return len(values) > 0 }
+	if filter.isNull {
+		if filter.op == "eq" { return len(values) == 0 }
+		if filter.op == "ne" { return len(values) > 0 }
+		return false
+	}
+	if len(values) == 0 { return filter.op == "ne" }
+	var operand = strings.ToLower(filter.value)
+	for _, obj := range values {
+		var value = strings.ToLower(fmt.Sprint(obj))
+		var satisfied bool
+		switch filter.op {
+			case "eq": satisfied = (value == operand)
+			case "ne": satisfied = (value != operand)
+			case "co": satisfied = strings.Contains(value, operand)
+			case "sw": satisfied = strings.HasPrefix(value, operand)
+			case "ew": satisfied = strings.HasSuffix(value, operand)
+			case "gt": satisfied = (value > operand)
+			case "ge": satisfied = (value >= operand)
+			case "lt": satisfied = (value < operand)
+			case "le": satisfied = (value <= operand)
+		}
+		if satisfied { return true }
+	}
+	return false
+}
+
+/*******************************************************************************
+ * Apply the operations of a PATCH request to the resource. The resource is then
+ * applied as for PUT, so operations on attributes that SafeHarbor does not store
+ * have no effect.
+ */
+func applySCIMPatch(resource map[string]interface{}, body map[string]interface{}) error {
+	
+	var obj, _ = getSCIMAttribute(body, "Operations")
+	var operations, isList = obj.([]interface{})
+	if (! isList) || (len(operations) == 0) { return newSCIMError(http.StatusBadRequest,
+		"invalidSyntax", "Operations is required") }
+	for _, obj := range operations {
+		var operation, isComplex = obj.(map[string]interface{})
+		if ! isComplex { return newSCIMError(http.StatusBadRequest, "invalidSyntax",
+			"Each operation must be an object") }
+		var op = strings.ToLower(getSCIMString(operation, "op"))
+		var path = getSCIMString(operation, "path")
+		var value, hasValue = getSCIMAttribute(operation, "value")
+		switch op {
+			case "add", "replace":
+				if ! hasValue { return newSCIMError(http.StatusBadRequest, "invalidValue",
+					"A value is required for " + op) }
+			case "remove":
+				if path == "" { return newSCIMError(http.StatusBadRequest, "noTarget",
+					"A path is required for remove") }
+			default:
+				return newSCIMError(http.StatusBadRequest, "invalidSyntax", "Unsupported operation " + op)
+		}
+		var err = applySCIMPatchOperation(resource, op, path, value)
+		if err != nil { return err }
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Apply an add, replace, or remove operation. The path is "", in which case the
+ * value is an object whose attributes are each added or replaced; an attribute;
+ * attribute.subAttribute; attribute[filter]; or attribute[filter].subAttribute.
+ */
+func applySCIMPatchOperation(resource map[string]interface{}, op, path string, value interface{}) error {
+	
+	if path == "" {
+		var values, isComplex = value.(map[string]interface{})
+		if ! isComplex { return newSCIMError(http.StatusBadRequest, "invalidValue",
+			"The value must be an object if there is no path") }
+		for name, v := range values {
+			var err = applySCIMPatchOperation(resource, op, name, v)
+			if err != nil { return err }
+		}
+		return nil
+	}
+	
+	var attribute, filterString, subAttribute = path, "", ""
+	var open = strings.Index(path, "[")
+	if open >= 0 {
+		var close = strings.LastIndex(path, "]")
+		if close < open { return newSCIMError(http.StatusBadRequest, "invalidPath", "Malformed path " + path) }
+		attribute = path[0:open]
+		filterString = path[open+1:close]
+		subAttribute = strings.TrimPrefix(path[close+1:], ".")
+	}
+	attribute = trimSCIMSchema(attribute)
+	if filterString == "" {
+		var dot = strings.Index(attribute, ".")
+		if dot >= 0 { attribute, subAttribute = attribute[0:dot], attribute[dot+1:] }
+	}
+	if attribute == "" { return newSCIMError(http.StatusBadRequest, "invalidPath", "Malformed path " + path) }
+	var current, _ = getSCIMAttribute(resource, attribute)
+	
+	if (filterString == "") && (subAttribute == "") {
+		var list, isList = current.([]interface{})
+		var complex, isComplex = current.(map[string]interface{})
+		switch op {
+			case "add":
+				if isList {
+					var newValues, isNewList = value.([]interface{})
+					if ! isNewList { newValues = []interface{}{ value } }
+					setSCIMAttribute(resource, attribute, append(list, newValues...))
+				} else if newComplex, isNewComplex := value.(map[string]interface{}); isComplex && isNewComplex {
+					for name, v := range newComplex { setSCIMAttribute(complex, name, v) }
+				} else {
+					setSCIMAttribute(resource, attribute, value)
+				}
+			case "replace":
+				setSCIMAttribute(resource, attribute, value)
+			case "remove":
+				// A value lists the elements of a multi-valued attribute to be removed.
+				var removals, isRemovalList = value.([]interface{})
+				if isList && isRemovalList {
+					setSCIMAttribute(resource, attribute, removeSCIMValues(list, removals))
+				} else {
+					removeSCIMAttribute(resource, attribute)
+				}
+		}
+		return nil
+	}
+	
+	if filterString == "" {
+		var complex, isComplex = current.(map[string]interface{})
+		if ! isComplex {
+			if op == "remove" { return nil }
+			complex = make(map[string]interface{})
+			setSCIMAttribute(resource, attribute, complex)
+		}
+		if op == "remove" {
+			removeSCIMAttribute(complex, subAttribute)
+		} else {
+			setSCIMAttribute(complex, subAttribute, value)
+		}
+		return nil
+	}
+	
+	var filter, err = parseSCIMFilter(filterString)
+	if err != nil { return err }
+	var list, _ = current.([]interface{})
+	var result = make([]interface{}, 0)
+	var matched = false
+	for _, element := range list {
+		var complex, isComplex = element.(map[string]interface{})
+		if (! isComplex) || (! filter.matches(complex)) {
+			result = append(result, element)
+			continue
+		}
+		matched = true
+		if (op == "remove") && (subAttribute == "") { continue }
+		if op == "remove" {
+			removeSCIMAttribute(complex, subAttribute)
+		} else if subAttribute == "" {
+			element = value
+		} else {
+			setSCIMAttribute(complex, subAttribute, value)
+		}
+		result = append(result, element)
+	}
+	
+	// Setting a sub-attribute of an element that does not exist, such as
+	// emails[type eq "work"].value, creates the element.
+	if (! matched) && (op != "remove") {
+		if (filter.op != "eq") || (subAttribute == "") { return newSCIMError(http.StatusBadRequest,
+			"noTarget", "No values match " + path) }
+		result = append(result, map[string]interface{}{ filter.attribute: filter.value, subAttribute: value })
+	}
+	setSCIMAttribute(resource, attribute, result)
+	return nil
+}
+
+/*******************************************************************************
+ * Return the elements of the list other than those whose values are those of
+ * the removals.
+ */
+func removeSCIMValues(list, removals []interface{}) []interface{} {
+	
+	var removed = make(map[string]bool)
+	for _, removal := range removals { removed[getSCIMElementValue(removal)] = true }
+	var result = make([]interface{}, 0)
+	for _, element := range list {
+		if ! removed[getSCIMElementValue(element)] { result = append(result, element) }
+	}
+	return result
+}
+
+func getSCIMElementValue(element interface{}) string {
+	var complex, isComplex = element.(map[string]interface{})
+	if isComplex { element, _ = getSCIMAttribute(complex, "value") }
+	return fmt.Sprint(element)
+}
+
+/*******************************************************************************
+ * Return the values of the attribute that the path (attribute or
+ * attribute.subAttribute) identifies, flattening multi-valued attributes. If
+ * simple is true, each element of a multi-valued complex attribute is
+ * represented by its value sub-attribute, so that, e.g., emails means the email
+ * addresses. Empty values are omitted.
+ */
+func getSCIMValues(resource map[string]interface{}, path string, simple bool) []interface{} {
+	
+	var name, rest = path, ""
+	var dot = strings.Index(path, ".")
+	if dot >= 0 { name, rest = path[0:dot], path[dot+1:] }
+	var value, found = getSCIMAttribute(resource, name)
+	if ! found { return nil }
+	var elements, isList = value.([]interface{})
+	if ! isList { elements = []interface{}{ value } }
+	
+	var values = make([]interface{}, 0)
+	for _, element := range elements {
+		var complex, isComplex = element.(map[string]interface{})
+		if rest != "" {
+			if isComplex { values = append(values, getSCIMValues(complex, rest, simple)...) }
+		} else if isComplex && simple {
+			var v, _ = getSCIMAttribute(complex, "value")
+			if (v != nil) && (v != "") { values = append(values, v) }
+		} else if (element != nil) && (element != "") {
+			values = append(values, element)
+		}
+	}
+	return values
+}
+
+/*******************************************************************************
+ * Return the value of the attribute, whose name is not case sensitive.
+ */
+func getSCIMAttribute(resource map[string]interface{}, name string) (interface{}, bool) {
+	
+	var value, found = resource[name]
+	if found { return value, true }
+	for key, value := range resource {
+		if strings.EqualFold(key, name) { return value, true }
+	}
+	return nil, false
+}
+
+func getSCIMString(resource map[string]interface{}, name string) string {
+	var value, _ = getSCIMAttribute(resource, name)
+	var s, _ = value.(string)
+	return s
+}
+
+/*******************************************************************************
+ * Return the value of a boolean attribute, and whether it is present. Some
+ * identity providers send booleans as strings, such as "False".
+ */
+func getSCIMBool(resource map[string]interface{}, name string) (bool, bool, error) {
+	
+	var value, found = getSCIMAttribute(resource, name)
+	if (! found) || (value == nil) { return false, false, nil }
+	var b, isBool = value.(bool)
+	if isBool { return b, true, nil }
+	var s, isString = value.(string)
+	if isString {
+		var err error
+		b, err = strconv.ParseBool(strings.ToLower(s))
+		if err == nil { return b, true, nil }
+	}
+	return false, false, newSCIMError(http.StatusBadRequest, "invalidValue", name + " must be true or false")
+}
+
+/*******************************************************************************
+ * Set the attribute, replacing any attribute whose name differs only in case.
+ */
+func setSCIMAttribute(resource map[string]interface{}, name string, value interface{}) {
+	removeSCIMAttribute(resource, name)
+	resource[name] = value
+}
+
+func removeSCIMAttribute(resource map[string]interface{}, name string) {
+	for key := range resource {
+		if strings.EqualFold(key, name) { delete(resource, key) }
+	}
+}
+
+/*******************************************************************************
+ * Remove the schema URN, if any, that qualifies an attribute path, e.g.,
+ * urn:ietf:params:scim:schemas:core:2.0:User:userName.
+ */
+func trimSCIMSchema(path string) string {
+	var colon = strings.LastIndex(path, ":")
+	if colon >= 0 { return path[colon+1:] }
+	return path
+}
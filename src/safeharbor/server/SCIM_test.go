@@ -0,0 +1,171 @@
+package server
+
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func Test_SCIMFiltersSelectMatchingResources(testContext *testing.T) {
+	
+	var resource = map[string]interface{}{
+		"userName": "alice",
+		"active": true,
+		"name": map[string]interface{}{ "formatted": "Alice Liddell" },
+		"emails": []interface{}{
+			map[string]interface{}{ "value": "alice@example.com", "type": "work", "primary": true },
+		},
+	}
+	var expectedMatches = map[string]bool{
+		`userName eq "Alice"`: true,
+		`userName eq "bob"`: false,
+		`UserName sw "al" and active eq true`: true,
+		`active eq false or name.formatted co "liddell"`: true,
+		`not (userName pr)`: false,
+		`title pr`: false,
+		`emails eq "alice@example.com"`: true,
+		`emails[type eq "work" and value ew "@example.com"]`: true,
+		`emails[type eq "home"]`: false,
+		`urn:ietf:params:scim:schemas:core:2.0:User:userName ne "alice"`: false,
+	}
+	for filterString, expected := range expectedMatches {
+		var filter, err = parseSCIMFilter(filterString)
+		if err != nil {
+			testContext.Errorf("%s: %s", filterString, err.Error())
+			continue
+		}
+		if filter.matches(resource) != expected {
+			testContext.Errorf("Expected match of %s to be %v", filterString, expected)
+		}
+	}
+	
+	for _, filterString := range []string{ `userName eq`, `(userName eq "a"`,
+		`userName xx "a"`, `userName eq "a" junk`, `userName eq "a` } {
+		var _, err = parseSCIMFilter(filterString)
+		if err == nil { testContext.Errorf("Expected %s to be rejected", filterString) }
+	}
+}
+
+func Test_SCIMProvisionsUsersAndGroups(testContext *testing.T) {
+	
+	var f = newTestDB(testContext)
+	var response, err = scimCreateUser(f.client, f.realm, &SCIMRequest{
+		Body: map[string]interface{}{
+			"schemas": []interface{}{ SCIMUserSchema },
+			"userName": "alice",
+			"name": map[string]interface{}{ "givenName": "Alice", "familyName": "Liddell" },
+			"emails": []interface{}{ map[string]interface{}{ "value": "alice@example.com", "primary": true } },
+			"active": true,
+		},
+	})
+	if err != nil { testContext.Fatal(err) }
+	if response.Status != http.StatusCreated { testContext.Errorf("Expected status 201, but got %d", response.Status) }
+	var aliceId = response.Resource["id"].(string)
+	var alice User
+	alice, err = f.client.getUser(aliceId)
+	if err != nil { testContext.Fatal(err) }
+	if (alice.getRealmId() != f.realm.getId()) || (alice.getName() != "Alice Liddell") ||
+		! alice.emailIsVerified() {
+		testContext.Error("Expected alice to be created in the realm from the SCIM resource")
+	}
+	
+	_, err = scimCreateUser(f.client, f.realm, &SCIMRequest{
+		Body: map[string]interface{}{ "userName": "alice" },
+	})
+	var scimErr, isType = err.(*SCIMError)
+	if (! isType) || (scimErr.Status != http.StatusConflict) {
+		testContext.Errorf("Expected a second alice to conflict, but got %v", err)
+	}
+	
+	response, err = scimListUsers(f.client, f.realm, &SCIMRequest{
+		Query: url.Values{ "filter": { `userName eq "ALICE"` } },
+	})
+	if err != nil { testContext.Fatal(err) }
+	if response.Resource["totalResults"] != 1 {
+		testContext.Errorf("Expected the filter to select alice, but got %v", response.Resource["totalResults"])
+	}
+	
+	response, err = scimCreateGroup(f.client, f.realm, &SCIMRequest{
+		Body: map[string]interface{}{
+			"displayName": "developers",
+			"members": []interface{}{ map[string]interface{}{ "value": aliceId } },
+		},
+	})
+	if err != nil { testContext.Fatal(err) }
+	var groupId = response.Resource["id"].(string)
+	expectMembership(testContext, f, alice, "developers", true)
+	
+	// Deactivate alice, as some identity providers do, with a string value.
+	_, err = scimPatchUser(f.client, f.realm, &SCIMRequest{
+		Id: aliceId,
+		Body: map[string]interface{}{
+			"schemas": []interface{}{ SCIMPatchOpSchema },
+			"Operations": []interface{}{
+				map[string]interface{}{ "op": "Replace", "path": "active", "value": "False" },
+				map[string]interface{}{ "op": "replace", "path": `emails[type eq "work"].value`,
+					"value": "alice@wonderland.example" },
+			},
+		},
+	})
+	if err != nil { testContext.Fatal(err) }
+	alice, err = f.client.getUser(aliceId)
+	if err != nil { testContext.Fatal(err) }
+	if alice.isActive() || (alice.getEmailAddress() != "alice@wonderland.example") {
+		testContext.Error("Expected alice to be deactivated and her email address replaced")
+	}
+	
+	_, err = scimPatchGroup(f.client, f.realm, &SCIMRequest{
+		Id: groupId,
+		Body: map[string]interface{}{
+			"Operations": []interface{}{
+				map[string]interface{}{ "op": "remove", "path": `members[value eq "` + aliceId + `"]` },
+			},
+		},
+	})
+	if err != nil { testContext.Fatal(err) }
+	expectMembership(testContext, f, alice, "developers", false)
+	
+	response, err = scimDeleteGroup(f.client, f.realm, &SCIMRequest{ Id: groupId })
+	if err != nil { testContext.Fatal(err) }
+	var group Group
+	group, err = f.realm.getGroupByName(f.client, "developers")
+	if err != nil { testContext.Fatal(err) }
+	if (response.Status != http.StatusNoContent) || (group != nil) {
+		testContext.Error("Expected the group to be deleted")
+	}
+	
+	// A displayName need not be unique.
+	_, err = scimCreateUser(f.client, f.realm, &SCIMRequest{
+		Body: map[string]interface{}{ "userName": "alice2", "displayName": "Alice Liddell" },
+	})
+	if err != nil { testContext.Errorf("Expected a second user named Alice Liddell, but got %v", err) }
+	
+	// A deleted user is not found, and its userName may be given to a new user.
+	response, err = scimDeleteUser(f.client, f.realm, &SCIMRequest{ Id: aliceId })
+	if err != nil { testContext.Fatal(err) }
+	if response.Status != http.StatusNoContent { testContext.Errorf("Expected status 204, but got %d", response.Status) }
+	_, err = scimGetUser(f.client, f.realm, &SCIMRequest{ Id: aliceId })
+	scimErr, isType = err.(*SCIMError)
+	if (! isType) || (scimErr.Status != http.StatusNotFound) {
+		testContext.Errorf("Expected a deleted user to be not found, but got %v", err)
+	}
+	response, err = scimListUsers(f.client, f.realm, &SCIMRequest{
+		Query: url.Values{ "filter": { `userName eq "alice"` } },
+	})
+	if err != nil { testContext.Fatal(err) }
+	if response.Resource["totalResults"] != 0 {
+		testContext.Errorf("Expected a deleted user not to be listed, but got %v", response.Resource["totalResults"])
+	}
+	response, err = scimCreateUser(f.client, f.realm, &SCIMRequest{
+		Body: map[string]interface{}{ "userName": "alice" },
+	})
+	if err != nil { testContext.Fatal(err) }
+	if response.Resource["id"] == aliceId { testContext.Error("Expected a new user to be created for alice") }
+	
+	_, err = scimGetUser(f.client, f.realm, &SCIMRequest{ Id: f.realm.getId() })
+	scimErr, isType = err.(*SCIMError)
+	if (! isType) || (scimErr.Status != http.StatusNotFound) {
+		testContext.Errorf("Expected an object that is not a user of the realm to be not found, but got %v", err)
+	}
+}
@@ -0,0 +1,435 @@
+/*******************************************************************************
+ * Scheduled rescans. A scan records the vulnerabilities known when it was
+ * performed, so an image that was clean when it was scanned may not be clean a
+ * month later. A scan schedule rescans, on a cron schedule (see CronSchedule),
+ * the most recent version - or, if AllVersions is set, every retained version -
+ * of a DockerImage, or of each image in a repo, with each of the image's scan
+ * configs. Each rescan is recorded as a ScanEvent, as for scanImage, so the
+ * image's status (see getDockerImageStatus) reflects it, and the image's
+ * subscribers are notified if it is worse than the version's previous scan (see
+ * notifyScanOutcome). The scans are performed on behalf of the schedule's
+ * creator, and are skipped if the creator is no longer active or no longer has
+ * the permissions that scanImage requires. They count toward the realm's scan
+ * quota.
+ *
+ * A background worker checks the schedules of every realm every
+ * SCAN_SCHEDULE_POLL_INTERVAL seconds. The worker advances each schedule that is
+ * due to its next run time, in a transaction, and then claims the run with a
+ * database key that is unique to the schedule and the run time, so that when
+ * several servers share the database, only the server that claims a run performs
+ * it. The run's scans are queued, and performed by the workers that scan pushed
+ * images (see RegistryNotifications.go), so that a long scan does not delay the
+ * schedules that follow it; if too many scans are already waiting, a scan is
+ * skipped. A run is not retried if the server that claimed it fails during it; runs
+ * that are missed while no server is running are not made up, other than by the
+ * first run after the servers restart. A schedule whose image or repo has been
+ * deleted is deleted when it is next due.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	
+	"safeharbor/apitypes"
+	"utilities"
+)
+
+const (
+	DefaultScanSchedulePollInterval = 60  // seconds
+	ScanScheduleClaimKeyPrefix = "SafeHarbor/ScanScheduleRun/"
+	ScanScheduleClaimSeconds = 7 * 24 * 3600  // how long the claim on a run is retained
+)
+
+/*******************************************************************************
+ * When a schedule runs, as a cron expression: minute, hour, day of month, month,
+ * and day of week (0 or 7 is Sunday). Each field is *, a value, a range a-b, or
+ * a list of these, separated by commas; * and ranges may have a step, /n. As in
+ * cron, if both the day of month and the day of week are restricted, a day that
+ * matches either runs. @hourly, @daily, @weekly, and @monthly are also accepted.
+ */
+type CronSchedule struct {
+	minutes [60]bool
+	hours [24]bool
+	daysOfMonth [32]bool  // 1-31
+	months [13]bool  // 1-12
+	daysOfWeek [7]bool  // 0 is Sunday
+	anyDayOfMonth bool
+	anyDayOfWeek bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly": "0 * * * *",
+	"@daily": "0 0 * * *",
+	"@weekly": "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+func parseCronSchedule(expr string) (*CronSchedule, error) {
+	
+	var fields = strings.Fields(expr)
+	if (len(fields) == 1) && (cronMacros[fields[0]] != "") {
+		fields = strings.Fields(cronMacros[fields[0]])
+	}
+	if len(fields) != 5 { return nil, utilities.ConstructUserError(
+		"A schedule must have five fields - minute, hour, day of month, month, and day of week: " + expr) }
+	
+	var schedule = &CronSchedule{
+		anyDayOfMonth: strings.HasPrefix(fields[2], "*"),
+		anyDayOfWeek: strings.HasPrefix(fields[4], "*"),
+	}
+	var daysOfWeek [8]bool
+	var err error
+	for _, field := range []struct{ value string; set []bool; min int }{
+		{ fields[0], schedule.minutes[:], 0 },
+		{ fields[1], schedule.hours[:], 0 },
+		{ fields[2], schedule.daysOfMonth[1:], 1 },
+		{ fields[3], schedule.months[1:], 1 },
+		{ fields[4], daysOfWeek[:], 0 } } {
+		err = parseCronField(field.value, field.set, field.min)
+		if err != nil { return nil, utilities.ConstructUserError(
+			"Ill-formed schedule " + expr + ": " + err.Error()) }
+	}
+	for day := 0; day < 7; day++ { schedule.daysOfWeek[day] = daysOfWeek[day] }
+	if daysOfWeek[7] { schedule.daysOfWeek[0] = true }
+	return schedule, nil
+}
+
+/*******************************************************************************
+ * Set the elements of set that the field selects. The first element represents
+ * the value min.
+ */
+func parseCronField(field string, set []bool, min int) error {
+	
+	var max = min + len(set) - 1
+	for _, part := range strings.Split(field, ",") {
+		var rangePart = part
+		var step = 1
+		var slash = strings.Index(part, "/")
+		if slash >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[slash+1:])
+			if (err != nil) || (step < 1) { return fmt.Errorf("invalid step in %s", part) }
+			rangePart = part[:slash]
+		}
+		var low, high int
+		if rangePart == "*" {
+			low, high = min, max
+		} else {
+			var bounds = strings.Split(rangePart, "-")
+			var err1, err2 error
+			low, err1 = strconv.Atoi(bounds[0])
+			high = low
+			if len(bounds) == 2 {
+				high, err2 = strconv.Atoi(bounds[1])
+			} else if slash >= 0 {
+				high = max  // a/n means from a to the maximum, every n
+			}
+			if (len(bounds) > 2) || (err1 != nil) || (err2 != nil) || (low < min) || (high > max) ||
+				(low > high) {
+				return fmt.Errorf("%s is not within %d-%d", part, min, max)
+			}
+		}
+		for value := low; value <= high; value += step { set[value - min] = true }
+	}
+	return nil
+}
+
+func (schedule *CronSchedule) matchesDay(t time.Time) bool {
+	var domMatches = schedule.daysOfMonth[t.Day()]
+	var dowMatches = schedule.daysOfWeek[int(t.Weekday())]
+	if schedule.anyDayOfMonth { return dowMatches }
+	if schedule.anyDayOfWeek { return domMatches }
+	return domMatches || dowMatches
+}
+
+/*******************************************************************************
+ * Return the first time, after the specified time, at which the schedule runs,
+ * in the time's location. Return the zero time if the schedule never runs (for
+ * example, on February 30th) within the next five years.
+ */
+func (schedule *CronSchedule) next(after time.Time) time.Time {
+	
+	var location = after.Location()
+	var t = after.Truncate(time.Minute).Add(time.Minute)
+	var limit = after.AddDate(5, 0, 0)
+	var startOfDay = func(year int, month time.Month, day int) time.Time {
+		var start = time.Date(year, month, day, 0, 0, 0, 0, location)
+		if ! start.After(t) { return t.Add(time.Hour) }  // midnight fell in a daylight saving gap
+		return start
+	}
+	for t.Before(limit) {
+		if ! schedule.months[int(t.Month())] {
+			t = startOfDay(t.Year(), t.Month() + 1, 1)
+			continue
+		}
+		if ! schedule.matchesDay(t) {
+			t = startOfDay(t.Year(), t.Month(), t.Day() + 1)
+			continue
+		}
+		if ! schedule.hours[t.Hour()] {
+			// Count minutes rather than calling time.Date, which can return an
+			// earlier time within a daylight saving gap.
+			t = t.Add(time.Duration(60 - t.Minute()) * time.Minute)
+			continue
+		}
+		if ! schedule.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+/*******************************************************************************
+ * Parse the cron expression and time zone ("" for UTC) of a schedule, and return
+ * the first time after the specified time at which the schedule runs, or the
+ * zero time if it never runs.
+ */
+func getNextScanTime(schedule, timeZone string, after time.Time) (time.Time, error) {
+	
+	var cronSchedule *CronSchedule
+	var err error
+	cronSchedule, err = parseCronSchedule(schedule)
+	if err != nil { return time.Time{}, err }
+	var location *time.Location
+	location, err = time.LoadLocation(timeZone)
+	if (err != nil) || (strings.ToLower(timeZone) == "local") { return time.Time{},
+		utilities.ConstructUserError("Unrecognized time zone: " + timeZone) }
+	return cronSchedule.next(after.In(location)), nil
+}
+
+/*******************************************************************************
+ * One scan that a run of a schedule performs.
+ */
+type scheduledScan struct {
+	imageVersionId string
+	scanConfigId string
+}
+
+/*******************************************************************************
+ * A run of a schedule, which a worker has taken, to be performed once the worker
+ * has claimed it.
+ */
+type scheduledScanRun struct {
+	scheduleId string
+	runTime time.Time  // when the run was due
+	userObjId string  // on whose behalf the scans are performed
+	scans []scheduledScan
+}
+
+/*******************************************************************************
+ * Return the scans that a run of the schedule now performs: each selected version
+ * of each image that the schedule covers, with each of the image's scan configs
+ * that the schedule's creator may use. Return nil, rather than an empty list, if
+ * the schedule's image or repo no longer exists.
+ */
+func getScheduledScans(dbClient DBClient, schedule ScanSchedule) ([]scheduledScan, error) {
+	
+	var resource Resource
+	var err error
+	resource, err = dbClient.getResource(schedule.getResourceId())
+	if err != nil {
+		if utilities.IsUserErr(err) { return nil, nil }  // deleted
+		return nil, err
+	}
+	var scans = make([]scheduledScan, 0)
+	var user User
+	user, err = dbClient.getUser(schedule.getCreatorId())
+	if err != nil {
+		if utilities.IsUserErr(err) { return scans, nil }  // the creator was deleted
+		return nil, err
+	}
+	if ! user.isActive() { return scans, nil }
+	
+	// Determine whether the creator has the permissions that scanImage requires.
+	var isPermitted = func(resource Resource, mask []bool) (bool, error) {
+		if ! dbClient.getServer().Authorize { return true, nil }
+		var lineage []Resource
+		var err error
+		lineage, err = getResourceLineage(dbClient, resource)
+		if err != nil { return false, err }
+		return userHasPermissions(dbClient, user, lineage, mask)
+	}
+	var configIsPermitted = make(map[string]bool)
+	
+	var imageIds []string
+	if resource.isRepo() {
+		imageIds = resource.(Repo).getDockerImageIds()
+	} else {
+		imageIds = []string{ resource.getId() }
+	}
+	for _, imageId := range imageIds {
+		var dockerImage DockerImage
+		dockerImage, err = dbClient.getDockerImage(imageId)
+		if err != nil { continue }  // dangling Id
+		var versionIds = dockerImage.getImageVersionIds()
+		if len(versionIds) == 0 { continue }
+		if ! schedule.scansAllVersions() { versionIds = versionIds[len(versionIds)-1:] }
+		var permitted bool
+		permitted, err = isPermitted(dockerImage, apitypes.ReadMask)
+		if err != nil { return nil, err }
+		if ! permitted { continue }
+		for _, scanConfigId := range dockerImage.getScanConfigsToUse() {
+			var configPermitted, isKnown = configIsPermitted[scanConfigId]
+			if ! isKnown {
+				var scanConfig ScanConfig
+				scanConfig, err = dbClient.getScanConfig(scanConfigId)
+				if err == nil {
+					configPermitted, err = isPermitted(scanConfig, apitypes.ExecuteMask)
+					if err != nil { return nil, err }
+				}  // else, the scan config was deleted
+				configIsPermitted[scanConfigId] = configPermitted
+			}
+			if ! configPermitted { continue }
+			for _, versionId := range versionIds {
+				scans = append(scans, scheduledScan{ imageVersionId: versionId, scanConfigId: scanConfigId })
+			}
+		}
+	}
+	return scans, nil
+}
+
+/*******************************************************************************
+ * Take each of the realm's schedules that is due as of now: determine the scans
+ * that its run performs, and advance it to its next run after now. Delete those
+ * whose image or repo no longer exists. Return the runs taken, and whether any
+ * schedule was changed.
+ */
+func takeDueScanSchedules(dbClient DBClient, realmId string, now time.Time) (
+	[]*scheduledScanRun, bool, error) {
+	
+	var realm Realm
+	var err error
+	realm, err = dbClient.getRealm(realmId)
+	if err != nil { return nil, false, err }
+	var runs = make([]*scheduledScanRun, 0)
+	var changed = false
+	for _, scheduleId := range realm.getScanScheduleIds() {
+		var schedule ScanSchedule
+		schedule, err = dbClient.getScanSchedule(scheduleId)
+		if err != nil { continue }  // dangling Id
+		if ! schedule.isDue(now) { continue }
+		changed = true
+		
+		var scans []scheduledScan
+		scans, err = getScheduledScans(dbClient, schedule)
+		if err != nil { return nil, false, err }
+		if scans == nil {
+			err = dbClient.dbDeleteScanSchedule(schedule)
+			if err != nil { return nil, false, err }
+			continue
+		}
+		
+		var nextRunTime time.Time
+		nextRunTime, err = getNextScanTime(schedule.getSchedule(), schedule.getTimeZone(), now)
+		if err != nil {
+			// For example, the time zone is no longer known: stop running.
+			fmt.Println("Stopping scan schedule " + scheduleId + ": " + err.Error())
+			nextRunTime = time.Time{}
+		}
+		var run = &scheduledScanRun{
+			scheduleId: scheduleId,
+			runTime: schedule.getNextRunTime(),
+			userObjId: schedule.getCreatorId(),
+			scans: scans,
+		}
+		err = schedule.recordRun(dbClient, nextRunTime)
+		if err != nil { return nil, false, err }
+		runs = append(runs, run)
+	}
+	return runs, changed, nil
+}
+
+/*******************************************************************************
+ * Queue the scheduled scans that are due, every ScanSchedulePollInterval
+ * seconds, until the process exits.
+ */
+func (server *Server) runScanSchedulesPeriodically() {
+	
+	var interval = server.Config.ScanSchedulePollInterval
+	if interval <= 0 { interval = DefaultScanSchedulePollInterval }
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		var count, err = server.runDueScanSchedules()
+		if err != nil { fmt.Println("While running scan schedules: " + err.Error()) }
+		if count > 0 { fmt.Println(fmt.Sprintf("Queued %d scheduled scans", count)) }
+	}
+}
+
+/*******************************************************************************
+ * Run each schedule, of any realm, that is due, and return the number of scans
+ * queued. A realm whose schedules cannot be run is logged and skipped.
+ */
+func (server *Server) runDueScanSchedules() (int, error) {
+	
+	var dbClient *InMemClient
+	var err error
+	dbClient, err = NewInMemClient(server)
+	if err != nil { return 0, err }
+	var realmIds []string
+	realmIds, err = dbClient.dbGetAllRealmIds()
+	dbClient.abort()
+	if err != nil { return 0, err }
+	
+	var total = 0
+	for _, realmId := range realmIds {
+		var count int
+		count, err = server.runDueScanSchedulesForRealm(realmId, time.Now())
+		if err != nil {
+			fmt.Println("While running scan schedules of realm " + realmId + ": " + err.Error())
+			continue
+		}
+		total = total + count
+	}
+	return total, nil
+}
+
+/*******************************************************************************
+ * Take the realm's schedules that are due as of now, in a transaction of their
+ * own, and then queue the scans of each run that this server claims. Return the
+ * number of scans queued. Each scan is performed, and recorded, by a scan worker
+ * (see scanPushedImages); a scan that fails is reported there.
+ * The transaction advances each schedule's next run, so that later polls - by
+ * any server - do not take the run again; since it watches the schedules that
+ * it reads, two servers that poll at the same moment cannot both commit the
+ * same run. The claim, a single SET NX on a key that names the schedule and the
+ * run time, is kept as a second guard, since the scans cannot be undone once
+ * they are performed.
+ */
+func (server *Server) runDueScanSchedulesForRealm(realmId string, now time.Time) (int, error) {
+	
+	var runs []*scheduledScanRun
+	var changed bool
+	var err = server.performInTransaction("scan schedules", func(dbClient *InMemClient) (bool, error) {
+		var err error
+		runs, changed, err = takeDueScanSchedules(dbClient, realmId, now)
+		return changed, err
+	})
+	if (err != nil) || ! changed { return 0, err }
+	
+	var count = 0
+	for _, run := range runs {
+		var claimed bool
+		claimed, err = server.persistence.claimKey(ScanScheduleClaimKeyPrefix + run.scheduleId +
+			"/" + strconv.FormatInt(run.runTime.Unix(), 10), ScanScheduleClaimSeconds)
+		if err != nil { return count, err }
+		if ! claimed { continue }  // another server is performing the run
+		for _, scan := range run.scans {
+			var queued = server.queueScan(&pushedImageScan{
+				imageVersionId: scan.imageVersionId,
+				scanConfigId: scan.scanConfigId,
+				userObjId: run.userObjId,
+				imageName: "image version " + scan.imageVersionId,
+			})
+			if queued { count++ }
+		}
+	}
+	return count, nil
+}
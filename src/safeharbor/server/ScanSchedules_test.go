@@ -0,0 +1,113 @@
+package server
+
+
+import (
+	"testing"
+	"time"
+	
+	"scanners"
+)
+
+func Test_CronScheduleNextRun(testContext *testing.T) {
+	
+	var after = time.Date(2016, time.March, 6, 10, 7, 30, 0, time.UTC)  // a Sunday
+	var expectedNext = map[string]time.Time{
+		"*/15 * * * *": time.Date(2016, time.March, 6, 10, 15, 0, 0, time.UTC),
+		"0 3 * * 1-5": time.Date(2016, time.March, 7, 3, 0, 0, 0, time.UTC),
+		"@monthly": time.Date(2016, time.April, 1, 0, 0, 0, 0, time.UTC),
+		"30 2 13 * 5": time.Date(2016, time.March, 11, 2, 30, 0, 0, time.UTC),  // the 13th, or a Friday
+		"0 0 29 2 *": time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC),
+		"7 10 6 3 *": time.Date(2017, time.March, 6, 10, 7, 0, 0, time.UTC),
+		"0 0 30 2 *": time.Time{},  // never
+	}
+	for expr, expected := range expectedNext {
+		var schedule, err = parseCronSchedule(expr)
+		if err != nil { testContext.Fatal(err) }
+		if next := schedule.next(after); ! next.Equal(expected) {
+			testContext.Errorf("Expected %s to run next at %s, but got %s", expr, expected, next)
+		}
+	}
+	for _, expr := range []string{ "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-3 * * * *" } {
+		if _, err := parseCronSchedule(expr); err == nil {
+			testContext.Errorf("Expected %s to be rejected", expr)
+		}
+	}
+	
+	// 02:30 does not occur on the day that daylight saving time begins.
+	var next, err = getNextScanTime("30 2 * * *", "America/New_York",
+		time.Date(2016, time.March, 13, 5, 0, 0, 0, time.UTC))
+	if err != nil { testContext.Fatal(err) }
+	if ! next.Equal(time.Date(2016, time.March, 14, 6, 30, 0, 0, time.UTC)) {
+		testContext.Errorf("Expected the schedule to skip the missing hour, but got %s", next)
+	}
+}
+
+func Test_DueScanSchedulesAreTakenOnce(testContext *testing.T) {
+	
+	var f = newTestDB(testContext)
+	var image, err = f.client.dbCreateDockerImage(f.repo.getId(), "imagea", "")
+	if err != nil { testContext.Fatal(err) }
+	var versions = make([]DockerImageVersion, 2)
+	for i, tag := range []string{ "v1", "v2" } {
+		versions[i], err = f.client.dbCreateDockerImageVersion(tag, image.getId(), time.Now(), "",
+			[]byte("digest-" + tag), nil)
+		if err != nil { testContext.Fatal(err) }
+	}
+	var scanConfig ScanConfig
+	scanConfig, err = f.client.dbCreateScanConfig("configa", "", f.repo.getId(), "clair", nil, "", "")
+	if err != nil { testContext.Fatal(err) }
+	image.addScanConfigIdToList(scanConfig.getId())
+	err = image.writeBack(f.client)
+	if err != nil { testContext.Fatal(err) }
+	
+	var now = time.Date(2016, time.March, 6, 12, 0, 0, 0, time.UTC)
+	var latest, all ScanSchedule
+	latest, err = f.client.dbCreateScanSchedule(f.realm.getId(), image.getId(), "@daily", "",
+		false, f.user.getId(), now.Add(-time.Minute))
+	if err != nil { testContext.Fatal(err) }
+	all, err = f.client.dbCreateScanSchedule(f.realm.getId(), f.repo.getId(), "@daily", "",
+		true, f.user.getId(), now.Add(time.Hour))
+	if err != nil { testContext.Fatal(err) }
+	var gone ScanSchedule
+	gone, err = f.client.dbCreateScanSchedule(f.realm.getId(), "nosuchimage", "@daily", "",
+		false, f.user.getId(), now.Add(-time.Minute))
+	if err != nil { testContext.Fatal(err) }
+	
+	var runs []*scheduledScanRun
+	runs, _, err = takeDueScanSchedules(f.client, f.realm.getId(), now)
+	if err != nil { testContext.Fatal(err) }
+	if (len(runs) != 1) || (runs[0].scheduleId != latest.getId()) || (len(runs[0].scans) != 1) ||
+		(runs[0].scans[0].imageVersionId != versions[1].getId()) {
+		testContext.Fatal("Expected one run, which scans the most recent version")
+	}
+	if (! latest.getNextRunTime().After(now)) || latest.getLastRunTime().IsZero() {
+		testContext.Error("Expected the schedule to be advanced past its run")
+	}
+	if _, err = f.client.getScanSchedule(gone.getId()); err == nil {
+		testContext.Error("Expected the schedule of a missing image to be deleted")
+	}
+	runs, _, err = takeDueScanSchedules(f.client, f.realm.getId(), now)
+	if err != nil { testContext.Fatal(err) }
+	if len(runs) != 0 { testContext.Error("Expected a run to be taken only once") }
+	
+	runs, _, err = takeDueScanSchedules(f.client, f.realm.getId(), now.Add(2 * time.Hour))
+	if err != nil { testContext.Fatal(err) }
+	if (len(runs) != 1) || (runs[0].scheduleId != all.getId()) || (len(runs[0].scans) != 2) {
+		testContext.Error("Expected one run, which scans each version of each image in the repo")
+	}
+	
+	// A rescan is compared with the version's own previous scan.
+	var v2Scan ScanEvent
+	v2Scan, err = f.client.dbCreateScanEvent(scanConfig.getId(), "clair", nil, nil,
+		versions[1].getId(), f.user.getId(), "3", &scanners.ScanResult{})
+	if err != nil { testContext.Fatal(err) }
+	_, err = f.client.dbCreateScanEvent(scanConfig.getId(), "clair", nil, nil,
+		versions[0].getId(), f.user.getId(), "0", &scanners.ScanResult{})
+	if err != nil { testContext.Fatal(err) }
+	var previous ScanEvent
+	previous, err = getPreviousScanEvent(f.client, image, versions[1], scanConfig.getId())
+	if err != nil { testContext.Fatal(err) }
+	if (previous == nil) || (previous.getId() != v2Scan.getId()) {
+		testContext.Error("Expected the previous scan of the same version")
+	}
+}
@@ -0,0 +1,253 @@
+/*******************************************************************************
+ * Second factor authentication, by means of time-based one-time passwords
+ * (TOTP, RFC 6238), as generated by authenticator apps.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	
+	"utilities"
+)
+
+const (
+	TOTPIssuer = "SafeHarbor"
+	TOTPPeriod = 30  // seconds
+	TOTPDigits = 6
+	TOTPAllowedSkew = 1  // periods before or after the current one for which a code is accepted
+	TOTPSecretSize = 20  // bytes
+	
+	NumberOfRecoveryCodes = 10
+	MaxSecondFactorAttempts = 5  // per challenge
+	LoginChallengeLifespan = 5 * time.Minute
+)
+
+/*******************************************************************************
+ * The state of a login for which the password has been verified but the second
+ * factor has not. For a user who has enrolled, or whose realm requires a second
+ * factor, authenticate returns a SecondFactorChallenge, rather than a
+ * SessionToken, and verifySecondFactor then verifies a code, or a recovery
+ * code, for the challenge and creates the session. If the realm requires a
+ * second factor but the user has not enrolled, the challenge permits the user
+ * to enroll (EnrollmentRequired), after which verifySecondFactor creates the
+ * session without a further code. Since requests are handled concurrently, a
+ * challenge is only accessed by means of the AuthService methods below, which
+ * hold the AuthService's challengeLock. Challenges, like sessions, are kept in
+ * the memory of the server that created them, and are not shared through redis:
+ * where several servers share a database, the load balancer must route each
+ * client to the same server (sticky sessions), or verifySecondFactor will not
+ * find the challenge.
+ */
+type LoginChallenge struct {
+	Id string
+	UserId string
+	Expires time.Time
+	EnrollmentRequired bool  // the user must enroll before logging in
+	Failures int  // codes rejected for this challenge
+	SecondFactorVerified bool  // true once the user has completed enrollment
+}
+
+/*******************************************************************************
+ * Create a challenge for the second step of a login by the specified user, and
+ * return its Id. Challenges that have expired are discarded.
+ */
+func (authSvc *AuthService) createLoginChallenge(userId string, enrollmentRequired bool) string {
+	
+	var challengeId = authSvc.createUniqueSessionId()
+	var now = time.Now()
+	authSvc.challengeLock.Lock()
+	defer authSvc.challengeLock.Unlock()
+	for id, challenge := range authSvc.LoginChallenges {
+		if now.After(challenge.Expires) { delete(authSvc.LoginChallenges, id) }
+	}
+	authSvc.LoginChallenges[challengeId] = &LoginChallenge{
+		Id: challengeId,
+		UserId: userId,
+		Expires: now.Add(LoginChallengeLifespan),
+		EnrollmentRequired: enrollmentRequired,
+	}
+	return challengeId
+}
+
+/*******************************************************************************
+ * Return a copy of the specified challenge, or nil if it does not exist or has
+ * expired. Changes to the copy have no effect on the challenge.
+ */
+func (authSvc *AuthService) getLoginChallenge(challengeId string) *LoginChallenge {
+	
+	if ! authSvc.validateSessionId(challengeId) { return nil }
+	authSvc.challengeLock.Lock()
+	defer authSvc.challengeLock.Unlock()
+	var challenge = authSvc.LoginChallenges[challengeId]
+	if challenge == nil { return nil }
+	if time.Now().After(challenge.Expires) {
+		delete(authSvc.LoginChallenges, challengeId)
+		return nil
+	}
+	var snapshot = *challenge
+	return &snapshot
+}
+
+/*******************************************************************************
+ * Count a rejected code for the challenge. If MaxSecondFactorAttempts codes have
+ * been rejected, the challenge is removed.
+ */
+func (authSvc *AuthService) recordLoginChallengeFailure(challengeId string) {
+	
+	authSvc.challengeLock.Lock()
+	defer authSvc.challengeLock.Unlock()
+	var challenge = authSvc.LoginChallenges[challengeId]
+	if challenge == nil { return }
+	challenge.Failures++
+	if challenge.Failures >= MaxSecondFactorAttempts {
+		delete(authSvc.LoginChallenges, challengeId)
+	}
+}
+
+/*******************************************************************************
+ * Record that the challenge's user has completed enrollment.
+ */
+func (authSvc *AuthService) setLoginChallengeVerified(challengeId string) {
+	
+	authSvc.challengeLock.Lock()
+	defer authSvc.challengeLock.Unlock()
+	var challenge = authSvc.LoginChallenges[challengeId]
+	if challenge != nil { challenge.SecondFactorVerified = true }
+}
+
+/*******************************************************************************
+ * Remove the challenge. Return true if it existed: since a challenge may be
+ * used for only one login, only a caller that removes it may complete it.
+ */
+func (authSvc *AuthService) removeLoginChallenge(challengeId string) bool {
+	
+	authSvc.challengeLock.Lock()
+	defer authSvc.challengeLock.Unlock()
+	var _, exists = authSvc.LoginChallenges[challengeId]
+	delete(authSvc.LoginChallenges, challengeId)
+	return exists
+}
+
+/*******************************************************************************
+ * Return a new random TOTP secret, in base 32, as authenticator apps expect.
+ */
+func generateTOTPSecret() (string, error) {
+	
+	var secret = make([]byte, TOTPSecretSize)
+	var _, err = rand.Read(secret)
+	if err != nil { return "", err }
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+/*******************************************************************************
+ * Return the URI with which an authenticator app is provisioned with the
+ * secret. It is also the payload of the QR code that the user may scan.
+ */
+func getTOTPProvisioningURI(userId, secret string) string {
+	
+	var params = url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", TOTPIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", TOTPDigits))
+	params.Set("period", fmt.Sprintf("%d", TOTPPeriod))
+	var label = url.PathEscape(TOTPIssuer + ":" + userId)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+/*******************************************************************************
+ * Return the TOTP code for the specified secret and time step (RFC 4226).
+ */
+func computeTOTPCode(secret string, step int64) (string, error) {
+	
+	var key []byte
+	var err error
+	key, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(
+		strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil { return "", utilities.ConstructServerError("Malformed TOTP secret") }
+	
+	var counter = make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	var mac = hmac.New(sha1.New, key)
+	mac.Write(counter)
+	var sum = mac.Sum(nil)
+	var offset = sum[len(sum)-1] & 0x0f
+	var value = binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	var modulus uint32 = 1
+	for i := 0; i < TOTPDigits; i++ { modulus = modulus * 10 }
+	return fmt.Sprintf("%0*d", TOTPDigits, value % modulus), nil
+}
+
+/*******************************************************************************
+ * If the code is valid for the secret at the specified time, allowing for
+ * TOTPAllowedSkew, and its time step is later than lastStep, return its time
+ * step and true. Requiring a later step prevents a code from being used twice.
+ */
+func checkTOTPCode(secret, code string, now time.Time, lastStep int64) (int64, bool, error) {
+	
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != TOTPDigits { return 0, false, nil }
+	var current = now.Unix() / TOTPPeriod
+	for step := current - TOTPAllowedSkew; step <= current + TOTPAllowedSkew; step++ {
+		if step <= lastStep { continue }
+		var expected, err = computeTOTPCode(secret, step)
+		if err != nil { return 0, false, err }
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 { return step, true, nil }
+	}
+	return 0, false, nil
+}
+
+/*******************************************************************************
+ * Return NumberOfRecoveryCodes new random recovery codes, each of the form
+ * xxxxx-xxxxx. A user is given them on enabling the second factor (see
+ * confirmTOTPEnrollment), and each may be used once in place of a code.
+ */
+func generateRecoveryCodes() ([]string, error) {
+	
+	var codes = make([]string, 0)
+	for i := 0; i < NumberOfRecoveryCodes; i++ {
+		var bytes = make([]byte, 7)
+		var _, err = rand.Read(bytes)
+		if err != nil { return nil, err }
+		var code = strings.ToLower(base32.StdEncoding.EncodeToString(bytes))[0:10]
+		codes = append(codes, code[0:5] + "-" + code[5:10])
+	}
+	return codes, nil
+}
+
+/*******************************************************************************
+ * Return new recovery codes, to be shown to the user, and their hashes, to be
+ * stored for the user.
+ */
+func createRecoveryCodes(authSvc *AuthService) ([]string, []string, error) {
+	
+	var codes, err = generateRecoveryCodes()
+	if err != nil { return nil, nil, err }
+	var hashes = make([]string, 0)
+	for _, code := range codes { hashes = append(hashes, authSvc.hashRecoveryCode(code)) }
+	return codes, hashes, nil
+}
+
+/*******************************************************************************
+ * Return the hash of the recovery code that is stored for the user. Case,
+ * spaces, and hyphens are ignored.
+ */
+func (authSvc *AuthService) hashRecoveryCode(code string) string {
+	
+	var normalized = strings.ToLower(code)
+	normalized = strings.Replace(normalized, "-", "", -1)
+	normalized = strings.Replace(normalized, " ", "", -1)
+	return fmt.Sprintf("%x", authSvc.computeHash(normalized).Sum([]byte{}))
+}
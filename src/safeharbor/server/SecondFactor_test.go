@@ -0,0 +1,85 @@
+package server
+
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_LoginChallengesAreCompletedOnceAndSwept(testContext *testing.T) {
+	
+	var authSvc = NewAuthService("SafeHarbor", "", 0, nil, "test salt")
+	var challengeId = authSvc.createLoginChallenge("jdoe", false)
+	
+	// Concurrent rejected codes are all counted, and then remove the challenge.
+	var wg sync.WaitGroup
+	for i := 0; i < MaxSecondFactorAttempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			authSvc.recordLoginChallengeFailure(challengeId)
+		}()
+	}
+	wg.Wait()
+	if authSvc.getLoginChallenge(challengeId) != nil {
+		testContext.Error("Expected the challenge to be removed after too many rejected codes")
+	}
+	
+	// A challenge may be completed only once.
+	challengeId = authSvc.createLoginChallenge("jdoe", false)
+	if ! authSvc.removeLoginChallenge(challengeId) { testContext.Error("Expected the challenge to exist") }
+	if authSvc.removeLoginChallenge(challengeId) { testContext.Error("Expected the challenge to be used once") }
+	
+	// Expired challenges are discarded when another is created.
+	challengeId = authSvc.createLoginChallenge("jdoe", false)
+	authSvc.LoginChallenges[challengeId].Expires = time.Now().Add(-time.Second)
+	authSvc.createLoginChallenge("jdoe", false)
+	if _, exists := authSvc.LoginChallenges[challengeId]; exists {
+		testContext.Error("Expected the expired challenge to be swept")
+	}
+	if len(authSvc.LoginChallenges) != 1 {
+		testContext.Errorf("Expected 1 challenge, but there are %d", len(authSvc.LoginChallenges))
+	}
+}
+
+func Test_TOTPCodesMatchRFC6238AndAreAcceptedOnce(testContext *testing.T) {
+	
+	// The SHA-1 test vectors of RFC 6238, truncated to six digits.
+	var secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"  // "12345678901234567890"
+	for unixTime, expected := range map[int64]string{
+		59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037" } {
+		var code, err = computeTOTPCode(secret, unixTime / TOTPPeriod)
+		if err != nil { testContext.Fatal(err) }
+		if code != expected { testContext.Errorf("At %d, expected %s but got %s", unixTime, expected, code) }
+	}
+	
+	var f = newTestDB(testContext)
+	var err = f.user.beginTOTPEnrollment(f.client, secret)
+	if err != nil { testContext.Fatal(err) }
+	var codes, hashes []string
+	codes, hashes, err = createRecoveryCodes(f.server.authService)
+	if err != nil { testContext.Fatal(err) }
+	err = f.user.enableTOTP(f.client, hashes)
+	if err != nil { testContext.Fatal(err) }
+	
+	var now = time.Unix(1234567890, 0)
+	var valid bool
+	valid, err = f.user.verifyTOTPCode(f.client, "005924", now)
+	if err != nil { testContext.Fatal(err) }
+	if ! valid { testContext.Error("Expected the current code to be accepted") }
+	valid, err = f.user.verifyTOTPCode(f.client, "005924", now)
+	if err != nil { testContext.Fatal(err) }
+	if valid { testContext.Error("Expected a code to be accepted only once") }
+	
+	valid, err = f.user.useRecoveryCode(f.client, strings.ToUpper(codes[0]))
+	if err != nil { testContext.Fatal(err) }
+	if ! valid { testContext.Error("Expected a recovery code to be accepted") }
+	valid, err = f.user.useRecoveryCode(f.client, codes[0])
+	if err != nil { testContext.Fatal(err) }
+	if valid { testContext.Error("Expected a recovery code to be accepted only once") }
+	if f.user.getRecoveryCodeCount() != NumberOfRecoveryCodes - 1 {
+		testContext.Error("Expected the used recovery code to be removed")
+	}
+}
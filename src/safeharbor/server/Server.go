@@ -46,8 +46,12 @@ type Server struct {
 	authService *AuthService
 	DockerServices *docker.DockerServices
 	ScanServices []scanners.ScanService
-	EmailService *utilities.EmailService
+	EmailDriver EmailDriver  // nil if email is not configured; see EmailOutbox.go
 	dispatcher *Dispatcher
+	rateLimiter *RateLimiter  // nil if requests are not rate limited
+	passwordPolicy *PasswordPolicy
+	ldapClient *LDAPClient  // nil if users are not authenticated against an LDAP directory
+	pushedImageScans chan *pushedImageScan  // scans waiting for a worker; see RegistryNotifications.go
 	sessions map[string]*apitypes.Credentials  // map session key to Credentials.
 	Authorize bool
 	AllowToggleEmailVerification bool
@@ -146,6 +150,13 @@ func NewServer(debug bool, nocache bool, stubScanners bool, useStubScannerFor ma
 	}
 	_, err = NewPersistence(server, redisClient)
 	if err != nil { AbortStartup(err.Error()) }
+	if config.RateLimits != nil {
+		server.rateLimiter = NewRateLimiter(config.RateLimits, redisClient)
+	}
+	server.passwordPolicy, err = NewPasswordPolicy(config)
+	if err != nil { AbortStartup("When loading the password policy: " + err.Error()) }
+	if config.LDAP != nil { server.ldapClient = NewLDAPClient(config.LDAP) }
+	server.pushedImageScans = make(chan *pushedImageScan, PushedImageScanQueueSize)
 	
 	var engine docker.DockerEngine
 	engine, err = docker.OpenDockerEngineConnection()
@@ -250,10 +261,21 @@ func NewServer(debug bool, nocache bool, stubScanners bool, useStubScannerFor ma
 			AbortStartup("Email service is not configured")
 		}
 	} else {
-		var emailService *utilities.EmailService
-		emailService, err = utilities.CreateEmailService(config.EmailService)
-		if err != nil { AbortStartup("When instantiating email service: " + err.Error()) }
-		server.EmailService = emailService
+		var driverName, _ = config.EmailService["Driver"].(string)
+		delete(config.EmailService, "Driver")
+		if driverName == "maildir" {
+			var directory, _ = config.EmailService["Directory"].(string)
+			var from, _ = config.EmailService["From"].(string)
+			server.EmailDriver, err = NewMaildirEmailDriver(directory, from)
+			if err != nil { AbortStartup("When instantiating maildir email driver: " + err.Error()) }
+		} else if (driverName == "") || (driverName == "smtp") {
+			var emailService *utilities.EmailService
+			emailService, err = utilities.CreateEmailService(config.EmailService)
+			if err != nil { AbortStartup("When instantiating email service: " + err.Error()) }
+			server.EmailDriver = emailService
+		} else {
+			AbortStartup("Unrecognized email driver: " + driverName)
+		}
 	}
 	
 	return server, nil
@@ -284,6 +306,15 @@ func (server *Server) Start() {
 	// Each service goroutine reads requests and then calls httpServer.Handler
 	// to reply to them. See https://golang.org/pkg/net/http/#Server.Serve
 	defer server.tcpListener.Close()
+	go server.sweepExpiredACLEntriesPeriodically()
+	if server.ldapClient != nil { go server.syncLDAPGroupsPeriodically() }
+	if server.EmailDriver != nil { go server.deliverQueuedEmailPeriodically() }
+	go server.sendNotificationDigestsPeriodically()
+	go server.deliverWebhooksPeriodically()
+	go server.runScanSchedulesPeriodically()
+	for i := 0; i < PushedImageScanWorkers; i++ {
+		go server.scanPushedImages()
+	}
 	fmt.Println("...Starting service...")
 	if err := server.httpServer.Serve(server.tcpListener); err != nil { AbortStartup(err.Error()) }
 }
@@ -325,11 +356,22 @@ func (server *Server) ResumeAcceptingNewRequests() {
 }
 
 /*******************************************************************************
- * Warn the administrator that a user has attempted to log in more than
- * MaxLoginAttemptsToRetain times.
+ * Return a user error if the password does not satisfy the password policy.
  */
-func (server *Server) LoginAlert(userId string) {
-	fmt.Println("*****Possible brute for attack for user Id " + userId)
+func (server *Server) checkPasswordPolicy(userId, pswd string) error {
+	if server.passwordPolicy == nil { return nil }
+	return server.passwordPolicy.check(userId, pswd)
+}
+
+/*******************************************************************************
+ * Warn the user, and the administrator of the user's realm, that the user's
+ * account has been locked after repeated failed logins (see Lockout.go).
+ */
+func (server *Server) LoginAlert(user User) {
+	fmt.Println("*****Possible brute force attack for user Id " + user.getUserId() +
+		"; locked until " + user.getLockedUntil().String())
+	if server.EmailDriver == nil { return }
+	server.sendLockoutNotifications(user)
 }
 
 /*******************************************************************************
@@ -458,6 +500,23 @@ func (server *Server) dispatch(sessionToken *apitypes.SessionToken,
 	
 	fmt.Println("URL=" + httpReq.URL.String())  // debug
 	fmt.Println("RequestURI=" + httpReq.RequestURI) // debug
+	
+	// Reject the request if the client has exceeded its rate limit. This is done
+	// before the body - which may be a large multipart upload - is read.
+	var isSCIM = (reqName == SCIMPathPrefix) || strings.HasPrefix(reqName, SCIMPathPrefix + "/")
+	if server.rejectIfClientRateLimited(sessionToken, writer, httpReq, reqName, isSCIM) { return }
+	
+	// SCIM requests are REST requests for resources, rather than methods.
+	if isSCIM {
+		server.dispatchSCIM(writer, httpReq, strings.TrimPrefix(reqName, SCIMPathPrefix))
+		return
+	}
+
+	// The registry posts its notifications as JSON envelopes, rather than as forms.
+	if reqName == RegistryNotificationPath {
+		server.dispatchRegistryNotification(writer, httpReq)
+		return
+	}
 
 	if httpMethod == "GET" {
 		
@@ -528,6 +587,10 @@ func (server *Server) dispatch(sessionToken *apitypes.SessionToken,
 		return
 	}
 
+	// Reject the request if it has exceeded the rate limit of the user that it
+	// logs in as, which is named by its values.
+	if server.rejectIfTargetRateLimited(sessionToken, writer, httpReq, reqName, values) { return }
+	
 	// Enable client to "log" an annotation in the server's stdout, to make it
 	// easier to find portions of server output that pertain to a given test.
 	if server.Debug && (values != nil) {
@@ -544,6 +607,58 @@ func (server *Server) dispatch(sessionToken *apitypes.SessionToken,
 	server.dispatcher.handleRequest(sessionToken, headers, writer, reqName, values, files)
 }
 
+/*******************************************************************************
+ * If the client - the authenticated user, the session, or the client IP address -
+ * has exceeded its rate limit for the request, respond with StatusTooManyRequests,
+ * and return true. Only the query parameters of the request are used, so that
+ * its body need not be read.
+ */
+func (server *Server) rejectIfClientRateLimited(sessionToken *apitypes.SessionToken,
+	writer http.ResponseWriter, httpReq *http.Request, reqName string, isSCIM bool) bool {
+	
+	if server.rateLimiter == nil { return false }
+	var limitedName = reqName
+	if isSCIM { limitedName = "scim" }
+	var retryAfter = server.rateLimiter.checkClient(server.authService, limitedName,
+		sessionToken, httpReq.URL.Query(), server.rateLimiter.getClientIP(httpReq))
+	return server.respondIfRateLimited(writer, reqName, isSCIM, retryAfter)
+}
+
+/*******************************************************************************
+ * If the user that the request logs in as, or resets the password of, has
+ * exceeded its rate limit, respond with StatusTooManyRequests, and return true.
+ * A session that is identified only by a SessionId value in the body of the
+ * request was not known to rejectIfClientRateLimited, and so the user and
+ * session limits are applied to it here.
+ */
+func (server *Server) rejectIfTargetRateLimited(sessionToken *apitypes.SessionToken,
+	writer http.ResponseWriter, httpReq *http.Request, reqName string, values url.Values) bool {
+	
+	if server.rateLimiter == nil { return false }
+	var retryAfter time.Duration
+	if (sessionToken == nil) && (httpReq.URL.Query().Get("SessionId") == "") {
+		retryAfter = server.rateLimiter.checkClient(server.authService, reqName, nil, values, "")
+		if server.respondIfRateLimited(writer, reqName, false, retryAfter) { return true }
+	}
+	retryAfter = server.rateLimiter.checkTargetUser(server.authService, reqName, values)
+	return server.respondIfRateLimited(writer, reqName, false, retryAfter)
+}
+
+/*******************************************************************************
+ * If retryAfter is non-zero, respond with StatusTooManyRequests, and return true.
+ */
+func (server *Server) respondIfRateLimited(writer http.ResponseWriter, reqName string,
+	isSCIM bool, retryAfter time.Duration) bool {
+	
+	if retryAfter == 0 { return false }
+	if isSCIM {
+		writeSCIMTooManyRequests(writer, retryAfter)
+	} else {
+		server.dispatcher.respondTooManyRequests(writer, reqName, retryAfter)
+	}
+	return true
+}
+
 /*******************************************************************************
  * Return the URL of this server.
  */
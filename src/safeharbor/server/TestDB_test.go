@@ -0,0 +1,92 @@
+package server
+
+
+import (
+	"testing"
+	
+	"safeharbor/apitypes"
+)
+
+/*******************************************************************************
+ * A test database and the resources that newTestDB creates in it.
+ */
+type testDB struct {
+	server *Server
+	client *InMemClient
+	user User
+	realm Realm
+	repo Repo
+	otherRepo Repo
+	dockerfile Dockerfile
+	flag Flag
+	otherDockerfile Dockerfile
+}
+
+/*******************************************************************************
+ * Create an in-memory database, so that tests do not need redis, containing a
+ * realm with two repos: the first contains a Dockerfile and a flag, and the
+ * second contains a Dockerfile. The user belongs to the realm but has no ACL
+ * entries.
+ */
+func newTestDB(testContext *testing.T) *testDB {
+	
+	var server = &Server{
+		Config: &Configuration{ FileRepoRootPath: testContext.TempDir() },
+		InMemoryOnly: true,
+		authService: NewAuthService("SafeHarbor", "", 0, nil, "test salt"),
+		MaxLoginAttemptsToRetain: 5,
+	}
+	var persist = &Persistence{
+		Server: server,
+		InMemoryOnly: true,
+	}
+	server.persistence = persist
+	persist.resetInMemoryState()
+	
+	var f = &testDB{ server: server }
+	var err error
+	f.client, err = NewInMemClient(server)
+	if err != nil { testContext.Fatal(err) }
+	
+	var realmInfo *apitypes.RealmInfo
+	realmInfo, err = apitypes.NewRealmInfo("testrealm", "Test Organization", "")
+	if err != nil { testContext.Fatal(err) }
+	f.realm, err = f.client.dbCreateRealm(realmInfo, "admin")
+	if err != nil { testContext.Fatal(err) }
+	f.user, err = f.client.dbCreateUser("jdoe", "Jane Doe", "jdoe@example.com",
+		"password", f.realm.getId())
+	if err != nil { testContext.Fatal(err) }
+	f.repo, err = f.client.dbCreateRepo(f.realm.getId(), "repoa", "")
+	if err != nil { testContext.Fatal(err) }
+	f.otherRepo, err = f.client.dbCreateRepo(f.realm.getId(), "repob", "")
+	if err != nil { testContext.Fatal(err) }
+	f.dockerfile, err = f.client.dbCreateDockerfile(f.repo.getId(), "dockerfilea", "", "")
+	if err != nil { testContext.Fatal(err) }
+	f.flag, err = f.client.dbCreateFlag("flaga", "", f.repo.getId(), "")
+	if err != nil { testContext.Fatal(err) }
+	f.otherDockerfile, err = f.client.dbCreateDockerfile(f.otherRepo.getId(), "dockerfileb", "", "")
+	if err != nil { testContext.Fatal(err) }
+	
+	return f
+}
+
+func (f *testDB) createGroup(testContext *testing.T, name string) Group {
+	var group, err = f.client.dbCreateGroup(f.realm.getId(), name, "")
+	if err != nil { testContext.Fatal(err) }
+	return group
+}
+
+func (f *testDB) grant(testContext *testing.T, party Party,
+	resource Resource, mask []bool) {
+	// Copy the mask, since the ACL entry retains it.
+	var _, err = f.client.addAccess(resource, party, append([]bool{}, mask...))
+	if err != nil { testContext.Fatal(err) }
+}
+
+func (f *testDB) deny(testContext *testing.T, party Party,
+	resource Resource, mask []bool) {
+	var entry, err = f.client.addAccess(resource, party, make([]bool, NumberOfAccessModes))
+	if err != nil { testContext.Fatal(err) }
+	err = entry.addDenyMask(f.client, append([]bool{}, mask...))
+	if err != nil { testContext.Fatal(err) }
+}
@@ -0,0 +1,577 @@
+/*******************************************************************************
+ * Webhooks. A realm or a repo may have webhooks: URLs to which the events that
+ * pertain to it, or to anything it contains, are posted, so that other tools can
+ * react to them without polling. A hook receives the types of event listed in
+ * its EventTypes, or, if that is empty, every type (see WebhookEventTypes).
+ *
+ * Like email (see EmailOutbox.go), events are not posted by the request in which
+ * they occur: each is stored as a WebhookDelivery, in the request's transaction,
+ * and a background worker posts the deliveries that are due, every
+ * WEBHOOK_POLL_INTERVAL seconds. A delivery that fails - because the receiver is
+ * unreachable, or does not respond with a 2xx status - is retried after
+ * WebhookRetryInitialDelay, then after twice as long each time, up to
+ * WebhookRetryMaxDelay, until MaxWebhookDeliveryAttempts attempts have failed.
+ * The most recent MaxWebhookDeliveryLog deliveries of each hook are kept, so that
+ * they can be inspected, and redelivered, with getWebhookDeliveries and
+ * redeliverWebhookDelivery. As for email, a delivery is made at least once, and
+ * occasionally more than once; a receiver can recognize a repeated delivery by
+ * its X-SafeHarbor-Delivery header.
+ *
+ * The body of each post is a JSON WebhookPayload. Each post is signed with the
+ * hook's secret: the X-SafeHarbor-Signature header is "sha256=" followed by the
+ * hex HMAC-SHA256, keyed by the secret, of the X-SafeHarbor-Timestamp header, a
+ * ".", and the body. A receiver should recompute the signature, compare it in
+ * constant time, and reject a timestamp that is not recent.
+ *
+ * A hook may not post to a loopback, link-local, private or unspecified
+ * address, lest a user who may create hooks use the server to reach services
+ * that are not otherwise exposed. The hook's host is checked when the hook is
+ * registered, and again for each connection - since the name may since have been
+ * made to resolve to another address - and redirects are not followed. Posts do
+ * not go through a proxy, as the address that a proxy connects to cannot be
+ * checked.
+ *
+ * Copyright Scaled Markets, Inc.
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	
+	"utilities"
+)
+
+const (
+	// Event types.
+	ImageCreationWebhookEvent = "ImageCreationEvent"  // a filter only: matches either of the next two
+	DockerfileExecWebhookEvent = "DockerfileExecEvent"
+	ImageUploadWebhookEvent = "ImageUploadEvent"
+	ScanWebhookEvent = "ScanEvent"
+	PermissionChangeWebhookEvent = "PermissionChange"
+	
+	DefaultWebhookPollInterval = 5  // seconds
+	MaxWebhookDeliveryAttempts = 10
+	MaxWebhookDeliveryLog = 100  // per hook; the oldest completed deliveries are discarded
+	WebhookRetryInitialDelay = 15 * time.Second
+	WebhookRetryMaxDelay = time.Hour
+	WebhookTimeout = 10 * time.Second
+	WebhookSendClaimDuration = 2 * time.Minute
+	WebhookPostConcurrency = 10  // posts in progress at once, per realm
+	// The most deliveries claimed at once, per realm: few enough that they can all
+	// be posted in half of the claim duration.
+	MaxWebhookDeliveriesPerClaim = WebhookPostConcurrency *
+		int(WebhookSendClaimDuration / (2 * WebhookTimeout))
+	WebhookSendClaimKeyPrefix = "SafeHarbor/WebhookDeliverySend/"
+	WebhookSecretLength = 32  // bytes, before hex encoding
+)
+
+var WebhookEventTypes = []string{ ImageCreationWebhookEvent, DockerfileExecWebhookEvent,
+	ImageUploadWebhookEvent, ScanWebhookEvent, PermissionChangeWebhookEvent }
+
+var webhookHTTPClient = &http.Client{
+	Timeout: WebhookTimeout,
+	Transport: &http.Transport{
+		Proxy: nil,  // a proxy would make the connection, unchecked; see checkWebhookDialAddress
+		DialContext: (&net.Dialer{
+			Timeout: WebhookTimeout,
+			Control: checkWebhookDialAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: WebhookTimeout,
+	},
+	CheckRedirect: func(request *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse  // a redirect is reported as a failed delivery
+	},
+}
+
+/*******************************************************************************
+ * Whether hooks may post to loopback, link-local and private addresses. Only
+ * tests, whose receivers listen on the loopback interface, set this.
+ */
+var allowPrivateWebhookAddresses = false
+
+/*******************************************************************************
+ * Special-purpose address ranges (RFC 6890 and its updates) to which a hook may
+ * not post, in addition to those that isPermittedWebhookAddress recognizes by
+ * means of the net.IP methods: shared (carrier-grade NAT) addresses, addresses
+ * reserved for documentation and benchmarking, relay and translation prefixes,
+ * which may embed a private IPv4 address, and reserved ranges.
+ */
+var deniedWebhookNetworks = mustParseCIDRs(
+	"0.0.0.0/8",  // "this" network
+	"100.64.0.0/10",  // shared address space (carrier-grade NAT)
+	"192.0.0.0/24",  // IETF protocol assignments
+	"192.0.2.0/24",  // documentation (TEST-NET-1)
+	"192.88.99.0/24",  // 6to4 relay anycast
+	"198.18.0.0/15",  // benchmarking
+	"198.51.100.0/24",  // documentation (TEST-NET-2)
+	"203.0.113.0/24",  // documentation (TEST-NET-3)
+	"240.0.0.0/4",  // reserved, including the limited broadcast address
+	"64:ff9b::/96",  // IPv4/IPv6 translation
+	"64:ff9b:1::/48",  // local-use IPv4/IPv6 translation
+	"100::/64",  // discard-only
+	"2001::/23",  // IETF protocol assignments, including Teredo
+	"2001:db8::/32",  // documentation
+	"2002::/16",  // 6to4
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks = make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		var _, network, err = net.ParseCIDR(cidr)
+		if err != nil { panic(err) }
+		networks[i] = network
+	}
+	return networks
+}
+
+/*******************************************************************************
+ * The body of a post to a webhook. Details depend on the EventType.
+ */
+type WebhookPayload struct {
+	EventType string
+	Time time.Time
+	RealmId string
+	WebhookId string
+	Details map[string]interface{}
+}
+
+/*******************************************************************************
+ * Parse a comma separated list of event types. An empty list means all types.
+ */
+func parseWebhookEventTypes(eventTypeSeq string) ([]string, error) {
+	
+	var eventTypes = make([]string, 0)
+	if eventTypeSeq == "" { return eventTypes, nil }
+	for _, eventType := range strings.Split(eventTypeSeq, ",") {
+		eventType = strings.TrimSpace(eventType)
+		var known = false
+		for _, t := range WebhookEventTypes { if t == eventType { known = true } }
+		if ! known { return nil, utilities.ConstructUserError(
+			"Unrecognized webhook event type: " + eventType + "; expected one of " +
+			strings.Join(WebhookEventTypes, ", ")) }
+		eventTypes = append(eventTypes, eventType)
+	}
+	return eventTypes, nil
+}
+
+/*******************************************************************************
+ * Check that a hook's URL is an absolute http or https URL, and that its host
+ * resolves only to addresses to which a hook may post.
+ */
+func validateWebhookURL(hookURL string) error {
+	
+	var parsedURL, err = url.Parse(hookURL)
+	if (err != nil) || ((parsedURL.Scheme != "http") && (parsedURL.Scheme != "https")) ||
+		(parsedURL.Hostname() == "") {
+		return utilities.ConstructUserError("A webhook URL must be an absolute http or https URL")
+	}
+	var ips []net.IP
+	ips, err = net.LookupIP(parsedURL.Hostname())
+	if err != nil { return utilities.ConstructUserError(
+		"Unable to resolve the webhook URL's host: " + err.Error()) }
+	for _, ip := range ips {
+		if ! isPermittedWebhookAddress(ip) { return utilities.ConstructUserError(
+			"A webhook may not post to a loopback, link-local or private address") }
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Return false if the address is a loopback, link-local, private, multicast or
+ * other special-purpose address (see deniedWebhookNetworks).
+ */
+func isPermittedWebhookAddress(ip net.IP) bool {
+	if allowPrivateWebhookAddresses { return true }
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() { return false }
+	for _, network := range deniedWebhookNetworks {
+		if network.Contains(ip) { return false }
+	}
+	return true
+}
+
+/*******************************************************************************
+ * Called by webhookHTTPClient's dialer, after the host has been resolved, to
+ * refuse a connection to an address to which a hook may not post.
+ */
+func checkWebhookDialAddress(network, address string, conn syscall.RawConn) error {
+	
+	var host, _, err = net.SplitHostPort(address)
+	if err != nil { return err }
+	var ip = net.ParseIP(host)
+	if (ip == nil) || (! isPermittedWebhookAddress(ip)) { return utilities.ConstructUserError(
+		"A webhook may not post to " + host + ": it is a loopback, link-local or private address") }
+	return nil
+}
+
+func createWebhookSecret() (string, error) {
+	var randomBytes = make([]byte, WebhookSecretLength)
+	var _, err = rand.Read(randomBytes)
+	if err != nil { return "", err }
+	return hex.EncodeToString(randomBytes), nil
+}
+
+func webhookWantsEventType(webhook Webhook, eventType string) bool {
+	
+	if len(webhook.getEventTypes()) == 0 { return true }
+	for _, t := range webhook.getEventTypes() {
+		if t == eventType { return true }
+		if (t == ImageCreationWebhookEvent) &&
+			((eventType == DockerfileExecWebhookEvent) || (eventType == ImageUploadWebhookEvent)) {
+			return true
+		}
+	}
+	return false
+}
+
+/*******************************************************************************
+ * Queue a delivery of the event to each hook, of the realm that contains the
+ * resource, that is registered for the resource or for one of its ancestors, and
+ * that wants the event's type.
+ */
+func queueWebhookEvent(dbClient DBClient, eventType string, resource Resource,
+	details map[string]interface{}) error {
+	
+	var lineage []Resource
+	var err error
+	lineage, err = getResourceLineage(dbClient, resource)
+	if err != nil { return err }
+	var realm, isRealm = lineage[len(lineage)-1].(Realm)
+	if (! isRealm) || (len(realm.getWebhookIds()) == 0) { return nil }
+	
+	var now = time.Now()
+	for _, webhookId := range realm.getWebhookIds() {
+		var webhook Webhook
+		webhook, err = dbClient.getWebhook(webhookId)
+		if err != nil { continue }  // dangling Id
+		if ! webhookWantsEventType(webhook, eventType) { continue }
+		var applies = false
+		for _, r := range lineage {
+			if r.getId() == webhook.getResourceId() { applies = true }
+		}
+		if ! applies { continue }
+		
+		var payload []byte
+		payload, err = json.Marshal(&WebhookPayload{
+			EventType: eventType,
+			Time: now,
+			RealmId: realm.getId(),
+			WebhookId: webhook.getId(),
+			Details: details,
+		})
+		if err != nil { return err }
+		_, err = dbClient.dbCreateWebhookDelivery(webhook, eventType, string(payload))
+		if err != nil { return err }
+		err = trimWebhookDeliveryLog(dbClient, webhook)
+		if err != nil { return err }
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Queue an event that pertains to an image version, such as its creation or a
+ * scan of it.
+ */
+func queueWebhookEventForImageVersion(dbClient DBClient, eventType string, event PersistObj,
+	imageVersion ImageVersion, details map[string]interface{}) error {
+	
+	var image Image
+	var err error
+	image, err = imageVersion.getImage(dbClient)
+	if err != nil { return err }
+	details["EventId"] = event.getId()
+	details["RepoId"] = image.getRepoId()
+	details["ImageId"] = image.getId()
+	details["ImageName"] = image.getName()
+	details["ImageVersionId"] = imageVersion.getId()
+	details["Version"] = imageVersion.getVersion()
+	return queueWebhookEvent(dbClient, eventType, image, details)
+}
+
+/*******************************************************************************
+ * Queue the granting, changing, or removal of a party's access to a resource.
+ * action is "set", "add", or "delete"; entry is the party's resulting ACL entry,
+ * or nil if its access was removed. The caller must queue the event only once
+ * it has finished changing the entry, so that the event reports the entry's
+ * final grants, denials, role, and expiry.
+ */
+func queuePermissionChangeWebhookEvent(dbClient DBClient, action string, resource Resource,
+	party Party, entry ACLEntry) error {
+	
+	var details = map[string]interface{}{
+		"Action": action,
+		"ResourceId": resource.getId(),
+		"ResourceName": resource.getName(),
+		"PartyId": party.getId(),
+		"PartyName": party.getName(),
+		"PermissionMask": nil,
+	}
+	if entry != nil {
+		details["PermissionMask"] = entry.getPermissionMask()
+		details["DenyMask"] = entry.getDenyMask()
+		details["RoleName"] = entry.getRoleName()
+		if ! entry.getExpiresAt().IsZero() { details["ExpiresAt"] = entry.getExpiresAt() }
+	}
+	return queueWebhookEvent(dbClient, PermissionChangeWebhookEvent, resource, details)
+}
+
+/*******************************************************************************
+ * Discard the oldest deliveries of the hook, beyond MaxWebhookDeliveryLog, that
+ * have been completed.
+ */
+func trimWebhookDeliveryLog(dbClient DBClient, webhook Webhook) error {
+	
+	var excess = len(webhook.getDeliveryIds()) - MaxWebhookDeliveryLog
+	if excess <= 0 { return nil }
+	var deliveryIds = append([]string{}, webhook.getDeliveryIds()...)
+	for _, deliveryId := range deliveryIds {
+		if excess <= 0 { break }
+		var delivery WebhookDelivery
+		var err error
+		delivery, err = dbClient.getWebhookDelivery(deliveryId)
+		if err == nil {
+			var status = delivery.getStatus()
+			if (status == WebhookDeliveryPending) || (status == WebhookDeliverySending) { continue }
+			err = dbClient.deleteObject(delivery)
+			if err != nil { return err }
+		}
+		err = webhook.removeDeliveryId(dbClient, deliveryId)
+		if err != nil { return err }
+		excess--
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Return the value of the X-SafeHarbor-Signature header of a post.
+ */
+func signWebhookPayload(secret, timestamp string, payload []byte) string {
+	var mac = hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/*******************************************************************************
+ * Post a delivery to its hook, and return the HTTP status of the response, or 0
+ * if none was received.
+ */
+func postWebhookDelivery(webhook Webhook, delivery WebhookDelivery) (int, error) {
+	
+	var payload = []byte(delivery.getPayload())
+	var timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+	var request, err = http.NewRequest("POST", webhook.getURL(), bytes.NewReader(payload))
+	if err != nil { return 0, err }
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "SafeHarbor-Webhook")
+	request.Header.Set("X-SafeHarbor-Event", delivery.getEventType())
+	request.Header.Set("X-SafeHarbor-Delivery", delivery.getId())
+	request.Header.Set("X-SafeHarbor-Timestamp", timestamp)
+	request.Header.Set("X-SafeHarbor-Signature", signWebhookPayload(webhook.getSecret(), timestamp, payload))
+	
+	var response *http.Response
+	response, err = webhookHTTPClient.Do(request)
+	if err != nil { return 0, err }
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64 * 1024))
+	if (response.StatusCode < 200) || (response.StatusCode >= 300) {
+		return response.StatusCode, utilities.ConstructServerError(
+			"Webhook responded with status " + response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+/*******************************************************************************
+ * Return how long to wait before the next attempt to post a delivery, after the
+ * specified number of failed attempts.
+ */
+func getWebhookRetryDelay(attempts int) time.Duration {
+	
+	var delay = WebhookRetryInitialDelay
+	for i := 1; i < attempts; i++ {
+		delay = delay * 2
+		if delay >= WebhookRetryMaxDelay { return WebhookRetryMaxDelay }
+	}
+	return delay
+}
+
+/*******************************************************************************
+ * Post the deliveries that are due, every WebhookPollInterval seconds, until the
+ * process exits.
+ */
+func (server *Server) deliverWebhooksPeriodically() {
+	
+	var interval = server.Config.WebhookPollInterval
+	if interval <= 0 { interval = DefaultWebhookPollInterval }
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		var count, err = server.deliverWebhooks()
+		if err != nil { fmt.Println("While posting webhook deliveries: " + err.Error()) }
+		if count > 0 { fmt.Println(fmt.Sprintf("Posted %d webhook deliveries", count)) }
+	}
+}
+
+/*******************************************************************************
+ * Attempt to post each delivery, of any realm, that is due, and return the
+ * number that succeeded. A realm whose deliveries cannot be posted is logged and
+ * skipped.
+ */
+func (server *Server) deliverWebhooks() (int, error) {
+	
+	var dbClient *InMemClient
+	var err error
+	dbClient, err = NewInMemClient(server)
+	if err != nil { return 0, err }
+	var realmIds []string
+	realmIds, err = dbClient.dbGetAllRealmIds()
+	dbClient.abort()
+	if err != nil { return 0, err }
+	
+	var total = 0
+	for _, realmId := range realmIds {
+		var count int
+		count, err = server.deliverWebhooksForRealm(realmId, time.Now())
+		if err != nil {
+			fmt.Println("While posting webhook deliveries of realm " + realmId + ": " + err.Error())
+			continue
+		}
+		total = total + count
+	}
+	return total, nil
+}
+
+/*******************************************************************************
+ * Claim the realm's deliveries that are due as of now, post them, and record the
+ * outcomes. Return the number that succeeded.
+ */
+func (server *Server) deliverWebhooksForRealm(realmId string, now time.Time) (int, error) {
+	
+	var claimed []WebhookDelivery
+	var webhooks []Webhook
+	var err error
+	claimed, webhooks, err = server.claimDueWebhookDeliveries(realmId, now)
+	if err != nil { return 0, err }
+	if len(claimed) == 0 { return 0, nil }
+	
+	// Post the deliveries concurrently, WebhookPostConcurrency at a time.
+	var responseStatuses = make([]int, len(claimed))
+	var postErrs = make([]error, len(claimed))
+	var slots = make(chan bool, WebhookPostConcurrency)
+	var wg sync.WaitGroup
+	for i, delivery := range claimed {
+		wg.Add(1)
+		slots <- true
+		go func(i int, delivery WebhookDelivery) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			responseStatuses[i], postErrs[i] = postWebhookDelivery(webhooks[i], delivery)
+		}(i, delivery)
+	}
+	wg.Wait()
+	var count = 0
+	for _, postErr := range postErrs { if postErr == nil { count++ } }
+	
+	err = server.performInTransaction("webhook delivery outcomes", func(dbClient *InMemClient) (bool, error) {
+		return true, recordWebhookDeliveryOutcomes(dbClient, claimed, responseStatuses, postErrs, time.Now())
+	})
+	return count, err
+}
+
+/*******************************************************************************
+ * Claim each of the realm's pending deliveries that is due - up to
+ * MaxWebhookDeliveriesPerClaim, so that the claims do not expire before the
+ * deliveries are posted - and return those claimed, with their hooks. Each
+ * attempt to post a delivery is claimed with a key that expires with the claim,
+ * so that, of several servers that find the delivery due at the same time, only
+ * one posts it; the claims are then recorded in a transaction.
+ */
+func (server *Server) claimDueWebhookDeliveries(realmId string, now time.Time) (
+	[]WebhookDelivery, []Webhook, error) {
+	
+	var keyClaimed = make(map[string]bool)  // keys that this server has set
+	var claimed []WebhookDelivery
+	var webhooks []Webhook
+	var err = server.performInTransaction("webhook delivery claims", func(dbClient *InMemClient) (bool, error) {
+		claimed = make([]WebhookDelivery, 0)
+		webhooks = make([]Webhook, 0)
+		var realm, err = dbClient.getRealm(realmId)
+		if err != nil { return false, err }
+		for _, deliveryId := range realm.getPendingWebhookDeliveryIds() {
+			if len(claimed) >= MaxWebhookDeliveriesPerClaim { break }  // the rest wait for the next poll
+			var delivery WebhookDelivery
+			delivery, err = dbClient.getWebhookDelivery(deliveryId)
+			if err != nil { continue }  // dangling Id
+			if ! delivery.isDue(now) { continue }
+			var webhook Webhook
+			webhook, err = dbClient.getWebhook(delivery.getWebhookId())
+			if err != nil { continue }  // the hook was deleted
+			var isClaimed bool
+			isClaimed, err = server.claimQueuedSend(dbClient, delivery, WebhookSendClaimKeyPrefix,
+				WebhookSendClaimDuration, now, keyClaimed)
+			if err != nil { return false, err }
+			if ! isClaimed { continue }
+			claimed = append(claimed, delivery)
+			webhooks = append(webhooks, webhook)
+		}
+		return len(claimed) > 0, nil
+	})
+	if err != nil { return nil, nil, err }
+	return claimed, webhooks, nil
+}
+
+/*******************************************************************************
+ * Record the outcome of each post, and schedule the next attempt of each that
+ * failed - unless it has been attempted MaxWebhookDeliveryAttempts times, in
+ * which case it is marked as failed. A delivery that is completed is removed from
+ * its realm's pending list. A delivery that was deleted, or redelivered, while it
+ * was being posted is left as it is.
+ */
+func recordWebhookDeliveryOutcomes(dbClient DBClient, claimed []WebhookDelivery,
+	responseStatuses []int, postErrs []error, now time.Time) error {
+	
+	for i, claimedDelivery := range claimed {
+		var delivery WebhookDelivery
+		var err error
+		delivery, err = dbClient.getWebhookDelivery(claimedDelivery.getId())
+		if err != nil { continue }  // deleted
+		if delivery.getStatus() != WebhookDeliverySending { continue }  // redelivered
+		if postErrs[i] == nil {
+			err = delivery.recordSuccess(dbClient, responseStatuses[i], now)
+		} else {
+			var nextAttemptTime time.Time
+			if delivery.getAttempts() < MaxWebhookDeliveryAttempts {
+				nextAttemptTime = now.Add(getWebhookRetryDelay(delivery.getAttempts()))
+			}
+			err = delivery.recordFailure(dbClient, responseStatuses[i], postErrs[i].Error(),
+				nextAttemptTime, now)
+		}
+		if err != nil { return err }
+		
+		var status = delivery.getStatus()
+		if (status == WebhookDeliveryDelivered) || (status == WebhookDeliveryFailed) {
+			var realm Realm
+			realm, err = dbClient.getRealm(delivery.getRealmId())
+			if err != nil { return err }
+			err = realm.removePendingWebhookDelivery(dbClient, delivery)
+			if err != nil { return err }
+		}
+	}
+	return nil
+}
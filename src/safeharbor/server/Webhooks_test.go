@@ -0,0 +1,158 @@
+package server
+
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+	
+	"safeharbor/apitypes"
+)
+
+type receivedPost struct {
+	header http.Header
+	body []byte
+}
+
+/*******************************************************************************
+ * The posts received by a test's receiver, whose handler runs in goroutines of
+ * the receiver's own.
+ */
+type receivedPosts struct {
+	lock sync.Mutex
+	posts []receivedPost
+}
+
+func (received *receivedPosts) add(post receivedPost) {
+	received.lock.Lock()
+	defer received.lock.Unlock()
+	received.posts = append(received.posts, post)
+}
+
+func (received *receivedPosts) count() int {
+	received.lock.Lock()
+	defer received.lock.Unlock()
+	return len(received.posts)
+}
+
+func (received *receivedPosts) get(i int) receivedPost {
+	received.lock.Lock()
+	defer received.lock.Unlock()
+	return received.posts[i]
+}
+
+func Test_WebhooksMayNotPostToInternalAddresses(testContext *testing.T) {
+	
+	for _, hookURL := range []string{ "http://127.0.0.1:8080/hook", "https://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data/", "http://10.1.2.3/hook",
+		"http://192.168.0.1/hook", "http://0.0.0.0/hook", "http://localhost/hook",
+		"http://100.64.0.1/hook", "http://0.1.2.3/hook", "http://198.18.0.1/hook",
+		"http://192.0.2.1/hook", "http://255.255.255.255/hook", "http://[64:ff9b::a01:203]/hook",
+		"http://[2002:a01:203::1]/hook", "http://[::ffff:10.1.2.3]/hook" } {
+		if validateWebhookURL(hookURL) == nil {
+			testContext.Errorf("Expected %s to be rejected", hookURL)
+		}
+	}
+	if validateWebhookURL("https://93.184.216.34/hook") != nil {
+		testContext.Error("Expected a public address to be accepted")
+	}
+	if checkWebhookDialAddress("tcp", "127.0.0.1:80", nil) == nil {
+		testContext.Error("Expected a connection to a loopback address to be refused")
+	}
+}
+
+func Test_WebhookDeliveriesAreSignedAndRetried(testContext *testing.T) {
+	
+	var f = newTestDB(testContext)
+	allowPrivateWebhookAddresses = true  // the receiver listens on the loopback interface
+	defer func() { allowPrivateWebhookAddresses = false }()
+	var received = &receivedPosts{}
+	var responseStatus = http.StatusInternalServerError
+	var receiver = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var body, _ = ioutil.ReadAll(request.Body)
+		received.add(receivedPost{ header: request.Header, body: body })
+		writer.WriteHeader(responseStatus)
+	}))
+	defer receiver.Close()
+	
+	var webhook, err = f.client.dbCreateWebhook(f.realm.getId(), f.realm.getId(), receiver.URL,
+		"s3cret", []string{ PermissionChangeWebhookEvent }, f.user.getId())
+	if err != nil { testContext.Fatal(err) }
+	var otherWebhook Webhook
+	otherWebhook, err = f.client.dbCreateWebhook(f.realm.getId(), f.otherRepo.getId(), receiver.URL,
+		"other", []string{}, f.user.getId())
+	if err != nil { testContext.Fatal(err) }
+	
+	// The event is queued once the entry is complete, with its denials.
+	var sessionToken = f.server.authService.createSession(apitypes.NewCredentials(f.user.getUserId(), ""))
+	var response = addPermission(f.client, sessionToken, url.Values{
+		"PartyId": { f.user.getId() }, "ResourceId": { f.repo.getId() },
+		"CanCreateIn": { "false" }, "CanRead": { "true" }, "CanWrite": { "false" },
+		"CanExecute": { "false" }, "CanDelete": { "false" }, "DenyWrite": { "true" } }, nil)
+	if _, isType := response.(*apitypes.FailureDesc); isType {
+		testContext.Fatalf("Expected the permission to be added: %s", response.AsJSON())
+	}
+	if (len(webhook.getDeliveryIds()) != 1) || (len(otherWebhook.getDeliveryIds()) != 0) {
+		testContext.Fatalf("Expected one delivery, to the realm's hook, but found %d and %d",
+			len(webhook.getDeliveryIds()), len(otherWebhook.getDeliveryIds()))
+	}
+	var deliveryId = webhook.getDeliveryIds()[0]
+	
+	// The receiver fails, so the delivery is retried later.
+	var now = time.Now()
+	var count int
+	count, err = f.server.deliverWebhooksForRealm(f.realm.getId(), now)
+	if err != nil { testContext.Fatal(err) }
+	var delivery WebhookDelivery
+	delivery, err = f.client.getWebhookDelivery(deliveryId)
+	if err != nil { testContext.Fatal(err) }
+	if (count != 0) || (received.count() != 1) || (delivery.getStatus() != WebhookDeliveryPending) ||
+		(delivery.getAttempts() != 1) || delivery.isDue(now) {
+		testContext.Errorf("Expected a failed attempt to be retried later, but status is %s after %d attempts",
+			delivery.getStatus(), delivery.getAttempts())
+	}
+	
+	responseStatus = http.StatusOK
+	count, err = f.server.deliverWebhooksForRealm(f.realm.getId(), now.Add(WebhookRetryInitialDelay + time.Minute))
+	if err != nil { testContext.Fatal(err) }
+	if (count != 1) || (received.count() != 2) || (delivery.getStatus() != WebhookDeliveryDelivered) ||
+		(len(f.realm.getPendingWebhookDeliveryIds()) != 0) {
+		testContext.Fatalf("Expected the delivery to succeed, but status is %s", delivery.getStatus())
+	}
+	var post = received.get(1)
+	var timestamp = post.header.Get("X-SafeHarbor-Timestamp")
+	if post.header.Get("X-SafeHarbor-Signature") != signWebhookPayload("s3cret", timestamp, post.body) {
+		testContext.Error("The post is not signed with the hook's secret")
+	}
+	if (post.header.Get("X-SafeHarbor-Event") != PermissionChangeWebhookEvent) ||
+		(post.header.Get("X-SafeHarbor-Delivery") != deliveryId) {
+		testContext.Errorf("Unexpected headers: %v", post.header)
+	}
+	var payload WebhookPayload
+	err = json.Unmarshal(post.body, &payload)
+	if err != nil { testContext.Fatal(err) }
+	if (payload.EventType != PermissionChangeWebhookEvent) || (payload.RealmId != f.realm.getId()) ||
+		(payload.Details["ResourceId"] != f.repo.getId()) || (payload.Details["PartyId"] != f.user.getId()) {
+		testContext.Errorf("Unexpected payload: %s", string(post.body))
+	}
+	var denyMask, isArray = payload.Details["DenyMask"].([]interface{})
+	if (! isArray) || (len(denyMask) != 5) || (denyMask[2] != true) || (denyMask[1] != false) {
+		testContext.Errorf("Expected the payload to include the final deny mask: %s", string(post.body))
+	}
+	
+	// A delivery can be made again on request.
+	err = delivery.redeliver(f.client)
+	if err != nil { testContext.Fatal(err) }
+	err = f.realm.addPendingWebhookDelivery(f.client, delivery)
+	if err != nil { testContext.Fatal(err) }
+	count, err = f.server.deliverWebhooksForRealm(f.realm.getId(), time.Now())
+	if err != nil { testContext.Fatal(err) }
+	if (count != 1) || (received.count() != 3) || (delivery.getAttempts() != 1) {
+		testContext.Error("Expected the delivery to be made again")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"net/http"
 	//"os"
+	"strconv"
 	"strings"
 	//"crypto/tls"
 	"crypto/x509"
@@ -18,15 +19,23 @@ import (
 	"crypto/sha256"
 	//"crypto/sha512"
 	"hash"
+	"sync"
 	//"encoding/hex"
 	
 	"safeharbor/apitypes"
 	"utilities"
 )
 
+const NumberOfAccessModes = int(apitypes.CanDelete) + 1  // CreateIn, Read, Write, Execute, Delete
+
+var AccessModeNames = []string{ "CreateIn", "Read", "Write", "Execute", "Delete" }  // in mask order
+
 type AuthService struct {
 	Service string
 	Sessions map[string]*apitypes.Credentials  // map session key to apitypes.Credentials.
+	sessionLock sync.Mutex  // guards Sessions, which requests and background workers share
+	LoginChallenges map[string]*LoginChallenge  // logins awaiting a second factor; see SecondFactor.go
+	challengeLock sync.Mutex  // guards LoginChallenges and the challenges in it
 	//DockerRegistry2AuthServerName string
 	//DockerRegistry2AuthPort int
 	//DockerRegistry2AuthSvc *http.Client
@@ -42,6 +51,7 @@ func NewAuthService(serviceName string, authServerName string, authPort int,
 	return &AuthService{
 		Service: serviceName,
 		Sessions: make(map[string]*apitypes.Credentials),
+		LoginChallenges: make(map[string]*LoginChallenge),
 		//DockerRegistry2AuthServerName: authServerName,
 		//DockerRegistry2AuthPort: authPort,
 		//DockerRegistry2AuthSvc: connectToAuthServer(certPool),
@@ -83,7 +93,9 @@ func (authSvc *AuthService) createSession(creds *apitypes.Credentials) *apitypes
 	
 	// Cache the new session token, so that this Server can recognize it in future
 	// exchanges during this session.
+	authSvc.sessionLock.Lock()
 	authSvc.Sessions[sessionId] = creds
+	authSvc.sessionLock.Unlock()
 	fmt.Println("Created session for session id " + sessionId)
 	
 	return token
@@ -94,15 +106,40 @@ func (authSvc *AuthService) createSession(creds *apitypes.Credentials) *apitypes
  * This effectively logs out the owner of that session.
  */
 func (authSvc *AuthService) invalidateSessionId(sessionId string) {
+	authSvc.sessionLock.Lock()
+	defer authSvc.sessionLock.Unlock()
 	authSvc.Sessions[sessionId] = nil
 }
 
+/*******************************************************************************
+ * End each session of the specified user, logging the user out everywhere, and
+ * invalidate any password reset tokens that the user has been sent. Sessions are
+ * held by each server, and so the user's credential epoch is advanced, in the
+ * transaction: each server rejects sessions that were created before it (see
+ * authenticateSession). This server's sessions are also removed immediately.
+ */
+func (authSvc *AuthService) invalidateSessionsForUser(dbClient DBClient, user User) error {
+	var err = user.advanceCredentialEpoch(dbClient, time.Now())
+	if err != nil { return err }
+	authSvc.sessionLock.Lock()
+	defer authSvc.sessionLock.Unlock()
+	for sessionId, creds := range authSvc.Sessions {
+		if (creds != nil) && (creds.UserId == user.getUserId()) { authSvc.Sessions[sessionId] = nil }
+	}
+	return nil
+}
+
 /*******************************************************************************
  * Clear all sessions that are cached in the auth service. The effect is that,
  * after calling this method, no user is logged in.
  */
 func (authSvc *AuthService) clearAllSessions() {
+	authSvc.sessionLock.Lock()
 	authSvc.Sessions = make(map[string]*apitypes.Credentials)
+	authSvc.sessionLock.Unlock()
+	authSvc.challengeLock.Lock()
+	authSvc.LoginChallenges = make(map[string]*LoginChallenge)
+	authSvc.challengeLock.Unlock()
 }
 
 /*******************************************************************************
@@ -162,11 +199,23 @@ func (authService *AuthService) authorized(dbClient DBClient, sessionToken *apit
 	A party can access a resource if the party,
 		has an ACL entry for the resource; or,
 		the resource belongs to a repo or realm for which the party has an ACL entry.
+	Access is thus inherited from realm to repo, and from realm and repo to each
+	Dockerfile, image, scan config, and flag of the repo. See getResourceLineage.
+	
+	An ACL entry may also deny access modes. A denial overrides the grant of the
+	same mode by any entry for the same resource, and any grant that would
+	otherwise be inherited from a containing resource; a grant for a resource in
+	turn overrides a denial that would otherwise be inherited. That is, deny beats
+	allow, and closer beats farther. See applyACLEntries.
+	
+	An ACL entry may have an expiry time, after which it has no effect, whether
+	or not the expiry sweeper has yet deleted it.
 	
 	In this context, a user is a party if the user is explicitly the party or if
 	the user belongs to a group that is explicitly the party.
 	
-	Groups may not belong to other groups.
+	Groups may belong to other groups: a user who belongs to a group also belongs
+	to every group that contains that group, directly or indirectly.
 	
 	The user must have the required access mode (CreateIn, Read, Write, Exec, Delete).
 	No access mode implies any other access mode.
@@ -195,54 +244,474 @@ func (authService *AuthService) authorized(dbClient DBClient, sessionToken *apit
 	if user.getId() == resourceId { return true, nil }
 
 	// Verify that at most one field of the actionMask is true.
-	var nTrue = 0
-	for _, b := range actionMask {
+	var action int = -1
+	for i, b := range actionMask {
 		if b {
-			if nTrue == 1 {
+			if action != -1 {
 				return false, utilities.ConstructUserError("More than one field in mask may not be true")
 			}
-			nTrue++
+			action = i
 		}
 	}
+	if action == -1 { return false, nil }  // no action mask fields were set.
 	
 	// Check if the user or a group that the user belongs to has the permission
-	// that is specified by the actionMask.
-	var party Party = user  // start with the user.
+	// that is specified by the actionMask, for the resource or for a resource
+	// that contains it.
 	var resource Resource
 	resource, err = dbClient.getResource(resourceId)
 	if err != nil { return false, err }
 	if resource == nil {
 		return false, utilities.ConstructUserError("Resource with Id " + resourceId + " not found")
 	}
-	var groupIds []string = user.getGroupIds()
-	var groupIndex = -1
-	for { // the user, and then each group that the user belongs to...
-		// See if the party (user or group) has an ACL entry for the resource.
-		var partyCanAccessResourceDirectoy bool
-		partyCanAccessResourceDirectoy, err =
-			authService.partyHasAccess(dbClient, party, actionMask, resource)
-		if err != nil { return false, err }
-		if partyCanAccessResourceDirectoy { return true, nil }
+	var lineage []Resource
+	lineage, err = getResourceLineage(dbClient, resource)
+	if err != nil { return false, err }
+	var parties []Party
+	parties, err = getEffectiveParties(dbClient, user)
+	if err != nil { return false, err }
+	var mask []bool
+	mask, err = getEffectiveMask(dbClient, parties, lineage)
+	if err != nil { return false, err }
+	return mask[action], nil
+}
+
+/*******************************************************************************
+ * Return the specified resource, followed by each resource that contains it,
+ * nearest first: for a Dockerfile, image, scan config, or flag, that is the
+ * resource, its repo, and the repo's realm. An ACL entry for any of these
+ * resources applies to the specified resource.
+ */
+func getResourceLineage(dbClient DBClient, resource Resource) ([]Resource, error) {
+	
+	var lineage = []Resource{ resource }
+	for {
+		var parentId = lineage[len(lineage)-1].getParentId()
+		if parentId == "" { return lineage, nil }
+		for _, r := range lineage {
+			if r.getId() == parentId { return nil, utilities.ConstructServerError(
+				"Internal error: resource " + resource.getId() + " is contained by itself") }
+		}
+		var parent Resource
+		var err error
+		parent, err = dbClient.getResource(parentId)
+		if err != nil { return nil, err }
+		lineage = append(lineage, parent)
+	}
+}
+
+/*******************************************************************************
+ * Return the Ids of the resources that the specified resource contains directly:
+ * the repos of a realm, or the Dockerfiles, images, scan configs, and flags of a
+ * repo. This is the inverse of getParentId, and so an ACL entry for the
+ * specified resource applies to each of these resources.
+ */
+func getChildResourceIds(resource Resource) []string {
+	
+	switch v := resource.(type) {
+		case Realm: return v.getRepoIds()
+		case Repo:
+			var ids = make([]string, 0)
+			ids = append(ids, v.getDockerfileIds()...)
+			ids = append(ids, v.getDockerImageIds()...)
+			ids = append(ids, v.getScanConfigIds()...)
+			ids = append(ids, v.getFlagIds()...)
+			return ids
+		default: return []string{}
+	}
+}
+
+/*******************************************************************************
+ * Return the parties whose ACL entries apply to the specified user: the user,
+ * followed by each group that the user belongs to, directly or indirectly.
+ */
+func getEffectiveParties(dbClient DBClient, user User) ([]Party, error) {
+	
+	var parties, _, err = getMembershipChains(dbClient, user)
+	return parties, err
+}
+
+/*******************************************************************************
+ * Return the parties whose ACL entries apply to the specified party, which may
+ * be a user or a group: the party, followed by each group that it belongs to,
+ * directly or indirectly, in order of increasing distance. Also return, for each
+ * of the groups, the Ids of the intervening groups through which the party
+ * belongs to it, nearest first.
+ */
+func getMembershipChains(dbClient DBClient, party Party) ([]Party, map[string][]string, error) {
+	
+	var parties = []Party{ party }
+	var chains = make(map[string][]string)
+	var pending = make([]string, 0)
+	var addGroupIds = func(groupIds []string, chain []string) {
+		for _, id := range groupIds {
+			if id == party.getId() { continue }
+			if _, found := chains[id]; found { continue }
+			chains[id] = chain
+			pending = append(pending, id)
+		}
+	}
+	switch v := party.(type) {
+		case User: addGroupIds(v.getGroupIds(), []string{})
+		case Group: addGroupIds(v.getGroupIds(), []string{})
+	}
+	for len(pending) > 0 {
+		var id = pending[0]
+		pending = pending[1:]
+		var group Group
+		var err error
+		group, err = dbClient.getGroup(id)
+		if err != nil { return nil, nil, err }
+		parties = append(parties, group)
+		addGroupIds(group.getGroupIds(), append(append([]string{}, chains[id]...), id))
+	}
+	return parties, chains, nil
+}
+
+/*******************************************************************************
+ * Explain whether the specified party may perform the action, identified by its
+ * index in a permission mask, on the resource. The decision is made in the same
+ * way as by authorized, but each level of the resource hierarchy is reported,
+ * together with the entries that apply at that level, and the groups through
+ * which those entries apply to the party. If redactNames, the levels are
+ * identified only by their Ids, not by their names.
+ */
+func explainPartyAccess(dbClient DBClient, party Party, resource Resource,
+	action int, redactNames bool) (*apitypes.AccessExplanationDesc, error) {
+	
+	var actionName = AccessModeNames[action]
+	var parties []Party
+	var chains map[string][]string
+	var err error
+	parties, chains, err = getMembershipChains(dbClient, party)
+	if err != nil { return nil, err }
+	var partyDescs = make([]*apitypes.PartyMembershipDesc, 0)
+	for _, p := range parties {
+		var chain = chains[p.getId()]
+		if chain == nil { chain = []string{} }
+		partyDescs = append(partyDescs, apitypes.NewPartyMembershipDesc(p.getId(), p.getName(), chain))
+	}
+	
+	// Special case, as in authorized: a user may do anything to their own user object.
+	if party.getId() == resource.getId() {
+		return apitypes.NewAccessExplanationDesc(party.getId(), resource.getId(), actionName,
+			true, "A user has all access modes for their own user object",
+			partyDescs, []*apitypes.AccessStepDesc{}), nil
+	}
+	
+	var lineage []Resource
+	lineage, err = getResourceLineage(dbClient, resource)
+	if err != nil { return nil, err }
+	var mask = make([]bool, NumberOfAccessModes)
+	var reason = "No ACL entry grants " + actionName + " to the party or to its groups"
+	var stepDescs = make([]*apitypes.AccessStepDesc, 0)
+	for i := len(lineage)-1; i >= 0; i-- {  // from the realm down to the resource, as in getEffectiveMask
+		var entries []ACLEntry
+		entries, err = getApplicableACLEntries(dbClient, parties, lineage[i])
+		if err != nil { return nil, err }
+		mask = applyACLEntries(mask, entries)
 		
-		// See if any of the party's parent resources have access.
-		var parentId string = resource.getParentId()
-		if parentId != "" {
-			var parent Resource
+		var outcome = "inherited"
+		var entryDescs = make([]*apitypes.PermissionDesc, 0)
+		var decidingEntry ACLEntry
+		for _, entry := range entries {
+			entryDescs = append(entryDescs, entry.asPermissionDesc())
+			if entry.getDenyMask()[action] {
+				outcome = "denied"
+				decidingEntry = entry
+			} else if entry.getPermissionMask()[action] && (outcome == "inherited") {
+				outcome = "granted"
+				decidingEntry = entry
+			}
+		}
+		var levelName = lineage[i].getName()
+		if redactNames { levelName = "" }
+		if decidingEntry != nil {
+			var level = levelName
+			if redactNames { level = lineage[i].getId() }
+			reason = actionName + " is " + outcome + " by the ACL entry of " +
+				describeParty(parties, chains, decidingEntry.getPartyId()) +
+				" for " + level
+		}
+		stepDescs = append(stepDescs, apitypes.NewAccessStepDesc(lineage[i].getId(),
+			levelName, entryDescs, outcome, mask[action]))
+	}
+	
+	return apitypes.NewAccessExplanationDesc(party.getId(), resource.getId(), actionName,
+		mask[action], reason, partyDescs, stepDescs), nil
+}
+
+/*******************************************************************************
+ * Return a phrase that identifies one of the parties returned by
+ * getMembershipChains, and how the first of those parties belongs to it.
+ */
+func describeParty(parties []Party, chains map[string][]string, partyId string) string {
+	
+	for i, p := range parties {
+		if p.getId() != partyId { continue }
+		if i == 0 { return p.getName() }
+		var phrase = "group " + p.getName()
+		if len(chains[partyId]) > 0 {
+			phrase = phrase + " (by way of " + strings.Join(chains[partyId], ", ") + ")"
+		}
+		return phrase
+	}
+	return partyId
+}
+
+/*******************************************************************************
+ * Return the ACL entry with the specified Id, or nil if there is no such object,
+ * as when a resource still lists the Id of an entry that has been deleted.
+ */
+func getACLEntryIfExists(dbClient DBClient, entryId string) (ACLEntry, error) {
+	var obj PersistObj
+	var err error
+	obj, err = dbClient.getPersistentObjectIfExists(entryId)
+	if err != nil { return nil, err }
+	if obj == nil { return nil, nil }
+	var entry, isType = obj.(ACLEntry)
+	if ! isType { return nil, utilities.ConstructServerError(fmt.Sprintf(
+		"Internal error: obj with Id %s is not an ACLEntry", entryId))
+	}
+	return entry, nil
+}
+
+/*******************************************************************************
+ * Return each party that has at least one access mode for the specified
+ * resource, together with the party's effective access modes. The candidates
+ * are the parties that have an ACL entry for the resource or for a resource that
+ * contains it, and the users and groups that belong to those parties, directly
+ * or indirectly.
+ */
+func getPartiesWithAccess(dbClient DBClient, resource Resource) ([]Party, [][]bool, error) {
+	
+	var lineage []Resource
+	var err error
+	lineage, err = getResourceLineage(dbClient, resource)
+	if err != nil { return nil, nil, err }
+	
+	// Identify the candidates.
+	var pendingIds = make([]string, 0)
+	for _, r := range lineage {
+		for _, entryId := range r.getACLEntryIds() {
+			var entry ACLEntry
+			entry, err = getACLEntryIfExists(dbClient, entryId)
+			if err != nil { return nil, nil, err }
+			if entry == nil { continue }  // dangling entry Id
+			pendingIds = append(pendingIds, entry.getPartyId())
+		}
+	}
+	var visited = make(map[string]bool)
+	var candidates = make([]Party, 0)
+	for len(pendingIds) > 0 {
+		var id = pendingIds[0]
+		pendingIds = pendingIds[1:]
+		if visited[id] { continue }
+		visited[id] = true
+		var party Party
+		party, err = dbClient.getParty(id)
+		if err != nil { return nil, nil, err }
+		if party == nil { continue }
+		candidates = append(candidates, party)
+		if group, isGroup := party.(Group); isGroup {
+			pendingIds = append(pendingIds, group.getMemberGroupIds()...)
+			pendingIds = append(pendingIds, group.getUserObjIds()...)
+		}
+	}
+	
+	// Retain those that have some access mode.
+	var parties = make([]Party, 0)
+	var masks = make([][]bool, 0)
+	for _, candidate := range candidates {
+		var effectiveParties []Party
+		effectiveParties, _, err = getMembershipChains(dbClient, candidate)
+		if err != nil { return nil, nil, err }
+		var mask []bool
+		mask, err = getEffectiveMask(dbClient, effectiveParties, lineage)
+		if err != nil { return nil, nil, err }
+		for _, allowed := range mask {
+			if allowed {
+				parties = append(parties, candidate)
+				masks = append(masks, mask)
+				break
+			}
+		}
+	}
+	return parties, masks, nil
+}
+
+/*******************************************************************************
+ * Return each resource for which the specified user has at least one access
+ * mode, keyed on object Id. This applies the same rules as authorized: an ACL
+ * entry of the user or of one of the user's groups grants access to the
+ * entry's resource and to every resource that it contains. Objects are loaded
+ * in batches, one batch per level of the resource hierarchy.
+ */
+func getAccessibleResources(dbClient DBClient, user User) (map[string]Resource, error) {
+	
+	var parties []Party
+	var err error
+	parties, err = getEffectiveParties(dbClient, user)
+	if err != nil { return nil, err }
+	var entryIds = make([]string, 0)
+	for _, party := range parties {
+		entryIds = append(entryIds, party.getACLEntryIds()...)
+	}
+	
+	var entryObjs []PersistObj
+	entryObjs, err = dbClient.getPersistentObjects(entryIds)
+	if err != nil { return nil, err }
+	var entriesByResourceId = make(map[string][]ACLEntry)
+	var resourceIds = make([]string, 0)
+	var now = time.Now()
+	for _, obj := range entryObjs {
+		var entry ACLEntry
+		var isType bool
+		entry, isType = obj.(ACLEntry)
+		if ! isType { return nil, utilities.ConstructServerError(
+			"Internal error: object is an unexpected type") }
+		if entry.hasExpired(now) { continue }
+		var resourceId = entry.getResourceId()
+		entriesByResourceId[resourceId] = append(entriesByResourceId[resourceId], entry)
+		for _, allowed := range entry.getPermissionMask() {
+			if allowed {
+				resourceIds = append(resourceIds, resourceId)
+				break
+			}
+		}
+	}
+	
+	// Find the candidates: the resources that are granted directly, and then,
+	// level by level, the resources that they contain.
+	var candidates = make(map[string]Resource)
+	for len(resourceIds) > 0 {
+		var ids = make([]string, 0)
+		for _, id := range resourceIds {
+			if _, found := candidates[id]; ! found { ids = append(ids, id) }
+		}
+		var resources []Resource
+		resources, err = getResources(dbClient, ids)
+		if err != nil { return nil, err }
+		resourceIds = make([]string, 0)
+		for _, resource := range resources {
+			if _, found := candidates[resource.getId()]; found { continue }
+			candidates[resource.getId()] = resource
+			resourceIds = append(resourceIds, getChildResourceIds(resource)...)
+		}
+	}
+	
+	// Retain the candidates for which a mode remains after denials are applied.
+	var masks = make(map[string][]bool)
+	var accessible = make(map[string]Resource)
+	for id, resource := range candidates {
+		var mask []bool
+		mask, err = getEffectiveMaskFromEntries(dbClient, resource, candidates,
+			entriesByResourceId, masks)
+		if err != nil { return nil, err }
+		for _, allowed := range mask {
+			if allowed {
+				accessible[id] = resource
+				break
+			}
+		}
+	}
+	
+	return accessible, nil
+}
+
+/*******************************************************************************
+ * Return the access modes that result from applying the specified entries to
+ * the resource and to each resource that contains it. Resources are obtained from
+ * the specified map if present, and results are memoized in masks.
+ */
+func getEffectiveMaskFromEntries(dbClient DBClient, resource Resource,
+	resources map[string]Resource, entriesByResourceId map[string][]ACLEntry,
+	masks map[string][]bool) ([]bool, error) {
+	
+	if mask, found := masks[resource.getId()]; found { return mask, nil }
+	
+	var inherited = make([]bool, NumberOfAccessModes)
+	var parentId = resource.getParentId()
+	if parentId != "" {
+		var parent = resources[parentId]
+		var err error
+		if parent == nil {
 			parent, err = dbClient.getResource(parentId)
-			if err != nil { return false, err }
-			var parentHasAccess bool
-			parentHasAccess, err = authService.partyHasAccess(dbClient, party, actionMask, parent)
-			if err != nil { return false, err }
-			if parentHasAccess { return true, nil }
+			if err != nil { return nil, err }
+			resources[parentId] = parent
 		}
-		
-		groupIndex++
-		if groupIndex == len(groupIds) { return false, nil }
+		masks[resource.getId()] = inherited  // guards against a containment cycle
+		inherited, err = getEffectiveMaskFromEntries(dbClient, parent, resources,
+			entriesByResourceId, masks)
+		if err != nil { return nil, err }
+	}
+	var mask = applyACLEntries(inherited, entriesByResourceId[resource.getId()])
+	masks[resource.getId()] = mask
+	return mask, nil
+}
+
+/*******************************************************************************
+ * Return the access modes that the parties have for the first resource of the
+ * lineage, as returned by getResourceLineage.
+ */
+func getEffectiveMask(dbClient DBClient, parties []Party, lineage []Resource) ([]bool, error) {
+	
+	var mask = make([]bool, NumberOfAccessModes)
+	for i := len(lineage)-1; i >= 0; i-- {  // from the realm down to the resource...
+		var entries []ACLEntry
+		var err error
+		entries, err = getApplicableACLEntries(dbClient, parties, lineage[i])
+		if err != nil { return nil, err }
+		mask = applyACLEntries(mask, entries)
+	}
+	return mask, nil
+}
+
+/*******************************************************************************
+ * Return the unexpired ACL entries that the specified parties have for the
+ * resource. Do not include the entries for resources that contain the resource.
+ */
+func getApplicableACLEntries(dbClient DBClient, parties []Party,
+	resource Resource) ([]ACLEntry, error) {
+	
+	var entries = make([]ACLEntry, 0)
+	var now = time.Now()
+	for _, party := range parties {
+		var entry ACLEntry
 		var err error
-		party, err = dbClient.getParty(groupIds[groupIndex])  // check next group
-		if err != nil { return false, err }
+		entry, err = party.getACLEntryForResourceId(dbClient, resource.getId())
+		if err != nil { return nil, err }
+		if (entry != nil) && (! entry.hasExpired(now)) { entries = append(entries, entry) }
 	}
-	return false, nil  // no access rights found
+	return entries, nil
+}
+
+/*******************************************************************************
+ * Combine the access modes that a resource inherits from the resource that
+ * contains it with the ACL entries for the resource itself. For each mode, a
+ * denial by any of the entries removes the mode; otherwise, a grant by any of
+ * the entries adds it; otherwise, the inherited value applies.
+ */
+func applyACLEntries(inherited []bool, entries []ACLEntry) []bool {
+	
+	var mask = make([]bool, len(inherited))
+	for mode, _ := range mask {
+		var granted, denied bool
+		for _, entry := range entries {
+			var permissionMask = entry.getPermissionMask()
+			var denyMask = entry.getDenyMask()
+			if (mode < len(denyMask)) && denyMask[mode] { denied = true }
+			if (mode < len(permissionMask)) && permissionMask[mode] { granted = true }
+		}
+		if denied {
+			mask[mode] = false
+		} else if granted {
+			mask[mode] = true
+		} else {
+			mask[mode] = inherited[mode]
+		}
+	}
+	return mask
 }
 
 /*******************************************************************************
@@ -281,41 +750,6 @@ func (authSvc *AuthService) compareHashValues(h1, h2 []byte) bool {
 /***************************** Internal Functions ******************************/
 
 
-/*******************************************************************************
- * Return true if the party has the right implied by the actionMask, for
- * the specified Resource, based on the ACLEntries that the resource has. Do not
- * attempt to determine if the resource''s owning Resource has applicable ACLEntries.
- * At most one elemente of the actionMask may be true.
- */
-func (authSvc *AuthService) partyHasAccess(dbClient DBClient, party Party,
-	actionMask []bool, resource Resource) (bool, error) {
-	
-	// Discover which field of the action mask is set.
-	var action int = -1
-	for i, entry := range actionMask {
-		if entry {
-			if action != -1 { return false, utilities.ConstructUserError("More than one field set in action mask") }
-			action = i
-		}
-	}
-	if action == -1 { return false, nil }  // no action mask fields were set.
-	
-	var entries []string = party.getACLEntryIds()
-	for _, entryId := range entries {  // for each of the party's ACL entries...
-		
-		var entry ACLEntry
-		var err error
-		entry, err = dbClient.getACLEntry(entryId)
-		if err != nil { return false, err }
-		
-		if entry.getResourceId() == resource.getId() {  // if the entry references the resource,
-			var mask []bool = entry.getPermissionMask()
-			if mask[action] { return true, nil }  // party has access to the resource
-		}
-	}
-	return false, nil
-}
-
 /*******************************************************************************
  * Returns the "SessionId" cookie value, or "" if there is none.
  * Used by authenticateRequestCookie.
@@ -344,7 +778,9 @@ func getSessionIdFromCookie(httpReq *http.Request) string {
  */
 func (authSvc *AuthService) identifySession(sessionId string) *apitypes.SessionToken {
 	
+	authSvc.sessionLock.Lock()
 	var credentials *apitypes.Credentials = authSvc.Sessions[sessionId]
+	authSvc.sessionLock.Unlock()
 	
 	if credentials == nil {
 		fmt.Println("No session found for session id", sessionId)
@@ -374,6 +810,17 @@ func (authSvc *AuthService) validateSessionId(sessionId string) bool {
 	return untrustedHash == fmt.Sprintf("%x", actualSaltedHashBytes)
 }
 
+/*******************************************************************************
+ * Return the time at which the specified session id (or token) was created by
+ * createUniqueSessionId. The id must be valid.
+ */
+func (authSvc *AuthService) getSessionCreationTime(sessionId string) time.Time {
+	
+	var nanoseconds, err = strconv.ParseInt(strings.Split(sessionId, ":")[0], 10, 64)
+	if err != nil { return time.Time{} }
+	return time.Unix(0, nanoseconds)
+}
+
 /*******************************************************************************
  * Return a session id that is guaranteed to be unique, and that is completely
  * opaque and unforgeable. See also validateSessionId.
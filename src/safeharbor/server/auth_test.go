@@ -0,0 +1,422 @@
+package server
+
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	
+	"safeharbor/apitypes"
+)
+
+/*******************************************************************************
+ * These tests pin down how access is inherited through the resource hierarchy,
+ * realm -> repo -> Dockerfile/image/scan config/flag, and check that authorized
+ * and the getMy* listings (getAccessibleResources) agree. They use an in-memory
+ * database, and so do not need redis.
+ */
+
+type inheritanceFixture struct {
+	*testDB
+}
+
+var allActionMasks = [][]bool{ apitypes.CreateInMask, apitypes.ReadMask,
+	apitypes.WriteMask, apitypes.ExecuteMask, apitypes.DeleteMask }
+
+func Test_RealmEntryGrantsAccessToEveryResourceInTheRealm(testContext *testing.T) {
+	
+	var f = newInheritanceFixture(testContext)
+	f.grant(testContext, f.user, f.realm, apitypes.ReadMask)
+	
+	for _, resource := range []Resource{ f.realm, f.repo, f.otherRepo, f.dockerfile,
+		f.flag, f.otherDockerfile } {
+		f.expectAccess(testContext, resource, apitypes.ReadMask, true)
+		f.expectAccess(testContext, resource, apitypes.WriteMask, false)
+	}
+	f.expectListingAgrees(testContext)
+}
+
+func Test_RepoEntryGrantsAccessOnlyWithinTheRepo(testContext *testing.T) {
+	
+	var f = newInheritanceFixture(testContext)
+	f.grant(testContext, f.user, f.repo, apitypes.WriteMask)
+	
+	f.expectAccess(testContext, f.repo, apitypes.WriteMask, true)
+	f.expectAccess(testContext, f.dockerfile, apitypes.WriteMask, true)
+	f.expectAccess(testContext, f.flag, apitypes.WriteMask, true)
+	f.expectAccess(testContext, f.realm, apitypes.WriteMask, false)
+	f.expectAccess(testContext, f.otherRepo, apitypes.WriteMask, false)
+	f.expectAccess(testContext, f.otherDockerfile, apitypes.WriteMask, false)
+	f.expectListingAgrees(testContext)
+}
+
+func Test_LeafEntryDoesNotGrantAccessToItsContainers(testContext *testing.T) {
+	
+	var f = newInheritanceFixture(testContext)
+	f.grant(testContext, f.user, f.dockerfile, apitypes.ExecuteMask)
+	
+	f.expectAccess(testContext, f.dockerfile, apitypes.ExecuteMask, true)
+	f.expectAccess(testContext, f.flag, apitypes.ExecuteMask, false)
+	f.expectAccess(testContext, f.repo, apitypes.ExecuteMask, false)
+	f.expectAccess(testContext, f.realm, apitypes.ExecuteMask, false)
+	f.expectListingAgrees(testContext)
+}
+
+func Test_GrantsAreCombinedAcrossLevels(testContext *testing.T) {
+	
+	var f = newInheritanceFixture(testContext)
+	f.grant(testContext, f.user, f.realm, apitypes.ReadMask)
+	f.grant(testContext, f.user, f.repo, apitypes.WriteMask)
+	
+	f.expectAccess(testContext, f.dockerfile, apitypes.ReadMask, true)
+	f.expectAccess(testContext, f.dockerfile, apitypes.WriteMask, true)
+	f.expectAccess(testContext, f.otherDockerfile, apitypes.ReadMask, true)
+	f.expectAccess(testContext, f.otherDockerfile, apitypes.WriteMask, false)
+	f.expectListingAgrees(testContext)
+}
+
+func Test_GroupEntriesAreInheritedByMembersOfNestedGroups(testContext *testing.T) {
+	
+	var f = newInheritanceFixture(testContext)
+	var outer = f.createGroup(testContext, "outer")
+	var inner = f.createGroup(testContext, "inner")
+	var err = outer.addMemberGroup(f.client, inner)
+	if err != nil { testContext.Fatal(err) }
+	err = inner.addUserId(f.client, f.user.getId())
+	if err != nil { testContext.Fatal(err) }
+	f.grant(testContext, outer, f.realm, apitypes.ReadMask)
+	
+	f.expectAccess(testContext, f.dockerfile, apitypes.ReadMask, true)
+	f.expectAccess(testContext, f.dockerfile, apitypes.WriteMask, false)
+	f.expectListingAgrees(testContext)
+	
+	// Membership may not be circular.
+	err = inner.addMemberGroup(f.client, outer)
+	if err == nil { testContext.Error("Expected circular group membership to be rejected") }
+}
+
+func Test_DenialOverridesInheritedGrant(testContext *testing.T) {
+	
+	var f = newInheritanceFixture(testContext)
+	f.grant(testContext, f.user, f.realm, apitypes.ReadMask)
+	f.deny(testContext, f.user, f.repo, apitypes.ReadMask)
+	
+	f.expectAccess(testContext, f.realm, apitypes.ReadMask, true)
+	f.expectAccess(testContext, f.repo, apitypes.ReadMask, false)
+	f.expectAccess(testContext, f.dockerfile, apitypes.ReadMask, false)
+	f.expectAccess(testContext, f.otherRepo, apitypes.ReadMask, true)
+	f.expectAccess(testContext, f.otherDockerfile, apitypes.ReadMask, true)
+	f.expectListingAgrees(testContext)
+}
+
+func Test_CloserGrantOverridesInheritedDenial(testContext *testing.T) {
+	
+	var f = newInheritanceFixture(testContext)
+	f.grant(testContext, f.user, f.realm, apitypes.ReadMask)
+	f.deny(testContext, f.user, f.repo, apitypes.ReadMask)
+	f.grant(testContext, f.user, f.dockerfile, apitypes.ReadMask)
+	
+	f.expectAccess(testContext, f.dockerfile, apitypes.ReadMask, true)
+	f.expectAccess(testContext, f.flag, apitypes.ReadMask, false)
+	f.expectListingAgrees(testContext)
+}
+
+func Test_DenialBeatsGrantAtTheSameLevel(testContext *testing.T) {
+	
+	var f = newInheritanceFixture(testContext)
+	var group = f.createGroup(testContext, "contractors")
+	var err = group.addUserId(f.client, f.user.getId())
+	if err != nil { testContext.Fatal(err) }
+	f.grant(testContext, f.user, f.repo, apitypes.WriteMask)
+	f.deny(testContext, group, f.repo, apitypes.WriteMask)
+	
+	f.expectAccess(testContext, f.repo, apitypes.WriteMask, false)
+	f.expectAccess(testContext, f.dockerfile, apitypes.WriteMask, false)
+	f.expectListingAgrees(testContext)
+}
+
+func Test_ChangingARoleUpdatesItsAssignments(testContext *testing.T) {
+	
+	var f = newInheritanceFixture(testContext)
+	var role, err = f.client.dbCreateRole(f.realm.getId(), "Auditor", "",
+		append([]bool{}, apitypes.ReadMask...))
+	if err != nil { testContext.Fatal(err) }
+	var entry ACLEntry
+	entry, err = f.client.setAccess(f.repo, f.user, make([]bool, NumberOfAccessModes))
+	if err != nil { testContext.Fatal(err) }
+	err = entry.setRole(f.client, role)
+	if err != nil { testContext.Fatal(err) }
+	f.expectAccess(testContext, f.dockerfile, apitypes.ReadMask, true)
+	f.expectAccess(testContext, f.dockerfile, apitypes.WriteMask, false)
+	
+	err = role.setDefinition(f.client, "", append([]bool{}, apitypes.WriteMask...))
+	if err != nil { testContext.Fatal(err) }
+	f.expectAccess(testContext, f.dockerfile, apitypes.ReadMask, false)
+	f.expectAccess(testContext, f.dockerfile, apitypes.WriteMask, true)
+	if entry.asPermissionDesc().RoleName != "Auditor" {
+		testContext.Error("Expected the permission to report the role Auditor")
+	}
+	
+	// A role that is in use may not be deleted.
+	err = f.realm.deleteRole(f.client, role)
+	if err == nil { testContext.Error("Expected deletion of an assigned role to be rejected") }
+}
+
+func Test_ChangingARoleKeepsTheDenialsOfItsAssignments(testContext *testing.T) {
+	
+	var f = newInheritanceFixture(testContext)
+	var role, err = f.client.dbCreateRole(f.realm.getId(), "Auditor", "",
+		append([]bool{}, apitypes.ReadMask...))
+	if err != nil { testContext.Fatal(err) }
+	var entry ACLEntry
+	entry, err = f.client.setAccess(f.repo, f.user, make([]bool, NumberOfAccessModes))
+	if err != nil { testContext.Fatal(err) }
+	err = entry.addDenyMask(f.client, append([]bool{}, apitypes.WriteMask...))
+	if err != nil { testContext.Fatal(err) }
+	err = entry.setRole(f.client, role)
+	if err != nil { testContext.Fatal(err) }
+	
+	// Widening the role does not grant a mode that the entry denies.
+	var mask = make([]bool, NumberOfAccessModes)
+	for i := range mask { mask[i] = apitypes.ReadMask[i] || apitypes.WriteMask[i] }
+	err = role.setDefinition(f.client, "", mask)
+	if err != nil { testContext.Fatal(err) }
+	f.expectAccess(testContext, f.dockerfile, apitypes.ReadMask, true)
+	f.expectAccess(testContext, f.dockerfile, apitypes.WriteMask, false)
+	if (entry.getRoleName() != "Auditor") || (len(role.getACLEntryIds()) != 1) {
+		testContext.Error("Expected the entry to remain assigned to the role")
+	}
+}
+
+func Test_ExplanationAgreesWithAuthorization(testContext *testing.T) {
+	
+	var f = newInheritanceFixture(testContext)
+	var outer = f.createGroup(testContext, "outer")
+	var inner = f.createGroup(testContext, "inner")
+	var err = outer.addMemberGroup(f.client, inner)
+	if err != nil { testContext.Fatal(err) }
+	err = inner.addUserId(f.client, f.user.getId())
+	if err != nil { testContext.Fatal(err) }
+	f.grant(testContext, outer, f.realm, apitypes.ReadMask)
+	f.deny(testContext, f.user, f.otherRepo, apitypes.ReadMask)
+	
+	for _, resource := range []Resource{ f.realm, f.dockerfile, f.otherDockerfile } {
+		var explanation, err = explainPartyAccess(f.client, f.user, resource, int(apitypes.CanRead), false)
+		if err != nil { testContext.Fatal(err) }
+		if explanation.Granted != f.isAuthorized(testContext, resource, apitypes.ReadMask) {
+			testContext.Errorf("%s: explanation disagrees with authorized: %s",
+				resource.getName(), explanation.Reason)
+		}
+	}
+	
+	// The listing for a resource names the groups and the user.
+	var parties []Party
+	parties, _, err = getPartiesWithAccess(f.client, f.dockerfile)
+	if err != nil { testContext.Fatal(err) }
+	if len(parties) != 3 { testContext.Errorf("Expected 3 parties with access, found %d", len(parties)) }
+	parties, _, err = getPartiesWithAccess(f.client, f.otherDockerfile)
+	if err != nil { testContext.Fatal(err) }
+	for _, party := range parties {
+		if party.getId() == f.user.getId() { testContext.Error("Expected the denied user not to be listed") }
+	}
+}
+
+func Test_AccessReviewSkipsDanglingEntryIds(testContext *testing.T) {
+	
+	var f = newInheritanceFixture(testContext)
+	f.grant(testContext, f.user, f.repo, apitypes.ReadMask)
+	var other = f.createGroup(testContext, "others")
+	var entry, err = f.client.addAccess(f.repo, other, append([]bool{}, apitypes.ReadMask...))
+	if err != nil { testContext.Fatal(err) }
+	
+	// Delete the entry's object, but leave its Id in the repo's list.
+	err = f.client.deleteObject(entry)
+	if err != nil { testContext.Fatal(err) }
+	var parties []Party
+	parties, _, err = getPartiesWithAccess(f.client, f.dockerfile)
+	if err != nil { testContext.Fatal(err) }
+	if (len(parties) != 1) || (parties[0].getId() != f.user.getId()) {
+		testContext.Errorf("Expected only the user to have access, but found %d parties", len(parties))
+	}
+}
+
+func Test_DeniedUserMayHaveTheirAccessExplained(testContext *testing.T) {
+	
+	var f = newInheritanceFixture(testContext)
+	f.server.Authorize = true
+	f.deny(testContext, f.user, f.repo, apitypes.ReadMask)
+	var sessionToken = f.server.authService.createSession(apitypes.NewCredentials(f.user.getUserId(), ""))
+	
+	var response = explainAccess(f.client, sessionToken, url.Values{
+		"ResourceId": { f.dockerfile.getId() }, "Action": { "Read" } }, nil)
+	var explanation, isType = response.(*apitypes.AccessExplanationDesc)
+	if ! isType { testContext.Fatalf("Expected an explanation, but got %s", response.AsJSON()) }
+	if (explanation.PartyId != f.user.getId()) || explanation.Granted {
+		testContext.Errorf("Expected the user to be told of the denial: %s", explanation.Reason)
+	}
+	
+	// The user may not read the resource, so its lineage is not named.
+	if strings.Contains(explanation.Reason, f.repo.getName()) {
+		testContext.Errorf("Expected the reason not to name the repo: %s", explanation.Reason)
+	}
+	for _, step := range explanation.Steps {
+		if step.ResourceName != "" { testContext.Errorf("Expected %s not to be named", step.ResourceId) }
+	}
+	
+	var other = f.createGroup(testContext, "other")
+	response = explainAccess(f.client, sessionToken, url.Values{ "PartyId": { other.getId() },
+		"ResourceId": { f.dockerfile.getId() }, "Action": { "Read" } }, nil)
+	if _, isType = response.(*apitypes.FailureDesc); ! isType {
+		testContext.Error("Expected a question about another party's access to be refused")
+	}
+}
+
+func Test_ExpiredEntriesHaveNoEffectAndAreSwept(testContext *testing.T) {
+	
+	var f = newInheritanceFixture(testContext)
+	f.grant(testContext, f.user, f.realm, apitypes.ReadMask)
+	var entry, err = f.client.addAccess(f.repo, f.user, append([]bool{}, apitypes.WriteMask...))
+	if err != nil { testContext.Fatal(err) }
+	err = entry.setExpiry(f.client, time.Now().Add(-time.Minute), f.user.getId())
+	if err != nil { testContext.Fatal(err) }
+	
+	f.expectAccess(testContext, f.repo, apitypes.WriteMask, false)
+	f.expectAccess(testContext, f.repo, apitypes.ReadMask, true)
+	f.expectListingAgrees(testContext)
+	
+	var count int
+	count, err = deleteExpiredACLEntries(f.client, f.realm.getId(), time.Now())
+	if err != nil { testContext.Fatal(err) }
+	if count != 1 { testContext.Errorf("Expected 1 expired entry to be deleted, but %d were", count) }
+	if len(f.repo.getACLEntryIds()) != 0 { testContext.Error("Expected the expired entry to be removed") }
+	if len(f.user.getEventIds()) != 1 { testContext.Error("Expected the grantor to have an expiry event") }
+}
+
+func Test_AcceptedInvitationGrantsCrossRealmAccessUntilRevoked(testContext *testing.T) {
+	
+	var f = newInheritanceFixture(testContext)
+	var realmInfo, err = apitypes.NewRealmInfo("partnerrealm", "Partner Organization", "")
+	if err != nil { testContext.Fatal(err) }
+	var partnerRealm Realm
+	partnerRealm, err = f.client.dbCreateRealm(realmInfo, "admin")
+	if err != nil { testContext.Fatal(err) }
+	var partner User
+	partner, err = f.client.dbCreateUser("partner", "Pat Partner", "pat@example.com",
+		"password", partnerRealm.getId())
+	if err != nil { testContext.Fatal(err) }
+	
+	// An invitation to a user who does not exist is made like any other, but
+	// cannot be accepted.
+	var invitation Invitation
+	invitation, err = f.client.dbCreateInvitation(f.repo.getId(), f.user.getId(), partnerRealm.getId(),
+		"nobody", "", "", append([]bool{}, apitypes.ReadMask...))
+	if err != nil { testContext.Fatal(err) }
+	_, err = invitation.accept(f.client)
+	if (err == nil) || (invitation.getStatus() != InvitationPending) {
+		testContext.Error("Expected an invitation to a user who does not exist not to be accepted")
+	}
+	
+	invitation, err = f.client.dbCreateInvitation(f.repo.getId(), f.user.getId(), partnerRealm.getId(),
+		"", "pat@example.com", "", append([]bool{}, apitypes.ReadMask...))
+	if err != nil { testContext.Fatal(err) }
+	var entry ACLEntry
+	entry, err = invitation.accept(f.client)
+	if err != nil { testContext.Fatal(err) }
+	if entry.getInvitationId() != invitation.getId() { testContext.Error("Expected the entry to be cross-realm") }
+	if invitation.getInviteePartyId() != partner.getId() { testContext.Error("Expected the invitee to be identified") }
+	
+	var sessionToken = apitypes.NewSessionToken("session", partner.getUserId())
+	var authorized bool
+	authorized, err = f.server.authService.authorized(f.client, sessionToken,
+		apitypes.ReadMask, f.dockerfile.getId())
+	if err != nil { testContext.Fatal(err) }
+	if ! authorized { testContext.Error("Expected the invitee to be able to read the repo's Dockerfile") }
+	
+	// A second invitation adds to the entry, but not what the entry denies;
+	// revoking it removes only what it added.
+	err = entry.addDenyMask(f.client, []bool{ false, false, false, false, true })
+	if err != nil { testContext.Fatal(err) }
+	var writeInvitation Invitation
+	writeInvitation, err = f.client.dbCreateInvitation(f.repo.getId(), f.user.getId(), partnerRealm.getId(),
+		"partner", "", "", []bool{ false, true, true, false, true })
+	if err != nil { testContext.Fatal(err) }
+	entry, err = writeInvitation.accept(f.client)
+	if err != nil { testContext.Fatal(err) }
+	if (! entry.getPermissionMask()[2]) || entry.getPermissionMask()[4] || (! entry.getDenyMask()[4]) {
+		testContext.Errorf("Expected write to be granted, and delete to remain denied: %s",
+			entry.asPermissionDesc().AsJSON())
+	}
+	err = writeInvitation.revoke(f.client)
+	if err != nil { testContext.Fatal(err) }
+	authorized, err = f.server.authService.authorized(f.client, sessionToken,
+		apitypes.WriteMask, f.dockerfile.getId())
+	if err != nil { testContext.Fatal(err) }
+	if authorized { testContext.Error("Expected revocation to remove the write access that it granted") }
+	authorized, err = f.server.authService.authorized(f.client, sessionToken,
+		apitypes.ReadMask, f.dockerfile.getId())
+	if err != nil { testContext.Fatal(err) }
+	if ! authorized { testContext.Error("Expected revocation to leave the read access of the other invitation") }
+	
+	err = invitation.revoke(f.client)
+	if err != nil { testContext.Fatal(err) }
+	authorized, err = f.server.authService.authorized(f.client, sessionToken,
+		apitypes.ReadMask, f.dockerfile.getId())
+	if err != nil { testContext.Fatal(err) }
+	if authorized { testContext.Error("Expected revocation to remove the invitee's access") }
+}
+
+func Test_NoEntriesGrantNoAccess(testContext *testing.T) {
+	
+	var f = newInheritanceFixture(testContext)
+	for _, resource := range []Resource{ f.realm, f.repo, f.dockerfile, f.flag } {
+		for _, mask := range allActionMasks {
+			f.expectAccess(testContext, resource, mask, false)
+		}
+	}
+	f.expectListingAgrees(testContext)
+}
+
+func newInheritanceFixture(testContext *testing.T) *inheritanceFixture {
+	return &inheritanceFixture{ newTestDB(testContext) }
+}
+
+func (f *inheritanceFixture) isAuthorized(testContext *testing.T, resource Resource,
+	mask []bool) bool {
+	var sessionToken = apitypes.NewSessionToken("session", f.user.getUserId())
+	var authorized, err = f.server.authService.authorized(f.client, sessionToken,
+		mask, resource.getId())
+	if err != nil { testContext.Fatal(err) }
+	return authorized
+}
+
+func (f *inheritanceFixture) expectAccess(testContext *testing.T, resource Resource,
+	mask []bool, expected bool) {
+	if f.isAuthorized(testContext, resource, mask) != expected {
+		testContext.Errorf("For %s with mask %v, expected authorized to return %v",
+			resource.getName(), mask, expected)
+	}
+}
+
+/*******************************************************************************
+ * Verify that getAccessibleResources, on which the getMy* handlers are based,
+ * lists exactly those resources for which authorized permits at least one
+ * access mode.
+ */
+func (f *inheritanceFixture) expectListingAgrees(testContext *testing.T) {
+	
+	var accessible, err = getAccessibleResources(f.client, f.user)
+	if err != nil { testContext.Fatal(err) }
+	for _, resource := range []Resource{ f.realm, f.repo, f.otherRepo, f.dockerfile,
+		f.flag, f.otherDockerfile } {
+		var authorizedForSomeMode = false
+		for _, mask := range allActionMasks {
+			if f.isAuthorized(testContext, resource, mask) { authorizedForSomeMode = true }
+		}
+		var _, listed = accessible[resource.getId()]
+		if listed != authorizedForSomeMode {
+			testContext.Errorf("%s: listed=%v, but authorized for some mode=%v",
+				resource.getName(), listed, authorizedForSomeMode)
+		}
+	}
+}